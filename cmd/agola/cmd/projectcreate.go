@@ -42,6 +42,7 @@ type projectCreateOptions struct {
 	skipSSHHostKeyCheck bool
 	visibility          string
 	passVarsToForkedPR  bool
+	validateConfig      bool
 }
 
 var projectCreateOpts projectCreateOptions
@@ -56,6 +57,7 @@ func init() {
 	flags.StringVar(&projectCreateOpts.parentPath, "parent", "", `parent project group path (i.e "org/org01" for root project group in org01, "user/user01/group01/subgroub01") or project group id where the project should be created`)
 	flags.StringVar(&projectCreateOpts.visibility, "visibility", "public", `project visibility (public or private)`)
 	flags.BoolVar(&projectCreateOpts.passVarsToForkedPR, "pass-vars-to-forked-pr", false, `pass variables to run even if triggered by PR from forked repo`)
+	flags.BoolVar(&projectCreateOpts.validateConfig, "validate-config", false, `fail the project creation if the repository default branch doesn't contain a valid run config`)
 
 	if err := cmdProjectCreate.MarkFlagRequired("name"); err != nil {
 		log.Fatal(err)
@@ -99,6 +101,7 @@ func projectCreate(cmd *cobra.Command, args []string) error {
 		RemoteSourceName:    projectCreateOpts.remoteSourceName,
 		SkipSSHHostKeyCheck: projectCreateOpts.skipSSHHostKeyCheck,
 		PassVarsToForkedPR:  projectCreateOpts.passVarsToForkedPR,
+		ValidateConfig:      projectCreateOpts.validateConfig,
 	}
 
 	log.Infof("creating project")
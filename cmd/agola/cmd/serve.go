@@ -67,6 +67,7 @@ type serveOptions struct {
 	components          []string
 	embeddedEtcd        bool
 	embeddedEtcdDataDir string
+	check               bool
 }
 
 var serveOpts serveOptions
@@ -78,6 +79,7 @@ func init() {
 	flags.StringSliceVar(&serveOpts.components, "components", []string{}, `list of components to start. Specify "all-base" to start all base components (excluding the executor).`)
 	flags.BoolVar(&serveOpts.embeddedEtcd, "embedded-etcd", false, "start and use an embedded etcd, only for testing purpose")
 	flags.StringVar(&serveOpts.embeddedEtcdDataDir, "embedded-etcd-data-dir", "/tmp/agola/etcd", "embedded etcd data dir, only for testing purpose")
+	flags.BoolVar(&serveOpts.check, "check", false, "check the config of the components, report all the found problems and exit without starting them")
 
 	if err := cmdServe.MarkFlagRequired("components"); err != nil {
 		log.Fatal(err)
@@ -117,6 +119,22 @@ func isComponentEnabled(name string) bool {
 	return util.StringInSlice(serveOpts.components, name)
 }
 
+func checkConfig() error {
+	c, err := config.Load(serveOpts.config)
+	if err != nil {
+		return errors.Errorf("config error: %w", err)
+	}
+	errs := config.Check(c, serveOpts.components)
+	for _, err := range errs {
+		log.Errorf("config error: %v", err)
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("config check failed: %d problems found", len(errs))
+	}
+	log.Infof("config is valid")
+	return nil
+}
+
 func serve(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 
@@ -129,6 +147,10 @@ func serve(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	if serveOpts.check {
+		return checkConfig()
+	}
+
 	c, err := config.Parse(serveOpts.config, serveOpts.components)
 	if err != nil {
 		return errors.Errorf("config error: %w", err)
@@ -14,4 +14,10 @@
 
 package cmd
 
-var Version = "No version defined at build time"
+// Version, Commit and BuildDate are set at build time using the linker
+// flags
+var (
+	Version   = "No version defined at build time"
+	Commit    = ""
+	BuildDate = ""
+)
@@ -15,6 +15,7 @@
 package common
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"net/url"
@@ -73,7 +74,28 @@ func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
 		})
 }
 
-func NewObjectStorage(c *config.ObjectStorage) (*objectstorage.ObjStorage, error) {
+// NewObjectStorage creates the object storage from its configuration. The
+// storage operations failed with transient errors or timed out will be
+// retried until ctx is done. When the configuration defines an object storage to migrate from
+// the returned storage is a MigratingStorage.
+func NewObjectStorage(ctx context.Context, logger *zap.Logger, c *config.ObjectStorage) (*objectstorage.ObjStorage, error) {
+	ost, err := newStorage(ctx, logger, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.MigrateFrom != nil {
+		oldOst, err := newStorage(ctx, logger, c.MigrateFrom)
+		if err != nil {
+			return nil, errors.Errorf("failed to create the object storage to migrate from: %w", err)
+		}
+		ost = objectstorage.NewMigratingStorage(ost, oldOst)
+	}
+
+	return objectstorage.NewObjStorage(ost, "/"), nil
+}
+
+func newStorage(ctx context.Context, logger *zap.Logger, c *config.ObjectStorage) (objectstorage.Storage, error) {
 	var (
 		err error
 		ost objectstorage.Storage
@@ -85,6 +107,9 @@ func NewObjectStorage(c *config.ObjectStorage) (*objectstorage.ObjStorage, error
 		if err != nil {
 			return nil, errors.Errorf("failed to create posix object storage: %w", err)
 		}
+		if c.ServerSideEncryption.Type != "" {
+			logger.Sugar().Warnf("server side encryption %q isn't supported by the posix object storage, the objects won't be encrypted", c.ServerSideEncryption.Type)
+		}
 	case config.ObjectStorageTypeS3:
 		// minio golang client doesn't accept an url as an endpoint
 		endpoint := c.Endpoint
@@ -100,25 +125,65 @@ func NewObjectStorage(c *config.ObjectStorage) (*objectstorage.ObjStorage, error
 				return nil, errors.Errorf("wrong s3 endpoint scheme %q (must be http or https)", u.Scheme)
 			}
 		}
-		ost, err = objectstorage.NewS3(c.Bucket, c.Location, endpoint, c.AccessKey, c.SecretAccessKey, secure)
+		s3, err := objectstorage.NewS3(c.Bucket, c.Location, endpoint, c.AccessKey, c.SecretAccessKey, secure, c.ForcePathStyle)
 		if err != nil {
 			return nil, errors.Errorf("failed to create s3 object storage: %w", err)
 		}
+		if err := s3.SetServerSideEncryption(objectstorage.ServerSideEncryptionType(c.ServerSideEncryption.Type), c.ServerSideEncryption.KMSKeyID); err != nil {
+			return nil, errors.Errorf("failed to configure s3 object storage: %w", err)
+		}
+		ost = s3
 	}
 
-	return objectstorage.NewObjStorage(ost, "/"), nil
+	// the timeout is applied to every operation attempt, so it must wrap the
+	// storage before the retries
+	if c.OperationTimeout > 0 {
+		ost = objectstorage.NewTimeoutStorage(ost, c.OperationTimeout)
+	}
+
+	maxRetries := c.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = objectstorage.DefaultMaxRetries
+	}
+	if maxRetries > 0 {
+		retryBaseDelay := c.RetryBaseDelay
+		if retryBaseDelay == 0 {
+			retryBaseDelay = objectstorage.DefaultRetryBaseDelay
+		}
+		ost = objectstorage.NewRetryStorage(ctx, ost, maxRetries, retryBaseDelay)
+	}
+
+	if c.Prefix != "" {
+		ost = objectstorage.NewPrefixStorage(ost, c.Prefix)
+	}
+
+	return ost, nil
+}
+
+// EtcdConfig returns the etcd store configuration from the service etcd
+// configuration
+func EtcdConfig(c *config.Etcd, logger *zap.Logger, prefix string) etcd.Config {
+	return etcd.Config{
+		Logger:           logger,
+		Endpoints:        c.Endpoints,
+		Prefix:           prefix,
+		CertFile:         c.TLSCertFile,
+		KeyFile:          c.TLSKeyFile,
+		CAFile:           c.TLSCAFile,
+		SkipTLSVerify:    c.TLSSkipVerify,
+		Username:         c.Username,
+		Password:         c.Password,
+		PoolSize:         c.PoolSize,
+		KeepAliveTime:    c.KeepAliveTime,
+		KeepAliveTimeout: c.KeepAliveTimeout,
+	}
 }
 
+// NewEtcd returns an etcd store with the provided prefix. The stores with the
+// same etcd configuration share the same pool of etcd clients, the store must
+// be closed when not used anymore to release its client
 func NewEtcd(c *config.Etcd, logger *zap.Logger, prefix string) (*etcd.Store, error) {
-	e, err := etcd.New(etcd.Config{
-		Logger:        logger,
-		Endpoints:     c.Endpoints,
-		Prefix:        prefix,
-		CertFile:      c.TLSCertFile,
-		KeyFile:       c.TLSKeyFile,
-		CAFile:        c.TLSCAFile,
-		SkipTLSVerify: c.TLSSkipVerify,
-	})
+	e, err := etcd.New(EtcdConfig(c, logger, prefix))
 	if err != nil {
 		return nil, errors.Errorf("failed to create etcd store: %w", err)
 	}
@@ -0,0 +1,133 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/etcd"
+	"agola.io/agola/internal/services/config"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+// writeTestCert writes a self signed certificate and its key in dir
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "agola test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestEtcdClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	t.Run("tls and auth", func(t *testing.T) {
+		c := &config.Etcd{
+			Endpoints:   "https://etcd01:2379,https://etcd02:2379",
+			TLSCertFile: certFile,
+			TLSKeyFile:  keyFile,
+			TLSCAFile:   certFile,
+			Username:    "agola",
+			Password:    "password",
+		}
+
+		cfg, err := etcd.NewClientConfig(EtcdConfig(c, logger, "configstore"))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		if diff := cmp.Diff([]string{"https://etcd01:2379", "https://etcd02:2379"}, cfg.Endpoints); diff != "" {
+			t.Fatalf("endpoints mismatch (-expected +got):\n%s", diff)
+		}
+		if cfg.TLS == nil {
+			t.Fatalf("expected tls config")
+		}
+		if len(cfg.TLS.Certificates) != 1 {
+			t.Fatalf("expected 1 client certificate, got %d", len(cfg.TLS.Certificates))
+		}
+		if cfg.TLS.RootCAs == nil {
+			t.Fatalf("expected root CAs")
+		}
+		if cfg.TLS.InsecureSkipVerify {
+			t.Fatalf("expected tls verification enabled")
+		}
+		if cfg.Username != "agola" || cfg.Password != "password" {
+			t.Fatalf("expected auth credentials, got username: %q, password: %q", cfg.Username, cfg.Password)
+		}
+	})
+
+	t.Run("plain http", func(t *testing.T) {
+		c := &config.Etcd{
+			Endpoints: "http://etcd01:2379",
+		}
+
+		cfg, err := etcd.NewClientConfig(EtcdConfig(c, logger, "configstore"))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if cfg.TLS != nil {
+			t.Fatalf("expected no tls config")
+		}
+	})
+}
@@ -130,7 +130,7 @@ func (c *WalChanges) removeChangeGroup(cgName string) {
 func (d *DataManager) applyWalChanges(ctx context.Context, walData *WalData, revision int64) error {
 	walDataFilePath := d.storageWalDataFile(walData.WalDataFileID)
 
-	walDataFile, err := d.ost.ReadObject(walDataFilePath)
+	walDataFile, err := d.ReadWalData(walData.WalDataFileID)
 	if err != nil {
 		return errors.Errorf("failed to read waldata %q: %w", walDataFilePath, err)
 	}
@@ -150,6 +150,9 @@ func (d *DataManager) applyWalChanges(ctx context.Context, walData *WalData, rev
 		if err != nil {
 			return errors.Errorf("failed to decode wal file: %w", err)
 		}
+		if err := d.MigrateAction(action); err != nil {
+			return err
+		}
 
 		d.applyWalChangesAction(ctx, action, walData.WalSequence, revision)
 	}
@@ -68,6 +68,8 @@ type DataEntry struct {
 	ID       string `json:"id,omitempty"`
 	DataType string `json:"data_type,omitempty"`
 	Data     []byte `json:"data,omitempty"`
+	// Version is the schema version of the data type of the entry data
+	Version int `json:"version,omitempty"`
 }
 
 // TODO(sgotti) this implementation could be heavily optimized to store less data in memory
@@ -118,6 +120,9 @@ func (d *DataManager) walIndex(ctx context.Context, wals []*WalData) (walIndex,
 			if err != nil {
 				return nil, errors.Errorf("failed to decode wal file: %w", err)
 			}
+			if err := d.MigrateAction(action); err != nil {
+				return nil, err
+			}
 
 			if _, ok := wimap[action.DataType]; !ok {
 				wimap[action.DataType] = map[string]*Action{}
@@ -204,7 +209,7 @@ func (d *DataManager) writeDataSnapshot(ctx context.Context, wals []*WalData) er
 	if err != nil {
 		return err
 	}
-	if err := d.ost.WriteObject(d.dataStatusPath(dataSequence), bytes.NewReader(dataStatusj), int64(len(dataStatusj)), true); err != nil {
+	if err := d.dataOst.WriteObject(d.dataStatusPath(dataSequence), bytes.NewReader(dataStatusj), int64(len(dataStatusj)), true); err != nil {
 		return err
 	}
 
@@ -216,7 +221,7 @@ func (d *DataManager) writeDataFile(ctx context.Context, buf *bytes.Buffer, size
 		return fmt.Errorf("empty data entries")
 	}
 
-	if err := d.ost.WriteObject(d.DataFilePath(dataType, dataFileID), buf, size, true); err != nil {
+	if err := d.dataOst.WriteObject(d.DataFilePath(dataType, dataFileID), buf, size, true); err != nil {
 		return err
 	}
 
@@ -224,7 +229,7 @@ func (d *DataManager) writeDataFile(ctx context.Context, buf *bytes.Buffer, size
 	if err != nil {
 		return err
 	}
-	if err := d.ost.WriteObject(d.DataFileIndexPath(dataType, dataFileID), bytes.NewReader(dataFileIndexj), int64(len(dataFileIndexj)), true); err != nil {
+	if err := d.dataOst.WriteObject(d.DataFileIndexPath(dataType, dataFileID), bytes.NewReader(dataFileIndexj), int64(len(dataFileIndexj)), true); err != nil {
 		return err
 	}
 
@@ -339,7 +344,7 @@ func (d *DataManager) writeDataType(ctx context.Context, wi walIndex, dataType s
 
 		if actionGroup.DataStatusFile != nil {
 			// TODO(sgotti) instead of reading all entries in memory decode it's contents one by one when needed
-			oldDataf, err := d.ost.ReadObject(d.DataFilePath(dataType, actionGroup.DataStatusFile.ID))
+			oldDataf, err := d.dataOst.ReadObject(d.DataFilePath(dataType, actionGroup.DataStatusFile.ID))
 			if err != nil && !objectstorage.IsNotExist(err) {
 				return nil, err
 			}
@@ -357,6 +362,10 @@ func (d *DataManager) writeDataType(ctx context.Context, wi walIndex, dataType s
 						oldDataf.Close()
 						return nil, err
 					}
+					if err := d.MigrateDataEntry(de); err != nil {
+						oldDataf.Close()
+						return nil, err
+					}
 
 					dataEntries = append(dataEntries, de)
 				}
@@ -407,6 +416,7 @@ func (d *DataManager) writeDataType(ctx context.Context, wi walIndex, dataType s
 							ID:       action.ID,
 							DataType: action.DataType,
 							Data:     action.Data,
+							Version:  action.Version,
 						}
 						if exists {
 							// replace current data entry with the action data
@@ -511,7 +521,7 @@ func (d *DataManager) Read(dataType, id string) (io.Reader, error) {
 		}
 	}
 
-	dataFileIndexf, err := d.ost.ReadObject(d.DataFileIndexPath(dataType, matchingDataFileID))
+	dataFileIndexf, err := d.dataOst.ReadObject(d.DataFileIndexPath(dataType, matchingDataFileID))
 	if err != nil {
 		return nil, err
 	}
@@ -529,7 +539,7 @@ func (d *DataManager) Read(dataType, id string) (io.Reader, error) {
 		return nil, util.NewErrNotExist(errors.Errorf("datatype %q, id %q doesn't exists", dataType, id))
 	}
 
-	dataf, err := d.ost.ReadObject(d.DataFilePath(dataType, matchingDataFileID))
+	dataf, err := d.dataOst.ReadObject(d.DataFilePath(dataType, matchingDataFileID))
 	if err != nil {
 		return nil, err
 	}
@@ -544,6 +554,9 @@ func (d *DataManager) Read(dataType, id string) (io.Reader, error) {
 		return nil, err
 	}
 	dataf.Close()
+	if err := d.MigrateDataEntry(de); err != nil {
+		return nil, err
+	}
 
 	return bytes.NewReader(de.Data), nil
 }
@@ -558,7 +571,7 @@ func (d *DataManager) GetFirstDataStatusSequences(n int) ([]*sequence.Sequence,
 
 	doneCh := make(chan struct{})
 	defer close(doneCh)
-	for object := range d.ost.List(d.storageDataDir()+"/", "", false, doneCh) {
+	for object := range d.dataOst.List(d.storageDataDir()+"/", "", false, doneCh) {
 		if object.Err != nil {
 			return nil, object.Err
 		}
@@ -595,7 +608,7 @@ func (d *DataManager) GetLastDataStatusSequences(n int) ([]*sequence.Sequence, e
 	doneCh := make(chan struct{})
 	defer close(doneCh)
 
-	for object := range d.ost.List(d.storageDataDir()+"/", "", false, doneCh) {
+	for object := range d.dataOst.List(d.storageDataDir()+"/", "", false, doneCh) {
 		if object.Err != nil {
 			return nil, object.Err
 		}
@@ -627,7 +640,7 @@ func (d *DataManager) GetLastDataStatusSequences(n int) ([]*sequence.Sequence, e
 }
 
 func (d *DataManager) GetDataStatus(dataSequence *sequence.Sequence) (*DataStatus, error) {
-	dataStatusf, err := d.ost.ReadObject(d.dataStatusPath(dataSequence))
+	dataStatusf, err := d.dataOst.ReadObject(d.dataStatusPath(dataSequence))
 	if err != nil {
 		return nil, err
 	}
@@ -675,7 +688,7 @@ func (d *DataManager) GetLastDataStatus() (*DataStatus, error) {
 }
 
 func (d *DataManager) Export(ctx context.Context, w io.Writer) error {
-	if err := d.checkpoint(ctx, true); err != nil {
+	if err := d.checkpoint(ctx, true, false); err != nil {
 		return err
 	}
 
@@ -690,7 +703,7 @@ func (d *DataManager) Export(ctx context.Context, w io.Writer) error {
 			curDataStatusFiles = curDataStatus.Files[dataType]
 		}
 		for _, dsf := range curDataStatusFiles {
-			dataf, err := d.ost.ReadObject(d.DataFilePath(dataType, dsf.ID))
+			dataf, err := d.dataOst.ReadObject(d.DataFilePath(dataType, dsf.ID))
 			if err != nil {
 				return err
 			}
@@ -808,6 +821,9 @@ func (d *DataManager) Import(ctx context.Context, r io.Reader) error {
 			return errors.Errorf("entry id %q is less or equal than previous entry id %q", de.ID, lastEntryID)
 		}
 		lastEntryID = de.ID
+		if err := d.MigrateDataEntry(de); err != nil {
+			return err
+		}
 
 		dataEntryj, err := json.Marshal(de)
 		if err != nil {
@@ -824,7 +840,7 @@ func (d *DataManager) Import(ctx context.Context, r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	if err := d.ost.WriteObject(d.dataStatusPath(dataSequence), bytes.NewReader(dataStatusj), int64(len(dataStatusj)), true); err != nil {
+	if err := d.dataOst.WriteObject(d.dataStatusPath(dataSequence), bytes.NewReader(dataStatusj), int64(len(dataStatusj)), true); err != nil {
 		return err
 	}
 
@@ -861,7 +877,7 @@ func (d *DataManager) cleanOldCheckpoints(ctx context.Context, dataStatusSequenc
 
 		doneCh := make(chan struct{})
 		defer close(doneCh)
-		for object := range d.ost.List(d.storageDataDir()+"/", "", false, doneCh) {
+		for object := range d.dataOst.List(d.storageDataDir()+"/", "", false, doneCh) {
 			if object.Err != nil {
 				return object.Err
 			}
@@ -880,7 +896,7 @@ func (d *DataManager) cleanOldCheckpoints(ctx context.Context, dataStatusSequenc
 
 			if _, ok := dataStatusPathsMap[object.Path]; !ok {
 				d.log.Infof("removing %q", object.Path)
-				if err := d.ost.DeleteObject(object.Path); err != nil {
+				if err := d.dataOst.DeleteObject(object.Path); err != nil {
 					if !objectstorage.IsNotExist(err) {
 						return err
 					}
@@ -908,7 +924,7 @@ func (d *DataManager) cleanOldCheckpoints(ctx context.Context, dataStatusSequenc
 	doneCh := make(chan struct{})
 	defer close(doneCh)
 
-	for object := range d.ost.List(d.storageDataDir()+"/", "", true, doneCh) {
+	for object := range d.dataOst.List(d.storageDataDir()+"/", "", true, doneCh) {
 		if object.Err != nil {
 			return object.Err
 		}
@@ -948,7 +964,7 @@ func (d *DataManager) cleanOldCheckpoints(ctx context.Context, dataStatusSequenc
 
 		if _, ok := files[pne]; !ok {
 			d.log.Infof("removing %q", object.Path)
-			if err := d.ost.DeleteObject(object.Path); err != nil {
+			if err := d.dataOst.DeleteObject(object.Path); err != nil {
 				if !objectstorage.IsNotExist(err) {
 					return err
 				}
@@ -19,11 +19,13 @@ import (
 	"fmt"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"agola.io/agola/internal/etcd"
 	"agola.io/agola/internal/objectstorage"
 	"agola.io/agola/internal/sequence"
+	"agola.io/agola/internal/util"
 
 	"go.uber.org/zap"
 	errors "golang.org/x/xerrors"
@@ -43,6 +45,7 @@ const (
 	DefaultEtcdPingerInterval          = 1 * time.Second
 	DefaultEtcdWalsKeepNum             = 100
 	DefaultMinCheckpointWalsNum        = 100
+	DefaultWriterLeaseTTL              = 10 * time.Second
 )
 
 var (
@@ -72,6 +75,7 @@ var (
 	etcdCheckpointLockKey          = path.Join(etcdWalBaseDir, "checkpointlock")
 	etcdWalCleanerLockKey          = path.Join(etcdWalBaseDir, "walcleanerlock")
 	etcdStorageWalCleanerLockKey   = path.Join(etcdWalBaseDir, "storagewalcleanerlock")
+	etcdWalWriterLeaseKey          = path.Join(etcdWalBaseDir, "walwriterlease")
 
 	etcdChangeGroupsDir           = path.Join(etcdWalBaseDir, "changegroups")
 	etcdChangeGroupMinRevisionKey = path.Join(etcdWalBaseDir, "changegroupsminrev")
@@ -86,32 +90,100 @@ const (
 )
 
 type DataManagerConfig struct {
-	BasePath                string
-	E                       *etcd.Store
-	OST                     *objectstorage.ObjStorage
+	BasePath string
+	E        *etcd.Store
+	OST      *objectstorage.ObjStorage
+	// WalsOST, when defined, is the object storage of the wals instead of OST
+	WalsOST *objectstorage.ObjStorage
+	// DataOST, when defined, is the object storage of the data files instead
+	// of OST
+	DataOST                 *objectstorage.ObjStorage
 	DataTypes               []string
 	EtcdWalsKeepNum         int
 	CheckpointInterval      time.Duration
 	CheckpointCleanInterval time.Duration
+	// StorageWalCleanInterval is the interval between runs of the cleaner that
+	// removes from the object storage the wals already included in a checkpoint
+	StorageWalCleanInterval time.Duration
 	// MinCheckpointWalsNum is the minimum number of wals required before doing a checkpoint
 	MinCheckpointWalsNum int
-	MaxDataFileSize      int64
-	MaintenanceMode      bool
+	// CheckpointWalsSizeThreshold is the total size in bytes of the wals data
+	// not yet checkpointed that triggers a checkpoint also if there're less
+	// than MinCheckpointWalsNum wals. When 0 only MinCheckpointWalsNum is
+	// considered
+	CheckpointWalsSizeThreshold int64
+	MaxDataFileSize             int64
+	MaintenanceMode             bool
+	// Migrations are the schema migrations of the data types, the entries of
+	// an older version are upgraded when read
+	Migrations map[string]Migrations
+	// EtcdMaxRetries and EtcdRetryBaseDelay configure the retries of the etcd
+	// operations failed while etcd is temporarily unavailable
+	EtcdMaxRetries     int
+	EtcdRetryBaseDelay time.Duration
+	// WalFlushInterval, when greater than 0, enables the batching of the
+	// flushes to the storage of the wals written concurrently: a write waits
+	// up to WalFlushInterval for other writes and then a single flush commits
+	// all of them to the storage. The write returns only after its wal has
+	// been flushed, so it's durable also if etcd data is lost, at the cost of
+	// a write latency increased up to WalFlushInterval.
+	// When 0 every write immediately tries to flush its wal but doesn't wait
+	// for a flush already in progress, so a returned write could have its
+	// wal committed only to etcd until the next sync (DefaultSyncInterval).
+	// A failed flush isn't reported as a write error since the wal is
+	// committed to etcd and will be flushed by the next sync.
+	WalFlushInterval time.Duration
+	// WalFlushMaxBatchSize is the max number of wals flushed together. A
+	// batch reaching it is flushed without waiting for WalFlushInterval.
+	// When 0 the batches size isn't limited
+	WalFlushMaxBatchSize int
+	// WalCompression is the compression of the wal data files written to
+	// the object storage. Defaults to WalCompressionNone. The wal data files
+	// are read whatever compression they've been written with.
+	WalCompression WalCompression
+	// WriterLease, when true, allows the wal writes only to the datamanager
+	// holding the etcd wal writer lease, so only a single writer can exist
+	// also if more instances believe to be the writer. The other ones will
+	// wait for the lease and their writes will fail with a misdirected
+	// request error.
+	WriterLease bool
+	// WriterLeaseTTL is the ttl of the wal writer lease: the time after
+	// which a writer that couldn't renew it (i.e. for a network partition)
+	// loses it. Defaults to DefaultWriterLeaseTTL
+	WriterLeaseTTL time.Duration
 }
 
 type DataManager struct {
-	basePath                string
-	log                     *zap.SugaredLogger
-	e                       *etcd.Store
-	ost                     *objectstorage.ObjStorage
-	changes                 *WalChanges
-	dataTypes               []string
-	etcdWalsKeepNum         int
-	checkpointInterval      time.Duration
-	checkpointCleanInterval time.Duration
-	minCheckpointWalsNum    int
-	maxDataFileSize         int64
-	maintenanceMode         bool
+	basePath                    string
+	log                         *zap.SugaredLogger
+	e                           *etcd.Store
+	walsOst                     *objectstorage.ObjStorage
+	dataOst                     *objectstorage.ObjStorage
+	changes                     *WalChanges
+	dataTypes                   []string
+	etcdWalsKeepNum             int
+	checkpointInterval          time.Duration
+	checkpointCleanInterval     time.Duration
+	storageWalCleanInterval     time.Duration
+	minCheckpointWalsNum        int
+	checkpointWalsSizeThreshold int64
+	maxDataFileSize             int64
+	maintenanceMode             bool
+	migrations                  map[string]Migrations
+	dataTypesVersions           map[string]int
+	etcdMaxRetries              int
+	etcdRetryBaseDelay          time.Duration
+	walCompression              WalCompression
+
+	etcdStatus etcdStatus
+
+	walFlusher walFlusher
+	walFlushes uint64
+
+	writerLease writerLease
+
+	lastCheckpointTime      time.Time
+	lastCheckpointTimeMutex sync.Mutex
 }
 
 func NewDataManager(ctx context.Context, logger *zap.Logger, conf *DataManagerConfig) (*DataManager, error) {
@@ -127,29 +199,92 @@ func NewDataManager(ctx context.Context, logger *zap.Logger, conf *DataManagerCo
 	if conf.CheckpointCleanInterval == 0 {
 		conf.CheckpointCleanInterval = DefaultCheckpointCleanInterval
 	}
+	if conf.StorageWalCleanInterval == 0 {
+		conf.StorageWalCleanInterval = DefaultStorageWalCleanInterval
+	}
 	if conf.MinCheckpointWalsNum == 0 {
 		conf.MinCheckpointWalsNum = DefaultMinCheckpointWalsNum
 	}
 	if conf.MinCheckpointWalsNum < 1 {
 		return nil, errors.New("minCheckpointWalsNum must be greater than 0")
 	}
+	if conf.CheckpointWalsSizeThreshold < 0 {
+		return nil, errors.New("checkpointWalsSizeThreshold must be greater or equal than 0")
+	}
 	if conf.MaxDataFileSize == 0 {
 		conf.MaxDataFileSize = DefaultMaxDataFileSize
 	}
+	if conf.EtcdMaxRetries == 0 {
+		conf.EtcdMaxRetries = etcd.DefaultMaxRetries
+	}
+	if conf.EtcdMaxRetries < 0 {
+		return nil, errors.New("etcdMaxRetries must be greater or equal than 0")
+	}
+	if conf.EtcdRetryBaseDelay == 0 {
+		conf.EtcdRetryBaseDelay = etcd.DefaultRetryBaseDelay
+	}
+	if conf.WalFlushInterval < 0 {
+		return nil, errors.New("walFlushInterval must be greater or equal than 0")
+	}
+	if conf.WalFlushMaxBatchSize < 0 {
+		return nil, errors.New("walFlushMaxBatchSize must be greater or equal than 0")
+	}
+	if conf.WriterLeaseTTL == 0 {
+		conf.WriterLeaseTTL = DefaultWriterLeaseTTL
+	}
+	if conf.WriterLeaseTTL < time.Second {
+		return nil, errors.New("writerLeaseTTL must be at least 1s")
+	}
+	switch conf.WalCompression {
+	case "":
+		conf.WalCompression = WalCompressionNone
+	case WalCompressionNone, WalCompressionGzip:
+	default:
+		return nil, errors.Errorf("unsupported wal compression %q", conf.WalCompression)
+	}
+	if conf.WalsOST == nil {
+		conf.WalsOST = conf.OST
+	}
+	if conf.DataOST == nil {
+		conf.DataOST = conf.OST
+	}
+	if conf.WalsOST == nil || conf.DataOST == nil {
+		return nil, errors.New("object storage undefined")
+	}
+	dataTypesVersions, err := checkMigrations(conf.Migrations)
+	if err != nil {
+		return nil, err
+	}
 
 	d := &DataManager{
-		basePath:                conf.BasePath,
-		log:                     logger.Sugar(),
-		e:                       conf.E,
-		ost:                     conf.OST,
-		changes:                 NewWalChanges(conf.DataTypes),
-		dataTypes:               conf.DataTypes,
-		etcdWalsKeepNum:         conf.EtcdWalsKeepNum,
-		checkpointInterval:      conf.CheckpointInterval,
-		checkpointCleanInterval: conf.CheckpointCleanInterval,
-		minCheckpointWalsNum:    conf.MinCheckpointWalsNum,
-		maxDataFileSize:         conf.MaxDataFileSize,
-		maintenanceMode:         conf.MaintenanceMode,
+		basePath:                    conf.BasePath,
+		log:                         logger.Sugar(),
+		e:                           conf.E,
+		walsOst:                     conf.WalsOST,
+		dataOst:                     conf.DataOST,
+		changes:                     NewWalChanges(conf.DataTypes),
+		dataTypes:                   conf.DataTypes,
+		etcdWalsKeepNum:             conf.EtcdWalsKeepNum,
+		checkpointInterval:          conf.CheckpointInterval,
+		checkpointCleanInterval:     conf.CheckpointCleanInterval,
+		storageWalCleanInterval:     conf.StorageWalCleanInterval,
+		minCheckpointWalsNum:        conf.MinCheckpointWalsNum,
+		checkpointWalsSizeThreshold: conf.CheckpointWalsSizeThreshold,
+		maxDataFileSize:             conf.MaxDataFileSize,
+		maintenanceMode:             conf.MaintenanceMode,
+		migrations:                  conf.Migrations,
+		dataTypesVersions:           dataTypesVersions,
+		etcdMaxRetries:              conf.EtcdMaxRetries,
+		etcdRetryBaseDelay:          conf.EtcdRetryBaseDelay,
+		walCompression:              conf.WalCompression,
+		walFlusher: walFlusher{
+			interval:     conf.WalFlushInterval,
+			maxBatchSize: conf.WalFlushMaxBatchSize,
+		},
+		writerLease: writerLease{
+			enabled: conf.WriterLease,
+			ttl:     conf.WriterLeaseTTL,
+		},
 	}
 
 	// add trailing slash the basepath
@@ -231,6 +366,7 @@ func (d *DataManager) deleteEtcd(ctx context.Context) error {
 }
 
 func (d *DataManager) Run(ctx context.Context, readyCh chan struct{}) error {
+	var wg sync.WaitGroup
 	if !d.maintenanceMode {
 		for {
 			err := d.InitEtcd(ctx, nil)
@@ -249,14 +385,17 @@ func (d *DataManager) Run(ctx context.Context, readyCh chan struct{}) error {
 
 		readyCh <- struct{}{}
 
-		go d.watcherLoop(ctx)
-		go d.syncLoop(ctx)
-		go d.checkpointLoop(ctx)
-		go d.checkpointCleanLoop(ctx)
-		go d.etcdWalCleanerLoop(ctx)
-		go d.storageWalCleanerLoop(ctx)
-		go d.compactChangeGroupsLoop(ctx)
-		go d.etcdPingerLoop(ctx)
+		util.GoWait(&wg, func() { d.watcherLoop(ctx) })
+		util.GoWait(&wg, func() { d.syncLoop(ctx) })
+		util.GoWait(&wg, func() { d.checkpointLoop(ctx) })
+		util.GoWait(&wg, func() { d.checkpointCleanLoop(ctx) })
+		util.GoWait(&wg, func() { d.etcdWalCleanerLoop(ctx) })
+		util.GoWait(&wg, func() { d.storageWalCleanerLoop(ctx) })
+		util.GoWait(&wg, func() { d.compactChangeGroupsLoop(ctx) })
+		util.GoWait(&wg, func() { d.etcdPingerLoop(ctx) })
+		if d.writerLease.enabled {
+			util.GoWait(&wg, func() { d.writerLeaseLoop(ctx) })
+		}
 
 	} else {
 		d.log.Infof("datamanager starting in maintenance mode")
@@ -266,5 +405,9 @@ func (d *DataManager) Run(ctx context.Context, readyCh chan struct{}) error {
 	<-ctx.Done()
 	d.log.Infof("datamanager exiting")
 
+	// wait for the loops to exit so they won't use the etcd client and the
+	// storage after Run returns
+	wg.Wait()
+
 	return nil
 }
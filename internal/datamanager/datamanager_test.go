@@ -29,11 +29,13 @@ import (
 	"testing"
 	"time"
 
+	"agola.io/agola/internal/etcd"
 	"agola.io/agola/internal/objectstorage"
 	"agola.io/agola/internal/testutil"
 	"agola.io/agola/internal/util"
 
 	"github.com/google/go-cmp/cmp"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 	errors "golang.org/x/xerrors"
@@ -252,7 +254,7 @@ func TestEtcdResetWalsGap(t *testing.T) {
 	defer close(doneCh)
 
 	walStatusFiles := []string{}
-	for object := range dm.ost.List(path.Join(dm.basePath, storageWalsStatusDir)+"/", "", true, doneCh) {
+	for object := range dm.walsOst.List(path.Join(dm.basePath, storageWalsStatusDir)+"/", "", true, doneCh) {
 		if object.Err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
@@ -264,7 +266,7 @@ func TestEtcdResetWalsGap(t *testing.T) {
 	}
 
 	removeIndex := 10
-	if err := dm.ost.DeleteObject(walStatusFiles[removeIndex]); err != nil {
+	if err := dm.walsOst.DeleteObject(walStatusFiles[removeIndex]); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 	errorWalSequence := strings.TrimSuffix(path.Base(walStatusFiles[removeIndex+1]), path.Ext(walStatusFiles[removeIndex+1]))
@@ -389,6 +391,112 @@ func TestConcurrentUpdate(t *testing.T) {
 	}
 }
 
+func TestWriteWalAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	etcdDir, err := ioutil.TempDir(dir, "etcd")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	tetcd := setupEtcd(t, logger, etcdDir)
+	defer shutdownEtcd(tetcd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ostDir, err := ioutil.TempDir(dir, "ost")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	ost, err := objectstorage.NewPosix(ostDir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	dmConfig := &DataManagerConfig{
+		E:               tetcd.TestEtcd.Store,
+		OST:             objectstorage.NewObjStorage(ost, "/"),
+		EtcdWalsKeepNum: 10,
+		DataTypes:       []string{"datatype01"},
+	}
+	dm, err := NewDataManager(ctx, logger, dmConfig)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	dmReadyCh := make(chan struct{})
+	go func() { _ = dm.Run(ctx, dmReadyCh) }()
+	<-dmReadyCh
+
+	time.Sleep(5 * time.Second)
+
+	exists := func(t *testing.T, id string) bool {
+		r, _, err := dm.ReadObject("datatype01", id, nil)
+		if util.IsNotExist(err) {
+			return false
+		}
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		r.Close()
+		return true
+	}
+	checkObjects := func(t *testing.T, expected map[string]bool) {
+		for id, e := range expected {
+			if got := exists(t, id); got != e {
+				t.Fatalf("expected object %q existance %t, got %t", id, e, got)
+			}
+		}
+	}
+
+	cgNames := []string{"changegroup01"}
+	cgt, err := dm.GetChangeGroupsUpdateToken(cgNames)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// all the actions of a wal are committed together
+	oldcgt := cgt
+	actions := []*Action{
+		{ActionType: ActionTypePut, ID: "object01", DataType: "datatype01", Data: []byte("{}")},
+		{ActionType: ActionTypePut, ID: "object02", DataType: "datatype01", Data: []byte("{}")},
+	}
+	if _, err := dm.WriteWal(ctx, actions, cgt); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	checkObjects(t, map[string]bool{"object01": true, "object02": true})
+
+	// none of the actions of a not committed wal are applied
+	actions = []*Action{
+		{ActionType: ActionTypePut, ID: "object03", DataType: "datatype01", Data: []byte("{}")},
+		{ActionType: ActionTypeDelete, ID: "object01", DataType: "datatype01"},
+	}
+	if _, err := dm.WriteWal(ctx, actions, oldcgt); err != ErrConcurrency {
+		t.Fatalf("expected err: %v, got %v", ErrConcurrency, err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	checkObjects(t, map[string]bool{"object01": true, "object02": true, "object03": false})
+
+	// the same after a checkpoint
+	if err := dm.Checkpoint(ctx); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	checkObjects(t, map[string]bool{"object01": true, "object02": true, "object03": false})
+}
+
 func TestEtcdWalCleaner(t *testing.T) {
 	dir, err := ioutil.TempDir("", "agola")
 	if err != nil {
@@ -449,10 +557,10 @@ func TestEtcdWalCleaner(t *testing.T) {
 		}
 	}
 
-	if err := dm.checkpoint(ctx, true); err != nil {
+	if err := dm.checkpoint(ctx, true, false); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	if err := dm.etcdWalCleaner(ctx); err != nil {
+	if err := dm.etcdWalCleaner(ctx, false); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
@@ -465,6 +573,103 @@ func TestEtcdWalCleaner(t *testing.T) {
 	}
 }
 
+func TestWatchRevisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	etcdDir, err := ioutil.TempDir(dir, "etcd")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	tetcd := setupEtcd(t, logger, etcdDir)
+	defer shutdownEtcd(tetcd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ostDir, err := ioutil.TempDir(dir, "ost")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	ost, err := objectstorage.NewPosix(ostDir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	dmConfig := &DataManagerConfig{
+		E:         tetcd.TestEtcd.Store,
+		OST:       objectstorage.NewObjStorage(ost, "/"),
+		DataTypes: []string{"datatype01"},
+	}
+	dm, err := NewDataManager(ctx, logger, dmConfig)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	dmReadyCh := make(chan struct{})
+	go func() { _ = dm.Run(ctx, dmReadyCh) }()
+	<-dmReadyCh
+
+	resp, err := tetcd.TestEtcd.Store.List(ctx, etcdWalsDir, "", 0)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	startRevision := resp.Header.Revision
+
+	walsNum := 5
+	for i := 0; i < walsNum; i++ {
+		actions := []*Action{
+			{
+				ActionType: ActionTypePut,
+				ID:         fmt.Sprintf("object%02d", i),
+				DataType:   "datatype01",
+				Data:       []byte("{}"),
+			},
+		}
+		if _, err := dm.WriteWal(ctx, actions, nil); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	// wait for the wals to be marked as committed storage so the watch will
+	// receive the events of many revisions in the same response
+	if err := waitWalsCommittedStorage(ctx, dm); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	wctx, wcancel := context.WithTimeout(ctx, 10*time.Second)
+	defer wcancel()
+
+	committedWals := map[string]struct{}{}
+	var revision int64
+	for we := range dm.Watch(wctx, startRevision+1) {
+		if we.Err != nil {
+			t.Fatalf("unexpected err: %v", we.Err)
+		}
+		if we.Revision <= revision {
+			t.Fatalf("expected watch element revision greater than %d, got %d", revision, we.Revision)
+		}
+		revision = we.Revision
+
+		if we.WalData != nil && we.WalData.WalStatus == WalStatusCommitted {
+			committedWals[we.WalData.WalSequence] = struct{}{}
+		}
+		if len(committedWals) == walsNum {
+			break
+		}
+	}
+
+	if len(committedWals) != walsNum {
+		t.Fatalf("expected %d committed wals watch elements, got %d", walsNum, len(committedWals))
+	}
+}
+
 func TestReadObject(t *testing.T) {
 	dir, err := ioutil.TempDir("", "agola")
 	if err != nil {
@@ -569,10 +774,10 @@ func TestReadObject(t *testing.T) {
 	}
 
 	// do a checkpoint and wal clean
-	if err := dm.checkpoint(ctx, true); err != nil {
+	if err := dm.checkpoint(ctx, true, false); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	if err := dm.etcdWalCleaner(ctx); err != nil {
+	if err := dm.etcdWalCleaner(ctx, false); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
@@ -622,7 +827,7 @@ func doAndCheckCheckpoint(t *testing.T, ctx context.Context, dm *DataManager, ac
 	time.Sleep(500 * time.Millisecond)
 
 	// do a checkpoint
-	if err := dm.checkpoint(ctx, true); err != nil {
+	if err := dm.checkpoint(ctx, true, false); err != nil {
 		return nil, err
 	}
 
@@ -633,6 +838,27 @@ func doAndCheckCheckpoint(t *testing.T, ctx context.Context, dm *DataManager, ac
 	return expectedEntries, nil
 }
 
+// waitWalsCommittedStorage waits for all the etcd wals to be committed to the
+// storage
+func waitWalsCommittedStorage(ctx context.Context, dm *DataManager) error {
+	for i := 0; i < 100; i++ {
+		committed := true
+		for wal := range dm.ListEtcdWals(ctx, 0) {
+			if wal.Err != nil {
+				return wal.Err
+			}
+			if wal.WalData.WalStatus == WalStatusCommitted {
+				committed = false
+			}
+		}
+		if committed {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.Errorf("timeout waiting for the wals to be committed to the storage")
+}
+
 func checkDataFiles(ctx context.Context, t *testing.T, dm *DataManager, expectedEntriesMap map[string]*DataEntry) error {
 	// read the data file
 	curDataStatus, err := dm.GetLastDataStatus()
@@ -645,7 +871,7 @@ func checkDataFiles(ctx context.Context, t *testing.T, dm *DataManager, expected
 	for dataType := range curDataStatus.Files {
 		var prevLastEntryID string
 		for i, file := range curDataStatus.Files[dataType] {
-			dataFileIndexf, err := dm.ost.ReadObject(dm.DataFileIndexPath(dataType, file.ID))
+			dataFileIndexf, err := dm.dataOst.ReadObject(dm.DataFileIndexPath(dataType, file.ID))
 			if err != nil {
 				return err
 			}
@@ -660,7 +886,7 @@ func checkDataFiles(ctx context.Context, t *testing.T, dm *DataManager, expected
 			dataFileIndexf.Close()
 			dataEntriesMap := map[string]*DataEntry{}
 			dataEntries := []*DataEntry{}
-			dataf, err := dm.ost.ReadObject(dm.DataFilePath(dataType, file.ID))
+			dataf, err := dm.dataOst.ReadObject(dm.DataFilePath(dataType, file.ID))
 			if err != nil {
 				return err
 			}
@@ -1432,7 +1658,7 @@ func testStorageWalCleaner(t *testing.T, basePath string) {
 
 	expectedWalStatusFiles := []string{}
 	expectedWalDataFiles := []string{}
-	for object := range dm.ost.List(dm.storageWalStatusDir()+"/", "", true, doneCh) {
+	for object := range dm.walsOst.List(dm.storageWalStatusDir()+"/", "", true, doneCh) {
 		if object.Err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
@@ -1458,20 +1684,20 @@ func testStorageWalCleaner(t *testing.T, basePath string) {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	if err := dm.storageWalCleaner(ctx); err != nil {
+	if err := dm.storageWalCleaner(ctx, false); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
 	currentWalStatusFiles := []string{}
 	currentWalDataFiles := []string{}
-	for object := range dm.ost.List(dm.storageWalStatusDir()+"/", "", true, doneCh) {
+	for object := range dm.walsOst.List(dm.storageWalStatusDir()+"/", "", true, doneCh) {
 		if object.Err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
 
 		currentWalStatusFiles = append(currentWalStatusFiles, object.Path)
 	}
-	for object := range dm.ost.List(dm.storageWalDataDir()+"/", "", true, doneCh) {
+	for object := range dm.walsOst.List(dm.storageWalDataDir()+"/", "", true, doneCh) {
 		if object.Err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
@@ -1487,7 +1713,7 @@ func testStorageWalCleaner(t *testing.T, basePath string) {
 	}
 }
 
-func TestExportImport(t *testing.T) {
+func TestForceCheckpoint(t *testing.T) {
 	dir, err := ioutil.TempDir("", "agola")
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
@@ -1501,8 +1727,10 @@ func TestExportImport(t *testing.T) {
 		t.Fatalf("unexpected err: %v", err)
 	}
 	tetcd := setupEtcd(t, logger, etcdDir)
+	defer shutdownEtcd(tetcd)
 
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	ostDir, err := ioutil.TempDir(dir, "ost")
 	if err != nil {
@@ -1514,16 +1742,16 @@ func TestExportImport(t *testing.T) {
 	}
 
 	dmConfig := &DataManagerConfig{
-		BasePath: "basepath",
-		E:        tetcd.TestEtcd.Store,
-		OST:      objectstorage.NewObjStorage(ost, "/"),
-		// remove almost all wals to see that they are removed also from changes
+		BasePath:        "basepath",
+		E:               tetcd.TestEtcd.Store,
+		OST:             objectstorage.NewObjStorage(ost, "/"),
 		EtcdWalsKeepNum: 1,
-		DataTypes:       []string{"datatype01", "datatype02"},
-		// checkpoint also with only one wal
-		MinCheckpointWalsNum: 1,
-		// use a small maxDataFileSize
-		MaxDataFileSize: 10 * 1024,
+		DataTypes:       []string{"datatype01"},
+		// disable the periodic checkpoint and cleaners so only the forced
+		// checkpoint will be done
+		CheckpointInterval:      1 * time.Hour,
+		CheckpointCleanInterval: 1 * time.Hour,
+		StorageWalCleanInterval: 1 * time.Hour,
 	}
 	dm, err := NewDataManager(ctx, logger, dmConfig)
 	if err != nil {
@@ -1535,97 +1763,322 @@ func TestExportImport(t *testing.T) {
 
 	time.Sleep(5 * time.Second)
 
-	contents := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
-
 	expectedEntries := map[string]*DataEntry{}
-
-	// test insert from scratch (no current entries)
-	actionGroups := [][]*Action{}
-	actions := []*Action{}
-	for i := 200; i < 400; i++ {
-		action := &Action{
-			ActionType: ActionTypePut,
-			ID:         fmt.Sprintf("object%04d", i),
-			DataType:   "datatype01",
-			Data:       []byte(fmt.Sprintf(`{ "ID": "%d", "Contents": %s }`, i, contents)),
-		}
-		actions = append(actions, action)
-	}
-	actionGroups = append(actionGroups, actions)
-
-	actions = []*Action{}
-	for i := 600; i < 1000; i++ {
-		action := &Action{
-			ActionType: ActionTypePut,
-			ID:         fmt.Sprintf("object%04d", i),
-			DataType:   "datatype02",
-			Data:       []byte(fmt.Sprintf(`{ "ID": "%d", "Contents": %s }`, i, contents)),
-		}
-		actions = append(actions, action)
-	}
-	actionGroups = append(actionGroups, actions)
-
-	for _, actionGroup := range actionGroups {
-		for _, action := range actionGroup {
-			switch action.ActionType {
-			case ActionTypePut:
-				expectedEntries[action.ID] = &DataEntry{ID: action.ID, DataType: action.DataType, Data: action.Data}
-			case ActionTypeDelete:
-				delete(expectedEntries, action.ID)
+	for n := 0; n < 2*dataStatusToKeep; n++ {
+		for i := 0; i < 10; i++ {
+			action := &Action{
+				ActionType: ActionTypePut,
+				ID:         fmt.Sprintf("object%04d", i),
+				DataType:   "datatype01",
+				Data:       []byte(fmt.Sprintf(`{ "ID": "%d", "N": %d }`, i, n)),
 			}
+			if _, err := dm.WriteWal(ctx, []*Action{action}, nil); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			expectedEntries[action.ID] = &DataEntry{ID: action.ID, DataType: action.DataType, Data: action.Data}
 		}
-	}
 
-	for _, actionGroup := range actionGroups {
-		// populate with a wal
-		_, err := dm.WriteWal(ctx, actionGroup, nil)
-		if err != nil {
+		// wait for the wals to be committed to the storage
+		time.Sleep(500 * time.Millisecond)
+
+		if err := dm.Checkpoint(ctx); err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
 	}
 
-	// wait for the event to be read
-	time.Sleep(500 * time.Millisecond)
-
-	var export bytes.Buffer
-	if err := dm.Export(ctx, &export); err != nil {
+	if err := checkDataFiles(ctx, t, dm, expectedEntries); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	t.Logf("stopping datamanager")
-	cancel()
-
-	time.Sleep(5 * time.Second)
-
-	t.Logf("stopping etcd")
-	// Reset etcd
-	shutdownEtcd(tetcd)
-
-	t.Logf("resetting etcd")
-	os.RemoveAll(etcdDir)
-	t.Logf("starting etcd")
-	tetcd = setupEtcd(t, logger, etcdDir)
-	if err := tetcd.Start(); err != nil {
+	// the wals older than the first kept data status must have been removed
+	dataStatusSequences, err := dm.GetFirstDataStatusSequences(dataStatusToKeep + 1)
+	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	defer shutdownEtcd(tetcd)
-
-	ostDir, err = ioutil.TempDir(dir, "ost")
+	if len(dataStatusSequences) != dataStatusToKeep {
+		t.Fatalf("expected %d data status files, got %d", dataStatusToKeep, len(dataStatusSequences))
+	}
+	firstDataStatus, err := dm.GetFirstDataStatus()
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	ost, err = objectstorage.NewPosix(ostDir)
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	walStatusFiles := 0
+	for object := range dm.walsOst.List(dm.storageWalStatusDir()+"/", "", true, doneCh) {
+		if object.Err != nil {
+			t.Fatalf("unexpected err: %v", object.Err)
+		}
+		walSequence := strings.TrimSuffix(path.Base(object.Path), path.Ext(object.Path))
+		if walSequence < firstDataStatus.WalSequence {
+			t.Fatalf("wal %q older than first data status wal sequence %q not removed", walSequence, firstDataStatus.WalSequence)
+		}
+		walStatusFiles++
+	}
+	if walStatusFiles >= 2*dataStatusToKeep*10 {
+		t.Fatalf("expected some wals to be removed from the storage")
+	}
+
+	// only the last wal must be kept in etcd
+	resp, err := dm.e.List(ctx, etcdWalsDir+"/", "", 0)
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
+	if len(resp.Kvs) != 1 {
+		t.Fatalf("expected 1 wal in etcd, got %d", len(resp.Kvs))
+	}
 
-	ctx, cancel = context.WithCancel(context.Background())
-
-	dmConfig = &DataManagerConfig{
-		BasePath: "basepath",
-		E:        tetcd.TestEtcd.Store,
-		OST:      objectstorage.NewObjStorage(ost, "/"),
+	// objects must still be readable after their wals have been removed
+	for id, e := range expectedEntries {
+		r, _, err := dm.ReadObject("datatype01", id, nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if string(data) != string(e.Data) {
+			t.Fatalf("expected object %q data %q, got %q", id, e.Data, data)
+		}
+	}
+}
+
+func TestCheckpointWalsSizeThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	etcdDir, err := ioutil.TempDir(dir, "etcd")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	tetcd := setupEtcd(t, logger, etcdDir)
+	defer shutdownEtcd(tetcd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ostDir, err := ioutil.TempDir(dir, "ost")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	ost, err := objectstorage.NewPosix(ostDir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	dmConfig := &DataManagerConfig{
+		BasePath:  "basepath",
+		E:         tetcd.TestEtcd.Store,
+		OST:       objectstorage.NewObjStorage(ost, "/"),
+		DataTypes: []string{"datatype01"},
+		// use a big MinCheckpointWalsNum so only the size threshold will
+		// trigger a checkpoint
+		MinCheckpointWalsNum:        1000,
+		CheckpointWalsSizeThreshold: 1024,
+		CheckpointInterval:          1 * time.Hour,
+	}
+	dm, err := NewDataManager(ctx, logger, dmConfig)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	dmReadyCh := make(chan struct{})
+	go func() { _ = dm.Run(ctx, dmReadyCh) }()
+	<-dmReadyCh
+
+	time.Sleep(5 * time.Second)
+
+	writeWal := func(id string, size int) {
+		action := &Action{
+			ActionType: ActionTypePut,
+			ID:         id,
+			DataType:   "datatype01",
+			Data:       []byte(fmt.Sprintf(`{ "ID": %q, "Contents": %q }`, id, strings.Repeat("a", size))),
+		}
+		if _, err := dm.WriteWal(ctx, []*Action{action}, nil); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	lastDataStatusSequence := func() string {
+		seq, err := dm.GetLastDataStatusSequence()
+		if err != nil {
+			if errors.Is(err, ErrNoDataStatus) {
+				return ""
+			}
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return seq.String()
+	}
+
+	initialSeq := lastDataStatusSequence()
+
+	// wals data size is under the threshold, no checkpoint should be done
+	writeWal("object01", 100)
+	if err := dm.checkpoint(ctx, false, false); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if seq := lastDataStatusSequence(); seq != initialSeq {
+		t.Fatalf("unexpected checkpoint with wals data size under the threshold")
+	}
+
+	// wals data size is over the threshold, a checkpoint should be done
+	writeWal("object02", 2048)
+	if err := dm.checkpoint(ctx, false, false); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if seq := lastDataStatusSequence(); seq == initialSeq {
+		t.Fatalf("expected checkpoint with wals data size over the threshold")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	etcdDir, err := ioutil.TempDir(dir, "etcd")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	tetcd := setupEtcd(t, logger, etcdDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ostDir, err := ioutil.TempDir(dir, "ost")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	ost, err := objectstorage.NewPosix(ostDir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	dmConfig := &DataManagerConfig{
+		BasePath: "basepath",
+		E:        tetcd.TestEtcd.Store,
+		OST:      objectstorage.NewObjStorage(ost, "/"),
+		// remove almost all wals to see that they are removed also from changes
+		EtcdWalsKeepNum: 1,
+		DataTypes:       []string{"datatype01", "datatype02"},
+		// checkpoint also with only one wal
+		MinCheckpointWalsNum: 1,
+		// use a small maxDataFileSize
+		MaxDataFileSize: 10 * 1024,
+	}
+	dm, err := NewDataManager(ctx, logger, dmConfig)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	dmReadyCh := make(chan struct{})
+	go func() { _ = dm.Run(ctx, dmReadyCh) }()
+	<-dmReadyCh
+
+	time.Sleep(5 * time.Second)
+
+	contents := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+	expectedEntries := map[string]*DataEntry{}
+
+	// test insert from scratch (no current entries)
+	actionGroups := [][]*Action{}
+	actions := []*Action{}
+	for i := 200; i < 400; i++ {
+		action := &Action{
+			ActionType: ActionTypePut,
+			ID:         fmt.Sprintf("object%04d", i),
+			DataType:   "datatype01",
+			Data:       []byte(fmt.Sprintf(`{ "ID": "%d", "Contents": %s }`, i, contents)),
+		}
+		actions = append(actions, action)
+	}
+	actionGroups = append(actionGroups, actions)
+
+	actions = []*Action{}
+	for i := 600; i < 1000; i++ {
+		action := &Action{
+			ActionType: ActionTypePut,
+			ID:         fmt.Sprintf("object%04d", i),
+			DataType:   "datatype02",
+			Data:       []byte(fmt.Sprintf(`{ "ID": "%d", "Contents": %s }`, i, contents)),
+		}
+		actions = append(actions, action)
+	}
+	actionGroups = append(actionGroups, actions)
+
+	for _, actionGroup := range actionGroups {
+		for _, action := range actionGroup {
+			switch action.ActionType {
+			case ActionTypePut:
+				expectedEntries[action.ID] = &DataEntry{ID: action.ID, DataType: action.DataType, Data: action.Data}
+			case ActionTypeDelete:
+				delete(expectedEntries, action.ID)
+			}
+		}
+	}
+
+	for _, actionGroup := range actionGroups {
+		// populate with a wal
+		_, err := dm.WriteWal(ctx, actionGroup, nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	// wait for the event to be read
+	time.Sleep(500 * time.Millisecond)
+
+	var export bytes.Buffer
+	if err := dm.Export(ctx, &export); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Logf("stopping datamanager")
+	cancel()
+
+	time.Sleep(5 * time.Second)
+
+	t.Logf("stopping etcd")
+	// Reset etcd
+	shutdownEtcd(tetcd)
+
+	t.Logf("resetting etcd")
+	os.RemoveAll(etcdDir)
+	t.Logf("starting etcd")
+	tetcd = setupEtcd(t, logger, etcdDir)
+	if err := tetcd.Start(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer shutdownEtcd(tetcd)
+
+	ostDir, err = ioutil.TempDir(dir, "ost")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	ost, err = objectstorage.NewPosix(ostDir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+
+	dmConfig = &DataManagerConfig{
+		BasePath: "basepath",
+		E:        tetcd.TestEtcd.Store,
+		OST:      objectstorage.NewObjStorage(ost, "/"),
 		// remove almost all wals to see that they are removed also from changes
 		EtcdWalsKeepNum: 1,
 		DataTypes:       []string{"datatype01", "datatype02"},
@@ -1733,7 +2186,7 @@ func TestExportImport(t *testing.T) {
 	// wait for the event to be read
 	time.Sleep(500 * time.Millisecond)
 
-	if err := dm.checkpoint(ctx, false); err != nil {
+	if err := dm.checkpoint(ctx, false, false); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
@@ -1741,3 +2194,879 @@ func TestExportImport(t *testing.T) {
 		t.Fatalf("unexpected err: %v", err)
 	}
 }
+
+func TestMigratingObjectStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	etcdDir, err := ioutil.TempDir(dir, "etcd")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	tetcd := setupEtcd(t, logger, etcdDir)
+	defer shutdownEtcd(tetcd)
+
+	ctx := context.Background()
+
+	newPosix := func(name string) *objectstorage.PosixStorage {
+		ost, err := objectstorage.NewPosix(path.Join(dir, name))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return ost
+	}
+	oldOst := newPosix("ost")
+
+	dmCtx, dmCancel := context.WithCancel(ctx)
+	dmConfig := &DataManagerConfig{
+		BasePath:        "basepath",
+		E:               tetcd.TestEtcd.Store,
+		OST:             objectstorage.NewObjStorage(oldOst, "/"),
+		EtcdWalsKeepNum: 10,
+		DataTypes:       []string{"datatype01"},
+	}
+	dm, err := NewDataManager(dmCtx, logger, dmConfig)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	dmReadyCh := make(chan struct{})
+	go func() { _ = dm.Run(dmCtx, dmReadyCh) }()
+	<-dmReadyCh
+
+	actions := []*Action{}
+	for i := 0; i < 10; i++ {
+		actions = append(actions, &Action{ActionType: ActionTypePut, ID: fmt.Sprintf("object%02d", i), DataType: "datatype01", Data: []byte("{}")})
+	}
+	if _, err := dm.WriteWal(ctx, actions, nil); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err := dm.checkpoint(ctx, true, false); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// a wal not yet checkpointed
+	actions = []*Action{
+		{ActionType: ActionTypePut, ID: "object10", DataType: "datatype01", Data: []byte("{}")},
+		{ActionType: ActionTypeDelete, ID: "object00", DataType: "datatype01"},
+	}
+	if _, err := dm.WriteWal(ctx, actions, nil); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// wait for the wals to be committed to the object storage
+	time.Sleep(DefaultSyncInterval + 1*time.Second)
+
+	oldWals := []string{}
+	for walFile := range dm.ListOSTWals("") {
+		if walFile.Err != nil {
+			t.Fatalf("unexpected err: %v", walFile.Err)
+		}
+		oldWals = append(oldWals, walFile.WalSequence)
+	}
+	if len(oldWals) < 2 {
+		t.Fatalf("expected at least 2 wals, got %d wals", len(oldWals))
+	}
+
+	dmCancel()
+	time.Sleep(1 * time.Second)
+
+	// restart the datamanager with the wals and the data in two new object
+	// storages being migrated from the old one
+	walsOst := objectstorage.NewMigratingStorage(newPosix("walsost"), oldOst)
+	dataOst := objectstorage.NewMigratingStorage(newPosix("dataost"), oldOst)
+
+	dmCtx, dmCancel = context.WithCancel(ctx)
+	defer dmCancel()
+	dmConfig = &DataManagerConfig{
+		BasePath:        "basepath",
+		E:               tetcd.TestEtcd.Store,
+		WalsOST:         objectstorage.NewObjStorage(walsOst, "/"),
+		DataOST:         objectstorage.NewObjStorage(dataOst, "/"),
+		EtcdWalsKeepNum: 10,
+		DataTypes:       []string{"datatype01"},
+	}
+	dm, err = NewDataManager(dmCtx, logger, dmConfig)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	dmReadyCh = make(chan struct{})
+	go func() { _ = dm.Run(dmCtx, dmReadyCh) }()
+	<-dmReadyCh
+
+	time.Sleep(500 * time.Millisecond)
+
+	checkObjects := func(t *testing.T) {
+		for i := 1; i <= 10; i++ {
+			id := fmt.Sprintf("object%02d", i)
+			if _, _, err := dm.ReadObject("datatype01", id, nil); err != nil {
+				t.Fatalf("object %q: unexpected err: %v", id, err)
+			}
+		}
+		for _, walSeq := range oldWals {
+			if _, err := dm.ReadWal(walSeq); err != nil {
+				t.Fatalf("wal %q: unexpected err: %v", walSeq, err)
+			}
+		}
+	}
+
+	t.Run("test read from the old object storage during the migration", func(t *testing.T) {
+		checkObjects(t)
+
+		wals := []string{}
+		for walFile := range dm.ListOSTWals("") {
+			if walFile.Err != nil {
+				t.Fatalf("unexpected err: %v", walFile.Err)
+			}
+			wals = append(wals, walFile.WalSequence)
+		}
+		if !reflect.DeepEqual(wals, oldWals) {
+			t.Fatalf("expected wals %v, got %v", oldWals, wals)
+		}
+	})
+
+	t.Run("test checkpoint during the migration", func(t *testing.T) {
+		if err := dm.checkpoint(ctx, true, false); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := dm.Read("datatype01", "object10"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := dm.Read("datatype01", "object00"); !util.IsNotExist(err) {
+			t.Fatalf("expected not exist err, got: %v", err)
+		}
+	})
+
+	t.Run("test read after the migration", func(t *testing.T) {
+		for _, ost := range []*objectstorage.MigratingStorage{walsOst, dataOst} {
+			if _, err := ost.Migrate(ctx); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+		}
+		if err := os.RemoveAll(path.Join(dir, "ost")); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		checkObjects(t)
+		if _, err := dm.Read("datatype01", "object10"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := dm.Read("datatype01", "object00"); !util.IsNotExist(err) {
+			t.Fatalf("expected not exist err, got: %v", err)
+		}
+	})
+}
+
+func TestWalMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	etcdDir, err := ioutil.TempDir(dir, "etcd")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	tetcd := setupEtcd(t, logger, etcdDir)
+	defer shutdownEtcd(tetcd)
+
+	ostDir, err := ioutil.TempDir(dir, "ost")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	ost, err := objectstorage.NewPosix(ostDir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	dmConfig := &DataManagerConfig{
+		BasePath:        "basepath",
+		E:               tetcd.TestEtcd.Store,
+		OST:             objectstorage.NewObjStorage(ost, "/"),
+		EtcdWalsKeepNum: 10,
+		DataTypes:       []string{"datatype01"},
+		// disable the periodic checkpoint and cleaners so only the forced
+		// checkpoint will be done
+		CheckpointInterval:      1 * time.Hour,
+		CheckpointCleanInterval: 1 * time.Hour,
+		StorageWalCleanInterval: 1 * time.Hour,
+	}
+
+	// version 1 renames the "Name" field to "name"
+	migrations := map[string]Migrations{
+		"datatype01": {
+			1: func(data []byte) ([]byte, error) {
+				var obj map[string]interface{}
+				if err := json.Unmarshal(data, &obj); err != nil {
+					return nil, err
+				}
+				obj["name"] = obj["Name"]
+				delete(obj, "Name")
+				return json.Marshal(obj)
+			},
+		},
+	}
+
+	t.Run("test wrong migration versions", func(t *testing.T) {
+		conf := *dmConfig
+		conf.Migrations = map[string]Migrations{
+			"datatype01": {
+				1: migrations["datatype01"][1],
+				3: migrations["datatype01"][1],
+			},
+		}
+		expectedErr := `datatype "datatype01" migration versions must be contiguous starting from 1, missing version 2`
+		if _, err := NewDataManager(context.Background(), logger, &conf); err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got: %v", expectedErr, err)
+		}
+	})
+
+	// write the old version wal entries with a datamanager without migrations
+	ctx, cancel := context.WithCancel(context.Background())
+	dm, err := NewDataManager(ctx, logger, dmConfig)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	dmReadyCh := make(chan struct{})
+	go func() { _ = dm.Run(ctx, dmReadyCh) }()
+	<-dmReadyCh
+
+	time.Sleep(5 * time.Second)
+
+	oldActions := []*Action{
+		{ActionType: ActionTypePut, ID: "object01", DataType: "datatype01", Data: []byte(`{"Name":"object01"}`)},
+		{ActionType: ActionTypePut, ID: "object02", DataType: "datatype01", Data: []byte(`{"Name":"object02"}`)},
+	}
+	if _, err := dm.WriteWal(ctx, oldActions, nil); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	cancel()
+
+	// restart with the migrations and write new version wal entries
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	conf := *dmConfig
+	conf.Migrations = migrations
+	dm, err = NewDataManager(ctx, logger, &conf)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	dmReadyCh = make(chan struct{})
+	go func() { _ = dm.Run(ctx, dmReadyCh) }()
+	<-dmReadyCh
+
+	time.Sleep(5 * time.Second)
+
+	newActions := []*Action{
+		{ActionType: ActionTypePut, ID: "object03", DataType: "datatype01", Data: []byte(`{"name":"object03"}`)},
+		{ActionType: ActionTypeDelete, ID: "object02", DataType: "datatype01"},
+	}
+	if _, err := dm.WriteWal(ctx, newActions, nil); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectedData := map[string]string{
+		"object01": `{"name":"object01"}`,
+		"object03": `{"name":"object03"}`,
+	}
+
+	// wait for the wals to be read and committed to the storage
+	if err := waitWalsCommittedStorage(ctx, dm); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for id, expected := range expectedData {
+		r, _, err := dm.ReadObject("datatype01", id, nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if string(data) != expected {
+			t.Fatalf("expected object %q data %s, got %s", id, expected, data)
+		}
+	}
+
+	if err := dm.Checkpoint(ctx); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectedEntries := map[string]*DataEntry{}
+	for id, data := range expectedData {
+		expectedEntries[id] = &DataEntry{ID: id, DataType: "datatype01", Data: []byte(data), Version: 1}
+	}
+	if err := checkDataFiles(ctx, t, dm, expectedEntries); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("test newer version entry", func(t *testing.T) {
+		action := &Action{ActionType: ActionTypePut, ID: "object04", DataType: "datatype01", Data: []byte(`{}`), Version: 2}
+		expectedErr := `datatype "datatype01" entry version 2 is newer than the supported version 1`
+		if err := dm.MigrateAction(action); err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestEtcdRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	ost, err := objectstorage.NewPosix(dir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	ctx := context.Background()
+
+	dm, err := NewDataManager(ctx, logger, &DataManagerConfig{
+		OST:                objectstorage.NewObjStorage(ost, "/"),
+		DataTypes:          []string{"datatype01"},
+		EtcdMaxRetries:     3,
+		EtcdRetryBaseDelay: 1 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("recovers after etcd becomes available", func(t *testing.T) {
+		calls := 0
+		err := dm.retryEtcd(ctx, etcd.IsTransientError, func() error {
+			calls++
+			if calls > 1 && dm.EtcdDegraded() == nil {
+				t.Fatalf("expected etcd degraded while unavailable")
+			}
+			if calls <= 2 {
+				return rpctypes.ErrNoLeader
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if calls != 3 {
+			t.Fatalf("expected 3 calls, got %d", calls)
+		}
+		if err := dm.EtcdDegraded(); err != nil {
+			t.Fatalf("expected etcd not degraded, got: %v", err)
+		}
+	})
+
+	t.Run("reports etcd unavailable", func(t *testing.T) {
+		calls := 0
+		err := dm.retryEtcd(ctx, etcd.IsTransientError, func() error {
+			calls++
+			return rpctypes.ErrLeaderChanged
+		})
+		if calls != 4 {
+			t.Fatalf("expected 4 calls, got %d", calls)
+		}
+		if !util.IsUnavailable(etcdUnavailableError(err)) {
+			t.Fatalf("expected unavailable error, got: %v", err)
+		}
+		if err := dm.EtcdDegraded(); err == nil || !errors.Is(err, rpctypes.ErrLeaderChanged) {
+			t.Fatalf("expected etcd degraded with leader changed error, got: %v", err)
+		}
+
+		// a not transient error means etcd is reachable again
+		err = dm.retryEtcd(ctx, etcd.IsTransientError, func() error {
+			return etcd.ErrKeyNotFound
+		})
+		if err != etcd.ErrKeyNotFound {
+			t.Fatalf("expected key not found error, got: %v", err)
+		}
+		if err := dm.EtcdDegraded(); err != nil {
+			t.Fatalf("expected etcd not degraded, got: %v", err)
+		}
+	})
+}
+
+func TestWalFlushBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	etcdDir, err := ioutil.TempDir(dir, "etcd")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	tetcd := setupEtcd(t, logger, etcdDir)
+	defer shutdownEtcd(tetcd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ostDir, err := ioutil.TempDir(dir, "ost")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	ost, err := objectstorage.NewPosix(ostDir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	dmConfig := &DataManagerConfig{
+		E:                tetcd.TestEtcd.Store,
+		OST:              objectstorage.NewObjStorage(ost, "/"),
+		EtcdWalsKeepNum:  100,
+		DataTypes:        []string{"datatype01"},
+		WalFlushInterval: 1 * time.Second,
+	}
+	dm, err := NewDataManager(ctx, logger, dmConfig)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	dmReadyCh := make(chan struct{})
+	go func() { _ = dm.Run(ctx, dmReadyCh) }()
+	<-dmReadyCh
+
+	time.Sleep(5 * time.Second)
+
+	// writeWal writes a wal, retrying on concurrent writes (also of the wal
+	// sequence), and checks that
+	// it's already committed to the storage
+	writeWal := func(i int) error {
+		actions := []*Action{
+			{
+				ActionType: ActionTypePut,
+				ID:         fmt.Sprintf("object%02d", i),
+				DataType:   "datatype01",
+				Data:       []byte("{}"),
+			},
+		}
+		var cgt *ChangeGroupsUpdateToken
+		for {
+			var err error
+			cgt, err = dm.WriteWal(ctx, actions, nil)
+			if err == nil {
+				break
+			}
+			if err != ErrConcurrency && !errors.Is(err, etcd.ErrKeyModified) {
+				return err
+			}
+		}
+
+		resp, err := dm.e.List(ctx, etcdWalsDir+"/", "", 0)
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			if kv.CreateRevision != cgt.CurRevision {
+				continue
+			}
+			var walData WalData
+			if err := json.Unmarshal(kv.Value, &walData); err != nil {
+				return err
+			}
+			if walData.WalStatus != WalStatusCommittedStorage {
+				return errors.Errorf("wal %q not committed to the storage, status: %q", walData.WalSequence, walData.WalStatus)
+			}
+			return nil
+		}
+		return errors.Errorf("wal written at revision %d not found", cgt.CurRevision)
+	}
+
+	concurrentWrites := func(t *testing.T, n int) {
+		errCh := make(chan error, n)
+		for i := 0; i < n; i++ {
+			i := i
+			go func() { errCh <- writeWal(i) }()
+		}
+		for i := 0; i < n; i++ {
+			if err := <-errCh; err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+		}
+	}
+
+	t.Run("concurrent writes are flushed together", func(t *testing.T) {
+		n := 20
+		prevFlushes := dm.Stats().WalFlushes
+		concurrentWrites(t, n)
+		flushes := dm.Stats().WalFlushes - prevFlushes
+		if flushes >= uint64(n/2) {
+			t.Fatalf("expected less than %d flushes for %d writes, got %d", n/2, n, flushes)
+		}
+	})
+
+	t.Run("full batch is flushed without waiting for the interval", func(t *testing.T) {
+		dm.walFlusher.interval = 1 * time.Minute
+		dm.walFlusher.maxBatchSize = 5
+
+		start := time.Now()
+		concurrentWrites(t, 10)
+		if elapsed := time.Since(start); elapsed >= dm.walFlusher.interval {
+			t.Fatalf("expected writes completed before the flush interval, took %s", elapsed)
+		}
+	})
+}
+
+func TestWalCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	etcdDir, err := ioutil.TempDir(dir, "etcd")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	tetcd := setupEtcd(t, logger, etcdDir)
+	defer shutdownEtcd(tetcd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ostDir, err := ioutil.TempDir(dir, "ost")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	ost, err := objectstorage.NewPosix(ostDir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	dmConfig := &DataManagerConfig{
+		E:               tetcd.TestEtcd.Store,
+		OST:             objectstorage.NewObjStorage(ost, "/"),
+		EtcdWalsKeepNum: 100,
+		DataTypes:       []string{"datatype01"},
+	}
+
+	conf := *dmConfig
+	conf.WalCompression = "zstd"
+	expectedErr := `unsupported wal compression "zstd"`
+	if _, err := NewDataManager(ctx, logger, &conf); err == nil || err.Error() != expectedErr {
+		t.Fatalf("expected err %q, got: %v", expectedErr, err)
+	}
+
+	// start without compression to write a legacy uncompressed wal
+	dm, err := NewDataManager(ctx, logger, dmConfig)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	dmReadyCh := make(chan struct{})
+	go func() { _ = dm.Run(ctx, dmReadyCh) }()
+	<-dmReadyCh
+
+	time.Sleep(5 * time.Second)
+
+	// writeWal writes a wal with a single put action and returns its data
+	// file id
+	writeWal := func(t *testing.T, id string, data []byte) string {
+		actions := []*Action{
+			{
+				ActionType: ActionTypePut,
+				ID:         id,
+				DataType:   "datatype01",
+				Data:       data,
+			},
+		}
+		cgt, err := dm.WriteWal(ctx, actions, nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		resp, err := dm.e.List(ctx, etcdWalsDir+"/", "", 0)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		for _, kv := range resp.Kvs {
+			if kv.CreateRevision != cgt.CurRevision {
+				continue
+			}
+			var walData WalData
+			if err := json.Unmarshal(kv.Value, &walData); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			return walData.WalDataFileID
+		}
+		t.Fatalf("wal written at revision %d not found", cgt.CurRevision)
+		return ""
+	}
+
+	// checkWalData checks the stored wal data file format and that it's read
+	// back uncompressed
+	checkWalData := func(t *testing.T, walDataFileID string, compressed bool, expectedID string, expectedData []byte) {
+		f, err := dm.walsOst.ReadObject(dm.storageWalDataFile(walDataFileID))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		raw, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if isCompressed := bytes.HasPrefix(raw, gzipMagic); isCompressed != compressed {
+			t.Fatalf("expected wal data file compressed: %t, got: %t", compressed, isCompressed)
+		}
+
+		walFile, err := dm.ReadWalData(walDataFileID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer walFile.Close()
+		var action *Action
+		if err := json.NewDecoder(walFile).Decode(&action); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if action.ID != expectedID || !bytes.Equal(action.Data, expectedData) {
+			t.Fatalf("expected action with id %q and data %q, got id %q and data %q", expectedID, expectedData, action.ID, action.Data)
+		}
+	}
+
+	// a compressible data
+	data := []byte(fmt.Sprintf(`{ "value": %q }`, strings.Repeat("a", 1024)))
+
+	legacyWalDataFileID := writeWal(t, "object01", data)
+
+	dm.walCompression = WalCompressionGzip
+	compressedWalDataFileID := writeWal(t, "object02", data)
+
+	t.Run("legacy uncompressed wal is read", func(t *testing.T) {
+		checkWalData(t, legacyWalDataFileID, false, "object01", data)
+	})
+
+	t.Run("compressed wal is read decompressed", func(t *testing.T) {
+		checkWalData(t, compressedWalDataFileID, true, "object02", data)
+
+		f, err := dm.walsOst.Stat(dm.storageWalDataFile(compressedWalDataFileID))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if f.Size >= int64(len(data)) {
+			t.Fatalf("expected compressed wal data file smaller than %d bytes, got %d bytes", len(data), f.Size)
+		}
+	})
+
+	t.Run("checkpoint reads both compressed and uncompressed wals", func(t *testing.T) {
+		if err := dm.checkpoint(ctx, true, false); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		for _, id := range []string{"object01", "object02"} {
+			r, err := dm.Read("datatype01", id)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			rdata, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if !bytes.Equal(rdata, data) {
+				t.Fatalf("expected data %q, got %q", data, rdata)
+			}
+		}
+	})
+
+	t.Run("empty wal data", func(t *testing.T) {
+		for _, compression := range []WalCompression{WalCompressionNone, WalCompressionGzip} {
+			dm.walCompression = compression
+			cdata, err := dm.compressWalData([]byte{})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			r, err := walDataReader(ioutil.NopCloser(bytes.NewReader(cdata)))
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			rdata, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if len(rdata) != 0 {
+				t.Fatalf("%s: expected empty data, got %q", compression, rdata)
+			}
+		}
+	})
+}
+
+func TestWriterLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	etcdDir, err := ioutil.TempDir(dir, "etcd")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	tetcd := setupEtcd(t, logger, etcdDir)
+	defer shutdownEtcd(tetcd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ostDir, err := ioutil.TempDir(dir, "ost")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	ost, err := objectstorage.NewPosix(ostDir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	dmConfig := &DataManagerConfig{
+		E:               tetcd.TestEtcd.Store,
+		OST:             objectstorage.NewObjStorage(ost, "/"),
+		EtcdWalsKeepNum: 100,
+		DataTypes:       []string{"datatype01"},
+		WriterLease:     true,
+	}
+
+	conf := *dmConfig
+	conf.WriterLeaseTTL = 500 * time.Millisecond
+	expectedErr := "writerLeaseTTL must be at least 1s"
+	if _, err := NewDataManager(ctx, logger, &conf); err == nil || err.Error() != expectedErr {
+		t.Fatalf("expected err %q, got: %v", expectedErr, err)
+	}
+
+	startDataManager := func(t *testing.T) *DataManager {
+		conf := *dmConfig
+		dm, err := NewDataManager(ctx, logger, &conf)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		dmReadyCh := make(chan struct{})
+		go func() { _ = dm.Run(ctx, dmReadyCh) }()
+		<-dmReadyCh
+		return dm
+	}
+
+	waitWriter := func(t *testing.T, dm *DataManager) {
+		for i := 0; i < 20; i++ {
+			if dm.IsWriter() {
+				return
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		t.Fatalf("expected datamanager to become the wal writer")
+	}
+
+	writeWal := func(dm *DataManager, id string) error {
+		actions := []*Action{
+			{
+				ActionType: ActionTypePut,
+				ID:         id,
+				DataType:   "datatype01",
+				Data:       []byte("{}"),
+			},
+		}
+		_, err := dm.WriteWal(ctx, actions, nil)
+		return err
+	}
+
+	checkNotWriterError := func(t *testing.T, err error) {
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if !util.IsMisdirectedRequest(err) {
+			t.Fatalf("expected misdirected request error, got: %v", err)
+		}
+	}
+
+	dm1 := startDataManager(t)
+	waitWriter(t, dm1)
+
+	dm2 := startDataManager(t)
+	// give dm2 the time to start waiting for the lease
+	time.Sleep(2 * time.Second)
+	if dm2.IsWriter() {
+		t.Fatalf("expected datamanager to not be the wal writer")
+	}
+
+	if err := writeWal(dm1, "object01"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	checkNotWriterError(t, writeWal(dm2, "object02"))
+
+	// simulate the dm1 lease loss (i.e. not renewed during a network
+	// partition) removing its lease owner key without dm1 noticing it
+	ownerKey, _, err := dm1.writerLease.owner()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := dm1.e.Delete(ctx, ownerKey); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	waitWriter(t, dm2)
+
+	// dm1 still believes to be the writer but its write is fenced by the
+	// wal write transaction
+	checkNotWriterError(t, writeWal(dm1, "object03"))
+	if dm1.IsWriter() {
+		t.Fatalf("expected datamanager to not be the wal writer")
+	}
+	// the next writes of the demoted writer fail fast
+	checkNotWriterError(t, writeWal(dm1, "object04"))
+
+	if err := writeWal(dm2, "object05"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// dm1 is waiting again for the lease
+	time.Sleep(2 * time.Second)
+	if dm1.IsWriter() {
+		t.Fatalf("expected datamanager to not be the wal writer")
+	}
+
+	resp, err := dm2.e.List(ctx, etcdWalsDir+"/", "", 0)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	ids := []string{}
+	for _, kv := range resp.Kvs {
+		var walData WalData
+		if err := json.Unmarshal(kv.Value, &walData); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if walData.WalDataSize == 0 {
+			// the empty wal written by the etcd initialization
+			continue
+		}
+		walFile, err := dm2.ReadWalData(walData.WalDataFileID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		var action *Action
+		err = json.NewDecoder(walFile).Decode(&action)
+		walFile.Close()
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		ids = append(ids, action.ID)
+	}
+	expectedIDs := []string{"object01", "object05"}
+	if diff := cmp.Diff(expectedIDs, ids); diff != "" {
+		t.Fatalf("wals mismatch (-want +got):\n%s", diff)
+	}
+}
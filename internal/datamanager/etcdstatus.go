@@ -0,0 +1,83 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datamanager
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/etcd"
+	"agola.io/agola/internal/util"
+
+	errors "golang.org/x/xerrors"
+)
+
+// etcdStatus tracks the etcd unavailability detected by the datamanager
+// operations
+type etcdStatus struct {
+	mu      sync.Mutex
+	lastErr error
+	since   time.Time
+}
+
+func (s *etcdStatus) update(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !etcd.IsTransientError(err) {
+		// the request reached a healthy etcd cluster
+		s.lastErr = nil
+		return
+	}
+	if s.lastErr == nil {
+		s.since = time.Now()
+	}
+	s.lastErr = err
+}
+
+// EtcdDegraded returns an error when the last etcd operation failed since etcd
+// is temporarily unavailable (i.e. it's electing a new leader)
+func (d *DataManager) EtcdDegraded() error {
+	d.etcdStatus.mu.Lock()
+	defer d.etcdStatus.mu.Unlock()
+
+	if d.etcdStatus.lastErr == nil {
+		return nil
+	}
+	return errors.Errorf("etcd unavailable since %s: %w", d.etcdStatus.since.Format(time.RFC3339), d.etcdStatus.lastErr)
+}
+
+// retryEtcd executes the etcd operation f retrying it with a backoff while it
+// fails with an error for which retriable is true
+func (d *DataManager) retryEtcd(ctx context.Context, retriable func(error) bool, f func() error) error {
+	return etcd.Retry(ctx, d.etcdMaxRetries, d.etcdRetryBaseDelay, retriable, func() error {
+		err := f()
+		d.etcdStatus.update(err)
+		if etcd.IsTransientError(err) {
+			d.log.Warnf("etcd unavailable: %v", err)
+		}
+		return err
+	})
+}
+
+// etcdUnavailableError marks the errors caused by the etcd unavailability as
+// unavailable errors so the clients know the request could be retried
+func etcdUnavailableError(err error) error {
+	if etcd.IsTransientError(err) {
+		return util.NewErrUnavailable(errors.Errorf("etcd unavailable: %w", err))
+	}
+	return err
+}
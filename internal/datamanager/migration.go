@@ -0,0 +1,117 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datamanager
+
+import (
+	"sort"
+
+	errors "golang.org/x/xerrors"
+)
+
+// MigrationFunc upgrades the data of an entry from the previous schema
+// version to the one the migration is registered for
+type MigrationFunc func(data []byte) ([]byte, error)
+
+// Migrations are the schema migrations of a data type keyed by the version
+// they upgrade the data to. Entries written before versioning have version 0,
+// so the versions must start from 1 and be contiguous. The highest version is
+// the current schema version of the data type.
+type Migrations map[int]MigrationFunc
+
+// checkMigrations verifies the migrations of every data type and returns
+// their current schema versions
+func checkMigrations(migrations map[string]Migrations) (map[string]int, error) {
+	versions := map[string]int{}
+	for dataType, dtMigrations := range migrations {
+		mversions := make([]int, 0, len(dtMigrations))
+		for version, f := range dtMigrations {
+			if f == nil {
+				return nil, errors.Errorf("datatype %q migration to version %d is nil", dataType, version)
+			}
+			mversions = append(mversions, version)
+		}
+		sort.Ints(mversions)
+		for i, version := range mversions {
+			if version != i+1 {
+				return nil, errors.Errorf("datatype %q migration versions must be contiguous starting from 1, missing version %d", dataType, i+1)
+			}
+		}
+		versions[dataType] = len(mversions)
+	}
+	return versions, nil
+}
+
+// DataTypeVersion returns the current schema version of the data type
+func (d *DataManager) DataTypeVersion(dataType string) int {
+	return d.dataTypesVersions[dataType]
+}
+
+// migrate upgrades the data from the provided schema version to the current
+// one of the data type
+func (d *DataManager) migrate(dataType string, version int, data []byte) ([]byte, int, error) {
+	curVersion := d.DataTypeVersion(dataType)
+	if version > curVersion {
+		return nil, 0, errors.Errorf("datatype %q entry version %d is newer than the supported version %d", dataType, version, curVersion)
+	}
+	for v := version + 1; v <= curVersion; v++ {
+		var err error
+		data, err = d.migrations[dataType][v](data)
+		if err != nil {
+			return nil, 0, errors.Errorf("failed to migrate datatype %q entry to version %d: %w", dataType, v, err)
+		}
+	}
+	return data, curVersion, nil
+}
+
+// MigrateAction upgrades the action data to the current schema version of its
+// data type. The delete actions have no data so only their version is updated.
+func (d *DataManager) MigrateAction(action *Action) error {
+	if action.ActionType != ActionTypePut {
+		version := d.DataTypeVersion(action.DataType)
+		if action.Version > version {
+			return errors.Errorf("datatype %q entry version %d is newer than the supported version %d", action.DataType, action.Version, version)
+		}
+		action.Version = version
+		return nil
+	}
+	data, version, err := d.migrate(action.DataType, action.Version, action.Data)
+	if err != nil {
+		return err
+	}
+	action.Data = data
+	action.Version = version
+	return nil
+}
+
+// MigrateDataEntry upgrades the data entry to the current schema version of
+// its data type
+func (d *DataManager) MigrateDataEntry(de *DataEntry) error {
+	data, version, err := d.migrate(de.DataType, de.Version, de.Data)
+	if err != nil {
+		return err
+	}
+	de.Data = data
+	de.Version = version
+	return nil
+}
+
+// DataTypesVersions returns the current schema versions of all the data types
+func (d *DataManager) DataTypesVersions() map[string]int {
+	versions := make(map[string]int, len(d.dataTypes))
+	for _, dataType := range d.dataTypes {
+		versions[dataType] = d.DataTypeVersion(dataType)
+	}
+	return versions
+}
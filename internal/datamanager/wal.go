@@ -15,7 +15,9 @@
 package datamanager
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -23,9 +25,11 @@ import (
 	"io/ioutil"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"agola.io/agola/internal/etcd"
+	slog "agola.io/agola/internal/log"
 	"agola.io/agola/internal/objectstorage"
 	"agola.io/agola/internal/sequence"
 	"agola.io/agola/internal/util"
@@ -45,11 +49,26 @@ const (
 	ActionTypeDelete ActionType = "delete"
 )
 
+// WalCompression is the compression of the wal data files written to the
+// object storage
+type WalCompression string
+
+const (
+	WalCompressionNone WalCompression = "none"
+	WalCompressionGzip WalCompression = "gzip"
+)
+
+// gzipMagic are the first bytes of a gzip stream. An uncompressed wal data
+// file is a stream of json objects so it cannot start with them.
+var gzipMagic = []byte{0x1f, 0x8b}
+
 type Action struct {
 	ActionType ActionType
 	DataType   string
 	ID         string
 	Data       []byte
+	// Version is the schema version of the data type of the action data
+	Version int `json:",omitempty"`
 }
 
 type WalHeader struct {
@@ -78,6 +97,9 @@ type WalData struct {
 	WalStatus           WalStatus
 	WalSequence         string
 	PreviousWalSequence string
+	// WalDataSize is the size of the wal data file. It'll be 0 for wals
+	// written by previous versions
+	WalDataSize int64 `json:",omitempty"`
 
 	// internal values not saved
 	Revision int64 `json:"-"`
@@ -90,6 +112,46 @@ type ChangeGroupsUpdateToken struct {
 
 type changeGroupsRevisions map[string]int64
 
+// IsReady reports if the datamanager has completed the initial sync of the wal
+// changes and is ready to serve requests
+func (d *DataManager) IsReady() bool {
+	d.changes.Lock()
+	defer d.changes.Unlock()
+	return d.changes.initialized
+}
+
+// Stats contains some statistics about the datamanager wals
+type Stats struct {
+	// WalSequence is the sequence of the last wal received by the wal changes
+	// watcher
+	WalSequence string
+	// PendingWals is the number of wals not yet checkpointed
+	PendingWals int
+	// LastCheckpointTime is the time of the last checkpoint done by this
+	// datamanager instance
+	LastCheckpointTime time.Time
+	// WalFlushes is the number of syncs of the wals to the storage done by
+	// this datamanager instance
+	WalFlushes uint64
+}
+
+func (d *DataManager) Stats() *Stats {
+	d.changes.Lock()
+	stats := &Stats{
+		WalSequence: d.changes.walSeq,
+		PendingWals: len(d.changes.actions),
+	}
+	d.changes.Unlock()
+
+	d.lastCheckpointTimeMutex.Lock()
+	stats.LastCheckpointTime = d.lastCheckpointTime
+	d.lastCheckpointTimeMutex.Unlock()
+
+	stats.WalFlushes = atomic.LoadUint64(&d.walFlushes)
+
+	return stats
+}
+
 func (d *DataManager) GetChangeGroupsUpdateToken(cgNames []string) (*ChangeGroupsUpdateToken, error) {
 	d.changes.Lock()
 	defer d.changes.Unlock()
@@ -132,7 +194,7 @@ func (d *DataManager) ReadObject(dataType, id string, cgNames []string) (io.Read
 }
 
 func (d *DataManager) HasOSTWal(walseq string) (bool, error) {
-	_, err := d.ost.Stat(d.storageWalStatusFile(walseq) + ".committed")
+	_, err := d.walsOst.Stat(d.storageWalStatusFile(walseq) + ".committed")
 	if objectstorage.IsNotExist(err) {
 		return false, nil
 	}
@@ -143,7 +205,7 @@ func (d *DataManager) HasOSTWal(walseq string) (bool, error) {
 }
 
 func (d *DataManager) ReadWal(walseq string) (*WalHeader, error) {
-	walFilef, err := d.ost.ReadObject(d.storageWalStatusFile(walseq) + ".committed")
+	walFilef, err := d.walsOst.ReadObject(d.storageWalStatusFile(walseq) + ".committed")
 	if err != nil {
 		return nil, err
 	}
@@ -157,8 +219,68 @@ func (d *DataManager) ReadWal(walseq string) (*WalHeader, error) {
 	return header, nil
 }
 
+// ReadWalData returns the uncompressed content of a wal data file
 func (d *DataManager) ReadWalData(walFileID string) (io.ReadCloser, error) {
-	return d.ost.ReadObject(d.storageWalDataFile(walFileID))
+	f, err := d.walsOst.ReadObject(d.storageWalDataFile(walFileID))
+	if err != nil {
+		return nil, err
+	}
+	return walDataReader(f)
+}
+
+// compressWalData compresses the wal data with the configured wal compression
+func (d *DataManager) compressWalData(data []byte) ([]byte, error) {
+	switch d.walCompression {
+	case WalCompressionGzip:
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return data, nil
+	}
+}
+
+// walDataReader returns a reader of the uncompressed wal data of f. The
+// compression is detected from the data so the wal data files written with a
+// different compression, or without it, are always readable.
+func walDataReader(f io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	if !bytes.Equal(magic, gzipMagic) {
+		return &walDataFile{Reader: br, closers: []io.Closer{f}}, nil
+	}
+
+	gr, err := gzip.NewReader(br)
+	if err != nil {
+		f.Close()
+		return nil, errors.Errorf("failed to read compressed wal data: %w", err)
+	}
+	return &walDataFile{Reader: gr, closers: []io.Closer{gr, f}}, nil
+}
+
+type walDataFile struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (f *walDataFile) Close() error {
+	var err error
+	for _, c := range f.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 type WalFile struct {
@@ -180,7 +302,7 @@ func (d *DataManager) ListOSTWals(start string) <-chan *WalFile {
 			startPath = d.storageWalStatusFile(start)
 		}
 
-		for object := range d.ost.List(d.storageWalStatusDir()+"/", startPath, true, doneCh) {
+		for object := range d.walsOst.List(d.storageWalStatusDir()+"/", startPath, true, doneCh) {
 			if object.Err != nil {
 				walCh <- &WalFile{
 					Err: object.Err,
@@ -329,10 +451,8 @@ func (d *DataManager) Watch(ctx context.Context, revision int64) <-chan *WatchEl
 	go func() {
 		defer close(walCh)
 		for wresp := range wch {
-			we := &WatchElement{ChangeGroupsRevisions: make(changeGroupsRevisions)}
-			send := false
-
 			if wresp.Canceled {
+				we := &WatchElement{}
 				err := wresp.Err()
 				switch err {
 				case etcdclientv3rpc.ErrCompacted:
@@ -345,9 +465,24 @@ func (d *DataManager) Watch(ctx context.Context, revision int64) <-chan *WatchEl
 				return
 			}
 
-			we.Revision = wresp.Header.Revision
-
+			// a watch response can contain the events of multiple revisions (i.e.
+			// a wal committed and then marked as committed storage), so send a
+			// watch element for every revision or the wal data of the previous
+			// revisions will be lost
+			var we *WatchElement
+			send := false
 			for _, ev := range wresp.Events {
+				if we != nil && ev.Kv.ModRevision != we.Revision {
+					if send {
+						walCh <- we
+					}
+					we = nil
+				}
+				if we == nil {
+					we = &WatchElement{Revision: ev.Kv.ModRevision, ChangeGroupsRevisions: make(changeGroupsRevisions)}
+					send = false
+				}
+
 				key := string(ev.Kv.Key)
 
 				switch {
@@ -384,7 +519,8 @@ func (d *DataManager) Watch(ctx context.Context, revision int64) <-chan *WatchEl
 				}
 			}
 
-			if send {
+			if we != nil && send {
+				we.Revision = wresp.Header.Revision
 				walCh <- we
 			}
 		}
@@ -396,7 +532,10 @@ func (d *DataManager) Watch(ctx context.Context, revision int64) <-chan *WatchEl
 // WriteWal writes the provided actions in a wal file. The wal will be marked as
 // "committed" on etcd if the provided group changes aren't changed in the
 // meantime or a optimistic concurrency error will be returned and the wal won't
-// be committed
+// be committed.
+// All the actions are written in the same wal so they are committed (and
+// applied by the readers) together or not at all. Operations changing multiple
+// objects must provide all their actions in a single call.
 //
 // TODO(sgotti) save inside the wal file also the previous committed wal to
 // handle possible objectstorage list operation eventual consistency gaps (list
@@ -423,14 +562,38 @@ func (d *DataManager) WriteWalAdditionalOps(ctx context.Context, actions []*Acti
 		return nil, errors.Errorf("cannot write wal: actions is empty")
 	}
 
-	walSequence, err := sequence.IncSequence(ctx, d.e, etcdWalSeqKey)
+	// fail fast if not holding the writer lease, the lease is anyway checked
+	// again in the wal write transaction
+	var leaseOwnerKey string
+	var leaseOwnerCmp etcdclientv3.Cmp
+	if d.writerLease.enabled {
+		var err error
+		leaseOwnerKey, leaseOwnerCmp, err = d.writerLease.owner()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// a failed sequence increment could have been applied, retrying it will
+	// just skip a sequence
+	var walSequence *sequence.Sequence
+	err := d.retryEtcd(ctx, etcd.IsTransientError, func() error {
+		var err error
+		walSequence, err = sequence.IncSequence(ctx, d.e, etcdWalSeqKey)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, etcdUnavailableError(err)
 	}
 
-	resp, err := d.e.Get(ctx, etcdWalsDataKey, 0)
+	var resp *etcdclientv3.GetResponse
+	err = d.retryEtcd(ctx, etcd.IsTransientError, func() error {
+		var err error
+		resp, err = d.e.Get(ctx, etcdWalsDataKey, 0)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, etcdUnavailableError(err)
 	}
 
 	var walsData WalsData
@@ -445,6 +608,7 @@ func (d *DataManager) WriteWalAdditionalOps(ctx context.Context, actions []*Acti
 
 	var buf bytes.Buffer
 	for _, action := range actions {
+		action.Version = d.DataTypeVersion(action.DataType)
 		actionj, err := json.Marshal(action)
 		if err != nil {
 			return nil, err
@@ -453,16 +617,21 @@ func (d *DataManager) WriteWalAdditionalOps(ctx context.Context, actions []*Acti
 			return nil, err
 		}
 	}
-	if err := d.ost.WriteObject(walDataFilePath, bytes.NewReader(buf.Bytes()), int64(buf.Len()), true); err != nil {
+	walDataFileData, err := d.compressWalData(buf.Bytes())
+	if err != nil {
+		return nil, errors.Errorf("failed to compress wal data: %w", err)
+	}
+	if err := d.walsOst.WriteObject(walDataFilePath, bytes.NewReader(walDataFileData), int64(len(walDataFileData)), true); err != nil {
 		return nil, err
 	}
-	d.log.Debugf("wrote wal file: %s", walDataFilePath)
+	slog.WithContext(ctx, d.log).Debugw("wrote wal file", "walSequence", walSequence.String(), "path", walDataFilePath)
 
 	walData := &WalData{
 		WalSequence:         walSequence.String(),
 		WalDataFileID:       walDataFileID,
 		WalStatus:           WalStatusCommitted,
 		PreviousWalSequence: walsData.LastCommittedWalSequence,
+		WalDataSize:         int64(buf.Len()),
 	}
 
 	walsData.LastCommittedWalSequence = walSequence.String()
@@ -485,6 +654,11 @@ func (d *DataManager) WriteWalAdditionalOps(ctx context.Context, actions []*Acti
 
 	getWalsData := etcdclientv3.OpGet(etcdWalsDataKey)
 	getWal := etcdclientv3.OpGet(walKey)
+	elseOps := []etcdclientv3.Op{getWalsData, getWal}
+	if leaseOwnerKey != "" {
+		cmp = append(cmp, leaseOwnerCmp)
+		elseOps = append(elseOps, etcdclientv3.OpGet(leaseOwnerKey))
+	}
 
 	if cgt != nil {
 		for cgName, cgRev := range cgt.ChangeGroupsRevisions {
@@ -510,12 +684,23 @@ func (d *DataManager) WriteWalAdditionalOps(ctx context.Context, actions []*Acti
 
 	// This will only succeed if no one else have concurrently updated the walsData
 	// TODO(sgotti) retry if it failed due to concurrency errors
-	txn := d.e.Client().Txn(ctx).If(cmp...).Then(then...).Else(getWalsData, getWal)
-	tresp, err := txn.Commit()
+	// the transaction is retried only if it wasn't certainly applied
+	var tresp *etcdclientv3.TxnResponse
+	err = d.retryEtcd(ctx, etcd.IsNotAppliedError, func() error {
+		var err error
+		tresp, err = d.e.Client().Txn(ctx).If(cmp...).Then(then...).Else(elseOps...).Commit()
+		return err
+	})
 	if err != nil {
-		return nil, etcd.FromEtcdError(err)
+		return nil, etcdUnavailableError(etcd.FromEtcdError(err))
 	}
 	if !tresp.Succeeded {
+		if leaseOwnerKey != "" && len(tresp.Responses[2].GetResponseRange().Kvs) == 0 {
+			// the lease expired, another writer could already exist
+			d.writerLease.lose(leaseOwnerKey)
+			return nil, notWriterError()
+		}
+
 		walsDataRev := tresp.Responses[0].GetResponseRange().Kvs[0].ModRevision
 		walDataCreateRev := tresp.Responses[0].GetResponseRange().Kvs[0].CreateRevision
 
@@ -533,9 +718,17 @@ func (d *DataManager) WriteWalAdditionalOps(ctx context.Context, actions []*Acti
 		}
 	}
 
-	// try to commit storage right now
-	if err := d.sync(ctx); err != nil {
-		d.log.Errorf("wal sync error: %+v", err)
+	if d.walFlusher.interval > 0 {
+		// the wal is committed to etcd and will be anyway flushed by the sync
+		// loop, so a failed flush isn't returned as a write error
+		if err := d.flushWal(ctx); err != nil {
+			d.log.Errorf("wal flush error: %+v", err)
+		}
+	} else {
+		// try to commit storage right now
+		if err := d.sync(ctx, false); err != nil {
+			d.log.Errorf("wal sync error: %+v", err)
+		}
 	}
 
 	return ncgt, nil
@@ -544,7 +737,7 @@ func (d *DataManager) WriteWalAdditionalOps(ctx context.Context, actions []*Acti
 func (d *DataManager) syncLoop(ctx context.Context) {
 	for {
 		d.log.Debugf("syncer")
-		if err := d.sync(ctx); err != nil {
+		if err := d.sync(ctx, false); err != nil {
 			d.log.Errorf("syncer error: %+v", err)
 		}
 
@@ -557,7 +750,9 @@ func (d *DataManager) syncLoop(ctx context.Context) {
 	}
 }
 
-func (d *DataManager) sync(ctx context.Context) error {
+// sync commits to the storage the wals committed to etcd. When wait is false
+// it returns without syncing if another sync is in progress
+func (d *DataManager) sync(ctx context.Context, wait bool) error {
 	session, err := concurrency.NewSession(d.e.Client(), concurrency.WithTTL(5), concurrency.WithContext(ctx))
 	if err != nil {
 		return err
@@ -566,14 +761,14 @@ func (d *DataManager) sync(ctx context.Context) error {
 
 	m := etcd.NewMutex(session, etcdSyncLockKey)
 
-	if err := m.TryLock(ctx); err != nil {
-		if errors.Is(err, etcd.ErrLocked) {
-			return nil
-		}
+	locked, err := lock(ctx, m, wait)
+	if err != nil || !locked {
 		return err
 	}
 	defer func() { _ = m.Unlock(ctx) }()
 
+	atomic.AddUint64(&d.walFlushes, 1)
+
 	resp, err := d.e.List(ctx, etcdWalsDir+"/", "", 0)
 	if err != nil {
 		return err
@@ -599,7 +794,7 @@ func (d *DataManager) sync(ctx context.Context) error {
 			}
 
 			walFileCommittedPath := walFilePath + ".committed"
-			if err := d.ost.WriteObject(walFileCommittedPath, bytes.NewReader(headerj), int64(len(headerj)), true); err != nil {
+			if err := d.walsOst.WriteObject(walFileCommittedPath, bytes.NewReader(headerj), int64(len(headerj)), true); err != nil {
 				return err
 			}
 
@@ -630,10 +825,53 @@ func (d *DataManager) sync(ctx context.Context) error {
 	return nil
 }
 
+// lock acquires the provided mutex. When wait is false it won't wait for
+// the lock to be released if already held by someone else and will return
+// false without an error
+func lock(ctx context.Context, m *etcd.Mutex, wait bool) (bool, error) {
+	if wait {
+		if err := m.Lock(ctx); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if err := m.TryLock(ctx); err != nil {
+		if errors.Is(err, etcd.ErrLocked) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Checkpoint forces a checkpoint of all the wals committed to the storage
+// and then removes the old checkpoints and the wals not needed anymore
+// from etcd and the storage.
+// It takes the same locks used by the periodic loops, waiting for them if
+// already held. It's safe to call it with in flight readdb syncs since the
+// cleaners always keep the last data status files, the wals after them and
+// the last etcdWalsKeepNum wals in etcd.
+func (d *DataManager) Checkpoint(ctx context.Context) error {
+	if err := d.checkpoint(ctx, true, true); err != nil {
+		return errors.Errorf("checkpoint error: %w", err)
+	}
+	if err := d.checkpointClean(ctx, true); err != nil {
+		return errors.Errorf("checkpoint clean error: %w", err)
+	}
+	if err := d.etcdWalCleaner(ctx, true); err != nil {
+		return errors.Errorf("etcd wal cleaner error: %w", err)
+	}
+	if err := d.storageWalCleaner(ctx, true); err != nil {
+		return errors.Errorf("storage wal cleaner error: %w", err)
+	}
+	return nil
+}
+
 func (d *DataManager) checkpointLoop(ctx context.Context) {
 	for {
 		d.log.Debugf("checkpointer")
-		if err := d.checkpoint(ctx, false); err != nil {
+		if err := d.checkpoint(ctx, false, false); err != nil {
 			d.log.Errorf("checkpoint error: %v", err)
 		}
 
@@ -646,7 +884,7 @@ func (d *DataManager) checkpointLoop(ctx context.Context) {
 	}
 }
 
-func (d *DataManager) checkpoint(ctx context.Context, force bool) error {
+func (d *DataManager) checkpoint(ctx context.Context, force bool, wait bool) error {
 	session, err := concurrency.NewSession(d.e.Client(), concurrency.WithTTL(5), concurrency.WithContext(ctx))
 	if err != nil {
 		return err
@@ -655,10 +893,7 @@ func (d *DataManager) checkpoint(ctx context.Context, force bool) error {
 
 	m := etcd.NewMutex(session, etcdCheckpointLockKey)
 
-	if err := m.TryLock(ctx); err != nil {
-		if errors.Is(err, etcd.ErrLocked) {
-			return nil
-		}
+	if ok, err := lock(ctx, m, wait); !ok {
 		return err
 	}
 	defer func() { _ = m.Unlock(ctx) }()
@@ -668,6 +903,7 @@ func (d *DataManager) checkpoint(ctx context.Context, force bool) error {
 		return err
 	}
 	walsData := []*WalData{}
+	var walsDataSize int64
 	for _, kv := range resp.Kvs {
 		var walData *WalData
 		if err := json.Unmarshal(kv.Value, &walData); err != nil {
@@ -683,10 +919,13 @@ func (d *DataManager) checkpoint(ctx context.Context, force bool) error {
 			continue
 		}
 		walsData = append(walsData, walData)
+		walsDataSize += walData.WalDataSize
 	}
 
 	if !force && len(walsData) < d.minCheckpointWalsNum {
-		return nil
+		if d.checkpointWalsSizeThreshold == 0 || walsDataSize < d.checkpointWalsSizeThreshold {
+			return nil
+		}
 	}
 	if len(walsData) == 0 {
 		return nil
@@ -709,13 +948,17 @@ func (d *DataManager) checkpoint(ctx context.Context, force bool) error {
 		}
 	}
 
+	d.lastCheckpointTimeMutex.Lock()
+	d.lastCheckpointTime = time.Now()
+	d.lastCheckpointTimeMutex.Unlock()
+
 	return nil
 }
 
 func (d *DataManager) checkpointCleanLoop(ctx context.Context) {
 	for {
 		d.log.Debugf("checkpointCleanLoop")
-		if err := d.checkpointClean(ctx); err != nil {
+		if err := d.checkpointClean(ctx, false); err != nil {
 			d.log.Errorf("checkpointClean error: %v", err)
 		}
 
@@ -728,7 +971,7 @@ func (d *DataManager) checkpointCleanLoop(ctx context.Context) {
 	}
 }
 
-func (d *DataManager) checkpointClean(ctx context.Context) error {
+func (d *DataManager) checkpointClean(ctx context.Context, wait bool) error {
 	session, err := concurrency.NewSession(d.e.Client(), concurrency.WithTTL(5), concurrency.WithContext(ctx))
 	if err != nil {
 		return err
@@ -737,10 +980,7 @@ func (d *DataManager) checkpointClean(ctx context.Context) error {
 
 	m := etcd.NewMutex(session, etcdCheckpointLockKey)
 
-	if err := m.TryLock(ctx); err != nil {
-		if errors.Is(err, etcd.ErrLocked) {
-			return nil
-		}
+	if ok, err := lock(ctx, m, wait); !ok {
 		return err
 	}
 	defer func() { _ = m.Unlock(ctx) }()
@@ -755,7 +995,7 @@ func (d *DataManager) checkpointClean(ctx context.Context) error {
 func (d *DataManager) etcdWalCleanerLoop(ctx context.Context) {
 	for {
 		d.log.Debugf("etcdwalcleaner")
-		if err := d.etcdWalCleaner(ctx); err != nil {
+		if err := d.etcdWalCleaner(ctx, false); err != nil {
 			d.log.Errorf("etcdwalcleaner error: %v", err)
 		}
 
@@ -771,7 +1011,7 @@ func (d *DataManager) etcdWalCleanerLoop(ctx context.Context) {
 // etcdWalCleaner will clean already checkpointed wals from etcd
 // it must always keep at least one wal that is needed for resync operations
 // from clients
-func (d *DataManager) etcdWalCleaner(ctx context.Context) error {
+func (d *DataManager) etcdWalCleaner(ctx context.Context, wait bool) error {
 	session, err := concurrency.NewSession(d.e.Client(), concurrency.WithTTL(5), concurrency.WithContext(ctx))
 	if err != nil {
 		return err
@@ -780,10 +1020,7 @@ func (d *DataManager) etcdWalCleaner(ctx context.Context) error {
 
 	m := etcd.NewMutex(session, etcdWalCleanerLockKey)
 
-	if err := m.TryLock(ctx); err != nil {
-		if errors.Is(err, etcd.ErrLocked) {
-			return nil
-		}
+	if ok, err := lock(ctx, m, wait); !ok {
 		return err
 	}
 	defer func() { _ = m.Unlock(ctx) }()
@@ -830,11 +1067,11 @@ func (d *DataManager) etcdWalCleaner(ctx context.Context) error {
 func (d *DataManager) storageWalCleanerLoop(ctx context.Context) {
 	for {
 		d.log.Debugf("storagewalcleaner")
-		if err := d.storageWalCleaner(ctx); err != nil {
+		if err := d.storageWalCleaner(ctx, false); err != nil {
 			d.log.Errorf("storagewalcleaner error: %v", err)
 		}
 
-		sleepCh := time.NewTimer(DefaultStorageWalCleanInterval).C
+		sleepCh := time.NewTimer(d.storageWalCleanInterval).C
 		select {
 		case <-ctx.Done():
 			return
@@ -844,7 +1081,7 @@ func (d *DataManager) storageWalCleanerLoop(ctx context.Context) {
 }
 
 // storageWalCleaner will clean unneeded wals from the storage
-func (d *DataManager) storageWalCleaner(ctx context.Context) error {
+func (d *DataManager) storageWalCleaner(ctx context.Context, wait bool) error {
 	session, err := concurrency.NewSession(d.e.Client(), concurrency.WithTTL(5), concurrency.WithContext(ctx))
 	if err != nil {
 		return err
@@ -853,10 +1090,7 @@ func (d *DataManager) storageWalCleaner(ctx context.Context) error {
 
 	m := etcd.NewMutex(session, etcdStorageWalCleanerLockKey)
 
-	if err := m.TryLock(ctx); err != nil {
-		if errors.Is(err, etcd.ErrLocked) {
-			return nil
-		}
+	if ok, err := lock(ctx, m, wait); !ok {
 		return err
 	}
 	defer func() { _ = m.Unlock(ctx) }()
@@ -887,7 +1121,7 @@ func (d *DataManager) storageWalCleaner(ctx context.Context) error {
 	doneCh := make(chan struct{})
 	defer close(doneCh)
 
-	for object := range d.ost.List(d.storageWalStatusDir()+"/", "", true, doneCh) {
+	for object := range d.walsOst.List(d.storageWalStatusDir()+"/", "", true, doneCh) {
 		if object.Err != nil {
 			return err
 		}
@@ -909,7 +1143,7 @@ func (d *DataManager) storageWalCleaner(ctx context.Context) error {
 			// first remove wal data file
 			walStatusFilePath := d.storageWalDataFile(header.WalDataFileID)
 			d.log.Infof("removing %q", walStatusFilePath)
-			if err := d.ost.DeleteObject(walStatusFilePath); err != nil {
+			if err := d.walsOst.DeleteObject(walStatusFilePath); err != nil {
 				if !objectstorage.IsNotExist(err) {
 					return err
 				}
@@ -917,7 +1151,7 @@ func (d *DataManager) storageWalCleaner(ctx context.Context) error {
 
 			// then remove wal status files
 			d.log.Infof("removing %q", object.Path)
-			if err := d.ost.DeleteObject(object.Path); err != nil {
+			if err := d.walsOst.DeleteObject(object.Path); err != nil {
 				if !objectstorage.IsNotExist(err) {
 					return err
 				}
@@ -928,7 +1162,7 @@ func (d *DataManager) storageWalCleaner(ctx context.Context) error {
 		// TODO(sgotti) remove this in future versions since .checkpointed files are not created anymore
 		if ext == ".checkpointed" {
 			d.log.Infof("removing %q", object.Path)
-			if err := d.ost.DeleteObject(object.Path); err != nil {
+			if err := d.walsOst.DeleteObject(object.Path); err != nil {
 				if !objectstorage.IsNotExist(err) {
 					return err
 				}
@@ -1040,7 +1274,9 @@ func (d *DataManager) etcdPingerLoop(ctx context.Context) {
 }
 
 func (d *DataManager) etcdPinger(ctx context.Context) error {
-	if _, err := d.e.Put(ctx, etcdPingKey, []byte{}, nil); err != nil {
+	_, err := d.e.Put(ctx, etcdPingKey, []byte{}, nil)
+	d.etcdStatus.update(err)
+	if err != nil {
 		return err
 	}
 	return nil
@@ -1048,7 +1284,7 @@ func (d *DataManager) etcdPinger(ctx context.Context) error {
 
 func (d *DataManager) InitEtcd(ctx context.Context, dataStatus *DataStatus) error {
 	writeWal := func(wal *WalFile, prevWalSequence string) error {
-		walFile, err := d.ost.ReadObject(d.storageWalStatusFile(wal.WalSequence) + ".committed")
+		walFile, err := d.walsOst.ReadObject(d.storageWalStatusFile(wal.WalSequence) + ".committed")
 		if err != nil {
 			return err
 		}
@@ -1200,7 +1436,7 @@ func (d *DataManager) InitEtcd(ctx context.Context, dataStatus *DataStatus) erro
 	walDataFilePath := d.storageWalDataFile(walDataFileID)
 	walKey := etcdWalKey(walSequence.String())
 
-	if err := d.ost.WriteObject(walDataFilePath, bytes.NewReader([]byte{}), 0, true); err != nil {
+	if err := d.walsOst.WriteObject(walDataFilePath, bytes.NewReader([]byte{}), 0, true); err != nil {
 		return err
 	}
 	d.log.Debugf("wrote wal file: %s", walDataFilePath)
@@ -1216,7 +1452,7 @@ func (d *DataManager) InitEtcd(ctx context.Context, dataStatus *DataStatus) erro
 		return err
 	}
 	walFileCommittedPath := walFilePath + ".committed"
-	if err := d.ost.WriteObject(walFileCommittedPath, bytes.NewReader(headerj), int64(len(headerj)), true); err != nil {
+	if err := d.walsOst.WriteObject(walFileCommittedPath, bytes.NewReader(headerj), int64(len(headerj)), true); err != nil {
 		return err
 	}
 
@@ -1264,7 +1500,7 @@ func (d *DataManager) InitEtcd(ctx context.Context, dataStatus *DataStatus) erro
 	}
 
 	// force a checkpoint
-	if err := d.checkpoint(ctx, true); err != nil {
+	if err := d.checkpoint(ctx, true, false); err != nil {
 		return err
 	}
 
@@ -0,0 +1,96 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datamanager
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// walFlushTimeout is the max duration of a batched wals flush
+const walFlushTimeout = 30 * time.Second
+
+// walFlusher groups the storage flushes of the wals written concurrently. The
+// wals committed to etcd are flushed to the storage by a single sync done
+// after the flush interval or when the wals of the batch reach the max batch
+// size.
+type walFlusher struct {
+	interval     time.Duration
+	maxBatchSize int
+
+	mu  sync.Mutex
+	cur *walFlushBatch
+}
+
+// walFlushBatch are the wals waiting for the same flush
+type walFlushBatch struct {
+	size   int
+	fullCh chan struct{}
+	doneCh chan struct{}
+	err    error
+}
+
+// flushWal waits for the flush to the storage of a wal already committed to
+// etcd, adding it to the current flush batch
+func (d *DataManager) flushWal(ctx context.Context) error {
+	f := &d.walFlusher
+	f.mu.Lock()
+	b := f.cur
+	if b == nil {
+		b = &walFlushBatch{fullCh: make(chan struct{}), doneCh: make(chan struct{})}
+		f.cur = b
+		go d.runWalFlushBatch(b)
+	}
+	b.size++
+	if f.maxBatchSize > 0 && b.size >= f.maxBatchSize {
+		// the next wals will be added to a new batch
+		f.cur = nil
+		close(b.fullCh)
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-b.doneCh:
+		return b.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *DataManager) runWalFlushBatch(b *walFlushBatch) {
+	f := &d.walFlusher
+	timer := time.NewTimer(f.interval)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		f.mu.Lock()
+		if f.cur == b {
+			f.cur = nil
+		}
+		f.mu.Unlock()
+	case <-b.fullCh:
+	}
+
+	// the flush isn't bound to the context of one of the waiting writes
+	ctx, cancel := context.WithTimeout(context.Background(), walFlushTimeout)
+	defer cancel()
+
+	// the sync lock is waited since the wals committed to etcd just before
+	// could be missed by a sync already in progress
+	b.err = d.sync(ctx, true)
+	close(b.doneCh)
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datamanager
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/etcd"
+	"agola.io/agola/internal/util"
+
+	etcdclientv3 "go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/concurrency"
+	errors "golang.org/x/xerrors"
+)
+
+// writerLease is the etcd lease that, when enabled, makes a datamanager the
+// only wal writer. The create revision of the lease owner key is used as a
+// fencing token: it's checked by every wal write transaction so a writer that
+// lost the lease (i.e. it couldn't renew it during a network partition) can't
+// commit a wal also before noticing it.
+type writerLease struct {
+	enabled bool
+	ttl     time.Duration
+
+	mu sync.Mutex
+	// ownerKey is the lease owner key, it's unique for every acquired lease
+	// since it contains the etcd lease id. It's empty when the lease isn't
+	// held
+	ownerKey string
+	// ownerCmp checks that the lease owner key exists with the create
+	// revision it had when the lease was acquired
+	ownerCmp etcdclientv3.Cmp
+	// lostCh is closed when a wal write detects the lease loss
+	lostCh chan struct{}
+}
+
+// notWriterError is returned by the wal writes done without holding the
+// writer lease. It's a misdirected request error since the write must be sent
+// to the current writer.
+func notWriterError() error {
+	return util.NewErrMisdirectedRequest(errors.Errorf("datamanager isn't the wal writer: the wal writer lease is held by another instance or has been lost"))
+}
+
+func (l *writerLease) acquired(m *etcd.Mutex) <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ownerKey = m.Key()
+	l.ownerCmp = m.IsOwner()
+	l.lostCh = make(chan struct{})
+	return l.lostCh
+}
+
+func (l *writerLease) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ownerKey = ""
+}
+
+// lose releases the lease with the provided owner key and notifies the lease
+// loop. It does nothing if a new lease has been acquired in the meantime.
+func (l *writerLease) lose(ownerKey string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ownerKey == "" || l.ownerKey != ownerKey {
+		return
+	}
+	l.ownerKey = ""
+	close(l.lostCh)
+}
+
+// owner returns the lease owner key and its comparison or a not writer error
+// if the lease isn't held
+func (l *writerLease) owner() (string, etcdclientv3.Cmp, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ownerKey == "" {
+		return "", etcdclientv3.Cmp{}, notWriterError()
+	}
+	return l.ownerKey, l.ownerCmp, nil
+}
+
+// IsWriter reports if the datamanager can write wals: the writer lease is
+// disabled or it's held by this datamanager.
+func (d *DataManager) IsWriter() bool {
+	if !d.writerLease.enabled {
+		return true
+	}
+	_, _, err := d.writerLease.owner()
+	return err == nil
+}
+
+func (d *DataManager) writerLeaseLoop(ctx context.Context) {
+	for {
+		if err := d.writerLeaseCampaign(ctx); err != nil {
+			d.log.Errorf("wal writer lease error: %+v", err)
+		}
+
+		sleepCh := time.NewTimer(1 * time.Second).C
+		select {
+		case <-ctx.Done():
+			return
+		case <-sleepCh:
+		}
+	}
+}
+
+// writerLeaseCampaign waits to acquire the writer lease and then keeps it,
+// renewing it, until ctx is done or the lease is lost
+func (d *DataManager) writerLeaseCampaign(ctx context.Context) error {
+	l := &d.writerLease
+
+	session, err := concurrency.NewSession(d.e.Client(), concurrency.WithTTL(int(l.ttl/time.Second)), concurrency.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	m := etcd.NewMutex(session, etcdWalWriterLeaseKey)
+	if err := m.Lock(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	lostCh := l.acquired(m)
+	d.log.Infof("acquired the wal writer lease")
+
+	select {
+	case <-ctx.Done():
+		l.release()
+		// release the lease now to not make the next writer wait for its
+		// expiration
+		uctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = m.Unlock(uctx)
+		return nil
+	case <-session.Done():
+		l.release()
+		return errors.Errorf("wal writer lease expired")
+	case <-lostCh:
+		return errors.Errorf("wal writer lease lost")
+	}
+}
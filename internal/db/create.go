@@ -26,23 +26,16 @@ const dbVersionTableDDLTmpl = `
 	create table if not exists dbversion (version int not null, time timestamptz not null)
 `
 
-const dbVersion = 1
-
-func (db *DB) Create(ctx context.Context, stmts []string) error {
-	sb := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+var sb = sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
 
+// Version returns the version of the db schema, 0 if the db isn't yet created
+func (db *DB) Version(ctx context.Context) (int, error) {
+	var version sql.NullInt64
 	err := db.Do(ctx, func(tx *Tx) error {
 		if _, err := tx.Exec(dbVersionTableDDLTmpl); err != nil {
 			return errors.Errorf("failed to create dbversion table: %w", err)
 		}
-		return nil
-	})
-	if err != nil {
-		return err
-	}
 
-	err = db.Do(ctx, func(tx *Tx) error {
-		var version sql.NullInt64
 		q, args, err := sb.Select("max(version)").From("dbversion").ToSql()
 		if err != nil {
 			return err
@@ -50,17 +43,34 @@ func (db *DB) Create(ctx context.Context, stmts []string) error {
 		if err := tx.QueryRow(q, args...).Scan(&version); err != nil {
 			return errors.Errorf("cannot get current db version: %w", err)
 		}
-		if version.Valid {
-			return nil
-		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(version.Int64), nil
+}
+
+// Create creates the db schema executing stmts and saves its version. If the
+// db is already created nothing is done, also when it has a different version.
+func (db *DB) Create(ctx context.Context, dbVersion int, stmts []string) error {
+	curVersion, err := db.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if curVersion != 0 {
+		return nil
+	}
 
+	err = db.Do(ctx, func(tx *Tx) error {
 		for _, stmt := range stmts {
 			if _, err := tx.Exec(stmt); err != nil {
 				return errors.Errorf("creation failed: %w", err)
 			}
 		}
 
-		q, args, err = sb.Insert("dbversion").Columns("version", "time").Values(dbVersion, "now()").ToSql()
+		q, args, err := sb.Insert("dbversion").Columns("version", "time").Values(dbVersion, "now()").ToSql()
 		if err != nil {
 			return err
 		}
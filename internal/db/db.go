@@ -211,7 +211,8 @@ func (db *DB) do(ctx context.Context, f func(tx *Tx) error) error {
 }
 
 func (tx *Tx) Start(ctx context.Context) error {
-	wtx, err := tx.db.db.Begin()
+	// the transaction is rolled back when ctx is done
+	wtx, err := tx.db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
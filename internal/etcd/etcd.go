@@ -20,6 +20,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"agola.io/agola/internal/util"
@@ -58,6 +59,18 @@ type Config struct {
 	CAFile        string
 	SkipTLSVerify bool
 
+	Username string
+	Password string
+
+	// PoolSize is the number of etcd clients shared by all the stores with the
+	// same client configuration. The stores are assigned to the clients in
+	// round robin. Defaults to 1
+	PoolSize int
+	// KeepAliveTime and KeepAliveTimeout are the client keepalive settings.
+	// When KeepAliveTime is 0 no keepalive probes are sent
+	KeepAliveTime    time.Duration
+	KeepAliveTimeout time.Duration
+
 	CompactionInterval time.Duration
 }
 
@@ -71,15 +84,19 @@ func FromEtcdError(err error) error {
 
 type Store struct {
 	log *zap.SugaredLogger
-	c   *etcdclientv3.Client
+	// c is the shared pooled client with the kv, watcher and lease namespaced
+	// with the store prefix
+	c *etcdclientv3.Client
+
+	pc        *pooledClient
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	closeErr  error
 }
 
-func New(cfg Config) (*Store, error) {
-	prefix := cfg.Prefix
-	if prefix != "" && !strings.HasSuffix(prefix, "/") {
-		prefix += "/"
-	}
-
+// NewClientConfig returns the etcd client configuration from the store
+// configuration
+func NewClientConfig(cfg Config) (*etcdclientv3.Config, error) {
 	endpointsStr := cfg.Endpoints
 	if endpointsStr == "" {
 		endpointsStr = defaultEndpoints
@@ -113,30 +130,57 @@ func New(cfg Config) (*Store, error) {
 		}
 	}
 
-	config := etcdclientv3.Config{
-		Endpoints: endpoints,
-		TLS:       tlsConfig,
+	return &etcdclientv3.Config{
+		Endpoints:            endpoints,
+		TLS:                  tlsConfig,
+		Username:             cfg.Username,
+		Password:             cfg.Password,
+		DialKeepAliveTime:    cfg.KeepAliveTime,
+		DialKeepAliveTimeout: cfg.KeepAliveTimeout,
+	}, nil
+}
+
+// New returns a store using a client of the pool of clients with the same
+// configuration. The pool is created at the first use and its clients are
+// closed when all the stores using it are closed.
+func New(cfg Config) (*Store, error) {
+	prefix := cfg.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	config, err := NewClientConfig(cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	c, err := etcdclientv3.New(config)
+	pc, err := pool.get(cfg, config)
 	if err != nil {
 		return nil, err
 	}
+	sc := pc.c
 
-	c.KV = namespace.NewKV(c.KV, prefix)
-	c.Watcher = namespace.NewWatcher(c.Watcher, prefix)
-	c.Lease = namespace.NewLease(c.Lease, prefix)
+	c := etcdclientv3.NewCtxClient(sc.Ctx())
+	c.KV = namespace.NewKV(sc.KV, prefix)
+	c.Watcher = namespace.NewWatcher(sc.Watcher, prefix)
+	c.Lease = namespace.NewLease(sc.Lease, prefix)
+	c.Cluster = sc.Cluster
+	c.Auth = sc.Auth
+	c.Maintenance = sc.Maintenance
 
+	ctx, cancel := context.WithCancel(context.Background())
 	s := &Store{
-		log: cfg.Logger.Sugar(),
-		c:   c,
+		log:    cfg.Logger.Sugar(),
+		c:      c,
+		pc:     pc,
+		cancel: cancel,
 	}
 
 	compactionInterval := defaultCompactionInterval
 	if cfg.CompactionInterval != 0 {
 		compactionInterval = cfg.CompactionInterval
 	}
-	go s.compactor(context.TODO(), compactionInterval)
+	go s.compactor(ctx, compactionInterval)
 
 	return s, nil
 }
@@ -251,7 +295,7 @@ func (s *Store) AtomicPut(ctx context.Context, key string, value []byte, prevRev
 	etcdv3Options := []etcdclientv3.OpOption{}
 	if options != nil {
 		if options.TTL > 0 {
-			lease, err := s.c.Grant(ctx, int64(options.TTL))
+			lease, err := s.c.Grant(ctx, int64(options.TTL.Seconds()))
 			if err != nil {
 				return nil, err
 			}
@@ -333,8 +377,14 @@ func (s *Store) Watch(ctx context.Context, prefix string, revision int64) etcdcl
 	return s.c.Watch(ctx, prefix, etcdv3Options...)
 }
 
+// Close stops the store and releases its pooled client. The client is closed
+// only when it isn't used by other stores
 func (s *Store) Close() error {
-	return s.c.Close()
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.closeErr = pool.release(s.pc)
+	})
+	return s.closeErr
 }
 
 func (s *Store) compactor(ctx context.Context, interval time.Duration) {
@@ -0,0 +1,111 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"fmt"
+	"sync"
+
+	etcdclientv3 "go.etcd.io/etcd/clientv3"
+)
+
+const defaultPoolSize = 1
+
+// pool is the process wide pool of etcd clients. Stores created with the same
+// client configuration (i.e. by different services running in the same
+// process) reuse the same connections instead of opening new ones.
+var pool = &clientPool{clientSets: map[string]*clientSet{}}
+
+type clientPool struct {
+	mu         sync.Mutex
+	clientSets map[string]*clientSet
+}
+
+// clientSet are the clients of the pool with the same configuration
+type clientSet struct {
+	key     string
+	clients []*pooledClient
+	next    int
+	refs    int
+}
+
+type pooledClient struct {
+	c   *etcdclientv3.Client
+	set *clientSet
+}
+
+// poolKey returns the key identifying the clients with the same configuration.
+// The store prefix isn't part of the key since it's applied by every store.
+func poolKey(cfg Config) string {
+	return fmt.Sprintf("%q %q %q %q %t %q %q %d %d %d", cfg.Endpoints, cfg.CertFile, cfg.KeyFile, cfg.CAFile, cfg.SkipTLSVerify, cfg.Username, cfg.Password, cfg.PoolSize, cfg.KeepAliveTime, cfg.KeepAliveTimeout)
+}
+
+// get returns the next client of the set of clients with the provided
+// configuration, creating it if not yet existing
+func (p *clientPool) get(cfg Config, config *etcdclientv3.Config) (*pooledClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := poolKey(cfg)
+	cs, ok := p.clientSets[key]
+	if !ok {
+		size := cfg.PoolSize
+		if size <= 0 {
+			size = defaultPoolSize
+		}
+		cs = &clientSet{key: key, clients: make([]*pooledClient, size)}
+	}
+
+	i := cs.next % len(cs.clients)
+	pc := cs.clients[i]
+	if pc == nil {
+		c, err := etcdclientv3.New(*config)
+		if err != nil {
+			return nil, err
+		}
+		pc = &pooledClient{c: c, set: cs}
+		cs.clients[i] = pc
+	}
+	cs.next++
+	cs.refs++
+	p.clientSets[key] = cs
+
+	return pc, nil
+}
+
+// release releases a client returned by get. When the set of clients isn't
+// used anymore all its clients are closed
+func (p *clientPool) release(pc *pooledClient) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cs := pc.set
+	cs.refs--
+	if cs.refs > 0 {
+		return nil
+	}
+
+	delete(p.clientSets, cs.key)
+	var err error
+	for _, c := range cs.clients {
+		if c == nil {
+			continue
+		}
+		if cerr := c.c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/etcd"
+	"agola.io/agola/internal/testutil"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestClientPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t)
+
+	tetcd, err := testutil.NewTestEmbeddedEtcd(t, logger, dir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer func() { _ = tetcd.Kill() }()
+	if err := tetcd.Start(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := tetcd.WaitUp(30 * time.Second); err != nil {
+		t.Fatalf("error waiting on etcd up: %v", err)
+	}
+
+	ctx := context.Background()
+
+	newStore := func(t *testing.T, prefix string, poolSize int) *etcd.Store {
+		s, err := etcd.New(etcd.Config{Logger: logger, Endpoints: tetcd.Endpoint, Prefix: prefix, PoolSize: poolSize})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return s
+	}
+
+	t.Run("test stores with the same config share the client", func(t *testing.T) {
+		s1 := newStore(t, "configstore", 0)
+		defer s1.Close()
+		s2 := newStore(t, "runservice", 0)
+		defer s2.Close()
+
+		if etcd.PooledClient(s1) != etcd.PooledClient(s2) {
+			t.Fatalf("expected stores sharing the same client")
+		}
+
+		// the keys are still namespaced by the store prefix
+		if _, err := s1.Put(ctx, "key01", []byte("value01"), nil); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := s2.Get(ctx, "key01", 0); err != etcd.ErrKeyNotFound {
+			t.Fatalf("expected err %v, got: %v", etcd.ErrKeyNotFound, err)
+		}
+		resp, err := s1.Get(ctx, "key01", 0)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if string(resp.Kvs[0].Value) != "value01" {
+			t.Fatalf("expected value %q, got %q", "value01", resp.Kvs[0].Value)
+		}
+	})
+
+	t.Run("test stores use the pool clients in round robin", func(t *testing.T) {
+		s1 := newStore(t, "s1", 2)
+		defer s1.Close()
+		s2 := newStore(t, "s2", 2)
+		defer s2.Close()
+		s3 := newStore(t, "s3", 2)
+		defer s3.Close()
+		s4 := newStore(t, "s4", 0)
+		defer s4.Close()
+
+		if etcd.PooledClient(s1) == etcd.PooledClient(s2) {
+			t.Fatalf("expected stores using different pool clients")
+		}
+		if etcd.PooledClient(s1) != etcd.PooledClient(s3) {
+			t.Fatalf("expected stores sharing the same client")
+		}
+		if etcd.PooledClient(s4) == etcd.PooledClient(s1) || etcd.PooledClient(s4) == etcd.PooledClient(s2) {
+			t.Fatalf("expected stores with a different config using a different client")
+		}
+	})
+
+	t.Run("test client is closed when not used anymore", func(t *testing.T) {
+		s1 := newStore(t, "s1", 0)
+		s2 := newStore(t, "s2", 0)
+
+		if err := s1.Close(); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		// closing again is a no op
+		if err := s1.Close(); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := s2.Put(ctx, "key01", []byte("value01"), nil); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		c := etcd.PooledClient(s2)
+		if err := s2.Close(); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		// the embedded etcd test store still uses the client
+		if err := c.Ctx().Err(); err != nil {
+			t.Fatalf("expected client not closed, got: %v", err)
+		}
+		if err := tetcd.TestEtcd.Store.Close(); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if err := c.Ctx().Err(); err != context.Canceled {
+			t.Fatalf("expected client closed, got: %v", err)
+		}
+
+		s3 := newStore(t, "s3", 0)
+		defer s3.Close()
+		if etcd.PooledClient(s3) == c {
+			t.Fatalf("expected a new client")
+		}
+		if _, err := s3.Put(ctx, "key01", []byte("value01"), nil); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
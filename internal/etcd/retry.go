@@ -0,0 +1,94 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"context"
+	"time"
+
+	"agola.io/agola/internal/util"
+
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	DefaultMaxRetries     = 5
+	DefaultRetryBaseDelay = 200 * time.Millisecond
+)
+
+// transientErrors are the errors returned by etcd while it's electing a new
+// leader or when it cannot reach the quorum
+var transientErrors = []error{
+	rpctypes.ErrNoLeader,
+	rpctypes.ErrLeaderChanged,
+	rpctypes.ErrNotCapable,
+	rpctypes.ErrStopped,
+	rpctypes.ErrTimeout,
+	rpctypes.ErrTimeoutDueToLeaderFail,
+	rpctypes.ErrTimeoutDueToConnectionLost,
+	rpctypes.ErrUnhealthy,
+}
+
+// IsTransientError reports if the error is caused by a temporary etcd
+// unavailability (i.e. a leader election) and the operation could be retried
+// later
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, terr := range transientErrors {
+		if errors.Is(err, terr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNotAppliedError reports if the error is returned by etcd before the
+// request was proposed to the cluster, so also a write could be safely
+// retried
+func IsNotAppliedError(err error) bool {
+	return errors.Is(err, rpctypes.ErrNoLeader)
+}
+
+// Retry calls f until it succeeds, it returns an error for which retriable is
+// false or maxRetries is reached. The retries are done with an exponential
+// backoff starting from baseDelay and stop when ctx is done.
+func Retry(ctx context.Context, maxRetries int, baseDelay time.Duration, retriable func(error) bool, f func() error) error {
+	delay := baseDelay
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || i >= maxRetries || !retriable(err) {
+			return err
+		}
+
+		wait := util.Jitter(delay, 0.1)
+		// don't wait if the context deadline will be reached before the next
+		// retry
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
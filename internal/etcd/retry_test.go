@@ -0,0 +1,111 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/etcd"
+
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	errors "golang.org/x/xerrors"
+)
+
+// fakeEtcdOp simulates an etcd operation failing with err for the first
+// failures calls
+type fakeEtcdOp struct {
+	err      error
+	failures int
+	calls    int
+}
+
+func (o *fakeEtcdOp) do() error {
+	o.calls++
+	if o.calls <= o.failures {
+		return o.err
+	}
+	return nil
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{err: nil},
+		{err: rpctypes.ErrNoLeader, transient: true},
+		{err: rpctypes.ErrLeaderChanged, transient: true},
+		{err: rpctypes.ErrTimeoutDueToLeaderFail, transient: true},
+		{err: rpctypes.ErrUnhealthy, transient: true},
+		{err: errors.Errorf("watch error: %w", rpctypes.ErrNoLeader), transient: true},
+		{err: rpctypes.ErrCompacted},
+		{err: etcd.ErrKeyNotFound},
+		{err: context.Canceled},
+	}
+
+	for _, tt := range tests {
+		if transient := etcd.IsTransientError(tt.err); transient != tt.transient {
+			t.Errorf("expected error %v transient %t, got %t", tt.err, tt.transient, transient)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("recovers after a leader election", func(t *testing.T) {
+		op := &fakeEtcdOp{err: rpctypes.ErrNoLeader, failures: 3}
+		if err := etcd.Retry(ctx, 5, time.Millisecond, etcd.IsTransientError, op.do); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if op.calls != 4 {
+			t.Fatalf("expected 4 calls, got %d", op.calls)
+		}
+	})
+
+	t.Run("gives up after max retries", func(t *testing.T) {
+		op := &fakeEtcdOp{err: rpctypes.ErrNoLeader, failures: 10}
+		if err := etcd.Retry(ctx, 2, time.Millisecond, etcd.IsTransientError, op.do); !errors.Is(err, rpctypes.ErrNoLeader) {
+			t.Fatalf("expected no leader error, got: %v", err)
+		}
+		if op.calls != 3 {
+			t.Fatalf("expected 3 calls, got %d", op.calls)
+		}
+	})
+
+	t.Run("doesn't retry not retriable errors", func(t *testing.T) {
+		op := &fakeEtcdOp{err: rpctypes.ErrLeaderChanged, failures: 1}
+		if err := etcd.Retry(ctx, 5, time.Millisecond, etcd.IsNotAppliedError, op.do); !errors.Is(err, rpctypes.ErrLeaderChanged) {
+			t.Fatalf("expected leader changed error, got: %v", err)
+		}
+		if op.calls != 1 {
+			t.Fatalf("expected 1 call, got %d", op.calls)
+		}
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		op := &fakeEtcdOp{err: rpctypes.ErrNoLeader, failures: 10}
+		if err := etcd.Retry(cctx, 5, time.Second, etcd.IsTransientError, op.do); !errors.Is(err, rpctypes.ErrNoLeader) {
+			t.Fatalf("expected no leader error, got: %v", err)
+		}
+		if op.calls != 1 {
+			t.Fatalf("expected 1 call, got %d", op.calls)
+		}
+	})
+}
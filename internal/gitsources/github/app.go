@@ -0,0 +1,125 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package github
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	// appJWTExpiration is the expiration of the jwt used to authenticate as
+	// the app. GitHub accepts a max of 10 minutes.
+	appJWTExpiration = 9 * time.Minute
+	// appJWTClockSkew is subtracted from the jwt issue time to handle clock
+	// differences with the github server
+	appJWTClockSkew = 60 * time.Second
+)
+
+type AppOpts struct {
+	APIURL         string
+	SkipVerify     bool
+	AppID          int64
+	InstallationID int64
+	// PrivateKey is the PEM encoded app private key
+	PrivateKey []byte
+}
+
+type AppInstallationToken struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+// ValidateAppPrivateKey checks that the provided app private key is a valid
+// PEM encoded RSA private key
+func ValidateAppPrivateKey(privateKey []byte) error {
+	if _, err := jwt.ParseRSAPrivateKeyFromPEM(privateKey); err != nil {
+		return errors.Errorf("failed to parse app private key: %w", err)
+	}
+	return nil
+}
+
+// appJWT generates the jwt used to authenticate as the github app
+func appJWT(appID int64, privateKey []byte, now time.Time) (string, error) {
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(privateKey)
+	if err != nil {
+		return "", errors.Errorf("failed to parse app private key: %w", err)
+	}
+
+	claims := jwt.StandardClaims{
+		IssuedAt:  now.Add(-appJWTClockSkew).Unix(),
+		ExpiresAt: now.Add(appJWTExpiration).Unix(),
+		Issuer:    strconv.FormatInt(appID, 10),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+}
+
+// CreateAppInstallationToken creates a new installation access token for the
+// github app installation
+func CreateAppInstallationToken(ctx context.Context, opts AppOpts) (*AppInstallationToken, error) {
+	token, err := appJWT(opts.AppID, opts.PrivateKey, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := New(Opts{
+		APIURL:     opts.APIURL,
+		SkipVerify: opts.SkipVerify,
+		Token:      token,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	itoken, _, err := c.client.Apps.CreateInstallationToken(ctx, opts.InstallationID, nil)
+	if err != nil {
+		return nil, errors.Errorf("failed to create installation token for installation %d: %w", opts.InstallationID, err)
+	}
+
+	return &AppInstallationToken{
+		Token:     itoken.GetToken(),
+		ExpiresAt: itoken.GetExpiresAt(),
+	}, nil
+}
+
+// GetAppInstallationAccount returns the login of the account where the github
+// app is installed. Since it authenticates as the app it's used to verify the
+// app credentials
+func GetAppInstallationAccount(ctx context.Context, opts AppOpts) (string, error) {
+	token, err := appJWT(opts.AppID, opts.PrivateKey, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	c, err := New(Opts{
+		APIURL:     opts.APIURL,
+		SkipVerify: opts.SkipVerify,
+		Token:      token,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	installation, _, err := c.client.Apps.GetInstallation(ctx, opts.InstallationID)
+	if err != nil {
+		return "", errors.Errorf("failed to get installation %d: %w", opts.InstallationID, err)
+	}
+
+	return installation.GetAccount().GetLogin(), nil
+}
@@ -418,11 +418,12 @@ func (c *Client) ListUserRepos() ([]*gitsource.RepoInfo, error) {
 
 func fromGithubRepo(rr *github.Repository) *gitsource.RepoInfo {
 	return &gitsource.RepoInfo{
-		ID:           strconv.FormatInt(*rr.ID, 10),
-		Path:         path.Join(*rr.Owner.Login, *rr.Name),
-		HTMLURL:      *rr.HTMLURL,
-		SSHCloneURL:  *rr.SSHURL,
-		HTTPCloneURL: *rr.CloneURL,
+		ID:            strconv.FormatInt(*rr.ID, 10),
+		Path:          path.Join(*rr.Owner.Login, *rr.Name),
+		HTMLURL:       *rr.HTMLURL,
+		SSHCloneURL:   *rr.SSHURL,
+		HTTPCloneURL:  *rr.CloneURL,
+		DefaultBranch: rr.GetDefaultBranch(),
 	}
 }
 
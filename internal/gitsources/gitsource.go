@@ -86,6 +86,9 @@ type RepoInfo struct {
 	HTMLURL      string
 	SSHCloneURL  string
 	HTTPCloneURL string
+	// DefaultBranch is the repository default branch. It's empty when not
+	// provided by the git source
+	DefaultBranch string
 }
 
 type UserInfo struct {
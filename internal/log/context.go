@@ -0,0 +1,47 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// RequestIDKey is the log field containing the request id
+const RequestIDKey = "requestID"
+
+type requestIDContextKey struct{}
+
+// WithRequestID returns a copy of ctx containing the provided request id
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// RequestID returns the request id saved in ctx or an empty string
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// WithContext returns a logger that adds to every entry the request id saved
+// in ctx. If ctx doesn't contain a request id the provided logger is returned.
+func WithContext(ctx context.Context, l *zap.SugaredLogger) *zap.SugaredLogger {
+	requestID := RequestID(ctx)
+	if requestID == "" {
+		return l
+	}
+	return l.With(RequestIDKey, requestID)
+}
@@ -0,0 +1,225 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objectstorage
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	errors "golang.org/x/xerrors"
+)
+
+// MigratingStorage is a Storage whose objects are being migrated from an old
+// storage.
+// Until the migration is completed the objects are read from the new storage
+// or, when missing, from the old one and are listed from both. The objects are
+// always written to the new storage and deleted from both.
+type MigratingStorage struct {
+	Storage
+	old Storage
+
+	completed   bool
+	completedMu sync.RWMutex
+
+	// copyMu serializes the objects copies with the writes and the deletes so
+	// an object copy won't overwrite a newer object or restore a deleted one
+	copyMu sync.Mutex
+}
+
+func NewMigratingStorage(s, old Storage) *MigratingStorage {
+	return &MigratingStorage{Storage: s, old: old}
+}
+
+// oldStorage returns the old storage or nil if the migration is completed
+func (s *MigratingStorage) oldStorage() Storage {
+	s.completedMu.RLock()
+	defer s.completedMu.RUnlock()
+	if s.completed {
+		return nil
+	}
+	return s.old
+}
+
+// Completed reports if the migration is completed
+func (s *MigratingStorage) Completed() bool {
+	return s.oldStorage() == nil
+}
+
+func (s *MigratingStorage) Stat(p string) (*ObjectInfo, error) {
+	oi, err := s.Storage.Stat(p)
+	if IsNotExist(err) {
+		if old := s.oldStorage(); old != nil {
+			return old.Stat(p)
+		}
+	}
+	return oi, err
+}
+
+func (s *MigratingStorage) ReadObject(p string) (ReadSeekCloser, error) {
+	r, err := s.Storage.ReadObject(p)
+	if IsNotExist(err) {
+		if old := s.oldStorage(); old != nil {
+			return old.ReadObject(p)
+		}
+	}
+	return r, err
+}
+
+func (s *MigratingStorage) WriteObject(p string, data io.Reader, size int64, persist bool) error {
+	if s.oldStorage() != nil {
+		s.copyMu.Lock()
+		defer s.copyMu.Unlock()
+	}
+	return s.Storage.WriteObject(p, data, size, persist)
+}
+
+// DeleteObject deletes the object from both the storages. It returns a not
+// exist error only if the object doesn't exist in both.
+func (s *MigratingStorage) DeleteObject(p string) error {
+	old := s.oldStorage()
+	if old == nil {
+		return s.Storage.DeleteObject(p)
+	}
+
+	s.copyMu.Lock()
+	defer s.copyMu.Unlock()
+
+	err := s.Storage.DeleteObject(p)
+	if err != nil && !IsNotExist(err) {
+		return err
+	}
+	oldErr := old.DeleteObject(p)
+	if oldErr != nil && !IsNotExist(oldErr) {
+		return oldErr
+	}
+	if err != nil && oldErr != nil {
+		return err
+	}
+	return nil
+}
+
+// List merges the sorted objects lists of both the storages
+func (s *MigratingStorage) List(prefix, startWith, delimiter string, doneCh <-chan struct{}) <-chan ObjectInfo {
+	old := s.oldStorage()
+	if old == nil {
+		return s.Storage.List(prefix, startWith, delimiter, doneCh)
+	}
+
+	objectCh := make(chan ObjectInfo, 1)
+
+	go func() {
+		defer close(objectCh)
+
+		// the lists could be stopped before being fully read
+		listDoneCh := make(chan struct{})
+		defer close(listDoneCh)
+
+		newCh := s.Storage.List(prefix, startWith, delimiter, listDoneCh)
+		oldCh := old.List(prefix, startWith, delimiter, listDoneCh)
+
+		newObject, newOk := <-newCh
+		oldObject, oldOk := <-oldCh
+		for newOk || oldOk {
+			var object ObjectInfo
+			switch {
+			case newOk && newObject.Err != nil:
+				object, newOk, oldOk = newObject, false, false
+			case oldOk && oldObject.Err != nil:
+				object, newOk, oldOk = oldObject, false, false
+			case !oldOk || (newOk && newObject.Path <= oldObject.Path):
+				if oldOk && newObject.Path == oldObject.Path {
+					oldObject, oldOk = <-oldCh
+				}
+				object = newObject
+				newObject, newOk = <-newCh
+			default:
+				object = oldObject
+				oldObject, oldOk = <-oldCh
+			}
+
+			select {
+			case objectCh <- object:
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+
+	return objectCh
+}
+
+// Migrate copies to the new storage all the objects of the old storage
+// missing from it. When done the migration is completed and the old storage
+// won't be used anymore. It returns the number of copied objects.
+func (s *MigratingStorage) Migrate(ctx context.Context) (int, error) {
+	if s.oldStorage() == nil {
+		return 0, nil
+	}
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	copied := 0
+	for object := range s.old.List("", "", "", doneCh) {
+		if object.Err != nil {
+			return copied, object.Err
+		}
+		if err := ctx.Err(); err != nil {
+			return copied, err
+		}
+		ok, err := s.copyObject(object.Path, object.Size)
+		if err != nil {
+			return copied, errors.Errorf("failed to copy object %q: %w", object.Path, err)
+		}
+		if ok {
+			copied++
+		}
+	}
+
+	s.completedMu.Lock()
+	s.completed = true
+	s.completedMu.Unlock()
+
+	return copied, nil
+}
+
+// copyObject copies an object from the old storage if missing from the new
+// one
+func (s *MigratingStorage) copyObject(p string, size int64) (bool, error) {
+	s.copyMu.Lock()
+	defer s.copyMu.Unlock()
+
+	if _, err := s.Storage.Stat(p); err == nil {
+		return false, nil
+	} else if !IsNotExist(err) {
+		return false, err
+	}
+
+	r, err := s.old.ReadObject(p)
+	if err != nil {
+		// removed since listed
+		if IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer r.Close()
+
+	if err := s.Storage.WriteObject(p, r, size, true); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objectstorage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeObjects(t *testing.T, s Storage, objects map[string]string) {
+	for p, data := range objects {
+		if err := s.WriteObject(p, bytes.NewReader([]byte(data)), int64(len(data)), true); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+}
+
+func readObject(t *testing.T, s Storage, p string) string {
+	r, err := s.ReadObject(p)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	return string(data)
+}
+
+func listObjects(t *testing.T, s *ObjStorage, prefix, startWith string) []string {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	paths := []string{}
+	for object := range s.List(prefix, startWith, true, doneCh) {
+		if object.Err != nil {
+			t.Fatalf("unexpected err: %v", object.Err)
+		}
+		paths = append(paths, object.Path)
+	}
+	return paths
+}
+
+func TestMigratingStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objectstorage")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	olds, err := NewPosix(filepath.Join(dir, "old"))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	news, err := NewPosix(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	writeObjects(t, olds, map[string]string{
+		"wals/01": "old01",
+		"wals/02": "old02",
+		"wals/04": "old04",
+		"data/01": "olddata01",
+	})
+	writeObjects(t, news, map[string]string{
+		"wals/02": "new02",
+		"wals/03": "new03",
+	})
+
+	ms := NewMigratingStorage(news, olds)
+	s := NewObjStorage(ms, "/")
+
+	t.Run("test read from both storages", func(t *testing.T) {
+		for p, expected := range map[string]string{
+			"wals/01": "old01",
+			"wals/02": "new02",
+			"wals/03": "new03",
+			"data/01": "olddata01",
+		} {
+			if data := readObject(t, ms, p); data != expected {
+				t.Fatalf("expected object %q data %q, got %q", p, expected, data)
+			}
+			oi, err := s.Stat(p)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if oi.Size != int64(len(expected)) {
+				t.Fatalf("expected object %q size %d, got %d", p, len(expected), oi.Size)
+			}
+		}
+		if _, err := s.ReadObject("wals/05"); !IsNotExist(err) {
+			t.Fatalf("expected not exist error, got: %v", err)
+		}
+		if _, err := s.Stat("wals/05"); !IsNotExist(err) {
+			t.Fatalf("expected not exist error, got: %v", err)
+		}
+	})
+
+	t.Run("test list from both storages", func(t *testing.T) {
+		expected := []string{"wals/01", "wals/02", "wals/03", "wals/04"}
+		if paths := listObjects(t, s, "wals/", ""); !reflect.DeepEqual(paths, expected) {
+			t.Fatalf("expected objects %v, got %v", expected, paths)
+		}
+		expected = []string{"wals/03", "wals/04"}
+		if paths := listObjects(t, s, "wals/", "wals/02"); !reflect.DeepEqual(paths, expected) {
+			t.Fatalf("expected objects %v, got %v", expected, paths)
+		}
+	})
+
+	t.Run("test write to the new storage", func(t *testing.T) {
+		writeObjects(t, ms, map[string]string{"wals/05": "new05"})
+		if data := readObject(t, news, "wals/05"); data != "new05" {
+			t.Fatalf("expected object data %q, got %q", "new05", data)
+		}
+		if _, err := olds.Stat("wals/05"); !IsNotExist(err) {
+			t.Fatalf("expected not exist error, got: %v", err)
+		}
+	})
+
+	t.Run("test delete from both storages", func(t *testing.T) {
+		for _, p := range []string{"wals/01", "wals/02"} {
+			if err := s.DeleteObject(p); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if _, err := s.Stat(p); !IsNotExist(err) {
+				t.Fatalf("expected not exist error, got: %v", err)
+			}
+		}
+		if err := s.DeleteObject("wals/01"); !IsNotExist(err) {
+			t.Fatalf("expected not exist error, got: %v", err)
+		}
+		expected := []string{"wals/03", "wals/04", "wals/05"}
+		if paths := listObjects(t, s, "wals/", ""); !reflect.DeepEqual(paths, expected) {
+			t.Fatalf("expected objects %v, got %v", expected, paths)
+		}
+	})
+
+	t.Run("test migrate", func(t *testing.T) {
+		if ms.Completed() {
+			t.Fatalf("expected migration not completed")
+		}
+		copied, err := ms.Migrate(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if copied != 2 {
+			t.Fatalf("expected 2 copied objects, got %d", copied)
+		}
+		if !ms.Completed() {
+			t.Fatalf("expected migration completed")
+		}
+		for p, expected := range map[string]string{
+			"wals/03": "new03",
+			"wals/04": "old04",
+			"data/01": "olddata01",
+		} {
+			if data := readObject(t, news, p); data != expected {
+				t.Fatalf("expected object %q data %q, got %q", p, expected, data)
+			}
+		}
+
+		// the old storage isn't used anymore
+		writeObjects(t, olds, map[string]string{"wals/06": "old06"})
+		if _, err := s.ReadObject("wals/06"); !IsNotExist(err) {
+			t.Fatalf("expected not exist error, got: %v", err)
+		}
+		expected := []string{"wals/03", "wals/04", "wals/05"}
+		if paths := listObjects(t, s, "wals/", ""); !reflect.DeepEqual(paths, expected) {
+			t.Fatalf("expected objects %v, got %v", expected, paths)
+		}
+	})
+}
+
+func TestPrefixStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objectstorage")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ps, err := NewPosix(dir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	walss := NewPrefixStorage(ps, "/wals/")
+	datas := NewPrefixStorage(ps, "data")
+
+	writeObjects(t, walss, map[string]string{"status/01": "wal01", "status/02": "wal02"})
+	writeObjects(t, datas, map[string]string{"status/01": "data01"})
+
+	if data := readObject(t, ps, "wals/status/01"); data != "wal01" {
+		t.Fatalf("expected object data %q, got %q", "wal01", data)
+	}
+	if data := readObject(t, datas, "status/01"); data != "data01" {
+		t.Fatalf("expected object data %q, got %q", "data01", data)
+	}
+	oi, err := walss.Stat("status/02")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if oi.Path != "status/02" {
+		t.Fatalf("expected object path %q, got %q", "status/02", oi.Path)
+	}
+
+	expected := []string{"status/01", "status/02"}
+	if paths := listObjects(t, NewObjStorage(walss, "/"), "status/", ""); !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("expected objects %v, got %v", expected, paths)
+	}
+	expected = []string{"status/02"}
+	if paths := listObjects(t, NewObjStorage(walss, "/"), "status/", "status/01"); !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("expected objects %v, got %v", expected, paths)
+	}
+
+	if err := walss.DeleteObject("status/01"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := ps.Stat("wals/status/01"); !IsNotExist(err) {
+		t.Fatalf("expected not exist error, got: %v", err)
+	}
+	if _, err := ps.Stat("data/status/01"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
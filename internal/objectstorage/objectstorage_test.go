@@ -43,7 +43,7 @@ func setupS3(t *testing.T, dir string) (*S3Storage, error) {
 		return nil, nil
 	}
 
-	return NewS3(filepath.Base(dir), "", minioEndpoint, minioAccessKey, minioSecretKey, false)
+	return NewS3(filepath.Base(dir), "", minioEndpoint, minioAccessKey, minioSecretKey, false, true)
 }
 
 func TestList(t *testing.T) {
@@ -0,0 +1,85 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objectstorage
+
+import (
+	"io"
+	"strings"
+)
+
+// PrefixStorage wraps a Storage saving the objects under a path prefix, so
+// different data can share the same storage (i.e. the same s3 bucket).
+// The object paths provided to and returned by its methods don't contain the
+// prefix.
+type PrefixStorage struct {
+	Storage
+	prefix string
+}
+
+func NewPrefixStorage(s Storage, prefix string) *PrefixStorage {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &PrefixStorage{Storage: s, prefix: prefix}
+}
+
+func (s *PrefixStorage) path(p string) string {
+	return s.prefix + strings.TrimPrefix(p, "/")
+}
+
+func (s *PrefixStorage) Stat(p string) (*ObjectInfo, error) {
+	oi, err := s.Storage.Stat(s.path(p))
+	if err != nil {
+		return nil, err
+	}
+	oi.Path = strings.TrimPrefix(oi.Path, s.prefix)
+	return oi, nil
+}
+
+func (s *PrefixStorage) ReadObject(p string) (ReadSeekCloser, error) {
+	return s.Storage.ReadObject(s.path(p))
+}
+
+func (s *PrefixStorage) WriteObject(p string, data io.Reader, size int64, persist bool) error {
+	return s.Storage.WriteObject(s.path(p), data, size, persist)
+}
+
+func (s *PrefixStorage) DeleteObject(p string) error {
+	return s.Storage.DeleteObject(s.path(p))
+}
+
+func (s *PrefixStorage) List(prefix, startWith, delimiter string, doneCh <-chan struct{}) <-chan ObjectInfo {
+	if startWith != "" {
+		startWith = s.path(startWith)
+	}
+	objectCh := make(chan ObjectInfo, 1)
+
+	go func() {
+		defer close(objectCh)
+		for object := range s.Storage.List(s.path(prefix), startWith, delimiter, doneCh) {
+			if object.Err == nil {
+				object.Path = strings.TrimPrefix(object.Path, s.prefix)
+			}
+			select {
+			case objectCh <- object:
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+
+	return objectCh
+}
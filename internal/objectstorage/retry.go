@@ -0,0 +1,158 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objectstorage
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"agola.io/agola/internal/util"
+
+	minio "github.com/minio/minio-go/v6"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	DefaultMaxRetries     = 3
+	DefaultRetryBaseDelay = 100 * time.Millisecond
+)
+
+// RetryStorage wraps a Storage retrying, with an exponential backoff, the
+// operations failed with a transient error.
+// List isn't retried since its results are streamed.
+type RetryStorage struct {
+	Storage
+
+	// ctx is used to stop retrying, usually it's the service context so
+	// retries won't block its shutdown
+	ctx        context.Context
+	maxRetries int
+	baseDelay  time.Duration
+}
+
+func NewRetryStorage(ctx context.Context, s Storage, maxRetries int, baseDelay time.Duration) *RetryStorage {
+	return &RetryStorage{
+		Storage:    s,
+		ctx:        ctx,
+		maxRetries: maxRetries,
+		baseDelay:  baseDelay,
+	}
+}
+
+// IsRetriable reports if the error returned by a storage operation is a
+// transient error and the operation could be retried
+func IsRetriable(err error) bool {
+	if err == nil || IsNotExist(err) {
+		return false
+	}
+
+	var merr minio.ErrorResponse
+	if errors.As(err, &merr) && merr.StatusCode != 0 {
+		return merr.StatusCode >= http.StatusInternalServerError ||
+			merr.StatusCode == http.StatusTooManyRequests ||
+			merr.StatusCode == http.StatusRequestTimeout
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return true
+	}
+
+	// an operation cancelled by a TimeoutStorage
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (s *RetryStorage) retry(f func() error) error {
+	delay := s.baseDelay
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || i >= s.maxRetries || !IsRetriable(err) {
+			return err
+		}
+
+		wait := util.Jitter(delay, 0.1)
+		// don't wait if the context deadline will be reached before the next
+		// retry
+		if deadline, ok := s.ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+func (s *RetryStorage) Stat(p string) (*ObjectInfo, error) {
+	var oi *ObjectInfo
+	err := s.retry(func() error {
+		var err error
+		oi, err = s.Storage.Stat(p)
+		return err
+	})
+	return oi, err
+}
+
+func (s *RetryStorage) ReadObject(p string) (ReadSeekCloser, error) {
+	var r ReadSeekCloser
+	err := s.retry(func() error {
+		var err error
+		r, err = s.Storage.ReadObject(p)
+		return err
+	})
+	return r, err
+}
+
+// WriteObject retries the write only if data is an io.Seeker since it must
+// be read again from the start
+func (s *RetryStorage) WriteObject(p string, data io.Reader, size int64, persist bool) error {
+	seeker, ok := data.(io.Seeker)
+	if !ok {
+		return s.Storage.WriteObject(p, data, size, persist)
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return s.Storage.WriteObject(p, data, size, persist)
+	}
+
+	first := true
+	return s.retry(func() error {
+		if !first {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		first = false
+		return s.Storage.WriteObject(p, data, size, persist)
+	})
+}
+
+func (s *RetryStorage) DeleteObject(p string) error {
+	return s.retry(func() error {
+		return s.Storage.DeleteObject(p)
+	})
+}
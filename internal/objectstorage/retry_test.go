@@ -0,0 +1,233 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objectstorage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v6"
+	errors "golang.org/x/xerrors"
+)
+
+// failingStorage is a fake storage that fails the first failures calls with
+// err and then succeeds
+type failingStorage struct {
+	failures int
+	err      error
+
+	calls   int
+	written []byte
+}
+
+func (s *failingStorage) do() error {
+	s.calls++
+	if s.calls <= s.failures {
+		return s.err
+	}
+	return nil
+}
+
+func (s *failingStorage) Stat(p string) (*ObjectInfo, error) {
+	if err := s.do(); err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Path: p}, nil
+}
+
+func (s *failingStorage) ReadObject(p string) (ReadSeekCloser, error) {
+	return nil, s.do()
+}
+
+func (s *failingStorage) WriteObject(p string, data io.Reader, size int64, persist bool) error {
+	// consume data also on failure to check that it's read again on retry
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	if err := s.do(); err != nil {
+		return err
+	}
+	s.written = b
+	return nil
+}
+
+func (s *failingStorage) DeleteObject(p string) error {
+	return s.do()
+}
+
+func (s *failingStorage) List(prefix, startWith, delimiter string, doneCh <-chan struct{}) <-chan ObjectInfo {
+	ch := make(chan ObjectInfo)
+	close(ch)
+	return ch
+}
+
+var errTransient = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func TestRetryStorage(t *testing.T) {
+	tests := []struct {
+		name          string
+		failures      int
+		err           error
+		maxRetries    int
+		expectedCalls int
+		expectedErr   bool
+	}{
+		{
+			name:          "succeeds after transient errors",
+			failures:      2,
+			err:           errTransient,
+			maxRetries:    3,
+			expectedCalls: 3,
+		},
+		{
+			name:          "fails after max retries",
+			failures:      5,
+			err:           errTransient,
+			maxRetries:    3,
+			expectedCalls: 4,
+			expectedErr:   true,
+		},
+		{
+			name:          "retries on s3 server errors",
+			failures:      1,
+			err:           minio.ErrorResponse{StatusCode: http.StatusServiceUnavailable},
+			maxRetries:    3,
+			expectedCalls: 2,
+		},
+		{
+			name:          "doesn't retry on not exist errors",
+			failures:      1,
+			err:           NewErrNotExist(errors.Errorf("object doesn't exist")),
+			maxRetries:    3,
+			expectedCalls: 1,
+			expectedErr:   true,
+		},
+		{
+			name:          "doesn't retry on s3 auth errors",
+			failures:      1,
+			err:           minio.ErrorResponse{StatusCode: http.StatusForbidden, Code: "AccessDenied"},
+			maxRetries:    3,
+			expectedCalls: 1,
+			expectedErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			ops := map[string]func(s *RetryStorage) error{
+				"stat": func(s *RetryStorage) error {
+					_, err := s.Stat("object")
+					return err
+				},
+				"read": func(s *RetryStorage) error {
+					_, err := s.ReadObject("object")
+					return err
+				},
+				"write": func(s *RetryStorage) error {
+					return s.WriteObject("object", bytes.NewReader([]byte("data")), -1, false)
+				},
+				"delete": func(s *RetryStorage) error {
+					return s.DeleteObject("object")
+				},
+			}
+
+			for opName, op := range ops {
+				fs := &failingStorage{failures: tt.failures, err: tt.err}
+				s := NewRetryStorage(ctx, fs, tt.maxRetries, 1*time.Millisecond)
+
+				err := op(s)
+				if tt.expectedErr && err == nil {
+					t.Fatalf("%s: expected error, got nil error", opName)
+				}
+				if !tt.expectedErr && err != nil {
+					t.Fatalf("%s: unexpected err: %v", opName, err)
+				}
+				if fs.calls != tt.expectedCalls {
+					t.Fatalf("%s: expected %d calls, got %d", opName, tt.expectedCalls, fs.calls)
+				}
+				if opName == "write" && !tt.expectedErr && string(fs.written) != "data" {
+					t.Fatalf("expected written data %q, got %q", "data", fs.written)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryStorageNotSeekableWrite(t *testing.T) {
+	fs := &failingStorage{failures: 1, err: errTransient}
+	s := NewRetryStorage(context.Background(), fs, 3, 1*time.Millisecond)
+
+	// a not seekable reader cannot be read again so the write must not be
+	// retried
+	if err := s.WriteObject("object", ioutil.NopCloser(bytes.NewReader([]byte("data"))), -1, false); err == nil {
+		t.Fatalf("expected error, got nil error")
+	}
+	if fs.calls != 1 {
+		t.Fatalf("expected 1 call, got %d", fs.calls)
+	}
+}
+
+func TestRetryStorageContext(t *testing.T) {
+	t.Run("stops retrying when the context is canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		fs := &failingStorage{failures: 10, err: errTransient}
+		s := NewRetryStorage(ctx, fs, 10, 1*time.Hour)
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+		}()
+
+		start := time.Now()
+		if err := s.DeleteObject("object"); err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("retry not stopped by context cancel")
+		}
+		if fs.calls != 1 {
+			t.Fatalf("expected 1 call, got %d", fs.calls)
+		}
+	})
+
+	t.Run("doesn't retry after the context deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		fs := &failingStorage{failures: 10, err: errTransient}
+		s := NewRetryStorage(ctx, fs, 10, 200*time.Millisecond)
+
+		start := time.Now()
+		if err := s.DeleteObject("object"); err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if time.Since(start) > 500*time.Millisecond {
+			t.Fatalf("retry continued after the context deadline")
+		}
+		// first call and a retry after 200ms, the next retry after 400ms
+		// would be after the deadline
+		if fs.calls != 2 {
+			t.Fatalf("expected 2 calls, got %d", fs.calls)
+		}
+	})
+}
@@ -15,6 +15,7 @@
 package objectstorage
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -22,27 +23,54 @@ import (
 	"strings"
 
 	minio "github.com/minio/minio-go/v6"
+	"github.com/minio/minio-go/v6/pkg/credentials"
+	"github.com/minio/minio-go/v6/pkg/encrypt"
 	errors "golang.org/x/xerrors"
 )
 
+// ServerSideEncryptionType is the type of the server side encryption of the
+// s3 objects
+type ServerSideEncryptionType string
+
+const (
+	// ServerSideEncryptionS3 encrypts the objects with keys managed by s3
+	ServerSideEncryptionS3 ServerSideEncryptionType = "sse-s3"
+	// ServerSideEncryptionKMS encrypts the objects with a key managed by the
+	// key management service
+	ServerSideEncryptionKMS ServerSideEncryptionType = "sse-kms"
+)
+
 type S3Storage struct {
 	bucket      string
 	minioClient *minio.Client
 	// minio core client user for low level api
 	minioCore *minio.Core
+	// sse is the server side encryption requested when writing the objects
+	sse encrypt.ServerSide
 }
 
-func NewS3(bucket, location, endpoint, accessKeyID, secretAccessKey string, secure bool) (*S3Storage, error) {
-	minioClient, err := minio.New(endpoint, accessKeyID, secretAccessKey, secure)
-	if err != nil {
-		return nil, err
+// NewS3 creates a new S3 storage. When forcePathStyle is true the bucket
+// will be accessed using path style urls (endpoint/bucket) instead of
+// virtual hosted style urls (bucket.endpoint). This is usually needed with
+// self hosted S3 compatible services like minio.
+func NewS3(bucket, location, endpoint, accessKeyID, secretAccessKey string, secure, forcePathStyle bool) (*S3Storage, error) {
+	bucketLookup := minio.BucketLookupAuto
+	if forcePathStyle {
+		bucketLookup = minio.BucketLookupPath
 	}
 
-	minioCore, err := minio.NewCore(endpoint, accessKeyID, secretAccessKey, secure)
+	minioClient, err := minio.NewWithOptions(endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
+		Secure:       secure,
+		Region:       location,
+		BucketLookup: bucketLookup,
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	minioCore := &minio.Core{Client: minioClient}
+
 	exists, err := minioClient.BucketExists(bucket)
 	if err != nil {
 		return nil, errors.Errorf("cannot check if bucket %q in location %q exits: %w", bucket, location, err)
@@ -60,8 +88,37 @@ func NewS3(bucket, location, endpoint, accessKeyID, secretAccessKey string, secu
 	}, nil
 }
 
+// SetServerSideEncryption requests the server side encryption of type sseType
+// for all the objects written after it. kmsKeyID is the id of the key used by
+// the sse-kms type, when empty the default key of the bucket is used.
+func (s *S3Storage) SetServerSideEncryption(sseType ServerSideEncryptionType, kmsKeyID string) error {
+	if sseType != ServerSideEncryptionKMS && kmsKeyID != "" {
+		return errors.Errorf("kms key id can be set only with server side encryption %q", ServerSideEncryptionKMS)
+	}
+
+	switch sseType {
+	case "":
+		s.sse = nil
+	case ServerSideEncryptionS3:
+		s.sse = encrypt.NewSSE()
+	case ServerSideEncryptionKMS:
+		sse, err := encrypt.NewSSEKMS(kmsKeyID, nil)
+		if err != nil {
+			return errors.Errorf("wrong kms server side encryption: %w", err)
+		}
+		s.sse = sse
+	default:
+		return errors.Errorf("wrong server side encryption type %q", sseType)
+	}
+	return nil
+}
+
 func (s *S3Storage) Stat(p string) (*ObjectInfo, error) {
-	oi, err := s.minioClient.StatObject(s.bucket, p, minio.StatObjectOptions{})
+	return s.StatContext(context.Background(), p)
+}
+
+func (s *S3Storage) StatContext(ctx context.Context, p string) (*ObjectInfo, error) {
+	oi, err := s.minioClient.StatObjectWithContext(ctx, s.bucket, p, minio.StatObjectOptions{})
 	if err != nil {
 		merr := minio.ToErrorResponse(err)
 		if merr.StatusCode == http.StatusNotFound {
@@ -74,7 +131,13 @@ func (s *S3Storage) Stat(p string) (*ObjectInfo, error) {
 }
 
 func (s *S3Storage) ReadObject(filepath string) (ReadSeekCloser, error) {
-	if _, err := s.minioClient.StatObject(s.bucket, filepath, minio.StatObjectOptions{}); err != nil {
+	return s.ReadObjectContext(context.Background(), filepath)
+}
+
+// ReadObjectContext uses ctx only to check that the object exists, the
+// returned object is read without it
+func (s *S3Storage) ReadObjectContext(ctx context.Context, filepath string) (ReadSeekCloser, error) {
+	if _, err := s.minioClient.StatObjectWithContext(ctx, s.bucket, filepath, minio.StatObjectOptions{}); err != nil {
 		merr := minio.ToErrorResponse(err)
 		if merr.StatusCode == http.StatusNotFound {
 			return nil, NewErrNotExist(errors.Errorf("object %q doesn't exist", filepath))
@@ -85,14 +148,17 @@ func (s *S3Storage) ReadObject(filepath string) (ReadSeekCloser, error) {
 }
 
 func (s *S3Storage) WriteObject(filepath string, data io.Reader, size int64, persist bool) error {
+	return s.WriteObjectContext(context.Background(), filepath, data, size, persist)
+}
+
+func (s *S3Storage) WriteObjectContext(ctx context.Context, filepath string, data io.Reader, size int64, persist bool) error {
 	// if size is not specified, limit max object size to defaultMaxObjectSize so
 	// minio client will not calculate a very big part size using tons of ram.
 	// An alternative is to write the file locally so we can calculate the size and
 	// then put it. See commented out code below.
 	if size >= 0 {
 		lr := io.LimitReader(data, size)
-		_, err := s.minioClient.PutObject(s.bucket, filepath, lr, size, minio.PutObjectOptions{ContentType: "application/octet-stream"})
-		return err
+		return s.putObject(ctx, filepath, lr, size)
 	}
 
 	// hack to know the real file size or minio will do this in memory with big memory usage since s3 doesn't support real streaming of unknown sizes
@@ -110,7 +176,19 @@ func (s *S3Storage) WriteObject(filepath string, data io.Reader, size int64, per
 	if _, err := tmpfile.Seek(0, 0); err != nil {
 		return err
 	}
-	_, err = s.minioClient.PutObject(s.bucket, filepath, tmpfile, size, minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return s.putObject(ctx, filepath, tmpfile, size)
+}
+
+func (s *S3Storage) putObject(ctx context.Context, filepath string, data io.Reader, size int64) error {
+	_, err := s.minioClient.PutObjectWithContext(ctx, s.bucket, filepath, data, size, minio.PutObjectOptions{ContentType: "application/octet-stream", ServerSideEncryption: s.sse})
+	if err != nil && s.sse != nil {
+		// report the errors of a request rejected by the server since they
+		// could be caused by a not supported or misconfigured encryption
+		merr := minio.ToErrorResponse(err)
+		if merr.StatusCode == http.StatusBadRequest || merr.StatusCode == http.StatusForbidden || merr.StatusCode == http.StatusNotImplemented {
+			return errors.Errorf("failed to write object %q with server side encryption %q: %w", filepath, s.sse.Type(), err)
+		}
+	}
 	return err
 }
 
@@ -118,6 +196,22 @@ func (s *S3Storage) DeleteObject(filepath string) error {
 	return s.minioClient.RemoveObject(s.bucket, filepath)
 }
 
+// DeleteObjectContext uses the multi objects delete api since the minio client
+// doesn't provide a single object delete with a context
+func (s *S3Storage) DeleteObjectContext(ctx context.Context, filepath string) error {
+	objectsCh := make(chan string, 1)
+	objectsCh <- filepath
+	close(objectsCh)
+	var err error
+	// the errors channel must be fully read to not block the minio client
+	for rerr := range s.minioClient.RemoveObjectsWithContext(ctx, s.bucket, objectsCh) {
+		if err == nil {
+			err = rerr.Err
+		}
+	}
+	return err
+}
+
 func (s *S3Storage) List(prefix, startWith, delimiter string, doneCh <-chan struct{}) <-chan ObjectInfo {
 	objectCh := make(chan ObjectInfo, 1)
 
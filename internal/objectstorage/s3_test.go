@@ -0,0 +1,154 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objectstorage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a minimal s3 server that saves the headers of the put requests
+// and rejects them when reject is true
+type fakeS3 struct {
+	mu         sync.Mutex
+	reject     bool
+	putHeaders http.Header
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case "HEAD":
+		// bucket exists
+		w.WriteHeader(http.StatusOK)
+	case "PUT":
+		_, _ = ioutil.ReadAll(r.Body)
+		f.putHeaders = r.Header
+		if f.reject {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>InvalidArgument</Code><Message>The encryption method specified is not supported</Message></Error>`))
+			return
+		}
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestS3ServerSideEncryption(t *testing.T) {
+	f := &fakeS3{}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	s, err := NewS3("bucket01", "us-east-1", strings.TrimPrefix(srv.URL, "http://"), "accesskey", "secretkey", false, true)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	tests := []struct {
+		name            string
+		sseType         ServerSideEncryptionType
+		kmsKeyID        string
+		expectedHeaders map[string]string
+	}{
+		{
+			name: "no encryption",
+			expectedHeaders: map[string]string{
+				"X-Amz-Server-Side-Encryption":                "",
+				"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "",
+			},
+		},
+		{
+			name:    "sse-s3",
+			sseType: ServerSideEncryptionS3,
+			expectedHeaders: map[string]string{
+				"X-Amz-Server-Side-Encryption":                "AES256",
+				"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "",
+			},
+		},
+		{
+			name:     "sse-kms with key id",
+			sseType:  ServerSideEncryptionKMS,
+			kmsKeyID: "key01",
+			expectedHeaders: map[string]string{
+				"X-Amz-Server-Side-Encryption":                "aws:kms",
+				"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "key01",
+			},
+		},
+		{
+			name:    "sse-kms with the bucket default key",
+			sseType: ServerSideEncryptionKMS,
+			expectedHeaders: map[string]string{
+				"X-Amz-Server-Side-Encryption":                "aws:kms",
+				"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.SetServerSideEncryption(tt.sseType, tt.kmsKeyID); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			data := []byte("data01")
+			if err := s.WriteObject("object01", bytes.NewReader(data), int64(len(data)), true); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			for header, expected := range tt.expectedHeaders {
+				if v := f.putHeaders.Get(header); v != expected {
+					t.Fatalf("expected header %q value %q, got %q", header, expected, v)
+				}
+			}
+		})
+	}
+
+	t.Run("wrong settings", func(t *testing.T) {
+		expectedErr := `kms key id can be set only with server side encryption "sse-kms"`
+		if err := s.SetServerSideEncryption(ServerSideEncryptionS3, "key01"); err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got: %v", expectedErr, err)
+		}
+		expectedErr = `wrong server side encryption type "sse-c"`
+		if err := s.SetServerSideEncryption("sse-c", ""); err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("encryption rejected by the server", func(t *testing.T) {
+		if err := s.SetServerSideEncryption(ServerSideEncryptionKMS, "key01"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		f.mu.Lock()
+		f.reject = true
+		f.mu.Unlock()
+
+		data := []byte("data01")
+		err := s.WriteObject("object01", bytes.NewReader(data), int64(len(data)), true)
+		expectedErr := `failed to write object "object01" with server side encryption "KMS": The encryption method specified is not supported`
+		if err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got: %v", expectedErr, err)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objectstorage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	errors "golang.org/x/xerrors"
+)
+
+// ContextStorage is implemented by the storages whose operations can be
+// cancelled with a context. ReadObjectContext ctx must be used only to open
+// the object since the returned reader is read after it's done.
+type ContextStorage interface {
+	StatContext(ctx context.Context, filepath string) (*ObjectInfo, error)
+	ReadObjectContext(ctx context.Context, filepath string) (ReadSeekCloser, error)
+	WriteObjectContext(ctx context.Context, filepath string, data io.Reader, size int64, persist bool) error
+	DeleteObjectContext(ctx context.Context, filepath string) error
+}
+
+// TimeoutStorage wraps a Storage cancelling the operations not completed
+// within timeout. A timed out operation returns an error wrapping
+// context.DeadlineExceeded that is retried by a RetryStorage wrapping it.
+// Only the operations of a storage implementing ContextStorage can be
+// cancelled, the other storages are used without timeout. List isn't
+// cancelled since its results are streamed.
+type TimeoutStorage struct {
+	Storage
+
+	timeout time.Duration
+}
+
+func NewTimeoutStorage(s Storage, timeout time.Duration) *TimeoutStorage {
+	return &TimeoutStorage{
+		Storage: s,
+		timeout: timeout,
+	}
+}
+
+func (s *TimeoutStorage) withTimeout(op, p string, f func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	err := f(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("object storage %s of %q not completed in %s: %w", op, p, s.timeout, context.DeadlineExceeded)
+	}
+	return err
+}
+
+func (s *TimeoutStorage) Stat(p string) (*ObjectInfo, error) {
+	cs, ok := s.Storage.(ContextStorage)
+	if !ok {
+		return s.Storage.Stat(p)
+	}
+	var oi *ObjectInfo
+	err := s.withTimeout("stat", p, func(ctx context.Context) error {
+		var err error
+		oi, err = cs.StatContext(ctx, p)
+		return err
+	})
+	return oi, err
+}
+
+func (s *TimeoutStorage) ReadObject(p string) (ReadSeekCloser, error) {
+	cs, ok := s.Storage.(ContextStorage)
+	if !ok {
+		return s.Storage.ReadObject(p)
+	}
+	var r ReadSeekCloser
+	err := s.withTimeout("read", p, func(ctx context.Context) error {
+		var err error
+		r, err = cs.ReadObjectContext(ctx, p)
+		return err
+	})
+	return r, err
+}
+
+func (s *TimeoutStorage) WriteObject(p string, data io.Reader, size int64, persist bool) error {
+	cs, ok := s.Storage.(ContextStorage)
+	if !ok {
+		return s.Storage.WriteObject(p, data, size, persist)
+	}
+	return s.withTimeout("write", p, func(ctx context.Context) error {
+		return cs.WriteObjectContext(ctx, p, data, size, persist)
+	})
+}
+
+func (s *TimeoutStorage) DeleteObject(p string) error {
+	cs, ok := s.Storage.(ContextStorage)
+	if !ok {
+		return s.Storage.DeleteObject(p)
+	}
+	return s.withTimeout("delete", p, func(ctx context.Context) error {
+		return cs.DeleteObjectContext(ctx, p)
+	})
+}
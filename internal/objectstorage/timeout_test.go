@@ -0,0 +1,184 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objectstorage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	errors "golang.org/x/xerrors"
+)
+
+// blockingStorage is a fake context storage whose first blocks calls block
+// until their context is done
+type blockingStorage struct {
+	failingStorage
+
+	blocks int
+
+	// canceled is the number of calls whose context was done
+	canceled int
+}
+
+func (s *blockingStorage) block(ctx context.Context) error {
+	if s.calls >= s.blocks {
+		return nil
+	}
+	s.calls++
+	<-ctx.Done()
+	s.canceled++
+	return ctx.Err()
+}
+
+func (s *blockingStorage) StatContext(ctx context.Context, p string) (*ObjectInfo, error) {
+	if err := s.block(ctx); err != nil {
+		return nil, err
+	}
+	return s.Stat(p)
+}
+
+func (s *blockingStorage) ReadObjectContext(ctx context.Context, p string) (ReadSeekCloser, error) {
+	if err := s.block(ctx); err != nil {
+		return nil, err
+	}
+	return s.ReadObject(p)
+}
+
+func (s *blockingStorage) WriteObjectContext(ctx context.Context, p string, data io.Reader, size int64, persist bool) error {
+	// consume data also when blocked to check that it's read again on retry
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	if err := s.block(ctx); err != nil {
+		return err
+	}
+	return s.WriteObject(p, bytes.NewReader(b), size, persist)
+}
+
+func (s *blockingStorage) DeleteObjectContext(ctx context.Context, p string) error {
+	if err := s.block(ctx); err != nil {
+		return err
+	}
+	return s.DeleteObject(p)
+}
+
+func TestTimeoutStorage(t *testing.T) {
+	tests := []struct {
+		name          string
+		blocks        int
+		maxRetries    int
+		expectedCalls int
+		expectedErr   bool
+	}{
+		{
+			name:          "not blocking",
+			maxRetries:    3,
+			expectedCalls: 1,
+		},
+		{
+			name:          "succeeds after timed out attempts",
+			blocks:        2,
+			maxRetries:    3,
+			expectedCalls: 3,
+		},
+		{
+			name:          "fails after max retries",
+			blocks:        5,
+			maxRetries:    3,
+			expectedCalls: 4,
+			expectedErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			ops := map[string]func(s Storage) error{
+				"stat": func(s Storage) error {
+					_, err := s.Stat("object")
+					return err
+				},
+				"read": func(s Storage) error {
+					_, err := s.ReadObject("object")
+					return err
+				},
+				"write": func(s Storage) error {
+					return s.WriteObject("object", bytes.NewReader([]byte("data")), -1, false)
+				},
+				"delete": func(s Storage) error {
+					return s.DeleteObject("object")
+				},
+			}
+
+			for opName, op := range ops {
+				bs := &blockingStorage{blocks: tt.blocks}
+				s := NewRetryStorage(ctx, NewTimeoutStorage(bs, 50*time.Millisecond), tt.maxRetries, 1*time.Millisecond)
+
+				start := time.Now()
+				err := op(s)
+				if tt.expectedErr {
+					if err == nil {
+						t.Fatalf("%s: expected error, got nil error", opName)
+					}
+					if !errors.Is(err, context.DeadlineExceeded) {
+						t.Fatalf("%s: expected deadline exceeded error, got: %v", opName, err)
+					}
+				}
+				if !tt.expectedErr && err != nil {
+					t.Fatalf("%s: unexpected err: %v", opName, err)
+				}
+				if time.Since(start) > 5*time.Second {
+					t.Fatalf("%s: blocked operations not canceled", opName)
+				}
+				if bs.calls != tt.expectedCalls {
+					t.Fatalf("%s: expected %d calls, got %d", opName, tt.expectedCalls, bs.calls)
+				}
+				expectedCanceled := tt.blocks
+				if expectedCanceled > tt.expectedCalls {
+					expectedCanceled = tt.expectedCalls
+				}
+				if bs.canceled != expectedCanceled {
+					t.Fatalf("%s: expected %d canceled calls, got %d", opName, expectedCanceled, bs.canceled)
+				}
+				if opName == "write" && !tt.expectedErr && string(bs.written) != "data" {
+					t.Fatalf("expected written data %q, got %q", "data", bs.written)
+				}
+			}
+		})
+	}
+}
+
+func TestTimeoutStorageNotContextStorage(t *testing.T) {
+	// the operations of a storage not implementing ContextStorage cannot be
+	// canceled so they're executed without timeout
+	fs := &failingStorage{failures: 1, err: errTransient}
+	s := NewTimeoutStorage(fs, 1*time.Nanosecond)
+
+	if err := s.DeleteObject("object"); !errors.Is(err, errTransient) {
+		t.Fatalf("expected error %v, got: %v", errTransient, err)
+	}
+	if err := s.DeleteObject("object"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if fs.calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", fs.calls)
+	}
+}
@@ -56,7 +56,7 @@ func newGithub(rs *cstypes.RemoteSource, accessToken string) (*github.Client, er
 
 func GetAccessToken(rs *cstypes.RemoteSource, userAccessToken, oauth2AccessToken string) (string, error) {
 	switch rs.AuthType {
-	case cstypes.RemoteSourceAuthTypePassword:
+	case cstypes.RemoteSourceAuthTypePassword, cstypes.RemoteSourceAuthTypeToken:
 		return userAccessToken, nil
 	case cstypes.RemoteSourceAuthTypeOauth2:
 		return oauth2AccessToken, nil
@@ -97,7 +97,9 @@ func GetUserSource(rs *cstypes.RemoteSource, accessToken string) (gitsource.User
 	switch rs.AuthType {
 	case cstypes.RemoteSourceAuthTypeOauth2:
 		userSource, err = GetOauth2Source(rs, accessToken)
-	case cstypes.RemoteSourceAuthTypePassword:
+	case cstypes.RemoteSourceAuthTypePassword, cstypes.RemoteSourceAuthTypeToken:
+		// the user access token is the one created by the password login or
+		// provided by the user
 		userSource, err = GetPasswordSource(rs, accessToken)
 	default:
 		return nil, errors.Errorf("unknown remote source auth type")
@@ -15,7 +15,13 @@
 package config
 
 import (
+	"encoding/base64"
 	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"agola.io/agola/internal/util"
@@ -26,6 +32,14 @@ import (
 
 const (
 	maxIDLength = 20
+
+	// DefaultConfigstoreDataDirMode is the default permission mode of the
+	// configstore data directories
+	DefaultConfigstoreDataDirMode os.FileMode = 0770
+
+	// MaxProjectsLimit is the max number of projects returned by a single
+	// call of the configstore projects list api
+	MaxProjectsLimit = 20
 )
 
 type Config struct {
@@ -64,6 +78,10 @@ type Gateway struct {
 	TokenSigning TokenSigning `yaml:"tokenSigning"`
 
 	AdminToken string `yaml:"adminToken"`
+
+	// ConfigstoreToken is the token used to authenticate to the configstore
+	// api when the configstore auth is enabled
+	ConfigstoreToken string `yaml:"configstoreToken"`
 }
 
 type Scheduler struct {
@@ -82,6 +100,10 @@ type Notification struct {
 	RunserviceURL  string `yaml:"runserviceURL"`
 	ConfigstoreURL string `yaml:"configstoreURL"`
 
+	// ConfigstoreToken is the token used to authenticate to the configstore
+	// api when the configstore auth is enabled
+	ConfigstoreToken string `yaml:"configstoreToken"`
+
 	Etcd Etcd `yaml:"etcd"`
 }
 
@@ -120,10 +142,317 @@ type Configstore struct {
 	Debug bool `yaml:"debug"`
 
 	DataDir string `yaml:"dataDir"`
+	// DataDirMode is the octal permission mode (i.e. "0750") of the data
+	// directories created at startup. When empty the default is used
+	DataDirMode string `yaml:"dataDirMode"`
 
 	Web           Web           `yaml:"web"`
 	Etcd          Etcd          `yaml:"etcd"`
 	ObjectStorage ObjectStorage `yaml:"objectStorage"`
+	// WalsObjectStorage and DataObjectStorage, when defined, are the object
+	// storages of the wals and of the data files (the checkpointed data used
+	// to restore the readdb) instead of ObjectStorage
+	WalsObjectStorage *ObjectStorage `yaml:"walsObjectStorage"`
+	DataObjectStorage *ObjectStorage `yaml:"dataObjectStorage"`
+
+	// DefaultProjectsLimit is the number of projects returned by the projects
+	// list api when no limit is provided. It can't be greater than
+	// MaxProjectsLimit
+	DefaultProjectsLimit int `yaml:"defaultProjectsLimit"`
+
+	Metrics Metrics `yaml:"metrics"`
+
+	Admin Admin `yaml:"admin"`
+
+	// ShutdownTimeout is the maximum time to wait for in flight requests to
+	// complete when stopping
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+
+	// SecretsEncryptionKey is the base64 encoded 32 bytes key used to encrypt
+	// the secrets data at rest. When empty the secrets data isn't encrypted
+	SecretsEncryptionKey string `yaml:"secretsEncryptionKey"`
+
+	// CheckpointInterval is the interval between wals checkpoints. When 0 the
+	// datamanager default is used
+	CheckpointInterval time.Duration `yaml:"checkpointInterval"`
+	// CheckpointWalsSizeThreshold is the size in bytes of the wals not yet
+	// checkpointed that will trigger a checkpoint
+	CheckpointWalsSizeThreshold int64 `yaml:"checkpointWalsSizeThreshold"`
+	// StorageWalCleanInterval is the interval between the removal of the wals
+	// already checkpointed from the object storage. When 0 the datamanager
+	// default is used
+	StorageWalCleanInterval time.Duration `yaml:"storageWalCleanInterval"`
+	// WalFlushInterval, when greater than 0, is the max time a write waits
+	// for other writes to flush their wals to the object storage together.
+	// The write returns only after its wal is flushed: a longer interval
+	// means less object storage flushes but higher write latency
+	WalFlushInterval time.Duration `yaml:"walFlushInterval"`
+	// WalFlushMaxBatchSize is the max number of wals flushed together, a
+	// full batch is flushed without waiting for the flush interval
+	WalFlushMaxBatchSize int `yaml:"walFlushMaxBatchSize"`
+	// WalCompression is the compression (none or gzip) of the wals data
+	// written to the object storage. Defaults to none. Changing it doesn't
+	// affect the already written wals, they're read whatever their
+	// compression.
+	WalCompression string `yaml:"walCompression"`
+	// WalWriterLease, when true, allows the wals writes only to the
+	// configstore holding the etcd wal writer lease, so two configstores
+	// that both believe to be the writer can't write concurrently. The
+	// writes of a configstore not holding the lease fail with a misdirected
+	// request error. It isn't used by the read replicas.
+	WalWriterLease bool `yaml:"walWriterLease"`
+	// WalWriterLeaseTTL is the time after which a configstore that couldn't
+	// renew the wal writer lease loses it. When 0 the datamanager default is
+	// used
+	WalWriterLeaseTTL time.Duration `yaml:"walWriterLeaseTTL"`
+
+	// ReadDBCacheSize is the max number of objects kept in the readdb cache.
+	// When 0 the default is used, a negative value disables the cache
+	ReadDBCacheSize int `yaml:"readDBCacheSize"`
+	// ReadDBCacheTTL is the expiration time of the readdb cached objects. When
+	// 0 the default is used
+	ReadDBCacheTTL time.Duration `yaml:"readDBCacheTTL"`
+	// ReadDBSyncBatchSize is the max number of wals applied to the readdb in a
+	// single transaction when syncing it from the object storage wals (i.e. at
+	// startup). When 0 the default is used
+	ReadDBSyncBatchSize int `yaml:"readDBSyncBatchSize"`
+	// ReadDBSyncBatchMaxSize is the max size in bytes of the data of a batch of
+	// wals, kept in memory until the batch is applied. When 0 the default is
+	// used
+	ReadDBSyncBatchMaxSize int64 `yaml:"readDBSyncBatchMaxSize"`
+
+	// UniqueNamePolicy defines how the users, orgs, project groups and
+	// projects names are compared when checking their uniqueness and looking
+	// them up. Defaults to caseSensitive. Switching to caseInsensitive
+	// requires the existing names to not differ only by their case: if they
+	// do the readdb sync fails reporting them and the configstore won't
+	// become ready.
+	UniqueNamePolicy UniqueNamePolicy `yaml:"uniqueNamePolicy"`
+
+	Auth ConfigstoreAuth `yaml:"auth"`
+
+	RateLimit RateLimit `yaml:"rateLimit"`
+
+	SoftDelete SoftDelete `yaml:"softDelete"`
+
+	Webhooks ConfigstoreWebhooks `yaml:"webhooks"`
+
+	RequestTimeout RequestTimeout `yaml:"requestTimeout"`
+
+	RequestBodyLimit RequestBodyLimit `yaml:"requestBodyLimit"`
+
+	Compression Compression `yaml:"compression"`
+
+	CacheControl CacheControl `yaml:"cacheControl"`
+
+	HTTP2 HTTP2 `yaml:"http2"`
+
+	// IdempotencyKeyTTL is the time a create request idempotency key is
+	// remembered. When 0 the default is used
+	IdempotencyKeyTTL time.Duration `yaml:"idempotencyKeyTTL"`
+
+	// ReadOnly starts the configstore in read only mode, rejecting the
+	// writes. It can be changed at runtime using the admin api
+	ReadOnly bool `yaml:"readOnly"`
+
+	ReadReplica ReadReplica `yaml:"readReplica"`
+}
+
+// ReadReplica configures the configstore as a read replica: its readdb is
+// synced from the wals like on the other configstores but only the read
+// requests are served
+type ReadReplica struct {
+	Enabled bool `yaml:"enabled"`
+	// WriterURL is the url of the configstore serving the writes (i.e.
+	// https://configstore:4002). When set the write requests are redirected
+	// to it, otherwise they are rejected as misdirected
+	WriterURL string `yaml:"writerURL"`
+}
+
+type Compression struct {
+	// Enabled enables the gzip compression of the responses to the requests
+	// accepting it
+	Enabled bool `yaml:"enabled"`
+	// MinSize is the min size in bytes of a compressed response, smaller
+	// responses aren't compressed. When 0 the default is used
+	MinSize int `yaml:"minSize"`
+}
+
+type HTTP2 struct {
+	// Enabled enables HTTP/2 on the api listener. With TLS it's negotiated
+	// using ALPN, without TLS cleartext HTTP/2 (h2c) connections are
+	// accepted. Clients not supporting it keep using HTTP/1.1
+	Enabled bool `yaml:"enabled"`
+	// MaxConcurrentStreams is the max number of concurrent requests on a
+	// connection. When 0 the default is used
+	MaxConcurrentStreams uint32 `yaml:"maxConcurrentStreams"`
+	// IdleTimeout is the time after which an idle connection is closed. When
+	// 0 idle connections aren't closed
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+}
+
+type CacheControl struct {
+	// DefaultMaxAge is the max-age of the GET responses of the api resources
+	// without a configured max-age. When 0 the responses must be revalidated
+	// before being used by a cache
+	DefaultMaxAge time.Duration `yaml:"defaultMaxAge"`
+	// MaxAge is the max-age of the GET responses keyed by api resource, the
+	// first element of the api path (i.e. remotesources). It overrides the
+	// default max-age of the resource
+	MaxAge map[string]time.Duration `yaml:"maxAge"`
+}
+
+type RequestTimeout struct {
+	// Read is the max duration of a read (GET and HEAD) api request. When 0
+	// the read requests don't time out
+	Read time.Duration `yaml:"read"`
+	// Write is the max duration of the other api requests. When 0 the write
+	// requests don't time out
+	Write time.Duration `yaml:"write"`
+}
+
+type RequestBodyLimit struct {
+	// MaxSize is the max size in bytes of an api request body. When 0 the
+	// default is used
+	MaxSize int64 `yaml:"maxSize"`
+	// ImportMaxSize is the max size in bytes of the request body of the bulk
+	// import apis. When 0 the default is used
+	ImportMaxSize int64 `yaml:"importMaxSize"`
+}
+
+type ConfigstoreWebhooks struct {
+	// URLs are the endpoints receiving the configstore change events. When
+	// empty no event is sent
+	URLs []string `yaml:"urls"`
+	// Secret is the secret used to sign the events with HMAC-SHA256. When
+	// empty the events aren't signed
+	Secret string `yaml:"secret"`
+	// MaxRetries is the number of delivery retries of an event before it's
+	// written to the dead letter log. When 0 the default is used, a negative
+	// value disables the retries
+	MaxRetries int `yaml:"maxRetries"`
+	// RetryInterval is the time to wait before the first retry, doubled at
+	// every retry. When 0 the default is used
+	RetryInterval time.Duration `yaml:"retryInterval"`
+	// DeadLetterFile is the file where the undeliverable events are appended.
+	// When empty the file webhooks-deadletter.log inside the dataDir is used
+	DeadLetterFile string `yaml:"deadLetterFile"`
+}
+
+type SoftDelete struct {
+	// Enabled enables the soft delete of users and projects. A soft deleted
+	// user or project can be restored until its retention time has passed
+	Enabled bool `yaml:"enabled"`
+	// Retention is the time a soft deleted resource is kept before being
+	// permanently removed. When 0 the default is used
+	Retention time.Duration `yaml:"retention"`
+}
+
+type ConfigstoreAuth struct {
+	// Enabled enables the api authentication. When enabled every api request
+	// must provide a bearer token with the scopes required by the operation
+	Enabled bool `yaml:"enabled"`
+	// AdminToken is a token with the admin scope used by the other agola
+	// services (as their configstoreToken) to access the configstore api
+	AdminToken string `yaml:"adminToken"`
+	// AccessDeniedPolicy defines the response to a user token accessing an
+	// existing resource it cannot access. Defaults to forbidden.
+	AccessDeniedPolicy AccessDeniedPolicy `yaml:"accessDeniedPolicy"`
+}
+
+type AccessDeniedPolicy string
+
+const (
+	// AccessDeniedPolicyForbidden explicitly rejects the request with a
+	// forbidden error
+	AccessDeniedPolicyForbidden AccessDeniedPolicy = "forbidden"
+	// AccessDeniedPolicyNotFound returns the same not found error of a not
+	// existing resource, hiding the resource existence
+	AccessDeniedPolicyNotFound AccessDeniedPolicy = "notFound"
+)
+
+type UniqueNamePolicy string
+
+const (
+	// UniqueNamePolicyCaseSensitive considers names differing only by their
+	// case as different names
+	UniqueNamePolicyCaseSensitive UniqueNamePolicy = "caseSensitive"
+	// UniqueNamePolicyCaseInsensitive considers names differing only by their
+	// case as the same name. The names keep the provided case
+	UniqueNamePolicyCaseInsensitive UniqueNamePolicy = "caseInsensitive"
+)
+
+// DataDirFileMode returns the permission mode of the data directories
+func (c *Configstore) DataDirFileMode() (os.FileMode, error) {
+	if c.DataDirMode == "" {
+		return DefaultConfigstoreDataDirMode, nil
+	}
+	mode, err := strconv.ParseUint(c.DataDirMode, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return 0, errors.Errorf("wrong dataDirMode %q, must be an octal permission mode", c.DataDirMode)
+	}
+	// the configstore must be able to create and list the directory content
+	if mode&0700 != 0700 {
+		return 0, errors.Errorf("wrong dataDirMode %q, the owner must have read, write and execute permissions", c.DataDirMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// SecretsKey returns the decoded secrets encryption key or nil if not defined
+func (c *Configstore) SecretsKey() ([]byte, error) {
+	if c.SecretsEncryptionKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(c.SecretsEncryptionKey)
+	if err != nil {
+		return nil, errors.Errorf("failed to decode secrets encryption key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, errors.Errorf("secrets encryption key must be 32 bytes long")
+	}
+	return key, nil
+}
+
+type RateLimit struct {
+	// Enabled enables the requests rate limiting
+	Enabled bool `yaml:"enabled"`
+	// Token is the rate limit of every bearer token. It's applied to the
+	// requests providing a token that authenticates
+	Token RateLimitRule `yaml:"token"`
+	// IP is the rate limit of every client ip. It's applied to the requests
+	// without a token or with a token that doesn't authenticate, or to all
+	// the requests when the api authentication is disabled
+	IP RateLimitRule `yaml:"ip"`
+	// IdleTimeout is the time after which the state of a client without new
+	// requests is removed. When 0 the default is used
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+}
+
+type RateLimitRule struct {
+	// RequestsPerSecond is the sustained rate of allowed requests
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
+	// Burst is the max number of requests allowed at once. When 0 it's
+	// RequestsPerSecond rounded up
+	Burst int `yaml:"burst"`
+}
+
+type Metrics struct {
+	// Enabled enables the prometheus metrics endpoint (/metrics)
+	Enabled bool `yaml:"enabled"`
+	// ListenAddress is the address where the metrics endpoint is served. When
+	// empty the metrics endpoint is served by the main web listener
+	ListenAddress string `yaml:"listenAddress"`
+}
+
+type Admin struct {
+	// ListenAddress is the address where the admin api routes (/admin/...)
+	// and the metrics endpoint, when not served by its own listener, are
+	// served. When empty they are served by the main web listener
+	ListenAddress string `yaml:"listenAddress"`
+	// Pprof enables the pprof profiling endpoints (/debug/pprof/) on the admin
+	// listener. When the api authentication is enabled they require an admin
+	// token
+	Pprof bool `yaml:"pprof"`
 }
 
 type Gitserver struct {
@@ -151,8 +480,54 @@ type Web struct {
 	// TODO(sgotti) support encrypted private keys (add a private key password config entry)
 	TLSKeyFile string `yaml:"tlsKeyFile"`
 
-	// CORS allowed origins
+	// CORS allowed origins. When empty cross origin requests are not allowed
 	AllowedOrigins []string `yaml:"allowedOrigins"`
+	// CORS allowed methods. When empty DefaultCORSAllowedMethods are used
+	AllowedMethods []string `yaml:"allowedMethods"`
+	// CORS allowed headers. When empty DefaultCORSAllowedHeaders are used
+	AllowedHeaders []string `yaml:"allowedHeaders"`
+	// CORS preflight max-age, the time a browser can cache a preflight
+	// response. When 0 DefaultCORSMaxAge is used. It's rounded down to seconds
+	// and can't be greater than MaxCORSMaxAge
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+var (
+	DefaultCORSAllowedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	DefaultCORSAllowedHeaders = []string{"Accept", "Accept-Encoding", "Authorization", "Content-Length", "Content-Type", "X-CSRF-Token", "If-Match", "Idempotency-Key", "X-Request-Id"}
+)
+
+const (
+	DefaultCORSMaxAge = 5 * time.Minute
+	// MaxCORSMaxAge is the max preflight max-age accepted by the cors handler
+	MaxCORSMaxAge = 10 * time.Minute
+)
+
+// CORSAllowedMethods returns the configured CORS allowed methods or the
+// default ones
+func (w *Web) CORSAllowedMethods() []string {
+	if len(w.AllowedMethods) > 0 {
+		return w.AllowedMethods
+	}
+	return DefaultCORSAllowedMethods
+}
+
+// CORSAllowedHeaders returns the configured CORS allowed headers or the
+// default ones
+func (w *Web) CORSAllowedHeaders() []string {
+	if len(w.AllowedHeaders) > 0 {
+		return w.AllowedHeaders
+	}
+	return DefaultCORSAllowedHeaders
+}
+
+// CORSMaxAge returns the configured CORS preflight max-age or the default
+// one in seconds
+func (w *Web) CORSMaxAge() int {
+	if w.MaxAge > 0 {
+		return int(w.MaxAge / time.Second)
+	}
+	return int(DefaultCORSMaxAge / time.Second)
 }
 
 type ObjectStorageType string
@@ -162,6 +537,22 @@ const (
 	ObjectStorageTypeS3    ObjectStorageType = "s3"
 )
 
+type ServerSideEncryptionType string
+
+const (
+	ServerSideEncryptionTypeS3  ServerSideEncryptionType = "sse-s3"
+	ServerSideEncryptionTypeKMS ServerSideEncryptionType = "sse-kms"
+)
+
+type ServerSideEncryption struct {
+	// Type is the server side encryption type, when empty the objects aren't
+	// encrypted
+	Type ServerSideEncryptionType `yaml:"type"`
+	// KMSKeyID is the id of the key used by the sse-kms type. When empty the
+	// default key of the bucket is used
+	KMSKeyID string `yaml:"kmsKeyID"`
+}
+
 type ObjectStorage struct {
 	Type ObjectStorageType `yaml:"type"`
 
@@ -169,12 +560,45 @@ type ObjectStorage struct {
 	Path string `yaml:"path"`
 
 	// S3
-	Endpoint        string `yaml:"endpoint"`
-	Bucket          string `yaml:"bucket"`
+	// Endpoint is the s3 endpoint url (http://host[:port] or
+	// https://host[:port]) i.e. of a minio or other s3 compatible service
+	Endpoint string `yaml:"endpoint"`
+	Bucket   string `yaml:"bucket"`
+	// Location is the bucket region
 	Location        string `yaml:"location"`
 	AccessKey       string `yaml:"accessKey"`
 	SecretAccessKey string `yaml:"secretAccessKey"`
 	DisableTLS      bool   `yaml:"disableTLS"`
+	// ForcePathStyle forces path style bucket urls (endpoint/bucket) instead
+	// of virtual hosted style urls (bucket.endpoint), usually required by
+	// self hosted s3 compatible services
+	ForcePathStyle bool `yaml:"forcePathStyle"`
+	// ServerSideEncryption is the encryption at rest requested for all the
+	// written objects. It's ignored by the posix object storage
+	ServerSideEncryption ServerSideEncryption `yaml:"serverSideEncryption"`
+
+	// MaxRetries is the max number of retries of an operation failed with a
+	// transient error. When 0 the default is used, a negative value disables
+	// the retries
+	MaxRetries int `yaml:"maxRetries"`
+	// RetryBaseDelay is the wait before the first retry, it's doubled at
+	// every retry. When 0 the default is used
+	RetryBaseDelay time.Duration `yaml:"retryBaseDelay"`
+	// OperationTimeout is the max duration of a single operation (stat, read,
+	// write, delete) attempt. A timed out operation is cancelled and retried.
+	// It's unrelated to the api requests timeout. When 0 there's no timeout.
+	// It's ignored by the posix object storage
+	OperationTimeout time.Duration `yaml:"operationTimeout"`
+
+	// Prefix is the path prefix of the objects, it lets different data share
+	// the same storage (i.e. the same s3 bucket)
+	Prefix string `yaml:"prefix"`
+
+	// MigrateFrom is the object storage whose objects are being migrated to
+	// this one. Until all of them are copied, the objects missing from this
+	// storage are read from it. It can be removed when the migration is
+	// completed
+	MigrateFrom *ObjectStorage `yaml:"migrateFrom"`
 }
 
 type Etcd struct {
@@ -185,6 +609,20 @@ type Etcd struct {
 	TLSKeyFile    string `yaml:"tlsKeyFile"`
 	TLSCAFile     string `yaml:"tlsCAFile"`
 	TLSSkipVerify bool   `yaml:"tlsSkipVerify"`
+
+	// Username and Password are the credentials used when etcd auth is
+	// enabled
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// PoolSize is the number of etcd connections shared by the services, with
+	// the same etcd configuration, running in the same process
+	PoolSize int `yaml:"poolSize"`
+	// KeepAliveTime is the interval of the keepalive probes sent to etcd, by
+	// default no probes are sent. KeepAliveTimeout is the time to wait for a
+	// probe response before closing the connection
+	KeepAliveTime    time.Duration `yaml:"keepAliveTime"`
+	KeepAliveTimeout time.Duration `yaml:"keepAliveTimeout"`
 }
 
 type DriverType string
@@ -233,17 +671,29 @@ var defaultConfig = Config{
 }
 
 func Parse(configFile string, componentsNames []string) (*Config, error) {
+	c, err := Load(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, Validate(c, componentsNames)
+}
+
+// Load reads the config file without validating it
+func Load(configFile string) (*Config, error) {
 	configData, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return nil, err
 	}
 
-	c := &defaultConfig
+	// copy the default config to not modify it
+	dc := defaultConfig
+	c := &dc
 	if err := yaml.Unmarshal(configData, &c); err != nil {
 		return nil, err
 	}
 
-	return c, Validate(c, componentsNames)
+	return c, nil
 }
 
 func validateWeb(w *Web) error {
@@ -260,10 +710,401 @@ func validateWeb(w *Web) error {
 		}
 	}
 
+	for _, o := range w.AllowedOrigins {
+		if o == "*" {
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil {
+			return errors.Errorf("wrong allowed origin %q: %w", o, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+			return errors.Errorf("wrong allowed origin %q: must be \"*\" or in the form scheme://host[:port]", o)
+		}
+	}
+	for _, m := range w.AllowedMethods {
+		if m == "" || strings.ToUpper(m) != m || strings.ContainsAny(m, " \t") {
+			return errors.Errorf("wrong allowed method %q", m)
+		}
+	}
+	for _, h := range w.AllowedHeaders {
+		if h == "" || strings.ContainsAny(h, " \t:") {
+			return errors.Errorf("wrong allowed header %q", h)
+		}
+	}
+	if w.MaxAge < 0 || w.MaxAge > MaxCORSMaxAge {
+		return errors.Errorf("cors max age must be between 0 and %s", MaxCORSMaxAge)
+	}
+
+	return nil
+}
+
+func validateEtcd(e *Etcd) error {
+	if (e.TLSCertFile == "") != (e.TLSKeyFile == "") {
+		return errors.Errorf("both tls cert file and tls key file must be specified")
+	}
+	for _, f := range []string{e.TLSCertFile, e.TLSKeyFile, e.TLSCAFile} {
+		if f == "" {
+			continue
+		}
+		// check that the file exists and is readable
+		fh, err := os.Open(f)
+		if err != nil {
+			return errors.Errorf("cannot read tls file: %w", err)
+		}
+		fh.Close()
+	}
+
+	if e.Password != "" && e.Username == "" {
+		return errors.Errorf("password specified without an username")
+	}
+
+	if e.PoolSize < 0 {
+		return errors.Errorf("poolSize must be greater or equal than 0")
+	}
+	if e.KeepAliveTime < 0 || e.KeepAliveTimeout < 0 {
+		return errors.Errorf("keepAliveTime and keepAliveTimeout must be greater or equal than 0")
+	}
+
+	return nil
+}
+
+func validateObjectStorage(o *ObjectStorage) error {
+	switch o.Type {
+	case ObjectStorageTypePosix:
+		if o.Path == "" {
+			return errors.Errorf("posix object storage path is empty")
+		}
+	case ObjectStorageTypeS3:
+		if o.Endpoint == "" {
+			return errors.Errorf("s3 object storage endpoint is empty")
+		}
+		u, err := url.Parse(o.Endpoint)
+		if err != nil {
+			return errors.Errorf("wrong s3 object storage endpoint %q: %w", o.Endpoint, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return errors.Errorf("wrong s3 object storage endpoint scheme %q (must be http or https)", u.Scheme)
+		}
+		if u.Host == "" {
+			return errors.Errorf("wrong s3 object storage endpoint %q: empty host", o.Endpoint)
+		}
+		if o.Bucket == "" {
+			return errors.Errorf("s3 object storage bucket is empty")
+		}
+		if (o.AccessKey == "") != (o.SecretAccessKey == "") {
+			return errors.Errorf("both s3 object storage access key and secret access key must be specified")
+		}
+	case "":
+		return errors.Errorf("object storage type undefined")
+	default:
+		return errors.Errorf("wrong object storage type %q", o.Type)
+	}
+	switch o.ServerSideEncryption.Type {
+	case "", ServerSideEncryptionTypeS3:
+		if o.ServerSideEncryption.KMSKeyID != "" {
+			return errors.Errorf("object storage serverSideEncryption kmsKeyID can be set only with type %q", ServerSideEncryptionTypeKMS)
+		}
+	case ServerSideEncryptionTypeKMS:
+	default:
+		return errors.Errorf("wrong object storage serverSideEncryption type %q", o.ServerSideEncryption.Type)
+	}
+	if o.RetryBaseDelay < 0 {
+		return errors.Errorf("object storage retryBaseDelay must be greater or equal than 0")
+	}
+	if o.OperationTimeout < 0 {
+		return errors.Errorf("object storage operationTimeout must be greater or equal than 0")
+	}
+	if o.MigrateFrom != nil {
+		if o.MigrateFrom.MigrateFrom != nil {
+			return errors.Errorf("object storage migrateFrom cannot be migrating from another object storage")
+		}
+		if err := validateObjectStorage(o.MigrateFrom); err != nil {
+			return errors.Errorf("object storage migrateFrom configuration error: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func validateWebhooks(w *ConfigstoreWebhooks) error {
+	for _, u := range w.URLs {
+		pu, err := url.Parse(u)
+		if err != nil {
+			return errors.Errorf("wrong url %q: %w", u, err)
+		}
+		if pu.Scheme != "http" && pu.Scheme != "https" {
+			return errors.Errorf("wrong url %q: scheme must be http or https", u)
+		}
+	}
+	if w.RetryInterval < 0 {
+		return errors.Errorf("retryInterval must be greater or equal than 0")
+	}
+	return nil
+}
+
+func validateCacheControl(c *CacheControl) error {
+	if c.DefaultMaxAge < 0 {
+		return errors.Errorf("defaultMaxAge must be greater or equal than 0")
+	}
+	for resource, maxAge := range c.MaxAge {
+		if maxAge < 0 {
+			return errors.Errorf("resource %q maxAge must be greater or equal than 0", resource)
+		}
+	}
+	return nil
+}
+
+func validateReadReplica(r *ReadReplica) error {
+	if r.WriterURL == "" {
+		return nil
+	}
+	u, err := url.Parse(r.WriterURL)
+	if err != nil {
+		return errors.Errorf("wrong writerURL %q: %w", r.WriterURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return errors.Errorf("wrong writerURL %q: must be in the form scheme://host[:port][/path]", r.WriterURL)
+	}
+	return nil
+}
+
+func validateRateLimit(r *RateLimit) error {
+	if !r.Enabled {
+		return nil
+	}
+	rules := []struct {
+		name string
+		rule RateLimitRule
+	}{
+		{name: "token", rule: r.Token},
+		{name: "ip", rule: r.IP},
+	}
+	for _, r := range rules {
+		if r.rule.RequestsPerSecond <= 0 {
+			return errors.Errorf("%s requestsPerSecond must be greater than 0", r.name)
+		}
+		if r.rule.Burst < 0 {
+			return errors.Errorf("%s burst must be greater or equal than 0", r.name)
+		}
+	}
+	if r.IdleTimeout < 0 {
+		return errors.Errorf("idleTimeout must be greater or equal than 0")
+	}
 	return nil
 }
 
 func Validate(c *Config, componentsNames []string) error {
+	return validate(c, componentsNames, true)
+}
+
+// Check validates the configuration of the enabled components like Validate
+// but reports all the configstore problems at once, including the ones of its
+// environment (data dir writability, tls files), instead of only the first one
+func Check(c *Config, componentsNames []string) []error {
+	var errs []error
+	configstoreEnabled := isComponentEnabled(componentsNames, "configstore")
+	if configstoreEnabled {
+		errs = append(errs, CheckConfigstore(&c.Configstore)...)
+	}
+	// the configstore problems are already reported
+	if err := validate(c, componentsNames, !configstoreEnabled); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// CheckConfigstore returns all the problems of the configstore configuration
+// and of its environment
+func CheckConfigstore(c *Configstore) []error {
+	errs := validateConfigstore(c)
+
+	if c.DataDir != "" {
+		if err := checkDirWritable(c.DataDir); err != nil {
+			errs = append(errs, errors.Errorf("configstore dataDir %q isn't writable: %w", c.DataDir, err))
+		}
+	}
+	if c.Web.TLS {
+		for _, f := range []string{c.Web.TLSCertFile, c.Web.TLSKeyFile} {
+			if f == "" {
+				continue
+			}
+			if err := checkFileReadable(f); err != nil {
+				errs = append(errs, errors.Errorf("configstore web configuration error: cannot read tls file: %w", err))
+			}
+		}
+	}
+	if c.ObjectStorage.Type == ObjectStorageTypePosix && c.ObjectStorage.Path != "" {
+		if err := checkDirWritable(c.ObjectStorage.Path); err != nil {
+			errs = append(errs, errors.Errorf("configstore posix object storage path %q isn't writable: %w", c.ObjectStorage.Path, err))
+		}
+	}
+
+	return errs
+}
+
+// validateConfigstore returns all the configstore configuration errors
+func validateConfigstore(c *Configstore) []error {
+	var errs []error
+	if c.DataDir == "" {
+		errs = append(errs, errors.Errorf("configstore dataDir is empty"))
+	}
+	if err := validateWeb(&c.Web); err != nil {
+		errs = append(errs, errors.Errorf("configstore web configuration error: %w", err))
+	}
+	if c.Etcd.Endpoints == "" {
+		errs = append(errs, errors.Errorf("configstore etcd endpoints are empty"))
+	}
+	if err := validateEtcd(&c.Etcd); err != nil {
+		errs = append(errs, errors.Errorf("configstore etcd configuration error: %w", err))
+	}
+	if err := validateObjectStorage(&c.ObjectStorage); err != nil {
+		errs = append(errs, errors.Errorf("configstore object storage configuration error: %w", err))
+	}
+	if c.WalsObjectStorage != nil {
+		if err := validateObjectStorage(c.WalsObjectStorage); err != nil {
+			errs = append(errs, errors.Errorf("configstore wals object storage configuration error: %w", err))
+		}
+	}
+	if c.DataObjectStorage != nil {
+		if err := validateObjectStorage(c.DataObjectStorage); err != nil {
+			errs = append(errs, errors.Errorf("configstore data object storage configuration error: %w", err))
+		}
+	}
+	if c.DefaultProjectsLimit < 0 {
+		errs = append(errs, errors.Errorf("configstore defaultProjectsLimit must be greater or equal than 0"))
+	}
+	if c.DefaultProjectsLimit > MaxProjectsLimit {
+		errs = append(errs, errors.Errorf("configstore defaultProjectsLimit must be less or equal than %d", MaxProjectsLimit))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, errors.Errorf("configstore shutdownTimeout must be greater or equal than 0"))
+	}
+	if c.CheckpointInterval < 0 {
+		errs = append(errs, errors.Errorf("configstore checkpointInterval must be greater or equal than 0"))
+	}
+	if c.CheckpointWalsSizeThreshold < 0 {
+		errs = append(errs, errors.Errorf("configstore checkpointWalsSizeThreshold must be greater or equal than 0"))
+	}
+	if c.StorageWalCleanInterval < 0 {
+		errs = append(errs, errors.Errorf("configstore storageWalCleanInterval must be greater or equal than 0"))
+	}
+	if c.WalFlushInterval < 0 {
+		errs = append(errs, errors.Errorf("configstore walFlushInterval must be greater or equal than 0"))
+	}
+	if c.WalFlushMaxBatchSize < 0 {
+		errs = append(errs, errors.Errorf("configstore walFlushMaxBatchSize must be greater or equal than 0"))
+	}
+	switch c.WalCompression {
+	case "", "none", "gzip":
+	default:
+		errs = append(errs, errors.Errorf("configstore wrong walCompression %q", c.WalCompression))
+	}
+	if c.WalWriterLeaseTTL != 0 && c.WalWriterLeaseTTL < time.Second {
+		errs = append(errs, errors.Errorf("configstore walWriterLeaseTTL must be at least 1s"))
+	}
+	if c.ReadDBCacheTTL < 0 {
+		errs = append(errs, errors.Errorf("configstore readDBCacheTTL must be greater or equal than 0"))
+	}
+	if c.ReadDBSyncBatchSize < 0 || c.ReadDBSyncBatchMaxSize < 0 {
+		errs = append(errs, errors.Errorf("configstore readDBSyncBatchSize and readDBSyncBatchMaxSize must be greater or equal than 0"))
+	}
+	switch c.UniqueNamePolicy {
+	case "", UniqueNamePolicyCaseSensitive, UniqueNamePolicyCaseInsensitive:
+	default:
+		errs = append(errs, errors.Errorf("configstore wrong uniqueNamePolicy %q", c.UniqueNamePolicy))
+	}
+	if err := validateRateLimit(&c.RateLimit); err != nil {
+		errs = append(errs, errors.Errorf("configstore rate limit configuration error: %w", err))
+	}
+	if err := validateWebhooks(&c.Webhooks); err != nil {
+		errs = append(errs, errors.Errorf("configstore webhooks configuration error: %w", err))
+	}
+	if c.SoftDelete.Retention < 0 {
+		errs = append(errs, errors.Errorf("configstore softDelete retention must be greater or equal than 0"))
+	}
+	if c.RequestTimeout.Read < 0 || c.RequestTimeout.Write < 0 {
+		errs = append(errs, errors.Errorf("configstore requestTimeout must be greater or equal than 0"))
+	}
+	if c.RequestBodyLimit.MaxSize < 0 || c.RequestBodyLimit.ImportMaxSize < 0 {
+		errs = append(errs, errors.Errorf("configstore requestBodyLimit must be greater or equal than 0"))
+	}
+	if c.Compression.MinSize < 0 {
+		errs = append(errs, errors.Errorf("configstore compression minSize must be greater or equal than 0"))
+	}
+	if err := validateCacheControl(&c.CacheControl); err != nil {
+		errs = append(errs, errors.Errorf("configstore cacheControl configuration error: %w", err))
+	}
+	if c.Admin.ListenAddress != "" && c.Admin.ListenAddress == c.Web.ListenAddress {
+		errs = append(errs, errors.Errorf("configstore admin listenAddress must be different than the web listenAddress"))
+	}
+	if c.Admin.Pprof && c.Admin.ListenAddress == "" {
+		errs = append(errs, errors.Errorf("configstore admin pprof requires an admin listenAddress"))
+	}
+	if c.HTTP2.IdleTimeout < 0 {
+		errs = append(errs, errors.Errorf("configstore http2 idleTimeout must be greater or equal than 0"))
+	}
+	if err := validateReadReplica(&c.ReadReplica); err != nil {
+		errs = append(errs, errors.Errorf("configstore readReplica configuration error: %w", err))
+	}
+	if c.IdempotencyKeyTTL < 0 {
+		errs = append(errs, errors.Errorf("configstore idempotencyKeyTTL must be greater or equal than 0"))
+	}
+	if c.Auth.Enabled && c.Auth.AdminToken == "" {
+		errs = append(errs, errors.Errorf("configstore auth enabled but no admin token specified"))
+	}
+	switch c.Auth.AccessDeniedPolicy {
+	case "", AccessDeniedPolicyForbidden, AccessDeniedPolicyNotFound:
+	default:
+		errs = append(errs, errors.Errorf("configstore auth wrong accessDeniedPolicy %q", c.Auth.AccessDeniedPolicy))
+	}
+	if _, err := c.DataDirFileMode(); err != nil {
+		errs = append(errs, errors.Errorf("configstore configuration error: %w", err))
+	}
+	if _, err := c.SecretsKey(); err != nil {
+		errs = append(errs, errors.Errorf("configstore configuration error: %w", err))
+	}
+	return errs
+}
+
+// checkDirWritable checks that a file can be created in dir or, if it doesn't
+// exist yet, in its nearest existing parent where it'll be created
+func checkDirWritable(dir string) error {
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return errors.Errorf("%q isn't a directory", dir)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+
+	f, err := ioutil.TempFile(dir, ".agola-check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkFileReadable(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func validate(c *Config, componentsNames []string, validateCS bool) error {
 	// Global
 	if len(c.ID) > maxIDLength {
 		return errors.Errorf("id too long")
@@ -292,12 +1133,9 @@ func Validate(c *Config, componentsNames []string) error {
 	}
 
 	// Configstore
-	if isComponentEnabled(componentsNames, "configstore") {
-		if c.Configstore.DataDir == "" {
-			return errors.Errorf("configstore dataDir is empty")
-		}
-		if err := validateWeb(&c.Configstore.Web); err != nil {
-			return errors.Errorf("configstore web configuration error: %w", err)
+	if validateCS && isComponentEnabled(componentsNames, "configstore") {
+		if errs := validateConfigstore(&c.Configstore); len(errs) > 0 {
+			return errs[0]
 		}
 	}
 
@@ -309,6 +1147,12 @@ func Validate(c *Config, componentsNames []string) error {
 		if err := validateWeb(&c.Runservice.Web); err != nil {
 			return errors.Errorf("runservice web configuration error: %w", err)
 		}
+		if err := validateEtcd(&c.Runservice.Etcd); err != nil {
+			return errors.Errorf("runservice etcd configuration error: %w", err)
+		}
+		if err := validateObjectStorage(&c.Runservice.ObjectStorage); err != nil {
+			return errors.Errorf("runservice object storage configuration error: %w", err)
+		}
 	}
 
 	// Executor
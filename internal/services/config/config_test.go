@@ -15,11 +15,13 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	errors "golang.org/x/xerrors"
 )
 
@@ -225,6 +227,769 @@ gitserver:
   dataDir:`,
 			err: errors.Errorf("git server dataDir is empty"),
 		},
+		{
+			name:     "test config for configstore with cors allowed origins",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+    allowedOrigins:
+      - "https://agola.example.com"
+      - "http://localhost:8080"
+    allowedMethods:
+      - GET
+      - POST
+    maxAge: 2m`,
+		},
+		{
+			name:     "test config for configstore with wrong cors allowed origin",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+    allowedOrigins:
+      - "agola.example.com"`,
+			err: errors.Errorf(`configstore web configuration error: wrong allowed origin "agola.example.com": must be "*" or in the form scheme://host[:port]`),
+		},
+		{
+			name:     "test config for configstore with wrong cors max age",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+    allowedOrigins:
+      - "https://agola.example.com"
+    maxAge: 1h`,
+			err: errors.Errorf("configstore web configuration error: cors max age must be between 0 and 10m0s"),
+		},
+		{
+			name:     "test config for configstore with wrong secrets encryption key",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  secretsEncryptionKey: c2hvcnQ=
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf("configstore configuration error: secrets encryption key must be 32 bytes long"),
+		},
+		{
+			name:     "test config for configstore with etcd tls cert without key",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "https://localhost:2379"
+    tlsCertFile: /etc/agola/etcd/client.crt
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf("configstore etcd configuration error: both tls cert file and tls key file must be specified"),
+		},
+		{
+			name:     "test config for configstore with not existing etcd tls ca file",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "https://localhost:2379"
+    tlsCAFile: /not/existing/ca.crt
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf("configstore etcd configuration error: cannot read tls file: open /not/existing/ca.crt: no such file or directory"),
+		},
+		{
+			name:     "test config for configstore with etcd password without username",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+    password: secret
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf("configstore etcd configuration error: password specified without an username"),
+		},
+		{
+			name:     "test config for configstore with negative etcd pool size",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+    poolSize: -1
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf("configstore etcd configuration error: poolSize must be greater or equal than 0"),
+		},
+		{
+			name:     "test config for configstore with negative idempotency key ttl",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  idempotencyKeyTTL: -1s`,
+			err: errors.Errorf("configstore idempotencyKeyTTL must be greater or equal than 0"),
+		},
+		{
+			name:     "test config for configstore with default projects limit greater than the max",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  defaultProjectsLimit: 21`,
+			err: errors.Errorf("configstore defaultProjectsLimit must be less or equal than 20"),
+		},
+		{
+			name:     "test config for configstore with negative resource cache max age",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  cacheControl:
+    maxAge:
+      remotesources: -1m`,
+			err: errors.Errorf(`configstore cacheControl configuration error: resource "remotesources" maxAge must be greater or equal than 0`),
+		},
+		{
+			name:     "test config for configstore with admin listen address equal to the web listen address",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  admin:
+    listenAddress: ":4002"`,
+			err: errors.Errorf(`configstore admin listenAddress must be different than the web listenAddress`),
+		},
+		{
+			name:     "test config for configstore with admin pprof without admin listen address",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  admin:
+    pprof: true`,
+			err: errors.Errorf(`configstore admin pprof requires an admin listenAddress`),
+		},
+		{
+			name:     "test config for configstore with negative http2 idle timeout",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  http2:
+    enabled: true
+    idleTimeout: -1s`,
+			err: errors.Errorf(`configstore http2 idleTimeout must be greater or equal than 0`),
+		},
+		{
+			name:     "test config for configstore read replica with wrong writer url",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  readReplica:
+    enabled: true
+    writerURL: "configstore:4002"`,
+			err: errors.Errorf(`configstore readReplica configuration error: wrong writerURL "configstore:4002": must be in the form scheme://host[:port][/path]`),
+		},
+		{
+			name:     "test config for configstore with minio s3 object storage",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: s3
+    endpoint: "http://minio:9000"
+    bucket: agola-configstore
+    location: us-east-1
+    accessKey: minio
+    secretAccessKey: minio123
+    forcePathStyle: true
+  web:
+    listenAddress: ":4002"`,
+		},
+		{
+			name:     "test config for configstore with s3 object storage without endpoint",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: s3
+    bucket: agola-configstore
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf(`configstore object storage configuration error: s3 object storage endpoint is empty`),
+		},
+		{
+			name:     "test config for configstore with s3 object storage with wrong endpoint scheme",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: s3
+    endpoint: "minio:9000"
+    bucket: agola-configstore
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf(`configstore object storage configuration error: wrong s3 object storage endpoint scheme "minio" (must be http or https)`),
+		},
+		{
+			name:     "test config for configstore with s3 object storage without bucket",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: s3
+    endpoint: "https://s3.example.com"
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf(`configstore object storage configuration error: s3 object storage bucket is empty`),
+		},
+		{
+			name:     "test config for configstore with s3 object storage access key without secret access key",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: s3
+    endpoint: "https://s3.example.com"
+    bucket: agola-configstore
+    accessKey: minio
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf(`configstore object storage configuration error: both s3 object storage access key and secret access key must be specified`),
+		},
+		{
+			name:     "test config for configstore with wrong object storage type",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: gcs
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf(`configstore object storage configuration error: wrong object storage type "gcs"`),
+		},
+		{
+			name:     "test config for configstore with wals and data object storages migrating from another bucket",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: s3
+    endpoint: "http://minio:9000"
+    bucket: agola-configstore
+  walsObjectStorage:
+    type: s3
+    endpoint: "http://minio:9000"
+    bucket: agola-configstore-wals
+    migrateFrom:
+      type: s3
+      endpoint: "http://minio:9000"
+      bucket: agola-configstore
+  dataObjectStorage:
+    type: s3
+    endpoint: "http://minio:9000"
+    bucket: agola-configstore
+    prefix: data
+  web:
+    listenAddress: ":4002"`,
+		},
+		{
+			name:     "test config for configstore with wals object storage without bucket",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: s3
+    endpoint: "http://minio:9000"
+    bucket: agola-configstore
+  walsObjectStorage:
+    type: s3
+    endpoint: "http://minio:9000"
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf(`configstore wals object storage configuration error: s3 object storage bucket is empty`),
+		},
+		{
+			name:     "test config for configstore with object storage migrating from a migrating object storage",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: s3
+    endpoint: "http://minio:9000"
+    bucket: agola-configstore
+  dataObjectStorage:
+    type: s3
+    endpoint: "http://minio:9000"
+    bucket: agola-configstore-data
+    migrateFrom:
+      type: s3
+      endpoint: "http://minio:9000"
+      bucket: agola-configstore-old
+      migrateFrom:
+        type: s3
+        endpoint: "http://minio:9000"
+        bucket: agola-configstore
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf(`configstore data object storage configuration error: object storage migrateFrom cannot be migrating from another object storage`),
+		},
+		{
+			name:     "test config for configstore with negative object storage retry base delay",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+    maxRetries: 5
+    retryBaseDelay: -1s
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf("configstore object storage configuration error: object storage retryBaseDelay must be greater or equal than 0"),
+		},
+		{
+			name:     "test config for configstore with negative object storage operation timeout",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+    operationTimeout: -1s
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf("configstore object storage configuration error: object storage operationTimeout must be greater or equal than 0"),
+		},
+		{
+			name:     "test config for configstore with wrong object storage server side encryption type",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: s3
+    endpoint: "http://minio:9000"
+    bucket: agola-configstore
+    serverSideEncryption:
+      type: sse-c
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf(`configstore object storage configuration error: wrong object storage serverSideEncryption type "sse-c"`),
+		},
+		{
+			name:     "test config for configstore with object storage kms key id without sse-kms",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: s3
+    endpoint: "http://minio:9000"
+    bucket: agola-configstore
+    serverSideEncryption:
+      type: sse-s3
+      kmsKeyID: key01
+  web:
+    listenAddress: ":4002"`,
+			err: errors.Errorf(`configstore object storage configuration error: object storage serverSideEncryption kmsKeyID can be set only with type "sse-kms"`),
+		},
+		{
+			name:     "test config for configstore with auth enabled without admin token",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  auth:
+    enabled: true`,
+			err: errors.Errorf("configstore auth enabled but no admin token specified"),
+		},
+		{
+			name:     "test config for configstore with negative readdb sync batch size",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  readDBSyncBatchSize: -1`,
+			err: errors.Errorf("configstore readDBSyncBatchSize and readDBSyncBatchMaxSize must be greater or equal than 0"),
+		},
+		{
+			name:     "test config for configstore with auth access denied policy",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  auth:
+    enabled: true
+    adminToken: "admintoken"
+    accessDeniedPolicy: notFound`,
+		},
+		{
+			name:     "test config for configstore with wrong wal compression",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  walCompression: zstd`,
+			err: errors.Errorf(`configstore wrong walCompression "zstd"`),
+		},
+		{
+			name:     "test config for configstore with wrong wal writer lease ttl",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  walWriterLease: true
+  walWriterLeaseTTL: 100ms`,
+			err: errors.Errorf("configstore walWriterLeaseTTL must be at least 1s"),
+		},
+		{
+			name:     "test config for configstore with case insensitive unique name policy",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  uniqueNamePolicy: caseInsensitive`,
+		},
+		{
+			name:     "test config for configstore with wrong unique name policy",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  uniqueNamePolicy: lowercase`,
+			err: errors.Errorf(`configstore wrong uniqueNamePolicy "lowercase"`),
+		},
+		{
+			name:     "test config for configstore with auth wrong access denied policy",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  auth:
+    enabled: true
+    adminToken: "admintoken"
+    accessDeniedPolicy: hide`,
+			err: errors.Errorf(`configstore auth wrong accessDeniedPolicy "hide"`),
+		},
+		{
+			name:     "test config for configstore with rate limit",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  rateLimit:
+    enabled: true
+    token:
+      requestsPerSecond: 100
+      burst: 200
+    ip:
+      requestsPerSecond: 10`,
+		},
+		{
+			name:     "test config for configstore with rate limit without ip requests per second",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  rateLimit:
+    enabled: true
+    token:
+      requestsPerSecond: 100`,
+			err: errors.Errorf("configstore rate limit configuration error: ip requestsPerSecond must be greater than 0"),
+		},
+		{
+			name:     "test config for configstore with soft delete",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  softDelete:
+    enabled: true
+    retention: 72h`,
+		},
+		{
+			name:     "test config for configstore with negative soft delete retention",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  softDelete:
+    enabled: true
+    retention: -1h`,
+			err: errors.Errorf("configstore softDelete retention must be greater or equal than 0"),
+		},
+		{
+			name:     "test config for configstore with negative request body limit",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  requestBodyLimit:
+    maxSize: 1048576
+    importMaxSize: -1`,
+			err: errors.Errorf("configstore requestBodyLimit must be greater or equal than 0"),
+		},
+		{
+			name:     "test config for configstore with webhooks",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  webhooks:
+    urls:
+      - https://hooks.example.com/agola
+    secret: secret
+    maxRetries: 3
+    retryInterval: 2s`,
+		},
+		{
+			name:     "test config for configstore with wrong webhook url",
+			services: []string{"configstore"},
+			in: `
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: /agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+  webhooks:
+    urls:
+      - hooks.example.com/agola`,
+			err: errors.Errorf(`configstore webhooks configuration error: wrong url "hooks.example.com/agola": scheme must be http or https`),
+		},
 	}
 
 	for _, tt := range tests {
@@ -255,3 +1020,156 @@ gitserver:
 		})
 	}
 }
+
+func TestCheckConfigstore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "CheckConfig")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a file used where a directory is expected
+	notDir := path.Join(dir, "file")
+	if err := ioutil.WriteFile(notDir, []byte{}, 0644); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		in   string
+		errs []string
+	}{
+		{
+			name: "valid config",
+			in: `
+configstore:
+  dataDir: ` + path.Join(dir, "configstore") + `
+  dataDirMode: "0750"
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: ` + path.Join(dir, "ost") + `
+  web:
+    listenAddress: ":4002"`,
+		},
+		{
+			name: "missing required fields",
+			in: `
+configstore:
+  web:
+    listenAddress: ":4002"`,
+			errs: []string{
+				"configstore dataDir is empty",
+				"configstore etcd endpoints are empty",
+				"configstore object storage configuration error: object storage type undefined",
+			},
+		},
+		{
+			name: "not writable data dir and missing tls files",
+			in: `
+configstore:
+  dataDir: ` + path.Join(notDir, "configstore") + `
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: ` + notDir + `
+  web:
+    listenAddress: ":4002"
+    tls: true
+    tlsCertFile: ` + path.Join(dir, "cert.pem") + `
+    tlsKeyFile: ` + path.Join(dir, "key.pem"),
+			errs: []string{
+				`configstore dataDir "` + path.Join(notDir, "configstore") + `" isn't writable: stat ` + path.Join(notDir, "configstore") + `: not a directory`,
+				"configstore web configuration error: cannot read tls file: open " + path.Join(dir, "cert.pem") + ": no such file or directory",
+				"configstore web configuration error: cannot read tls file: open " + path.Join(dir, "key.pem") + ": no such file or directory",
+				`configstore posix object storage path "` + notDir + `" isn't writable: "` + notDir + `" isn't a directory`,
+			},
+		},
+		{
+			name: "wrong values",
+			in: `
+configstore:
+  dataDir: ` + path.Join(dir, "configstore") + `
+  etcd:
+    endpoints: "http://localhost:2379"
+    password: password
+  objectStorage:
+    type: s3
+    endpoint: "http://minio:9000"
+  web:
+    listenAddress: ":4002"
+    tls: true
+  shutdownTimeout: -1s
+  auth:
+    enabled: true`,
+			errs: []string{
+				"configstore web configuration error: no tls key file specified",
+				"configstore etcd configuration error: password specified without an username",
+				"configstore object storage configuration error: s3 object storage bucket is empty",
+				"configstore shutdownTimeout must be greater or equal than 0",
+				"configstore auth enabled but no admin token specified",
+			},
+		},
+		{
+			name: "wrong data dir mode",
+			in: `
+configstore:
+  dataDir: ` + path.Join(dir, "configstore") + `
+  dataDirMode: "0640"
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: ` + path.Join(dir, "ost") + `
+  web:
+    listenAddress: ":4002"`,
+			errs: []string{
+				`configstore configuration error: wrong dataDirMode "0640", the owner must have read, write and execute permissions`,
+			},
+		},
+		{
+			name: "not octal data dir mode",
+			in: `
+configstore:
+  dataDir: ` + path.Join(dir, "configstore") + `
+  dataDirMode: "rwx"
+  etcd:
+    endpoints: "http://localhost:2379"
+  objectStorage:
+    type: posix
+    path: ` + path.Join(dir, "ost") + `
+  web:
+    listenAddress: ":4002"`,
+			errs: []string{
+				`configstore configuration error: wrong dataDirMode "rwx", must be an octal permission mode`,
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := path.Join(dir, fmt.Sprintf("config%d.yml", i))
+			if err := ioutil.WriteFile(configFile, []byte(tt.in), 0644); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			c, err := Load(configFile)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			errs := []string{}
+			for _, err := range Check(c, []string{"configstore"}) {
+				errs = append(errs, err.Error())
+			}
+			expectedErrs := tt.errs
+			if expectedErrs == nil {
+				expectedErrs = []string{}
+			}
+			if diff := cmp.Diff(expectedErrs, errs); diff != "" {
+				t.Fatalf("errors mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -15,19 +15,64 @@
 package action
 
 import (
+	"time"
+
 	"agola.io/agola/internal/datamanager"
 	"agola.io/agola/internal/etcd"
 	"agola.io/agola/internal/services/configstore/readdb"
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/configstore/types"
 
 	"go.uber.org/zap"
 )
 
+// error codes returned by the actions in addition to the generic ones defined
+// by the util package
+const (
+	ErrorCodeProjectAlreadyExists util.ErrorCode = "project_already_exists"
+	ErrorCodeProjectNotExist      util.ErrorCode = "project_not_exist"
+	ErrorCodeProjectGroupNotEmpty util.ErrorCode = "project_group_not_empty"
+	ErrorCodeRevisionMismatch     util.ErrorCode = "revision_mismatch"
+	ErrorCodeUsersImportRejected  util.ErrorCode = "users_import_rejected"
+	ErrorCodeIdempotencyKeyReused util.ErrorCode = "idempotency_key_reused"
+	ErrorCodeUserAlreadyExists    util.ErrorCode = "user_already_exists"
+
+	ErrorCodeRemoteSourceAlreadyExists util.ErrorCode = "remote_source_already_exists"
+	ErrorCodeRemoteSourceNotExist      util.ErrorCode = "remote_source_not_exist"
+
+	ErrorCodeLinkedAccountAlreadyExists util.ErrorCode = "linked_account_already_exists"
+)
+
 type ActionHandler struct {
 	log             *zap.SugaredLogger
 	readDB          *readdb.ReadDB
 	dm              *datamanager.DataManager
 	e               *etcd.Store
 	maintenanceMode bool
+	// secretsKey is the key used to encrypt the secrets data. When nil the
+	// secrets data isn't encrypted
+	secretsKey []byte
+	// softDelete reports if the deleted users and projects are kept, and can
+	// be restored, for deletedResourcesRetention
+	softDelete                bool
+	deletedResourcesRetention time.Duration
+	// idempotencyKeyTTL is the time the idempotency key of a create operation
+	// is remembered
+	idempotencyKeyTTL time.Duration
+
+	readOnly readOnlyMode
+
+	githubAppTokens *githubAppTokenCache
+
+	changeNotifier ChangeNotifier
+}
+
+// ChangeNotifier is notified of the changes successfully applied by the
+// actions
+type ChangeNotifier interface {
+	// Notify receives the audit entries of the applied changes. It must not
+	// block
+	Notify(entries []*types.AuditEntry)
 }
 
 func NewActionHandler(logger *zap.Logger, readDB *readdb.ReadDB, dm *datamanager.DataManager, e *etcd.Store) *ActionHandler {
@@ -37,9 +82,31 @@ func NewActionHandler(logger *zap.Logger, readDB *readdb.ReadDB, dm *datamanager
 		dm:              dm,
 		e:               e,
 		maintenanceMode: false,
+		githubAppTokens: newGithubAppTokenCache(),
+
+		deletedResourcesRetention: DefaultDeletedResourcesRetention,
+		idempotencyKeyTTL:         DefaultIdempotencyKeyTTL,
 	}
 }
 
 func (h *ActionHandler) SetMaintenanceMode(maintenanceMode bool) {
 	h.maintenanceMode = maintenanceMode
 }
+
+func (h *ActionHandler) SetSecretsKey(secretsKey []byte) {
+	h.secretsKey = secretsKey
+}
+
+func (h *ActionHandler) SetChangeNotifier(changeNotifier ChangeNotifier) {
+	h.changeNotifier = changeNotifier
+}
+
+// SetSoftDelete enables or disables the soft delete of users and projects.
+// When retention is 0 the default retention is used
+func (h *ActionHandler) SetSoftDelete(enabled bool, retention time.Duration) {
+	if retention == 0 {
+		retention = DefaultDeletedResourcesRetention
+	}
+	h.softDelete = enabled
+	h.deletedResourcesRetention = retention
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package action
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/datamanager"
+	"agola.io/agola/services/configstore/types"
+
+	uuid "github.com/satori/go.uuid"
+	errors "golang.org/x/xerrors"
+)
+
+type actorKeyType struct{}
+
+var actorKey actorKeyType
+
+// WithActor returns a copy of ctx with the actor that requested the
+// operations. It's recorded in the audit entries.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+// Actor returns the actor saved in ctx by WithActor
+func Actor(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey).(string)
+	return actor
+}
+
+type writeRevisionKeyType struct{}
+
+var writeRevisionKey writeRevisionKeyType
+
+// WriteRevision records the revision of the changes written by the operations
+// executed with a context returned by WithWriteRevision
+type WriteRevision struct {
+	mu       sync.Mutex
+	revision int64
+}
+
+// Revision returns the revision of the last written change, 0 if nothing has
+// been written
+func (wr *WriteRevision) Revision() int64 {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return wr.revision
+}
+
+func (wr *WriteRevision) set(revision int64) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if revision > wr.revision {
+		wr.revision = revision
+	}
+}
+
+// WithWriteRevision returns a copy of ctx where the revision of the written
+// changes is recorded in wr
+func WithWriteRevision(ctx context.Context, wr *WriteRevision) context.Context {
+	return context.WithValue(ctx, writeRevisionKey, wr)
+}
+
+// writeWal writes the actions adding an audit entry for every changed
+// resource. Since the audit entries are written in the same wal they are
+// committed (or not) together with the change.
+func (h *ActionHandler) writeWal(ctx context.Context, operation string, actions []*datamanager.Action, cgt *datamanager.ChangeGroupsUpdateToken) (*datamanager.ChangeGroupsUpdateToken, error) {
+	endWrite, err := h.startWrite()
+	if err != nil {
+		return nil, err
+	}
+	defer endWrite()
+
+	now := time.Now().UTC()
+	actor := Actor(ctx)
+
+	entries := make([]*types.AuditEntry, 0, len(actions))
+	auditActions := make([]*datamanager.Action, 0, len(actions))
+	for _, action := range actions {
+		entry := &types.AuditEntry{
+			ID:           uuid.NewV4().String(),
+			Time:         now,
+			Actor:        actor,
+			Operation:    operation,
+			ResourceType: types.ConfigType(action.DataType),
+			ResourceID:   action.ID,
+			Deleted:      action.ActionType == datamanager.ActionTypeDelete,
+		}
+		entryj, err := json.Marshal(entry)
+		if err != nil {
+			return nil, errors.Errorf("failed to marshal audit entry: %w", err)
+		}
+		entries = append(entries, entry)
+		auditActions = append(auditActions, &datamanager.Action{
+			ActionType: datamanager.ActionTypePut,
+			DataType:   string(types.ConfigTypeAuditEntry),
+			ID:         entry.ID,
+			Data:       entryj,
+		})
+	}
+
+	ncgt, err := h.dm.WriteWal(ctx, append(actions, auditActions...), cgt)
+	if err != nil {
+		return nil, err
+	}
+	if wr, ok := ctx.Value(writeRevisionKey).(*WriteRevision); ok {
+		wr.set(ncgt.CurRevision)
+	}
+	if h.changeNotifier != nil {
+		h.changeNotifier.Notify(entries)
+	}
+	return ncgt, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package action
+
+import (
+	"context"
+
+	"agola.io/agola/services/configstore/types"
+)
+
+// Principal is the authenticated entity that requested the operations
+type Principal struct {
+	// UserID and UserName are empty when not authenticated with a user token
+	UserID   string
+	UserName string
+	// TokenName is the name of the user token used to authenticate
+	TokenName string
+
+	Scopes []types.TokenScope
+}
+
+// HasScope reports if the principal scopes allow the operations of the
+// required scope
+func (p *Principal) HasScope(required types.TokenScope) bool {
+	for _, scope := range p.Scopes {
+		if types.TokenScopeIncludes(scope, required) {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKeyType struct{}
+
+var principalKey principalKeyType
+
+// WithPrincipal returns a copy of ctx with the authenticated principal
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// PrincipalFromContext returns the principal saved in ctx by WithPrincipal or
+// nil if the request isn't authenticated
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey).(*Principal)
+	return principal
+}
@@ -0,0 +1,283 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package action
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"time"
+
+	"agola.io/agola/internal/datamanager"
+	"agola.io/agola/internal/db"
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/configstore/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	DefaultDeletedResourcesRetention = 7 * 24 * time.Hour
+
+	// purgeDeletedResourcesBatchSize is the max number of expired deleted
+	// resources removed by a single purge
+	purgeDeletedResourcesBatchSize = 100
+)
+
+// softDeleteAction returns the action saving the soft deleted resource. The
+// resource DeletionTime must already be set to deletionTime.
+func softDeleteAction(resourceType types.ConfigType, id string, deletionTime time.Time, resource interface{}) (*datamanager.Action, error) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, errors.Errorf("failed to marshal %s: %w", resourceType, err)
+	}
+	dr := &types.DeletedResource{
+		ID:           id,
+		ResourceType: resourceType,
+		DeletionTime: deletionTime,
+		Data:         data,
+	}
+	drj, err := json.Marshal(dr)
+	if err != nil {
+		return nil, errors.Errorf("failed to marshal deleted resource: %w", err)
+	}
+	return &datamanager.Action{
+		ActionType: datamanager.ActionTypePut,
+		DataType:   string(types.ConfigTypeDeletedResource),
+		ID:         id,
+		Data:       drj,
+	}, nil
+}
+
+// getRestorableResource returns the soft deleted resource with the provided
+// id and type if its retention time hasn't passed
+func (h *ActionHandler) getRestorableResource(tx *db.Tx, resourceType types.ConfigType, id string) (*types.DeletedResource, error) {
+	dr, err := h.readDB.GetDeletedResource(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if dr == nil || dr.ResourceType != resourceType {
+		return nil, util.NewErrNotExist(errors.Errorf("deleted %s %q doesn't exist", resourceType, id))
+	}
+	if time.Since(dr.DeletionTime) > h.deletedResourcesRetention {
+		return nil, util.NewErrNotExist(errors.Errorf("deleted %s %q retention time has expired", resourceType, id))
+	}
+	return dr, nil
+}
+
+// RestoreProject restores a soft deleted project. The project is restored
+// with the same id, name and parent.
+func (h *ActionHandler) RestoreProject(ctx context.Context, projectID string) (*types.Project, error) {
+	var project *types.Project
+
+	var cgt *datamanager.ChangeGroupsUpdateToken
+
+	// must do all the checks in a single transaction to avoid concurrent changes
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		dr, err := h.getRestorableResource(tx, types.ConfigTypeProject, projectID)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(dr.Data, &project); err != nil {
+			return errors.Errorf("failed to unmarshal project: %w", err)
+		}
+
+		group, err := h.readDB.GetProjectGroup(tx, project.Parent.ID)
+		if err != nil {
+			return err
+		}
+		if group == nil {
+			return util.NewErrBadRequest(errors.Errorf("project group with id %q doesn't exist", project.Parent.ID))
+		}
+
+		groupPath, err := h.readDB.GetProjectGroupPath(tx, group)
+		if err != nil {
+			return err
+		}
+		pp := path.Join(groupPath, project.Name)
+
+		cgNames := []string{util.EncodeSha256Hex(project.ID), util.EncodeSha256Hex("projectpath-" + h.readDB.NameKey(pp)), util.EncodeSha256Hex("deletedresource-" + project.ID)}
+		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
+		if err != nil {
+			return err
+		}
+
+		// check duplicate project name
+		p, err := h.readDB.GetProjectByName(tx, project.Parent.ID, project.Name)
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			return util.NewErrConflict(util.NewAPIError(ErrorCodeProjectAlreadyExists, errors.Errorf("project with name %q, path %q already exists", p.Name, pp)))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	project.DeletionTime = nil
+	pcj, err := json.Marshal(project)
+	if err != nil {
+		return nil, errors.Errorf("failed to marshal project: %w", err)
+	}
+	actions := []*datamanager.Action{
+		{
+			ActionType: datamanager.ActionTypePut,
+			DataType:   string(types.ConfigTypeProject),
+			ID:         project.ID,
+			Data:       pcj,
+		},
+		{
+			ActionType: datamanager.ActionTypeDelete,
+			DataType:   string(types.ConfigTypeDeletedResource),
+			ID:         project.ID,
+		},
+	}
+
+	_, err = h.writeWal(ctx, "restore_project", actions, cgt)
+	return project, err
+}
+
+// RestoreUser restores a soft deleted user with its tokens and linked
+// accounts
+func (h *ActionHandler) RestoreUser(ctx context.Context, userID string) (*types.User, error) {
+	var user *types.User
+
+	var cgt *datamanager.ChangeGroupsUpdateToken
+
+	// must do all the checks in a single transaction to avoid concurrent changes
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		dr, err := h.getRestorableResource(tx, types.ConfigTypeUser, userID)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(dr.Data, &user); err != nil {
+			return errors.Errorf("failed to unmarshal user: %w", err)
+		}
+
+		cgNames := []string{util.EncodeSha256Hex("userid-" + user.ID), util.EncodeSha256Hex("username-" + h.readDB.NameKey(user.Name)), util.EncodeSha256Hex("deletedresource-" + user.ID)}
+		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
+		if err != nil {
+			return err
+		}
+
+		// check duplicate user name
+		u, err := h.readDB.GetUserByName(tx, user.Name)
+		if err != nil {
+			return err
+		}
+		if u != nil {
+			return util.NewErrConflict(util.NewAPIError(ErrorCodeUserAlreadyExists, errors.Errorf("user with name %q already exists", u.Name)))
+		}
+
+		// the remote users of the linked accounts could have been linked to
+		// another user in the meantime
+		for _, la := range user.LinkedAccounts {
+			u, err := h.readDB.GetUserByLinkedAccountRemoteUserIDandSource(tx, la.RemoteUserID, la.RemoteSourceID)
+			if err != nil {
+				return errors.Errorf("failed to get user for remote user id %q and remote source %q: %w", la.RemoteUserID, la.RemoteSourceID, err)
+			}
+			if u != nil {
+				return util.NewErrConflict(util.NewAPIError(ErrorCodeLinkedAccountAlreadyExists, errors.Errorf("remote user id %q for remote source %q is already linked to user %q", la.RemoteUserID, la.RemoteSourceID, u.Name)))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user.DeletionTime = nil
+	userj, err := json.Marshal(user)
+	if err != nil {
+		return nil, errors.Errorf("failed to marshal user: %w", err)
+	}
+	actions := []*datamanager.Action{
+		{
+			ActionType: datamanager.ActionTypePut,
+			DataType:   string(types.ConfigTypeUser),
+			ID:         user.ID,
+			Data:       userj,
+		},
+		{
+			ActionType: datamanager.ActionTypeDelete,
+			DataType:   string(types.ConfigTypeDeletedResource),
+			ID:         user.ID,
+		},
+	}
+
+	_, err = h.writeWal(ctx, "restore_user", actions, cgt)
+	return user, err
+}
+
+// PurgeExpiredDeletedResources permanently removes the soft deleted resources
+// whose retention time has passed
+func (h *ActionHandler) PurgeExpiredDeletedResources(ctx context.Context) error {
+	var drs []*types.DeletedResource
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		drs, err = h.readDB.GetExpiredDeletedResources(tx, time.Now().Add(-h.deletedResourcesRetention), purgeDeletedResourcesBatchSize)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dr := range drs {
+		if err := h.purgeDeletedResource(ctx, dr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *ActionHandler) purgeDeletedResource(ctx context.Context, dr *types.DeletedResource) error {
+	var cgt *datamanager.ChangeGroupsUpdateToken
+	exists := false
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		// changegroup is the deleted resource id to avoid concurrent restores
+		cgNames := []string{util.EncodeSha256Hex("deletedresource-" + dr.ID)}
+		var err error
+		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
+		if err != nil {
+			return err
+		}
+
+		// the resource could have been restored in the meantime
+		cdr, err := h.readDB.GetDeletedResource(tx, dr.ID)
+		exists = cdr != nil
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	actions := []*datamanager.Action{
+		{
+			ActionType: datamanager.ActionTypeDelete,
+			DataType:   string(types.ConfigTypeDeletedResource),
+			ID:         dr.ID,
+		},
+	}
+
+	_, err = h.writeWal(ctx, "purge_deleted_resource", actions, cgt)
+	return err
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package action
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"agola.io/agola/internal/datamanager"
+	"agola.io/agola/internal/db"
+	"agola.io/agola/internal/services/configstore/readdb"
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/configstore/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+// importBatchSize is the max number of resources written in a single wal by
+// ImportResources
+const importBatchSize = 100
+
+// exportFlushRecords is the number of records written by ExportResources
+// between the flushes of its writer
+const exportFlushRecords = 100
+
+// ExportResources writes to w a newline delimited json export of all the
+// configstore resources (audit entries and soft deleted resources excluded).
+// The resources are read in a single readdb transaction so the export is a
+// consistent snapshot at the revision reported in the header.
+// Every resource is written as soon as it's read from the readdb and, if w is
+// an http.Flusher, w is flushed every exportFlushRecords records, so the
+// memory used doesn't depend on the number of exported resources.
+func (h *ActionHandler) ExportResources(ctx context.Context, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	records := 0
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	started := false
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		// the transaction cannot be retried after part of the export has been
+		// written
+		if started {
+			return errors.Errorf("export transaction cannot be retried")
+		}
+		started = true
+
+		revision, err := h.readDB.GetRevisionTx(tx)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(&types.ExportHeader{Version: types.ExportVersion, Revision: revision}); err != nil {
+			return err
+		}
+
+		for _, resourceType := range readdb.ExportedTypes {
+			err := h.readDB.ForEachResource(tx, resourceType, func(data []byte) error {
+				if err := enc.Encode(&types.ExportRecord{Type: resourceType, Data: data}); err != nil {
+					return err
+				}
+				records++
+				if records%exportFlushRecords == 0 {
+					flush()
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	flush()
+	return nil
+}
+
+// ImportResources imports in an empty configstore the resources exported by
+// ExportResources. The resources are written through the wal in batches, so
+// on error only part of them could have been imported.
+func (h *ActionHandler) ImportResources(ctx context.Context, r io.Reader) error {
+	exportedTypes := map[types.ConfigType]struct{}{}
+	for _, resourceType := range readdb.ExportedTypes {
+		exportedTypes[resourceType] = struct{}{}
+	}
+
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		for _, resourceType := range readdb.ExportedTypes {
+			exists, err := h.readDB.HasResources(tx, resourceType)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return util.NewErrBadRequest(errors.Errorf("cannot import in a not empty configstore: %s resources already exist", resourceType))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(r)
+
+	var header *types.ExportHeader
+	if err := dec.Decode(&header); err != nil {
+		return util.NewErrBadRequest(errors.Errorf("failed to decode export header: %w", err))
+	}
+	if header.Version != types.ExportVersion {
+		return util.NewErrBadRequest(errors.Errorf("unsupported export version %d", header.Version))
+	}
+
+	actions := []*datamanager.Action{}
+	for {
+		var record *types.ExportRecord
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return util.NewErrBadRequest(errors.Errorf("failed to decode export record: %w", err))
+		}
+		if _, ok := exportedTypes[record.Type]; !ok {
+			return util.NewErrBadRequest(errors.Errorf("unsupported resource type %q", record.Type))
+		}
+		var resource struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(record.Data, &resource); err != nil {
+			return util.NewErrBadRequest(errors.Errorf("failed to unmarshal %s: %w", record.Type, err))
+		}
+		if resource.ID == "" {
+			return util.NewErrBadRequest(errors.Errorf("%s without id", record.Type))
+		}
+
+		actions = append(actions, &datamanager.Action{
+			ActionType: datamanager.ActionTypePut,
+			DataType:   string(record.Type),
+			ID:         resource.ID,
+			Data:       record.Data,
+		})
+		if len(actions) == importBatchSize {
+			if _, err := h.writeWal(ctx, "import_resources", actions, nil); err != nil {
+				return err
+			}
+			actions = []*datamanager.Action{}
+		}
+	}
+	if len(actions) > 0 {
+		if _, err := h.writeWal(ctx, "import_resources", actions, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package action
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"time"
+
+	"agola.io/agola/internal/db"
+	"agola.io/agola/internal/etcd"
+	"agola.io/agola/internal/services/configstore/common"
+	"agola.io/agola/internal/util"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	// DefaultIdempotencyKeyTTL is the default time an idempotency key is
+	// remembered
+	DefaultIdempotencyKeyTTL = 24 * time.Hour
+
+	// idempotencyWaitTimeout is the max time waiting for the readdb to apply
+	// the resource created by a previous request with the same idempotency key
+	idempotencyWaitTimeout = 10 * time.Second
+)
+
+type idempotencyKeyType struct{}
+
+var idempotencyKey idempotencyKeyType
+
+// WithIdempotencyKey returns a copy of ctx with the idempotency key of the
+// request. A create operation executed with the key of a previous create
+// operation returns the resource created by it instead of creating a new one.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey, key)
+}
+
+// idempotencyRecord is the result of a create operation saved in etcd with its
+// idempotency key. A record without the resource id reserves the key for the
+// create operation in progress.
+type idempotencyRecord struct {
+	Operation  string `json:"operation"`
+	ResourceID string `json:"resource_id"`
+	// Revision is the revision of the wal creating the resource
+	Revision int64 `json:"revision"`
+}
+
+// SetIdempotencyKeyTTL sets the time an idempotency key is remembered. When ttl
+// is 0 the default is used
+func (h *ActionHandler) SetIdempotencyKeyTTL(ttl time.Duration) {
+	if ttl == 0 {
+		ttl = DefaultIdempotencyKeyTTL
+	}
+	h.idempotencyKeyTTL = ttl
+}
+
+// idempotencyScope returns the scope of the idempotency keys of the request
+// principal, so the same key used by another principal won't return its
+// resources
+func idempotencyScope(ctx context.Context) string {
+	principal := PrincipalFromContext(ctx)
+	switch {
+	case principal == nil:
+		return ""
+	case principal.UserID != "":
+		return "user/" + principal.UserID
+	default:
+		return "admin"
+	}
+}
+
+// idempotent executes create, that returns the id of the created resource,
+// only once for the idempotency key in ctx. When the key was already used by
+// the same operation, get is called with the id of the resource created by
+// it, after the readdb has applied it, and must report if the resource still
+// exists.
+// The key is reserved before calling create so concurrent requests with the
+// same key wait for the first one to complete.
+func (h *ActionHandler) idempotent(ctx context.Context, operation string, create func(ctx context.Context) (string, error), get func(tx *db.Tx, id string) (bool, error)) error {
+	key, _ := ctx.Value(idempotencyKey).(string)
+	if key == "" {
+		_, err := create(ctx)
+		return err
+	}
+	etcdKey := path.Join(common.EtcdIdempotencyKeysDir, util.EncodeSha256Hex(idempotencyScope(ctx)+"/"+key))
+
+	rec, reservedRevision, err := h.reserveIdempotencyKey(ctx, etcdKey, key, operation)
+	if err != nil {
+		return err
+	}
+	if rec != nil {
+		wctx, cancel := context.WithTimeout(ctx, idempotencyWaitTimeout)
+		err := h.readDB.WaitRevision(wctx, rec.Revision)
+		timedOut := wctx.Err() == context.DeadlineExceeded
+		cancel()
+		if err != nil {
+			if timedOut {
+				err = util.NewErrUnavailable(err)
+			}
+			return err
+		}
+
+		var found bool
+		err = h.readDB.Do(ctx, func(tx *db.Tx) error {
+			var err error
+			found, err = get(tx, rec.ResourceID)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if !found {
+			return util.NewErrNotExist(errors.Errorf("resource %q created with idempotency key %q doesn't exist anymore", rec.ResourceID, key))
+		}
+		return nil
+	}
+
+	wr := &WriteRevision{}
+	id, err := create(WithWriteRevision(ctx, wr))
+	if pwr, ok := ctx.Value(writeRevisionKey).(*WriteRevision); ok {
+		pwr.set(wr.Revision())
+	}
+	if err != nil {
+		// release the key so the request can be retried
+		if _, derr := h.e.AtomicDelete(ctx, etcdKey, reservedRevision); derr != nil {
+			h.log.Errorf("failed to release idempotency key for %s: %+v", operation, derr)
+		}
+		return err
+	}
+
+	recj, err := json.Marshal(&idempotencyRecord{Operation: operation, ResourceID: id, Revision: wr.Revision()})
+	if err != nil {
+		return errors.Errorf("failed to marshal idempotency key: %w", err)
+	}
+	// the resource has already been created so don't report an error, at
+	// most a retried request will fail like without an idempotency key
+	if _, err := h.e.AtomicPut(ctx, etcdKey, recj, reservedRevision, &etcd.WriteOptions{TTL: h.idempotencyKeyTTL}); err != nil {
+		h.log.Errorf("failed to save idempotency key for %s %q: %+v", operation, id, err)
+	}
+
+	return nil
+}
+
+// reserveIdempotencyKey reserves the etcd key of the idempotency key for the
+// operation and returns its revision. If the key was already used by a
+// completed operation its record is returned instead. If the operation is in
+// progress it waits for it to complete.
+func (h *ActionHandler) reserveIdempotencyKey(ctx context.Context, etcdKey, key, operation string) (*idempotencyRecord, int64, error) {
+	reservej, err := json.Marshal(&idempotencyRecord{Operation: operation})
+	if err != nil {
+		return nil, 0, errors.Errorf("failed to marshal idempotency key: %w", err)
+	}
+
+	deadline := time.Now().Add(idempotencyWaitTimeout)
+	for {
+		tresp, err := h.e.AtomicPut(ctx, etcdKey, reservej, 0, &etcd.WriteOptions{TTL: h.idempotencyKeyTTL})
+		if err == nil {
+			return nil, tresp.Header.Revision, nil
+		}
+		if err != etcd.ErrKeyModified {
+			return nil, 0, err
+		}
+
+		resp, err := h.e.Get(ctx, etcdKey, 0)
+		if err == etcd.ErrKeyNotFound {
+			// released by a failed operation or expired, retry to reserve it
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		var rec idempotencyRecord
+		if err := json.Unmarshal(resp.Kvs[0].Value, &rec); err != nil {
+			return nil, 0, errors.Errorf("failed to unmarshal idempotency key: %w", err)
+		}
+		if rec.Operation != operation {
+			return nil, 0, util.NewErrBadRequest(util.NewAPIError(ErrorCodeIdempotencyKeyReused, errors.Errorf("idempotency key %q already used by operation %q", key, rec.Operation)))
+		}
+		if rec.ResourceID != "" {
+			return &rec, 0, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, 0, util.NewErrUnavailable(errors.Errorf("operation with idempotency key %q still in progress", key))
+		}
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
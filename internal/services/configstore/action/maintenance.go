@@ -71,3 +71,9 @@ func (h *ActionHandler) Import(ctx context.Context, r io.Reader) error {
 	}
 	return h.dm.Import(ctx, r)
 }
+
+// Checkpoint forces a datamanager checkpoint and the removal of the wals
+// already checkpointed
+func (h *ActionHandler) Checkpoint(ctx context.Context) error {
+	return h.dm.Checkpoint(ctx)
+}
@@ -70,6 +70,28 @@ func (h *ActionHandler) GetOrgMembers(ctx context.Context, orgRef string) ([]*Or
 }
 
 func (h *ActionHandler) CreateOrg(ctx context.Context, org *types.Organization) (*types.Organization, error) {
+	var res *types.Organization
+	err := h.idempotent(ctx, "create_org",
+		func(ctx context.Context) (string, error) {
+			var err error
+			res, err = h.createOrg(ctx, org)
+			if err != nil {
+				return "", err
+			}
+			return res.ID, nil
+		},
+		func(tx *db.Tx, id string) (bool, error) {
+			var err error
+			res, err = h.readDB.GetOrgByID(tx, id)
+			return res != nil, err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (h *ActionHandler) createOrg(ctx context.Context, org *types.Organization) (*types.Organization, error) {
 	if org.Name == "" {
 		return nil, util.NewErrBadRequest(errors.Errorf("organization name required"))
 	}
@@ -82,7 +104,7 @@ func (h *ActionHandler) CreateOrg(ctx context.Context, org *types.Organization)
 
 	var cgt *datamanager.ChangeGroupsUpdateToken
 	// changegroup is the org name
-	cgNames := []string{util.EncodeSha256Hex("orgname-" + org.Name)}
+	cgNames := []string{util.EncodeSha256Hex("orgname-" + h.readDB.NameKey(org.Name))}
 
 	// must do all the checks in a single transaction to avoid concurrent changes
 	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
@@ -173,7 +195,7 @@ func (h *ActionHandler) CreateOrg(ctx context.Context, org *types.Organization)
 		Data:       pgj,
 	})
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "create_org", actions, cgt)
 	return org, err
 }
 
@@ -215,7 +237,7 @@ func (h *ActionHandler) DeleteOrg(ctx context.Context, orgRef string) error {
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "delete_org", actions, cgt)
 	return err
 }
 
@@ -296,7 +318,7 @@ func (h *ActionHandler) AddOrgMember(ctx context.Context, orgRef, userRef string
 		Data:       orgmemberj,
 	})
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "add_org_member", actions, cgt)
 	return orgmember, err
 }
 
@@ -355,6 +377,6 @@ func (h *ActionHandler) RemoveOrgMember(ctx context.Context, orgRef, userRef str
 		ID:         orgmember.ID,
 	})
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "remove_org_member", actions, cgt)
 	return err
 }
@@ -18,6 +18,8 @@ import (
 	"context"
 	"encoding/json"
 	"path"
+	"strings"
+	"time"
 
 	"agola.io/agola/internal/datamanager"
 	"agola.io/agola/internal/db"
@@ -61,6 +63,20 @@ func (h *ActionHandler) ValidateProject(ctx context.Context, project *types.Proj
 			return util.NewErrBadRequest(errors.Errorf("empty remote repository path"))
 		}
 	}
+	if project.ConfigPath != "" && !util.ValidateRelativePath(project.ConfigPath) {
+		return util.NewErrBadRequest(errors.Errorf("invalid project config path %q", project.ConfigPath))
+	}
+	if project.DefaultBranch != "" && !util.ValidateBranchName(project.DefaultBranch) {
+		return util.NewErrBadRequest(errors.Errorf("invalid project default branch %q", project.DefaultBranch))
+	}
+	for key, value := range project.Labels {
+		if !util.ValidateLabelKey(key) {
+			return util.NewErrBadRequest(errors.Errorf("invalid project label key %q", key))
+		}
+		if !util.ValidateLabelValue(value) {
+			return util.NewErrBadRequest(errors.Errorf("invalid project label %q value %q", key, value))
+		}
+	}
 	return nil
 }
 
@@ -83,6 +99,34 @@ func (h *ActionHandler) GetProject(ctx context.Context, projectRef string) (*typ
 }
 
 func (h *ActionHandler) CreateProject(ctx context.Context, project *types.Project) (*types.Project, error) {
+	var res *types.Project
+	err := h.idempotent(ctx, "create_project",
+		func(ctx context.Context) (string, error) {
+			var err error
+			res, err = h.createProject(ctx, project, false)
+			if err != nil {
+				return "", err
+			}
+			return res.ID, nil
+		},
+		func(tx *db.Tx, id string) (bool, error) {
+			var err error
+			res, err = h.readDB.GetProjectByID(tx, id)
+			return res != nil, err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// CreateProjectDryRun does all the checks done by CreateProject and returns
+// the project that would be created without saving it
+func (h *ActionHandler) CreateProjectDryRun(ctx context.Context, project *types.Project) (*types.Project, error) {
+	return h.createProject(ctx, project, true)
+}
+
+func (h *ActionHandler) createProject(ctx context.Context, project *types.Project, dryRun bool) (*types.Project, error) {
 	if err := h.ValidateProject(ctx, project); err != nil {
 		return nil, err
 	}
@@ -109,7 +153,7 @@ func (h *ActionHandler) CreateProject(ctx context.Context, project *types.Projec
 
 		// changegroup is the project path. Use "projectpath" prefix as it must
 		// cover both projects and projectgroups
-		cgNames := []string{util.EncodeSha256Hex("projectpath-" + pp)}
+		cgNames := []string{util.EncodeSha256Hex("projectpath-" + h.readDB.NameKey(pp))}
 		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
 		if err != nil {
 			return err
@@ -121,7 +165,7 @@ func (h *ActionHandler) CreateProject(ctx context.Context, project *types.Projec
 			return err
 		}
 		if p != nil {
-			return util.NewErrBadRequest(errors.Errorf("project with name %q, path %q already exists", p.Name, pp))
+			return util.NewErrConflict(util.NewAPIError(ErrorCodeProjectAlreadyExists, errors.Errorf("project with name %q, path %q already exists", p.Name, pp)))
 		}
 
 		if project.RemoteRepositoryConfigType == types.RemoteRepositoryConfigTypeRemoteSource {
@@ -154,6 +198,10 @@ func (h *ActionHandler) CreateProject(ctx context.Context, project *types.Projec
 	project.Secret = util.EncodeSha1Hex(uuid.NewV4().String())
 	project.WebhookSecret = util.EncodeSha1Hex(uuid.NewV4().String())
 
+	if dryRun {
+		return project, nil
+	}
+
 	pcj, err := json.Marshal(project)
 	if err != nil {
 		return nil, errors.Errorf("failed to marshal project: %w", err)
@@ -167,7 +215,7 @@ func (h *ActionHandler) CreateProject(ctx context.Context, project *types.Projec
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "create_project", actions, cgt)
 	return project, err
 }
 
@@ -175,9 +223,18 @@ type UpdateProjectRequest struct {
 	ProjectRef string
 
 	Project *types.Project
+
+	// ExpectedRevision, when not empty, is the project revision the update
+	// is based on. The update is rejected if the project has been changed in
+	// the meantime.
+	ExpectedRevision string
 }
 
 func (h *ActionHandler) UpdateProject(ctx context.Context, req *UpdateProjectRequest) (*types.Project, error) {
+	return h.updateProject(ctx, req, "update_project")
+}
+
+func (h *ActionHandler) updateProject(ctx context.Context, req *UpdateProjectRequest, op string) (*types.Project, error) {
 	if err := h.ValidateProject(ctx, req.Project); err != nil {
 		return nil, err
 	}
@@ -199,6 +256,9 @@ func (h *ActionHandler) UpdateProject(ctx context.Context, req *UpdateProjectReq
 		if p.ID != req.Project.ID {
 			return util.NewErrBadRequest(errors.Errorf("project with ref %q has a different id", req.ProjectRef))
 		}
+		if err := h.checkProjectRevision(tx, p.ID, req.ExpectedRevision); err != nil {
+			return err
+		}
 
 		// check parent project group exists
 		group, err := h.readDB.GetProjectGroup(tx, req.Project.Parent.ID)
@@ -222,14 +282,14 @@ func (h *ActionHandler) UpdateProject(ctx context.Context, req *UpdateProjectReq
 			if err != nil {
 				return err
 			}
-			if ap != nil {
-				return util.NewErrBadRequest(errors.Errorf("project with name %q, path %q already exists", req.Project.Name, pp))
+			if ap != nil && ap.ID != p.ID {
+				return util.NewErrConflict(util.NewAPIError(ErrorCodeProjectAlreadyExists, errors.Errorf("project with name %q, path %q already exists", req.Project.Name, pp)))
 			}
 		}
 
 		// changegroup is the project path. Use "projectpath" prefix as it must
 		// cover both projects and projectgroups
-		cgNames := []string{util.EncodeSha256Hex("projectpath-" + pp)}
+		cgNames := []string{util.EncodeSha256Hex("projectpath-" + h.readDB.NameKey(pp))}
 
 		// add new projectpath
 		if p.Parent.ID != req.Project.Parent.ID {
@@ -247,7 +307,7 @@ func (h *ActionHandler) UpdateProject(ctx context.Context, req *UpdateProjectReq
 			}
 			pp := path.Join(curGroupPath, req.Project.Name)
 
-			cgNames = append(cgNames, util.EncodeSha256Hex("projectpath-"+pp))
+			cgNames = append(cgNames, util.EncodeSha256Hex("projectpath-"+h.readDB.NameKey(pp)))
 		}
 
 		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
@@ -292,30 +352,139 @@ func (h *ActionHandler) UpdateProject(ctx context.Context, req *UpdateProjectReq
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, op, actions, cgt)
 	return req.Project, err
 }
 
-func (h *ActionHandler) DeleteProject(ctx context.Context, projectRef string) error {
+type PatchProjectRequest struct {
+	ProjectRef string
+
+	// only the non nil fields will be updated
+	Name          *string
+	ParentRef     *string
+	Visibility    *types.Visibility
+	ConfigPath    *string
+	DefaultBranch *string
+
+	ExpectedRevision string
+}
+
+// PatchProject updates only the provided project fields keeping all the others
+// (and the project id) unchanged.
+func (h *ActionHandler) PatchProject(ctx context.Context, req *PatchProjectRequest) (*types.Project, error) {
 	var project *types.Project
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		project, err = h.readDB.GetProject(tx, req.ProjectRef)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if project == nil {
+		return nil, util.NewErrNotExist(errors.Errorf("project %q doesn't exist", req.ProjectRef))
+	}
 
-	var cgt *datamanager.ChangeGroupsUpdateToken
+	if req.Name != nil {
+		project.Name = *req.Name
+	}
+	if req.ParentRef != nil {
+		project.Parent = types.Parent{
+			Type: types.ConfigTypeProjectGroup,
+			ID:   *req.ParentRef,
+		}
+	}
+	if req.Visibility != nil {
+		project.Visibility = *req.Visibility
+	}
+	if req.ConfigPath != nil {
+		project.ConfigPath = *req.ConfigPath
+	}
+	if req.DefaultBranch != nil {
+		project.DefaultBranch = *req.DefaultBranch
+	}
 
-	// must do all the checks in a single transaction to avoid concurrent changes
+	return h.UpdateProject(ctx, &UpdateProjectRequest{ProjectRef: req.ProjectRef, Project: project, ExpectedRevision: req.ExpectedRevision})
+}
+
+type MoveProjectRequest struct {
+	ProjectID string
+
+	// ParentRef is the ref of the new parent project group, it could be the
+	// group of another user or organization
+	ParentRef string
+
+	ExpectedRevision string
+}
+
+// MoveProject moves the project to another project group keeping its name.
+// The move is rejected if the new parent already has a project with the same
+// name. Since a project cannot contain project groups it cannot be moved
+// inside itself.
+func (h *ActionHandler) MoveProject(ctx context.Context, req *MoveProjectRequest) (*types.Project, error) {
+	if req.ParentRef == "" {
+		return nil, util.NewErrBadRequest(errors.Errorf("project parent ref required"))
+	}
+
+	var project *types.Project
 	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
 		var err error
+		project, err = h.readDB.GetProjectByID(tx, req.ProjectID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if project == nil {
+		return nil, util.NewErrNotExist(errors.Errorf("project with id %q doesn't exist", req.ProjectID))
+	}
+
+	project.Parent = types.Parent{
+		Type: types.ConfigTypeProjectGroup,
+		ID:   req.ParentRef,
+	}
+
+	// the project path change groups and the project existence are checked
+	// again in the update transaction
+	return h.updateProject(ctx, &UpdateProjectRequest{ProjectRef: project.ID, Project: project, ExpectedRevision: req.ExpectedRevision}, "move_project")
+}
+
+// DeleteProject deletes the project. If expectedRevision isn't empty the
+// project is deleted only if its revision matches.
+func (h *ActionHandler) DeleteProject(ctx context.Context, projectRef, expectedRevision string) error {
+	return h.deleteProject(ctx, projectRef, expectedRevision, h.readDB.GetProject)
+}
+
+// DeleteProjectByID is like DeleteProject but the project is looked up only
+// by its id, so it isn't affected by concurrent project renames.
+func (h *ActionHandler) DeleteProjectByID(ctx context.Context, projectID, expectedRevision string) error {
+	return h.deleteProject(ctx, projectID, expectedRevision, h.readDB.GetProjectByID)
+}
 
+func (h *ActionHandler) deleteProject(ctx context.Context, projectRef, expectedRevision string, getProject func(tx *db.Tx, projectRef string) (*types.Project, error)) error {
+	var actions []*datamanager.Action
+
+	var cgt *datamanager.ChangeGroupsUpdateToken
+
+	// must do all the checks in a single transaction to avoid concurrent changes
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
 		// check project existance
-		project, err = h.readDB.GetProject(tx, projectRef)
+		project, err := getProject(tx, projectRef)
 		if err != nil {
 			return err
 		}
 		if project == nil {
-			return util.NewErrBadRequest(errors.Errorf("project %q doesn't exist", projectRef))
+			return util.NewErrBadRequest(util.NewAPIError(ErrorCodeProjectNotExist, errors.Errorf("project %q doesn't exist", projectRef)))
+		}
+		if err := h.checkProjectRevision(tx, project.ID, expectedRevision); err != nil {
+			return err
 		}
 
-		// changegroup is the project id.
-		cgNames := []string{util.EncodeSha256Hex(project.ID)}
+		var cgNames []string
+		actions, cgNames, err = h.projectDeleteActions(tx, project, time.Now().UTC())
+		if err != nil {
+			return err
+		}
 		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
 		if err != nil {
 			return err
@@ -327,6 +496,97 @@ func (h *ActionHandler) DeleteProject(ctx context.Context, projectRef string) er
 		return err
 	}
 
+	_, err = h.writeWal(ctx, "delete_project", actions, cgt)
+	return err
+}
+
+// DeleteProjectsRequest defines the projects deleted by DeleteProjects. Only
+// the projects matching all the provided filters are deleted.
+type DeleteProjectsRequest struct {
+	NamePrefix string
+
+	// OwnerType and OwnerID are the user or organization owning the projects
+	OwnerType types.ConfigType
+	OwnerID   string
+}
+
+// DeleteProjects deletes all the projects matching the request filters and
+// returns their ids. The projects are deleted in a single wal so they are all
+// deleted or, on error (i.e. a concurrent project update), none of them is.
+func (h *ActionHandler) DeleteProjects(ctx context.Context, req *DeleteProjectsRequest) ([]string, error) {
+	if req.NamePrefix == "" && req.OwnerID == "" {
+		return nil, util.NewErrBadRequest(errors.Errorf("at least a projects filter is required"))
+	}
+	if req.OwnerID != "" && req.OwnerType != types.ConfigTypeUser && req.OwnerType != types.ConfigTypeOrg {
+		return nil, util.NewErrBadRequest(errors.Errorf("invalid owner type %q", req.OwnerType))
+	}
+
+	projectIDs := []string{}
+	actions := []*datamanager.Action{}
+
+	var cgt *datamanager.ChangeGroupsUpdateToken
+
+	// must do all the checks in a single transaction to avoid concurrent changes
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		projects, err := h.readDB.GetProjects(tx, "", "", 0, true, false, nil)
+		if err != nil {
+			return err
+		}
+
+		deletionTime := time.Now().UTC()
+		cgNames := []string{}
+		for _, project := range projects {
+			if !strings.HasPrefix(project.Name, req.NamePrefix) {
+				continue
+			}
+			if req.OwnerID != "" {
+				ownerType, ownerID, err := h.readDB.GetProjectOwnerID(tx, project)
+				if err != nil {
+					return err
+				}
+				if ownerType != req.OwnerType || ownerID != req.OwnerID {
+					continue
+				}
+			}
+
+			projectActions, projectCgNames, err := h.projectDeleteActions(tx, project, deletionTime)
+			if err != nil {
+				return err
+			}
+			actions = append(actions, projectActions...)
+			cgNames = append(cgNames, projectCgNames...)
+			projectIDs = append(projectIDs, project.ID)
+		}
+
+		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(projectIDs) == 0 {
+		return projectIDs, nil
+	}
+
+	if _, err := h.writeWal(ctx, "delete_projects", actions, cgt); err != nil {
+		return nil, err
+	}
+	return projectIDs, nil
+}
+
+// projectDeleteActions returns the actions needed to delete the project and
+// the related changegroups names
+func (h *ActionHandler) projectDeleteActions(tx *db.Tx, project *types.Project, deletionTime time.Time) ([]*datamanager.Action, []string, error) {
+	pp, err := h.readDB.GetProjectPath(tx, project)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// changegroup is the project id. Also add the project path changegroup
+	// to avoid concurrent project updates
+	cgNames := []string{util.EncodeSha256Hex(project.ID), util.EncodeSha256Hex("projectpath-" + h.readDB.NameKey(pp))}
+
 	// TODO(sgotti) implement childs garbage collection
 	actions := []*datamanager.Action{
 		{
@@ -335,7 +595,32 @@ func (h *ActionHandler) DeleteProject(ctx context.Context, projectRef string) er
 			ID:         project.ID,
 		},
 	}
+	if h.softDelete {
+		cgNames = append(cgNames, util.EncodeSha256Hex("deletedresource-"+project.ID))
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
-	return err
+		project.DeletionTime = &deletionTime
+		action, err := softDeleteAction(types.ConfigTypeProject, project.ID, deletionTime, project)
+		if err != nil {
+			return nil, nil, err
+		}
+		actions = append(actions, action)
+	}
+
+	return actions, cgNames, nil
+}
+
+// checkProjectRevision returns an ErrPreconditionFailed if expectedRevision
+// isn't empty and doesn't match the current project revision
+func (h *ActionHandler) checkProjectRevision(tx *db.Tx, projectID, expectedRevision string) error {
+	if expectedRevision == "" {
+		return nil
+	}
+	revision, err := h.readDB.GetProjectRevision(tx, projectID)
+	if err != nil {
+		return err
+	}
+	if revision != expectedRevision {
+		return util.NewErrPreconditionFailed(util.NewAPIError(ErrorCodeRevisionMismatch, errors.Errorf("project %q revision %q doesn't match the expected revision %q", projectID, revision, expectedRevision)))
+	}
+	return nil
 }
@@ -124,6 +124,28 @@ func (h *ActionHandler) ValidateProjectGroup(ctx context.Context, projectGroup *
 }
 
 func (h *ActionHandler) CreateProjectGroup(ctx context.Context, projectGroup *types.ProjectGroup) (*types.ProjectGroup, error) {
+	var res *types.ProjectGroup
+	err := h.idempotent(ctx, "create_project_group",
+		func(ctx context.Context) (string, error) {
+			var err error
+			res, err = h.createProjectGroup(ctx, projectGroup)
+			if err != nil {
+				return "", err
+			}
+			return res.ID, nil
+		},
+		func(tx *db.Tx, id string) (bool, error) {
+			var err error
+			res, err = h.readDB.GetProjectGroupByID(tx, id)
+			return res != nil, err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (h *ActionHandler) createProjectGroup(ctx context.Context, projectGroup *types.ProjectGroup) (*types.ProjectGroup, error) {
 	if err := h.ValidateProjectGroup(ctx, projectGroup); err != nil {
 		return nil, err
 	}
@@ -156,7 +178,7 @@ func (h *ActionHandler) CreateProjectGroup(ctx context.Context, projectGroup *ty
 
 		// changegroup is the projectgroup path. Use "projectpath" prefix as it must
 		// cover both projects and projectgroups
-		cgNames := []string{util.EncodeSha256Hex("projectpath-" + pp)}
+		cgNames := []string{util.EncodeSha256Hex("projectpath-" + h.readDB.NameKey(pp))}
 		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
 		if err != nil {
 			return err
@@ -192,7 +214,7 @@ func (h *ActionHandler) CreateProjectGroup(ctx context.Context, projectGroup *ty
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "create_project_group", actions, cgt)
 	return projectGroup, err
 }
 
@@ -273,7 +295,7 @@ func (h *ActionHandler) UpdateProjectGroup(ctx context.Context, req *UpdateProje
 			if err != nil {
 				return err
 			}
-			if ap != nil {
+			if ap != nil && ap.ID != pg.ID {
 				return util.NewErrBadRequest(errors.Errorf("project group with name %q, path %q already exists", req.ProjectGroup.Name, pgp))
 			}
 			// Cannot move inside itself or a child project group
@@ -284,11 +306,11 @@ func (h *ActionHandler) UpdateProjectGroup(ctx context.Context, req *UpdateProje
 
 		// changegroup is the project group path. Use "projectpath" prefix as it must
 		// cover both projects and projectgroups
-		cgNames := []string{util.EncodeSha256Hex("projectpath-" + pgp)}
+		cgNames := []string{util.EncodeSha256Hex("projectpath-" + h.readDB.NameKey(pgp))}
 
 		// add new projectpath
 		if pg.Parent.ID != req.ProjectGroup.Parent.ID {
-			cgNames = append(cgNames, util.EncodeSha256Hex("projectpath-"+pgp))
+			cgNames = append(cgNames, util.EncodeSha256Hex("projectpath-"+h.readDB.NameKey(pgp)))
 		}
 
 		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
@@ -315,15 +337,21 @@ func (h *ActionHandler) UpdateProjectGroup(ctx context.Context, req *UpdateProje
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "update_project_group", actions, cgt)
 	return req.ProjectGroup, err
 }
 
-func (h *ActionHandler) DeleteProjectGroup(ctx context.Context, projectGroupRef string) error {
+// DeleteProjectGroup deletes a project group. If the project group contains
+// subgroups or projects the deletion is rejected unless cascade is true, in
+// this case all the child project groups and projects (with their secrets and
+// variables) are also deleted.
+func (h *ActionHandler) DeleteProjectGroup(ctx context.Context, projectGroupRef string, cascade bool) error {
 	var projectGroup *types.ProjectGroup
 
 	var cgt *datamanager.ChangeGroupsUpdateToken
 
+	actions := []*datamanager.Action{}
+
 	// must do all the checks in a single transaction to avoid concurrent changes
 	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
 		var err error
@@ -343,8 +371,26 @@ func (h *ActionHandler) DeleteProjectGroup(ctx context.Context, projectGroupRef
 			return util.NewErrBadRequest(errors.Errorf("cannot delete root project group"))
 		}
 
-		// changegroup is the project group id.
-		cgNames := []string{util.EncodeSha256Hex(projectGroup.ID)}
+		if !cascade {
+			subgroups, err := h.readDB.GetProjectGroupSubgroups(tx, projectGroup.ID)
+			if err != nil {
+				return err
+			}
+			projects, err := h.readDB.GetProjectGroupProjects(tx, projectGroup.ID)
+			if err != nil {
+				return err
+			}
+			if len(subgroups) > 0 || len(projects) > 0 {
+				return util.NewErrBadRequest(util.NewAPIError(ErrorCodeProjectGroupNotEmpty, errors.Errorf("project group %q isn't empty", projectGroupRef)))
+			}
+		}
+
+		// changegroups are the project groups and projects ids.
+		var cgNames []string
+		actions, cgNames, err = h.projectGroupDeleteActions(tx, projectGroup)
+		if err != nil {
+			return err
+		}
 		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
 		if err != nil {
 			return err
@@ -356,15 +402,89 @@ func (h *ActionHandler) DeleteProjectGroup(ctx context.Context, projectGroupRef
 		return err
 	}
 
-	// TODO(sgotti) implement childs garbage collection
-	actions := []*datamanager.Action{
-		{
+	_, err = h.writeWal(ctx, "delete_project_group", actions, cgt)
+	return err
+}
+
+// projectGroupDeleteActions returns the actions needed to delete the project
+// group and all its childs and the related changegroups names
+func (h *ActionHandler) projectGroupDeleteActions(tx *db.Tx, projectGroup *types.ProjectGroup) ([]*datamanager.Action, []string, error) {
+	actions := []*datamanager.Action{}
+	cgNames := []string{util.EncodeSha256Hex(projectGroup.ID)}
+
+	subgroups, err := h.readDB.GetProjectGroupSubgroups(tx, projectGroup.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, subgroup := range subgroups {
+		subActions, subCgNames, err := h.projectGroupDeleteActions(tx, subgroup)
+		if err != nil {
+			return nil, nil, err
+		}
+		actions = append(actions, subActions...)
+		cgNames = append(cgNames, subCgNames...)
+	}
+
+	projects, err := h.readDB.GetProjectGroupProjects(tx, projectGroup.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, project := range projects {
+		projectActions, err := h.parentChildsDeleteActions(tx, project.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		actions = append(actions, projectActions...)
+		actions = append(actions, &datamanager.Action{
 			ActionType: datamanager.ActionTypeDelete,
-			DataType:   string(types.ConfigTypeProjectGroup),
-			ID:         projectGroup.ID,
-		},
+			DataType:   string(types.ConfigTypeProject),
+			ID:         project.ID,
+		})
+		cgNames = append(cgNames, util.EncodeSha256Hex(project.ID))
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
-	return err
+	pgActions, err := h.parentChildsDeleteActions(tx, projectGroup.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	actions = append(actions, pgActions...)
+	actions = append(actions, &datamanager.Action{
+		ActionType: datamanager.ActionTypeDelete,
+		DataType:   string(types.ConfigTypeProjectGroup),
+		ID:         projectGroup.ID,
+	})
+
+	return actions, cgNames, nil
+}
+
+// parentChildsDeleteActions returns the actions needed to delete the secrets
+// and variables of the provided project group or project
+func (h *ActionHandler) parentChildsDeleteActions(tx *db.Tx, parentID string) ([]*datamanager.Action, error) {
+	actions := []*datamanager.Action{}
+
+	secrets, err := h.readDB.GetSecrets(tx, parentID)
+	if err != nil {
+		return nil, err
+	}
+	for _, secret := range secrets {
+		actions = append(actions, &datamanager.Action{
+			ActionType: datamanager.ActionTypeDelete,
+			DataType:   string(types.ConfigTypeSecret),
+			ID:         secret.ID,
+		})
+	}
+
+	variables, err := h.readDB.GetVariables(tx, parentID)
+	if err != nil {
+		return nil, err
+	}
+	for _, variable := range variables {
+		actions = append(actions, &datamanager.Action{
+			ActionType: datamanager.ActionTypeDelete,
+			DataType:   string(types.ConfigTypeVariable),
+			ID:         variable.ID,
+		})
+	}
+
+	return actions, nil
 }
@@ -0,0 +1,88 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package action
+
+import (
+	"context"
+	"sync"
+
+	"agola.io/agola/internal/util"
+
+	errors "golang.org/x/xerrors"
+)
+
+// readOnlyMode rejects the writes while enabled. The writes in progress are
+// counted so enabling it can wait for them to complete.
+type readOnlyMode struct {
+	mu      sync.Mutex
+	enabled bool
+	writes  int
+	// idleCh, when not nil, is closed when there're no more writes in progress
+	idleCh chan struct{}
+}
+
+// SetReadOnly enables or disables the read only mode. When enabled all the
+// writes are rejected while the reads continue to be served. Enabling it
+// returns only after the writes in progress have completed or ctx is done.
+func (h *ActionHandler) SetReadOnly(ctx context.Context, enabled bool) error {
+	ro := &h.readOnly
+	ro.mu.Lock()
+	ro.enabled = enabled
+	if !enabled || ro.writes == 0 {
+		ro.mu.Unlock()
+		return nil
+	}
+	if ro.idleCh == nil {
+		ro.idleCh = make(chan struct{})
+	}
+	idleCh := ro.idleCh
+	ro.mu.Unlock()
+
+	select {
+	case <-idleCh:
+		return nil
+	case <-ctx.Done():
+		return errors.Errorf("read only mode enabled but failed to wait for the writes in progress: %w", ctx.Err())
+	}
+}
+
+// IsReadOnly reports if the read only mode is enabled
+func (h *ActionHandler) IsReadOnly() bool {
+	h.readOnly.mu.Lock()
+	defer h.readOnly.mu.Unlock()
+	return h.readOnly.enabled
+}
+
+// startWrite registers a write in progress, it must be ended calling the
+// returned function. It fails when the read only mode is enabled.
+func (h *ActionHandler) startWrite() (func(), error) {
+	ro := &h.readOnly
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	if ro.enabled {
+		return nil, util.NewErrUnavailable(errors.Errorf("configstore is in read only mode"))
+	}
+	ro.writes++
+
+	return func() {
+		ro.mu.Lock()
+		defer ro.mu.Unlock()
+		ro.writes--
+		if ro.writes == 0 && ro.idleCh != nil {
+			close(ro.idleCh)
+			ro.idleCh = nil
+		}
+	}, nil
+}
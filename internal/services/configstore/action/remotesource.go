@@ -16,10 +16,18 @@ package action
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"agola.io/agola/internal/datamanager"
 	"agola.io/agola/internal/db"
+	"agola.io/agola/internal/gitsources/github"
 	"agola.io/agola/internal/util"
 	"agola.io/agola/services/configstore/types"
 
@@ -27,6 +35,24 @@ import (
 	errors "golang.org/x/xerrors"
 )
 
+// remoteSourceProbeTimeout is the timeout of the remote source api url
+// reachability check
+const remoteSourceProbeTimeout = 5 * time.Second
+
+// remoteSourceTestTimeout is the timeout of the remote source connectivity
+// and credentials test
+const remoteSourceTestTimeout = 10 * time.Second
+
+// remoteSourceRotateTimeout is the maximum time to wait for a remote source
+// rotated secret to be applied to the readdb
+const remoteSourceRotateTimeout = 5 * time.Second
+
+// giteaAPIPath is the path of the gitea api, appended to the instance url by
+// the gitea client
+const giteaAPIPath = "/api/v1"
+
+// ValidateRemoteSource validates the remote source. It also normalizes the
+// remote source api url.
 func (h *ActionHandler) ValidateRemoteSource(ctx context.Context, remoteSource *types.RemoteSource) error {
 	if remoteSource.Name == "" {
 		return util.NewErrBadRequest(errors.Errorf("remotesource name required"))
@@ -41,9 +67,15 @@ func (h *ActionHandler) ValidateRemoteSource(ctx context.Context, remoteSource *
 	if remoteSource.APIURL == "" {
 		return util.NewErrBadRequest(errors.Errorf("remotesource api url required"))
 	}
+	if err := validateRemoteSourceURL(remoteSource.APIURL); err != nil {
+		return util.NewErrBadRequest(errors.Errorf("invalid remotesource api url %q: %w", remoteSource.APIURL, err))
+	}
 	if remoteSource.Type == "" {
 		return util.NewErrBadRequest(errors.Errorf("remotesource type required"))
 	}
+	if !types.IsValidRemoteSourceType(remoteSource.Type) {
+		return util.NewErrBadRequest(errors.Errorf("invalid remotesource type %q", remoteSource.Type))
+	}
 	if remoteSource.AuthType == "" {
 		return util.NewErrBadRequest(errors.Errorf("remotesource auth type required"))
 	}
@@ -52,6 +84,13 @@ func (h *ActionHandler) ValidateRemoteSource(ctx context.Context, remoteSource *
 	if !types.SourceSupportsAuthType(types.RemoteSourceType(remoteSource.Type), types.RemoteSourceAuthType(remoteSource.AuthType)) {
 		return util.NewErrBadRequest(errors.Errorf("remotesource type %q doesn't support auth type %q", remoteSource.Type, remoteSource.AuthType))
 	}
+	if remoteSource.Type == types.RemoteSourceTypeGitea {
+		apiURL, err := normalizeGiteaAPIURL(remoteSource.APIURL)
+		if err != nil {
+			return util.NewErrBadRequest(errors.Errorf("invalid remotesource api url %q: %w", remoteSource.APIURL, err))
+		}
+		remoteSource.APIURL = apiURL
+	}
 	if remoteSource.AuthType == types.RemoteSourceAuthTypeOauth2 {
 		if remoteSource.Oauth2ClientID == "" {
 			return util.NewErrBadRequest(errors.Errorf("remotesource oauth2clientid required for auth type %q", types.RemoteSourceAuthTypeOauth2))
@@ -60,14 +99,183 @@ func (h *ActionHandler) ValidateRemoteSource(ctx context.Context, remoteSource *
 			return util.NewErrBadRequest(errors.Errorf("remotesource oauth2clientsecret required for auth type %q", types.RemoteSourceAuthTypeOauth2))
 		}
 	}
+	if remoteSource.AuthType == types.RemoteSourceAuthTypeGithubApp {
+		if remoteSource.GithubAppID <= 0 {
+			return util.NewErrBadRequest(errors.Errorf("remotesource github app id required for auth type %q", types.RemoteSourceAuthTypeGithubApp))
+		}
+		if remoteSource.GithubAppInstallationID <= 0 {
+			return util.NewErrBadRequest(errors.Errorf("remotesource github app installation id required for auth type %q", types.RemoteSourceAuthTypeGithubApp))
+		}
+		if remoteSource.GithubAppPrivateKey == "" {
+			return util.NewErrBadRequest(errors.Errorf("remotesource github app private key required for auth type %q", types.RemoteSourceAuthTypeGithubApp))
+		}
+		// an already encrypted private key is accepted only when updating a
+		// remote source and it's the current one
+		if !remoteSource.GithubAppPrivateKeyEncrypted {
+			if err := github.ValidateAppPrivateKey([]byte(remoteSource.GithubAppPrivateKey)); err != nil {
+				return util.NewErrBadRequest(errors.Errorf("invalid remotesource github app private key: %w", err))
+			}
+		}
+	}
+	if remoteSource.APIRateLimit < 0 {
+		return util.NewErrBadRequest(errors.Errorf("remotesource api rate limit must be greater or equal than 0"))
+	}
+	if remoteSource.MaxConcurrency < 0 {
+		return util.NewErrBadRequest(errors.Errorf("remotesource max concurrency must be greater or equal than 0"))
+	}
+
+	return nil
+}
+
+// validateRemoteSourceURL checks that u is an absolute http or https url
+func validateRemoteSourceURL(u string) error {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if pu.Scheme != "http" && pu.Scheme != "https" {
+		return errors.Errorf("scheme must be http or https")
+	}
+	if pu.Host == "" {
+		return errors.Errorf("host required")
+	}
+	return nil
+}
+
+// normalizeGiteaAPIURL returns the gitea instance base url used by the gitea
+// client, removing the trailing slashes and the api path often provided with
+// it (i.e. https://gitea.example.com/api/v1/ becomes https://gitea.example.com)
+func normalizeGiteaAPIURL(u string) (string, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if pu.RawQuery != "" || pu.Fragment != "" {
+		return "", errors.Errorf("gitea url cannot contain a query or a fragment")
+	}
+	p := strings.TrimRight(pu.Path, "/")
+	p = strings.TrimSuffix(p, giteaAPIPath)
+	pu.Path = strings.TrimRight(p, "/")
+	pu.RawPath = ""
+	return pu.String(), nil
+}
+
+// CheckRemoteSourceReachable validates the remote source and checks that its
+// api url is reachable doing a HEAD request. Any response, whatever its
+// status code, is considered reachable.
+func (h *ActionHandler) CheckRemoteSourceReachable(ctx context.Context, remoteSource *types.RemoteSource) error {
+	if err := h.ValidateRemoteSource(ctx, remoteSource); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, remoteSourceProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("HEAD", remoteSource.APIURL, nil)
+	if err != nil {
+		return util.NewErrBadRequest(errors.Errorf("invalid remotesource api url %q: %w", remoteSource.APIURL, err))
+	}
+	req = req.WithContext(ctx)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: remoteSource.SkipVerify}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		// the api url could redirect to a login page, it's reachable anyway
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return util.NewErrBadRequest(errors.Errorf("remotesource api url %q isn't reachable: %w", remoteSource.APIURL, err))
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// encryptRemoteSource returns a copy of the remote source with its github app
+// private key encrypted with the secrets key. If no secrets key is defined the
+// remote source is returned unchanged
+func (h *ActionHandler) encryptRemoteSource(remoteSource *types.RemoteSource) (*types.RemoteSource, error) {
+	if h.secretsKey == nil || remoteSource.GithubAppPrivateKey == "" || remoteSource.GithubAppPrivateKeyEncrypted {
+		return remoteSource, nil
+	}
+
+	gcm, err := newSecretsAEAD(h.secretsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ers := *remoteSource
+	ers.GithubAppPrivateKey, err = encryptValue(gcm, remoteSource.GithubAppPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	ers.GithubAppPrivateKeyEncrypted = true
+
+	return &ers, nil
+}
+
+// decryptRemoteSource decrypts in place the remote source github app private
+// key
+func (h *ActionHandler) decryptRemoteSource(remoteSource *types.RemoteSource) error {
+	if !remoteSource.GithubAppPrivateKeyEncrypted {
+		return nil
+	}
+	if h.secretsKey == nil {
+		return errors.Errorf("remotesource %q github app private key is encrypted but no secrets key is defined", remoteSource.ID)
+	}
+
+	gcm, err := newSecretsAEAD(h.secretsKey)
+	if err != nil {
+		return err
+	}
+
+	remoteSource.GithubAppPrivateKey, err = decryptValue(gcm, remoteSource.GithubAppPrivateKey)
+	if err != nil {
+		return errors.Errorf("failed to decrypt remotesource %q github app private key: %w", remoteSource.ID, err)
+	}
+	remoteSource.GithubAppPrivateKeyEncrypted = false
 
 	return nil
 }
 
 func (h *ActionHandler) CreateRemoteSource(ctx context.Context, remoteSource *types.RemoteSource) (*types.RemoteSource, error) {
+	var res *types.RemoteSource
+	err := h.idempotent(ctx, "create_remote_source",
+		func(ctx context.Context) (string, error) {
+			var err error
+			res, err = h.createRemoteSource(ctx, remoteSource)
+			if err != nil {
+				return "", err
+			}
+			return res.ID, nil
+		},
+		func(tx *db.Tx, id string) (bool, error) {
+			var err error
+			res, err = h.readDB.GetRemoteSourceByID(tx, id)
+			if err != nil || res == nil {
+				return false, err
+			}
+			return true, h.decryptRemoteSource(res)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (h *ActionHandler) createRemoteSource(ctx context.Context, remoteSource *types.RemoteSource) (*types.RemoteSource, error) {
 	if err := h.ValidateRemoteSource(ctx, remoteSource); err != nil {
 		return nil, err
 	}
+	if remoteSource.GithubAppPrivateKeyEncrypted {
+		return nil, util.NewErrBadRequest(errors.Errorf("remotesource github app private key must be provided unencrypted"))
+	}
 
 	var cgt *datamanager.ChangeGroupsUpdateToken
 	// changegroup is the remotesource name
@@ -87,7 +295,7 @@ func (h *ActionHandler) CreateRemoteSource(ctx context.Context, remoteSource *ty
 			return err
 		}
 		if u != nil {
-			return util.NewErrBadRequest(errors.Errorf("remotesource %q already exists", u.Name))
+			return util.NewErrConflict(util.NewAPIError(ErrorCodeRemoteSourceAlreadyExists, errors.Errorf("remotesource %q already exists", u.Name)))
 		}
 		return nil
 	})
@@ -97,7 +305,11 @@ func (h *ActionHandler) CreateRemoteSource(ctx context.Context, remoteSource *ty
 
 	remoteSource.ID = uuid.NewV4().String()
 
-	rsj, err := json.Marshal(remoteSource)
+	ers, err := h.encryptRemoteSource(remoteSource)
+	if err != nil {
+		return nil, err
+	}
+	rsj, err := json.Marshal(ers)
 	if err != nil {
 		return nil, errors.Errorf("failed to marshal remotesource: %w", err)
 	}
@@ -110,7 +322,7 @@ func (h *ActionHandler) CreateRemoteSource(ctx context.Context, remoteSource *ty
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "create_remote_source", actions, cgt)
 	return remoteSource, err
 }
 
@@ -148,10 +360,14 @@ func (h *ActionHandler) UpdateRemoteSource(ctx context.Context, req *UpdateRemot
 				return err
 			}
 			if u != nil {
-				return util.NewErrBadRequest(errors.Errorf("remotesource %q already exists", u.Name))
+				return util.NewErrConflict(util.NewAPIError(ErrorCodeRemoteSourceAlreadyExists, errors.Errorf("remotesource %q already exists", u.Name)))
 			}
 		}
 
+		if req.RemoteSource.GithubAppPrivateKeyEncrypted && req.RemoteSource.GithubAppPrivateKey != curRemoteSource.GithubAppPrivateKey {
+			return util.NewErrBadRequest(errors.Errorf("remotesource github app private key must be provided unencrypted"))
+		}
+
 		// set/override ID that must be kept from the current remote source
 		req.RemoteSource.ID = curRemoteSource.ID
 
@@ -168,7 +384,11 @@ func (h *ActionHandler) UpdateRemoteSource(ctx context.Context, req *UpdateRemot
 		return nil, err
 	}
 
-	rsj, err := json.Marshal(req.RemoteSource)
+	ers, err := h.encryptRemoteSource(req.RemoteSource)
+	if err != nil {
+		return nil, err
+	}
+	rsj, err := json.Marshal(ers)
 	if err != nil {
 		return nil, errors.Errorf("failed to marshal remotesource: %w", err)
 	}
@@ -181,10 +401,177 @@ func (h *ActionHandler) UpdateRemoteSource(ctx context.Context, req *UpdateRemot
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "update_remote_source", actions, cgt)
 	return req.RemoteSource, err
 }
 
+type PatchRemoteSourceRequest struct {
+	RemoteSourceRef string
+
+	// only the non nil fields will be updated. The remote source name, type
+	// and auth type cannot be changed
+	APIURL                  *string
+	SkipVerify              *bool
+	Oauth2ClientID          *string
+	Oauth2ClientSecret      *string
+	SSHHostKey              *string
+	SkipSSHHostKeyCheck     *bool
+	RegistrationEnabled     *bool
+	LoginEnabled            *bool
+	GithubAppID             *int64
+	GithubAppInstallationID *int64
+	GithubAppPrivateKey     *string
+	APIRateLimit            *int
+	MaxConcurrency          *int
+}
+
+// PatchRemoteSource updates only the provided remote source fields keeping
+// its id and name unchanged, so the linked accounts referencing it remain
+// valid.
+func (h *ActionHandler) PatchRemoteSource(ctx context.Context, req *PatchRemoteSourceRequest) (*types.RemoteSource, error) {
+	var remoteSource *types.RemoteSource
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		remoteSource, err = h.readDB.GetRemoteSource(tx, req.RemoteSourceRef)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if remoteSource == nil {
+		return nil, util.NewErrNotExist(errors.Errorf("remotesource %q doesn't exist", req.RemoteSourceRef))
+	}
+
+	if req.APIURL != nil {
+		remoteSource.APIURL = *req.APIURL
+	}
+	if req.SkipVerify != nil {
+		remoteSource.SkipVerify = *req.SkipVerify
+	}
+	if req.Oauth2ClientID != nil {
+		remoteSource.Oauth2ClientID = *req.Oauth2ClientID
+	}
+	if req.Oauth2ClientSecret != nil {
+		remoteSource.Oauth2ClientSecret = *req.Oauth2ClientSecret
+	}
+	if req.SSHHostKey != nil {
+		remoteSource.SSHHostKey = *req.SSHHostKey
+	}
+	if req.SkipSSHHostKeyCheck != nil {
+		remoteSource.SkipSSHHostKeyCheck = *req.SkipSSHHostKeyCheck
+	}
+	if req.RegistrationEnabled != nil {
+		remoteSource.RegistrationEnabled = req.RegistrationEnabled
+	}
+	if req.LoginEnabled != nil {
+		remoteSource.LoginEnabled = req.LoginEnabled
+	}
+	if req.GithubAppID != nil {
+		remoteSource.GithubAppID = *req.GithubAppID
+	}
+	if req.GithubAppInstallationID != nil {
+		remoteSource.GithubAppInstallationID = *req.GithubAppInstallationID
+	}
+	if req.GithubAppPrivateKey != nil {
+		remoteSource.GithubAppPrivateKey = *req.GithubAppPrivateKey
+		remoteSource.GithubAppPrivateKeyEncrypted = false
+	}
+	if req.APIRateLimit != nil {
+		remoteSource.APIRateLimit = *req.APIRateLimit
+	}
+	if req.MaxConcurrency != nil {
+		remoteSource.MaxConcurrency = *req.MaxConcurrency
+	}
+
+	return h.UpdateRemoteSource(ctx, &UpdateRemoteSourceRequest{RemoteSourceRef: remoteSource.Name, RemoteSource: remoteSource})
+}
+
+type RotateRemoteSourceSecretRequest struct {
+	RemoteSourceRef string
+
+	// Oauth2ClientID, when not nil, also replaces the oauth2 client id
+	Oauth2ClientID     *string
+	Oauth2ClientSecret string
+}
+
+// RotateRemoteSourceSecret replaces the oauth2 client secret (and optionally
+// the client id) of a remote source keeping unchanged all its other fields,
+// including its id and name, so the linked accounts referencing it remain
+// valid.
+// It waits for the readdb to apply the change so the new secret is
+// immediately used by the new auth flows.
+func (h *ActionHandler) RotateRemoteSourceSecret(ctx context.Context, req *RotateRemoteSourceSecretRequest) (*types.RemoteSource, error) {
+	if req.Oauth2ClientSecret == "" {
+		return nil, util.NewErrBadRequest(errors.Errorf("remotesource oauth2 client secret required"))
+	}
+	if req.Oauth2ClientID != nil && *req.Oauth2ClientID == "" {
+		return nil, util.NewErrBadRequest(errors.Errorf("remotesource oauth2 client id cannot be empty"))
+	}
+
+	var remoteSource *types.RemoteSource
+	var cgt *datamanager.ChangeGroupsUpdateToken
+
+	// must do all the checks in a single transaction to avoid concurrent changes
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		remoteSource, err = h.readDB.GetRemoteSource(tx, req.RemoteSourceRef)
+		if err != nil {
+			return err
+		}
+		if remoteSource == nil {
+			return util.NewErrNotExist(errors.Errorf("remotesource %q doesn't exist", req.RemoteSourceRef))
+		}
+
+		// changegroup is the remotesource id
+		cgNames := []string{util.EncodeSha256Hex("remotesourceid-" + remoteSource.ID)}
+		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if remoteSource.AuthType != types.RemoteSourceAuthTypeOauth2 {
+		return nil, util.NewErrBadRequest(errors.Errorf("remotesource %q auth type is %q, only the %q remote sources have a client secret", remoteSource.Name, remoteSource.AuthType, types.RemoteSourceAuthTypeOauth2))
+	}
+
+	if req.Oauth2ClientID != nil {
+		remoteSource.Oauth2ClientID = *req.Oauth2ClientID
+	}
+	remoteSource.Oauth2ClientSecret = req.Oauth2ClientSecret
+
+	// the remote source is saved as read from the readdb, with its github app
+	// private key still encrypted
+	rsj, err := json.Marshal(remoteSource)
+	if err != nil {
+		return nil, errors.Errorf("failed to marshal remotesource: %w", err)
+	}
+	actions := []*datamanager.Action{
+		{
+			ActionType: datamanager.ActionTypePut,
+			DataType:   string(types.ConfigTypeRemoteSource),
+			ID:         remoteSource.ID,
+			Data:       rsj,
+		},
+	}
+
+	ncgt, err := h.writeWal(ctx, "rotate_remote_source_secret", actions, cgt)
+	if err != nil {
+		return nil, err
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, remoteSourceRotateTimeout)
+	defer cancel()
+	if err := h.readDB.WaitRevision(wctx, ncgt.CurRevision); err != nil {
+		return nil, errors.Errorf("remotesource %q secret rotated but not yet applied: %w", remoteSource.Name, err)
+	}
+
+	if err := h.decryptRemoteSource(remoteSource); err != nil {
+		return nil, err
+	}
+	return remoteSource, nil
+}
+
 func (h *ActionHandler) DeleteRemoteSource(ctx context.Context, remoteSourceName string) error {
 	var remoteSource *types.RemoteSource
 	var cgt *datamanager.ChangeGroupsUpdateToken
@@ -224,6 +611,160 @@ func (h *ActionHandler) DeleteRemoteSource(ctx context.Context, remoteSourceName
 	}
 
 	// changegroup is all the remotesources
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "delete_remote_source", actions, cgt)
 	return err
 }
+
+// githubAppTokenRefreshMargin is the time before its expiration after which a
+// cached installation token isn't used anymore and a new one is created
+const githubAppTokenRefreshMargin = 5 * time.Minute
+
+// githubAppTokenCache caches the github app installation tokens by remote
+// source
+type githubAppTokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]*github.AppInstallationToken
+}
+
+func newGithubAppTokenCache() *githubAppTokenCache {
+	return &githubAppTokenCache{tokens: make(map[string]*github.AppInstallationToken)}
+}
+
+// get returns the cached token for key if not near its expiration, otherwise
+// it creates and caches a new one using create
+func (c *githubAppTokenCache) get(key string, create func() (*github.AppInstallationToken, error)) (*github.AppInstallationToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if token, ok := c.tokens[key]; ok && time.Until(token.ExpiresAt) > githubAppTokenRefreshMargin {
+		return token, nil
+	}
+
+	token, err := create()
+	if err != nil {
+		return nil, err
+	}
+	c.tokens[key] = token
+
+	return token, nil
+}
+
+// GetGithubAppInstallationToken returns an installation access token for the
+// github app remote source
+func (h *ActionHandler) GetGithubAppInstallationToken(ctx context.Context, remoteSourceRef string) (*github.AppInstallationToken, error) {
+	var remoteSource *types.RemoteSource
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		remoteSource, err = h.readDB.GetRemoteSource(tx, remoteSourceRef)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if remoteSource == nil {
+		return nil, util.NewErrNotExist(errors.Errorf("remotesource %q doesn't exist", remoteSourceRef))
+	}
+	if remoteSource.AuthType != types.RemoteSourceAuthTypeGithubApp {
+		return nil, util.NewErrBadRequest(errors.Errorf("remotesource %q auth type isn't %q", remoteSource.Name, types.RemoteSourceAuthTypeGithubApp))
+	}
+
+	if err := h.decryptRemoteSource(remoteSource); err != nil {
+		return nil, err
+	}
+
+	// also use the app and installation ids in the key so a remote source
+	// update won't reuse a token of the previous installation
+	key := fmt.Sprintf("%s/%d/%d", remoteSource.ID, remoteSource.GithubAppID, remoteSource.GithubAppInstallationID)
+	return h.githubAppTokens.get(key, func() (*github.AppInstallationToken, error) {
+		return github.CreateAppInstallationToken(ctx, github.AppOpts{
+			APIURL:         remoteSource.APIURL,
+			SkipVerify:     remoteSource.SkipVerify,
+			AppID:          remoteSource.GithubAppID,
+			InstallationID: remoteSource.GithubAppInstallationID,
+			PrivateKey:     []byte(remoteSource.GithubAppPrivateKey),
+		})
+	})
+}
+
+// RemoteSourceTestResult is the result of a remote source connectivity and
+// credentials test
+type RemoteSourceTestResult struct {
+	Success bool
+	// CredentialsVerified reports if the remote source credentials were used
+	// in the test. The oauth2 client credentials are used only in the user
+	// login flows so just the api url reachability is tested
+	CredentialsVerified bool
+	// Message is a summary of the provider response, with the remote source
+	// secrets redacted
+	Message string
+}
+
+// TestRemoteSource tests the remote source connectivity and, when possible,
+// its credentials doing a lightweight authenticated api call. A failed test
+// isn't an error and is reported in the result. Nothing is stored.
+func (h *ActionHandler) TestRemoteSource(ctx context.Context, remoteSourceRef string) (*RemoteSourceTestResult, error) {
+	var remoteSource *types.RemoteSource
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		remoteSource, err = h.readDB.GetRemoteSource(tx, remoteSourceRef)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if remoteSource == nil {
+		return nil, util.NewErrNotExist(errors.Errorf("remotesource %q doesn't exist", remoteSourceRef))
+	}
+
+	if err := h.decryptRemoteSource(remoteSource); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, remoteSourceTestTimeout)
+	defer cancel()
+
+	res := &RemoteSourceTestResult{}
+	switch remoteSource.AuthType {
+	case types.RemoteSourceAuthTypeGithubApp:
+		res.CredentialsVerified = true
+		account, err := github.GetAppInstallationAccount(ctx, github.AppOpts{
+			APIURL:         remoteSource.APIURL,
+			SkipVerify:     remoteSource.SkipVerify,
+			AppID:          remoteSource.GithubAppID,
+			InstallationID: remoteSource.GithubAppInstallationID,
+			PrivateKey:     []byte(remoteSource.GithubAppPrivateKey),
+		})
+		if err != nil {
+			res.Message = redactRemoteSourceSecrets(remoteSource, err.Error())
+			return res, nil
+		}
+		res.Success = true
+		res.Message = fmt.Sprintf("github app %d installation %d on account %q", remoteSource.GithubAppID, remoteSource.GithubAppInstallationID, account)
+	default:
+		if err := h.CheckRemoteSourceReachable(ctx, remoteSource); err != nil {
+			res.Message = redactRemoteSourceSecrets(remoteSource, err.Error())
+			return res, nil
+		}
+		res.Success = true
+		res.Message = fmt.Sprintf("remotesource api url reachable, credentials not verified for auth type %q", remoteSource.AuthType)
+	}
+
+	return res, nil
+}
+
+// redactRemoteSourceSecrets replaces in msg the remote source secrets,
+// including an api url password
+func redactRemoteSourceSecrets(remoteSource *types.RemoteSource, msg string) string {
+	secrets := []string{remoteSource.Oauth2ClientSecret, remoteSource.GithubAppPrivateKey}
+	if u, err := url.Parse(remoteSource.APIURL); err == nil && u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			secrets = append(secrets, password)
+		}
+	}
+	for _, secret := range secrets {
+		if secret != "" {
+			msg = strings.Replace(msg, secret, "[REDACTED]", -1)
+		}
+	}
+	return msg
+}
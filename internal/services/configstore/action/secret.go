@@ -16,7 +16,12 @@ package action
 
 import (
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"io"
 
 	"agola.io/agola/internal/datamanager"
 	"agola.io/agola/internal/db"
@@ -42,10 +47,26 @@ func (h *ActionHandler) GetSecret(ctx context.Context, secretID string) (*types.
 		return nil, util.NewErrNotExist(errors.Errorf("secret %q doesn't exist", secretID))
 	}
 
+	if err := h.decryptSecret(secret); err != nil {
+		return nil, err
+	}
+
 	return secret, nil
 }
 
+// GetSecrets returns the secrets of the parent, and of its ancestors when
+// tree is true, with their data decrypted
 func (h *ActionHandler) GetSecrets(ctx context.Context, parentType types.ConfigType, parentRef string, tree bool) ([]*types.Secret, error) {
+	return h.getSecrets(ctx, parentType, parentRef, tree, true)
+}
+
+// GetSecretsWithoutData returns the secrets like GetSecrets but without their
+// data, that isn't decrypted
+func (h *ActionHandler) GetSecretsWithoutData(ctx context.Context, parentType types.ConfigType, parentRef string, tree bool) ([]*types.Secret, error) {
+	return h.getSecrets(ctx, parentType, parentRef, tree, false)
+}
+
+func (h *ActionHandler) getSecrets(ctx context.Context, parentType types.ConfigType, parentRef string, tree, withData bool) ([]*types.Secret, error) {
 	var secrets []*types.Secret
 	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
 		parentID, err := h.readDB.ResolveConfigID(tx, parentType, parentRef)
@@ -63,9 +84,107 @@ func (h *ActionHandler) GetSecrets(ctx context.Context, parentType types.ConfigT
 		return nil, err
 	}
 
+	for _, secret := range secrets {
+		if !withData {
+			secret.Data = nil
+			continue
+		}
+		if err := h.decryptSecret(secret); err != nil {
+			return nil, err
+		}
+	}
+
 	return secrets, nil
 }
 
+// encryptSecret returns a copy of the secret with its data encrypted with the
+// secrets key. If no secrets key is defined the secret is returned unchanged
+func (h *ActionHandler) encryptSecret(secret *types.Secret) (*types.Secret, error) {
+	if h.secretsKey == nil {
+		return secret, nil
+	}
+
+	gcm, err := newSecretsAEAD(h.secretsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	es := *secret
+	es.Data = make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		ev, err := encryptValue(gcm, v)
+		if err != nil {
+			return nil, err
+		}
+		es.Data[k] = ev
+	}
+	es.DataEncrypted = true
+
+	return &es, nil
+}
+
+// decryptSecret decrypts in place the secret data
+func (h *ActionHandler) decryptSecret(secret *types.Secret) error {
+	if !secret.DataEncrypted {
+		return nil
+	}
+	if h.secretsKey == nil {
+		return errors.Errorf("secret %q data is encrypted but no secrets key is defined", secret.ID)
+	}
+
+	gcm, err := newSecretsAEAD(h.secretsKey)
+	if err != nil {
+		return err
+	}
+
+	data := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		dv, err := decryptValue(gcm, v)
+		if err != nil {
+			return errors.Errorf("failed to decrypt secret %q data: %w", secret.ID, err)
+		}
+		data[k] = dv
+	}
+	secret.Data = data
+	secret.DataEncrypted = false
+
+	return nil
+}
+
+func newSecretsAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Errorf("failed to create secrets cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptValue encrypts the value with a random nonce and returns the base64
+// encoded nonce and ciphertext
+func encryptValue(gcm cipher.AEAD, v string) (string, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.Errorf("failed to generate nonce: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(v), nil)), nil
+}
+
+// decryptValue decrypts a value encrypted by encryptValue
+func decryptValue(gcm cipher.AEAD, v string) (string, error) {
+	ev, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return "", errors.Errorf("failed to decode encrypted data: %w", err)
+	}
+	if len(ev) < gcm.NonceSize() {
+		return "", errors.Errorf("wrong encrypted data")
+	}
+	dv, err := gcm.Open(nil, ev[:gcm.NonceSize()], ev[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(dv), nil
+}
+
 func (h *ActionHandler) ValidateSecret(ctx context.Context, secret *types.Secret) error {
 	if secret.Name == "" {
 		return util.NewErrBadRequest(errors.Errorf("secret name required"))
@@ -81,6 +200,9 @@ func (h *ActionHandler) ValidateSecret(ctx context.Context, secret *types.Secret
 		if len(secret.Data) == 0 {
 			return util.NewErrBadRequest(errors.Errorf("empty secret data"))
 		}
+		if secret.DataEncrypted {
+			return util.NewErrBadRequest(errors.Errorf("secret data must be provided unencrypted"))
+		}
 	}
 	if secret.Parent.Type == "" {
 		return util.NewErrBadRequest(errors.Errorf("secret parent type required"))
@@ -96,6 +218,31 @@ func (h *ActionHandler) ValidateSecret(ctx context.Context, secret *types.Secret
 }
 
 func (h *ActionHandler) CreateSecret(ctx context.Context, secret *types.Secret) (*types.Secret, error) {
+	var res *types.Secret
+	err := h.idempotent(ctx, "create_secret",
+		func(ctx context.Context) (string, error) {
+			var err error
+			res, err = h.createSecret(ctx, secret)
+			if err != nil {
+				return "", err
+			}
+			return res.ID, nil
+		},
+		func(tx *db.Tx, id string) (bool, error) {
+			var err error
+			res, err = h.readDB.GetSecretByID(tx, id)
+			if err != nil || res == nil {
+				return false, err
+			}
+			return true, h.decryptSecret(res)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (h *ActionHandler) createSecret(ctx context.Context, secret *types.Secret) (*types.Secret, error) {
 	if err := h.ValidateSecret(ctx, secret); err != nil {
 		return nil, err
 	}
@@ -135,7 +282,11 @@ func (h *ActionHandler) CreateSecret(ctx context.Context, secret *types.Secret)
 
 	secret.ID = uuid.NewV4().String()
 
-	secretj, err := json.Marshal(secret)
+	es, err := h.encryptSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	secretj, err := json.Marshal(es)
 	if err != nil {
 		return nil, errors.Errorf("failed to marshal secret: %w", err)
 	}
@@ -148,7 +299,7 @@ func (h *ActionHandler) CreateSecret(ctx context.Context, secret *types.Secret)
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "create_secret", actions, cgt)
 	return secret, err
 }
 
@@ -215,7 +366,11 @@ func (h *ActionHandler) UpdateSecret(ctx context.Context, req *UpdateSecretReque
 		return nil, err
 	}
 
-	secretj, err := json.Marshal(req.Secret)
+	es, err := h.encryptSecret(req.Secret)
+	if err != nil {
+		return nil, err
+	}
+	secretj, err := json.Marshal(es)
 	if err != nil {
 		return nil, errors.Errorf("failed to marshal secret: %w", err)
 	}
@@ -228,7 +383,7 @@ func (h *ActionHandler) UpdateSecret(ctx context.Context, req *UpdateSecretReque
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "update_secret", actions, cgt)
 	return req.Secret, err
 }
 
@@ -275,6 +430,6 @@ func (h *ActionHandler) DeleteSecret(ctx context.Context, parentType types.Confi
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "delete_secret", actions, cgt)
 	return err
 }
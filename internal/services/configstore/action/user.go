@@ -17,6 +17,8 @@ package action
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"sort"
 	"time"
 
 	"agola.io/agola/internal/datamanager"
@@ -29,65 +31,69 @@ import (
 	errors "golang.org/x/xerrors"
 )
 
+const (
+	// tokenRevokeTimeout is the maximum time to wait for a deleted token to be
+	// revoked
+	tokenRevokeTimeout = 5 * time.Second
+
+	// purgeExpiredUserTokensBatchSize is the max number of users whose expired
+	// tokens are removed by a single purge
+	purgeExpiredUserTokensBatchSize = 100
+)
+
 type CreateUserRequest struct {
 	UserName string
 
 	CreateUserLARequest *CreateUserLARequest
 }
 
-func (h *ActionHandler) CreateUser(ctx context.Context, req *CreateUserRequest) (*types.User, error) {
+func validateCreateUserRequest(req *CreateUserRequest) error {
 	if req.UserName == "" {
-		return nil, util.NewErrBadRequest(errors.Errorf("user name required"))
+		return util.NewErrBadRequest(errors.Errorf("user name required"))
 	}
 	if !util.ValidateName(req.UserName) {
-		return nil, util.NewErrBadRequest(errors.Errorf("invalid user name %q", req.UserName))
+		return util.NewErrBadRequest(errors.Errorf("invalid user name %q", req.UserName))
 	}
+	return nil
+}
 
-	var cgt *datamanager.ChangeGroupsUpdateToken
-	// changegroup is the username (and in future the email) to ensure no
-	// concurrent user creation/modification using the same name
-	cgNames := []string{util.EncodeSha256Hex("username-" + req.UserName)}
-	var rs *types.RemoteSource
-
-	// must do all the checks in a single transaction to avoid concurrent changes
-	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
-		var err error
-		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
-		if err != nil {
-			return err
-		}
+// checkCreateUser checks that the user could be created and returns the
+// remote source of the requested linked account
+func (h *ActionHandler) checkCreateUser(tx *db.Tx, req *CreateUserRequest) (*types.RemoteSource, error) {
+	// check duplicate user name
+	u, err := h.readDB.GetUserByName(tx, req.UserName)
+	if err != nil {
+		return nil, err
+	}
+	if u != nil {
+		return nil, util.NewErrBadRequest(errors.Errorf("user with name %q already exists", u.Name))
+	}
 
-		// check duplicate user name
-		u, err := h.readDB.GetUserByName(tx, req.UserName)
-		if err != nil {
-			return err
-		}
-		if u != nil {
-			return util.NewErrBadRequest(errors.Errorf("user with name %q already exists", u.Name))
-		}
+	if req.CreateUserLARequest == nil {
+		return nil, nil
+	}
 
-		if req.CreateUserLARequest != nil {
-			rs, err = h.readDB.GetRemoteSourceByName(tx, req.CreateUserLARequest.RemoteSourceName)
-			if err != nil {
-				return err
-			}
-			if rs == nil {
-				return util.NewErrBadRequest(errors.Errorf("remote source %q doesn't exist", req.CreateUserLARequest.RemoteSourceName))
-			}
-			user, err := h.readDB.GetUserByLinkedAccountRemoteUserIDandSource(tx, req.CreateUserLARequest.RemoteUserID, rs.ID)
-			if err != nil {
-				return errors.Errorf("failed to get user for remote user id %q and remote source %q: %w", req.CreateUserLARequest.RemoteUserID, rs.ID, err)
-			}
-			if user != nil {
-				return util.NewErrBadRequest(errors.Errorf("user for remote user id %q for remote source %q already exists", req.CreateUserLARequest.RemoteUserID, req.CreateUserLARequest.RemoteSourceName))
-			}
-		}
-		return nil
-	})
+	rs, err := h.readDB.GetRemoteSourceByName(tx, req.CreateUserLARequest.RemoteSourceName)
 	if err != nil {
 		return nil, err
 	}
+	if rs == nil {
+		return nil, util.NewErrBadRequest(errors.Errorf("remote source %q doesn't exist", req.CreateUserLARequest.RemoteSourceName))
+	}
+	user, err := h.readDB.GetUserByLinkedAccountRemoteUserIDandSource(tx, req.CreateUserLARequest.RemoteUserID, rs.ID)
+	if err != nil {
+		return nil, errors.Errorf("failed to get user for remote user id %q and remote source %q: %w", req.CreateUserLARequest.RemoteUserID, rs.ID, err)
+	}
+	if user != nil {
+		return nil, util.NewErrBadRequest(errors.Errorf("user for remote user id %q for remote source %q already exists", req.CreateUserLARequest.RemoteUserID, req.CreateUserLARequest.RemoteSourceName))
+	}
 
+	return rs, nil
+}
+
+// newUser returns the new user and the wal actions to create it and its root
+// project group
+func newUser(req *CreateUserRequest, rs *types.RemoteSource) (*types.User, []*datamanager.Action, error) {
 	user := &types.User{
 		ID:     uuid.NewV4().String(),
 		Name:   req.UserName,
@@ -114,7 +120,7 @@ func (h *ActionHandler) CreateUser(ctx context.Context, req *CreateUserRequest)
 
 	userj, err := json.Marshal(user)
 	if err != nil {
-		return nil, errors.Errorf("failed to marshal user: %w", err)
+		return nil, nil, errors.Errorf("failed to marshal user: %w", err)
 	}
 
 	// create root user project group
@@ -129,7 +135,7 @@ func (h *ActionHandler) CreateUser(ctx context.Context, req *CreateUserRequest)
 	}
 	pgj, err := json.Marshal(pg)
 	if err != nil {
-		return nil, errors.Errorf("failed to marshal project group: %w", err)
+		return nil, nil, errors.Errorf("failed to marshal project group: %w", err)
 	}
 
 	actions := []*datamanager.Action{
@@ -147,11 +153,187 @@ func (h *ActionHandler) CreateUser(ctx context.Context, req *CreateUserRequest)
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	return user, actions, nil
+}
+
+func (h *ActionHandler) CreateUser(ctx context.Context, req *CreateUserRequest) (*types.User, error) {
+	var res *types.User
+	err := h.idempotent(ctx, "create_user",
+		func(ctx context.Context) (string, error) {
+			var err error
+			res, err = h.createUser(ctx, req, false)
+			if err != nil {
+				return "", err
+			}
+			return res.ID, nil
+		},
+		func(tx *db.Tx, id string) (bool, error) {
+			var err error
+			res, err = h.readDB.GetUserByID(tx, id)
+			return res != nil, err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// CreateUserDryRun does all the checks done by CreateUser and returns the user
+// that would be created without saving it
+func (h *ActionHandler) CreateUserDryRun(ctx context.Context, req *CreateUserRequest) (*types.User, error) {
+	return h.createUser(ctx, req, true)
+}
+
+func (h *ActionHandler) createUser(ctx context.Context, req *CreateUserRequest, dryRun bool) (*types.User, error) {
+	if err := validateCreateUserRequest(req); err != nil {
+		return nil, err
+	}
+
+	var cgt *datamanager.ChangeGroupsUpdateToken
+	// changegroup is the username (and in future the email) to ensure no
+	// concurrent user creation/modification using the same name
+	cgNames := []string{util.EncodeSha256Hex("username-" + h.readDB.NameKey(req.UserName))}
+	var rs *types.RemoteSource
+
+	// must do all the checks in a single transaction to avoid concurrent changes
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
+		if err != nil {
+			return err
+		}
+
+		rs, err = h.checkCreateUser(tx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user, actions, err := newUser(req, rs)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return user, nil
+	}
+
+	_, err = h.writeWal(ctx, "create_user", actions, cgt)
 	return user, err
 }
 
-func (h *ActionHandler) DeleteUser(ctx context.Context, userRef string) error {
+// ImportUsers creates all the provided users in a single wal. If any of the
+// users cannot be created no user is created and the returned error details
+// contain the reason of every rejected user.
+func (h *ActionHandler) ImportUsers(ctx context.Context, reqs []*CreateUserRequest) ([]*types.User, error) {
+	if len(reqs) == 0 {
+		return nil, util.NewErrBadRequest(errors.Errorf("no users to import"))
+	}
+
+	// rejectReasons contains the reject reason of every user request
+	rejectReasons := make([]string, len(reqs))
+
+	cgNames := []string{}
+	userNames := map[string]struct{}{}
+	remoteUsers := map[string]struct{}{}
+	for i, req := range reqs {
+		if req == nil {
+			rejectReasons[i] = "empty user definition"
+			continue
+		}
+		if err := validateCreateUserRequest(req); err != nil {
+			rejectReasons[i] = err.Error()
+			continue
+		}
+		if _, ok := userNames[req.UserName]; ok {
+			rejectReasons[i] = fmt.Sprintf("duplicate user name %q", req.UserName)
+			continue
+		}
+		userNames[req.UserName] = struct{}{}
+
+		if req.CreateUserLARequest != nil {
+			remoteUser := req.CreateUserLARequest.RemoteSourceName + "/" + req.CreateUserLARequest.RemoteUserID
+			if _, ok := remoteUsers[remoteUser]; ok {
+				rejectReasons[i] = fmt.Sprintf("duplicate remote user id %q for remote source %q", req.CreateUserLARequest.RemoteUserID, req.CreateUserLARequest.RemoteSourceName)
+				continue
+			}
+			remoteUsers[remoteUser] = struct{}{}
+		}
+
+		cgNames = append(cgNames, util.EncodeSha256Hex("username-"+h.readDB.NameKey(req.UserName)))
+	}
+
+	var cgt *datamanager.ChangeGroupsUpdateToken
+	rss := make([]*types.RemoteSource, len(reqs))
+
+	// must do all the checks in a single transaction to avoid concurrent changes
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
+		if err != nil {
+			return err
+		}
+
+		for i, req := range reqs {
+			if rejectReasons[i] != "" {
+				continue
+			}
+			rs, err := h.checkCreateUser(tx, req)
+			if err != nil {
+				if util.IsBadRequest(err) {
+					rejectReasons[i] = err.Error()
+					continue
+				}
+				return err
+			}
+			rss[i] = rs
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	details := []string{}
+	for i, reason := range rejectReasons {
+		if reason != "" {
+			details = append(details, fmt.Sprintf("users[%d]: %s", i, reason))
+		}
+	}
+	if len(details) > 0 {
+		return nil, util.NewErrBadRequest(util.NewAPIError(ErrorCodeUsersImportRejected, errors.Errorf("%d of %d users rejected, no user imported", len(details), len(reqs)), details...))
+	}
+
+	users := []*types.User{}
+	actions := []*datamanager.Action{}
+	for i, req := range reqs {
+		user, userActions, err := newUser(req, rss[i])
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+		actions = append(actions, userActions...)
+	}
+
+	if _, err := h.writeWal(ctx, "import_users", actions, cgt); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// DeleteUser deletes the user. If expectedRevision isn't empty the user is
+// deleted only if its revision matches.
+func (h *ActionHandler) DeleteUser(ctx context.Context, userRef, expectedRevision string) error {
+	return h.deleteUser(ctx, userRef, expectedRevision, h.readDB.GetUser)
+}
+
+// DeleteUserByID is like DeleteUser but the user is looked up only by its id,
+// so it isn't affected by concurrent user renames.
+func (h *ActionHandler) DeleteUserByID(ctx context.Context, userID, expectedRevision string) error {
+	return h.deleteUser(ctx, userID, expectedRevision, h.readDB.GetUserByID)
+}
+
+func (h *ActionHandler) deleteUser(ctx context.Context, userRef, expectedRevision string, getUser func(tx *db.Tx, userRef string) (*types.User, error)) error {
 	var user *types.User
 
 	var cgt *datamanager.ChangeGroupsUpdateToken
@@ -160,16 +342,22 @@ func (h *ActionHandler) DeleteUser(ctx context.Context, userRef string) error {
 		var err error
 
 		// check user existance
-		user, err = h.readDB.GetUser(tx, userRef)
+		user, err = getUser(tx, userRef)
 		if err != nil {
 			return err
 		}
 		if user == nil {
 			return util.NewErrBadRequest(errors.Errorf("user %q doesn't exist", userRef))
 		}
+		if err := h.checkUserRevision(tx, user.ID, expectedRevision); err != nil {
+			return err
+		}
 
 		// changegroup is the userid
 		cgNames := []string{util.EncodeSha256Hex("userid-" + user.ID)}
+		if h.softDelete {
+			cgNames = append(cgNames, util.EncodeSha256Hex("deletedresource-"+user.ID))
+		}
 		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
 		if err != nil {
 			return err
@@ -188,8 +376,17 @@ func (h *ActionHandler) DeleteUser(ctx context.Context, userRef string) error {
 			ID:         user.ID,
 		},
 	}
+	if h.softDelete {
+		deletionTime := time.Now().UTC()
+		user.DeletionTime = &deletionTime
+		action, err := softDeleteAction(types.ConfigTypeUser, user.ID, deletionTime, user)
+		if err != nil {
+			return err
+		}
+		actions = append(actions, action)
+	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "delete_user", actions, cgt)
 	return err
 }
 
@@ -197,9 +394,18 @@ type UpdateUserRequest struct {
 	UserRef string
 
 	UserName string
+
+	// ExpectedRevision, when not empty, is the user revision the update is
+	// based on. The update is rejected if the user has been changed in the
+	// meantime.
+	ExpectedRevision string
 }
 
 func (h *ActionHandler) UpdateUser(ctx context.Context, req *UpdateUserRequest) (*types.User, error) {
+	if req.UserName != "" && !util.ValidateName(req.UserName) {
+		return nil, util.NewErrBadRequest(errors.Errorf("invalid user name %q", req.UserName))
+	}
+
 	var cgt *datamanager.ChangeGroupsUpdateToken
 
 	cgNames := []string{}
@@ -215,24 +421,32 @@ func (h *ActionHandler) UpdateUser(ctx context.Context, req *UpdateUserRequest)
 		if user == nil {
 			return util.NewErrBadRequest(errors.Errorf("user %q doesn't exist", req.UserRef))
 		}
-
-		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
-		if err != nil {
+		if err := h.checkUserRevision(tx, user.ID, req.ExpectedRevision); err != nil {
 			return err
 		}
 
+		// changegroup is the userid
+		cgNames = append(cgNames, util.EncodeSha256Hex("userid-"+user.ID))
+
 		if req.UserName != "" {
 			// check duplicate user name
 			u, err := h.readDB.GetUserByName(tx, req.UserName)
 			if err != nil {
 				return err
 			}
-			if u != nil {
+			// with case insensitive names the user itself is returned when
+			// only the name case is changed
+			if u != nil && u.ID != user.ID {
 				return util.NewErrBadRequest(errors.Errorf("user with name %q already exists", u.Name))
 			}
 			// changegroup is the username (and in future the email) to ensure no
 			// concurrent user creation/modification using the same name
-			cgNames = append(cgNames, util.EncodeSha256Hex("username-"+req.UserName))
+			cgNames = append(cgNames, util.EncodeSha256Hex("username-"+h.readDB.NameKey(req.UserName)))
+		}
+
+		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
+		if err != nil {
+			return err
 		}
 
 		return nil
@@ -259,10 +473,26 @@ func (h *ActionHandler) UpdateUser(ctx context.Context, req *UpdateUserRequest)
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "update_user", actions, cgt)
 	return user, err
 }
 
+// checkUserRevision returns an ErrPreconditionFailed if expectedRevision isn't
+// empty and doesn't match the current user revision
+func (h *ActionHandler) checkUserRevision(tx *db.Tx, userID, expectedRevision string) error {
+	if expectedRevision == "" {
+		return nil
+	}
+	revision, err := h.readDB.GetUserRevision(tx, userID)
+	if err != nil {
+		return err
+	}
+	if revision != expectedRevision {
+		return util.NewErrPreconditionFailed(util.NewAPIError(ErrorCodeRevisionMismatch, errors.Errorf("user %q revision %q doesn't match the expected revision %q", userID, revision, expectedRevision)))
+	}
+	return nil
+}
+
 type CreateUserLARequest struct {
 	UserRef string
 
@@ -311,15 +541,17 @@ func (h *ActionHandler) CreateUserLA(ctx context.Context, req *CreateUserLAReque
 			return err
 		}
 		if rs == nil {
-			return util.NewErrBadRequest(errors.Errorf("remote source %q doesn't exist", req.RemoteSourceName))
+			return util.NewErrNotExist(util.NewAPIError(ErrorCodeRemoteSourceNotExist, errors.Errorf("remote source %q doesn't exist", req.RemoteSourceName)))
 		}
 
-		user, err := h.readDB.GetUserByLinkedAccountRemoteUserIDandSource(tx, req.RemoteUserID, rs.ID)
+		// a remote user must be linked to only one user or the lookup of the
+		// user by linked account will be ambiguous
+		laUser, err := h.readDB.GetUserByLinkedAccountRemoteUserIDandSource(tx, req.RemoteUserID, rs.ID)
 		if err != nil {
 			return errors.Errorf("failed to get user for remote user id %q and remote source %q: %w", req.RemoteUserID, rs.ID, err)
 		}
-		if user != nil {
-			return util.NewErrBadRequest(errors.Errorf("user for remote user id %q for remote source %q already exists", req.RemoteUserID, req.RemoteSourceName))
+		if laUser != nil {
+			return util.NewErrConflict(util.NewAPIError(ErrorCodeLinkedAccountAlreadyExists, errors.Errorf("remote user id %q for remote source %q is already linked to user %q", req.RemoteUserID, req.RemoteSourceName, laUser.Name)))
 		}
 		return nil
 	})
@@ -357,7 +589,7 @@ func (h *ActionHandler) CreateUserLA(ctx context.Context, req *CreateUserLAReque
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "create_user_la", actions, cgt)
 	return la, err
 }
 
@@ -417,10 +649,79 @@ func (h *ActionHandler) DeleteUserLA(ctx context.Context, userRef, laID string)
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "delete_user_la", actions, cgt)
 	return err
 }
 
+// DeleteUserLAs deletes all the linked accounts of the user in a single wal
+// and returns the ids of the deleted linked accounts.
+// The remote source tokens (oauth2 and user access tokens) are saved in the
+// linked accounts so they are removed with them. They aren't revoked on the
+// remote source. The user api tokens aren't tied to the linked accounts and
+// are kept.
+func (h *ActionHandler) DeleteUserLAs(ctx context.Context, userRef string) ([]string, error) {
+	if userRef == "" {
+		return nil, util.NewErrBadRequest(errors.Errorf("user ref required"))
+	}
+
+	var user *types.User
+
+	var cgt *datamanager.ChangeGroupsUpdateToken
+
+	// must do all the checks in a single transaction to avoid concurrent changes
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		user, err = h.readDB.GetUser(tx, userRef)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return util.NewErrNotExist(errors.Errorf("user %q doesn't exist", userRef))
+		}
+
+		// changegroup is the userid
+		cgNames := []string{util.EncodeSha256Hex("userid-" + user.ID)}
+		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	laIDs := []string{}
+	for laID := range user.LinkedAccounts {
+		laIDs = append(laIDs, laID)
+	}
+	sort.Strings(laIDs)
+	if len(laIDs) == 0 {
+		return laIDs, nil
+	}
+
+	user.LinkedAccounts = map[string]*types.LinkedAccount{}
+
+	userj, err := json.Marshal(user)
+	if err != nil {
+		return nil, errors.Errorf("failed to marshal user: %w", err)
+	}
+	actions := []*datamanager.Action{
+		{
+			ActionType: datamanager.ActionTypePut,
+			DataType:   string(types.ConfigTypeUser),
+			ID:         user.ID,
+			Data:       userj,
+		},
+	}
+
+	if _, err := h.writeWal(ctx, "delete_user_las", actions, cgt); err != nil {
+		return nil, err
+	}
+	return laIDs, nil
+}
+
 type UpdateUserLARequest struct {
 	UserRef string
 
@@ -501,17 +802,138 @@ func (h *ActionHandler) UpdateUserLA(ctx context.Context, req *UpdateUserLAReque
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "update_user_la", actions, cgt)
 	return la, err
 }
 
-func (h *ActionHandler) CreateUserToken(ctx context.Context, userRef, tokenName string) (string, error) {
+type UpdateUserLATokenRequest struct {
+	UserRef string
+
+	LinkedAccountID            string
+	UserAccessToken            string
+	Oauth2AccessToken          string
+	Oauth2RefreshToken         string
+	Oauth2AccessTokenExpiresAt time.Time
+}
+
+// UpdateUserLAToken updates only the tokens of a linked account, the remote
+// user isn't changed. Nothing is written if the tokens are unchanged so the
+// same update can be safely retried.
+func (h *ActionHandler) UpdateUserLAToken(ctx context.Context, req *UpdateUserLATokenRequest) (*types.LinkedAccount, *types.RemoteSource, error) {
+	if req.UserRef == "" {
+		return nil, nil, util.NewErrBadRequest(errors.Errorf("user ref required"))
+	}
+
+	var user *types.User
+	var rs *types.RemoteSource
+
+	var cgt *datamanager.ChangeGroupsUpdateToken
+
+	// must do all the checks in a single transaction to avoid concurrent changes
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		user, err = h.readDB.GetUser(tx, req.UserRef)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return util.NewErrNotExist(errors.Errorf("user %q doesn't exist", req.UserRef))
+		}
+
+		// changegroup is the userid
+		cgNames := []string{util.EncodeSha256Hex("userid-" + user.ID)}
+		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
+		if err != nil {
+			return err
+		}
+
+		la, ok := user.LinkedAccounts[req.LinkedAccountID]
+		if !ok {
+			return util.NewErrNotExist(errors.Errorf("linked account id %q for user %q doesn't exist", req.LinkedAccountID, user.Name))
+		}
+
+		rs, err = h.readDB.GetRemoteSource(tx, la.RemoteSourceID)
+		if err != nil {
+			return err
+		}
+		if rs == nil {
+			return util.NewErrBadRequest(errors.Errorf("remote source with id %q doesn't exist", la.RemoteSourceID))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	la := user.LinkedAccounts[req.LinkedAccountID]
+
+	if la.UserAccessToken == req.UserAccessToken &&
+		la.Oauth2AccessToken == req.Oauth2AccessToken &&
+		la.Oauth2RefreshToken == req.Oauth2RefreshToken &&
+		la.Oauth2AccessTokenExpiresAt.Equal(req.Oauth2AccessTokenExpiresAt) {
+		return la, rs, nil
+	}
+
+	la.UserAccessToken = req.UserAccessToken
+	la.Oauth2AccessToken = req.Oauth2AccessToken
+	la.Oauth2RefreshToken = req.Oauth2RefreshToken
+	la.Oauth2AccessTokenExpiresAt = req.Oauth2AccessTokenExpiresAt
+
+	userj, err := json.Marshal(user)
+	if err != nil {
+		return nil, nil, errors.Errorf("failed to marshal user: %w", err)
+	}
+	actions := []*datamanager.Action{
+		{
+			ActionType: datamanager.ActionTypePut,
+			DataType:   string(types.ConfigTypeUser),
+			ID:         user.ID,
+			Data:       userj,
+		},
+	}
+
+	_, err = h.writeWal(ctx, "update_user_la_token", actions, cgt)
+	return la, rs, err
+}
+
+// CreateUserTokenOptions are the options of the user token creation
+type CreateUserTokenOptions struct {
+	// TTL is the time after which the token expires. When 0 the token never
+	// expires.
+	TTL time.Duration
+}
+
+// CreateUserToken creates a new user token with the provided scopes. A token
+// without scopes is a read only token.
+func (h *ActionHandler) CreateUserToken(ctx context.Context, userRef, tokenName string, scopes []types.TokenScope) (string, error) {
+	return h.CreateUserTokenWithOptions(ctx, userRef, tokenName, scopes, nil)
+}
+
+// CreateUserTokenWithOptions creates a new user token like CreateUserToken
+// with the provided options, opts can be nil
+func (h *ActionHandler) CreateUserTokenWithOptions(ctx context.Context, userRef, tokenName string, scopes []types.TokenScope, opts *CreateUserTokenOptions) (string, error) {
+	var ttl time.Duration
+	if opts != nil {
+		ttl = opts.TTL
+	}
 	if userRef == "" {
 		return "", util.NewErrBadRequest(errors.Errorf("user ref required"))
 	}
 	if tokenName == "" {
 		return "", util.NewErrBadRequest(errors.Errorf("token name required"))
 	}
+	if ttl < 0 {
+		return "", util.NewErrBadRequest(errors.Errorf("token ttl must be greater or equal than 0"))
+	}
+	tokenScopes := []types.TokenScope{}
+	for _, scope := range scopes {
+		if !types.IsValidTokenScope(scope) {
+			return "", util.NewErrBadRequest(errors.Errorf("invalid token scope %q", scope))
+		}
+		if !tokenScopeInList(tokenScopes, scope) {
+			tokenScopes = append(tokenScopes, scope)
+		}
+	}
 
 	var user *types.User
 
@@ -545,13 +967,46 @@ func (h *ActionHandler) CreateUserToken(ctx context.Context, userRef, tokenName
 			return "", util.NewErrBadRequest(errors.Errorf("token %q for user %q already exists", tokenName, userRef))
 		}
 	}
+	if tokenScopeInList(tokenScopes, types.TokenScopeAdmin) && !user.Admin {
+		return "", util.NewErrBadRequest(errors.Errorf("token scope %q requires an admin user", types.TokenScopeAdmin))
+	}
+	// a user authenticated by token can only create tokens for itself, unless
+	// it's an admin, with scopes included in its token scopes
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		if principal.UserID != "" && principal.UserID != user.ID && !principal.HasScope(types.TokenScopeAdmin) {
+			return "", util.NewErrForbidden(errors.Errorf("cannot create tokens for user %q", userRef))
+		}
+		for _, scope := range tokenScopes {
+			if !principal.HasScope(scope) {
+				return "", util.NewErrForbidden(errors.Errorf("cannot create a token with scope %q", scope))
+			}
+		}
+	}
 
 	if user.Tokens == nil {
 		user.Tokens = make(map[string]string)
 	}
 
+	if user.TokensCreationTime == nil {
+		user.TokensCreationTime = make(map[string]time.Time)
+	}
+
 	token := util.EncodeSha1Hex(uuid.NewV4().String())
-	user.Tokens[tokenName] = token
+	now := time.Now()
+	user.Tokens[tokenName] = types.HashToken(token)
+	user.TokensCreationTime[tokenName] = now
+	if ttl > 0 {
+		if user.TokensExpirationTime == nil {
+			user.TokensExpirationTime = make(map[string]time.Time)
+		}
+		user.TokensExpirationTime[tokenName] = now.Add(ttl)
+	}
+	if len(tokenScopes) > 0 {
+		if user.TokensScopes == nil {
+			user.TokensScopes = make(map[string][]types.TokenScope)
+		}
+		user.TokensScopes[tokenName] = tokenScopes
+	}
 
 	userj, err := json.Marshal(user)
 	if err != nil {
@@ -566,16 +1021,30 @@ func (h *ActionHandler) CreateUserToken(ctx context.Context, userRef, tokenName
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "create_user_token", actions, cgt)
 	return token, err
 }
 
-func (h *ActionHandler) DeleteUserToken(ctx context.Context, userRef, tokenName string) error {
+func tokenScopeInList(scopes []types.TokenScope, scope types.TokenScope) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteUserToken deletes the user token and waits for the readdb to apply the
+// change, so the token can't be used anymore, and reports if it's revoked.
+// If the readdb doesn't apply it before tokenRevokeTimeout the token is
+// deleted but still accepted for a short time, this isn't reported as an error
+// since retrying the delete would fail with the token not existing.
+func (h *ActionHandler) DeleteUserToken(ctx context.Context, userRef, tokenName string) (bool, error) {
 	if userRef == "" {
-		return util.NewErrBadRequest(errors.Errorf("user ref required"))
+		return false, util.NewErrBadRequest(errors.Errorf("user ref required"))
 	}
 	if tokenName == "" {
-		return util.NewErrBadRequest(errors.Errorf("token name required"))
+		return false, util.NewErrBadRequest(errors.Errorf("token name required"))
 	}
 
 	var user *types.User
@@ -590,7 +1059,7 @@ func (h *ActionHandler) DeleteUserToken(ctx context.Context, userRef, tokenName
 			return err
 		}
 		if user == nil {
-			return util.NewErrBadRequest(errors.Errorf("user %q doesn't exist", userRef))
+			return util.NewErrNotExist(errors.Errorf("user %q doesn't exist", userRef))
 		}
 
 		// changegroup is the userid
@@ -603,15 +1072,123 @@ func (h *ActionHandler) DeleteUserToken(ctx context.Context, userRef, tokenName
 		return nil
 	})
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		if principal.UserID != "" && principal.UserID != user.ID && !principal.HasScope(types.TokenScopeAdmin) {
+			return false, util.NewErrForbidden(errors.Errorf("cannot delete tokens of user %q", userRef))
+		}
 	}
 
 	_, ok := user.Tokens[tokenName]
 	if !ok {
-		return util.NewErrBadRequest(errors.Errorf("token %q for user %q doesn't exist", tokenName, userRef))
+		return false, util.NewErrNotExist(errors.Errorf("token %q for user %q doesn't exist", tokenName, userRef))
 	}
 
 	delete(user.Tokens, tokenName)
+	delete(user.TokensCreationTime, tokenName)
+	delete(user.TokensScopes, tokenName)
+	delete(user.TokensExpirationTime, tokenName)
+
+	userj, err := json.Marshal(user)
+	if err != nil {
+		return false, errors.Errorf("failed to marshal user: %w", err)
+	}
+	actions := []*datamanager.Action{
+		{
+			ActionType: datamanager.ActionTypePut,
+			DataType:   string(types.ConfigTypeUser),
+			ID:         user.ID,
+			Data:       userj,
+		},
+	}
+
+	ncgt, err := h.writeWal(ctx, "delete_user_token", actions, cgt)
+	if err != nil {
+		return false, err
+	}
+
+	// wait for the readdb to apply the change so the token is immediately
+	// revoked since the readdb is used to authenticate users by token
+	wctx, cancel := context.WithTimeout(ctx, tokenRevokeTimeout)
+	defer cancel()
+	if err := h.readDB.WaitRevision(wctx, ncgt.CurRevision); err != nil {
+		if wctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			h.log.Warnf("token %q of user %q deleted but not yet revoked: %v", tokenName, userRef, err)
+			return false, nil
+		}
+		return false, errors.Errorf("token %q deleted but not yet revoked: %w", tokenName, err)
+	}
+
+	return true, nil
+}
+
+// PurgeExpiredUserTokens removes the expired user tokens. The expired tokens
+// are already rejected when authenticating, they're removed to not keep them
+// forever in the users data
+func (h *ActionHandler) PurgeExpiredUserTokens(ctx context.Context) error {
+	var users []*types.User
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		users, err = h.readDB.GetUsersWithExpiredTokens(tx, time.Now(), purgeExpiredUserTokensBatchSize)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if err := h.purgeExpiredUserTokens(ctx, user.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *ActionHandler) purgeExpiredUserTokens(ctx context.Context, userID string) error {
+	var user *types.User
+
+	var cgt *datamanager.ChangeGroupsUpdateToken
+
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		// the user could have been changed in the meantime
+		user, err = h.readDB.GetUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return nil
+		}
+
+		// changegroup is the userid
+		cgNames := []string{util.EncodeSha256Hex("userid-" + user.ID)}
+		cgt, err = h.readDB.GetChangeGroupsUpdateTokens(tx, cgNames)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return nil
+	}
+
+	now := time.Now()
+	purged := false
+	for tokenName := range user.Tokens {
+		if !user.TokenExpired(tokenName, now) {
+			continue
+		}
+		delete(user.Tokens, tokenName)
+		delete(user.TokensCreationTime, tokenName)
+		delete(user.TokensScopes, tokenName)
+		delete(user.TokensExpirationTime, tokenName)
+		purged = true
+	}
+	if !purged {
+		return nil
+	}
 
 	userj, err := json.Marshal(user)
 	if err != nil {
@@ -626,7 +1203,7 @@ func (h *ActionHandler) DeleteUserToken(ctx context.Context, userRef, tokenName
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "purge_expired_user_tokens", actions, cgt)
 	return err
 }
 
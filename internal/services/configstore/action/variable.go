@@ -72,6 +72,28 @@ func (h *ActionHandler) ValidateVariable(ctx context.Context, variable *types.Va
 }
 
 func (h *ActionHandler) CreateVariable(ctx context.Context, variable *types.Variable) (*types.Variable, error) {
+	var res *types.Variable
+	err := h.idempotent(ctx, "create_variable",
+		func(ctx context.Context) (string, error) {
+			var err error
+			res, err = h.createVariable(ctx, variable)
+			if err != nil {
+				return "", err
+			}
+			return res.ID, nil
+		},
+		func(tx *db.Tx, id string) (bool, error) {
+			var err error
+			res, err = h.readDB.GetVariableByID(tx, id)
+			return res != nil, err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (h *ActionHandler) createVariable(ctx context.Context, variable *types.Variable) (*types.Variable, error) {
 	if err := h.ValidateVariable(ctx, variable); err != nil {
 		return nil, err
 	}
@@ -124,7 +146,7 @@ func (h *ActionHandler) CreateVariable(ctx context.Context, variable *types.Vari
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "create_variable", actions, cgt)
 	return variable, err
 }
 
@@ -204,7 +226,7 @@ func (h *ActionHandler) UpdateVariable(ctx context.Context, req *UpdateVariableR
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "update_variable", actions, cgt)
 	return req.Variable, err
 }
 
@@ -250,6 +272,6 @@ func (h *ActionHandler) DeleteVariable(ctx context.Context, parentType types.Con
 		},
 	}
 
-	_, err = h.dm.WriteWal(ctx, actions, cgt)
+	_, err = h.writeWal(ctx, "delete_variable", actions, cgt)
 	return err
 }
@@ -0,0 +1,47 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+// setupAdminRouter returns the handler of the admin listener serving the admin
+// api routes of router, the metrics endpoint when it isn't served by a
+// dedicated listener and, when enabled, the pprof endpoints
+func (s *Configstore) setupAdminRouter(router *mux.Router) http.Handler {
+	mainrouter := s.newMainRouter()
+	if s.c.Metrics.Enabled && s.c.Metrics.ListenAddress == "" {
+		mainrouter.Handle("/metrics", s.metrics.handler()).Methods("GET")
+	}
+	if s.c.Admin.Pprof {
+		pprofrouter := mainrouter.PathPrefix("/debug/pprof").Subrouter()
+		if s.auth != nil {
+			pprofrouter.Use(s.auth.middleware)
+		}
+		pprofrouter.Handle("/cmdline", s.adminHandler(http.HandlerFunc(pprof.Cmdline)))
+		pprofrouter.Handle("/profile", s.adminHandler(http.HandlerFunc(pprof.Profile)))
+		pprofrouter.Handle("/symbol", s.adminHandler(http.HandlerFunc(pprof.Symbol)))
+		pprofrouter.Handle("/trace", s.adminHandler(http.HandlerFunc(pprof.Trace)))
+		// the index also serves the named profiles (heap, goroutine...)
+		pprofrouter.PathPrefix("/").Handler(s.adminHandler(http.HandlerFunc(pprof.Index)))
+	}
+	mainrouter.PathPrefix("/").Handler(router)
+
+	return mainrouter
+}
@@ -0,0 +1,362 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"agola.io/agola/internal/db"
+	slog "agola.io/agola/internal/log"
+	"agola.io/agola/internal/services/configstore/action"
+	"agola.io/agola/internal/services/configstore/readdb"
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/configstore/types"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
+)
+
+// resourceAccess reports if a principal can read or write the resources.
+// Without a principal (api authentication disabled), with the admin token or a
+// token with the admin scope all the resources can be accessed. A user can
+// access:
+// * only itself
+// * the public orgs and the orgs it's a member of, for reading, and the orgs
+// it's an owner of, for writing
+// * the public projects and project groups and the ones owned by the user or
+// by its orgs, for reading, and the ones owned by the user or by the orgs
+// it's an owner of, for writing
+type resourceAccess struct {
+	readDB    *readdb.ReadDB
+	tx        *db.Tx
+	principal *action.Principal
+
+	// orgRoles are the user roles in its orgs keyed by org id
+	orgRoles map[string]types.MemberRole
+}
+
+func newResourceAccess(readDB *readdb.ReadDB, tx *db.Tx, principal *action.Principal) (*resourceAccess, error) {
+	a := &resourceAccess{readDB: readDB, tx: tx, principal: principal, orgRoles: map[string]types.MemberRole{}}
+	if a.unrestricted() {
+		return a, nil
+	}
+
+	userOrgs, err := readDB.GetUserOrgs(tx, principal.UserID)
+	if err != nil {
+		return nil, err
+	}
+	for _, userOrg := range userOrgs {
+		a.orgRoles[userOrg.Organization.ID] = userOrg.Role
+	}
+	return a, nil
+}
+
+func (a *resourceAccess) unrestricted() bool {
+	return a.principal == nil || a.principal.UserID == "" || a.principal.HasScope(types.TokenScopeAdmin)
+}
+
+func (a *resourceAccess) canAccessUser(user *types.User) bool {
+	return a.unrestricted() || user.ID == a.principal.UserID
+}
+
+func (a *resourceAccess) canAccessOrg(org *types.Organization, write bool) bool {
+	if a.unrestricted() {
+		return true
+	}
+	role, ok := a.orgRoles[org.ID]
+	if write {
+		return ok && role == types.MemberRoleOwner
+	}
+	return ok || org.Visibility == types.VisibilityPublic
+}
+
+// canAccessOwned reports if the principal can access a project or project
+// group with the provided visibility, parent and owner
+func (a *resourceAccess) canAccessOwned(visibility types.Visibility, parent *types.Parent, ownerType types.ConfigType, ownerID string, write bool) (bool, error) {
+	if a.unrestricted() {
+		return true, nil
+	}
+	switch ownerType {
+	case types.ConfigTypeUser:
+		if ownerID == a.principal.UserID {
+			return true, nil
+		}
+	case types.ConfigTypeOrg:
+		if role, ok := a.orgRoles[ownerID]; ok && (!write || role == types.MemberRoleOwner) {
+			return true, nil
+		}
+	}
+	if write {
+		return false, nil
+	}
+	globalVisibility, err := getGlobalVisibility(a.readDB, a.tx, visibility, parent)
+	if err != nil {
+		return false, err
+	}
+	return globalVisibility == types.VisibilityPublic, nil
+}
+
+func (a *resourceAccess) canAccessProject(project *types.Project, write bool) (bool, error) {
+	if a.unrestricted() {
+		return true, nil
+	}
+	ownerType, ownerID, err := a.readDB.GetProjectOwnerID(a.tx, project)
+	if err != nil {
+		return false, err
+	}
+	return a.canAccessOwned(project.Visibility, &project.Parent, ownerType, ownerID, write)
+}
+
+func (a *resourceAccess) canAccessProjectGroup(group *types.ProjectGroup, write bool) (bool, error) {
+	if a.unrestricted() {
+		return true, nil
+	}
+	ownerType, ownerID, err := a.readDB.GetProjectGroupOwnerID(a.tx, group)
+	if err != nil {
+		return false, err
+	}
+	return a.canAccessOwned(group.Visibility, &group.Parent, ownerType, ownerID, write)
+}
+
+// checkParentAccess returns a forbidden error if the request principal cannot
+// write in the parent of a created, updated or moved project or project group.
+// A not existing parent is reported by the action.
+func checkParentAccess(ctx context.Context, readDB *readdb.ReadDB, parent types.Parent) error {
+	return checkWriteAccess(ctx, readDB, parent.Type, parent.ID)
+}
+
+// checkWriteAccess returns a forbidden error if the request principal cannot
+// write the resource of type resourceType with the provided ref. A not
+// existing resource is reported by the action.
+func checkWriteAccess(ctx context.Context, readDB *readdb.ReadDB, resourceType types.ConfigType, ref string) error {
+	principal := action.PrincipalFromContext(ctx)
+	if principal == nil || ref == "" {
+		return nil
+	}
+
+	allowed := true
+	err := readDB.Do(ctx, func(tx *db.Tx) error {
+		a, err := newResourceAccess(readDB, tx, principal)
+		if err != nil {
+			return err
+		}
+		if a.unrestricted() {
+			return nil
+		}
+		switch resourceType {
+		case types.ConfigTypeProject:
+			project, err := readDB.GetProject(tx, ref)
+			if err != nil || project == nil {
+				return err
+			}
+			allowed, err = a.canAccessProject(project, true)
+			return err
+		case types.ConfigTypeProjectGroup:
+			group, err := readDB.GetProjectGroup(tx, ref)
+			if err != nil || group == nil {
+				return err
+			}
+			allowed, err = a.canAccessProjectGroup(group, true)
+			return err
+		case types.ConfigTypeUser:
+			user, err := readDB.GetUser(tx, ref)
+			if err != nil || user == nil {
+				return err
+			}
+			allowed = a.canAccessUser(user)
+		case types.ConfigTypeOrg:
+			org, err := readDB.GetOrg(tx, ref)
+			if err != nil || org == nil {
+				return err
+			}
+			allowed = a.canAccessOrg(org, true)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return util.NewErrForbidden(errors.Errorf("%s %q write access denied", resourceType, ref))
+	}
+	return nil
+}
+
+// getDeletedResource decodes in v the soft deleted resource of type
+// resourceType with the provided id. It returns false if it doesn't exist.
+func getDeletedResource(readDB *readdb.ReadDB, tx *db.Tx, resourceType types.ConfigType, id string, v interface{}) (bool, error) {
+	dr, err := readDB.GetDeletedResource(tx, id)
+	if err != nil {
+		return false, err
+	}
+	if dr == nil || dr.ResourceType != resourceType {
+		return false, nil
+	}
+	if err := json.Unmarshal(dr.Data, v); err != nil {
+		return false, errors.Errorf("failed to unmarshal deleted %s: %w", resourceType, err)
+	}
+	return true, nil
+}
+
+// ResourceAccessHandler executes h only if the request principal can access
+// the resource of type resourceType identified by the request route, by ref
+// or, for the routes of the soft deleted resources, by id. The GET and HEAD
+// requests require the read access, all the others the write access.
+// When the resource doesn't exist h is executed to return its own error.
+// A denied access is reported with a forbidden error or, if hideDenied is
+// true, with a not exist error to not disclose the resource existence.
+type ResourceAccessHandler struct {
+	log          *zap.SugaredLogger
+	readDB       *readdb.ReadDB
+	resourceType types.ConfigType
+	hideDenied   bool
+	h            http.Handler
+}
+
+func NewResourceAccessHandler(logger *zap.Logger, readDB *readdb.ReadDB, resourceType types.ConfigType, hideDenied bool, h http.Handler) *ResourceAccessHandler {
+	return &ResourceAccessHandler{log: logger.Sugar(), readDB: readDB, resourceType: resourceType, hideDenied: hideDenied, h: h}
+}
+
+func (h *ResourceAccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+
+	principal := action.PrincipalFromContext(ctx)
+	if principal == nil {
+		h.h.ServeHTTP(w, r)
+		return
+	}
+	write := r.Method != "GET" && r.Method != "HEAD"
+
+	var resourceName, ref string
+	// byID reports if the resource is identified by the id route variable
+	byID := false
+	switch h.resourceType {
+	case types.ConfigTypeProject:
+		resourceName, ref = "project", vars["projectref"]
+		if id, ok := vars["projectid"]; ok {
+			ref, byID = id, true
+		}
+	case types.ConfigTypeProjectGroup:
+		resourceName, ref = "project group", vars["projectgroupref"]
+	case types.ConfigTypeUser:
+		resourceName, ref = "user", vars["userref"]
+		if id, ok := vars["userid"]; ok {
+			ref, byID = id, true
+		}
+	case types.ConfigTypeOrg:
+		resourceName, ref = "org", vars["orgref"]
+	}
+	// the project and project group refs could be escaped paths
+	if !byID && (h.resourceType == types.ConfigTypeProject || h.resourceType == types.ConfigTypeProjectGroup) {
+		var err error
+		ref, err = url.PathUnescape(ref)
+		if err != nil {
+			httpError(w, r, util.NewErrBadRequest(errors.Errorf("wrong %s ref %q: %w", resourceName, ref, err)))
+			return
+		}
+	}
+
+	allowed := true
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		a, err := newResourceAccess(h.readDB, tx, principal)
+		if err != nil {
+			return err
+		}
+		if a.unrestricted() {
+			return nil
+		}
+
+		switch h.resourceType {
+		case types.ConfigTypeProject:
+			var project *types.Project
+			if byID {
+				project, err = h.readDB.GetProjectByID(tx, ref)
+			} else {
+				project, err = h.readDB.GetProject(tx, ref)
+			}
+			if err != nil {
+				return err
+			}
+			if project == nil && byID {
+				var ok bool
+				project = &types.Project{}
+				if ok, err = getDeletedResource(h.readDB, tx, types.ConfigTypeProject, ref, project); err != nil || !ok {
+					return err
+				}
+			}
+			if project == nil {
+				return nil
+			}
+			allowed, err = a.canAccessProject(project, write)
+			return err
+		case types.ConfigTypeProjectGroup:
+			group, err := h.readDB.GetProjectGroup(tx, ref)
+			if err != nil || group == nil {
+				return err
+			}
+			allowed, err = a.canAccessProjectGroup(group, write)
+			return err
+		case types.ConfigTypeUser:
+			var user *types.User
+			if byID {
+				user, err = h.readDB.GetUserByID(tx, ref)
+			} else {
+				user, err = h.readDB.GetUser(tx, ref)
+			}
+			if err != nil {
+				return err
+			}
+			if user == nil && byID {
+				var ok bool
+				user = &types.User{}
+				if ok, err = getDeletedResource(h.readDB, tx, types.ConfigTypeUser, ref, user); err != nil || !ok {
+					return err
+				}
+			}
+			if user == nil {
+				return nil
+			}
+			allowed = a.canAccessUser(user)
+		case types.ConfigTypeOrg:
+			org, err := h.readDB.GetOrg(tx, ref)
+			if err != nil || org == nil {
+				return err
+			}
+			allowed = a.canAccessOrg(org, write)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+
+	if !allowed {
+		if h.hideDenied {
+			httpError(w, r, util.NewErrNotExist(errors.Errorf("%s %q doesn't exist", resourceName, ref)))
+			return
+		}
+		httpError(w, r, util.NewErrForbidden(errors.Errorf("%s %q access denied", resourceName, ref)))
+		return
+	}
+
+	h.h.ServeHTTP(w, r)
+}
@@ -16,106 +16,321 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
+	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"agola.io/agola/internal/util"
 	"agola.io/agola/services/configstore/types"
 
+	"github.com/ghodss/yaml"
 	"github.com/gorilla/mux"
 	errors "golang.org/x/xerrors"
 )
 
-type ErrorResponse struct {
-	Message string `json:"message"`
+const (
+	jsonContentType = "application/json"
+	yamlContentType = "application/yaml"
+)
+
+// yamlMediaTypes are the accepted media types for a yaml response
+var yamlMediaTypes = map[string]struct{}{
+	yamlContentType:      {},
+	"application/x-yaml": {},
+	"text/yaml":          {},
+	"text/x-yaml":        {},
 }
 
-func ErrorResponseFromError(err error) *ErrorResponse {
-	var aerr error
-	// use inner errors if of these types
-	switch {
-	case util.IsBadRequest(err):
-		var cerr *util.ErrBadRequest
-		errors.As(err, &cerr)
-		aerr = cerr
-	case util.IsNotExist(err):
-		var cerr *util.ErrNotExist
-		errors.As(err, &cerr)
-		aerr = cerr
-	case util.IsForbidden(err):
-		var cerr *util.ErrForbidden
-		errors.As(err, &cerr)
-		aerr = cerr
-	case util.IsUnauthorized(err):
-		var cerr *util.ErrUnauthorized
-		errors.As(err, &cerr)
-		aerr = cerr
-	case util.IsInternal(err):
-		var cerr *util.ErrInternal
-		errors.As(err, &cerr)
-		aerr = cerr
+// responseContentType returns the response content type negotiated with the
+// request Accept header. A yaml response is returned only when a yaml media
+// type is preferred to json, json is the default.
+func responseContentType(r *http.Request) string {
+	contentType := jsonContentType
+	bestQ := -1.0
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		// with the same quality the first media type wins
+		if q <= bestQ || q == 0 {
+			continue
+		}
+		if _, ok := yamlMediaTypes[mediaType]; ok {
+			contentType, bestQ = yamlContentType, q
+		} else if mediaType == jsonContentType || mediaType == "application/*" || mediaType == "*/*" {
+			contentType, bestQ = jsonContentType, q
+		}
 	}
+	return contentType
+}
 
-	if aerr != nil {
-		return &ErrorResponse{Message: aerr.Error()}
+// marshalResponse marshals res in the content type negotiated with the
+// request
+func marshalResponse(r *http.Request, res interface{}) ([]byte, string, error) {
+	resj, err := json.Marshal(res)
+	if err != nil {
+		return nil, "", err
 	}
-
-	// on generic error return an generic message to not leak the real error
-	return &ErrorResponse{Message: "internal server error"}
+	contentType := responseContentType(r)
+	if contentType != yamlContentType {
+		return resj, contentType, nil
+	}
+	// convert from json to keep the json field names
+	resy, err := yaml.JSONToYAML(resj)
+	if err != nil {
+		return nil, "", err
+	}
+	return resy, contentType, nil
 }
 
-func httpError(w http.ResponseWriter, err error) bool {
+func httpError(w http.ResponseWriter, r *http.Request, err error) bool {
 	if err == nil {
 		return false
 	}
 
-	response := ErrorResponseFromError(err)
-	resj, merr := json.Marshal(response)
+	response := util.APIErrorFromError(err)
+	resb, contentType, merr := marshalResponse(r, response)
 	if merr != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return true
 	}
+	w.Header().Set("Content-Type", contentType)
 	switch {
+	case util.IsRequestTooLarge(err):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = w.Write(resb)
 	case util.IsBadRequest(err):
 		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write(resj)
+		_, _ = w.Write(resb)
 	case util.IsNotExist(err):
 		w.WriteHeader(http.StatusNotFound)
-		_, _ = w.Write(resj)
+		_, _ = w.Write(resb)
 	case util.IsForbidden(err):
 		w.WriteHeader(http.StatusForbidden)
-		_, _ = w.Write(resj)
+		_, _ = w.Write(resb)
 	case util.IsUnauthorized(err):
 		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write(resj)
+		_, _ = w.Write(resb)
+	case util.IsConflict(err):
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write(resb)
+	case util.IsPreconditionFailed(err):
+		w.WriteHeader(http.StatusPreconditionFailed)
+		_, _ = w.Write(resb)
+	case util.IsTooManyRequests(err):
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write(resb)
+	case util.IsUnavailable(err):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write(resb)
+	case util.IsTimeout(err):
+		w.WriteHeader(http.StatusGatewayTimeout)
+		_, _ = w.Write(resb)
+	case util.IsMisdirectedRequest(err):
+		w.WriteHeader(http.StatusMisdirectedRequest)
+		_, _ = w.Write(resb)
 	case util.IsInternal(err):
 		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write(resj)
+		_, _ = w.Write(resb)
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write(resj)
+		_, _ = w.Write(resb)
 	}
 	return true
 }
 
-func httpResponse(w http.ResponseWriter, code int, res interface{}) error {
-	w.Header().Set("Content-Type", "application/json")
+// HTTPError writes the error response for err in the content type negotiated
+// with the request. It's used by the middlewares defined outside this package.
+func HTTPError(w http.ResponseWriter, r *http.Request, err error) bool {
+	return httpError(w, r, err)
+}
 
+// NotFoundHandler returns an error for the not existing routes
+type NotFoundHandler struct{}
+
+func NewNotFoundHandler() *NotFoundHandler {
+	return &NotFoundHandler{}
+}
+
+func (h *NotFoundHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	httpError(w, r, util.NewErrNotExist(errors.Errorf("path %q not found", r.URL.Path)))
+}
+
+// routeMethods are the methods checked to report the methods allowed for a
+// path
+var routeMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// MethodNotAllowedHandler returns an error for the routes existing with
+// a different method. The Allow header reports the methods of the router
+// routes matching the request path.
+// An OPTIONS request, when not handled by a route, is answered with just the
+// Allow header.
+type MethodNotAllowedHandler struct {
+	router *mux.Router
+}
+
+func NewMethodNotAllowedHandler(router *mux.Router) *MethodNotAllowedHandler {
+	return &MethodNotAllowedHandler{router: router}
+}
+
+func (h *MethodNotAllowedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	methods := h.allowedMethods(r)
+	w.Header().Set("Allow", strings.Join(append(methods, "OPTIONS"), ", "))
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	_ = httpResponse(w, r, http.StatusMethodNotAllowed, &util.APIError{
+		Code:    util.ErrorCodeBadRequest,
+		Message: fmt.Sprintf("method %s not allowed", r.Method),
+	})
+}
+
+func (h *MethodNotAllowedHandler) allowedMethods(r *http.Request) []string {
+	methods := []string{}
+	for _, method := range routeMethods {
+		mr := r.WithContext(r.Context())
+		mr.Method = method
+		var match mux.RouteMatch
+		if h.router.Match(mr, &match) && match.MatchErr == nil {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// httpResponse writes res in the content type negotiated with the request,
+// restricted to the fields requested by a GET request
+func httpResponse(w http.ResponseWriter, r *http.Request, code int, res interface{}) error {
 	if res != nil {
-		resj, err := json.Marshal(res)
+		res, err := selectFields(r, res)
 		if err != nil {
-			httpError(w, err)
+			httpError(w, r, err)
 			return err
 		}
+		resb, contentType, err := marshalResponse(r, res)
+		if err != nil {
+			httpError(w, r, err)
+			return err
+		}
+		w.Header().Set("Content-Type", contentType)
 		w.WriteHeader(code)
-		_, err = w.Write(resj)
+		_, err = w.Write(resb)
 		return err
 	}
 
+	w.Header().Set("Content-Type", responseContentType(r))
 	w.WriteHeader(code)
 	return nil
 }
 
+// setETag sets the ETag header using the resource revision
+func setETag(w http.ResponseWriter, revision string) {
+	if revision == "" {
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(revision))
+}
+
+// checkLastModified sets the Last-Modified header using the resource
+// modification time and reports if the resource wasn't modified since the
+// request If-Modified-Since time. If-Modified-Since is ignored when the request
+// has an If-None-Match header.
+func checkLastModified(w http.ResponseWriter, r *http.Request, modTime time.Time) bool {
+	if modTime.IsZero() {
+		return false
+	}
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// the http dates have a seconds precision
+	return !modTime.Truncate(time.Second).After(t)
+}
+
+// notModified writes a not modified response
+func notModified(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// ifMatchRevision returns the resource revision provided in the If-Match
+// header. An empty revision is returned if the header is missing or is "*".
+func ifMatchRevision(r *http.Request) (string, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return "", nil
+	}
+	revision, err := strconv.Unquote(ifMatch)
+	if err != nil || !strings.HasPrefix(ifMatch, `"`) {
+		return "", util.NewErrBadRequest(errors.Errorf("wrong If-Match header %q, only a single strong entity tag is supported", ifMatch))
+	}
+	return revision, nil
+}
+
+// boolParam reports if the request has the provided query parameter set to
+// true
+func boolParam(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, util.NewErrBadRequest(errors.Errorf("wrong %s value %q", name, v))
+	}
+	return b, nil
+}
+
+// dryRunParam reports if the request has the dryRun query parameter set to true
+func dryRunParam(r *http.Request) (bool, error) {
+	return boolParam(r, "dryRun")
+}
+
+// includeDeletedParam reports if the request has the includeDeleted query
+// parameter set to true
+func includeDeletedParam(r *http.Request) (bool, error) {
+	return boolParam(r, "includeDeleted")
+}
+
+// ignoreMissingParam reports if the request has the ignoreMissing query
+// parameter set to true
+func ignoreMissingParam(r *http.Request) (bool, error) {
+	return boolParam(r, "ignoreMissing")
+}
+
+// cascadeParam reports if the request has the cascade query parameter set to
+// true
+func cascadeParam(r *http.Request) (bool, error) {
+	return boolParam(r, "cascade")
+}
+
 func GetConfigTypeRef(r *http.Request) (types.ConfigType, string, error) {
 	vars := mux.Vars(r)
 	projectRef, err := url.PathUnescape(vars["projectref"])
@@ -0,0 +1,130 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"agola.io/agola/internal/db"
+	slog "agola.io/agola/internal/log"
+	"agola.io/agola/internal/services/configstore/readdb"
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/configstore/types"
+
+	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	DefaultAuditEntriesLimit = 25
+	MaxAuditEntriesLimit     = 100
+)
+
+type AuditEntriesHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+}
+
+func NewAuditEntriesHandler(logger *zap.Logger, readDB *readdb.ReadDB) *AuditEntriesHandler {
+	return &AuditEntriesHandler{log: logger.Sugar(), readDB: readDB}
+}
+
+func (h *AuditEntriesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	limitS := query.Get("limit")
+	limit := DefaultAuditEntriesLimit
+	if limitS != "" {
+		var err error
+		limit, err = strconv.Atoi(limitS)
+		if err != nil {
+			httpError(w, r, util.NewErrBadRequest(errors.Errorf("cannot parse limit: %w", err)))
+			return
+		}
+	}
+	if limit < 0 {
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("limit must be greater or equal than 0")))
+		return
+	}
+	if limit == 0 || limit > MaxAuditEntriesLimit {
+		limit = MaxAuditEntriesLimit
+	}
+	asc := false
+	if _, ok := query["asc"]; ok {
+		asc = true
+	}
+
+	// since and until define the [since, until) time range
+	var since, until time.Time
+	if sinceS := query.Get("since"); sinceS != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, sinceS)
+		if err != nil {
+			httpError(w, r, util.NewErrBadRequest(errors.Errorf("cannot parse since: %w", err)))
+			return
+		}
+	}
+	if untilS := query.Get("until"); untilS != "" {
+		var err error
+		until, err = time.Parse(time.RFC3339Nano, untilS)
+		if err != nil {
+			httpError(w, r, util.NewErrBadRequest(errors.Errorf("cannot parse until: %w", err)))
+			return
+		}
+	}
+
+	filter := &readdb.AuditEntriesFilter{
+		Since:        since,
+		Until:        until,
+		Actor:        query.Get("actor"),
+		ResourceType: types.ConfigType(query.Get("resourceType")),
+		ResourceID:   query.Get("resourceId"),
+	}
+
+	// start is the id of the audit entry after which the list starts
+	start := query.Get("start")
+
+	var entries []*types.AuditEntry
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		// fetch one more entry to know if there's a next page
+		entries, err = h.readDB.GetAuditEntries(tx, filter, start, limit+1, asc)
+		return err
+	})
+	if err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+
+	if len(entries) > limit {
+		entries = entries[:limit]
+
+		q := r.URL.Query()
+		q.Set("start", entries[len(entries)-1].ID)
+		q.Set("limit", strconv.Itoa(limit))
+		next := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.String()))
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, entries); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
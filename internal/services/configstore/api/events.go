@@ -0,0 +1,136 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	slog "agola.io/agola/internal/log"
+	"agola.io/agola/internal/services/configstore/readdb"
+	"agola.io/agola/internal/util"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+	"agola.io/agola/services/configstore/types"
+
+	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
+)
+
+// eventsKeepAliveInterval is the interval between the keep alive comments sent
+// on an idle events stream. They keep the connection open through the proxies
+// and detect the disconnected clients.
+const eventsKeepAliveInterval = 30 * time.Second
+
+// eventTypes are the resource types whose changes are streamed
+var eventTypes = map[types.ConfigType]struct{}{
+	types.ConfigTypeUser:         {},
+	types.ConfigTypeOrg:          {},
+	types.ConfigTypeOrgMember:    {},
+	types.ConfigTypeProjectGroup: {},
+	types.ConfigTypeProject:      {},
+	types.ConfigTypeRemoteSource: {},
+	types.ConfigTypeSecret:       {},
+	types.ConfigTypeVariable:     {},
+}
+
+// EventsHandler streams the resource changes as server-sent events. The
+// streamed resource types can be filtered with the type query parameter.
+type EventsHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+}
+
+func NewEventsHandler(logger *zap.Logger, readDB *readdb.ReadDB) *EventsHandler {
+	return &EventsHandler{log: logger.Sugar(), readDB: readDB}
+}
+
+func (h *EventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// the types can be provided as multiple or comma separated values
+	var configTypes []types.ConfigType
+	for _, v := range r.URL.Query()["type"] {
+		for _, t := range strings.Split(v, ",") {
+			configType := types.ConfigType(strings.TrimSpace(t))
+			if _, ok := eventTypes[configType]; !ok {
+				httpError(w, r, util.NewErrBadRequest(errors.Errorf("wrong type %q", t)))
+				return
+			}
+			configTypes = append(configTypes, configType)
+		}
+	}
+	if len(configTypes) == 0 {
+		for configType := range eventTypes {
+			configTypes = append(configTypes, configType)
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, r, errors.Errorf("streaming not supported"))
+		return
+	}
+
+	// subscribe before sending the response header so a client receiving it
+	// won't miss the next changes
+	changes, cancel := h.readDB.Subscribe(configTypes)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case change, ok := <-changes:
+			if !ok {
+				// the subscription has been closed, the client should
+				// reconnect and refetch the resources since it could have
+				// missed some changes
+				return
+			}
+			action := csapitypes.ChangeEventActionPut
+			if change.Deleted {
+				action = csapitypes.ChangeEventActionDelete
+			}
+			data, err := json.Marshal(&csapitypes.ChangeNotification{
+				Type:       change.Type,
+				Action:     action,
+				ResourceID: change.ID,
+			})
+			if err != nil {
+				slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", csapitypes.ChangeEventName, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"agola.io/agola/internal/util"
+
+	errors "golang.org/x/xerrors"
+)
+
+// FieldsParam is the query parameter of the GET requests with the comma
+// separated json names of the response fields to return
+const FieldsParam = "fields"
+
+// selectFields returns the response res restricted to the fields requested
+// with the fields query parameter. When res is a list the fields of every
+// item are selected.
+// The requested fields are checked against the fields of the response type so
+// also a field omitted since empty is accepted.
+func selectFields(r *http.Request, res interface{}) (interface{}, error) {
+	if r.Method != "GET" {
+		return res, nil
+	}
+	fieldsv := r.URL.Query().Get(FieldsParam)
+	if fieldsv == "" {
+		return res, nil
+	}
+
+	t := reflect.TypeOf(res)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	isList := t.Kind() == reflect.Slice || t.Kind() == reflect.Array
+	if isList {
+		t = t.Elem()
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, util.NewErrBadRequest(errors.Errorf("the response doesn't support the %s parameter", FieldsParam))
+	}
+
+	structFields := jsonFields(t)
+	fields := map[string]struct{}{}
+	invalidFields := []string{}
+	for _, field := range strings.Split(fieldsv, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if _, ok := structFields[field]; !ok {
+			invalidFields = append(invalidFields, field)
+			continue
+		}
+		fields[field] = struct{}{}
+	}
+	if len(invalidFields) > 0 {
+		err := errors.Errorf("invalid fields: %s", strings.Join(invalidFields, ", "))
+		return nil, util.NewErrBadRequest(util.NewAPIError(util.ErrorCodeBadRequest, err, invalidFields...))
+	}
+
+	resj, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := func(obj map[string]json.RawMessage) {
+		for k := range obj {
+			if _, ok := fields[k]; !ok {
+				delete(obj, k)
+			}
+		}
+	}
+
+	if isList {
+		var items []map[string]json.RawMessage
+		if err := json.Unmarshal(resj, &items); err != nil {
+			return nil, errors.Errorf("failed to unmarshal response: %w", err)
+		}
+		for _, item := range items {
+			filter(item)
+		}
+		return items, nil
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(resj, &obj); err != nil {
+		return nil, errors.Errorf("failed to unmarshal response: %w", err)
+	}
+	filter(obj)
+	return obj, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"agola.io/agola/internal/datamanager"
+	"agola.io/agola/internal/etcd"
+	slog "agola.io/agola/internal/log"
+	"agola.io/agola/internal/services/configstore/action"
+	"agola.io/agola/internal/services/configstore/common"
+	"agola.io/agola/internal/services/configstore/readdb"
+
+	"go.uber.org/zap"
+)
+
+const (
+	etcdReadyTimeout = 2 * time.Second
+)
+
+type HealthResponse struct {
+	// ReadOnly reports if the writes are rejected by the read only mode
+	ReadOnly bool `json:"read_only"`
+	// Degraded contains the subsystems temporarily not working (i.e. during an
+	// etcd leader election) and the related reason
+	Degraded map[string]string `json:"degraded,omitempty"`
+}
+
+type HealthHandler struct {
+	log    *zap.SugaredLogger
+	ah     *action.ActionHandler
+	dm     *datamanager.DataManager
+	readDB *readdb.ReadDB
+}
+
+func NewHealthHandler(logger *zap.Logger, ah *action.ActionHandler, dm *datamanager.DataManager, readDB *readdb.ReadDB) *HealthHandler {
+	return &HealthHandler{log: logger.Sugar(), ah: ah, dm: dm, readDB: readDB}
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res := &HealthResponse{ReadOnly: h.ah.IsReadOnly()}
+	degraded := map[string]string{}
+	if err := h.dm.EtcdDegraded(); err != nil {
+		degraded["etcd"] = err.Error()
+	}
+	if err := h.readDB.Degraded(); err != nil {
+		degraded["readdb"] = err.Error()
+	}
+	if len(degraded) > 0 {
+		res.Degraded = degraded
+	}
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type ReadyResponse struct {
+	Ready bool `json:"ready"`
+	// NotReady contains the not ready subsystems and the related reason
+	NotReady map[string]string `json:"not_ready,omitempty"`
+}
+
+type ReadyHandler struct {
+	log    *zap.SugaredLogger
+	dm     *datamanager.DataManager
+	readDB *readdb.ReadDB
+	e      *etcd.Store
+}
+
+func NewReadyHandler(logger *zap.Logger, dm *datamanager.DataManager, readDB *readdb.ReadDB, e *etcd.Store) *ReadyHandler {
+	return &ReadyHandler{log: logger.Sugar(), dm: dm, readDB: readDB, e: e}
+}
+
+func (h *ReadyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), etcdReadyTimeout)
+	defer cancel()
+
+	notReady := map[string]string{}
+
+	if _, err := h.e.Get(ctx, common.EtcdMaintenanceKey, 0); err != nil && err != etcd.ErrKeyNotFound {
+		notReady["etcd"] = err.Error()
+	}
+	if !h.dm.IsReady() {
+		notReady["datamanager"] = "wal changes not synced"
+	}
+	if !h.readDB.IsInitialized() {
+		notReady["readdb"] = "readdb not synced"
+	}
+
+	res := &ReadyResponse{Ready: true}
+	status := http.StatusOK
+	if len(notReady) > 0 {
+		res = &ReadyResponse{Ready: false, NotReady: notReady}
+		status = http.StatusServiceUnavailable
+	}
+
+	if err := httpResponse(w, r, status, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	slog "agola.io/agola/internal/log"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logLevels are the log levels that can be set at runtime
+var logLevels = map[string]zapcore.Level{
+	"debug": zapcore.DebugLevel,
+	"info":  zapcore.InfoLevel,
+	"warn":  zapcore.WarnLevel,
+	"error": zapcore.ErrorLevel,
+}
+
+type LogLevelHandler struct {
+	log   *zap.SugaredLogger
+	level zap.AtomicLevel
+}
+
+func NewLogLevelHandler(logger *zap.Logger, level zap.AtomicLevel) *LogLevelHandler {
+	return &LogLevelHandler{log: logger.Sugar(), level: level}
+}
+
+func (h *LogLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res := &csapitypes.LogLevel{Level: h.level.Level().String()}
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// SetLogLevelHandler changes the log level without restarting the
+// configstore
+type SetLogLevelHandler struct {
+	log   *zap.SugaredLogger
+	level zap.AtomicLevel
+}
+
+func NewSetLogLevelHandler(logger *zap.Logger, level zap.AtomicLevel) *SetLogLevelHandler {
+	return &SetLogLevelHandler{log: logger.Sugar(), level: level}
+}
+
+func (h *SetLogLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req csapitypes.LogLevel
+	if err := decodeRequest(r, &req, func(v *requestValidator) {
+		if _, ok := logLevels[req.Level]; !ok {
+			v.invalid("level", "wrong log level %q", req.Level)
+		}
+	}); err != nil {
+		httpError(w, r, err)
+		return
+	}
+
+	level := logLevels[req.Level]
+	oldLevel := h.level.Level()
+	h.level.SetLevel(level)
+	slog.WithContext(ctx, h.log).Infof("log level changed from %q to %q", oldLevel, level)
+
+	res := &csapitypes.LogLevel{Level: level.String()}
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
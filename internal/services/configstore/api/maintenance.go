@@ -18,6 +18,7 @@ import (
 	"net/http"
 
 	"agola.io/agola/internal/etcd"
+	slog "agola.io/agola/internal/log"
 	"agola.io/agola/internal/services/configstore/action"
 
 	"go.uber.org/zap"
@@ -46,17 +47,44 @@ func (h *MaintenanceModeHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 
 	err := h.ah.MaintenanceMode(ctx, enable)
 	if err != nil {
-		h.log.Errorf("err: %+v", err)
-		httpError(w, err)
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, nil); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 
 }
 
+// ReadOnlyModeHandler enables (PUT) or disables (DELETE) the read only mode.
+// When enabling it answers after the writes in progress have completed.
+type ReadOnlyModeHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewReadOnlyModeHandler(logger *zap.Logger, ah *action.ActionHandler) *ReadOnlyModeHandler {
+	return &ReadOnlyModeHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *ReadOnlyModeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	enable := r.Method == "PUT"
+	if err := h.ah.SetReadOnly(ctx, enable); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+	slog.WithContext(ctx, h.log).Infof("read only mode enabled: %t", enable)
+
+	if err := httpResponse(w, r, http.StatusOK, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
 type ExportHandler struct {
 	log *zap.SugaredLogger
 	ah  *action.ActionHandler
@@ -71,7 +99,7 @@ func (h *ExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	err := h.ah.Export(ctx, w)
 	if err != nil {
-		h.log.Errorf("err: %+v", err)
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		// since we already answered with a 200 we cannot return another error code
 		// So abort the connection and the client will detect the missing ending chunk
 		// and consider this an error
@@ -95,13 +123,87 @@ func (h *ImportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	err := h.ah.Import(ctx, r.Body)
 	if err != nil {
-		h.log.Errorf("err: %+v", err)
-		httpError(w, err)
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, nil); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 
 }
+
+// ExportResourcesHandler streams a newline delimited json export of the
+// configstore resources
+type ExportResourcesHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewExportResourcesHandler(logger *zap.Logger, ah *action.ActionHandler) *ExportResourcesHandler {
+	return &ExportResourcesHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *ExportResourcesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	err := h.ah.ExportResources(ctx, w)
+	if err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		// the response could have already been partially written, so abort the
+		// connection and the client will detect the missing ending chunk
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// ImportResourcesHandler imports in an empty configstore the resources
+// exported by the ExportResourcesHandler
+type ImportResourcesHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewImportResourcesHandler(logger *zap.Logger, ah *action.ActionHandler) *ImportResourcesHandler {
+	return &ImportResourcesHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *ImportResourcesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	err := h.ah.ImportResources(ctx, r.Body)
+	if err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type CheckpointHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewCheckpointHandler(logger *zap.Logger, ah *action.ActionHandler) *CheckpointHandler {
+	return &CheckpointHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *CheckpointHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	err := h.ah.Checkpoint(ctx)
+	if err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
@@ -15,11 +15,11 @@
 package api
 
 import (
-	"encoding/json"
 	"net/http"
 	"strconv"
 
 	"agola.io/agola/internal/db"
+	slog "agola.io/agola/internal/log"
 	"agola.io/agola/internal/services/configstore/action"
 	"agola.io/agola/internal/services/configstore/readdb"
 	"agola.io/agola/internal/util"
@@ -52,18 +52,18 @@ func (h *OrgHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return err
 	})
 	if err != nil {
-		h.log.Errorf("err: %+v", err)
-		httpError(w, err)
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
 		return
 	}
 
 	if org == nil {
-		httpError(w, util.NewErrNotExist(errors.Errorf("org %q doesn't exist", orgRef)))
+		httpError(w, r, util.NewErrNotExist(errors.Errorf("org %q doesn't exist", orgRef)))
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, org); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, org); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -80,20 +80,26 @@ func (h *CreateOrgHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	var req types.Organization
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&req); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &req, func(v *requestValidator) {
+		if req.Name == "" {
+			v.required("name")
+		}
+		if !types.IsValidVisibility(req.Visibility) {
+			v.invalid("visibility", "invalid visibility %q", req.Visibility)
+		}
+	}); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
 	org, err := h.ah.CreateOrg(ctx, &req)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, org); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusCreated, org); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -113,12 +119,12 @@ func (h *DeleteOrgHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	orgRef := vars["orgref"]
 
 	err := h.ah.DeleteOrg(ctx, orgRef)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
-	if err := httpResponse(w, http.StatusNoContent, nil); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusNoContent, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -146,12 +152,12 @@ func (h *OrgsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		var err error
 		limit, err = strconv.Atoi(limitS)
 		if err != nil {
-			httpError(w, util.NewErrBadRequest(errors.Errorf("cannot parse limit: %w", err)))
+			httpError(w, r, util.NewErrBadRequest(errors.Errorf("cannot parse limit: %w", err)))
 			return
 		}
 	}
 	if limit < 0 {
-		httpError(w, util.NewErrBadRequest(errors.Errorf("limit must be greater or equal than 0")))
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("limit must be greater or equal than 0")))
 		return
 	}
 	if limit > MaxOrgsLimit {
@@ -171,13 +177,13 @@ func (h *OrgsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return err
 	})
 	if err != nil {
-		h.log.Errorf("err: %+v", err)
-		httpError(w, err)
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, orgs); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, orgs); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -198,20 +204,23 @@ func (h *AddOrgMemberHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	userRef := vars["userref"]
 
 	var req csapitypes.AddOrgMemberRequest
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&req); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &req, func(v *requestValidator) {
+		if !types.IsValidMemberRole(req.Role) {
+			v.invalid("Role", "invalid role %q", req.Role)
+		}
+	}); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
 	org, err := h.ah.AddOrgMember(ctx, orgRef, userRef, req.Role)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, org); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusCreated, org); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -232,13 +241,13 @@ func (h *RemoveOrgMemberHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	userRef := vars["userref"]
 
 	err := h.ah.RemoveOrgMember(ctx, orgRef, userRef)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusNoContent, nil); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusNoContent, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -264,8 +273,8 @@ func (h *OrgMembersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	orgRef := vars["orgref"]
 
 	orgUsers, err := h.ah.GetOrgMembers(ctx, orgRef)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
@@ -274,7 +283,7 @@ func (h *OrgMembersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		res[i] = orgMemberResponse(orgUser)
 	}
 
-	if err := httpResponse(w, http.StatusOK, res); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
@@ -16,12 +16,18 @@ package api
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"agola.io/agola/internal/db"
+	slog "agola.io/agola/internal/log"
+	"agola.io/agola/internal/services/config"
 	"agola.io/agola/internal/services/configstore/action"
 	"agola.io/agola/internal/services/configstore/readdb"
 	"agola.io/agola/internal/util"
@@ -30,6 +36,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
 )
 
 func projectResponse(ctx context.Context, readDB *readdb.ReadDB, project *types.Project) (*csapitypes.Project, error) {
@@ -45,6 +52,18 @@ func projectsResponse(ctx context.Context, readDB *readdb.ReadDB, projects []*ty
 
 	err := readDB.Do(ctx, func(tx *db.Tx) error {
 		for i, project := range projects {
+			if project.DeletionTime != nil {
+				// the parent of a soft deleted project could have been removed
+				group, err := readDB.GetProjectGroup(tx, project.Parent.ID)
+				if err != nil {
+					return err
+				}
+				if group == nil {
+					resProjects[i] = &csapitypes.Project{Project: project}
+					continue
+				}
+			}
+
 			pp, err := readDB.GetPath(tx, project.Parent.Type, project.Parent.ID)
 			if err != nil {
 				return err
@@ -126,24 +145,49 @@ func (h *ProjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectRef, err := url.PathUnescape(vars["projectref"])
 	if err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+		httpError(w, r, util.NewErrBadRequest(err))
+		return
+	}
+
+	var project *types.Project
+	var revision string
+	var modTime time.Time
+	// get the project, its revision and modification time in the same transaction
+	err = h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		project, err = h.readDB.GetProject(tx, projectRef)
+		if err != nil {
+			return err
+		}
+		if project == nil {
+			return util.NewErrNotExist(errors.Errorf("project %q doesn't exist", projectRef))
+		}
+		revision, err = h.readDB.GetProjectRevision(tx, project.ID)
+		if err != nil {
+			return err
+		}
+		modTime, err = h.readDB.GetProjectModTime(tx, project)
+		return err
+	})
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	project, err := h.ah.GetProject(ctx, projectRef)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	setETag(w, revision)
+	if checkLastModified(w, r, modTime) {
+		notModified(w)
 		return
 	}
 
 	resProject, err := projectResponse(ctx, h.readDB, project)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, resProject); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, resProject); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -160,27 +204,42 @@ func NewCreateProjectHandler(logger *zap.Logger, ah *action.ActionHandler, readD
 func (h *CreateProjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	dryRun, err := dryRunParam(r)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
 	var req types.Project
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&req); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &req, func(v *requestValidator) { validateProjectRequest(v, &req) }); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if err := checkParentAccess(ctx, h.readDB, req.Parent); httpError(w, r, err) {
 		return
 	}
 
-	project, err := h.ah.CreateProject(ctx, &req)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	createProject := h.ah.CreateProject
+	status := http.StatusCreated
+	if dryRun {
+		createProject = h.ah.CreateProjectDryRun
+		status = http.StatusOK
+	}
+
+	project, err := createProject(ctx, &req)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	resProject, err := projectResponse(ctx, h.readDB, project)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, resProject); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, status, resProject); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -200,38 +259,171 @@ func (h *UpdateProjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	vars := mux.Vars(r)
 	projectRef, err := url.PathUnescape(vars["projectref"])
 	if err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+		httpError(w, r, util.NewErrBadRequest(err))
+		return
+	}
+
+	revision, err := ifMatchRevision(r)
+	if httpError(w, r, err) {
 		return
 	}
 
 	var project *types.Project
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&project); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &project, func(v *requestValidator) { validateProjectRequest(v, project) }); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if err := checkParentAccess(ctx, h.readDB, project.Parent); httpError(w, r, err) {
 		return
 	}
 
 	areq := &action.UpdateProjectRequest{
-		ProjectRef: projectRef,
-		Project:    project,
+		ProjectRef:       projectRef,
+		Project:          project,
+		ExpectedRevision: revision,
 	}
 	project, err = h.ah.UpdateProject(ctx, areq)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	resProject, err := projectResponse(ctx, h.readDB, project)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	if err := httpResponse(w, r, http.StatusCreated, resProject); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type PatchProjectHandler struct {
+	log    *zap.SugaredLogger
+	ah     *action.ActionHandler
+	readDB *readdb.ReadDB
+}
+
+func NewPatchProjectHandler(logger *zap.Logger, ah *action.ActionHandler, readDB *readdb.ReadDB) *PatchProjectHandler {
+	return &PatchProjectHandler{log: logger.Sugar(), ah: ah, readDB: readDB}
+}
+
+func (h *PatchProjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	projectRef, err := url.PathUnescape(vars["projectref"])
+	if err != nil {
+		httpError(w, r, util.NewErrBadRequest(err))
+		return
+	}
+
+	revision, err := ifMatchRevision(r)
+	if httpError(w, r, err) {
+		return
+	}
+
+	var req *csapitypes.PatchProjectRequest
+	if err := decodeRequest(r, &req, nil); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if req.ParentRef != nil {
+		if err := checkParentAccess(ctx, h.readDB, types.Parent{Type: types.ConfigTypeProjectGroup, ID: *req.ParentRef}); httpError(w, r, err) {
+			return
+		}
+	}
+
+	areq := &action.PatchProjectRequest{
+		ProjectRef:       projectRef,
+		Name:             req.Name,
+		ParentRef:        req.ParentRef,
+		Visibility:       req.Visibility,
+		ConfigPath:       req.ConfigPath,
+		DefaultBranch:    req.DefaultBranch,
+		ExpectedRevision: revision,
+	}
+	project, err := h.ah.PatchProject(ctx, areq)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	resProject, err := projectResponse(ctx, h.readDB, project)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, resProject); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type MoveProjectHandler struct {
+	log    *zap.SugaredLogger
+	ah     *action.ActionHandler
+	readDB *readdb.ReadDB
+}
+
+func NewMoveProjectHandler(logger *zap.Logger, ah *action.ActionHandler, readDB *readdb.ReadDB) *MoveProjectHandler {
+	return &MoveProjectHandler{log: logger.Sugar(), ah: ah, readDB: readDB}
+}
+
+func (h *MoveProjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	projectID := vars["projectid"]
+
+	revision, err := ifMatchRevision(r)
+	if httpError(w, r, err) {
+		return
+	}
+
+	var req *csapitypes.MoveProjectRequest
+	if err := decodeRequest(r, &req, func(v *requestValidator) {
+		if req.ParentRef == "" {
+			v.required("parent_ref")
+		}
+	}); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if err := checkParentAccess(ctx, h.readDB, types.Parent{Type: types.ConfigTypeProjectGroup, ID: req.ParentRef}); httpError(w, r, err) {
+		return
+	}
+
+	areq := &action.MoveProjectRequest{
+		ProjectID:        projectID,
+		ParentRef:        req.ParentRef,
+		ExpectedRevision: revision,
+	}
+	project, err := h.ah.MoveProject(ctx, areq)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	resProject, err := projectResponse(ctx, h.readDB, project)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, resProject); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, resProject); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
+// isProjectNotExist reports if err is caused by the deleted project not
+// existing. Other errors, also the ones with the same status code, aren't
+// matched.
+func isProjectNotExist(err error) bool {
+	return err != nil && util.APIErrorFromError(err).Code == action.ErrorCodeProjectNotExist
+}
+
 type DeleteProjectHandler struct {
 	log *zap.SugaredLogger
 	ah  *action.ActionHandler
@@ -247,20 +439,606 @@ func (h *DeleteProjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	vars := mux.Vars(r)
 	projectRef, err := url.PathUnescape(vars["projectref"])
 	if err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+		httpError(w, r, util.NewErrBadRequest(err))
+		return
+	}
+
+	revision, err := ifMatchRevision(r)
+	if httpError(w, r, err) {
+		return
+	}
+	ignoreMissing, err := ignoreMissingParam(r)
+	if httpError(w, r, err) {
+		return
+	}
+
+	err = h.ah.DeleteProject(ctx, projectRef, revision)
+	if ignoreMissing && isProjectNotExist(err) {
+		// the project was already deleted (i.e. by a retried request)
+		err = nil
+	}
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+	if err := httpResponse(w, r, http.StatusNoContent, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// DeleteProjectsHandler deletes all the projects matching the request filters.
+// Since it could delete many projects it requires the confirm query parameter
+// set to true.
+type DeleteProjectsHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewDeleteProjectsHandler(logger *zap.Logger, ah *action.ActionHandler) *DeleteProjectsHandler {
+	return &DeleteProjectsHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *DeleteProjectsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	confirm, err := boolParam(r, "confirm")
+	if httpError(w, r, err) {
+		return
+	}
+	if !confirm {
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("the confirm query parameter must be true to delete the projects")))
+		return
+	}
+
+	var req csapitypes.DeleteProjectsRequest
+	if err := decodeRequest(r, &req, func(v *requestValidator) {
+		if req.NamePrefix == "" && req.OwnerID == "" {
+			v.required("name_prefix or owner_id")
+		}
+		if req.OwnerID != "" {
+			switch req.OwnerType {
+			case types.ConfigTypeUser, types.ConfigTypeOrg:
+			default:
+				v.invalid("owner_type", "invalid owner type %q", req.OwnerType)
+			}
+		} else if req.OwnerType != "" {
+			v.required("owner_id")
+		}
+	}); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
-	err = h.ah.DeleteProject(ctx, projectRef)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	projectIDs, err := h.ah.DeleteProjects(ctx, &action.DeleteProjectsRequest{
+		NamePrefix: req.NamePrefix,
+		OwnerType:  req.OwnerType,
+		OwnerID:    req.OwnerID,
+	})
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
 	}
-	if err := httpResponse(w, http.StatusNoContent, nil); err != nil {
-		h.log.Errorf("err: %+v", err)
+
+	res := &csapitypes.DeleteProjectsResponse{DeletedProjectIDs: projectIDs}
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type DeleteProjectByIDHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewDeleteProjectByIDHandler(logger *zap.Logger, ah *action.ActionHandler) *DeleteProjectByIDHandler {
+	return &DeleteProjectByIDHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *DeleteProjectByIDHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	projectID := vars["projectid"]
+
+	revision, err := ifMatchRevision(r)
+	if httpError(w, r, err) {
+		return
+	}
+	ignoreMissing, err := ignoreMissingParam(r)
+	if httpError(w, r, err) {
+		return
+	}
+
+	err = h.ah.DeleteProjectByID(ctx, projectID, revision)
+	if ignoreMissing && isProjectNotExist(err) {
+		// the project was already deleted (i.e. by a retried request)
+		err = nil
+	}
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+	if err := httpResponse(w, r, http.StatusNoContent, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type RestoreProjectHandler struct {
+	log    *zap.SugaredLogger
+	ah     *action.ActionHandler
+	readDB *readdb.ReadDB
+}
+
+func NewRestoreProjectHandler(logger *zap.Logger, ah *action.ActionHandler, readDB *readdb.ReadDB) *RestoreProjectHandler {
+	return &RestoreProjectHandler{log: logger.Sugar(), ah: ah, readDB: readDB}
+}
+
+func (h *RestoreProjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	projectID := vars["projectid"]
+
+	project, err := h.ah.RestoreProject(ctx, projectID)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	resProject, err := projectResponse(ctx, h.readDB, project)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, resProject); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
 const (
 	DefaultProjectsLimit = 10
-	MaxProjectsLimit     = 20
+	MaxProjectsLimit     = config.MaxProjectsLimit
 )
+
+// projectsPage is the page of a projects list requested with the limit, asc
+// and start query parameters
+type projectsPage struct {
+	limit     int
+	asc       bool
+	startName string
+	startID   string
+}
+
+func parseProjectsPage(r *http.Request, defaultLimit int) (*projectsPage, error) {
+	query := r.URL.Query()
+
+	page := &projectsPage{limit: defaultLimit}
+	if limitS := query.Get("limit"); limitS != "" {
+		var err error
+		page.limit, err = strconv.Atoi(limitS)
+		if err != nil {
+			return nil, util.NewErrBadRequest(errors.Errorf("cannot parse limit: %w", err))
+		}
+	}
+	if page.limit < 0 {
+		return nil, util.NewErrBadRequest(errors.Errorf("limit must be greater or equal than 0"))
+	}
+	if page.limit == 0 || page.limit > MaxProjectsLimit {
+		page.limit = MaxProjectsLimit
+	}
+	if _, ok := query["asc"]; ok {
+		page.asc = true
+	}
+
+	// start is the cursor returned in the next link of the previous page and
+	// has the format "projectname/projectid"
+	if start := query.Get("start"); start != "" {
+		parts := strings.SplitN(start, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, util.NewErrBadRequest(errors.Errorf("wrong start %q", start))
+		}
+		page.startName, page.startID = parts[0], parts[1]
+	}
+
+	return page, nil
+}
+
+// setNextLink sets the link header to the page starting after the last
+// project. q are the additional query parameters of the next page request.
+func (p *projectsPage) setNextLink(w http.ResponseWriter, r *http.Request, last *types.Project, q url.Values) {
+	q.Set("start", last.Name+"/"+last.ID)
+	q.Set("limit", strconv.Itoa(p.limit))
+	if p.asc {
+		q.Set("asc", "")
+	}
+	next := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.String()))
+}
+
+type ProjectsHandler struct {
+	log          *zap.SugaredLogger
+	readDB       *readdb.ReadDB
+	defaultLimit int
+}
+
+func NewProjectsHandler(logger *zap.Logger, readDB *readdb.ReadDB, defaultLimit int) *ProjectsHandler {
+	if defaultLimit <= 0 {
+		defaultLimit = DefaultProjectsLimit
+	}
+	return &ProjectsHandler{log: logger.Sugar(), readDB: readDB, defaultLimit: defaultLimit}
+}
+
+func (h *ProjectsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	if projectPath, ok := query["path"]; ok {
+		h.projectByPath(w, r, projectPath[0])
+		return
+	}
+
+	page, err := parseProjectsPage(r, h.defaultLimit)
+	if httpError(w, r, err) {
+		return
+	}
+
+	includeDeleted, err := includeDeletedParam(r)
+	if httpError(w, r, err) {
+		return
+	}
+
+	labelSelectors, err := labelSelectorsParam(r)
+	if httpError(w, r, err) {
+		return
+	}
+
+	var projects []*types.Project
+	err = h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		// fetch one more project to know if there's a next page
+		projects, err = h.readDB.GetProjects(tx, page.startName, page.startID, page.limit+1, page.asc, includeDeleted, labelSelectors)
+		return err
+	})
+	if err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+
+	hasMore := len(projects) > page.limit
+	if hasMore {
+		projects = projects[:page.limit]
+	}
+
+	resProjects, err := projectsResponse(ctx, h.readDB, projects)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	if hasMore {
+		q := url.Values{}
+		if includeDeleted {
+			q.Set("includeDeleted", "true")
+		}
+		if labels, ok := query["label"]; ok {
+			q["label"] = labels
+		}
+		page.setNextLink(w, r, projects[len(projects)-1], q)
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, resProjects); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// labelSelectorsParam parses the label query parameters. Every parameter is a
+// label selector in the form "key", matching the projects with the label, or
+// "key=value", matching the projects with the label value
+func labelSelectorsParam(r *http.Request) ([]*readdb.LabelSelector, error) {
+	labelSelectors := []*readdb.LabelSelector{}
+	for _, label := range r.URL.Query()["label"] {
+		parts := strings.SplitN(label, "=", 2)
+		if !util.ValidateLabelKey(parts[0]) {
+			return nil, util.NewErrBadRequest(errors.Errorf("wrong label selector %q: invalid label key %q", label, parts[0]))
+		}
+		ls := &readdb.LabelSelector{Key: parts[0]}
+		if len(parts) == 2 {
+			if !util.ValidateLabelValue(parts[1]) {
+				return nil, util.NewErrBadRequest(errors.Errorf("wrong label selector %q: invalid label value %q", label, parts[1]))
+			}
+			ls.Value = &parts[1]
+		}
+		labelSelectors = append(labelSelectors, ls)
+	}
+	return labelSelectors, nil
+}
+
+// OwnerProjectsHandler lists the projects of a user or an org, in all their
+// project groups
+type OwnerProjectsHandler struct {
+	log          *zap.SugaredLogger
+	readDB       *readdb.ReadDB
+	ownerType    types.ConfigType
+	defaultLimit int
+}
+
+func NewOwnerProjectsHandler(logger *zap.Logger, readDB *readdb.ReadDB, ownerType types.ConfigType, defaultLimit int) *OwnerProjectsHandler {
+	if defaultLimit <= 0 {
+		defaultLimit = DefaultProjectsLimit
+	}
+	return &OwnerProjectsHandler{log: logger.Sugar(), readDB: readDB, ownerType: ownerType, defaultLimit: defaultLimit}
+}
+
+func (h *OwnerProjectsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+
+	page, err := parseProjectsPage(r, h.defaultLimit)
+	if httpError(w, r, err) {
+		return
+	}
+
+	var projects []*types.Project
+	err = h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var ownerID string
+		switch h.ownerType {
+		case types.ConfigTypeUser:
+			userRef := vars["userref"]
+			user, err := h.readDB.GetUser(tx, userRef)
+			if err != nil {
+				return err
+			}
+			if user == nil {
+				return util.NewErrNotExist(errors.Errorf("user %q doesn't exist", userRef))
+			}
+			ownerID = user.ID
+		case types.ConfigTypeOrg:
+			orgRef := vars["orgref"]
+			org, err := h.readDB.GetOrg(tx, orgRef)
+			if err != nil {
+				return err
+			}
+			if org == nil {
+				return util.NewErrNotExist(errors.Errorf("org %q doesn't exist", orgRef))
+			}
+			ownerID = org.ID
+		}
+
+		var err error
+		// fetch one more project to know if there's a next page
+		projects, err = h.readDB.GetOwnerProjects(tx, ownerID, page.startName, page.startID, page.limit+1, page.asc)
+		return err
+	})
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	hasMore := len(projects) > page.limit
+	if hasMore {
+		projects = projects[:page.limit]
+	}
+
+	resProjects, err := projectsResponse(ctx, h.readDB, projects)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	if hasMore {
+		page.setNextLink(w, r, projects[len(projects)-1], url.Values{})
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, resProjects); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// projectByPath returns the project with the provided path and its ancestry.
+// The path segments are separated by a slash, a segment containing a slash
+// must be escaped (i.e. with url.PathEscape).
+func (h *ProjectsHandler) projectByPath(w http.ResponseWriter, r *http.Request, projectPath string) {
+	ctx := r.Context()
+
+	parts := strings.Split(projectPath, "/")
+	segments := make([]string, len(parts))
+	for i, part := range parts {
+		segment, err := url.PathUnescape(part)
+		if err != nil {
+			httpError(w, r, util.NewErrBadRequest(errors.Errorf("wrong project path %q segment %d: %w", projectPath, i, err)))
+			return
+		}
+		if segment == "" {
+			httpError(w, r, util.NewErrBadRequest(errors.Errorf("wrong project path %q: segment %d is empty", projectPath, i)))
+			return
+		}
+		segments[i] = segment
+	}
+	if len(segments) < 3 || (segments[0] != string(types.ConfigTypeUser) && segments[0] != string(types.ConfigTypeOrg)) {
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("wrong project path %q: must be in the form user|org/ownername/[projectgroup/...]projectname", projectPath)))
+		return
+	}
+
+	var res *readdb.ResolvedProjectPath
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		res, err = h.readDB.ResolveProjectPath(tx, segments)
+		return err
+	})
+	if err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+
+	if i := res.UnresolvedSegment; i >= 0 {
+		kind := "project group"
+		switch i {
+		case 1:
+			kind = segments[0]
+		case len(segments) - 1:
+			kind = "project"
+		}
+		detail := fmt.Sprintf("path[%d]: %s %q doesn't exist", i, kind, segments[i])
+		err := errors.Errorf("project path %q cannot be resolved: %s %q doesn't exist", projectPath, kind, segments[i])
+		httpError(w, r, util.NewErrNotExist(util.NewAPIError(util.ErrorCodeNotExist, err, detail)))
+		return
+	}
+
+	project, err := projectResponse(ctx, h.readDB, res.Project)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	ownerPath := path.Join(segments[0], res.OwnerName)
+	ancestry := []*csapitypes.ProjectAncestor{
+		{Type: res.OwnerType, ID: res.OwnerID, Name: res.OwnerName, Path: ownerPath},
+	}
+	groupPath := ownerPath
+	for _, projectGroup := range res.ProjectGroups {
+		groupPath = path.Join(groupPath, projectGroup.Name)
+		ancestry = append(ancestry, &csapitypes.ProjectAncestor{Type: types.ConfigTypeProjectGroup, ID: projectGroup.ID, Name: projectGroup.Name, Path: groupPath})
+	}
+
+	resp := &csapitypes.ProjectByPathResponse{Project: project, Ancestry: ancestry}
+	if err := httpResponse(w, r, http.StatusOK, resp); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// ProjectsCountHandler returns the number of projects listed by the
+// ProjectsHandler with the same filters
+type ProjectsCountHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+}
+
+func NewProjectsCountHandler(logger *zap.Logger, readDB *readdb.ReadDB) *ProjectsCountHandler {
+	return &ProjectsCountHandler{log: logger.Sugar(), readDB: readDB}
+}
+
+func (h *ProjectsCountHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	includeDeleted, err := includeDeletedParam(r)
+	if httpError(w, r, err) {
+		return
+	}
+
+	var count int
+	err = h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		count, err = h.readDB.CountProjects(tx, includeDeleted)
+		return err
+	})
+	if err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+
+	res := &csapitypes.CountResponse{Count: count}
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// ProjectAvailabilityHandler reports if a project with the provided path could
+// be created, checking that its parent project group exists and that the
+// project name isn't already used in it
+type ProjectAvailabilityHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+}
+
+func NewProjectAvailabilityHandler(logger *zap.Logger, readDB *readdb.ReadDB) *ProjectAvailabilityHandler {
+	return &ProjectAvailabilityHandler{log: logger.Sugar(), readDB: readDB}
+}
+
+func (h *ProjectAvailabilityHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	projectPath, err := url.PathUnescape(vars["projectpath"])
+	if err != nil {
+		httpError(w, r, util.NewErrBadRequest(err))
+		return
+	}
+
+	// the project path is made of the owner type, the owner name, the optional
+	// parent project groups and the project name
+	if len(strings.Split(projectPath, "/")) < 3 {
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("invalid project path %q", projectPath)))
+		return
+	}
+	parentPath, projectName := path.Dir(projectPath), path.Base(projectPath)
+	if !util.ValidateName(projectName) {
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("invalid project name %q", projectName)))
+		return
+	}
+
+	var available bool
+	err = h.readDB.Do(ctx, func(tx *db.Tx) error {
+		group, err := h.readDB.GetProjectGroupByPath(tx, parentPath)
+		if err != nil {
+			return err
+		}
+		if group == nil {
+			return util.NewErrBadRequest(errors.Errorf("project group %q doesn't exist", parentPath))
+		}
+		p, err := h.readDB.GetProjectByName(tx, group.ID, projectName)
+		available = p == nil
+		return err
+	})
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	res := &csapitypes.NameAvailabilityResponse{Available: available}
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// validateProjectRequest checks the project fields of the create and update
+// requests
+func validateProjectRequest(v *requestValidator, project *types.Project) {
+	if project.Name == "" {
+		v.required("name")
+	}
+	if project.Parent.ID == "" {
+		v.required("parent.id")
+	}
+	if project.Parent.Type != types.ConfigTypeProjectGroup {
+		v.invalid("parent.type", "invalid parent type %q", project.Parent.Type)
+	}
+	if !types.IsValidVisibility(project.Visibility) {
+		v.invalid("visibility", "invalid visibility %q", project.Visibility)
+	}
+	if !types.IsValidRemoteRepositoryConfigType(project.RemoteRepositoryConfigType) {
+		v.invalid("remote_repository_config_type", "invalid remote repository config type %q", project.RemoteRepositoryConfigType)
+	}
+	if project.ConfigPath != "" && !util.ValidateRelativePath(project.ConfigPath) {
+		v.invalid("config_path", "invalid config path %q, it must be a relative path inside the repository", project.ConfigPath)
+	}
+	if project.DefaultBranch != "" && !util.ValidateBranchName(project.DefaultBranch) {
+		v.invalid("default_branch", "invalid default branch %q", project.DefaultBranch)
+	}
+	keys := make([]string, 0, len(project.Labels))
+	for key := range project.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !util.ValidateLabelKey(key) {
+			v.invalid("labels", "invalid label key %q", key)
+			continue
+		}
+		if !util.ValidateLabelValue(project.Labels[key]) {
+			v.invalid(fieldPath("labels", key), "invalid label value %q", project.Labels[key])
+		}
+	}
+}
@@ -16,12 +16,12 @@ package api
 
 import (
 	"context"
-	"encoding/json"
 	"net/http"
 	"net/url"
 	"path"
 
 	"agola.io/agola/internal/db"
+	slog "agola.io/agola/internal/log"
 	"agola.io/agola/internal/services/configstore/action"
 	"agola.io/agola/internal/services/configstore/readdb"
 	"agola.io/agola/internal/util"
@@ -95,24 +95,24 @@ func (h *ProjectGroupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 	projectGroupRef, err := url.PathUnescape(vars["projectgroupref"])
 	if err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+		httpError(w, r, util.NewErrBadRequest(err))
 		return
 	}
 
 	projectGroup, err := h.ah.GetProjectGroup(ctx, projectGroupRef)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	resProjectGroup, err := projectGroupResponse(ctx, h.readDB, projectGroup)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, resProjectGroup); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, resProjectGroup); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -132,24 +132,24 @@ func (h *ProjectGroupProjectsHandler) ServeHTTP(w http.ResponseWriter, r *http.R
 
 	projectGroupRef, err := url.PathUnescape(vars["projectgroupref"])
 	if err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+		httpError(w, r, util.NewErrBadRequest(err))
 		return
 	}
 
 	projects, err := h.ah.GetProjectGroupProjects(ctx, projectGroupRef)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	resProjects, err := projectsResponse(ctx, h.readDB, projects)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, resProjects); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, resProjects); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -168,24 +168,24 @@ func (h *ProjectGroupSubgroupsHandler) ServeHTTP(w http.ResponseWriter, r *http.
 	vars := mux.Vars(r)
 	projectGroupRef, err := url.PathUnescape(vars["projectgroupref"])
 	if err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+		httpError(w, r, util.NewErrBadRequest(err))
 		return
 	}
 
 	projectGroups, err := h.ah.GetProjectGroupSubgroups(ctx, projectGroupRef)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	resProjectGroups, err := projectGroupsResponse(ctx, h.readDB, projectGroups)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, resProjectGroups); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, resProjectGroups); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -203,26 +203,28 @@ func (h *CreateProjectGroupHandler) ServeHTTP(w http.ResponseWriter, r *http.Req
 	ctx := r.Context()
 
 	var req types.ProjectGroup
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&req); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &req, func(v *requestValidator) { validateProjectGroupRequest(v, &req) }); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if err := checkParentAccess(ctx, h.readDB, req.Parent); httpError(w, r, err) {
 		return
 	}
 
 	projectGroup, err := h.ah.CreateProjectGroup(ctx, &req)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	resProjectGroup, err := projectGroupResponse(ctx, h.readDB, projectGroup)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, resProjectGroup); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusCreated, resProjectGroup); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -242,14 +244,16 @@ func (h *UpdateProjectGroupHandler) ServeHTTP(w http.ResponseWriter, r *http.Req
 	vars := mux.Vars(r)
 	projectGroupRef, err := url.PathUnescape(vars["projectgroupref"])
 	if err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+		httpError(w, r, util.NewErrBadRequest(err))
 		return
 	}
 
 	var projectGroup *types.ProjectGroup
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&projectGroup); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &projectGroup, func(v *requestValidator) { validateProjectGroupRequest(v, projectGroup) }); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if err := checkParentAccess(ctx, h.readDB, projectGroup.Parent); httpError(w, r, err) {
 		return
 	}
 
@@ -258,19 +262,19 @@ func (h *UpdateProjectGroupHandler) ServeHTTP(w http.ResponseWriter, r *http.Req
 		ProjectGroup:    projectGroup,
 	}
 	projectGroup, err = h.ah.UpdateProjectGroup(ctx, areq)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	resProjectGroup, err := projectGroupResponse(ctx, h.readDB, projectGroup)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, resProjectGroup); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusCreated, resProjectGroup); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -289,15 +293,38 @@ func (h *DeleteProjectGroupHandler) ServeHTTP(w http.ResponseWriter, r *http.Req
 	vars := mux.Vars(r)
 	projectGroupRef, err := url.PathUnescape(vars["projectgroupref"])
 	if err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+		httpError(w, r, util.NewErrBadRequest(err))
+		return
+	}
+
+	// when cascade is true also delete all the project group childs
+	cascade, err := cascadeParam(r)
+	if httpError(w, r, err) {
 		return
 	}
 
-	err = h.ah.DeleteProjectGroup(ctx, projectGroupRef)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	err = h.ah.DeleteProjectGroup(ctx, projectGroupRef, cascade)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+	if err := httpResponse(w, r, http.StatusNoContent, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// validateProjectGroupRequest checks the project group fields of the create
+// and update requests
+func validateProjectGroupRequest(v *requestValidator, projectGroup *types.ProjectGroup) {
+	if projectGroup.Parent.ID == "" {
+		v.required("parent.id")
+	}
+	switch projectGroup.Parent.Type {
+	case types.ConfigTypeProjectGroup, types.ConfigTypeOrg, types.ConfigTypeUser:
+	default:
+		v.invalid("parent.type", "invalid parent type %q", projectGroup.Parent.Type)
 	}
-	if err := httpResponse(w, http.StatusNoContent, nil); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if !types.IsValidVisibility(projectGroup.Visibility) {
+		v.invalid("visibility", "invalid visibility %q", projectGroup.Visibility)
 	}
 }
@@ -15,14 +15,17 @@
 package api
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 
 	"agola.io/agola/internal/db"
+	slog "agola.io/agola/internal/log"
 	"agola.io/agola/internal/services/configstore/action"
 	"agola.io/agola/internal/services/configstore/readdb"
 	"agola.io/agola/internal/util"
+	csapitypes "agola.io/agola/services/configstore/api/types"
 	"agola.io/agola/services/configstore/types"
 
 	"github.com/gorilla/mux"
@@ -51,18 +54,18 @@ func (h *RemoteSourceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		return err
 	})
 	if err != nil {
-		h.log.Errorf("err: %+v", err)
-		httpError(w, err)
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
 		return
 	}
 
 	if remoteSource == nil {
-		httpError(w, util.NewErrNotExist(errors.Errorf("remote source %q doesn't exist", rsRef)))
+		httpError(w, r, util.NewErrNotExist(errors.Errorf("remote source %q doesn't exist", rsRef)))
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, remoteSource); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, remoteSource); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -78,21 +81,34 @@ func NewCreateRemoteSourceHandler(logger *zap.Logger, ah *action.ActionHandler)
 func (h *CreateRemoteSourceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	// validate also checks that the remote source api url is reachable
+	validate, err := boolParam(r, "validate")
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+
 	var req types.RemoteSource
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&req); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &req, func(v *requestValidator) { validateRemoteSourceRequest(v, &req) }); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
+	if validate {
+		if err := h.ah.CheckRemoteSourceReachable(ctx, &req); err != nil {
+			httpError(w, r, err)
+			return
+		}
+	}
+
 	remoteSource, err := h.ah.CreateRemoteSource(ctx, &req)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, remoteSource); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusCreated, remoteSource); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -112,9 +128,8 @@ func (h *UpdateRemoteSourceHandler) ServeHTTP(w http.ResponseWriter, r *http.Req
 	rsRef := vars["remotesourceref"]
 
 	var remoteSource *types.RemoteSource
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&remoteSource); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &remoteSource, func(v *requestValidator) { validateRemoteSourceRequest(v, remoteSource) }); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
@@ -123,13 +138,105 @@ func (h *UpdateRemoteSourceHandler) ServeHTTP(w http.ResponseWriter, r *http.Req
 		RemoteSource:    remoteSource,
 	}
 	remoteSource, err := h.ah.UpdateRemoteSource(ctx, areq)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, remoteSource); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusCreated, remoteSource); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type PatchRemoteSourceHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewPatchRemoteSourceHandler(logger *zap.Logger, ah *action.ActionHandler) *PatchRemoteSourceHandler {
+	return &PatchRemoteSourceHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *PatchRemoteSourceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	rsRef := vars["remotesourceref"]
+
+	var req *csapitypes.PatchRemoteSourceRequest
+	if err := decodeRequest(r, &req, nil); err != nil {
+		httpError(w, r, err)
+		return
+	}
+
+	areq := &action.PatchRemoteSourceRequest{
+		RemoteSourceRef:         rsRef,
+		APIURL:                  req.APIURL,
+		SkipVerify:              req.SkipVerify,
+		Oauth2ClientID:          req.Oauth2ClientID,
+		Oauth2ClientSecret:      req.Oauth2ClientSecret,
+		SSHHostKey:              req.SSHHostKey,
+		SkipSSHHostKeyCheck:     req.SkipSSHHostKeyCheck,
+		RegistrationEnabled:     req.RegistrationEnabled,
+		LoginEnabled:            req.LoginEnabled,
+		GithubAppID:             req.GithubAppID,
+		GithubAppInstallationID: req.GithubAppInstallationID,
+		GithubAppPrivateKey:     req.GithubAppPrivateKey,
+		APIRateLimit:            req.APIRateLimit,
+		MaxConcurrency:          req.MaxConcurrency,
+	}
+	remoteSource, err := h.ah.PatchRemoteSource(ctx, areq)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, remoteSource); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type RotateRemoteSourceSecretHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewRotateRemoteSourceSecretHandler(logger *zap.Logger, ah *action.ActionHandler) *RotateRemoteSourceSecretHandler {
+	return &RotateRemoteSourceSecretHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *RotateRemoteSourceSecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	rsRef := vars["remotesourceref"]
+
+	var req csapitypes.RotateRemoteSourceSecretRequest
+	if err := decodeRequest(r, &req, func(v *requestValidator) {
+		if req.Oauth2ClientSecret == "" {
+			v.required("client_secret")
+		}
+		if req.Oauth2ClientID != nil && *req.Oauth2ClientID == "" {
+			v.invalid("client_id", "cannot be empty")
+		}
+	}); err != nil {
+		httpError(w, r, err)
+		return
+	}
+
+	areq := &action.RotateRemoteSourceSecretRequest{
+		RemoteSourceRef:    rsRef,
+		Oauth2ClientID:     req.Oauth2ClientID,
+		Oauth2ClientSecret: req.Oauth2ClientSecret,
+	}
+	remoteSource, err := h.ah.RotateRemoteSourceSecret(ctx, areq)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, remoteSource); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -149,11 +256,11 @@ func (h *DeleteRemoteSourceHandler) ServeHTTP(w http.ResponseWriter, r *http.Req
 	rsRef := vars["remotesourceref"]
 
 	err := h.ah.DeleteRemoteSource(ctx, rsRef)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
-	if err := httpResponse(w, http.StatusNoContent, nil); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusNoContent, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -181,12 +288,12 @@ func (h *RemoteSourcesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		var err error
 		limit, err = strconv.Atoi(limitS)
 		if err != nil {
-			httpError(w, util.NewErrBadRequest(errors.Errorf("cannot parse limit: %w", err)))
+			httpError(w, r, util.NewErrBadRequest(errors.Errorf("cannot parse limit: %w", err)))
 			return
 		}
 	}
 	if limit < 0 {
-		httpError(w, util.NewErrBadRequest(errors.Errorf("limit must be greater or equal than 0")))
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("limit must be greater or equal than 0")))
 		return
 	}
 	if limit > MaxRemoteSourcesLimit {
@@ -198,15 +305,123 @@ func (h *RemoteSourcesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	}
 
 	start := query.Get("start")
+	rsType := types.RemoteSourceType(query.Get("type"))
+	authType := types.RemoteSourceAuthType(query.Get("auth_type"))
 
-	remoteSources, err := h.readDB.GetRemoteSources(ctx, start, limit, asc)
+	fetchLimit := limit
+	if limit > 0 {
+		// fetch one more remote source to know if there's a next page
+		fetchLimit++
+	}
+	remoteSources, err := h.readDB.GetRemoteSources(ctx, start, rsType, authType, fetchLimit, asc)
 	if err != nil {
-		h.log.Errorf("err: %+v", err)
-		httpError(w, err)
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+
+	if limit > 0 && len(remoteSources) > limit {
+		remoteSources = remoteSources[:limit]
+
+		q := url.Values{}
+		q.Set("start", remoteSources[len(remoteSources)-1].Name)
+		q.Set("limit", strconv.Itoa(limit))
+		if rsType != "" {
+			q.Set("type", string(rsType))
+		}
+		if authType != "" {
+			q.Set("auth_type", string(authType))
+		}
+		if asc {
+			q.Set("asc", "")
+		}
+		next := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.String()))
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, remoteSources); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type GithubAppInstallationTokenHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewGithubAppInstallationTokenHandler(logger *zap.Logger, ah *action.ActionHandler) *GithubAppInstallationTokenHandler {
+	return &GithubAppInstallationTokenHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *GithubAppInstallationTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	rsRef := vars["remotesourceref"]
+
+	token, err := h.ah.GetGithubAppInstallationToken(ctx, rsRef)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	resp := &csapitypes.GithubAppInstallationTokenResponse{
+		Token:     token.Token,
+		ExpiresAt: token.ExpiresAt,
+	}
+	if err := httpResponse(w, r, http.StatusOK, resp); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type TestRemoteSourceHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewTestRemoteSourceHandler(logger *zap.Logger, ah *action.ActionHandler) *TestRemoteSourceHandler {
+	return &TestRemoteSourceHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *TestRemoteSourceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	rsRef := vars["remotesourceref"]
+
+	res, err := h.ah.TestRemoteSource(ctx, rsRef)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, remoteSources); err != nil {
-		h.log.Errorf("err: %+v", err)
+	resp := &csapitypes.TestRemoteSourceResponse{
+		Success:             res.Success,
+		CredentialsVerified: res.CredentialsVerified,
+		Message:             res.Message,
+	}
+	if err := httpResponse(w, r, http.StatusOK, resp); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// validateRemoteSourceRequest checks the remote source fields of the create
+// and update requests
+func validateRemoteSourceRequest(v *requestValidator, remoteSource *types.RemoteSource) {
+	if remoteSource.Name == "" {
+		v.required("name")
+	}
+	if remoteSource.APIURL == "" {
+		v.required("apiurl")
+	}
+	if remoteSource.Type == "" {
+		v.required("type")
+	}
+	if remoteSource.AuthType == "" {
+		v.required("auth_type")
+	}
+	if remoteSource.APIRateLimit < 0 {
+		v.invalid("api_rate_limit", "must be greater or equal than 0")
+	}
+	if remoteSource.MaxConcurrency < 0 {
+		v.invalid("max_concurrency", "must be greater or equal than 0")
 	}
 }
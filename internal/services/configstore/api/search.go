@@ -0,0 +1,149 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+
+	"agola.io/agola/internal/db"
+	slog "agola.io/agola/internal/log"
+	"agola.io/agola/internal/services/configstore/action"
+	"agola.io/agola/internal/services/configstore/readdb"
+	"agola.io/agola/internal/util"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+	"agola.io/agola/services/configstore/types"
+
+	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	DefaultSearchLimit = 5
+	MaxSearchLimit     = 20
+)
+
+// SearchHandler returns the projects, users and remote sources with a name
+// containing the search term, at most limit for every type.
+// When authenticated with a user token without the admin scope, only the
+// public projects and the private projects owned by the user or by its
+// organizations are returned.
+type SearchHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+}
+
+func NewSearchHandler(logger *zap.Logger, readDB *readdb.ReadDB) *SearchHandler {
+	return &SearchHandler{log: logger.Sugar(), readDB: readDB}
+}
+
+func (h *SearchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	term := query.Get("q")
+	if term == "" {
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("empty search term")))
+		return
+	}
+
+	limitS := query.Get("limit")
+	limit := DefaultSearchLimit
+	if limitS != "" {
+		var err error
+		limit, err = strconv.Atoi(limitS)
+		if err != nil {
+			httpError(w, r, util.NewErrBadRequest(errors.Errorf("cannot parse limit: %w", err)))
+			return
+		}
+	}
+	if limit <= 0 {
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("limit must be greater than 0")))
+		return
+	}
+	if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+
+	res := &csapitypes.SearchResponse{
+		Projects:      []*csapitypes.SearchResult{},
+		Users:         []*csapitypes.SearchResult{},
+		RemoteSources: []*csapitypes.SearchResult{},
+	}
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		access, err := newResourceAccess(h.readDB, tx, action.PrincipalFromContext(ctx))
+		if err != nil {
+			return err
+		}
+
+		// fetch the projects until limit accessible projects are found
+		var startName, startID string
+		for len(res.Projects) < limit {
+			projects, err := h.readDB.SearchProjects(tx, term, startName, startID, limit)
+			if err != nil {
+				return err
+			}
+			for _, project := range projects {
+				ok, err := access.canAccessProject(project, false)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				pp, err := h.readDB.GetPath(tx, project.Parent.Type, project.Parent.ID)
+				if err != nil {
+					return err
+				}
+				res.Projects = append(res.Projects, &csapitypes.SearchResult{Type: types.ConfigTypeProject, ID: project.ID, Name: project.Name, Path: path.Join(pp, project.Name)})
+				if len(res.Projects) == limit {
+					break
+				}
+			}
+			if len(projects) < limit {
+				break
+			}
+			startName, startID = projects[len(projects)-1].Name, projects[len(projects)-1].ID
+		}
+
+		users, err := h.readDB.GetUsers(tx, "", "", term, limit, true, false)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			res.Users = append(res.Users, &csapitypes.SearchResult{Type: types.ConfigTypeUser, ID: user.ID, Name: user.Name})
+		}
+
+		remoteSources, err := h.readDB.SearchRemoteSources(tx, term, limit)
+		if err != nil {
+			return err
+		}
+		for _, rs := range remoteSources {
+			res.RemoteSources = append(res.RemoteSources, &csapitypes.SearchResult{Type: types.ConfigTypeRemoteSource, ID: rs.ID, Name: rs.Name})
+		}
+
+		return nil
+	})
+	if err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
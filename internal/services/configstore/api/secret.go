@@ -15,13 +15,12 @@
 package api
 
 import (
-	"encoding/json"
 	"net/http"
 
 	"agola.io/agola/internal/db"
+	slog "agola.io/agola/internal/log"
 	"agola.io/agola/internal/services/configstore/action"
 	"agola.io/agola/internal/services/configstore/readdb"
-	"agola.io/agola/internal/util"
 	csapitypes "agola.io/agola/services/configstore/api/types"
 	"agola.io/agola/services/configstore/types"
 
@@ -45,13 +44,13 @@ func (h *SecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	secretID := vars["secretid"]
 
 	secret, err := h.ah.GetSecret(ctx, secretID)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, secret); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, secret); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -69,16 +68,29 @@ func (h *SecretsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	query := r.URL.Query()
 	_, tree := query["tree"]
+	// secrets data is returned only when explicitly requested and only to
+	// who can write the parent
+	withData, err := boolParam(r, "withdata")
+	if httpError(w, r, err) {
+		return
+	}
 
 	parentType, parentRef, err := GetConfigTypeRef(r)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	secrets, err := h.ah.GetSecrets(ctx, parentType, parentRef, tree)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	getSecrets := h.ah.GetSecretsWithoutData
+	if withData {
+		if err := checkWriteAccess(ctx, h.readDB, parentType, parentRef); httpError(w, r, err) {
+			return
+		}
+		getSecrets = h.ah.GetSecrets
+	}
+	secrets, err := getSecrets(ctx, parentType, parentRef, tree)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
@@ -99,13 +111,13 @@ func (h *SecretsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return err
 	})
 	if err != nil {
-		h.log.Errorf("err: %+v", err)
-		httpError(w, err)
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, resSecrets); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, resSecrets); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -121,15 +133,14 @@ func NewCreateSecretHandler(logger *zap.Logger, ah *action.ActionHandler) *Creat
 func (h *CreateSecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	parentType, parentRef, err := GetConfigTypeRef(r)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	var secret *types.Secret
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&secret); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &secret, func(v *requestValidator) { validateSecretRequest(v, secret) }); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
@@ -137,13 +148,13 @@ func (h *CreateSecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	secret.Parent.ID = parentRef
 
 	secret, err = h.ah.CreateSecret(ctx, secret)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, secret); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusCreated, secret); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -162,15 +173,14 @@ func (h *UpdateSecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	secretName := vars["secretname"]
 
 	parentType, parentRef, err := GetConfigTypeRef(r)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	var secret *types.Secret
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&secret); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &secret, func(v *requestValidator) { validateSecretRequest(v, secret) }); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
@@ -182,13 +192,13 @@ func (h *UpdateSecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		Secret:     secret,
 	}
 	secret, err = h.ah.UpdateSecret(ctx, areq)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, secret); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, secret); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -207,16 +217,30 @@ func (h *DeleteSecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	secretName := vars["secretname"]
 
 	parentType, parentRef, err := GetConfigTypeRef(r)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	err = h.ah.DeleteSecret(ctx, parentType, parentRef, secretName)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+	if err := httpResponse(w, r, http.StatusNoContent, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// validateSecretRequest checks the secret fields of the create and update
+// requests. The secret parent is defined by the request path.
+func validateSecretRequest(v *requestValidator, secret *types.Secret) {
+	if secret.Name == "" {
+		v.required("name")
+	}
+	if secret.Type != types.SecretTypeInternal {
+		v.invalid("type", "invalid secret type %q", secret.Type)
 	}
-	if err := httpResponse(w, http.StatusNoContent, nil); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if len(secret.Data) == 0 {
+		v.required("data")
 	}
 }
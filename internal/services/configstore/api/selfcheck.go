@@ -0,0 +1,69 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	slog "agola.io/agola/internal/log"
+	"agola.io/agola/internal/services/configstore/readdb"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+
+	"go.uber.org/zap"
+)
+
+// SelfCheckHandler verifies that the readdb reflects the data and the wals.
+// With repair, when there're discrepancies, the readdb is rebuilt from them.
+type SelfCheckHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+	repair bool
+}
+
+func NewSelfCheckHandler(logger *zap.Logger, readDB *readdb.ReadDB, repair bool) *SelfCheckHandler {
+	return &SelfCheckHandler{log: logger.Sugar(), readDB: readDB, repair: repair}
+}
+
+func (h *SelfCheckHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res, err := h.readDB.SelfCheck(ctx)
+	if err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+
+	resp := &csapitypes.SelfCheckResponse{
+		DataWalSequence: res.DataWalSequence,
+		WalSequence:     res.WalSequence,
+		Discrepancies:   make([]*csapitypes.SelfCheckDiscrepancy, len(res.Discrepancies)),
+	}
+	for i, d := range res.Discrepancies {
+		resp.Discrepancies[i] = &csapitypes.SelfCheckDiscrepancy{Type: d.Type, ID: d.ID, Kind: string(d.Kind)}
+	}
+	if len(res.Discrepancies) > 0 {
+		slog.WithContext(ctx, h.log).Warnf("readdb self check found %d discrepancies", len(res.Discrepancies))
+		if h.repair {
+			slog.WithContext(ctx, h.log).Infof("rebuilding the readdb")
+			h.readDB.RequestFullSync()
+			resp.Repairing = true
+		}
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, resp); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
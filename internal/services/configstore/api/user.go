@@ -15,11 +15,16 @@
 package api
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"agola.io/agola/internal/db"
+	slog "agola.io/agola/internal/log"
 	action "agola.io/agola/internal/services/configstore/action"
 	"agola.io/agola/internal/services/configstore/readdb"
 	"agola.io/agola/internal/util"
@@ -46,24 +51,39 @@ func (h *UserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	userRef := vars["userref"]
 
 	var user *types.User
+	var revision string
+	var modTime time.Time
 	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
 		var err error
 		user, err = h.readDB.GetUser(tx, userRef)
+		if err != nil || user == nil {
+			return err
+		}
+		revision, err = h.readDB.GetUserRevision(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		modTime, err = h.readDB.GetUserModTime(tx, user.ID)
 		return err
 	})
 	if err != nil {
-		h.log.Errorf("err: %+v", err)
-		httpError(w, err)
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
 		return
 	}
 
 	if user == nil {
-		httpError(w, util.NewErrNotExist(errors.Errorf("user %q doesn't exist", userRef)))
+		httpError(w, r, util.NewErrNotExist(errors.Errorf("user %q doesn't exist", userRef)))
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, user); err != nil {
-		h.log.Errorf("err: %+v", err)
+	setETag(w, revision)
+	if checkLastModified(w, r, modTime) {
+		notModified(w)
+		return
+	}
+	if err := httpResponse(w, r, http.StatusOK, user); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -79,13 +99,47 @@ func NewCreateUserHandler(logger *zap.Logger, ah *action.ActionHandler) *CreateU
 func (h *CreateUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	dryRun, err := dryRunParam(r)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
 	var req *csapitypes.CreateUserRequest
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&req); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &req, func(v *requestValidator) {
+		if req.UserName == "" {
+			v.required("user_name")
+		}
+		if req.CreateUserLARequest != nil && req.CreateUserLARequest.RemoteSourceName == "" {
+			v.required("create_user_la_request.remote_source_name")
+		}
+	}); err != nil {
+		httpError(w, r, err)
+		return
+	}
+
+	createUser := h.ah.CreateUser
+	status := http.StatusCreated
+	if dryRun {
+		createUser = h.ah.CreateUserDryRun
+		status = http.StatusOK
+	}
+
+	user, err := createUser(ctx, createUserRequest(req))
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
+	if err := httpResponse(w, r, status, user); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+func createUserRequest(req *csapitypes.CreateUserRequest) *action.CreateUserRequest {
+	if req == nil {
+		return nil
+	}
 	creq := &action.CreateUserRequest{
 		UserName: req.UserName,
 	}
@@ -100,15 +154,53 @@ func (h *CreateUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Oauth2AccessTokenExpiresAt: req.CreateUserLARequest.Oauth2AccessTokenExpiresAt,
 		}
 	}
+	return creq
+}
 
-	user, err := h.ah.CreateUser(ctx, creq)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+type ImportUsersHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewImportUsersHandler(logger *zap.Logger, ah *action.ActionHandler) *ImportUsersHandler {
+	return &ImportUsersHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *ImportUsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req []*csapitypes.CreateUserRequest
+	if err := decodeRequest(r, &req, func(v *requestValidator) {
+		for i, user := range req {
+			if user == nil || user.UserName == "" {
+				v.required(fmt.Sprintf("[%d].user_name", i))
+			}
+		}
+	}); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, user); err != nil {
-		h.log.Errorf("err: %+v", err)
+	creqs := make([]*action.CreateUserRequest, len(req))
+	for i, ureq := range req {
+		creqs[i] = createUserRequest(ureq)
+	}
+
+	users, err := h.ah.ImportUsers(ctx, creqs)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	resp := &csapitypes.ImportUsersResponse{
+		Users: make([]*csapitypes.ImportedUser, len(users)),
+	}
+	for i, user := range users {
+		resp.Users[i] = &csapitypes.ImportedUser{ID: user.ID, UserName: user.Name}
+	}
+
+	if err := httpResponse(w, r, http.StatusCreated, resp); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -127,26 +219,84 @@ func (h *UpdateUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userRef := vars["userref"]
 
+	revision, err := ifMatchRevision(r)
+	if httpError(w, r, err) {
+		return
+	}
+
 	var req *csapitypes.UpdateUserRequest
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&req); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &req, func(v *requestValidator) {
+		if req.UserName == "" {
+			v.required("user_name")
+		}
+	}); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
 	creq := &action.UpdateUserRequest{
-		UserRef:  userRef,
-		UserName: req.UserName,
+		UserRef:          userRef,
+		UserName:         req.UserName,
+		ExpectedRevision: revision,
 	}
 
 	user, err := h.ah.UpdateUser(ctx, creq)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, user); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusCreated, user); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type PatchUserHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewPatchUserHandler(logger *zap.Logger, ah *action.ActionHandler) *PatchUserHandler {
+	return &PatchUserHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *PatchUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userRef := vars["userref"]
+
+	revision, err := ifMatchRevision(r)
+	if httpError(w, r, err) {
+		return
+	}
+
+	var req *csapitypes.PatchUserRequest
+	if err := decodeRequest(r, &req, nil); err != nil {
+		httpError(w, r, err)
+		return
+	}
+
+	creq := &action.UpdateUserRequest{
+		UserRef:          userRef,
+		ExpectedRevision: revision,
+	}
+	if req.UserName != nil {
+		if *req.UserName == "" {
+			httpError(w, r, util.NewErrBadRequest(errors.Errorf("user name required")))
+			return
+		}
+		creq.UserName = *req.UserName
+	}
+
+	user, err := h.ah.UpdateUser(ctx, creq)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, user); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -165,12 +315,74 @@ func (h *DeleteUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userRef := vars["userref"]
 
-	err := h.ah.DeleteUser(ctx, userRef)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	revision, err := ifMatchRevision(r)
+	if httpError(w, r, err) {
+		return
 	}
-	if err := httpResponse(w, http.StatusNoContent, nil); err != nil {
-		h.log.Errorf("err: %+v", err)
+
+	err = h.ah.DeleteUser(ctx, userRef, revision)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+	if err := httpResponse(w, r, http.StatusNoContent, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type DeleteUserByIDHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewDeleteUserByIDHandler(logger *zap.Logger, ah *action.ActionHandler) *DeleteUserByIDHandler {
+	return &DeleteUserByIDHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *DeleteUserByIDHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID := vars["userid"]
+
+	revision, err := ifMatchRevision(r)
+	if httpError(w, r, err) {
+		return
+	}
+
+	err = h.ah.DeleteUserByID(ctx, userID, revision)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+	if err := httpResponse(w, r, http.StatusNoContent, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type RestoreUserHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewRestoreUserHandler(logger *zap.Logger, ah *action.ActionHandler) *RestoreUserHandler {
+	return &RestoreUserHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *RestoreUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID := vars["userid"]
+
+	user, err := h.ah.RestoreUser(ctx, userID)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, user); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -179,6 +391,54 @@ const (
 	MaxUsersLimit     = 20
 )
 
+// UserByLinkedAccountHandler returns the user with a linked account for the
+// remote user of a remote source
+type UserByLinkedAccountHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+}
+
+func NewUserByLinkedAccountHandler(logger *zap.Logger, readDB *readdb.ReadDB) *UserByLinkedAccountHandler {
+	return &UserByLinkedAccountHandler{log: logger.Sugar(), readDB: readDB}
+}
+
+func (h *UserByLinkedAccountHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	remoteSourceID := query.Get("remoteSourceId")
+	if remoteSourceID == "" {
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("remoteSourceId required")))
+		return
+	}
+	remoteUserID := query.Get("remoteUserId")
+	if remoteUserID == "" {
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("remoteUserId required")))
+		return
+	}
+
+	var user *types.User
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		user, err = h.readDB.GetUserByLinkedAccountRemoteUserIDandSource(tx, remoteUserID, remoteSourceID)
+		return err
+	})
+	if err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+
+	if user == nil {
+		httpError(w, r, util.NewErrNotExist(errors.Errorf("user with remote user %q for remote source %q doesn't exist", remoteUserID, remoteSourceID)))
+		return
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, user); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
 type UsersHandler struct {
 	log    *zap.SugaredLogger
 	readDB *readdb.ReadDB
@@ -198,12 +458,12 @@ func (h *UsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		var err error
 		limit, err = strconv.Atoi(limitS)
 		if err != nil {
-			httpError(w, util.NewErrBadRequest(errors.Errorf("cannot parse limit: %w", err)))
+			httpError(w, r, util.NewErrBadRequest(errors.Errorf("cannot parse limit: %w", err)))
 			return
 		}
 	}
 	if limit < 0 {
-		httpError(w, util.NewErrBadRequest(errors.Errorf("limit must be greater or equal than 0")))
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("limit must be greater or equal than 0")))
 		return
 	}
 	if limit > MaxUsersLimit {
@@ -213,8 +473,26 @@ func (h *UsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if _, ok := query["asc"]; ok {
 		asc = true
 	}
+	includeDeleted, err := includeDeletedParam(r)
+	if httpError(w, r, err) {
+		return
+	}
 
-	start := query.Get("start")
+	// start is a user name or the cursor returned in the next link of the
+	// previous page with the format "username/userid", since the soft deleted
+	// users can have the same name
+	var startName, startID string
+	if start := query.Get("start"); start != "" {
+		parts := strings.SplitN(start, "/", 2)
+		startName = parts[0]
+		if len(parts) == 2 {
+			startID = parts[1]
+		}
+		if startName == "" || (len(parts) == 2 && startID == "") {
+			httpError(w, r, util.NewErrBadRequest(errors.Errorf("wrong start %q", start)))
+			return
+		}
+	}
 
 	// handle special queries, like get user by token
 	queryType := query.Get("query_type")
@@ -230,12 +508,18 @@ func (h *UsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return err
 		})
 		if err != nil {
-			h.log.Errorf("err: %+v", err)
-			httpError(w, err)
+			slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+			httpError(w, r, err)
 			return
 		}
+		// an expired token, not yet removed, doesn't identify the user
+		if user != nil {
+			if tokenName, ok := user.TokenName(token); !ok || user.TokenExpired(tokenName, time.Now()) {
+				user = nil
+			}
+		}
 		if user == nil {
-			httpError(w, util.NewErrNotExist(errors.Errorf("user with required token doesn't exist")))
+			httpError(w, r, util.NewErrNotExist(errors.Errorf("user with required token doesn't exist")))
 			return
 		}
 		users = []*types.User{user}
@@ -248,12 +532,12 @@ func (h *UsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return err
 		})
 		if err != nil {
-			h.log.Errorf("err: %+v", err)
-			httpError(w, err)
+			slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+			httpError(w, r, err)
 			return
 		}
 		if user == nil {
-			httpError(w, util.NewErrNotExist(errors.Errorf("user with linked account %q token doesn't exist", linkedAccountID)))
+			httpError(w, r, util.NewErrNotExist(errors.Errorf("user with linked account %q token doesn't exist", linkedAccountID)))
 			return
 		}
 		users = []*types.User{user}
@@ -267,31 +551,186 @@ func (h *UsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return err
 		})
 		if err != nil {
-			h.log.Errorf("err: %+v", err)
-			httpError(w, err)
+			slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+			httpError(w, r, err)
 			return
 		}
 		if user == nil {
-			httpError(w, util.NewErrNotExist(errors.Errorf("user with remote user %q for remote source %q token doesn't exist", remoteUserID, remoteSourceID)))
+			httpError(w, r, util.NewErrNotExist(errors.Errorf("user with remote user %q for remote source %q token doesn't exist", remoteUserID, remoteSourceID)))
 			return
 		}
 		users = []*types.User{user}
 	default:
-		// default query
+		// default query, optionally filtered by a user name substring
+		nameQuery := query.Get("query")
+
+		fetchLimit := limit
+		if limit > 0 {
+			// fetch one more user to know if there's a next page
+			fetchLimit++
+		}
 		err := h.readDB.Do(ctx, func(tx *db.Tx) error {
 			var err error
-			users, err = h.readDB.GetUsers(tx, start, limit, asc)
+			users, err = h.readDB.GetUsers(tx, startName, startID, nameQuery, fetchLimit, asc, includeDeleted)
 			return err
 		})
 		if err != nil {
-			h.log.Errorf("err: %+v", err)
-			httpError(w, err)
+			slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+			httpError(w, r, err)
 			return
 		}
+
+		if limit > 0 && len(users) > limit {
+			users = users[:limit]
+
+			q := url.Values{}
+			last := users[len(users)-1]
+			q.Set("start", last.Name+"/"+last.ID)
+			q.Set("limit", strconv.Itoa(limit))
+			if nameQuery != "" {
+				q.Set("query", nameQuery)
+			}
+			if includeDeleted {
+				q.Set("includeDeleted", "true")
+			}
+			if asc {
+				q.Set("asc", "")
+			}
+			next := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+			w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.String()))
+		}
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, users); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// UsersCountHandler returns the number of users listed by the UsersHandler
+// default query with the same filters
+type UsersCountHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+}
+
+func NewUsersCountHandler(logger *zap.Logger, readDB *readdb.ReadDB) *UsersCountHandler {
+	return &UsersCountHandler{log: logger.Sugar(), readDB: readDB}
+}
+
+func (h *UsersCountHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	includeDeleted, err := includeDeletedParam(r)
+	if httpError(w, r, err) {
+		return
+	}
+	nameQuery := query.Get("query")
+
+	var count int
+	err = h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		count, err = h.readDB.CountUsers(tx, nameQuery, includeDeleted)
+		return err
+	})
+	if err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
+		return
+	}
+
+	res := &csapitypes.CountResponse{Count: count}
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// UserNameAvailabilityHandler reports if a user name isn't already used
+type UserNameAvailabilityHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+}
+
+func NewUserNameAvailabilityHandler(logger *zap.Logger, readDB *readdb.ReadDB) *UserNameAvailabilityHandler {
+	return &UserNameAvailabilityHandler{log: logger.Sugar(), readDB: readDB}
+}
+
+func (h *UserNameAvailabilityHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	userName := vars["username"]
+
+	if !util.ValidateName(userName) {
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("invalid user name %q", userName)))
+		return
+	}
+
+	var user *types.User
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		user, err = h.readDB.GetUserByName(tx, userName)
+		return err
+	})
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	res := &csapitypes.NameAvailabilityResponse{Available: user == nil}
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type UserLinkedAccountsHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+}
+
+func NewUserLinkedAccountsHandler(logger *zap.Logger, readDB *readdb.ReadDB) *UserLinkedAccountsHandler {
+	return &UserLinkedAccountsHandler{log: logger.Sugar(), readDB: readDB}
+}
+
+func (h *UserLinkedAccountsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	userRef := vars["userref"]
+
+	var las []*readdb.UserLinkedAccount
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		user, err := h.readDB.GetUser(tx, userRef)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return util.NewErrNotExist(errors.Errorf("user %q doesn't exist", userRef))
+		}
+
+		las, err = h.readDB.GetUserLinkedAccounts(tx, user.ID)
+		return err
+	})
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	res := make([]*csapitypes.UserLinkedAccount, len(las))
+	for i, la := range las {
+		res[i] = &csapitypes.UserLinkedAccount{
+			ID:                  la.LinkedAccount.ID,
+			RemoteSourceID:      la.LinkedAccount.RemoteSourceID,
+			RemoteUserID:        la.LinkedAccount.RemoteUserID,
+			RemoteUserName:      la.LinkedAccount.RemoteUserName,
+			RemoteUserAvatarURL: la.LinkedAccount.RemoteUserAvatarURL,
+		}
+		// the remote source name is empty when it doesn't exist anymore
+		if la.RemoteSource != nil {
+			res[i].RemoteSourceName = la.RemoteSource.Name
+		}
 	}
 
-	if err := httpResponse(w, http.StatusOK, users); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -310,9 +749,12 @@ func (h *CreateUserLAHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	userRef := vars["userref"]
 
 	var req csapitypes.CreateUserLARequest
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&req); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &req, func(v *requestValidator) {
+		if req.RemoteSourceName == "" {
+			v.required("remote_source_name")
+		}
+	}); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
@@ -327,13 +769,13 @@ func (h *CreateUserLAHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		Oauth2AccessTokenExpiresAt: req.Oauth2AccessTokenExpiresAt,
 	}
 	user, err := h.ah.CreateUserLA(ctx, creq)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, user); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusCreated, user); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -353,11 +795,38 @@ func (h *DeleteUserLAHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	laID := vars["laid"]
 
 	err := h.ah.DeleteUserLA(ctx, userRef, laID)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
-	if err := httpResponse(w, http.StatusNoContent, nil); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusNoContent, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// DeleteUserLAsHandler deletes all the user linked accounts
+type DeleteUserLAsHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewDeleteUserLAsHandler(logger *zap.Logger, ah *action.ActionHandler) *DeleteUserLAsHandler {
+	return &DeleteUserLAsHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *DeleteUserLAsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	userRef := vars["userref"]
+
+	laIDs, err := h.ah.DeleteUserLAs(ctx, userRef)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	res := &csapitypes.DeleteUserLAsResponse{DeletedLinkedAccountIDs: laIDs}
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -377,9 +846,8 @@ func (h *UpdateUserLAHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	linkedAccountID := vars["laid"]
 
 	var req csapitypes.UpdateUserLARequest
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&req); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &req, nil); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
@@ -394,13 +862,63 @@ func (h *UpdateUserLAHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		Oauth2AccessTokenExpiresAt: req.Oauth2AccessTokenExpiresAt,
 	}
 	user, err := h.ah.UpdateUserLA(ctx, creq)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, user); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, user); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// UpdateUserLATokenHandler updates only the tokens of a linked account
+type UpdateUserLATokenHandler struct {
+	log *zap.SugaredLogger
+	ah  *action.ActionHandler
+}
+
+func NewUpdateUserLATokenHandler(logger *zap.Logger, ah *action.ActionHandler) *UpdateUserLATokenHandler {
+	return &UpdateUserLATokenHandler{log: logger.Sugar(), ah: ah}
+}
+
+func (h *UpdateUserLATokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	userRef := vars["userref"]
+	linkedAccountID := vars["laid"]
+
+	var req csapitypes.UpdateUserLATokenRequest
+	if err := decodeRequest(r, &req, nil); err != nil {
+		httpError(w, r, err)
+		return
+	}
+
+	creq := &action.UpdateUserLATokenRequest{
+		UserRef:                    userRef,
+		LinkedAccountID:            linkedAccountID,
+		UserAccessToken:            req.UserAccessToken,
+		Oauth2AccessToken:          req.Oauth2AccessToken,
+		Oauth2RefreshToken:         req.Oauth2RefreshToken,
+		Oauth2AccessTokenExpiresAt: req.Oauth2AccessTokenExpiresAt,
+	}
+	la, rs, err := h.ah.UpdateUserLAToken(ctx, creq)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	// don't return the tokens
+	res := &csapitypes.UserLinkedAccount{
+		ID:                  la.ID,
+		RemoteSourceID:      rs.ID,
+		RemoteSourceName:    rs.Name,
+		RemoteUserID:        la.RemoteUserID,
+		RemoteUserName:      la.RemoteUserName,
+		RemoteUserAvatarURL: la.RemoteUserAvatarURL,
+	}
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -419,23 +937,160 @@ func (h *CreateUserTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	userRef := vars["userref"]
 
 	var req csapitypes.CreateUserTokenRequest
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&req); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	var ttl time.Duration
+	if err := decodeRequest(r, &req, func(v *requestValidator) {
+		if req.TokenName == "" {
+			v.required("token_name")
+		}
+		for i, scope := range req.Scopes {
+			if !types.IsValidTokenScope(scope) {
+				v.invalid(fmt.Sprintf("scopes[%d]", i), "invalid scope %q", scope)
+			}
+		}
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil {
+				v.invalid("ttl", "invalid duration %q", req.TTL)
+			} else if ttl <= 0 {
+				v.invalid("ttl", "must be greater than 0")
+			}
+		}
+	}); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
-	token, err := h.ah.CreateUserToken(ctx, userRef, req.TokenName)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	token, err := h.ah.CreateUserTokenWithOptions(ctx, userRef, req.TokenName, req.Scopes, &action.CreateUserTokenOptions{TTL: ttl})
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	resp := &csapitypes.CreateUserTokenResponse{
 		Token: token,
 	}
-	if err := httpResponse(w, http.StatusCreated, resp); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusCreated, resp); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type UserTokensHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+}
+
+func NewUserTokensHandler(logger *zap.Logger, readDB *readdb.ReadDB) *UserTokensHandler {
+	return &UserTokensHandler{log: logger.Sugar(), readDB: readDB}
+}
+
+func (h *UserTokensHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	userRef := vars["userref"]
+
+	var user *types.User
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		user, err = h.readDB.GetUser(tx, userRef)
+		return err
+	})
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	if user == nil {
+		httpError(w, r, util.NewErrNotExist(errors.Errorf("user %q doesn't exist", userRef)))
+		return
+	}
+
+	// never return the token values
+	res := []*csapitypes.UserToken{}
+	for tokenName := range user.Tokens {
+		token := &csapitypes.UserToken{Name: tokenName, Scopes: user.TokensScopes[tokenName]}
+		if creationTime, ok := user.TokensCreationTime[tokenName]; ok {
+			creationTime := creationTime
+			token.CreationTime = &creationTime
+		}
+		if expirationTime, ok := user.TokensExpirationTime[tokenName]; ok {
+			expirationTime := expirationTime
+			token.ExpirationTime = &expirationTime
+		}
+		res = append(res, token)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// IntrospectUserTokenHandler returns the user owning a token, the token scopes
+// and expiration time. Unknown and expired tokens are reported as unauthorized.
+type IntrospectUserTokenHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+}
+
+func NewIntrospectUserTokenHandler(logger *zap.Logger, readDB *readdb.ReadDB) *IntrospectUserTokenHandler {
+	return &IntrospectUserTokenHandler{log: logger.Sugar(), readDB: readDB}
+}
+
+func (h *IntrospectUserTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req csapitypes.IntrospectUserTokenRequest
+	if err := decodeRequest(r, &req, func(v *requestValidator) {
+		if req.Token == "" {
+			v.required("token")
+		}
+	}); err != nil {
+		httpError(w, r, err)
+		return
+	}
+
+	var user *types.User
+	err := h.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		user, err = h.readDB.GetUserByTokenValue(tx, req.Token)
+		return err
+	})
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	var tokenName string
+	if user != nil {
+		var ok bool
+		if tokenName, ok = user.TokenName(req.Token); !ok {
+			user = nil
+		}
+	}
+	if user == nil {
+		httpError(w, r, util.NewErrUnauthorized(errors.Errorf("unknown token")))
+		return
+	}
+	if user.TokenExpired(tokenName, time.Now()) {
+		httpError(w, r, util.NewErrUnauthorized(errors.Errorf("expired token")))
+		return
+	}
+
+	res := &csapitypes.UserTokenIntrospection{
+		UserID:    user.ID,
+		UserName:  user.Name,
+		TokenName: tokenName,
+		Scopes:    user.TokenScopes(tokenName),
+	}
+	if creationTime, ok := user.TokensCreationTime[tokenName]; ok {
+		res.CreationTime = &creationTime
+	}
+	if expirationTime, ok := user.TokensExpirationTime[tokenName]; ok {
+		res.ExpirationTime = &expirationTime
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -454,13 +1109,18 @@ func (h *DeleteUserTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	userRef := vars["userref"]
 	tokenName := vars["tokenname"]
 
-	err := h.ah.DeleteUserToken(ctx, userRef, tokenName)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	revoked, err := h.ah.DeleteUserToken(ctx, userRef, tokenName)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
-	if err := httpResponse(w, http.StatusNoContent, nil); err != nil {
-		h.log.Errorf("err: %+v", err)
+	// the token is deleted but could still be accepted for a short time
+	status := http.StatusNoContent
+	if !revoked {
+		status = http.StatusAccepted
+	}
+	if err := httpResponse(w, r, status, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -486,8 +1146,8 @@ func (h *UserOrgsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	userRef := vars["userref"]
 
 	userOrgs, err := h.ah.GetUserOrgs(ctx, userRef)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
@@ -496,7 +1156,7 @@ func (h *UserOrgsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		res[i] = userOrgsResponse(userOrg)
 	}
 
-	if err := httpResponse(w, http.StatusOK, res); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
@@ -0,0 +1,196 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"agola.io/agola/internal/util"
+
+	errors "golang.org/x/xerrors"
+)
+
+// requestValidator collects the invalid fields of a request body. The fields
+// are identified by their json path (i.e. parent.id or values[0].secret_name)
+type requestValidator struct {
+	errs []string
+}
+
+func (v *requestValidator) required(field string) {
+	v.errs = append(v.errs, fmt.Sprintf("%s: required", field))
+}
+
+func (v *requestValidator) invalid(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Sprintf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+// decodeRequest decodes the json request body into req. Unlike a plain json
+// decoding the fields not defined by req are rejected and, if provided,
+// validate is called to check the decoded request fields.
+// All the unknown and invalid fields are reported together in the details of
+// the returned bad request error.
+func decodeRequest(r *http.Request, req interface{}, validate func(v *requestValidator)) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		if util.IsRequestTooLarge(err) {
+			return err
+		}
+		return util.NewErrBadRequest(errors.Errorf("failed to read request body: %w", err))
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return util.NewErrBadRequest(err)
+	}
+	if data == nil {
+		return util.NewErrBadRequest(errors.Errorf("empty request body"))
+	}
+
+	v := &requestValidator{}
+	for _, field := range unknownFields("", data, reflect.TypeOf(req)) {
+		v.errs = append(v.errs, fmt.Sprintf("%s: unknown field", field))
+	}
+
+	if err := json.Unmarshal(body, req); err != nil {
+		var terr *json.UnmarshalTypeError
+		if !errors.As(err, &terr) {
+			return util.NewErrBadRequest(err)
+		}
+		// the request is only partially decoded so it isn't validated
+		v.invalid(terr.Field, "wrong value type %s, expected %s", terr.Value, terr.Type)
+	} else if validate != nil {
+		validate(v)
+	}
+
+	if len(v.errs) > 0 {
+		err := errors.Errorf("invalid request body: %s", strings.Join(v.errs, ", "))
+		return util.NewErrBadRequest(util.NewAPIError(util.ErrorCodeBadRequest, err, v.errs...))
+	}
+	return nil
+}
+
+// unknownFields returns the paths of the json object fields in data that
+// won't be decoded into a value of type t
+func unknownFields(path string, data interface{}, t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	fields := []string{}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := data.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		structFields := jsonFields(t)
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ft, ok := jsonField(structFields, key)
+			if !ok {
+				fields = append(fields, fieldPath(path, key))
+				continue
+			}
+			fields = append(fields, unknownFields(fieldPath(path, key), obj[key], ft)...)
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := data.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			fields = append(fields, unknownFields(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+	case reflect.Map:
+		obj, ok := data.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for key, value := range obj {
+			fields = append(fields, unknownFields(fieldPath(path, key), value, t.Elem())...)
+		}
+		sort.Strings(fields)
+	}
+	return fields
+}
+
+// jsonFields returns the types of the fields of struct type t keyed by their
+// json name. The fields of the embedded structs are included like done by the
+// json decoder.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for name, eft := range jsonFields(ft) {
+					if _, ok := fields[name]; !ok {
+						fields[name] = eft
+					}
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			// unexported field
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// jsonField returns the type of the struct field matching the json key. Like
+// the json decoder an exact match is preferred to a case insensitive one.
+func jsonField(fields map[string]reflect.Type, key string) (reflect.Type, bool) {
+	if ft, ok := fields[key]; ok {
+		return ft, true
+	}
+	for name, ft := range fields {
+		if strings.EqualFold(name, key) {
+			return ft, true
+		}
+	}
+	return nil, false
+}
+
+func fieldPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
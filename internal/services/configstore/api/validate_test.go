@@ -0,0 +1,184 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"agola.io/agola/internal/util"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+	"agola.io/agola/services/configstore/types"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	// the validations done by the create user handler
+	validateCreateUserRequest := func(v *requestValidator, req *csapitypes.CreateUserRequest) {
+		if req.UserName == "" {
+			v.required("user_name")
+		}
+		if req.CreateUserLARequest != nil && req.CreateUserLARequest.RemoteSourceName == "" {
+			v.required("create_user_la_request.remote_source_name")
+		}
+	}
+
+	tests := []struct {
+		name string
+		body string
+		// decode decodes the request body like done by an api handler
+		decode func(r *http.Request) error
+		// details are the expected invalid fields, nil if the request is valid
+		details []string
+		// expectedErr is the expected error of a request body that cannot
+		// be validated
+		expectedErr string
+	}{
+		{
+			name: "misspelled field",
+			body: `{"name": "org01", "visibilty": "public"}`,
+			decode: func(r *http.Request) error {
+				var req types.Organization
+				return decodeRequest(r, &req, func(v *requestValidator) {
+					if !types.IsValidVisibility(req.Visibility) {
+						v.invalid("visibility", "invalid visibility %q", req.Visibility)
+					}
+				})
+			},
+			details: []string{
+				"visibilty: unknown field",
+				`visibility: invalid visibility ""`,
+			},
+		},
+		{
+			name: "unknown and missing required fields",
+			body: `{"username": "user02", "create_user_la_request": {"remote_user_id": "1", "remote_source": "rs01"}}`,
+			decode: func(r *http.Request) error {
+				var req *csapitypes.CreateUserRequest
+				return decodeRequest(r, &req, func(v *requestValidator) { validateCreateUserRequest(v, req) })
+			},
+			details: []string{
+				"create_user_la_request.remote_source: unknown field",
+				"username: unknown field",
+				"user_name: required",
+				"create_user_la_request.remote_source_name: required",
+			},
+		},
+		{
+			name: "nested unknown fields",
+			body: `{"name": "project01", "parent": {"type": "projectgroup", "idd": "user/user01"}, "visibility": "public", "remote_repository_config_type": "manual"}`,
+			decode: func(r *http.Request) error {
+				var project *types.Project
+				return decodeRequest(r, &project, func(v *requestValidator) { validateProjectRequest(v, project) })
+			},
+			details: []string{
+				"parent.idd: unknown field",
+				"parent.id: required",
+			},
+		},
+		{
+			name: "array items fields",
+			body: `[{"user_name": "user02"}, {"user_name": "user03", "password": "pass"}, {}]`,
+			decode: func(r *http.Request) error {
+				var req []*csapitypes.CreateUserRequest
+				return decodeRequest(r, &req, func(v *requestValidator) {
+					for i, user := range req {
+						if user == nil || user.UserName == "" {
+							v.required(fmt.Sprintf("[%d].user_name", i))
+						}
+					}
+				})
+			},
+			details: []string{
+				"[1].password: unknown field",
+				"[2].user_name: required",
+			},
+		},
+		{
+			name: "wrong value type",
+			body: `{"name": "var01", "values": "value", "unknown": true}`,
+			decode: func(r *http.Request) error {
+				var variable *types.Variable
+				return decodeRequest(r, &variable, func(v *requestValidator) { validateVariableRequest(v, variable) })
+			},
+			details: []string{
+				"unknown: unknown field",
+				"values: wrong value type string, expected []types.VariableValue",
+			},
+		},
+		{
+			name: "negative remote source limits",
+			body: `{"name": "rs01", "apiurl": "https://gitea.example.com", "type": "gitea", "auth_type": "token", "api_rate_limit": -1, "max_concurrency": -1}`,
+			decode: func(r *http.Request) error {
+				var remoteSource *types.RemoteSource
+				return decodeRequest(r, &remoteSource, func(v *requestValidator) { validateRemoteSourceRequest(v, remoteSource) })
+			},
+			details: []string{
+				"api_rate_limit: must be greater or equal than 0",
+				"max_concurrency: must be greater or equal than 0",
+			},
+		},
+		{
+			name: "empty body",
+			body: `null`,
+			decode: func(r *http.Request) error {
+				var req *csapitypes.UpdateUserRequest
+				return decodeRequest(r, &req, nil)
+			},
+			expectedErr: "empty request body",
+		},
+		{
+			name: "case insensitive field names",
+			body: `{"User_Name": "user02"}`,
+			decode: func(r *http.Request) error {
+				var req *csapitypes.CreateUserRequest
+				return decodeRequest(r, &req, func(v *requestValidator) { validateCreateUserRequest(v, req) })
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.decode(httptest.NewRequest("POST", "/", strings.NewReader(tt.body)))
+			if tt.details == nil && tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				return
+			}
+			if !util.IsBadRequest(err) {
+				t.Fatalf("expected bad request error, got: %v", err)
+			}
+			if tt.expectedErr != "" {
+				if err.Error() != tt.expectedErr {
+					t.Fatalf("expected err %q, got err: %v", tt.expectedErr, err)
+				}
+				return
+			}
+			expectedErr := &util.APIError{
+				Code:    util.ErrorCodeBadRequest,
+				Message: "invalid request body: " + strings.Join(tt.details, ", "),
+				Details: tt.details,
+			}
+			if diff := cmp.Diff(expectedErr, util.APIErrorFromError(err)); diff != "" {
+				t.Fatalf("api error mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
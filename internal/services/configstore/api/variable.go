@@ -15,18 +15,20 @@
 package api
 
 import (
-	"encoding/json"
 	"net/http"
 
 	"agola.io/agola/internal/db"
+	slog "agola.io/agola/internal/log"
 	"agola.io/agola/internal/services/configstore/action"
 	"agola.io/agola/internal/services/configstore/readdb"
+	itypes "agola.io/agola/internal/services/types"
 	"agola.io/agola/internal/util"
 	csapitypes "agola.io/agola/services/configstore/api/types"
 	"agola.io/agola/services/configstore/types"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
 )
 
 type VariablesHandler struct {
@@ -45,14 +47,14 @@ func (h *VariablesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	_, tree := query["tree"]
 
 	parentType, parentRef, err := GetConfigTypeRef(r)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	variables, err := h.ah.GetVariables(ctx, parentType, parentRef, tree)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
@@ -72,13 +74,13 @@ func (h *VariablesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return err
 	})
 	if err != nil {
-		h.log.Errorf("err: %+v", err)
-		httpError(w, err)
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		httpError(w, r, err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, resVariables); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, resVariables); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -94,15 +96,14 @@ func NewCreateVariableHandler(logger *zap.Logger, ah *action.ActionHandler) *Cre
 func (h *CreateVariableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	parentType, parentRef, err := GetConfigTypeRef(r)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	var variable *types.Variable
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&variable); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &variable, func(v *requestValidator) { validateVariableRequest(v, variable) }); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
@@ -110,13 +111,13 @@ func (h *CreateVariableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	variable.Parent.ID = parentRef
 
 	variable, err = h.ah.CreateVariable(ctx, variable)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusCreated, variable); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusCreated, variable); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -135,15 +136,14 @@ func (h *UpdateVariableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	variableName := vars["variablename"]
 
 	parentType, parentRef, err := GetConfigTypeRef(r)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	var variable *types.Variable
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&variable); err != nil {
-		httpError(w, util.NewErrBadRequest(err))
+	if err := decodeRequest(r, &variable, func(v *requestValidator) { validateVariableRequest(v, variable) }); err != nil {
+		httpError(w, r, err)
 		return
 	}
 
@@ -155,13 +155,13 @@ func (h *UpdateVariableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		Variable:     variable,
 	}
 	variable, err = h.ah.UpdateVariable(ctx, areq)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
-	if err := httpResponse(w, http.StatusOK, variable); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusOK, variable); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
 }
 
@@ -180,16 +180,106 @@ func (h *DeleteVariableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	variableName := vars["variablename"]
 
 	parentType, parentRef, err := GetConfigTypeRef(r)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 		return
 	}
 
 	err = h.ah.DeleteVariable(ctx, parentType, parentRef, variableName)
-	if httpError(w, err) {
-		h.log.Errorf("err: %+v", err)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
 	}
-	if err := httpResponse(w, http.StatusNoContent, nil); err != nil {
-		h.log.Errorf("err: %+v", err)
+	if err := httpResponse(w, r, http.StatusNoContent, nil); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+type ResolvedVariablesHandler struct {
+	log    *zap.SugaredLogger
+	readDB *readdb.ReadDB
+}
+
+func NewResolvedVariablesHandler(logger *zap.Logger, readDB *readdb.ReadDB) *ResolvedVariablesHandler {
+	return &ResolvedVariablesHandler{log: logger.Sugar(), readDB: readDB}
+}
+
+func (h *ResolvedVariablesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	refType := itypes.RunRefType(query.Get("ref_type"))
+	switch refType {
+	case itypes.RunRefTypeBranch, itypes.RunRefTypeTag, itypes.RunRefTypePullRequest:
+	default:
+		httpError(w, r, util.NewErrBadRequest(errors.Errorf("wrong ref type %q", refType)))
+		return
+	}
+	branch := query.Get("branch")
+	tag := query.Get("tag")
+	ref := query.Get("ref")
+
+	parentType, parentRef, err := GetConfigTypeRef(r)
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	resVariables := []*csapitypes.ResolvedVariable{}
+	err = h.readDB.Do(ctx, func(tx *db.Tx) error {
+		parentID, err := h.readDB.ResolveConfigID(tx, parentType, parentRef)
+		if err != nil {
+			return err
+		}
+
+		rvs, err := h.readDB.ResolveVariables(tx, parentType, parentID, refType, branch, tag, ref)
+		if err != nil {
+			return err
+		}
+
+		for _, rv := range rvs {
+			pp, err := h.readDB.GetPath(tx, rv.Variable.Parent.Type, rv.Variable.Parent.ID)
+			if err != nil {
+				return err
+			}
+			resVariable := &csapitypes.ResolvedVariable{
+				Name:       rv.Variable.Name,
+				ParentPath: pp,
+			}
+			if rv.Value != nil {
+				resVariable.Matched = true
+				resVariable.SecretName = rv.Value.SecretName
+				resVariable.SecretVar = rv.Value.SecretVar
+			}
+			if rv.Secret != nil {
+				spp, err := h.readDB.GetPath(tx, rv.Secret.Parent.Type, rv.Secret.Parent.ID)
+				if err != nil {
+					return err
+				}
+				resVariable.SecretID = rv.Secret.ID
+				resVariable.SecretParentPath = spp
+			}
+			resVariables = append(resVariables, resVariable)
+		}
+
+		return nil
+	})
+	if httpError(w, r, err) {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+		return
+	}
+
+	if err := httpResponse(w, r, http.StatusOK, resVariables); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
+
+// validateVariableRequest checks the variable fields of the create and update
+// requests. The variable parent is defined by the request path.
+func validateVariableRequest(v *requestValidator, variable *types.Variable) {
+	if variable.Name == "" {
+		v.required("name")
+	}
+	if len(variable.Values) == 0 {
+		v.required("values")
 	}
 }
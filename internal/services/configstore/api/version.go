@@ -0,0 +1,52 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	"agola.io/agola/cmd"
+	"agola.io/agola/internal/datamanager"
+	slog "agola.io/agola/internal/log"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+
+	"go.uber.org/zap"
+)
+
+// VersionHandler returns the build version of the configstore and the
+// supported api and wal schema versions
+type VersionHandler struct {
+	log *zap.SugaredLogger
+	dm  *datamanager.DataManager
+}
+
+func NewVersionHandler(logger *zap.Logger, dm *datamanager.DataManager) *VersionHandler {
+	return &VersionHandler{log: logger.Sugar(), dm: dm}
+}
+
+func (h *VersionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res := &csapitypes.VersionResponse{
+		Version:     cmd.Version,
+		Commit:      cmd.Commit,
+		BuildDate:   cmd.BuildDate,
+		APIVersion:  csapitypes.APIVersion,
+		WalVersions: h.dm.DataTypesVersions(),
+	}
+	if err := httpResponse(w, r, http.StatusOK, res); err != nil {
+		slog.WithContext(ctx, h.log).Errorf("err: %+v", err)
+	}
+}
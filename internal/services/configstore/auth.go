@@ -0,0 +1,180 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"agola.io/agola/internal/db"
+	slog "agola.io/agola/internal/log"
+	"agola.io/agola/internal/services/configstore/action"
+	"agola.io/agola/internal/services/configstore/api"
+	"agola.io/agola/internal/services/configstore/readdb"
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/configstore/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+// adminTokenActor is the actor recorded in the audit entries for the requests
+// authenticated with the admin token when no actor is provided
+const adminTokenActor = "<admintoken>"
+
+// authenticator authenticates a request bearer token
+type authenticator interface {
+	// authenticate returns the principal owning the token or nil if the token
+	// isn't handled by this authenticator
+	authenticate(ctx context.Context, token string) (*action.Principal, error)
+}
+
+// adminTokenAuthenticator authenticates the static admin token used by the
+// other agola services
+type adminTokenAuthenticator struct {
+	token string
+}
+
+func (a *adminTokenAuthenticator) authenticate(ctx context.Context, token string) (*action.Principal, error) {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		return nil, nil
+	}
+	return &action.Principal{Scopes: []types.TokenScope{types.TokenScopeAdmin}}, nil
+}
+
+// userTokenAuthenticator authenticates the user tokens saved in the readdb
+type userTokenAuthenticator struct {
+	readDB *readdb.ReadDB
+}
+
+func (a *userTokenAuthenticator) authenticate(ctx context.Context, token string) (*action.Principal, error) {
+	var user *types.User
+	err := a.readDB.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		user, err = a.readDB.GetUserByTokenValue(tx, token)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, nil
+	}
+
+	tokenName, ok := user.TokenName(token)
+	if !ok {
+		return nil, nil
+	}
+	if user.TokenExpired(tokenName, time.Now()) {
+		return nil, util.NewErrUnauthorized(errors.Errorf("expired bearer token"))
+	}
+	principal := &action.Principal{
+		UserID:    user.ID,
+		UserName:  user.Name,
+		TokenName: tokenName,
+		Scopes:    user.TokenScopes(tokenName),
+	}
+
+	return principal, nil
+}
+
+// authHandler authenticates the api requests using the configured
+// authenticators and enforces the token scopes
+type authHandler struct {
+	authenticators []authenticator
+}
+
+func newAuthHandler(authenticators ...authenticator) *authHandler {
+	return &authHandler{authenticators: authenticators}
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return auth[len(prefix):]
+	}
+	return ""
+}
+
+func (a *authHandler) authenticate(ctx context.Context, token string) (*action.Principal, error) {
+	if token == "" {
+		return nil, util.NewErrUnauthorized(errors.Errorf("missing bearer token"))
+	}
+	for _, au := range a.authenticators {
+		principal, err := au.authenticate(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		if principal != nil {
+			return principal, nil
+		}
+	}
+	return nil, util.NewErrUnauthorized(errors.Errorf("invalid bearer token"))
+}
+
+// middleware is a mux middleware that authenticates the request and saves the
+// principal in the request context. Read only requests (GET, HEAD) require the
+// read scope, all the others the write scope.
+func (a *authHandler) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		principal, err := a.authenticate(ctx, bearerToken(r))
+		if err != nil {
+			if !util.IsUnauthorized(err) {
+				slog.WithContext(ctx, log).Errorf("err: %+v", err)
+			}
+			api.HTTPError(w, r, err)
+			return
+		}
+
+		requiredScope := types.TokenScopeWrite
+		if r.Method == "GET" || r.Method == "HEAD" {
+			requiredScope = types.TokenScopeRead
+		}
+		if !principal.HasScope(requiredScope) {
+			api.HTTPError(w, r, util.NewErrForbidden(errors.Errorf("token scope %q required", requiredScope)))
+			return
+		}
+
+		ctx = action.WithPrincipal(ctx, principal)
+		// an user can only act as itself, the actor provided in the request is
+		// accepted only from the other agola services
+		switch {
+		case principal.UserName != "":
+			ctx = action.WithActor(ctx, principal.UserName)
+		case action.Actor(ctx) == "":
+			ctx = action.WithActor(ctx, adminTokenActor)
+		}
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireScope returns a handler that executes h only if the authenticated
+// principal has the required scope
+func (a *authHandler) requireScope(scope types.TokenScope, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := action.PrincipalFromContext(r.Context())
+		if principal == nil || !principal.HasScope(scope) {
+			api.HTTPError(w, r, util.NewErrForbidden(errors.Errorf("token scope %q required", scope)))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
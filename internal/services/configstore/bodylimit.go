@@ -0,0 +1,101 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"io"
+	"net/http"
+
+	"agola.io/agola/internal/services/configstore/api"
+	"agola.io/agola/internal/util"
+
+	"github.com/gorilla/mux"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	// DefaultMaxRequestBodySize is the max size of an api request body when
+	// not configured
+	DefaultMaxRequestBodySize = 1 << 20
+	// DefaultMaxImportRequestBodySize is the max size of a bulk import api
+	// request body when not configured
+	DefaultMaxImportRequestBodySize = 1 << 30
+)
+
+const (
+	usersImportRouteName     = "usersImport"
+	resourcesImportRouteName = "resourcesImport"
+	importRouteName          = "import"
+)
+
+// importRoutes are the names of the routes of the bulk import apis that
+// accept bodies up to the import max size
+var importRoutes = map[string]struct{}{
+	usersImportRouteName:     {},
+	resourcesImportRouteName: {},
+	importRouteName:          {},
+}
+
+// maxBytesBody reports a body exceeding the max size with a request too large
+// error
+type maxBytesBody struct {
+	io.ReadCloser
+	maxSize int64
+	n       int64
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err != nil && err != io.EOF && b.n >= b.maxSize {
+		return n, requestTooLargeError(b.maxSize)
+	}
+	return n, err
+}
+
+func requestTooLargeError(maxSize int64) error {
+	return util.NewErrRequestTooLarge(errors.Errorf("request body exceeds the max size of %d bytes", maxSize))
+}
+
+// bodyLimitMiddleware is a mux middleware that limits the size of the
+// request bodies. The requests declaring a bigger body are rejected before
+// reading it, the others fail when reading beyond the limit.
+func (s *Configstore) bodyLimitMiddleware(h http.Handler) http.Handler {
+	maxSize := s.c.RequestBodyLimit.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxRequestBodySize
+	}
+	importMaxSize := s.c.RequestBodyLimit.ImportMaxSize
+	if importMaxSize == 0 {
+		importMaxSize = DefaultMaxImportRequestBodySize
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := maxSize
+		if route := mux.CurrentRoute(r); route != nil {
+			if _, ok := importRoutes[route.GetName()]; ok {
+				limit = importMaxSize
+			}
+		}
+
+		if r.ContentLength > limit {
+			api.HTTPError(w, r, requestTooLargeError(limit))
+			return
+		}
+		r.Body = &maxBytesBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit), maxSize: limit}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+
+	"github.com/gorilla/mux"
+)
+
+const apiPathPrefix = "/api/" + csapitypes.APIVersion + "/"
+
+// defaultCacheMaxAges are the default max-age of the GET responses of the api
+// resources rarely changed. The other resources responses must be revalidated
+// (they have an ETag) before being reused
+var defaultCacheMaxAges = map[string]time.Duration{
+	"remotesources": 1 * time.Minute,
+}
+
+// cacheControlPolicy defines the Cache-Control header of every api response
+type cacheControlPolicy struct {
+	defaultMaxAge time.Duration
+	maxAges       map[string]time.Duration
+	// private forbids the shared caches (proxies, CDNs) to store the responses
+	// since they're returned only to the authenticated clients
+	private bool
+}
+
+func newCacheControlPolicy(c *config.CacheControl, private bool) *cacheControlPolicy {
+	maxAges := map[string]time.Duration{}
+	for resource, maxAge := range defaultCacheMaxAges {
+		maxAges[resource] = maxAge
+	}
+	for resource, maxAge := range c.MaxAge {
+		maxAges[resource] = maxAge
+	}
+	return &cacheControlPolicy{defaultMaxAge: c.DefaultMaxAge, maxAges: maxAges, private: private}
+}
+
+// apiResource returns the api resource of the request route (the first element
+// of the api path)
+func apiResource(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(strings.TrimPrefix(tmpl, apiPathPrefix), "/", 2)[0]
+}
+
+// value returns the Cache-Control header value of the response with the
+// provided status. Only the successful responses of the GET requests can be
+// cached.
+func (p *cacheControlPolicy) value(r *http.Request, status int) string {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return "no-store"
+	}
+	if status >= http.StatusMultipleChoices && status != http.StatusNotModified {
+		return "no-store"
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if _, ok := longLivedRoutes[route.GetName()]; ok {
+			return "no-store"
+		}
+	}
+
+	maxAge := p.defaultMaxAge
+	if resourceMaxAge, ok := p.maxAges[apiResource(r)]; ok {
+		maxAge = resourceMaxAge
+	}
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	visibility := "public"
+	if p.private {
+		visibility = "private"
+	}
+	return fmt.Sprintf("%s, max-age=%d", visibility, int64(maxAge/time.Second))
+}
+
+// cacheControlResponseWriter sets the Cache-Control header when the response
+// status is known, if not already set by the handler
+type cacheControlResponseWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	p           *cacheControlPolicy
+	wroteHeader bool
+}
+
+func (w *cacheControlResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.Header().Get("Cache-Control") == "" {
+			w.Header().Set("Cache-Control", w.p.value(w.r, status))
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheControlResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher since it's used by the streaming handlers
+func (w *cacheControlResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// cacheControlMiddleware is a mux middleware that adds to the api responses
+// the Cache-Control header defined by the configured cache control policy.
+// The mutating requests responses are never stored.
+func (s *Configstore) cacheControlMiddleware(h http.Handler) http.Handler {
+	p := newCacheControlPolicy(&s.c.CacheControl, s.c.Auth.Enabled)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&cacheControlResponseWriter{ResponseWriter: w, r: r, p: p}, r)
+	})
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCacheControl(t *testing.T) {
+	// newRouter returns an api router with the cache control middleware of a
+	// configstore with the provided config
+	newRouter := func(c *config.Configstore) *mux.Router {
+		s := &Configstore{c: c}
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "POST":
+				w.WriteHeader(http.StatusCreated)
+			default:
+				w.WriteHeader(http.StatusOK)
+			}
+		})
+		notFound := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		})
+
+		router := mux.NewRouter()
+		apirouter := router.PathPrefix("/api/v1alpha").Subrouter()
+		apirouter.Use(s.cacheControlMiddleware)
+		apirouter.Handle("/remotesources", h).Methods("GET")
+		apirouter.Handle("/users", h).Methods("GET", "POST")
+		apirouter.Handle("/users/unexistent", notFound).Methods("GET")
+		apirouter.Handle("/users/{userref}", h).Methods("GET")
+		apirouter.Handle("/orgs", h).Methods("GET")
+		apirouter.Handle("/events", h).Methods("GET").Name(eventsRouteName)
+		return router
+	}
+
+	tests := []struct {
+		name                 string
+		config               *config.Configstore
+		method               string
+		path                 string
+		expectedCacheControl string
+	}{
+		{
+			name:                 "get remote sources",
+			config:               &config.Configstore{},
+			method:               "GET",
+			path:                 "/remotesources",
+			expectedCacheControl: "public, max-age=60",
+		},
+		{
+			name:                 "get users",
+			config:               &config.Configstore{},
+			method:               "GET",
+			path:                 "/users",
+			expectedCacheControl: "no-cache",
+		},
+		{
+			name:                 "get user",
+			config:               &config.Configstore{},
+			method:               "GET",
+			path:                 "/users/user01",
+			expectedCacheControl: "no-cache",
+		},
+		{
+			name:                 "get orgs with configured max age",
+			config:               &config.Configstore{CacheControl: config.CacheControl{MaxAge: map[string]time.Duration{"orgs": 30 * time.Second}}},
+			method:               "GET",
+			path:                 "/orgs",
+			expectedCacheControl: "public, max-age=30",
+		},
+		{
+			name:                 "get users with configured default max age",
+			config:               &config.Configstore{CacheControl: config.CacheControl{DefaultMaxAge: 10 * time.Second}},
+			method:               "GET",
+			path:                 "/users",
+			expectedCacheControl: "public, max-age=10",
+		},
+		{
+			name:                 "get remote sources with authentication enabled",
+			config:               &config.Configstore{Auth: config.ConfigstoreAuth{Enabled: true}},
+			method:               "GET",
+			path:                 "/remotesources",
+			expectedCacheControl: "private, max-age=60",
+		},
+		{
+			name:                 "get unexistent user",
+			config:               &config.Configstore{},
+			method:               "GET",
+			path:                 "/users/unexistent",
+			expectedCacheControl: "no-store",
+		},
+		{
+			name:                 "create user",
+			config:               &config.Configstore{},
+			method:               "POST",
+			path:                 "/users",
+			expectedCacheControl: "no-store",
+		},
+		{
+			name:                 "long lived request",
+			config:               &config.Configstore{CacheControl: config.CacheControl{DefaultMaxAge: 10 * time.Second}},
+			method:               "GET",
+			path:                 "/events",
+			expectedCacheControl: "no-store",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			newRouter(tt.config).ServeHTTP(w, httptest.NewRequest(tt.method, "/api/v1alpha"+tt.path, nil))
+
+			if cacheControl := w.Header().Get("Cache-Control"); cacheControl != tt.expectedCacheControl {
+				t.Fatalf("expected Cache-Control %q, got %q", tt.expectedCacheControl, cacheControl)
+			}
+		})
+	}
+}
@@ -23,6 +23,10 @@ import (
 
 const (
 	EtcdMaintenanceKey = "maintenance"
+
+	// EtcdIdempotencyKeysDir contains the idempotency keys of the create
+	// requests
+	EtcdIdempotencyKeysDir = "idempotencykeys"
 )
 
 type RefType int
@@ -0,0 +1,200 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultCompressionMinSize is the min size of the compressed responses when
+// not configured
+const DefaultCompressionMinSize = 1024
+
+// compressedContentTypes are the content types that are already compressed
+var compressedContentTypes = map[string]struct{}{
+	"application/gzip":   {},
+	"application/x-gzip": {},
+	"application/zip":    {},
+	"application/zstd":   {},
+}
+
+func isCompressedContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if _, ok := compressedContentTypes[mediaType]; ok {
+		return true
+	}
+	return strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/")
+}
+
+// acceptsGzip reports if the request Accept-Encoding header accepts a gzip
+// encoded response
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(v, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(p[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		if q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the response until it reaches minSize. Smaller
+// responses and the ones already encoded or with an already compressed content
+// type are written uncompressed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+
+	status  int
+	buf     []byte
+	started bool
+	gw      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.started || w.status != 0 {
+		return
+	}
+	w.status = status
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.gw != nil {
+		return w.gw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// start writes the response header and the buffered data, compressing them if
+// compress is true and the response can be compressed
+func (w *gzipResponseWriter) start(compress bool) error {
+	w.started = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		// detect it now since it cannot be detected from the compressed data
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if compress && h.Get("Content-Encoding") == "" && !isCompressedContentType(h.Get("Content-Type")) && w.status != http.StatusNoContent && w.status != http.StatusNotModified {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gw = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.gw != nil {
+		_, err := w.gw.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// Flush implements http.Flusher since it's used by streaming handlers like
+// the export handler. A flushed response is compressed also if smaller than
+// minSize since its final size is unknown.
+func (w *gzipResponseWriter) Flush() {
+	if !w.started {
+		if err := w.start(true); err != nil {
+			return
+		}
+	}
+	if w.gw != nil {
+		if err := w.gw.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close writes the remaining buffered data and completes the compressed
+// stream
+func (w *gzipResponseWriter) close() error {
+	if !w.started {
+		if err := w.start(len(w.buf) >= w.minSize); err != nil {
+			return err
+		}
+	}
+	if w.gw != nil {
+		return w.gw.Close()
+	}
+	return nil
+}
+
+// compressionMiddleware is a mux middleware that gzip compresses the
+// responses of the requests accepting a gzip encoding
+func (s *Configstore) compressionMiddleware(h http.Handler) http.Handler {
+	minSize := s.c.Compression.MinSize
+	if minSize == 0 {
+		minSize = DefaultCompressionMinSize
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == "HEAD" || !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize}
+		defer func() {
+			if err := gw.close(); err != nil {
+				log.Errorf("failed to write compressed response: %+v", err)
+			}
+		}()
+		h.ServeHTTP(gw, r)
+	})
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"agola.io/agola/internal/services/config"
+)
+
+func TestCompression(t *testing.T) {
+	largeBody := bytes.Repeat([]byte(`{"name": "project01"}`), 100)
+	smallBody := []byte(`{"name": "user01"}`)
+
+	s := &Configstore{c: &config.Configstore{Compression: config.Compression{Enabled: true}}}
+	h := s.compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(largeBody)
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(smallBody)
+		case "/zip":
+			w.Header().Set("Content-Type", "application/zip")
+			_, _ = w.Write(largeBody)
+		case "/nocontent":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	tests := []struct {
+		name                    string
+		path                    string
+		acceptEncoding          string
+		expectedStatusCode      int
+		expectedContentEncoding string
+		expectedContentType     string
+		expectedBody            []byte
+	}{
+		{
+			name:                    "gzipped large response",
+			path:                    "/large",
+			acceptEncoding:          "gzip",
+			expectedStatusCode:      http.StatusOK,
+			expectedContentEncoding: "gzip",
+			expectedContentType:     "application/json",
+			expectedBody:            largeBody,
+		},
+		{
+			name:                "large response without accepted gzip encoding",
+			path:                "/large",
+			expectedStatusCode:  http.StatusOK,
+			expectedContentType: "application/json",
+			expectedBody:        largeBody,
+		},
+		{
+			name:                "large response with gzip encoding not acceptable",
+			path:                "/large",
+			acceptEncoding:      "gzip;q=0, deflate",
+			expectedStatusCode:  http.StatusOK,
+			expectedContentType: "application/json",
+			expectedBody:        largeBody,
+		},
+		{
+			name:                "small response isn't compressed",
+			path:                "/small",
+			acceptEncoding:      "gzip",
+			expectedStatusCode:  http.StatusOK,
+			expectedContentType: "application/json",
+			expectedBody:        smallBody,
+		},
+		{
+			name:                "already compressed content type isn't compressed",
+			path:                "/zip",
+			acceptEncoding:      "gzip",
+			expectedStatusCode:  http.StatusOK,
+			expectedContentType: "application/zip",
+			expectedBody:        largeBody,
+		},
+		{
+			name:               "no content response isn't compressed",
+			path:               "/nocontent",
+			acceptEncoding:     "gzip",
+			expectedStatusCode: http.StatusNoContent,
+			expectedBody:       []byte{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatusCode {
+				t.Fatalf("expected status code %d, got %d", tt.expectedStatusCode, w.Code)
+			}
+			if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+				t.Fatalf("expected Vary %q, got %q", "Accept-Encoding", vary)
+			}
+			if ce := w.Header().Get("Content-Encoding"); ce != tt.expectedContentEncoding {
+				t.Fatalf("expected content encoding %q, got %q", tt.expectedContentEncoding, ce)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.expectedContentType {
+				t.Fatalf("expected content type %q, got %q", tt.expectedContentType, ct)
+			}
+
+			body := w.Body.Bytes()
+			if tt.expectedContentEncoding == "gzip" {
+				gr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				if body, err = ioutil.ReadAll(gr); err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			}
+			if !bytes.Equal(body, tt.expectedBody) {
+				t.Fatalf("expected body %q, got %q", tt.expectedBody, body)
+			}
+		})
+	}
+}
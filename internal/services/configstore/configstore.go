@@ -17,8 +17,11 @@ package configstore
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net/http"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -32,14 +35,28 @@ import (
 	"agola.io/agola/internal/services/configstore/api"
 	"agola.io/agola/internal/services/configstore/common"
 	"agola.io/agola/internal/services/configstore/readdb"
+	"agola.io/agola/internal/services/configstore/webhook"
 	"agola.io/agola/internal/util"
+	csapitypes "agola.io/agola/services/configstore/api/types"
 	"agola.io/agola/services/configstore/types"
 
+	ghandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	etcdclientv3 "go.etcd.io/etcd/clientv3"
 	"go.etcd.io/etcd/mvcc/mvccpb"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+
+	purgeDeletedResourcesInterval = 1 * time.Minute
+
+	purgeExpiredUserTokensInterval = 1 * time.Minute
+
+	migrateObjectStorageRetryInterval = 1 * time.Minute
 )
 
 var level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
@@ -116,7 +133,13 @@ type Configstore struct {
 	dm              *datamanager.DataManager
 	readDB          *readdb.ReadDB
 	ost             *objectstorage.ObjStorage
+	walsOst         *objectstorage.ObjStorage
+	dataOst         *objectstorage.ObjStorage
 	ah              *action.ActionHandler
+	metrics         *metrics
+	auth            *authHandler
+	rateLimiter     *rateLimiter
+	webhookNotifier *webhook.Notifier
 	maintenanceMode bool
 }
 
@@ -129,25 +152,59 @@ func NewConfigstore(ctx context.Context, l *zap.Logger, c *config.Configstore) (
 	}
 	log = logger.Sugar()
 
-	ost, err := scommon.NewObjectStorage(&c.ObjectStorage)
+	if c.Web.TLS {
+		if c.Web.TLSCertFile == "" {
+			return nil, errors.Errorf("web tls enabled but no tls cert file specified")
+		}
+		if c.Web.TLSKeyFile == "" {
+			return nil, errors.Errorf("web tls enabled but no tls key file specified")
+		}
+	}
+
+	dataDirMode, err := c.DataDirFileMode()
+	if err != nil {
+		return nil, err
+	}
+	if err := setupDataDirs(c.DataDir, dataDirMode); err != nil {
+		return nil, err
+	}
+
+	ost, err := scommon.NewObjectStorage(ctx, logger, &c.ObjectStorage)
 	if err != nil {
 		return nil, err
 	}
+	walsOst, dataOst := ost, ost
+	if c.WalsObjectStorage != nil {
+		walsOst, err = scommon.NewObjectStorage(ctx, logger, c.WalsObjectStorage)
+		if err != nil {
+			return nil, errors.Errorf("failed to create the wals object storage: %w", err)
+		}
+	}
+	if c.DataObjectStorage != nil {
+		dataOst, err = scommon.NewObjectStorage(ctx, logger, c.DataObjectStorage)
+		if err != nil {
+			return nil, errors.Errorf("failed to create the data object storage: %w", err)
+		}
+	}
 	e, err := scommon.NewEtcd(&c.Etcd, logger, "configstore")
 	if err != nil {
 		return nil, err
 	}
 
 	cs := &Configstore{
-		c:   c,
-		e:   e,
-		ost: ost,
+		c:       c,
+		e:       e,
+		ost:     ost,
+		walsOst: walsOst,
+		dataOst: dataOst,
 	}
 
 	dmConf := &datamanager.DataManagerConfig{
 		BasePath: "configdata",
 		E:        e,
 		OST:      ost,
+		WalsOST:  walsOst,
+		DataOST:  dataOst,
 		DataTypes: []string{
 			string(types.ConfigTypeUser),
 			string(types.ConfigTypeOrg),
@@ -157,29 +214,200 @@ func NewConfigstore(ctx context.Context, l *zap.Logger, c *config.Configstore) (
 			string(types.ConfigTypeRemoteSource),
 			string(types.ConfigTypeSecret),
 			string(types.ConfigTypeVariable),
+			string(types.ConfigTypeAuditEntry),
+			string(types.ConfigTypeDeletedResource),
 		},
+		CheckpointInterval:          c.CheckpointInterval,
+		CheckpointWalsSizeThreshold: c.CheckpointWalsSizeThreshold,
+		StorageWalCleanInterval:     c.StorageWalCleanInterval,
+		WalFlushInterval:            c.WalFlushInterval,
+		WalFlushMaxBatchSize:        c.WalFlushMaxBatchSize,
+		WalCompression:              datamanager.WalCompression(c.WalCompression),
+		// a read replica never writes so it must not take the lease from
+		// the writer
+		WriterLease:    c.WalWriterLease && !c.ReadReplica.Enabled,
+		WriterLeaseTTL: c.WalWriterLeaseTTL,
 	}
 	dm, err := datamanager.NewDataManager(ctx, logger, dmConf)
 	if err != nil {
 		return nil, err
 	}
-	readDB, err := readdb.NewReadDB(ctx, logger, filepath.Join(c.DataDir, "readdb"), e, ost, dm)
+	readDB, err := readdb.NewReadDB(ctx, logger, filepath.Join(c.DataDir, "readdb"), e, dataOst, dm, c.ReadDBCacheSize, c.ReadDBCacheTTL)
 	if err != nil {
 		return nil, err
 	}
+	readDB.SetSyncBatch(c.ReadDBSyncBatchSize, c.ReadDBSyncBatchMaxSize)
+	readDB.SetCaseInsensitiveNames(c.UniqueNamePolicy == config.UniqueNamePolicyCaseInsensitive)
 
 	cs.dm = dm
 	cs.readDB = readDB
 
+	secretsKey, err := c.SecretsKey()
+	if err != nil {
+		return nil, err
+	}
+
 	ah := action.NewActionHandler(logger, readDB, dm, e)
+	ah.SetSecretsKey(secretsKey)
+	ah.SetSoftDelete(c.SoftDelete.Enabled, c.SoftDelete.Retention)
+	ah.SetIdempotencyKeyTTL(c.IdempotencyKeyTTL)
+	// a read replica never writes, also the internal writes like the deleted
+	// resources purge are disabled
+	if err := ah.SetReadOnly(ctx, c.ReadOnly || c.ReadReplica.Enabled); err != nil {
+		return nil, err
+	}
 	cs.ah = ah
 
+	cs.metrics = newMetrics(dm, readDB)
+
 	return cs, nil
 }
 
-func (s *Configstore) setupDefaultRouter() http.Handler {
+// migrateObjectStoragesLoop copies the objects of the object storages being
+// migrated from another one, retrying on errors, until all the migrations are
+// completed
+func (s *Configstore) migrateObjectStoragesLoop(ctx context.Context) {
+	var msts []*objectstorage.MigratingStorage
+	for _, ost := range []*objectstorage.ObjStorage{s.ost, s.walsOst, s.dataOst} {
+		mst, ok := ost.Storage.(*objectstorage.MigratingStorage)
+		if !ok {
+			continue
+		}
+		dup := false
+		for _, m := range msts {
+			if m == mst {
+				dup = true
+			}
+		}
+		if !dup {
+			msts = append(msts, mst)
+		}
+	}
+
+	for {
+		completed := true
+		for _, mst := range msts {
+			if mst.Completed() {
+				continue
+			}
+			copied, err := mst.Migrate(ctx)
+			if err != nil {
+				log.Errorf("object storage migration error: %+v", err)
+				completed = false
+				continue
+			}
+			log.Infof("object storage migration completed, copied %d objects", copied)
+		}
+		if completed {
+			return
+		}
+
+		sleepCh := time.NewTimer(migrateObjectStorageRetryInterval).C
+		select {
+		case <-ctx.Done():
+			return
+		case <-sleepCh:
+		}
+	}
+}
+
+// purgeDeletedResourcesLoop periodically removes the soft deleted resources
+// whose retention time has passed
+func (s *Configstore) purgeDeletedResourcesLoop(ctx context.Context) {
+	for {
+		sleepCh := time.NewTimer(purgeDeletedResourcesInterval).C
+		select {
+		case <-ctx.Done():
+			return
+		case <-sleepCh:
+		}
+
+		if s.ah.IsReadOnly() {
+			continue
+		}
+		if err := s.ah.PurgeExpiredDeletedResources(ctx); err != nil {
+			log.Errorf("err: %+v", err)
+		}
+	}
+}
+
+// purgeExpiredUserTokensLoop periodically removes the expired user tokens
+func (s *Configstore) purgeExpiredUserTokensLoop(ctx context.Context) {
+	for {
+		sleepCh := time.NewTimer(purgeExpiredUserTokensInterval).C
+		select {
+		case <-ctx.Done():
+			return
+		case <-sleepCh:
+		}
+
+		if s.ah.IsReadOnly() {
+			continue
+		}
+		if err := s.ah.PurgeExpiredUserTokens(ctx); err != nil {
+			log.Errorf("err: %+v", err)
+		}
+	}
+}
+
+// newAPIRouter returns a router and its subrouter serving the api routes with
+// the api middlewares
+func (s *Configstore) newAPIRouter() (*mux.Router, *mux.Router) {
+	router := mux.NewRouter()
+	router.NotFoundHandler = api.NewNotFoundHandler()
+	router.MethodNotAllowedHandler = api.NewMethodNotAllowedHandler(router)
+	apirouter := router.PathPrefix("/api/" + csapitypes.APIVersion).Subrouter().UseEncodedPath()
+	apirouter.Use(s.metrics.middleware)
+	if s.c.ReadReplica.Enabled {
+		apirouter.Use(s.readReplicaMiddleware)
+	}
+	apirouter.Use(s.timeoutMiddleware)
+	apirouter.Use(s.bodyLimitMiddleware)
+	if s.auth != nil {
+		apirouter.Use(s.auth.middleware)
+	}
+	apirouter.Use(s.revisionMiddleware)
+	apirouter.Use(s.cacheControlMiddleware)
+
+	return router, apirouter
+}
+
+// newMainRouter returns a router with the middlewares applied to all the
+// requests of a listener
+func (s *Configstore) newMainRouter() *mux.Router {
+	mainrouter := mux.NewRouter()
+	mainrouter.Use(requestIDMiddleware)
+	if s.rateLimiter != nil {
+		mainrouter.Use(s.rateLimiter.middleware)
+	}
+	mainrouter.Use(actorMiddleware)
+	mainrouter.Use(idempotencyKeyMiddleware)
+	if s.c.Compression.Enabled {
+		mainrouter.Use(s.compressionMiddleware)
+	}
+
+	return mainrouter
+}
+
+// setupDefaultRouter returns the handlers of the main listener and of the
+// admin listener, nil when the admin listener isn't configured
+func (s *Configstore) setupDefaultRouter() (http.Handler, http.Handler) {
+	healthHandler := api.NewHealthHandler(logger, s.ah, s.dm, s.readDB)
+	versionHandler := api.NewVersionHandler(logger, s.dm)
+	readyHandler := api.NewReadyHandler(logger, s.dm, s.readDB, s.e)
 	maintenanceModeHandler := api.NewMaintenanceModeHandler(logger, s.ah, s.e)
+	readOnlyModeHandler := api.NewReadOnlyModeHandler(logger, s.ah)
 	exportHandler := api.NewExportHandler(logger, s.ah)
+	checkpointHandler := api.NewCheckpointHandler(logger, s.ah)
+	exportResourcesHandler := api.NewExportResourcesHandler(logger, s.ah)
+	importResourcesHandler := api.NewImportResourcesHandler(logger, s.ah)
+	logLevelHandler := api.NewLogLevelHandler(logger, level)
+	setLogLevelHandler := api.NewSetLogLevelHandler(logger, level)
+	selfCheckHandler := api.NewSelfCheckHandler(logger, s.readDB, false)
+	selfCheckRepairHandler := api.NewSelfCheckHandler(logger, s.readDB, true)
+
+	auditEntriesHandler := api.NewAuditEntriesHandler(logger, s.readDB)
+	eventsHandler := api.NewEventsHandler(logger, s.readDB)
 
 	projectGroupHandler := api.NewProjectGroupHandler(logger, s.ah, s.readDB)
 	projectGroupSubgroupsHandler := api.NewProjectGroupSubgroupsHandler(logger, s.ah, s.readDB)
@@ -189,9 +417,19 @@ func (s *Configstore) setupDefaultRouter() http.Handler {
 	deleteProjectGroupHandler := api.NewDeleteProjectGroupHandler(logger, s.ah)
 
 	projectHandler := api.NewProjectHandler(logger, s.ah, s.readDB)
+	projectsHandler := api.NewProjectsHandler(logger, s.readDB, s.c.DefaultProjectsLimit)
+	projectsCountHandler := api.NewProjectsCountHandler(logger, s.readDB)
+	projectAvailabilityHandler := api.NewProjectAvailabilityHandler(logger, s.readDB)
+	userProjectsHandler := api.NewOwnerProjectsHandler(logger, s.readDB, types.ConfigTypeUser, s.c.DefaultProjectsLimit)
+	orgProjectsHandler := api.NewOwnerProjectsHandler(logger, s.readDB, types.ConfigTypeOrg, s.c.DefaultProjectsLimit)
 	createProjectHandler := api.NewCreateProjectHandler(logger, s.ah, s.readDB)
 	updateProjectHandler := api.NewUpdateProjectHandler(logger, s.ah, s.readDB)
+	patchProjectHandler := api.NewPatchProjectHandler(logger, s.ah, s.readDB)
 	deleteProjectHandler := api.NewDeleteProjectHandler(logger, s.ah)
+	deleteProjectsHandler := api.NewDeleteProjectsHandler(logger, s.ah)
+	deleteProjectByIDHandler := api.NewDeleteProjectByIDHandler(logger, s.ah)
+	restoreProjectHandler := api.NewRestoreProjectHandler(logger, s.ah, s.readDB)
+	moveProjectHandler := api.NewMoveProjectHandler(logger, s.ah, s.readDB)
 
 	secretsHandler := api.NewSecretsHandler(logger, s.ah, s.readDB)
 	createSecretHandler := api.NewCreateSecretHandler(logger, s.ah)
@@ -199,22 +437,35 @@ func (s *Configstore) setupDefaultRouter() http.Handler {
 	deleteSecretHandler := api.NewDeleteSecretHandler(logger, s.ah)
 
 	variablesHandler := api.NewVariablesHandler(logger, s.ah, s.readDB)
+	resolvedVariablesHandler := api.NewResolvedVariablesHandler(logger, s.readDB)
 	createVariableHandler := api.NewCreateVariableHandler(logger, s.ah)
 	updateVariableHandler := api.NewUpdateVariableHandler(logger, s.ah)
 	deleteVariableHandler := api.NewDeleteVariableHandler(logger, s.ah)
 
 	userHandler := api.NewUserHandler(logger, s.readDB)
 	usersHandler := api.NewUsersHandler(logger, s.readDB)
+	usersCountHandler := api.NewUsersCountHandler(logger, s.readDB)
+	userNameAvailabilityHandler := api.NewUserNameAvailabilityHandler(logger, s.readDB)
+	userByLinkedAccountHandler := api.NewUserByLinkedAccountHandler(logger, s.readDB)
 	createUserHandler := api.NewCreateUserHandler(logger, s.ah)
+	importUsersHandler := api.NewImportUsersHandler(logger, s.ah)
 	updateUserHandler := api.NewUpdateUserHandler(logger, s.ah)
+	patchUserHandler := api.NewPatchUserHandler(logger, s.ah)
 	deleteUserHandler := api.NewDeleteUserHandler(logger, s.ah)
+	deleteUserByIDHandler := api.NewDeleteUserByIDHandler(logger, s.ah)
+	restoreUserHandler := api.NewRestoreUserHandler(logger, s.ah)
 
+	userLinkedAccountsHandler := api.NewUserLinkedAccountsHandler(logger, s.readDB)
 	createUserLAHandler := api.NewCreateUserLAHandler(logger, s.ah)
 	deleteUserLAHandler := api.NewDeleteUserLAHandler(logger, s.ah)
+	deleteUserLAsHandler := api.NewDeleteUserLAsHandler(logger, s.ah)
 	updateUserLAHandler := api.NewUpdateUserLAHandler(logger, s.ah)
+	updateUserLATokenHandler := api.NewUpdateUserLATokenHandler(logger, s.ah)
 
+	userTokensHandler := api.NewUserTokensHandler(logger, s.readDB)
 	createUserTokenHandler := api.NewCreateUserTokenHandler(logger, s.ah)
 	deleteUserTokenHandler := api.NewDeleteUserTokenHandler(logger, s.ah)
+	introspectUserTokenHandler := api.NewIntrospectUserTokenHandler(logger, s.readDB)
 
 	userOrgsHandler := api.NewUserOrgsHandler(logger, s.ah)
 
@@ -231,101 +482,275 @@ func (s *Configstore) setupDefaultRouter() http.Handler {
 	remoteSourcesHandler := api.NewRemoteSourcesHandler(logger, s.readDB)
 	createRemoteSourceHandler := api.NewCreateRemoteSourceHandler(logger, s.ah)
 	updateRemoteSourceHandler := api.NewUpdateRemoteSourceHandler(logger, s.ah)
+	patchRemoteSourceHandler := api.NewPatchRemoteSourceHandler(logger, s.ah)
+	rotateRemoteSourceSecretHandler := api.NewRotateRemoteSourceSecretHandler(logger, s.ah)
 	deleteRemoteSourceHandler := api.NewDeleteRemoteSourceHandler(logger, s.ah)
+	githubAppInstallationTokenHandler := api.NewGithubAppInstallationTokenHandler(logger, s.ah)
+	testRemoteSourceHandler := api.NewTestRemoteSourceHandler(logger, s.ah)
 
-	router := mux.NewRouter()
-	apirouter := router.PathPrefix("/api/v1alpha").Subrouter().UseEncodedPath()
+	searchHandler := api.NewSearchHandler(logger, s.readDB)
 
-	apirouter.Handle("/projectgroups/{projectgroupref}", projectGroupHandler).Methods("GET")
-	apirouter.Handle("/projectgroups/{projectgroupref}/subgroups", projectGroupSubgroupsHandler).Methods("GET")
-	apirouter.Handle("/projectgroups/{projectgroupref}/projects", projectGroupProjectsHandler).Methods("GET")
-	apirouter.Handle("/projectgroups", createProjectGroupHandler).Methods("POST")
-	apirouter.Handle("/projectgroups/{projectgroupref}", updateProjectGroupHandler).Methods("PUT")
-	apirouter.Handle("/projectgroups/{projectgroupref}", deleteProjectGroupHandler).Methods("DELETE")
+	router, apirouter := s.newAPIRouter()
+	// the admin api routes are registered in adminapirouter, served by the
+	// admin listener when configured
+	adminrouter, adminapirouter := router, apirouter
+	if s.c.Admin.ListenAddress != "" {
+		adminrouter, adminapirouter = s.newAPIRouter()
+	}
 
-	apirouter.Handle("/projects/{projectref}", projectHandler).Methods("GET")
+	apirouter.Handle("/projectgroups/{projectgroupref}", s.accessHandler(types.ConfigTypeProjectGroup, projectGroupHandler)).Methods("GET")
+	apirouter.Handle("/projectgroups/{projectgroupref}/subgroups", s.accessHandler(types.ConfigTypeProjectGroup, projectGroupSubgroupsHandler)).Methods("GET")
+	apirouter.Handle("/projectgroups/{projectgroupref}/projects", s.accessHandler(types.ConfigTypeProjectGroup, projectGroupProjectsHandler)).Methods("GET")
+	apirouter.Handle("/projectgroups", createProjectGroupHandler).Methods("POST")
+	apirouter.Handle("/projectgroups/{projectgroupref}", s.accessHandler(types.ConfigTypeProjectGroup, updateProjectGroupHandler)).Methods("PUT")
+	apirouter.Handle("/projectgroups/{projectgroupref}", s.accessHandler(types.ConfigTypeProjectGroup, deleteProjectGroupHandler)).Methods("DELETE")
+
+	apirouter.Handle("/projects", projectsHandler).Methods("GET")
+	// must be registered before the project route
+	apirouter.Handle("/projects/count", projectsCountHandler).Methods("GET")
+	apirouter.Handle("/projects/{projectref}", s.accessHandler(types.ConfigTypeProject, projectHandler)).Methods("GET")
+	apirouter.Handle("/projects/{projectpath}/available", projectAvailabilityHandler).Methods("GET")
 	apirouter.Handle("/projects", createProjectHandler).Methods("POST")
-	apirouter.Handle("/projects/{projectref}", updateProjectHandler).Methods("PUT")
-	apirouter.Handle("/projects/{projectref}", deleteProjectHandler).Methods("DELETE")
-
-	apirouter.Handle("/projectgroups/{projectgroupref}/secrets", secretsHandler).Methods("GET")
-	apirouter.Handle("/projects/{projectref}/secrets", secretsHandler).Methods("GET")
-	apirouter.Handle("/projectgroups/{projectgroupref}/secrets", createSecretHandler).Methods("POST")
-	apirouter.Handle("/projects/{projectref}/secrets", createSecretHandler).Methods("POST")
-	apirouter.Handle("/projectgroups/{projectgroupref}/secrets/{secretname}", updateSecretHandler).Methods("PUT")
-	apirouter.Handle("/projects/{projectref}/secrets/{secretname}", updateSecretHandler).Methods("PUT")
-	apirouter.Handle("/projectgroups/{projectgroupref}/secrets/{secretname}", deleteSecretHandler).Methods("DELETE")
-	apirouter.Handle("/projects/{projectref}/secrets/{secretname}", deleteSecretHandler).Methods("DELETE")
-
-	apirouter.Handle("/projectgroups/{projectgroupref}/variables", variablesHandler).Methods("GET")
-	apirouter.Handle("/projects/{projectref}/variables", variablesHandler).Methods("GET")
-	apirouter.Handle("/projectgroups/{projectgroupref}/variables", createVariableHandler).Methods("POST")
-	apirouter.Handle("/projects/{projectref}/variables", createVariableHandler).Methods("POST")
-	apirouter.Handle("/projectgroups/{projectgroupref}/variables/{variablename}", updateVariableHandler).Methods("PUT")
-	apirouter.Handle("/projects/{projectref}/variables/{variablename}", updateVariableHandler).Methods("PUT")
-	apirouter.Handle("/projectgroups/{projectgroupref}/variables/{variablename}", deleteVariableHandler).Methods("DELETE")
-	apirouter.Handle("/projects/{projectref}/variables/{variablename}", deleteVariableHandler).Methods("DELETE")
-
-	apirouter.Handle("/users/{userref}", userHandler).Methods("GET")
+	apirouter.Handle("/projects/{projectref}", s.accessHandler(types.ConfigTypeProject, updateProjectHandler)).Methods("PUT")
+	apirouter.Handle("/projects/{projectref}", s.accessHandler(types.ConfigTypeProject, patchProjectHandler)).Methods("PATCH")
+	apirouter.Handle("/projects/{projectref}", s.accessHandler(types.ConfigTypeProject, deleteProjectHandler)).Methods("DELETE")
+	apirouter.Handle("/projects", s.adminHandler(deleteProjectsHandler)).Methods("DELETE")
+	apirouter.Handle("/project/{projectid}", s.accessHandler(types.ConfigTypeProject, deleteProjectByIDHandler)).Methods("DELETE")
+	apirouter.Handle("/project/{projectid}/restore", s.accessHandler(types.ConfigTypeProject, restoreProjectHandler)).Methods("POST")
+	apirouter.Handle("/project/{projectid}/move", s.accessHandler(types.ConfigTypeProject, moveProjectHandler)).Methods("PATCH")
+
+	apirouter.Handle("/projectgroups/{projectgroupref}/secrets", s.accessHandler(types.ConfigTypeProjectGroup, secretsHandler)).Methods("GET")
+	apirouter.Handle("/projects/{projectref}/secrets", s.accessHandler(types.ConfigTypeProject, secretsHandler)).Methods("GET")
+	apirouter.Handle("/projectgroups/{projectgroupref}/secrets", s.accessHandler(types.ConfigTypeProjectGroup, createSecretHandler)).Methods("POST")
+	apirouter.Handle("/projects/{projectref}/secrets", s.accessHandler(types.ConfigTypeProject, createSecretHandler)).Methods("POST")
+	apirouter.Handle("/projectgroups/{projectgroupref}/secrets/{secretname}", s.accessHandler(types.ConfigTypeProjectGroup, updateSecretHandler)).Methods("PUT")
+	apirouter.Handle("/projects/{projectref}/secrets/{secretname}", s.accessHandler(types.ConfigTypeProject, updateSecretHandler)).Methods("PUT")
+	apirouter.Handle("/projectgroups/{projectgroupref}/secrets/{secretname}", s.accessHandler(types.ConfigTypeProjectGroup, deleteSecretHandler)).Methods("DELETE")
+	apirouter.Handle("/projects/{projectref}/secrets/{secretname}", s.accessHandler(types.ConfigTypeProject, deleteSecretHandler)).Methods("DELETE")
+
+	apirouter.Handle("/projectgroups/{projectgroupref}/variables", s.accessHandler(types.ConfigTypeProjectGroup, variablesHandler)).Methods("GET")
+	apirouter.Handle("/projects/{projectref}/variables", s.accessHandler(types.ConfigTypeProject, variablesHandler)).Methods("GET")
+	apirouter.Handle("/projectgroups/{projectgroupref}/resolvedvariables", s.accessHandler(types.ConfigTypeProjectGroup, resolvedVariablesHandler)).Methods("GET")
+	apirouter.Handle("/projects/{projectref}/resolvedvariables", s.accessHandler(types.ConfigTypeProject, resolvedVariablesHandler)).Methods("GET")
+	apirouter.Handle("/projectgroups/{projectgroupref}/variables", s.accessHandler(types.ConfigTypeProjectGroup, createVariableHandler)).Methods("POST")
+	apirouter.Handle("/projects/{projectref}/variables", s.accessHandler(types.ConfigTypeProject, createVariableHandler)).Methods("POST")
+	apirouter.Handle("/projectgroups/{projectgroupref}/variables/{variablename}", s.accessHandler(types.ConfigTypeProjectGroup, updateVariableHandler)).Methods("PUT")
+	apirouter.Handle("/projects/{projectref}/variables/{variablename}", s.accessHandler(types.ConfigTypeProject, updateVariableHandler)).Methods("PUT")
+	apirouter.Handle("/projectgroups/{projectgroupref}/variables/{variablename}", s.accessHandler(types.ConfigTypeProjectGroup, deleteVariableHandler)).Methods("DELETE")
+	apirouter.Handle("/projects/{projectref}/variables/{variablename}", s.accessHandler(types.ConfigTypeProject, deleteVariableHandler)).Methods("DELETE")
+
+	// must be registered before the user route
+	apirouter.Handle("/users/byLinkedAccount", userByLinkedAccountHandler).Methods("GET")
+	apirouter.Handle("/users/count", usersCountHandler).Methods("GET")
+	apirouter.Handle("/users/{userref}", s.accessHandler(types.ConfigTypeUser, userHandler)).Methods("GET")
+	apirouter.Handle("/users/{username}/available", userNameAvailabilityHandler).Methods("GET")
 	apirouter.Handle("/users", usersHandler).Methods("GET")
 	apirouter.Handle("/users", createUserHandler).Methods("POST")
-	apirouter.Handle("/users/{userref}", updateUserHandler).Methods("PUT")
-	apirouter.Handle("/users/{userref}", deleteUserHandler).Methods("DELETE")
+	apirouter.Handle("/users/import", importUsersHandler).Methods("POST").Name(usersImportRouteName)
+	apirouter.Handle("/users/{userref}", s.accessHandler(types.ConfigTypeUser, updateUserHandler)).Methods("PUT")
+	apirouter.Handle("/users/{userref}", s.accessHandler(types.ConfigTypeUser, patchUserHandler)).Methods("PATCH")
+	apirouter.Handle("/users/{userref}", s.accessHandler(types.ConfigTypeUser, deleteUserHandler)).Methods("DELETE")
+	apirouter.Handle("/user/{userid}", s.accessHandler(types.ConfigTypeUser, deleteUserByIDHandler)).Methods("DELETE")
+	apirouter.Handle("/user/{userid}/restore", s.accessHandler(types.ConfigTypeUser, restoreUserHandler)).Methods("POST")
+
+	apirouter.Handle("/users/{userref}/linkedaccounts", s.accessHandler(types.ConfigTypeUser, userLinkedAccountsHandler)).Methods("GET")
+	apirouter.Handle("/users/{userref}/linkedaccounts", s.accessHandler(types.ConfigTypeUser, createUserLAHandler)).Methods("POST")
+	apirouter.Handle("/users/{userref}/linkedaccounts", s.accessHandler(types.ConfigTypeUser, deleteUserLAsHandler)).Methods("DELETE")
+	apirouter.Handle("/users/{userref}/linkedaccounts/{laid}", s.accessHandler(types.ConfigTypeUser, deleteUserLAHandler)).Methods("DELETE")
+	apirouter.Handle("/users/{userref}/linkedaccounts/{laid}", s.accessHandler(types.ConfigTypeUser, updateUserLAHandler)).Methods("PUT")
+	apirouter.Handle("/users/{userref}/linkedaccounts/{laid}/token", s.accessHandler(types.ConfigTypeUser, updateUserLATokenHandler)).Methods("PUT")
+	apirouter.Handle("/users/{userref}/tokens", s.accessHandler(types.ConfigTypeUser, userTokensHandler)).Methods("GET")
+	apirouter.Handle("/users/{userref}/tokens", s.accessHandler(types.ConfigTypeUser, createUserTokenHandler)).Methods("POST")
+	apirouter.Handle("/users/{userref}/tokens/{tokenname}", s.accessHandler(types.ConfigTypeUser, deleteUserTokenHandler)).Methods("DELETE")
+	apirouter.Handle("/auth/token/introspect", s.adminHandler(introspectUserTokenHandler)).Methods("POST")
+
+	apirouter.Handle("/users/{userref}/orgs", s.accessHandler(types.ConfigTypeUser, userOrgsHandler)).Methods("GET")
+	apirouter.Handle("/users/{userref}/projects", s.accessHandler(types.ConfigTypeUser, userProjectsHandler)).Methods("GET")
+
+	apirouter.Handle("/orgs/{orgref}", s.accessHandler(types.ConfigTypeOrg, orgHandler)).Methods("GET")
+	apirouter.Handle("/orgs", orgsHandler).Methods("GET")
+	apirouter.Handle("/orgs", createOrgHandler).Methods("POST")
+	apirouter.Handle("/orgs/{orgref}", s.accessHandler(types.ConfigTypeOrg, deleteOrgHandler)).Methods("DELETE")
+	apirouter.Handle("/orgs/{orgref}/members", s.accessHandler(types.ConfigTypeOrg, orgMembersHandler)).Methods("GET")
+	apirouter.Handle("/orgs/{orgref}/projects", s.accessHandler(types.ConfigTypeOrg, orgProjectsHandler)).Methods("GET")
+	apirouter.Handle("/orgs/{orgref}/members/{userref}", s.accessHandler(types.ConfigTypeOrg, addOrgMemberHandler)).Methods("PUT")
+	apirouter.Handle("/orgs/{orgref}/members/{userref}", s.accessHandler(types.ConfigTypeOrg, removeOrgMemberHandler)).Methods("DELETE")
 
-	apirouter.Handle("/users/{userref}/linkedaccounts", createUserLAHandler).Methods("POST")
-	apirouter.Handle("/users/{userref}/linkedaccounts/{laid}", deleteUserLAHandler).Methods("DELETE")
-	apirouter.Handle("/users/{userref}/linkedaccounts/{laid}", updateUserLAHandler).Methods("PUT")
-	apirouter.Handle("/users/{userref}/tokens", createUserTokenHandler).Methods("POST")
-	apirouter.Handle("/users/{userref}/tokens/{tokenname}", deleteUserTokenHandler).Methods("DELETE")
+	apirouter.Handle("/remotesources/{remotesourceref}", s.adminHandler(remoteSourceHandler)).Methods("GET")
+	apirouter.Handle("/remotesources", s.adminHandler(remoteSourcesHandler)).Methods("GET")
+	apirouter.Handle("/remotesources", s.adminHandler(createRemoteSourceHandler)).Methods("POST")
+	apirouter.Handle("/remotesources/{remotesourceref}", s.adminHandler(updateRemoteSourceHandler)).Methods("PUT")
+	apirouter.Handle("/remotesources/{remotesourceref}", s.adminHandler(patchRemoteSourceHandler)).Methods("PATCH")
+	apirouter.Handle("/remotesources/{remotesourceref}/rotatesecret", s.adminHandler(rotateRemoteSourceSecretHandler)).Methods("POST")
+	apirouter.Handle("/remotesources/{remotesourceref}", s.adminHandler(deleteRemoteSourceHandler)).Methods("DELETE")
+	apirouter.Handle("/remotesources/{remotesourceref}/installationtoken", s.adminHandler(githubAppInstallationTokenHandler)).Methods("GET")
+	apirouter.Handle("/remotesources/{remotesourceref}/test", s.adminHandler(testRemoteSourceHandler)).Methods("POST")
 
-	apirouter.Handle("/users/{userref}/orgs", userOrgsHandler).Methods("GET")
+	apirouter.Handle("/search", searchHandler).Methods("GET")
 
-	apirouter.Handle("/orgs/{orgref}", orgHandler).Methods("GET")
-	apirouter.Handle("/orgs", orgsHandler).Methods("GET")
-	apirouter.Handle("/orgs", createOrgHandler).Methods("POST")
-	apirouter.Handle("/orgs/{orgref}", deleteOrgHandler).Methods("DELETE")
-	apirouter.Handle("/orgs/{orgref}/members", orgMembersHandler).Methods("GET")
-	apirouter.Handle("/orgs/{orgref}/members/{userref}", addOrgMemberHandler).Methods("PUT")
-	apirouter.Handle("/orgs/{orgref}/members/{userref}", removeOrgMemberHandler).Methods("DELETE")
+	apirouter.Handle("/maintenance", s.adminHandler(maintenanceModeHandler)).Methods("PUT", "DELETE")
 
-	apirouter.Handle("/remotesources/{remotesourceref}", remoteSourceHandler).Methods("GET")
-	apirouter.Handle("/remotesources", remoteSourcesHandler).Methods("GET")
-	apirouter.Handle("/remotesources", createRemoteSourceHandler).Methods("POST")
-	apirouter.Handle("/remotesources/{remotesourceref}", updateRemoteSourceHandler).Methods("PUT")
-	apirouter.Handle("/remotesources/{remotesourceref}", deleteRemoteSourceHandler).Methods("DELETE")
+	apirouter.Handle("/export", s.adminHandler(exportHandler)).Methods("GET").Name(exportRouteName)
 
-	apirouter.Handle("/maintenance", maintenanceModeHandler).Methods("PUT", "DELETE")
+	apirouter.Handle("/checkpoint", s.adminHandler(checkpointHandler)).Methods("POST")
 
-	apirouter.Handle("/export", exportHandler).Methods("GET")
+	apirouter.Handle("/audit", s.adminHandler(auditEntriesHandler)).Methods("GET")
 
-	mainrouter := mux.NewRouter()
+	apirouter.Handle("/events", eventsHandler).Methods("GET").Name(eventsRouteName)
+
+	adminapirouter.Handle("/admin/loglevel", s.adminHandler(logLevelHandler)).Methods("GET")
+	adminapirouter.Handle("/admin/loglevel", s.adminHandler(setLogLevelHandler)).Methods("PUT").Name(setLogLevelRouteName)
+
+	adminapirouter.Handle("/admin/readonly", s.adminHandler(readOnlyModeHandler)).Methods("PUT", "DELETE")
+
+	adminapirouter.Handle("/admin/export", s.adminHandler(exportResourcesHandler)).Methods("GET").Name(resourcesExportRouteName)
+	adminapirouter.Handle("/admin/import", s.adminHandler(importResourcesHandler)).Methods("POST").Name(resourcesImportRouteName)
+
+	adminapirouter.Handle("/admin/selfcheck", s.adminHandler(selfCheckHandler)).Methods("GET")
+	adminapirouter.Handle("/admin/selfcheck/repair", s.adminHandler(selfCheckRepairHandler)).Methods("POST").Name(selfCheckRepairRouteName)
+
+	apirouter.Handle("/version", versionHandler).Methods("GET")
+
+	apirouter.Handle("/openapi.json", newOpenAPIHandler(apirouter)).Methods("GET")
+
+	mainrouter := s.newMainRouter()
+	mainrouter.Handle("/health", healthHandler).Methods("GET")
+	mainrouter.Handle("/ready", readyHandler).Methods("GET")
+	if s.c.Metrics.Enabled && s.c.Metrics.ListenAddress == "" && s.c.Admin.ListenAddress == "" {
+		mainrouter.Handle("/metrics", s.metrics.handler()).Methods("GET")
+	}
 	mainrouter.PathPrefix("/").Handler(router)
 
-	return mainrouter
+	if s.c.Admin.ListenAddress == "" {
+		return mainrouter, nil
+	}
+	return mainrouter, s.setupAdminRouter(adminrouter)
+}
+
+// accessHandler requires the request principal to be able to access the
+// resource of type resourceType of the handler h route when the api
+// authentication is enabled
+func (s *Configstore) accessHandler(resourceType types.ConfigType, h http.Handler) http.Handler {
+	if s.auth == nil {
+		return h
+	}
+	hideDenied := s.c.Auth.AccessDeniedPolicy == config.AccessDeniedPolicyNotFound
+	return api.NewResourceAccessHandler(logger, s.readDB, resourceType, hideDenied, h)
+}
+
+// adminHandler requires the admin token scope to execute the administrative
+// handler h when the api authentication is enabled
+func (s *Configstore) adminHandler(h http.Handler) http.Handler {
+	if s.auth == nil {
+		return h
+	}
+	return s.auth.requireScope(types.TokenScopeAdmin, h)
 }
 
-func (s *Configstore) setupMaintenanceRouter() http.Handler {
+// setupMaintenanceRouter returns the handlers of the main listener and of the
+// admin listener in maintenance mode, like setupDefaultRouter
+func (s *Configstore) setupMaintenanceRouter() (http.Handler, http.Handler) {
+	healthHandler := api.NewHealthHandler(logger, s.ah, s.dm, s.readDB)
+	versionHandler := api.NewVersionHandler(logger, s.dm)
+	readyHandler := api.NewReadyHandler(logger, s.dm, s.readDB, s.e)
 	maintenanceModeHandler := api.NewMaintenanceModeHandler(logger, s.ah, s.e)
 	exportHandler := api.NewExportHandler(logger, s.ah)
 	importHandler := api.NewImportHandler(logger, s.ah)
+	logLevelHandler := api.NewLogLevelHandler(logger, level)
+	setLogLevelHandler := api.NewSetLogLevelHandler(logger, level)
+
+	router, apirouter := s.newAPIRouter()
+	// the admin api routes are registered in adminapirouter, served by the
+	// admin listener when configured
+	adminrouter, adminapirouter := router, apirouter
+	if s.c.Admin.ListenAddress != "" {
+		adminrouter, adminapirouter = s.newAPIRouter()
+	}
 
-	router := mux.NewRouter()
-	apirouter := router.PathPrefix("/api/v1alpha").Subrouter().UseEncodedPath()
+	apirouter.Handle("/maintenance", s.adminHandler(maintenanceModeHandler)).Methods("PUT", "DELETE")
 
-	apirouter.Handle("/maintenance", maintenanceModeHandler).Methods("PUT", "DELETE")
+	apirouter.Handle("/export", s.adminHandler(exportHandler)).Methods("GET").Name(exportRouteName)
+	apirouter.Handle("/import", s.adminHandler(importHandler)).Methods("POST").Name(importRouteName)
 
-	apirouter.Handle("/export", exportHandler).Methods("GET")
-	apirouter.Handle("/import", importHandler).Methods("POST")
+	adminapirouter.Handle("/admin/loglevel", s.adminHandler(logLevelHandler)).Methods("GET")
+	adminapirouter.Handle("/admin/loglevel", s.adminHandler(setLogLevelHandler)).Methods("PUT").Name(setLogLevelRouteName)
 
-	mainrouter := mux.NewRouter()
+	apirouter.Handle("/version", versionHandler).Methods("GET")
+
+	apirouter.Handle("/openapi.json", newOpenAPIHandler(apirouter)).Methods("GET")
+
+	mainrouter := s.newMainRouter()
+	mainrouter.Handle("/health", healthHandler).Methods("GET")
+	mainrouter.Handle("/ready", readyHandler).Methods("GET")
+	if s.c.Metrics.Enabled && s.c.Metrics.ListenAddress == "" && s.c.Admin.ListenAddress == "" {
+		mainrouter.Handle("/metrics", s.metrics.handler()).Methods("GET")
+	}
 	mainrouter.PathPrefix("/").Handler(router)
 
-	return mainrouter
+	if s.c.Admin.ListenAddress == "" {
+		return mainrouter, nil
+	}
+	return mainrouter, s.setupAdminRouter(adminrouter)
+}
+
+// activeRequests keeps track of the in flight http requests
+type activeRequests struct {
+	requests map[*http.Request]struct{}
+	sync.Mutex
 }
 
+func newActiveRequests() *activeRequests {
+	return &activeRequests{requests: make(map[*http.Request]struct{})}
+}
+
+func (a *activeRequests) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.Lock()
+		a.requests[r] = struct{}{}
+		a.Unlock()
+
+		defer func() {
+			a.Lock()
+			delete(a.requests, r)
+			a.Unlock()
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (a *activeRequests) list() []string {
+	a.Lock()
+	defer a.Unlock()
+
+	l := []string{}
+	for r := range a.requests {
+		l = append(l, fmt.Sprintf("%s %s", r.Method, r.URL.Path))
+	}
+	sort.Strings(l)
+	return l
+}
+
+// shutdownHTTPServer gracefully shuts down the http server waiting for the in
+// flight requests to complete. If they don't complete before timeout the server
+// is forcibly closed.
+func shutdownHTTPServer(httpServer *http.Server, ar *activeRequests, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Warnf("http server shutdown not completed in %s, closing it. Active requests: %s", timeout, strings.Join(ar.list(), ", "))
+		httpServer.Close()
+	}
+}
+
+// Run runs the configstore until ctx is done, restarting it on errors. When
+// it returns all the configstore goroutines have exited and the returned error
+// contains the errors of the last run.
 func (s *Configstore) Run(ctx context.Context) error {
 	for {
-		if err := s.run(ctx); err != nil {
+		err := s.run(ctx)
+		if err != nil {
 			log.Errorf("run error: %+v", err)
 		}
 
@@ -333,7 +758,10 @@ func (s *Configstore) Run(ctx context.Context) error {
 		select {
 		case <-ctx.Done():
 			log.Infof("configstore exiting")
-			return nil
+			if err := s.e.Close(); err != nil {
+				log.Errorf("failed to close etcd store: %+v", err)
+			}
+			return err
 		case <-sleepCh:
 		}
 	}
@@ -345,7 +773,8 @@ func (s *Configstore) run(ctx context.Context) error {
 		var err error
 		tlsConfig, err = util.NewTLSConfig(s.c.Web.TLSCertFile, s.c.Web.TLSKeyFile, "", false)
 		if err != nil {
-			log.Errorf("err: %+v")
+			err = errors.Errorf("failed to create tls config (cert file: %q, key file: %q): %w", s.c.Web.TLSCertFile, s.c.Web.TLSKeyFile, err)
+			log.Errorf("err: %+v", err)
 			return err
 		}
 	}
@@ -365,60 +794,192 @@ func (s *Configstore) run(ctx context.Context) error {
 	s.dm.SetMaintenanceMode(maintenanceMode)
 	s.ah.SetMaintenanceMode(maintenanceMode)
 
-	ctx, cancel := context.WithCancel(ctx)
+	// the run context isn't derived from the parent context since, on exit, the
+	// datamanager and readdb must be stopped only after the http server has
+	// drained the in flight requests
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	errCh := make(chan error, 100)
 	var wg sync.WaitGroup
-	dmReadyCh := make(chan struct{})
+	dmReadyCh := make(chan struct{}, 1)
+
+	s.auth = nil
+	if s.c.Auth.Enabled {
+		s.auth = newAuthHandler(
+			&adminTokenAuthenticator{token: s.c.Auth.AdminToken},
+			&userTokenAuthenticator{readDB: s.readDB},
+		)
+	}
+
+	s.rateLimiter = nil
+	if s.c.RateLimit.Enabled {
+		s.rateLimiter = newRateLimiter(&s.c.RateLimit, s.auth)
+	}
 
-	var mainrouter http.Handler
+	// the notifier is kept between runs to not lose the queued events
+	if s.webhookNotifier == nil && len(s.c.Webhooks.URLs) > 0 {
+		s.webhookNotifier = webhook.NewNotifier(logger, &s.c.Webhooks, filepath.Join(s.c.DataDir, "webhooks-deadletter.log"))
+		s.ah.SetChangeNotifier(s.webhookNotifier)
+	}
+
+	var mainrouter, adminrouter http.Handler
 	if s.maintenanceMode {
-		mainrouter = s.setupMaintenanceRouter()
-		util.GoWait(&wg, func() { s.maintenanceModeWatcherLoop(ctx, cancel, s.maintenanceMode) })
+		mainrouter, adminrouter = s.setupMaintenanceRouter()
+		util.GoWait(&wg, func() { s.maintenanceModeWatcherLoop(runCtx, cancel, s.maintenanceMode) })
 
 	} else {
-		mainrouter = s.setupDefaultRouter()
+		mainrouter, adminrouter = s.setupDefaultRouter()
 
-		util.GoWait(&wg, func() { s.maintenanceModeWatcherLoop(ctx, cancel, s.maintenanceMode) })
+		util.GoWait(&wg, func() { s.maintenanceModeWatcherLoop(runCtx, cancel, s.maintenanceMode) })
 
-		// TODO(sgotti) wait for all goroutines exiting
-		util.GoWait(&wg, func() { errCh <- s.dm.Run(ctx, dmReadyCh) })
+		util.GoWait(&wg, func() { errCh <- s.dm.Run(runCtx, dmReadyCh) })
 
 		// wait for dm to be ready
-		<-dmReadyCh
+		select {
+		case <-dmReadyCh:
+		case <-ctx.Done():
+			cancel()
+			wg.Wait()
+			return nil
+		}
 
-		util.GoWait(&wg, func() { errCh <- s.readDB.Run(ctx) })
+		util.GoWait(&wg, func() { errCh <- s.readDB.Run(runCtx) })
+
+		util.GoWait(&wg, func() { s.purgeDeletedResourcesLoop(runCtx) })
+
+		util.GoWait(&wg, func() { s.purgeExpiredUserTokensLoop(runCtx) })
+
+		util.GoWait(&wg, func() { s.migrateObjectStoragesLoop(runCtx) })
+
+		if s.webhookNotifier != nil {
+			util.GoWait(&wg, func() { s.webhookNotifier.Run(runCtx) })
+		}
 	}
 
+	// noop cors handler, cross origin requests aren't allowed
+	corsHandler := func(h http.Handler) http.Handler {
+		return h
+	}
+
+	if len(s.c.Web.AllowedOrigins) > 0 {
+		corsAllowedMethodsOptions := ghandlers.AllowedMethods(s.c.Web.CORSAllowedMethods())
+		corsAllowedHeadersOptions := ghandlers.AllowedHeaders(s.c.Web.CORSAllowedHeaders())
+		corsAllowedOriginsOptions := ghandlers.AllowedOrigins(s.c.Web.AllowedOrigins)
+		corsMaxAgeOptions := ghandlers.MaxAge(s.c.Web.CORSMaxAge())
+		corsHandler = ghandlers.CORS(corsAllowedMethodsOptions, corsAllowedHeadersOptions, corsAllowedOriginsOptions, corsMaxAgeOptions)
+	}
+
+	activeRequests := newActiveRequests()
+
 	httpServer := http.Server{
 		Addr:      s.c.Web.ListenAddress,
-		Handler:   mainrouter,
+		Handler:   activeRequests.handler(corsHandler(mainrouter)),
 		TLSConfig: tlsConfig,
 	}
+	if err := setupHTTP2(&httpServer, &s.c.HTTP2); err != nil {
+		log.Errorf("err: %+v", err)
+		cancel()
+		wg.Wait()
+		return err
+	}
+
+	// close the events streams since they don't end by themself
+	httpServer.RegisterOnShutdown(s.readDB.CloseSubscriptions)
 
-	lerrCh := make(chan error, 1)
+	lerrCh := make(chan error, 3)
 	util.GoWait(&wg, func() {
+		if tlsConfig != nil {
+			// the certificates are already loaded in the tls config
+			lerrCh <- httpServer.ListenAndServeTLS("", "")
+			return
+		}
 		lerrCh <- httpServer.ListenAndServe()
 	})
 	defer httpServer.Close()
 
+	// serve metrics on a dedicated listener when requested
+	metricsServer := http.Server{
+		Addr:    s.c.Metrics.ListenAddress,
+		Handler: s.metrics.handler(),
+	}
+	if s.c.Metrics.Enabled && s.c.Metrics.ListenAddress != "" {
+		util.GoWait(&wg, func() {
+			lerrCh <- metricsServer.ListenAndServe()
+		})
+	}
+	defer metricsServer.Close()
+
+	// serve the admin routes on a dedicated listener when requested. The
+	// admin listener doesn't use tls, it's expected to be reachable only from
+	// a trusted network
+	adminActiveRequests := newActiveRequests()
+	adminServer := http.Server{
+		Addr:    s.c.Admin.ListenAddress,
+		Handler: adminActiveRequests.handler(adminrouter),
+	}
+	if adminrouter != nil {
+		util.GoWait(&wg, func() {
+			lerrCh <- adminServer.ListenAndServe()
+		})
+	}
+	defer adminServer.Close()
+
+	errs := &util.Errors{}
 	select {
 	case <-ctx.Done():
 		log.Infof("configstore run exiting")
+	case <-runCtx.Done():
+		log.Infof("configstore run exiting")
 	case err := <-lerrCh:
 		if err != nil {
 			log.Errorf("http server listen error: %+v", err)
-			return err
+			errs.Append(err)
 		}
 	case err := <-errCh:
 		if err != nil {
 			log.Errorf("error: %+v", err)
-			return err
+			errs.Append(err)
 		}
 	}
 
+	// the shutdown is done in order: the listeners stop accepting new requests
+	// and drain the in flight ones, then the background goroutines are stopped
+	shutdownTimeout := s.c.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	// shutdown the listeners concurrently so the whole shutdown doesn't take
+	// more than the shutdown timeout
+	var swg sync.WaitGroup
+	util.GoWait(&swg, func() { shutdownHTTPServer(&httpServer, activeRequests, shutdownTimeout) })
+	if adminrouter != nil {
+		util.GoWait(&swg, func() { shutdownHTTPServer(&adminServer, adminActiveRequests, shutdownTimeout) })
+	}
+	swg.Wait()
+	metricsServer.Close()
+
+	// stop the datamanager and readdb only after the http server has been drained
+	// and wait for all the goroutines to exit
 	cancel()
-	httpServer.Close()
 	wg.Wait()
 
-	return err
+	// report also the errors of the goroutines that failed while stopping. All
+	// the goroutines have exited so the channels can be closed.
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			errs.Append(err)
+		}
+	}
+	close(lerrCh)
+	for err := range lerrCh {
+		if err != nil && err != http.ErrServerClosed {
+			errs.Append(err)
+		}
+	}
+
+	if errs.IsErr() {
+		return errs
+	}
+	return nil
 }
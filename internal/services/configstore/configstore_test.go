@@ -15,28 +15,65 @@
 package configstore
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"agola.io/agola/cmd"
 	"agola.io/agola/internal/db"
+	slog "agola.io/agola/internal/log"
+	"agola.io/agola/internal/sequence"
 	"agola.io/agola/internal/services/config"
 	"agola.io/agola/internal/services/configstore/action"
+	"agola.io/agola/internal/services/configstore/api"
+	"agola.io/agola/internal/services/configstore/readdb"
+	"agola.io/agola/internal/services/configstore/webhook"
+	itypes "agola.io/agola/internal/services/types"
 	"agola.io/agola/internal/testutil"
 	"agola.io/agola/internal/util"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+	csclient "agola.io/agola/services/configstore/client"
 	"agola.io/agola/services/configstore/types"
+	stypes "agola.io/agola/services/types"
 
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/ghodss/yaml"
 	"github.com/google/go-cmp/cmp"
+	uuid "github.com/satori/go.uuid"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/net/http2"
 )
 
 func setupEtcd(t *testing.T, logger *zap.Logger, dir string) *testutil.TestEmbeddedEtcd {
@@ -102,6 +139,93 @@ func setupConfigstore(ctx context.Context, t *testing.T, logger *zap.Logger, dir
 	return cs, tetcd
 }
 
+// setupTestConfigstore creates a configstore with its own etcd and data dirs
+// and starts it. configure, if not nil, is called to change the configstore
+// before starting it. The returned func stops the configstore and removes its
+// data.
+func setupTestConfigstore(t *testing.T, configure func(cs *Configstore)) (context.Context, *Configstore, func()) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
+
+	if configure != nil {
+		configure(cs)
+	}
+	doneCh := startConfigstore(ctx, t, cs)
+
+	// stop cs before the end of the test since it logs to the test logger
+	teardown := func() {
+		cancel()
+		<-doneCh
+		shutdownEtcd(tetcd)
+		os.RemoveAll(dir)
+	}
+
+	return ctx, cs, teardown
+}
+
+// startConfigstore runs cs and waits for it to be ready to serve requests. The
+// returned channel is closed when cs.Run returns.
+func startConfigstore(ctx context.Context, t *testing.T, cs *Configstore) <-chan struct{} {
+	t.Logf("starting cs")
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		_ = cs.Run(ctx)
+	}()
+
+	waitConfigstoreReady(t, cs)
+
+	return doneCh
+}
+
+// waitConfigstoreReady waits for the cs datamanager and readdb to be synced
+// and for its http server to accept connections
+func waitConfigstoreReady(t *testing.T, cs *Configstore) {
+	for i := 0; i < 300; i++ {
+		if cs.dm.IsReady() && cs.readDB.IsInitialized() {
+			conn, err := net.Dial("tcp", cs.c.Web.ListenAddress)
+			if err == nil {
+				conn.Close()
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for configstore ready")
+}
+
+// waitReadDB waits for the cs readdb to apply all the changes already written
+// to the datamanager
+func waitReadDB(ctx context.Context, t *testing.T, cs *Configstore) {
+	// the readdb revision is updated by the events of the datamanager wals and
+	// changegroups etcd keys, so wait for the last revision of these keys
+	var revision int64
+	for _, dir := range []string{"datamanager/wals", "datamanager/changegroups"} {
+		resp, err := cs.e.List(ctx, dir, "", 0)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		for _, kv := range resp.Kvs {
+			if kv.ModRevision > revision {
+				revision = kv.ModRevision
+			}
+		}
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := cs.readDB.WaitRevision(wctx, revision); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
 func getProjects(ctx context.Context, cs *Configstore) ([]*types.Project, error) {
 	var projects []*types.Project
 	err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
@@ -116,221 +240,769 @@ func getUsers(ctx context.Context, cs *Configstore) ([]*types.User, error) {
 	var users []*types.User
 	err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
 		var err error
-		users, err = cs.readDB.GetUsers(tx, "", 0, true)
+		users, err = cs.readDB.GetUsers(tx, "", "", "", 0, true, false)
 		return err
 	})
 	return users, err
 }
 
-func TestResync(t *testing.T) {
+func TestReady(t *testing.T) {
 	dir, err := ioutil.TempDir("", "agola")
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 	defer os.RemoveAll(dir)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
 
-	etcdDir, err := ioutil.TempDir(dir, "etcd")
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	tetcd := setupEtcd(t, logger, etcdDir)
+	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
 	defer shutdownEtcd(tetcd)
 
-	listenAddress1, port1, err := testutil.GetFreePort(true, false)
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	h := api.NewReadyHandler(logger, cs.dm, cs.readDB, cs.e)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
 	}
-	listenAddress2, port2, err := testutil.GetFreePort(true, false)
-	if err != nil {
+	var res api.ReadyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	listenAddress3, port3, err := testutil.GetFreePort(true, false)
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	if res.Ready {
+		t.Fatalf("expected not ready")
+	}
+	for _, subsystem := range []string{"datamanager", "readdb"} {
+		if _, ok := res.NotReady[subsystem]; !ok {
+			t.Fatalf("expected subsystem %q not ready, got: %v", subsystem, res.NotReady)
+		}
+	}
+	if _, ok := res.NotReady["etcd"]; ok {
+		t.Fatalf("expected subsystem etcd ready, got: %v", res.NotReady)
 	}
 
-	ctx := context.Background()
+	startConfigstore(ctx, t, cs)
 
-	ostDir, err := ioutil.TempDir(dir, "ost")
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d, body: %s", http.StatusOK, w.Code, w.Body.String())
 	}
-	csDir1, err := ioutil.TempDir(dir, "cs1")
+}
+
+func TestMetrics(t *testing.T) {
+	_, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.c.Metrics.Enabled = true
+	})
+	defer teardown()
+
+	baseURL := fmt.Sprintf("http://%s", cs.c.Web.ListenAddress)
+
+	// do an api request to populate the http metrics
+	resp, err := http.Get(baseURL + "/api/v1alpha/users")
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	csDir2, err := ioutil.TempDir(dir, "cs2")
+	resp.Body.Close()
+
+	resp, err = http.Get(baseURL + "/metrics")
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	csDir3, err := ioutil.TempDir(dir, "cs3")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	baseConfig := config.Configstore{
-		Etcd: config.Etcd{
-			Endpoints: tetcd.Endpoint,
+	expectedMetrics := []string{
+		`agola_configstore_http_requests_total{code="200",handler="/api/v1alpha/users",method="GET"} 1`,
+		`agola_configstore_http_request_duration_seconds_count{handler="/api/v1alpha/users",method="GET"} 1`,
+		"agola_configstore_wal_pending",
+		"agola_configstore_wal_last_checkpoint_timestamp_seconds",
+	}
+	for _, m := range expectedMetrics {
+		if !strings.Contains(string(body), m) {
+			t.Fatalf("expected metric %q not found in:\n%s", m, body)
+		}
+	}
+}
+
+func TestShutdownHTTPServer(t *testing.T) {
+	tests := []struct {
+		name            string
+		timeout         time.Duration
+		requestDuration time.Duration
+		completed       bool
+	}{
+		{
+			name:            "in flight request completes during shutdown",
+			timeout:         5 * time.Second,
+			requestDuration: 1 * time.Second,
+			completed:       true,
 		},
-		ObjectStorage: config.ObjectStorage{
-			Type: config.ObjectStorageTypePosix,
-			Path: ostDir,
+		{
+			name:            "in flight request interrupted after shutdown timeout",
+			timeout:         200 * time.Millisecond,
+			requestDuration: 5 * time.Second,
+			completed:       false,
 		},
-		Web: config.Web{},
 	}
-	cs1Config := baseConfig
-	cs1Config.DataDir = csDir1
-	cs1Config.Web.ListenAddress = net.JoinHostPort(listenAddress1, port1)
 
-	cs2Config := baseConfig
-	cs2Config.DataDir = csDir2
-	cs2Config.Web.ListenAddress = net.JoinHostPort(listenAddress2, port2)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listenAddress, port, err := testutil.GetFreePort(true, false)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			addr := net.JoinHostPort(listenAddress, port)
+
+			ar := newActiveRequests()
+			startedCh := make(chan struct{})
+			slowHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(startedCh)
+				time.Sleep(tt.requestDuration)
+				w.WriteHeader(http.StatusOK)
+			})
 
-	cs1, err := NewConfigstore(ctx, logger.With(zap.String("name", "cs1")), &cs1Config)
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	cs2, err := NewConfigstore(ctx, logger.With(zap.String("name", "cs2")), &cs2Config)
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
+			httpServer := http.Server{
+				Addr:    addr,
+				Handler: ar.handler(slowHandler),
+			}
+			go func() {
+				_ = httpServer.ListenAndServe()
+			}()
+			// wait for the server to listen
+			time.Sleep(200 * time.Millisecond)
 
-	ctx1 := context.Background()
-	ctx2, cancel2 := context.WithCancel(context.Background())
+			resCh := make(chan error, 1)
+			go func() {
+				resp, err := http.Get(fmt.Sprintf("http://%s/slow", addr))
+				if err != nil {
+					resCh <- err
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					resCh <- fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+					return
+				}
+				resCh <- nil
+			}()
 
-	t.Logf("starting cs1")
-	go func() { _ = cs1.Run(ctx1) }()
-	t.Logf("starting cs2")
-	go func() { _ = cs2.Run(ctx2) }()
+			<-startedCh
+			if l := ar.list(); len(l) != 1 || l[0] != "GET /slow" {
+				t.Fatalf("unexpected active requests: %v", l)
+			}
 
-	time.Sleep(1 * time.Second)
+			shutdownHTTPServer(&httpServer, ar, tt.timeout)
 
-	for i := 0; i < 10; i++ {
-		if _, err := cs1.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: fmt.Sprintf("user%d", i)}); err != nil {
-			t.Fatalf("err: %v", err)
-		}
-		time.Sleep(200 * time.Millisecond)
+			err = <-resCh
+			if tt.completed && err != nil {
+				t.Fatalf("expected request completed, got err: %v", err)
+			}
+			if !tt.completed && err == nil {
+				t.Fatalf("expected request interrupted")
+			}
+		})
 	}
+}
 
-	time.Sleep(5 * time.Second)
-
-	// stop cs2
-	log.Infof("stopping cs2")
-	cancel2()
-
-	// Do some more changes
-	for i := 10; i < 20; i++ {
-		if _, err := cs1.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: fmt.Sprintf("user%d", i)}); err != nil {
-			t.Fatalf("err: %v", err)
-		}
-		time.Sleep(200 * time.Millisecond)
+// labeledGoroutines returns the stacks of the agola goroutines with the
+// provided pprof test label
+func labeledGoroutines(t *testing.T, label string) []string {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		t.Fatalf("unexpected err: %v", err)
 	}
-
-	time.Sleep(5 * time.Second)
-
-	// compact etcd
-	if err := tetcd.Compact(); err != nil {
-		t.Fatalf("err: %v", err)
+	stacks := []string{}
+	for _, stack := range strings.Split(buf.String(), "\n\n") {
+		if strings.Contains(stack, fmt.Sprintf("%q:%q", "test", label)) && strings.Contains(stack, "\tagola.io/agola/") {
+			stacks = append(stacks, stack)
+		}
 	}
+	return stacks
+}
 
-	// start cs2
-	// it should resync from wals since the etcd revision as been compacted
-	cs2, err = NewConfigstore(ctx, logger.With(zap.String("name", "cs2")), &cs2Config)
+func TestRunGoroutinesExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
 	if err != nil {
-		t.Fatalf("err: %v", err)
+		t.Fatalf("unexpected err: %v", err)
 	}
-	log.Infof("starting cs2")
-	ctx2 = context.Background()
-	go func() { _ = cs2.Run(ctx2) }()
+	defer os.RemoveAll(dir)
 
-	time.Sleep(5 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
 
-	users1, err := getUsers(ctx, cs1)
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	if len(users1) != 20 {
-		t.Logf("users1: %s", util.Dump(users1))
-		t.Fatalf("expected %d users, got %d users", 20, len(users1))
-	}
+	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
+	defer shutdownEtcd(tetcd)
+	// the goroutines started by Run inherit its pprof labels
+	label := t.Name()
+	runErrCh := make(chan error, 1)
+	t.Logf("starting cs")
+	go func() {
+		var err error
+		pprof.Do(ctx, pprof.Labels("test", label), func(ctx context.Context) {
+			err = cs.Run(ctx)
+		})
+		runErrCh <- err
+	}()
 
-	users2, err := getUsers(ctx, cs2)
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
+	waitConfigstoreReady(t, cs)
 
-	if !compareUsers(users1, users2) {
-		t.Logf("len(users1): %d", len(users1))
-		t.Logf("len(users2): %d", len(users2))
-		t.Logf("users1: %s", util.Dump(users1))
-		t.Logf("users2: %s", util.Dump(users2))
-		t.Fatalf("users are different between the two readdbs")
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+	if _, _, err := csc.CreateUser(ctx, &csapitypes.CreateUserRequest{UserName: "user01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
 	}
 
-	// start cs3, since it's a new instance it should do a full resync
-	cs3Config := baseConfig
-	cs3Config.DataDir = csDir3
-	cs3Config.Web.ListenAddress = net.JoinHostPort(listenAddress3, port3)
+	waitReadDB(ctx, t, cs)
 
-	cs3, err := NewConfigstore(ctx, logger.With(zap.String("name", "cs3")), &cs3Config)
-	if err != nil {
-		t.Fatalf("err: %v", err)
+	if _, _, err := csc.GetUser(ctx, "user01"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if stacks := labeledGoroutines(t, label); len(stacks) == 0 {
+		t.Fatalf("expected running configstore goroutines")
 	}
-	log.Infof("starting cs3")
-	ctx3 := context.Background()
-	go func() { _ = cs3.Run(ctx3) }()
-
-	time.Sleep(5 * time.Second)
 
-	users3, err := getUsers(ctx, cs3)
-	if err != nil {
-		t.Fatalf("err: %v", err)
+	cancel()
+	select {
+	case err := <-runErrCh:
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("configstore Run didn't return")
 	}
 
-	if !compareUsers(users1, users3) {
-		t.Logf("len(users1): %d", len(users1))
-		t.Logf("len(users3): %d", len(users3))
-		t.Logf("users1: %s", util.Dump(users1))
-		t.Logf("users3: %s", util.Dump(users3))
-		t.Fatalf("users are different between the two readdbs")
+	if stacks := labeledGoroutines(t, label); len(stacks) > 0 {
+		t.Fatalf("goroutines still running after Run returned:\n%s", strings.Join(stacks, "\n\n"))
 	}
 }
 
-func TestExportImport(t *testing.T) {
+func TestMisconfiguredTLS(t *testing.T) {
 	dir, err := ioutil.TempDir("", "agola")
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 	defer os.RemoveAll(dir)
 
+	ctx := context.Background()
 	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
 
-	etcdDir, err := ioutil.TempDir(dir, "etcd")
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	tetcd := setupEtcd(t, logger, etcdDir)
+	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
 	defer shutdownEtcd(tetcd)
 
-	listenAddress1, port1, err := testutil.GetFreePort(true, false)
+	t.Run("missing tls cert and key files", func(t *testing.T) {
+		c := *cs.c
+		c.Web.TLS = true
+
+		_, err := NewConfigstore(ctx, logger, &c)
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+		expectedErr := "web tls enabled but no tls cert file specified"
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got %q", expectedErr, err.Error())
+		}
+
+		c.Web.TLSCertFile = filepath.Join(dir, "cert.pem")
+		_, err = NewConfigstore(ctx, logger, &c)
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+		expectedErr = "web tls enabled but no tls key file specified"
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got %q", expectedErr, err.Error())
+		}
+	})
+
+	t.Run("not existing tls cert and key files", func(t *testing.T) {
+		c := *cs.c
+		c.Web.TLS = true
+		c.Web.TLSCertFile = filepath.Join(dir, "cert.pem")
+		c.Web.TLSKeyFile = filepath.Join(dir, "key.pem")
+
+		cs, err := NewConfigstore(ctx, logger, &c)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		err = cs.run(ctx)
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+		for _, f := range []string{c.Web.TLSCertFile, c.Web.TLSKeyFile} {
+			if !strings.Contains(err.Error(), f) {
+				t.Fatalf("expected err to contain %q, got %q", f, err.Error())
+			}
+		}
+	})
+}
+
+// writeTestCert writes a self signed server certificate and its key in dir
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	listenAddress2, port2, err := testutil.GetFreePort(true, false)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "agola test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	listenAddress3, port3, err := testutil.GetFreePort(true, false)
+	keyDER, err := x509.MarshalECPrivateKey(key)
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	ctx := context.Background()
-
-	ostDir, err := ioutil.TempDir(dir, "ost")
-	if err != nil {
+	certFile := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	// h2cTransport creates cleartext http2 connections with prior knowledge
+	h2cTransport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	defer h2cTransport.CloseIdleConnections()
+
+	getVersion := func(t *testing.T, client *http.Client, u string) *http.Response {
+		res, err := client.Get(u + "/api/v1alpha/version")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer res.Body.Close()
+		if _, err := ioutil.ReadAll(res.Body); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, res.StatusCode)
+		}
+		return res
+	}
+
+	tests := []struct {
+		name          string
+		http2         bool
+		tls           bool
+		client        func() *http.Client
+		expectedProto string
+	}{
+		{
+			name:          "h2c with http2 enabled",
+			http2:         true,
+			client:        func() *http.Client { return &http.Client{Transport: h2cTransport} },
+			expectedProto: "HTTP/2.0",
+		},
+		{
+			name:          "http/1.1 fallback with http2 enabled",
+			http2:         true,
+			client:        func() *http.Client { return &http.Client{} },
+			expectedProto: "HTTP/1.1",
+		},
+		{
+			name:          "tls with http2 enabled",
+			http2:         true,
+			tls:           true,
+			expectedProto: "HTTP/2.0",
+		},
+		{
+			name:          "tls with http2 disabled",
+			tls:           true,
+			expectedProto: "HTTP/1.1",
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tdir := filepath.Join(dir, strconv.Itoa(i))
+			if err := os.MkdirAll(tdir, 0770); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cs, tetcd := setupConfigstore(ctx, t, logger, tdir)
+			defer shutdownEtcd(tetcd)
+
+			cs.c.HTTP2.Enabled = tt.http2
+			scheme := "http"
+			client := &http.Client{}
+			if tt.tls {
+				cs.c.Web.TLS = true
+				cs.c.Web.TLSCertFile, cs.c.Web.TLSKeyFile = writeTestCert(t, tdir)
+				scheme = "https"
+				// the default transport negotiates http2 with ALPN
+				tr := &http.Transport{
+					TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+					ForceAttemptHTTP2: true,
+				}
+				defer tr.CloseIdleConnections()
+				client = &http.Client{Transport: tr}
+			}
+			if tt.client != nil {
+				client = tt.client()
+			}
+
+			startConfigstore(ctx, t, cs)
+
+			res := getVersion(t, client, scheme+"://"+cs.c.Web.ListenAddress)
+			if res.Proto != tt.expectedProto {
+				t.Fatalf("expected proto %q, got %q", tt.expectedProto, res.Proto)
+			}
+		})
+	}
+
+	t.Run("h2c with http2 disabled", func(t *testing.T) {
+		tdir := filepath.Join(dir, "h2c-disabled")
+		if err := os.MkdirAll(tdir, 0770); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		cs, tetcd := setupConfigstore(ctx, t, logger, tdir)
+		defer shutdownEtcd(tetcd)
+
+		startConfigstore(ctx, t, cs)
+
+		client := &http.Client{Transport: h2cTransport}
+		if _, err := client.Get("http://" + cs.c.Web.ListenAddress + "/api/v1alpha/version"); err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+	})
+}
+
+func TestAdminListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
+	defer shutdownEtcd(tetcd)
+
+	adminListenAddress, adminPort, err := testutil.GetFreePort(true, false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	cs.c.Admin.ListenAddress = net.JoinHostPort(adminListenAddress, adminPort)
+	cs.c.Metrics.Enabled = true
+
+	t.Logf("starting cs")
+	doneCh := make(chan struct{})
+	go func() {
+		_ = cs.run(ctx)
+		close(doneCh)
+	}()
+
+	waitConfigstoreReady(t, cs)
+
+	baseURL := fmt.Sprintf("http://%s", cs.c.Web.ListenAddress)
+	adminBaseURL := fmt.Sprintf("http://%s", cs.c.Admin.ListenAddress)
+
+	tests := []struct {
+		path  string
+		admin bool
+	}{
+		{path: "/api/v1alpha/users"},
+		{path: "/api/v1alpha/version"},
+		{path: "/health"},
+		{path: "/api/v1alpha/admin/loglevel", admin: true},
+		{path: "/api/v1alpha/admin/selfcheck", admin: true},
+		{path: "/api/v1alpha/admin/export", admin: true},
+		{path: "/metrics", admin: true},
+	}
+
+	get := func(u string) int {
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			mainCode, adminCode := http.StatusOK, http.StatusNotFound
+			if tt.admin {
+				mainCode, adminCode = http.StatusNotFound, http.StatusOK
+			}
+			if code := get(baseURL + tt.path); code != mainCode {
+				t.Fatalf("expected status code %d from the main listener, got %d", mainCode, code)
+			}
+			if code := get(adminBaseURL + tt.path); code != adminCode {
+				t.Fatalf("expected status code %d from the admin listener, got %d", adminCode, code)
+			}
+		})
+	}
+
+	// both listeners are closed when stopping
+	cancel()
+	select {
+	case <-doneCh:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("configstore not stopped")
+	}
+	for _, u := range []string{baseURL, adminBaseURL} {
+		if _, err := http.Get(u + "/health"); err == nil {
+			t.Fatalf("expected connection error to %s, got nil", u)
+		}
+	}
+}
+
+func TestAdminPprof(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	get := func(t *testing.T, u, token string) int {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		name      string
+		pprof     bool
+		auth      bool
+		token     string
+		adminCode int
+	}{
+		{
+			name:      "pprof disabled",
+			adminCode: http.StatusNotFound,
+		},
+		{
+			name:      "pprof enabled",
+			pprof:     true,
+			adminCode: http.StatusOK,
+		},
+		{
+			name:      "pprof enabled with auth and without token",
+			pprof:     true,
+			auth:      true,
+			adminCode: http.StatusUnauthorized,
+		},
+		{
+			name:      "pprof enabled with auth and admin token",
+			pprof:     true,
+			auth:      true,
+			token:     "admintoken",
+			adminCode: http.StatusOK,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tdir := filepath.Join(dir, strconv.Itoa(i))
+			if err := os.MkdirAll(tdir, 0770); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cs, tetcd := setupConfigstore(ctx, t, logger, tdir)
+			defer shutdownEtcd(tetcd)
+
+			adminListenAddress, adminPort, err := testutil.GetFreePort(true, false)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			cs.c.Admin.ListenAddress = net.JoinHostPort(adminListenAddress, adminPort)
+			cs.c.Admin.Pprof = tt.pprof
+			cs.c.Auth.Enabled = tt.auth
+			cs.c.Auth.AdminToken = "admintoken"
+
+			startConfigstore(ctx, t, cs)
+
+			for _, p := range []string{"/debug/pprof/", "/debug/pprof/goroutine", "/debug/pprof/cmdline"} {
+				if code := get(t, "http://"+cs.c.Admin.ListenAddress+p, tt.token); code != tt.adminCode {
+					t.Fatalf("expected status code %d for %s from the admin listener, got %d", tt.adminCode, p, code)
+				}
+				// never served by the main listener
+				if code := get(t, "http://"+cs.c.Web.ListenAddress+p, tt.token); code != http.StatusNotFound {
+					t.Fatalf("expected status code %d for %s from the main listener, got %d", http.StatusNotFound, p, code)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	core, logs := observer.New(zap.DebugLevel)
+	logger := zap.New(zapcore.NewTee(zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel)).Core(), core))
+
+	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
+	defer shutdownEtcd(tetcd)
+
+	startConfigstore(ctx, t, cs)
+
+	baseURL := fmt.Sprintf("http://%s", cs.c.Web.ListenAddress)
+
+	doRequest := func(method, u, requestID string, req interface{}) *http.Response {
+		var body io.Reader
+		if req != nil {
+			reqj, err := json.Marshal(req)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			body = bytes.NewReader(reqj)
+		}
+		hreq, err := http.NewRequest(method, u, body)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if requestID != "" {
+			hreq.Header.Set("X-Request-Id", requestID)
+		}
+		resp, err := http.DefaultClient.Do(hreq)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("request id is returned", func(t *testing.T) {
+		resp := doRequest("GET", baseURL+"/health", "request01", nil)
+		if requestID := resp.Header.Get("X-Request-Id"); requestID != "request01" {
+			t.Fatalf("expected request id %q, got %q", "request01", requestID)
+		}
+	})
+
+	t.Run("request id is generated when missing or not valid", func(t *testing.T) {
+		for _, requestID := range []string{"", "not valid request id"} {
+			resp := doRequest("GET", baseURL+"/health", requestID, nil)
+			got := resp.Header.Get("X-Request-Id")
+			if got == "" || got == requestID {
+				t.Fatalf("expected a generated request id, got %q", got)
+			}
+		}
+	})
+
+	t.Run("request id is logged by the handlers and the wal writes", func(t *testing.T) {
+		requestID := "createuser01"
+		resp := doRequest("POST", baseURL+"/api/v1alpha/users", requestID, &csapitypes.CreateUserRequest{UserName: "user01"})
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, resp.StatusCode)
+		}
+
+		messages := []string{}
+		for _, entry := range logs.FilterField(zap.String(slog.RequestIDKey, requestID)).All() {
+			messages = append(messages, entry.Message)
+		}
+		expected := []string{"wrote wal file", "http request"}
+		if diff := cmp.Diff(expected, messages); diff != "" {
+			t.Fatalf("log entries mismatch (-expected +got):\n%s", diff)
+		}
+	})
+}
+
+func TestResync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	etcdDir, err := ioutil.TempDir(dir, "etcd")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	tetcd := setupEtcd(t, logger, etcdDir)
+	defer shutdownEtcd(tetcd)
+
+	listenAddress1, port1, err := testutil.GetFreePort(true, false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	listenAddress2, port2, err := testutil.GetFreePort(true, false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	listenAddress3, port3, err := testutil.GetFreePort(true, false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	ctx := context.Background()
+
+	ostDir, err := ioutil.TempDir(dir, "ost")
+	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 	csDir1, err := ioutil.TempDir(dir, "cs1")
@@ -364,10 +1036,6 @@ func TestExportImport(t *testing.T) {
 	cs2Config.DataDir = csDir2
 	cs2Config.Web.ListenAddress = net.JoinHostPort(listenAddress2, port2)
 
-	cs3Config := baseConfig
-	cs3Config.DataDir = csDir3
-	cs3Config.Web.ListenAddress = net.JoinHostPort(listenAddress3, port3)
-
 	cs1, err := NewConfigstore(ctx, logger.With(zap.String("name", "cs1")), &cs1Config)
 	if err != nil {
 		t.Fatalf("err: %v", err)
@@ -376,23 +1044,17 @@ func TestExportImport(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	cs3, err := NewConfigstore(ctx, logger.With(zap.String("name", "cs3")), &cs3Config)
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
 
 	ctx1 := context.Background()
 	ctx2, cancel2 := context.WithCancel(context.Background())
-	ctx3, cancel3 := context.WithCancel(context.Background())
 
 	t.Logf("starting cs1")
 	go func() { _ = cs1.Run(ctx1) }()
 	t.Logf("starting cs2")
 	go func() { _ = cs2.Run(ctx2) }()
-	t.Logf("starting cs3")
-	go func() { _ = cs3.Run(ctx3) }()
 
-	time.Sleep(1 * time.Second)
+	waitConfigstoreReady(t, cs1)
+	waitConfigstoreReady(t, cs2)
 
 	for i := 0; i < 10; i++ {
 		if _, err := cs1.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: fmt.Sprintf("user%d", i)}); err != nil {
@@ -401,14 +1063,11 @@ func TestExportImport(t *testing.T) {
 		time.Sleep(200 * time.Millisecond)
 	}
 
-	time.Sleep(5 * time.Second)
+	waitReadDB(ctx, t, cs2)
 
 	// stop cs2
 	log.Infof("stopping cs2")
 	cancel2()
-	// stop cs3
-	log.Infof("stopping cs3")
-	cancel3()
 
 	// Do some more changes
 	for i := 10; i < 20; i++ {
@@ -420,18 +1079,214 @@ func TestExportImport(t *testing.T) {
 
 	time.Sleep(5 * time.Second)
 
-	users1, err := getUsers(ctx, cs1)
-	if err != nil {
+	// compact etcd
+	if err := tetcd.Compact(); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if len(users1) != 20 {
-		t.Logf("users1: %s", util.Dump(users1))
-		t.Fatalf("expected %d users, got %d users", 20, len(users1))
-	}
 
-	var export bytes.Buffer
-	if err := cs1.ah.Export(ctx, &export); err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	// start cs2
+	// it should resync from wals since the etcd revision as been compacted
+	cs2, err = NewConfigstore(ctx, logger.With(zap.String("name", "cs2")), &cs2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	log.Infof("starting cs2")
+	ctx2 = context.Background()
+	go func() { _ = cs2.Run(ctx2) }()
+
+	waitConfigstoreReady(t, cs2)
+	waitReadDB(ctx, t, cs1)
+	waitReadDB(ctx, t, cs2)
+
+	users1, err := getUsers(ctx, cs1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(users1) != 20 {
+		t.Logf("users1: %s", util.Dump(users1))
+		t.Fatalf("expected %d users, got %d users", 20, len(users1))
+	}
+
+	users2, err := getUsers(ctx, cs2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !compareUsers(users1, users2) {
+		t.Logf("len(users1): %d", len(users1))
+		t.Logf("len(users2): %d", len(users2))
+		t.Logf("users1: %s", util.Dump(users1))
+		t.Logf("users2: %s", util.Dump(users2))
+		t.Fatalf("users are different between the two readdbs")
+	}
+
+	// start cs3, since it's a new instance it should do a full resync
+	cs3Config := baseConfig
+	cs3Config.DataDir = csDir3
+	cs3Config.Web.ListenAddress = net.JoinHostPort(listenAddress3, port3)
+
+	cs3, err := NewConfigstore(ctx, logger.With(zap.String("name", "cs3")), &cs3Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	log.Infof("starting cs3")
+	ctx3 := context.Background()
+	go func() { _ = cs3.Run(ctx3) }()
+
+	waitConfigstoreReady(t, cs3)
+	waitReadDB(ctx, t, cs3)
+
+	users3, err := getUsers(ctx, cs3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !compareUsers(users1, users3) {
+		t.Logf("len(users1): %d", len(users1))
+		t.Logf("len(users3): %d", len(users3))
+		t.Logf("users1: %s", util.Dump(users1))
+		t.Logf("users3: %s", util.Dump(users3))
+		t.Fatalf("users are different between the two readdbs")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	etcdDir, err := ioutil.TempDir(dir, "etcd")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	tetcd := setupEtcd(t, logger, etcdDir)
+	defer shutdownEtcd(tetcd)
+
+	listenAddress1, port1, err := testutil.GetFreePort(true, false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	listenAddress2, port2, err := testutil.GetFreePort(true, false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	listenAddress3, port3, err := testutil.GetFreePort(true, false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	ctx := context.Background()
+
+	ostDir, err := ioutil.TempDir(dir, "ost")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	csDir1, err := ioutil.TempDir(dir, "cs1")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	csDir2, err := ioutil.TempDir(dir, "cs2")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	csDir3, err := ioutil.TempDir(dir, "cs3")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	baseConfig := config.Configstore{
+		Etcd: config.Etcd{
+			Endpoints: tetcd.Endpoint,
+		},
+		ObjectStorage: config.ObjectStorage{
+			Type: config.ObjectStorageTypePosix,
+			Path: ostDir,
+		},
+		Web: config.Web{},
+	}
+	cs1Config := baseConfig
+	cs1Config.DataDir = csDir1
+	cs1Config.Web.ListenAddress = net.JoinHostPort(listenAddress1, port1)
+
+	cs2Config := baseConfig
+	cs2Config.DataDir = csDir2
+	cs2Config.Web.ListenAddress = net.JoinHostPort(listenAddress2, port2)
+
+	cs3Config := baseConfig
+	cs3Config.DataDir = csDir3
+	cs3Config.Web.ListenAddress = net.JoinHostPort(listenAddress3, port3)
+
+	cs1, err := NewConfigstore(ctx, logger.With(zap.String("name", "cs1")), &cs1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cs2, err := NewConfigstore(ctx, logger.With(zap.String("name", "cs2")), &cs2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cs3, err := NewConfigstore(ctx, logger.With(zap.String("name", "cs3")), &cs3Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ctx1 := context.Background()
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	ctx3, cancel3 := context.WithCancel(context.Background())
+
+	t.Logf("starting cs1")
+	go func() { _ = cs1.Run(ctx1) }()
+	t.Logf("starting cs2")
+	go func() { _ = cs2.Run(ctx2) }()
+	t.Logf("starting cs3")
+	go func() { _ = cs3.Run(ctx3) }()
+
+	waitConfigstoreReady(t, cs1)
+	waitConfigstoreReady(t, cs2)
+	waitConfigstoreReady(t, cs3)
+
+	for i := 0; i < 10; i++ {
+		if _, err := cs1.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: fmt.Sprintf("user%d", i)}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	waitReadDB(ctx, t, cs2)
+	waitReadDB(ctx, t, cs3)
+
+	// stop cs2
+	log.Infof("stopping cs2")
+	cancel2()
+	// stop cs3
+	log.Infof("stopping cs3")
+	cancel3()
+
+	// Do some more changes
+	for i := 10; i < 20; i++ {
+		if _, err := cs1.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: fmt.Sprintf("user%d", i)}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	waitReadDB(ctx, t, cs1)
+
+	users1, err := getUsers(ctx, cs1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(users1) != 20 {
+		t.Logf("users1: %s", util.Dump(users1))
+		t.Fatalf("expected %d users, got %d users", 20, len(users1))
+	}
+
+	var export bytes.Buffer
+	if err := cs1.ah.Export(ctx, &export); err != nil {
+		t.Fatalf("unexpected err: %v", err)
 	}
 
 	if err := cs1.ah.MaintenanceMode(ctx, true); err != nil {
@@ -473,7 +1328,8 @@ func TestExportImport(t *testing.T) {
 	ctx2 = context.Background()
 	go func() { _ = cs2.Run(ctx2) }()
 
-	time.Sleep(5 * time.Second)
+	waitConfigstoreReady(t, cs2)
+	waitReadDB(ctx, t, cs2)
 
 	users2, err := getUsers(ctx, cs2)
 	if err != nil {
@@ -496,7 +1352,7 @@ func TestExportImport(t *testing.T) {
 		time.Sleep(200 * time.Millisecond)
 	}
 
-	time.Sleep(5 * time.Second)
+	waitReadDB(ctx, t, cs1)
 
 	users1, err = getUsers(ctx, cs1)
 	if err != nil {
@@ -517,7 +1373,8 @@ func TestExportImport(t *testing.T) {
 	ctx3 = context.Background()
 	go func() { _ = cs3.Run(ctx3) }()
 
-	time.Sleep(5 * time.Second)
+	waitConfigstoreReady(t, cs3)
+	waitReadDB(ctx, t, cs3)
 
 	users3, err := getUsers(ctx, cs3)
 	if err != nil {
@@ -547,195 +1404,316 @@ func compareUsers(u1, u2 []*types.User) bool {
 	return reflect.DeepEqual(u1ids, u2ids)
 }
 
-func TestUser(t *testing.T) {
+func TestExportImportResources(t *testing.T) {
 	dir, err := ioutil.TempDir("", "agola")
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 	defer os.RemoveAll(dir)
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
 
-	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
-	defer shutdownEtcd(tetcd)
-
-	t.Logf("starting cs")
-	go func() {
-		_ = cs.Run(ctx)
-	}()
+	dir1, err := ioutil.TempDir(dir, "cs1")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	dir2, err := ioutil.TempDir(dir, "cs2")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	cs1, tetcd1 := setupConfigstore(ctx, t, logger, dir1)
+	defer shutdownEtcd(tetcd1)
+	cs2, tetcd2 := setupConfigstore(ctx, t, logger, dir2)
+	defer shutdownEtcd(tetcd2)
+
+	startConfigstore(ctx, t, cs1)
+	startConfigstore(ctx, t, cs2)
+
+	if _, err := cs1.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+		Name:               "rs01",
+		APIURL:             "https://api.example.com",
+		Type:               types.RemoteSourceTypeGitea,
+		AuthType:           types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:     "clientid",
+		Oauth2ClientSecret: "clientsecret",
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
 
-	// TODO(sgotti) change the sleep with a real check that all is ready
-	time.Sleep(2 * time.Second)
+	waitReadDB(ctx, t, cs1)
 
-	t.Run("create user", func(t *testing.T) {
-		_, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
-		}
+	user, err := cs1.ah.CreateUser(ctx, &action.CreateUserRequest{
+		UserName: "user01",
+		CreateUserLARequest: &action.CreateUserLARequest{
+			RemoteSourceName: "rs01",
+			RemoteUserID:     "remoteuser01",
+			RemoteUserName:   "remoteuser01",
+		},
 	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	org, err := cs1.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
 
-	// TODO(sgotti) change the sleep with a real check that user is in readdb
-	time.Sleep(2 * time.Second)
-
-	t.Run("create duplicated user", func(t *testing.T) {
-		expectedErr := fmt.Sprintf("user with name %q already exists", "user01")
-		_, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
-		if err == nil {
-			t.Fatalf("expected error %v, got nil err", expectedErr)
-		}
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
-		}
-	})
-	t.Run("concurrent user with same name creation", func(t *testing.T) {
-		prevUsers, err := getUsers(ctx, cs)
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
-		}
+	waitReadDB(ctx, t, cs1)
 
-		wg := sync.WaitGroup{}
-		for i := 0; i < 10; i++ {
-			wg.Add(1)
-			go func() { _, _ = cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"}) }()
-			wg.Done()
-		}
-		wg.Wait()
+	if _, err := cs1.ah.CreateUserToken(ctx, user.Name, "token01", nil); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs1.ah.AddOrgMember(ctx, org.Name, user.Name, types.MemberRoleMember); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	pg, err := cs1.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
 
-		time.Sleep(5 * time.Second)
+	waitReadDB(ctx, t, cs1)
 
-		users, err := getUsers(ctx, cs)
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
-		}
-
-		if len(users) != len(prevUsers)+1 {
-			t.Fatalf("expected %d users, got %d", len(prevUsers)+1, len(users))
-		}
-	})
-}
-
-func TestProjectGroupsAndProjectsCreate(t *testing.T) {
-	dir, err := ioutil.TempDir("", "agola")
+	project, err := cs1.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: pg.ID}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	defer os.RemoveAll(dir)
-
-	ctx := context.Background()
-	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
 
-	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
-	defer shutdownEtcd(tetcd)
-
-	t.Logf("starting cs")
-	go func() {
-		_ = cs.Run(ctx)
-	}()
-
-	// TODO(sgotti) change the sleep with a real check that all is ready
-	time.Sleep(2 * time.Second)
+	waitReadDB(ctx, t, cs1)
 
-	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
-	if err != nil {
+	if _, err := cs1.ah.CreateSecret(ctx, &types.Secret{Name: "secret01", Parent: types.Parent{Type: types.ConfigTypeProject, ID: project.ID}, Type: types.SecretTypeInternal, Data: map[string]string{"secret01": "secretvar01"}}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic})
-	if err != nil {
+	if _, err := cs1.ah.CreateVariable(ctx, &types.Variable{Name: "variable01", Parent: types.Parent{Type: types.ConfigTypeProject, ID: project.ID}, Values: []types.VariableValue{{SecretName: "secret01", SecretVar: "secretvar01"}}}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	// TODO(sgotti) change the sleep with a real check that user is in readdb
-	time.Sleep(2 * time.Second)
+	waitReadDB(ctx, t, cs1)
 
-	t.Run("create a project in user root project group", func(t *testing.T) {
-		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	csc1 := csclient.NewClient(fmt.Sprintf("http://%s", cs1.c.Web.ListenAddress))
+	csc2 := csclient.NewClient(fmt.Sprintf("http://%s", cs2.c.Web.ListenAddress))
+
+	export := func(ctx context.Context, t *testing.T, csc *csclient.Client) ([]byte, *types.ExportHeader, []*types.ExportRecord) {
+		r, resp, err := csc.ExportResources(ctx)
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-	})
-	t.Run("create a project in org root project group", func(t *testing.T) {
-		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		defer r.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Fatalf("expected content type %q, got %q", "application/x-ndjson", ct)
+		}
+		data, err := ioutil.ReadAll(r)
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-	})
-	t.Run("create a projectgroup in user root project group", func(t *testing.T) {
-		_, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic})
-		if err != nil {
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		var header *types.ExportHeader
+		if err := dec.Decode(&header); err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
+		records := []*types.ExportRecord{}
+		for {
+			var record *types.ExportRecord
+			err := dec.Decode(&record)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			records = append(records, record)
+		}
+		return data, header, records
+	}
+
+	data, header1, records1 := export(ctx, t, csc1)
+	if header1.Version != types.ExportVersion || header1.Revision == 0 {
+		t.Fatalf("unexpected export header: %s", util.Dump(header1))
+	}
+	// one remote source, the user with its root project group, the org with
+	// its root project group and member, the project group, the project, the
+	// secret and the variable
+	expectedCounts := map[types.ConfigType]int{
+		types.ConfigTypeRemoteSource: 1,
+		types.ConfigTypeUser:         1,
+		types.ConfigTypeOrg:          1,
+		types.ConfigTypeOrgMember:    1,
+		types.ConfigTypeProjectGroup: 3,
+		types.ConfigTypeProject:      1,
+		types.ConfigTypeSecret:       1,
+		types.ConfigTypeVariable:     1,
+	}
+	counts := map[types.ConfigType]int{}
+	for _, record := range records1 {
+		counts[record.Type]++
+	}
+	if diff := cmp.Diff(expectedCounts, counts); diff != "" {
+		t.Fatalf("exported resources mismatch (-expected +got):\n%s", diff)
+	}
+
+	t.Run("import in a not empty configstore", func(t *testing.T) {
+		resp, err := csc1.ImportResources(ctx, bytes.NewReader(data))
+		if err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
 	})
-	t.Run("create a projectgroup in org root project group", func(t *testing.T) {
-		_, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
+
+	t.Run("import in an empty configstore", func(t *testing.T) {
+		resp, err := csc2.ImportResources(ctx, bytes.NewReader(data))
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
+
+		_, _, records2 := export(csclient.WithMinRevision(ctx, csclient.ResponseRevision(resp)), t, csc2)
+		if diff := cmp.Diff(records1, records2); diff != "" {
+			t.Fatalf("imported resources mismatch (-expected +got):\n%s", diff)
+		}
+
+		// check that the linked accounts of the imported user are indexed
+		if len(user.LinkedAccounts) != 1 {
+			t.Fatalf("expected 1 linked account, got %d", len(user.LinkedAccounts))
+		}
+		for _, la := range user.LinkedAccounts {
+			var u *types.User
+			err := cs2.readDB.Do(ctx, func(tx *db.Tx) error {
+				var err error
+				u, err = cs2.readDB.GetUserByLinkedAccountRemoteUserIDandSource(tx, la.RemoteUserID, la.RemoteSourceID)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if u == nil || u.ID != user.ID {
+				t.Fatalf("expected user %q for linked account %q, got %s", user.ID, la.ID, util.Dump(u))
+			}
+		}
 	})
-	t.Run("create a project in user non root project group with same name as a root project", func(t *testing.T) {
-		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+}
+
+// flushRecorder records the bytes written before every flush
+type flushRecorder struct {
+	bytes.Buffer
+	flushes []int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushes = append(r.flushes, r.Len())
+}
+
+func TestExportResourcesStreaming(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	const usersCount = 1050
+
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	if err := enc.Encode(&types.ExportHeader{Version: types.ExportVersion}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for i := 0; i < usersCount; i++ {
+		userj, err := json.Marshal(&types.User{ID: uuid.NewV4().String(), Name: fmt.Sprintf("user%04d", i)})
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-	})
-	t.Run("create a project in org non root project group with same name as a root project", func(t *testing.T) {
-		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err != nil {
+		if err := enc.Encode(&types.ExportRecord{Type: types.ConfigTypeUser, Data: userj}); err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-	})
+	}
 
-	t.Run("create duplicated project in user root project group", func(t *testing.T) {
-		projectName := "project01"
-		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("user", user.Name, projectName))
-		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: projectName, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+	resp, err := csc.ImportResources(ctx, &data)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	wctx, wcancel := context.WithTimeout(ctx, 10*time.Second)
+	defer wcancel()
+	if err := cs.readDB.WaitRevision(wctx, csclient.ResponseRevision(resp)); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("export is flushed while written", func(t *testing.T) {
+		rec := &flushRecorder{}
+		if err := cs.ah.ExportResources(ctx, rec); err != nil {
+			t.Fatalf("unexpected err: %v", err)
 		}
-	})
-	t.Run("create duplicated project in org root project group", func(t *testing.T) {
-		projectName := "project01"
-		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("org", org.Name, projectName))
-		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: projectName, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+
+		lines := bytes.Count(rec.Bytes(), []byte("\n"))
+		if lines != usersCount+1 {
+			t.Fatalf("expected %d exported lines, got %d", usersCount+1, lines)
 		}
-	})
 
-	t.Run("create duplicated project in user non root project group", func(t *testing.T) {
-		projectName := "project01"
-		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("user", user.Name, "projectgroup01", projectName))
-		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: projectName, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		// a flush every 100 records and a final one
+		expectedFlushes := usersCount/100 + 1
+		if len(rec.flushes) != expectedFlushes {
+			t.Fatalf("expected %d flushes, got %d", expectedFlushes, len(rec.flushes))
+		}
+		// the records between two flushes are less than the flushed ones, so
+		// the export isn't written all at the end
+		prev := 0
+		for i, n := range rec.flushes[:len(rec.flushes)-1] {
+			if n <= prev {
+				t.Fatalf("expected flush %d after more than %d bytes, got %d bytes", i, prev, n)
+			}
+			prev = n
+		}
+		if last := rec.flushes[len(rec.flushes)-1]; last != rec.Len() {
+			t.Fatalf("expected last flush after all the %d bytes, got %d bytes", rec.Len(), last)
+		}
+		if first := rec.flushes[0]; first > rec.Len()/5 {
+			t.Fatalf("expected first flush after at most %d bytes, got %d bytes", rec.Len()/5, first)
 		}
 	})
-	t.Run("create duplicated project in org non root project group", func(t *testing.T) {
-		projectName := "project01"
-		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("org", org.Name, "projectgroup01", projectName))
-		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: projectName, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+
+	t.Run("export api response is streamed", func(t *testing.T) {
+		r, resp, err := csc.ExportResources(ctx)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer r.Close()
+		if resp.ContentLength != -1 {
+			t.Fatalf("expected a streamed response without content length, got content length %d", resp.ContentLength)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if lines := bytes.Count(data, []byte("\n")); lines != usersCount+1 {
+			t.Fatalf("expected %d exported lines, got %d", usersCount+1, lines)
 		}
 	})
+}
 
-	t.Run("create project in unexistent project group", func(t *testing.T) {
-		expectedErr := `project group with id "unexistentid" doesn't exist`
-		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "unexistentid"}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+func TestUser(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	t.Run("create user", func(t *testing.T) {
+		_, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
 		}
 	})
-	t.Run("create project without parent id specified", func(t *testing.T) {
-		expectedErr := "project parent id required"
-		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+
+	waitReadDB(ctx, t, cs)
+
+	t.Run("create duplicated user", func(t *testing.T) {
+		expectedErr := fmt.Sprintf("user with name %q already exists", "user01")
+		_, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
 		if err.Error() != expectedErr {
 			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
 		}
 	})
-
-	t.Run("concurrent project with same name creation", func(t *testing.T) {
-		prevProjects, err := getProjects(ctx, cs)
+	t.Run("concurrent user with same name creation", func(t *testing.T) {
+		prevUsers, err := getUsers(ctx, cs)
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
@@ -744,704 +1722,8177 @@ func TestProjectGroupsAndProjectsCreate(t *testing.T) {
 		for i := 0; i < 10; i++ {
 			wg.Add(1)
 			go func() {
-				_, _ = cs.ah.CreateProject(ctx, &types.Project{Name: "project02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+				defer wg.Done()
+				_, _ = cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"})
 			}()
-			wg.Done()
 		}
 		wg.Wait()
 
-		time.Sleep(1 * time.Second)
+		waitReadDB(ctx, t, cs)
 
-		projects, err := getProjects(ctx, cs)
+		users, err := getUsers(ctx, cs)
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
 
-		if len(projects) != len(prevProjects)+1 {
-			t.Fatalf("expected %d projects, got %d", len(prevProjects)+1, len(projects))
+		if len(users) != len(prevUsers)+1 {
+			t.Fatalf("expected %d users, got %d", len(prevUsers)+1, len(users))
 		}
 	})
 }
 
-func TestProjectUpdate(t *testing.T) {
-	dir, err := ioutil.TempDir("", "agola")
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+func TestUniqueNamePolicy(t *testing.T) {
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+	}{
+		{
+			name: "test case sensitive names",
+		},
+		{
+			name:            "test case insensitive names",
+			caseInsensitive: true,
+		},
 	}
-	defer os.RemoveAll(dir)
 
-	ctx := context.Background()
-	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+				cs.readDB.SetCaseInsensitiveNames(tt.caseInsensitive)
+			})
+			defer teardown()
 
-	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
-	defer shutdownEtcd(tetcd)
+			if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "Foo"}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if _, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "Org01", Visibility: types.VisibilityPublic}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
 
-	t.Logf("starting cs")
-	go func() {
-		_ = cs.Run(ctx)
-	}()
+			waitReadDB(ctx, t, cs)
 
-	// TODO(sgotti) change the sleep with a real check that all is ready
-	time.Sleep(2 * time.Second)
+			if _, err := cs.ah.CreateProject(ctx, &types.Project{Name: "Project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "user/Foo"}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if _, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "ProjectGroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "user/Foo"}, Visibility: types.VisibilityPublic}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
 
-	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
+			waitReadDB(ctx, t, cs)
 
-	// TODO(sgotti) change the sleep with a real check that user is in readdb
-	time.Sleep(2 * time.Second)
+			// checkCollision checks that the creation of a resource whose name
+			// differs only by its case fails only with case insensitive names
+			checkCollision := func(t *testing.T, expectedErr string, err error) {
+				if !tt.caseInsensitive {
+					if err != nil {
+						t.Fatalf("unexpected err: %v", err)
+					}
+					return
+				}
+				if err == nil {
+					t.Fatalf("expected error %v, got nil err", expectedErr)
+				}
+				if err.Error() != expectedErr {
+					t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+				}
+			}
 
-	_, err = cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	p01 := &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
-	_, err = cs.ah.CreateProject(ctx, p01)
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+			t.Run("create user with name differing only by case", func(t *testing.T) {
+				_, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "foo"})
+				checkCollision(t, fmt.Sprintf("user with name %q already exists", "Foo"), err)
+			})
+			t.Run("create org with name differing only by case", func(t *testing.T) {
+				_, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic})
+				checkCollision(t, fmt.Sprintf("org %q already exists", "Org01"), err)
+			})
+			t.Run("create project with name differing only by case", func(t *testing.T) {
+				_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "user/Foo"}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+				checkCollision(t, fmt.Sprintf("project with name %q, path %q already exists", "Project01", "user/Foo/project01"), err)
+			})
+			t.Run("create project group with name differing only by case", func(t *testing.T) {
+				_, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "user/Foo"}, Visibility: types.VisibilityPublic})
+				checkCollision(t, fmt.Sprintf("project group with name %q, path %q already exists", "ProjectGroup01", "user/Foo/projectgroup01"), err)
+			})
+
+			if !tt.caseInsensitive {
+				return
+			}
+
+			t.Run("lookup by name ignores the case and preserves the display case", func(t *testing.T) {
+				project, err := cs.ah.GetProject(ctx, "user/FOO/PROJECT01")
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				if project.Name != "Project01" {
+					t.Fatalf("expected project name %q, got %q", "Project01", project.Name)
+				}
+			})
+			t.Run("rename user changing only the name case", func(t *testing.T) {
+				user, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "foo", UserName: "fOO"})
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				if user.Name != "fOO" {
+					t.Fatalf("expected user name %q, got %q", "fOO", user.Name)
+				}
+			})
+		})
 	}
-	p02 := &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
-	_, err = cs.ah.CreateProject(ctx, p02)
-	if err != nil {
+}
+
+func TestNameAvailability(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	p03 := &types.Project{Name: "project02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
-	_, err = cs.ah.CreateProject(ctx, p03)
-	if err != nil {
+
+	waitReadDB(ctx, t, cs)
+
+	if _, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "user/user01"}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	t.Run("rename project keeping same parent", func(t *testing.T) {
-		projectName := "project02"
-		p03.Name = "newproject02"
-		_, err := cs.ah.UpdateProject(ctx, &action.UpdateProjectRequest{ProjectRef: path.Join("user", user.Name, "projectgroup01", projectName), Project: p03})
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	t.Run("user names", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			available bool
+		}{
+			{name: "user01", available: false},
+			{name: "user02", available: true},
 		}
-	})
-	t.Run("move project to project group having project with same name", func(t *testing.T) {
-		projectName := "project01"
-		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("user", user.Name, projectName))
-		p02.Parent.ID = path.Join("user", user.Name)
-		_, err := cs.ah.UpdateProject(ctx, &action.UpdateProjectRequest{ProjectRef: path.Join("user", user.Name, "projectgroup01", projectName), Project: p02})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		for _, tt := range tests {
+			available, _, err := csc.UserNameAvailable(ctx, tt.name)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if available != tt.available {
+				t.Fatalf("expected user name %q available %t, got %t", tt.name, tt.available, available)
+			}
 		}
-	})
-	t.Run("move project to project group changing name", func(t *testing.T) {
-		projectName := "project01"
-		p02.Name = "newproject01"
-		p02.Parent.ID = path.Join("user", user.Name)
-		_, err := cs.ah.UpdateProject(ctx, &action.UpdateProjectRequest{ProjectRef: path.Join("user", user.Name, "projectgroup01", projectName), Project: p02})
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
+
+		_, resp, err := csc.UserNameAvailable(ctx, "user-")
+		if err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
 		}
 	})
-}
-
-func TestProjectGroupUpdate(t *testing.T) {
-	dir, err := ioutil.TempDir("", "agola")
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	defer os.RemoveAll(dir)
-
-	ctx := context.Background()
-	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
 
-	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
-	defer shutdownEtcd(tetcd)
+	t.Run("project paths", func(t *testing.T) {
+		tests := []struct {
+			path      string
+			available bool
+		}{
+			{path: "user/user01/project01", available: false},
+			{path: "user/user01/project02", available: true},
+		}
+		for _, tt := range tests {
+			available, _, err := csc.ProjectAvailable(ctx, tt.path)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if available != tt.available {
+				t.Fatalf("expected project path %q available %t, got %t", tt.path, tt.available, available)
+			}
+		}
 
-	t.Logf("starting cs")
-	go func() {
-		_ = cs.Run(ctx)
-	}()
+		for _, projectPath := range []string{"user01", "user/user01/projectgroup01/project01", "user/user01/project-"} {
+			_, resp, err := csc.ProjectAvailable(ctx, projectPath)
+			if err == nil {
+				t.Fatalf("expected error for project path %q, got nil error", projectPath)
+			}
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status code %d for project path %q, got %d", http.StatusBadRequest, projectPath, resp.StatusCode)
+			}
+		}
+	})
 
-	// TODO(sgotti) change the sleep with a real check that all is ready
-	time.Sleep(2 * time.Second)
+	t.Run("a taken name is still rejected on creation", func(t *testing.T) {
+		// the availability is only advisory, the creation always checks the uniqueness
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err == nil {
+			t.Fatalf("expected error creating a user with a taken name, got nil error")
+		}
+	})
+}
 
-	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+func TestPatchUser(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	rs, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+		Name:               "rs01",
+		APIURL:             "https://api.example.com",
+		Type:               types.RemoteSourceTypeGitea,
+		AuthType:           types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:     "clientid",
+		Oauth2ClientSecret: "clientsecret",
+	})
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	// TODO(sgotti) change the sleep with a real check that user is in readdb
-	time.Sleep(2 * time.Second)
+	waitReadDB(ctx, t, cs)
 
-	pg01 := &types.ProjectGroup{Name: "pg01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}
-	pg01, err = cs.ah.CreateProjectGroup(ctx, pg01)
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	pg02 := &types.ProjectGroup{Name: "pg02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}
-	pg02, err = cs.ah.CreateProjectGroup(ctx, pg02)
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	pg03 := &types.ProjectGroup{Name: "pg03", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}
-	pg03, err = cs.ah.CreateProjectGroup(ctx, pg03)
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{
+		UserName: "user01",
+		CreateUserLARequest: &action.CreateUserLARequest{
+			RemoteSourceName: "rs01",
+			RemoteUserID:     "remoteuser01",
+			RemoteUserName:   "remoteuser01",
+		},
+	})
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	pg04 := &types.ProjectGroup{Name: "pg01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name, "pg01")}, Visibility: types.VisibilityPublic}
-	_, err = cs.ah.CreateProjectGroup(ctx, pg04)
-	if err != nil {
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	pg05 := &types.ProjectGroup{Name: "pg01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name, "pg02")}, Visibility: types.VisibilityPublic}
-	pg05, err = cs.ah.CreateProjectGroup(ctx, pg05)
+
+	waitReadDB(ctx, t, cs)
+
+	token, err := cs.ah.CreateUserToken(ctx, "user01", "token01", nil)
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	t.Run("rename project group keeping same parent", func(t *testing.T) {
-		projectGroupName := "pg03"
-		pg03.Name = "newpg03"
-		_, err := cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name, projectGroupName), ProjectGroup: pg03})
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	t.Run("rename user keeping its id, linked accounts and tokens", func(t *testing.T) {
+		newName := "user03"
+		u, _, err := csc.PatchUser(ctx, "user01", &csapitypes.PatchUserRequest{UserName: &newName})
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-	})
-	t.Run("move project to project group having project with same name", func(t *testing.T) {
-		projectGroupName := "pg01"
-		expectedErr := fmt.Sprintf("project group with name %q, path %q already exists", projectGroupName, path.Join("user", user.Name, projectGroupName))
-		pg05.Parent.ID = path.Join("user", user.Name)
-		_, err := cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name, "pg02", projectGroupName), ProjectGroup: pg05})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		if u.ID != user.ID {
+			t.Fatalf("expected user id %q, got %q", user.ID, u.ID)
 		}
-	})
-	t.Run("move project group to project group changing name", func(t *testing.T) {
-		projectGroupName := "pg01"
-		pg05.Name = "newpg01"
-		pg05.Parent.ID = path.Join("user", user.Name)
-		_, err := cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name, "pg02", projectGroupName), ProjectGroup: pg05})
+		if u.Name != newName {
+			t.Fatalf("expected user name %q, got %q", newName, u.Name)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if _, resp, err := csc.GetUser(ctx, "user01"); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected user %q to not exist", "user01")
+		}
+		u, _, err = csc.GetUser(ctx, newName)
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-	})
-	t.Run("move project group inside itself", func(t *testing.T) {
-		projectGroupName := "pg02"
-		expectedErr := "cannot move project group inside itself or child project group"
-		pg02.Parent.ID = path.Join("user", user.Name, "pg02")
-		_, err := cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name, projectGroupName), ProjectGroup: pg02})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
-		}
-	})
-	t.Run("move project group to child project group", func(t *testing.T) {
-		projectGroupName := "pg01"
-		expectedErr := "cannot move project group inside itself or child project group"
-		pg01.Parent.ID = path.Join("user", user.Name, "pg01", "pg01")
-		_, err := cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name, projectGroupName), ProjectGroup: pg01})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		if u.ID != user.ID {
+			t.Fatalf("expected user id %q, got %q", user.ID, u.ID)
 		}
-	})
-	t.Run("change root project group parent", func(t *testing.T) {
 
-		var rootPG *types.ProjectGroup
-		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+		u, _, err = csc.GetUserByToken(ctx, token)
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-		rootPG.Parent.ID = path.Join("user", user.Name, "pg01")
-
-		expectedErr := "cannot change root project group parent type or id"
-		_, err = cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name), ProjectGroup: rootPG})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		if u.ID != user.ID || u.Name != newName {
+			t.Fatalf("expected user %q with name %q, got user %q with name %q", user.ID, newName, u.ID, u.Name)
 		}
-	})
-	t.Run("change root project group name", func(t *testing.T) {
-		var rootPG *types.ProjectGroup
-		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+
+		u, _, err = csc.GetUserByLinkedAccountRemoteUserAndSource(ctx, "remoteuser01", rs.ID)
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-		rootPG.Name = "rootpgnewname"
+		if u.ID != user.ID || u.Name != newName {
+			t.Fatalf("expected user %q with name %q, got user %q with name %q", user.ID, newName, u.ID, u.Name)
+		}
+	})
 
-		expectedErr := "project group name for root project group must be empty"
-		_, err = cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name), ProjectGroup: rootPG})
+	t.Run("rename user to an already existing name", func(t *testing.T) {
+		newName := "user02"
+		expectedErr := fmt.Sprintf("user with name %q already exists", newName)
+		_, resp, err := csc.PatchUser(ctx, "user03", &csapitypes.PatchUserRequest{UserName: &newName})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
 		if err.Error() != expectedErr {
 			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
 		}
 	})
-	t.Run("change root project group visibility", func(t *testing.T) {
-		var rootPG *types.ProjectGroup
-		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
-		}
-		rootPG.Visibility = types.VisibilityPrivate
-
-		_, err = cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name), ProjectGroup: rootPG})
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
-		}
 
-		rootPG, err = cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
+	t.Run("rename user with an invalid name", func(t *testing.T) {
+		newName := "invalid name"
+		_, resp, err := csc.PatchUser(ctx, "user03", &csapitypes.PatchUserRequest{UserName: &newName})
+		if err == nil {
+			t.Fatalf("expected error, got nil err")
 		}
-		if rootPG.Visibility != types.VisibilityPrivate {
-			t.Fatalf("expected visiblity %q, got visibility: %q", types.VisibilityPublic, rootPG.Visibility)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
 		}
 	})
 }
 
-func TestProjectGroupDelete(t *testing.T) {
-	dir, err := ioutil.TempDir("", "agola")
-	if err != nil {
+func TestImportUsers(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	if _, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+		Name:               "rs01",
+		APIURL:             "https://api.example.com",
+		Type:               types.RemoteSourceTypeGitea,
+		AuthType:           types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:     "clientid",
+		Oauth2ClientSecret: "clientsecret",
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	defer os.RemoveAll(dir)
-
-	ctx := context.Background()
-	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
 
-	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
-	defer shutdownEtcd(tetcd)
+	waitReadDB(ctx, t, cs)
 
-	t.Logf("starting cs")
-	go func() {
-		_ = cs.Run(ctx)
-	}()
+	baseURL := fmt.Sprintf("http://%s/api/v1alpha", cs.c.Web.ListenAddress)
+	csclient := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
 
-	// TODO(sgotti) change the sleep with a real check that all is ready
-	time.Sleep(2 * time.Second)
+	importUsers := func(t *testing.T, req []*csapitypes.CreateUserRequest) (*http.Response, *util.APIError) {
+		reqj, err := json.Marshal(req)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp, err := http.Post(baseURL+"/users/import", "application/json", bytes.NewReader(reqj))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
 
-	org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+		if resp.StatusCode == http.StatusCreated {
+			return resp, nil
+		}
+		var apiErr *util.APIError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return resp, apiErr
 	}
 
-	// TODO(sgotti) change the sleep with a real check that user is in readdb
-	time.Sleep(2 * time.Second)
+	t.Run("partial failure rolls back the whole batch", func(t *testing.T) {
+		prevUsers, err := getUsers(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
 
-	// create a projectgroup in org root project group
-	pg01, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
+		resp, apiErr := importUsers(t, []*csapitypes.CreateUserRequest{
+			{UserName: "user02"},
+			{UserName: "user01"},
+			{UserName: "user03", CreateUserLARequest: &csapitypes.CreateUserLARequest{RemoteSourceName: "rs02", RemoteUserID: "1"}},
+			{UserName: "inv@lid"},
+			{UserName: "user04", CreateUserLARequest: &csapitypes.CreateUserLARequest{RemoteSourceName: "rs01", RemoteUserID: "1"}},
+		})
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		expectedErr := &util.APIError{
+			Code:    action.ErrorCodeUsersImportRejected,
+			Message: "3 of 5 users rejected, no user imported",
+			Details: []string{
+				fmt.Sprintf("users[1]: user with name %q already exists", "user01"),
+				fmt.Sprintf("users[2]: remote source %q doesn't exist", "rs02"),
+				fmt.Sprintf("users[3]: invalid user name %q", "inv@lid"),
+			},
+		}
+		if diff := cmp.Diff(expectedErr, apiErr); diff != "" {
+			t.Fatalf("api error mismatch (-expected +got):\n%s", diff)
+		}
 
-	// create a child projectgroup in org root project group
-	_, err = cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "subprojectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: pg01.ID}, Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
+		waitReadDB(ctx, t, cs)
 
-	t.Run("delete root project group", func(t *testing.T) {
-		expectedErr := "cannot delete root project group"
-		err := cs.ah.DeleteProjectGroup(ctx, path.Join("org", org.Name))
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		users, err := getUsers(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(users) != len(prevUsers) {
+			t.Fatalf("expected %d users, got %d", len(prevUsers), len(users))
 		}
 	})
 
-	t.Run("delete project group", func(t *testing.T) {
-		err := cs.ah.DeleteProjectGroup(ctx, pg01.ID)
+	t.Run("duplicate names in the batch", func(t *testing.T) {
+		resp, apiErr := importUsers(t, []*csapitypes.CreateUserRequest{
+			{UserName: "user02"},
+			{UserName: "user03", CreateUserLARequest: &csapitypes.CreateUserLARequest{RemoteSourceName: "rs01", RemoteUserID: "1"}},
+			{UserName: "user02"},
+			{UserName: "user04", CreateUserLARequest: &csapitypes.CreateUserLARequest{RemoteSourceName: "rs01", RemoteUserID: "1"}},
+		})
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		expectedErr := &util.APIError{
+			Code:    action.ErrorCodeUsersImportRejected,
+			Message: "2 of 4 users rejected, no user imported",
+			Details: []string{
+				fmt.Sprintf("users[2]: duplicate user name %q", "user02"),
+				fmt.Sprintf("users[3]: duplicate remote user id %q for remote source %q", "1", "rs01"),
+			},
+		}
+		if diff := cmp.Diff(expectedErr, apiErr); diff != "" {
+			t.Fatalf("api error mismatch (-expected +got):\n%s", diff)
+		}
+	})
+
+	t.Run("import users", func(t *testing.T) {
+		iresp, _, err := csclient.ImportUsers(ctx, []*csapitypes.CreateUserRequest{
+			{UserName: "user02"},
+			{UserName: "user03", CreateUserLARequest: &csapitypes.CreateUserLARequest{RemoteSourceName: "rs01", RemoteUserID: "1"}},
+		})
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
+		if len(iresp.Users) != 2 {
+			t.Fatalf("expected %d imported users, got %d", 2, len(iresp.Users))
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		for _, iu := range iresp.Users {
+			user, _, err := csclient.GetUser(ctx, iu.ID)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if user.Name != iu.UserName {
+				t.Fatalf("expected user name %q, got %q", iu.UserName, user.Name)
+			}
+			// the user root project group must exist
+			if _, _, err := csclient.GetProjectGroup(ctx, path.Join("user", user.Name)); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+		}
 	})
 }
 
-func TestProjectGroupDeleteDontSeeOldChildObjects(t *testing.T) {
-	dir, err := ioutil.TempDir("", "agola")
+func TestProjectGroupsAndProjectsCreate(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	defer os.RemoveAll(dir)
-
-	ctx := context.Background()
-	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
-
-	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
-	defer shutdownEtcd(tetcd)
-
-	t.Logf("starting cs")
-	go func() {
-		_ = cs.Run(ctx)
-	}()
-
-	// TODO(sgotti) change the sleep with a real check that all is ready
-	time.Sleep(2 * time.Second)
-
 	org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic})
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	// TODO(sgotti) change the sleep with a real check that user is in readdb
-	time.Sleep(2 * time.Second)
+	waitReadDB(ctx, t, cs)
 
-	// create a projectgroup in org root project group
-	pg01, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
+	t.Run("create a project in user root project group", func(t *testing.T) {
+		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("create a project in org root project group", func(t *testing.T) {
+		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("create a projectgroup in user root project group", func(t *testing.T) {
+		_, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("create a projectgroup in org root project group", func(t *testing.T) {
+		_, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("create a project in user non root project group with same name as a root project", func(t *testing.T) {
+		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("create a project in org non root project group with same name as a root project", func(t *testing.T) {
+		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
 
-	// create a child projectgroup in org root project group
-	spg01, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "subprojectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: pg01.ID}, Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
+	t.Run("create duplicated project in user root project group", func(t *testing.T) {
+		projectName := "project01"
+		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("user", user.Name, projectName))
+		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: projectName, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("create duplicated project in org root project group", func(t *testing.T) {
+		projectName := "project01"
+		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("org", org.Name, projectName))
+		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: projectName, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
 
-	// create a project inside child projectgroup
-	project, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: spg01.ID}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	t.Run("create duplicated project in user non root project group", func(t *testing.T) {
+		projectName := "project01"
+		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("user", user.Name, "projectgroup01", projectName))
+		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: projectName, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("create duplicated project in org non root project group", func(t *testing.T) {
+		projectName := "project01"
+		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("org", org.Name, "projectgroup01", projectName))
+		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: projectName, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("create project in unexistent project group", func(t *testing.T) {
+		expectedErr := `project group with id "unexistentid" doesn't exist`
+		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "unexistentid"}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("create project without parent id specified", func(t *testing.T) {
+		expectedErr := "project parent id required"
+		_, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("concurrent project with same name creation", func(t *testing.T) {
+		prevProjects, err := getProjects(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _ = cs.ah.CreateProject(ctx, &types.Project{Name: "project02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+			}()
+		}
+		wg.Wait()
+
+		waitReadDB(ctx, t, cs)
+
+		projects, err := getProjects(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		if len(projects) != len(prevProjects)+1 {
+			t.Fatalf("expected %d projects, got %d", len(prevProjects)+1, len(projects))
+		}
+	})
+}
+
+func TestListOrdering(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.ah.SetSoftDelete(true, time.Hour)
+	})
+	defer teardown()
+
+	for _, userName := range []string{"user02", "user01", "user03"} {
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	for _, rsName := range []string{"rs02", "rs01", "rs03"} {
+		if _, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+			Name:               rsName,
+			APIURL:             "https://api.example.com",
+			Type:               types.RemoteSourceTypeGitea,
+			AuthType:           types.RemoteSourceAuthTypeOauth2,
+			Oauth2ClientID:     "clientid",
+			Oauth2ClientSecret: "clientsecret",
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
 	}
 
-	// create project secret
-	_, err = cs.ah.CreateSecret(ctx, &types.Secret{Name: "secret01", Parent: types.Parent{Type: types.ConfigTypeProject, ID: project.ID}, Type: types.SecretTypeInternal, Data: map[string]string{"secret01": "secretvar01"}})
-	if err != nil {
+	waitReadDB(ctx, t, cs)
+
+	// a soft deleted user with the same name of an existing one
+	if err := cs.ah.DeleteUser(ctx, "user01", ""); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	// create project variable
-	_, err = cs.ah.CreateVariable(ctx, &types.Variable{Name: "variable01", Parent: types.Parent{Type: types.ConfigTypeProject, ID: project.ID}, Values: []types.VariableValue{{SecretName: "secret01", SecretVar: "secretvar01"}}})
-	if err != nil {
+	waitReadDB(ctx, t, cs)
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
+	waitReadDB(ctx, t, cs)
+
+	// projects with the same name in different parents
+	for _, p := range []struct{ userName, projectName string }{
+		{"user03", "project01"},
+		{"user02", "project02"},
+		{"user01", "project01"},
+		{"user02", "project01"},
+	} {
+		if _, err := cs.ah.CreateProject(ctx, &types.Project{Name: p.projectName, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", p.userName)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
 
-	// delete projectgroup
-	if err = cs.ah.DeleteProjectGroup(ctx, pg01.ID); err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	waitReadDB(ctx, t, cs)
+
+	type listItem struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	list := func(t *testing.T, u string) []listItem {
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		items := []listItem{}
+		if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return items
 	}
 
-	// recreate the same hierarchj using the paths
-	pg01, err = cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	tests := []struct {
+		name          string
+		resource      string
+		query         string
+		expectedCount int
+	}{
+		{name: "users", resource: "users", query: "includeDeleted=true", expectedCount: 4},
+		{name: "projects", resource: "projects", expectedCount: 4},
+		{name: "remote sources", resource: "remotesources", expectedCount: 3},
 	}
-	spg01, err = cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "subprojectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name, pg01.Name)}, Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+
+	for _, tt := range tests {
+		for _, asc := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s asc %t", tt.name, asc), func(t *testing.T) {
+				q := url.Values{}
+				if tt.query != "" {
+					var err error
+					if q, err = url.ParseQuery(tt.query); err != nil {
+						t.Fatalf("unexpected err: %v", err)
+					}
+				}
+				if asc {
+					q.Set("asc", "")
+				}
+				u := fmt.Sprintf("http://%s/api/v1alpha/%s?%s", cs.c.Web.ListenAddress, tt.resource, q.Encode())
+
+				items := list(t, u)
+				if len(items) != tt.expectedCount {
+					t.Fatalf("expected %d items, got %d: %v", tt.expectedCount, len(items), items)
+				}
+
+				expectedItems := append([]listItem{}, items...)
+				sort.Slice(expectedItems, func(i, j int) bool {
+					a, b := expectedItems[i], expectedItems[j]
+					if !asc {
+						a, b = b, a
+					}
+					if a.Name != b.Name {
+						return a.Name < b.Name
+					}
+					return a.ID < b.ID
+				})
+				if diff := cmp.Diff(expectedItems, items); diff != "" {
+					t.Fatalf("items not ordered by name and id (-expected +got):\n%s", diff)
+				}
+
+				for i := 0; i < 5; i++ {
+					if diff := cmp.Diff(items, list(t, u)); diff != "" {
+						t.Fatalf("items order changed (-expected +got):\n%s", diff)
+					}
+				}
+			})
+		}
 	}
-	project, err = cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name, pg01.Name, spg01.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+}
+
+func TestSearch(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.c.Auth.Enabled = true
+		cs.c.Auth.AdminToken = "admintoken"
+	})
+	defer teardown()
+
+	for _, userName := range []string{"foouser01", "foouser02", "baruser01"} {
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
 	}
-	secret, err := cs.ah.CreateSecret(ctx, &types.Secret{Name: "secret01", Parent: types.Parent{Type: types.ConfigTypeProject, ID: path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name)}, Type: types.SecretTypeInternal, Data: map[string]string{"secret01": "secretvar01"}})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	for _, rsName := range []string{"foors01", "barrs01"} {
+		if _, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+			Name:               rsName,
+			APIURL:             "https://api.example.com",
+			Type:               types.RemoteSourceTypeGitea,
+			AuthType:           types.RemoteSourceAuthTypeOauth2,
+			Oauth2ClientID:     "clientid",
+			Oauth2ClientSecret: "clientsecret",
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
 	}
-	variable, err := cs.ah.CreateVariable(ctx, &types.Variable{Name: "variable01", Parent: types.Parent{Type: types.ConfigTypeProject, ID: path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name)}, Values: []types.VariableValue{{SecretName: "secret01", SecretVar: "secretvar01"}}})
-	if err != nil {
+	if _, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	// Get by projectgroup id
-	projects, err := cs.ah.GetProjectGroupProjects(ctx, spg01.ID)
-	if err != nil {
+	waitReadDB(ctx, t, cs)
+
+	if _, err := cs.ah.AddOrgMember(ctx, "org01", "foouser01", types.MemberRoleMember); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	if diff := cmp.Diff(projects, []*types.Project{project}); diff != "" {
-		t.Error(diff)
+	for _, p := range []struct {
+		parent     string
+		name       string
+		visibility types.Visibility
+	}{
+		{"user/foouser01", "fooproject01", types.VisibilityPublic},
+		{"user/foouser01", "fooproject02", types.VisibilityPrivate},
+		{"user/foouser02", "fooproject01", types.VisibilityPrivate},
+		{"user/foouser02", "barproject01", types.VisibilityPublic},
+		{"org/org01", "fooproject01", types.VisibilityPrivate},
+	} {
+		if _, err := cs.ah.CreateProject(ctx, &types.Project{Name: p.name, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: p.parent}, Visibility: p.visibility, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
 	}
 
-	// Get by projectgroup path
-	projects, err = cs.ah.GetProjectGroupProjects(ctx, path.Join("org", org.Name, pg01.Name, spg01.Name))
+	readToken, err := cs.ah.CreateUserToken(ctx, "foouser01", "readtoken", nil)
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	if diff := cmp.Diff(projects, []*types.Project{project}); diff != "" {
-		t.Error(diff)
+
+	waitReadDB(ctx, t, cs)
+
+	// names returns the paths of the found projects and the names of the other
+	// found resources, checking that every result has the right type and an id
+	names := func(t *testing.T, res *csapitypes.SearchResponse) map[types.ConfigType][]string {
+		found := map[types.ConfigType][]string{}
+		for configType, results := range map[types.ConfigType][]*csapitypes.SearchResult{
+			types.ConfigTypeProject:      res.Projects,
+			types.ConfigTypeUser:         res.Users,
+			types.ConfigTypeRemoteSource: res.RemoteSources,
+		} {
+			found[configType] = []string{}
+			for _, r := range results {
+				if r.Type != configType {
+					t.Fatalf("expected result type %q, got %q", configType, r.Type)
+				}
+				if r.ID == "" {
+					t.Fatalf("expected result id, got empty id")
+				}
+				name := r.Name
+				if configType == types.ConfigTypeProject {
+					name = r.Path
+				}
+				found[configType] = append(found[configType], name)
+			}
+		}
+		return found
 	}
 
-	secrets, err := cs.ah.GetSecrets(ctx, types.ConfigTypeProject, project.ID, false)
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	allProjects := []string{"org/org01/fooproject01", "user/foouser01/fooproject01", "user/foouser01/fooproject02", "user/foouser02/fooproject01"}
+
+	tests := []struct {
+		name     string
+		token    string
+		term     string
+		limit    int
+		expected map[types.ConfigType][]string
+	}{
+		{
+			name:  "admin token",
+			token: "admintoken",
+			term:  "foo",
+			expected: map[types.ConfigType][]string{
+				types.ConfigTypeProject:      allProjects,
+				types.ConfigTypeUser:         {"foouser01", "foouser02"},
+				types.ConfigTypeRemoteSource: {"foors01"},
+			},
+		},
+		{
+			name:  "case insensitive term",
+			token: "admintoken",
+			term:  "FOO",
+			expected: map[types.ConfigType][]string{
+				types.ConfigTypeProject:      allProjects,
+				types.ConfigTypeUser:         {"foouser01", "foouser02"},
+				types.ConfigTypeRemoteSource: {"foors01"},
+			},
+		},
+		{
+			name:  "user token hides the private projects of other users",
+			token: readToken,
+			term:  "foo",
+			expected: map[types.ConfigType][]string{
+				types.ConfigTypeProject:      {"org/org01/fooproject01", "user/foouser01/fooproject01", "user/foouser01/fooproject02"},
+				types.ConfigTypeUser:         {"foouser01", "foouser02"},
+				types.ConfigTypeRemoteSource: {"foors01"},
+			},
+		},
+		{
+			name:  "per type limit",
+			token: readToken,
+			term:  "user0",
+			limit: 2,
+			expected: map[types.ConfigType][]string{
+				types.ConfigTypeProject:      {},
+				types.ConfigTypeUser:         {"baruser01", "foouser01"},
+				types.ConfigTypeRemoteSource: {},
+			},
+		},
+		{
+			name:  "no matches",
+			token: "admintoken",
+			term:  "baz",
+			expected: map[types.ConfigType][]string{
+				types.ConfigTypeProject:      {},
+				types.ConfigTypeUser:         {},
+				types.ConfigTypeRemoteSource: {},
+			},
+		},
 	}
-	if diff := cmp.Diff(secrets, []*types.Secret{secret}); diff != "" {
-		t.Error(diff)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+			csc.SetToken(tt.token)
+
+			res, _, err := csc.Search(ctx, tt.term, tt.limit)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			found := names(t, res)
+			for _, configType := range []types.ConfigType{types.ConfigTypeProject, types.ConfigTypeUser, types.ConfigTypeRemoteSource} {
+				sort.Strings(found[configType])
+			}
+			if diff := cmp.Diff(tt.expected, found); diff != "" {
+				t.Fatalf("search results mismatch (-want +got):\n%s", diff)
+			}
+		})
 	}
 
-	secrets, err = cs.ah.GetSecrets(ctx, types.ConfigTypeProject, path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name), false)
+	t.Run("empty term", func(t *testing.T) {
+		csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+		csc.SetToken("admintoken")
+
+		_, resp, err := csc.Search(ctx, "", 0)
+		if err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
+
+func TestProjectUpdate(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	if diff := cmp.Diff(secrets, []*types.Secret{secret}); diff != "" {
-		t.Error(diff)
-	}
 
-	variables, err := cs.ah.GetVariables(ctx, types.ConfigTypeProject, project.ID, false)
+	waitReadDB(ctx, t, cs)
+
+	_, err = cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	p01 := &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
+	_, err = cs.ah.CreateProject(ctx, p01)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	p02 := &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
+	_, err = cs.ah.CreateProject(ctx, p02)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	p03 := &types.Project{Name: "project02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
+	_, err = cs.ah.CreateProject(ctx, p03)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("rename project keeping same parent", func(t *testing.T) {
+		projectName := "project02"
+		p03.Name = "newproject02"
+		_, err := cs.ah.UpdateProject(ctx, &action.UpdateProjectRequest{ProjectRef: path.Join("user", user.Name, "projectgroup01", projectName), Project: p03})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("move project to project group having project with same name", func(t *testing.T) {
+		projectName := "project01"
+		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("user", user.Name, projectName))
+		p02.Parent.ID = path.Join("user", user.Name)
+		_, err := cs.ah.UpdateProject(ctx, &action.UpdateProjectRequest{ProjectRef: path.Join("user", user.Name, "projectgroup01", projectName), Project: p02})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("move project to project group changing name", func(t *testing.T) {
+		projectName := "project01"
+		p02.Name = "newproject01"
+		p02.Parent.ID = path.Join("user", user.Name)
+		_, err := cs.ah.UpdateProject(ctx, &action.UpdateProjectRequest{ProjectRef: path.Join("user", user.Name, "projectgroup01", projectName), Project: p02})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
+
+func TestETags(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	project, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	baseURL := fmt.Sprintf("http://%s/api/v1alpha", cs.c.Web.ListenAddress)
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	doRequest := func(method, u, etag string, req interface{}) *http.Response {
+		reqj, err := json.Marshal(req)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		hreq, err := http.NewRequest(method, u, bytes.NewReader(reqj))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if etag != "" {
+			hreq.Header.Set("If-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(hreq)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("concurrent project update", func(t *testing.T) {
+		_, resp, err := csc.GetProject(ctx, project.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			t.Fatalf("expected ETag header")
+		}
+
+		// both writers read the same project revision
+		projectURL := fmt.Sprintf("%s/projects/%s", baseURL, project.ID)
+		writer1Project := *project
+		writer1Project.Visibility = types.VisibilityPrivate
+		if resp := doRequest("PUT", projectURL, etag, writer1Project); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, resp.StatusCode)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		writer2Project := *project
+		writer2Project.Name = "project02"
+		if resp := doRequest("PUT", projectURL, etag, writer2Project); resp.StatusCode != http.StatusPreconditionFailed {
+			t.Fatalf("expected status code %d, got %d", http.StatusPreconditionFailed, resp.StatusCode)
+		}
+		if resp := doRequest("DELETE", projectURL, etag, nil); resp.StatusCode != http.StatusPreconditionFailed {
+			t.Fatalf("expected status code %d, got %d", http.StatusPreconditionFailed, resp.StatusCode)
+		}
+
+		p, resp, err := csc.GetProject(ctx, project.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if p.Name != project.Name || p.Visibility != types.VisibilityPrivate {
+			t.Fatalf("expected project changed only by the first writer, got: %s", util.Dump(p))
+		}
+		newETag := resp.Header.Get("ETag")
+		if newETag == etag {
+			t.Fatalf("expected ETag to change after update")
+		}
+		_, err = cs.ah.UpdateProject(ctx, &action.UpdateProjectRequest{ProjectRef: project.ID, Project: &writer2Project, ExpectedRevision: "wrongrevision"})
+		if !util.IsPreconditionFailed(err) {
+			t.Fatalf("expected precondition failed error, got: %v", err)
+		}
+
+		if resp := doRequest("DELETE", projectURL, newETag, nil); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected status code %d, got %d", http.StatusNoContent, resp.StatusCode)
+		}
+	})
+
+	t.Run("concurrent user update", func(t *testing.T) {
+		_, resp, err := csc.GetUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			t.Fatalf("expected ETag header")
+		}
+
+		userURL := fmt.Sprintf("%s/users/%s", baseURL, user.ID)
+		if resp := doRequest("PUT", userURL, etag, &csapitypes.UpdateUserRequest{UserName: "user02"}); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, resp.StatusCode)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if resp := doRequest("PUT", userURL, etag, &csapitypes.UpdateUserRequest{UserName: "user03"}); resp.StatusCode != http.StatusPreconditionFailed {
+			t.Fatalf("expected status code %d, got %d", http.StatusPreconditionFailed, resp.StatusCode)
+		}
+		if resp := doRequest("DELETE", userURL, etag, nil); resp.StatusCode != http.StatusPreconditionFailed {
+			t.Fatalf("expected status code %d, got %d", http.StatusPreconditionFailed, resp.StatusCode)
+		}
+		if resp := doRequest("DELETE", userURL, `wrong"etag`, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+
+		u, _, err := csc.GetUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if u.Name != "user02" {
+			t.Fatalf("expected user name %q, got %q", "user02", u.Name)
+		}
+	})
+}
+
+func TestAPIErrors(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	project := &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
+	if _, err := cs.ah.CreateProject(ctx, project); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	baseURL := fmt.Sprintf("http://%s/api/v1alpha", cs.c.Web.ListenAddress)
+
+	tests := []struct {
+		name               string
+		method             string
+		path               string
+		req                interface{}
+		expectedStatusCode int
+		expected           *util.APIError
+		// expectedAllow is the expected Allow header
+		expectedAllow string
+	}{
+		{
+			name:               "not existing project",
+			method:             "GET",
+			path:               "/projects/" + url.PathEscape(path.Join("user", user.Name, "project02")),
+			expectedStatusCode: http.StatusNotFound,
+			expected: &util.APIError{
+				Code:    util.ErrorCodeNotExist,
+				Message: fmt.Sprintf("project %q doesn't exist", path.Join("user", user.Name, "project02")),
+			},
+		},
+		{
+			name:               "duplicate project",
+			method:             "POST",
+			path:               "/projects",
+			req:                &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual},
+			expectedStatusCode: http.StatusConflict,
+			expected: &util.APIError{
+				Code:    action.ErrorCodeProjectAlreadyExists,
+				Message: fmt.Sprintf("project with name %q, path %q already exists", "project01", path.Join("user", user.Name, "project01")),
+			},
+		},
+		{
+			name:               "not existing route",
+			method:             "GET",
+			path:               "/notexistingroute",
+			expectedStatusCode: http.StatusNotFound,
+			expected: &util.APIError{
+				Code:    util.ErrorCodeNotExist,
+				Message: fmt.Sprintf("path %q not found", "/api/v1alpha/notexistingroute"),
+			},
+		},
+		{
+			name:               "not allowed method",
+			method:             "POST",
+			path:               "/projects/" + url.PathEscape(path.Join("user", user.Name, "project01")),
+			expectedStatusCode: http.StatusMethodNotAllowed,
+			expected: &util.APIError{
+				Code:    util.ErrorCodeBadRequest,
+				Message: "method POST not allowed",
+			},
+			expectedAllow: "GET, PUT, PATCH, DELETE, OPTIONS",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.req != nil {
+				reqj, err := json.Marshal(tt.req)
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				body = bytes.NewReader(reqj)
+			}
+			req, err := http.NewRequest(tt.method, baseURL+tt.path, body)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("expected status code %d, got %d", tt.expectedStatusCode, resp.StatusCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("expected content type %q, got %q", "application/json", ct)
+			}
+			if allow := resp.Header.Get("Allow"); allow != tt.expectedAllow {
+				t.Fatalf("expected Allow header %q, got %q", tt.expectedAllow, allow)
+			}
+			var apiErr *util.APIError
+			if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, apiErr); diff != "" {
+				t.Fatalf("api error mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("options request", func(t *testing.T) {
+		req, err := http.NewRequest("OPTIONS", baseURL+"/projects", nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected status code %d, got %d", http.StatusNoContent, resp.StatusCode)
+		}
+		expectedAllow := "GET, POST, DELETE, OPTIONS"
+		if allow := resp.Header.Get("Allow"); allow != expectedAllow {
+			t.Fatalf("expected Allow header %q, got %q", expectedAllow, allow)
+		}
+	})
+}
+
+func TestContentNegotiation(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	project, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	baseURL := fmt.Sprintf("http://%s/api/v1alpha", cs.c.Web.ListenAddress)
+	projectPath := path.Join("user", user.Name, "project01")
+
+	get := func(t *testing.T, p, accept string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", baseURL+p, nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return resp, body
+	}
+
+	tests := []struct {
+		name                string
+		accept              string
+		expectedContentType string
+	}{
+		{
+			name:                "no accept header",
+			expectedContentType: "application/json",
+		},
+		{
+			name:                "json",
+			accept:              "application/json",
+			expectedContentType: "application/json",
+		},
+		{
+			name:                "yaml",
+			accept:              "application/yaml",
+			expectedContentType: "application/yaml",
+		},
+		{
+			name:                "yaml preferred to json",
+			accept:              "application/json;q=0.5, application/yaml",
+			expectedContentType: "application/yaml",
+		},
+		{
+			name:                "json preferred to yaml",
+			accept:              "application/json, application/yaml",
+			expectedContentType: "application/json",
+		},
+		{
+			name:                "unsupported media type",
+			accept:              "text/html",
+			expectedContentType: "application/json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unmarshal := json.Unmarshal
+			if tt.expectedContentType == "application/yaml" {
+				unmarshal = yaml.Unmarshal
+			}
+
+			resp, body := get(t, "/projects/"+url.PathEscape(projectPath), tt.accept)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != tt.expectedContentType {
+				t.Fatalf("expected content type %q, got %q", tt.expectedContentType, ct)
+			}
+			if tt.expectedContentType == "application/yaml" && json.Valid(body) {
+				t.Fatalf("expected a yaml response, got: %s", body)
+			}
+			var p *csapitypes.Project
+			if err := unmarshal(body, &p); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if p.ID != project.ID || p.Name != project.Name || p.Path != projectPath {
+				t.Fatalf("unexpected project: %s", util.Dump(p))
+			}
+
+			// errors are returned in the same content type
+			resp, body = get(t, "/projects/"+url.PathEscape(path.Join("user", user.Name, "project02")), tt.accept)
+			if resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != tt.expectedContentType {
+				t.Fatalf("expected content type %q, got %q", tt.expectedContentType, ct)
+			}
+			var apiErr *util.APIError
+			if err := unmarshal(body, &apiErr); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			expectedErr := &util.APIError{
+				Code:    util.ErrorCodeNotExist,
+				Message: fmt.Sprintf("project %q doesn't exist", path.Join("user", user.Name, "project02")),
+			}
+			if diff := cmp.Diff(expectedErr, apiErr); diff != "" {
+				t.Fatalf("api error mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSetupDataDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("missing data dir is created", func(t *testing.T) {
+		dataDir := filepath.Join(dir, "missing", "configstore")
+		if err := setupDataDirs(dataDir, 0750); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		for _, d := range []string{dataDir, filepath.Join(dataDir, "readdb")} {
+			fi, err := os.Stat(d)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			// the umask could remove some permissions
+			if !fi.IsDir() || fi.Mode().Perm()&^0750 != 0 || fi.Mode().Perm()&0700 != 0700 {
+				t.Fatalf("expected directory %q with mode 0750, got %s", d, fi.Mode())
+			}
+		}
+		// existing data dirs are accepted
+		if err := setupDataDirs(dataDir, 0750); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	t.Run("data dir isn't a directory", func(t *testing.T) {
+		dataDir := filepath.Join(dir, "file")
+		if err := ioutil.WriteFile(dataDir, []byte{}, 0660); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedErr := fmt.Sprintf("data dir %q isn't a directory", dataDir)
+		err := setupDataDirs(dataDir, 0750)
+		if err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("data dir isn't writable", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("the permissions aren't enforced for root")
+		}
+		dataDir := filepath.Join(dir, "notwritable")
+		if err := os.Mkdir(dataDir, 0500); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer func() { _ = os.Chmod(dataDir, 0700) }()
+
+		expectedErr := fmt.Sprintf("data dir %q isn't writable", dataDir)
+		err := setupDataDirs(dataDir, 0750)
+		if err == nil || !strings.HasPrefix(err.Error(), expectedErr) {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		if err := os.Chmod(dataDir, 0700); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if err := os.Mkdir(filepath.Join(dataDir, "readdb"), 0500); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer func() { _ = os.Chmod(filepath.Join(dataDir, "readdb"), 0700) }()
+		expectedErr = fmt.Sprintf("data dir %q isn't writable", filepath.Join(dataDir, "readdb"))
+		err = setupDataDirs(dataDir, 0750)
+		if err == nil || !strings.HasPrefix(err.Error(), expectedErr) {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("data dir owned by another user", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("changing the owner requires root")
+		}
+		dataDir := filepath.Join(dir, "otheruser")
+		if err := os.Mkdir(dataDir, 0770); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if err := os.Chown(dataDir, 65534, 65534); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedErr := fmt.Sprintf("data dir %q is owned by uid 65534 but the configstore is running as uid 0", dataDir)
+		err := setupDataDirs(dataDir, 0750)
+		if err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestRequestTimeout(t *testing.T) {
+	_, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.c.RequestTimeout = config.RequestTimeout{Read: 200 * time.Millisecond}
+	})
+	defer teardown()
+
+	// slowHandler simulates a slow readdb query that lasts until the request
+	// context is done or for the provided duration
+	workErrs := make(chan error, 1)
+	slowHandler := func(d time.Duration) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := cs.readDB.Do(r.Context(), func(tx *db.Tx) error {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(d):
+				}
+				_, err := tx.Exec("select 1")
+				return err
+			})
+			workErrs <- err
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+
+	t.Run("slow read request times out", func(t *testing.T) {
+		ts := httptest.NewServer(cs.timeoutMiddleware(slowHandler(10 * time.Second)))
+		defer ts.Close()
+
+		start := time.Now()
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Fatalf("expected status code %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("expected response after the timeout, got it after %s", elapsed)
+		}
+
+		// the readdb work must have been canceled
+		select {
+		case err := <-workErrs:
+			if err == nil {
+				t.Fatalf("expected readdb query error after the timeout")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("readdb work not canceled")
+		}
+	})
+
+	t.Run("fast read request doesn't time out", func(t *testing.T) {
+		ts := httptest.NewServer(cs.timeoutMiddleware(slowHandler(0)))
+		defer ts.Close()
+
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if err := <-workErrs; err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	t.Run("write request without write timeout", func(t *testing.T) {
+		ts := httptest.NewServer(cs.timeoutMiddleware(slowHandler(500 * time.Millisecond)))
+		defer ts.Close()
+
+		resp, err := http.Post(ts.URL, "application/json", nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if err := <-workErrs; err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
+
+func TestLongLivedRequestsTimeout(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		// a timeout exceeded by every request: only the long lived requests
+		// complete
+		cs.c.RequestTimeout = config.RequestTimeout{Read: time.Nanosecond, Write: time.Nanosecond}
+	})
+	defer teardown()
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	const usersCount = 1050
+
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	if err := enc.Encode(&types.ExportHeader{Version: types.ExportVersion}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for i := 0; i < usersCount; i++ {
+		userj, err := json.Marshal(&types.User{ID: uuid.NewV4().String(), Name: fmt.Sprintf("user%04d", i)})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if err := enc.Encode(&types.ExportRecord{Type: types.ConfigTypeUser, Data: userj}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	t.Run("import completes", func(t *testing.T) {
+		resp, err := csc.ImportResources(ctx, &data)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		wctx, wcancel := context.WithTimeout(ctx, 10*time.Second)
+		defer wcancel()
+		if err := cs.readDB.WaitRevision(wctx, csclient.ResponseRevision(resp)); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	t.Run("other requests time out", func(t *testing.T) {
+		_, resp, err := csc.GetUsers(ctx, "", 0, true)
+		if err == nil {
+			t.Fatalf("expected timeout error")
+		}
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Fatalf("expected status code %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+		}
+	})
+
+	t.Run("resources export completes", func(t *testing.T) {
+		r, _, err := csc.ExportResources(ctx)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if lines := bytes.Count(data, []byte("\n")); lines != usersCount+1 {
+			t.Fatalf("expected %d exported lines, got %d", usersCount+1, lines)
+		}
+	})
+
+	t.Run("export completes", func(t *testing.T) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/api/v1alpha/export", cs.c.Web.ListenAddress))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	t.Run("selfcheck repair completes", func(t *testing.T) {
+		if _, _, err := csc.RepairSelfCheck(ctx); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
+
+func TestMinRevision(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	user, resp, err := csc.CreateUser(ctx, &csapitypes.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	revision := csclient.ResponseRevision(resp)
+	if revision == 0 {
+		t.Fatalf("expected revision header in the write response")
+	}
+
+	t.Run("read own writes", func(t *testing.T) {
+		if _, _, err := csc.GetUser(csclient.WithMinRevision(ctx, revision), user.ID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		for i := 0; i < 20; i++ {
+			projectName := fmt.Sprintf("project%02d", i)
+			_, resp, err := csc.CreateProject(ctx, &types.Project{Name: projectName, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			revision := csclient.ResponseRevision(resp)
+			if revision == 0 {
+				t.Fatalf("expected revision header in the write response")
+			}
+
+			project, resp, err := csc.GetProject(csclient.WithMinRevision(ctx, revision), path.Join("user", user.Name, projectName))
+			if err != nil {
+				t.Fatalf("unexpected err: %v, status code: %d", err, resp.StatusCode)
+			}
+			if project.Name != projectName {
+				t.Fatalf("expected project %q, got %q", projectName, project.Name)
+			}
+			if rev := csclient.ResponseRevision(resp); rev != 0 {
+				t.Fatalf("unexpected revision header %d in the read response", rev)
+			}
+		}
+	})
+
+	t.Run("wrong min revision", func(t *testing.T) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/api/v1alpha/users/%s?minRevision=wrong", cs.c.Web.ListenAddress, user.ID))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
+
+func TestDeleteByID(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user01, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	user02, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	project01, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user01.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	project02, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user01.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	t.Run("delete renamed project by id", func(t *testing.T) {
+		name := "newproject01"
+		if _, err := cs.ah.PatchProject(ctx, &action.PatchProjectRequest{ProjectRef: project01.ID, Name: &name}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		if _, err := csc.DeleteProjectByID(ctx, project01.ID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if _, resp, err := csc.GetProject(ctx, project01.ID); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected project %q to be deleted", project01.ID)
+		}
+	})
+
+	t.Run("delete project by id with a project path", func(t *testing.T) {
+		resp, err := csc.DeleteProjectByID(ctx, path.Join("user", user01.Name, project02.Name))
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("delete project by path", func(t *testing.T) {
+		if _, err := csc.DeleteProject(ctx, path.Join("user", user01.Name, project02.Name)); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	t.Run("delete renamed user by id", func(t *testing.T) {
+		if _, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: user02.ID, UserName: "newuser02"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		if _, err := csc.DeleteUserByID(ctx, user02.ID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if _, resp, err := csc.GetUser(ctx, user02.ID); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected user %q to be deleted", user02.ID)
+		}
+	})
+
+	t.Run("delete user by id with an user name", func(t *testing.T) {
+		resp, err := csc.DeleteUserByID(ctx, user01.Name)
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("delete user by name", func(t *testing.T) {
+		if _, err := csc.DeleteUser(ctx, user01.Name); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
+
+func TestDeleteProjectIgnoreMissing(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user01, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	project01, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user01.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	project02, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user01.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	baseURL := fmt.Sprintf("http://%s/api/v1alpha", cs.c.Web.ListenAddress)
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	t.Run("double delete project", func(t *testing.T) {
+		if _, err := csc.DeleteProjectWithOptions(ctx, project01.ID, &csclient.DeleteProjectOptions{IgnoreMissing: true}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		resp, err := csc.DeleteProjectWithOptions(ctx, project01.ID, &csclient.DeleteProjectOptions{IgnoreMissing: true})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected status code %d, got %d", http.StatusNoContent, resp.StatusCode)
+		}
+		resp, err = csc.DeleteProjectByIDWithOptions(ctx, project01.ID, &csclient.DeleteProjectOptions{IgnoreMissing: true})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected status code %d, got %d", http.StatusNoContent, resp.StatusCode)
+		}
+	})
+
+	t.Run("double delete project without ignoreMissing", func(t *testing.T) {
+		resp, err := csc.DeleteProject(ctx, project01.ID)
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("ignoreMissing doesn't mask other errors", func(t *testing.T) {
+		hreq, err := http.NewRequest("DELETE", fmt.Sprintf("%s/projects/%s?ignoreMissing=true", baseURL, project02.ID), nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		hreq.Header.Set("If-Match", `"wrongrevision"`)
+		resp, err := http.DefaultClient.Do(hreq)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPreconditionFailed {
+			t.Fatalf("expected status code %d, got %d", http.StatusPreconditionFailed, resp.StatusCode)
+		}
+
+		hreq, err = http.NewRequest("DELETE", fmt.Sprintf("%s/projects/%s?ignoreMissing=wrong", baseURL, project02.ID), nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp, err = http.DefaultClient.Do(hreq)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if _, _, err := csc.GetProject(ctx, project02.ID); err != nil {
+			t.Fatalf("expected project %q to not be deleted: %v", project02.ID, err)
+		}
+	})
+
+}
+
+func TestGetProjectByPath(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	parentPath := path.Join("org", org.Name)
+	groups := []*types.ProjectGroup{}
+	for _, name := range []string{"projectgroup01", "projectgroup02", "projectgroup03"} {
+		pg, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: name, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: parentPath}, Visibility: types.VisibilityPublic})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		groups = append(groups, pg)
+		parentPath = path.Join(parentPath, name)
+		waitReadDB(ctx, t, cs)
+	}
+	project, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: parentPath}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	var rootGroupID string
+	err = cs.readDB.Do(ctx, func(tx *db.Tx) error {
+		rootGroup, err := cs.readDB.GetProjectGroupByName(tx, org.ID, "")
+		if err != nil {
+			return err
+		}
+		rootGroupID = rootGroup.ID
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	csc := csclient.NewClient("http://" + cs.c.Web.ListenAddress)
+
+	t.Run("get project by deep path", func(t *testing.T) {
+		res, _, err := csc.GetProjectByPath(ctx, "org", "org01", "projectgroup01", "projectgroup02", "projectgroup03", "project01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if res.ID != project.ID {
+			t.Fatalf("expected project id %q, got %q", project.ID, res.ID)
+		}
+		if res.Path != "org/org01/projectgroup01/projectgroup02/projectgroup03/project01" {
+			t.Fatalf("unexpected project path %q", res.Path)
+		}
+		expectedAncestry := []*csapitypes.ProjectAncestor{
+			{Type: types.ConfigTypeOrg, ID: org.ID, Name: "org01", Path: "org/org01"},
+			{Type: types.ConfigTypeProjectGroup, ID: rootGroupID, Name: "", Path: "org/org01"},
+			{Type: types.ConfigTypeProjectGroup, ID: groups[0].ID, Name: "projectgroup01", Path: "org/org01/projectgroup01"},
+			{Type: types.ConfigTypeProjectGroup, ID: groups[1].ID, Name: "projectgroup02", Path: "org/org01/projectgroup01/projectgroup02"},
+			{Type: types.ConfigTypeProjectGroup, ID: groups[2].ID, Name: "projectgroup03", Path: "org/org01/projectgroup01/projectgroup02/projectgroup03"},
+		}
+		if diff := cmp.Diff(expectedAncestry, res.Ancestry); diff != "" {
+			t.Fatalf("ancestry mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	getProjectByPath := func(t *testing.T, projectPath string) (*http.Response, *util.APIError) {
+		q := url.Values{}
+		q.Set("path", projectPath)
+		resp, err := http.Get(fmt.Sprintf("http://%s/api/v1alpha/projects?%s", cs.c.Web.ListenAddress, q.Encode()))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		var apiErr *util.APIError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return resp, apiErr
+	}
+
+	tests := []struct {
+		name               string
+		path               string
+		expectedStatusCode int
+		expectedDetails    []string
+	}{
+		{
+			name:               "partially resolvable path",
+			path:               "org/org01/projectgroup01/projectgroup04/projectgroup03/project01",
+			expectedStatusCode: http.StatusNotFound,
+			expectedDetails:    []string{`path[3]: project group "projectgroup04" doesn't exist`},
+		},
+		{
+			name:               "not existing project",
+			path:               "org/org01/projectgroup01/project01",
+			expectedStatusCode: http.StatusNotFound,
+			expectedDetails:    []string{`path[3]: project "project01" doesn't exist`},
+		},
+		{
+			name:               "not existing owner",
+			path:               "org/org02/projectgroup01/project01",
+			expectedStatusCode: http.StatusNotFound,
+			expectedDetails:    []string{`path[1]: org "org02" doesn't exist`},
+		},
+		{
+			name:               "escaped segment containing a slash",
+			path:               "org/org01/projectgroup01%2Fprojectgroup02/projectgroup03/project01",
+			expectedStatusCode: http.StatusNotFound,
+			expectedDetails:    []string{`path[2]: project group "projectgroup01/projectgroup02" doesn't exist`},
+		},
+		{
+			name:               "wrong owner type",
+			path:               "team/org01/project01",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "path too short",
+			path:               "org/org01",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, apiErr := getProjectByPath(t, tt.path)
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("expected status code %d, got %d", tt.expectedStatusCode, resp.StatusCode)
+			}
+			if diff := cmp.Diff(tt.expectedDetails, apiErr.Details); diff != "" {
+				t.Fatalf("error details mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDeleteProjects(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user01, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	user02, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	projects := map[string]*types.Project{}
+	for _, p := range []struct {
+		name string
+		user *types.User
+	}{
+		{name: "test-project01", user: user01},
+		{name: "test-project02", user: user01},
+		{name: "test-project03", user: user02},
+		{name: "project04", user: user01},
+	} {
+		project, err := cs.ah.CreateProject(ctx, &types.Project{Name: p.name, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", p.user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		projects[p.name] = project
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	t.Run("test delete without confirm", func(t *testing.T) {
+		for _, u := range []string{"/api/v1alpha/projects", "/api/v1alpha/projects?confirm=false"} {
+			body := strings.NewReader(`{"name_prefix": "test-"}`)
+			req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s%s", cs.c.Web.ListenAddress, u), body)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		for name, project := range projects {
+			if _, _, err := csc.GetProject(ctx, project.ID); err != nil {
+				t.Fatalf("expected project %q to exist, got err: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("test delete without filters", func(t *testing.T) {
+		_, resp, err := csc.DeleteProjects(ctx, &csapitypes.DeleteProjectsRequest{})
+		expectedErr := "invalid request body: name_prefix or owner_id: required"
+		if err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got: %v", expectedErr, err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("test delete by name prefix and owner", func(t *testing.T) {
+		res, _, err := csc.DeleteProjects(ctx, &csapitypes.DeleteProjectsRequest{NamePrefix: "test-", OwnerType: types.ConfigTypeUser, OwnerID: user01.ID})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedIDs := []string{projects["test-project01"].ID, projects["test-project02"].ID}
+		if diff := cmp.Diff(expectedIDs, res.DeletedProjectIDs); diff != "" {
+			t.Fatalf("deleted projects mismatch (-want +got):\n%s", diff)
+		}
+
+		waitReadDB(ctx, t, cs)
+	})
+
+	t.Run("test delete by name prefix", func(t *testing.T) {
+		res, _, err := csc.DeleteProjects(ctx, &csapitypes.DeleteProjectsRequest{NamePrefix: "test-"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedIDs := []string{projects["test-project03"].ID}
+		if diff := cmp.Diff(expectedIDs, res.DeletedProjectIDs); diff != "" {
+			t.Fatalf("deleted projects mismatch (-want +got):\n%s", diff)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		for _, name := range []string{"test-project01", "test-project02", "test-project03"} {
+			if _, resp, err := csc.GetProject(ctx, projects[name].ID); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected project %q to be deleted", name)
+			}
+		}
+		if _, _, err := csc.GetProject(ctx, projects["project04"].ID); err != nil {
+			t.Fatalf("expected project %q to exist, got err: %v", "project04", err)
+		}
+
+		// no more matching projects
+		res, _, err = csc.DeleteProjects(ctx, &csapitypes.DeleteProjectsRequest{NamePrefix: "test-"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(res.DeletedProjectIDs) != 0 {
+			t.Fatalf("expected no deleted projects, got %v", res.DeletedProjectIDs)
+		}
+	})
+}
+
+func TestSoftDelete(t *testing.T) {
+	retention := 8 * time.Second
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.ah.SetSoftDelete(true, retention)
+	})
+	defer teardown()
+
+	user01, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	user02, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	newProject := func(name string) *types.Project {
+		return &types.Project{Name: name, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user01.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
+	}
+	project01, err := cs.ah.CreateProject(ctx, newProject("project01"))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	project02, err := cs.ah.CreateProject(ctx, newProject("project02"))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	token, err := cs.ah.CreateUserToken(ctx, user02.Name, "token01", nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	// list returns the names of the resources returned by the list api and
+	// the names of the soft deleted ones
+	list := func(t *testing.T, resource string, includeDeleted bool) ([]string, []string) {
+		u := fmt.Sprintf("http://%s/api/v1alpha/%s", cs.c.Web.ListenAddress, resource)
+		if includeDeleted {
+			u += "?includeDeleted=true"
+		}
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		var resources []struct {
+			Name         string     `json:"name"`
+			DeletionTime *time.Time `json:"deletion_time"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&resources); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		names, deletedNames := []string{}, []string{}
+		for _, r := range resources {
+			names = append(names, r.Name)
+			if r.DeletionTime != nil {
+				deletedNames = append(deletedNames, r.Name)
+			}
+		}
+		sort.Strings(names)
+		return names, deletedNames
+	}
+
+	t.Run("soft delete and restore project", func(t *testing.T) {
+		if _, err := csc.DeleteProjectByID(ctx, project01.ID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if _, resp, err := csc.GetProject(ctx, project01.ID); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected project %q to be deleted", project01.ID)
+		}
+
+		names, _ := list(t, "projects", false)
+		if diff := cmp.Diff([]string{"project02"}, names); diff != "" {
+			t.Fatalf("projects mismatch (-want +got):\n%s", diff)
+		}
+		names, deletedNames := list(t, "projects", true)
+		if diff := cmp.Diff([]string{"project01", "project02"}, names); diff != "" {
+			t.Fatalf("projects mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"project01"}, deletedNames); diff != "" {
+			t.Fatalf("deleted projects mismatch (-want +got):\n%s", diff)
+		}
+
+		project, _, err := csc.RestoreProject(ctx, project01.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if project.DeletionTime != nil {
+			t.Fatalf("expected restored project deletion time to be empty")
+		}
+		if project.Path != path.Join("user", user01.Name, project01.Name) {
+			t.Fatalf("expected project path %q, got %q", path.Join("user", user01.Name, project01.Name), project.Path)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		project, _, err = csc.GetProject(ctx, project01.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if project.Name != project01.Name || project.Secret != project01.Secret {
+			t.Fatalf("restored project doesn't match the deleted project")
+		}
+		names, deletedNames = list(t, "projects", true)
+		if diff := cmp.Diff([]string{"project01", "project02"}, names); diff != "" {
+			t.Fatalf("projects mismatch (-want +got):\n%s", diff)
+		}
+		if len(deletedNames) != 0 {
+			t.Fatalf("expected no deleted projects, got %v", deletedNames)
+		}
+
+		// a restored project cannot be restored again
+		_, resp, err := csc.RestoreProject(ctx, project01.ID)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected not found error restoring project %q", project01.ID)
+		}
+	})
+
+	t.Run("restore project with name already in use", func(t *testing.T) {
+		if _, err := csc.DeleteProjectByID(ctx, project02.ID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if _, err := cs.ah.CreateProject(ctx, newProject("project02")); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		_, err := cs.ah.RestoreProject(ctx, project02.ID)
+		if !util.IsConflict(err) {
+			t.Fatalf("expected conflict error, got: %v", err)
+		}
+	})
+
+	t.Run("soft delete and restore user", func(t *testing.T) {
+		if _, err := csc.DeleteUserByID(ctx, user02.ID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if _, resp, err := csc.GetUser(ctx, user02.ID); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected user %q to be deleted", user02.ID)
+		}
+
+		names, _ := list(t, "users", false)
+		if diff := cmp.Diff([]string{"user01"}, names); diff != "" {
+			t.Fatalf("users mismatch (-want +got):\n%s", diff)
+		}
+		names, deletedNames := list(t, "users", true)
+		if diff := cmp.Diff([]string{"user01", "user02"}, names); diff != "" {
+			t.Fatalf("users mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"user02"}, deletedNames); diff != "" {
+			t.Fatalf("deleted users mismatch (-want +got):\n%s", diff)
+		}
+
+		if _, _, err := csc.RestoreUser(ctx, user02.ID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		// the user tokens are restored
+		var user *types.User
+		err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
+			var err error
+			user, err = cs.readDB.GetUserByTokenValue(tx, token)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if user == nil || user.ID != user02.ID {
+			t.Fatalf("expected user %q for token", user02.ID)
+		}
+		if user.DeletionTime != nil {
+			t.Fatalf("expected restored user deletion time to be empty")
+		}
+	})
+
+	t.Run("restore user with name already in use", func(t *testing.T) {
+		if _, err := csc.DeleteUserByID(ctx, user02.ID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		_, resp, err := csc.RestoreUser(ctx, user02.ID)
+		if err == nil || resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected conflict error restoring user %q", user02.ID)
+		}
+		_, err = cs.ah.RestoreUser(ctx, user02.ID)
+		if apiErr := util.APIErrorFromError(err); apiErr.Code != action.ErrorCodeUserAlreadyExists {
+			t.Fatalf("expected error code %q, got: %v", action.ErrorCodeUserAlreadyExists, err)
+		}
+	})
+
+	t.Run("restore user with remote user linked to another user", func(t *testing.T) {
+		if _, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+			Name:               "rs01",
+			APIURL:             "https://api.example.com",
+			Type:               types.RemoteSourceTypeGitea,
+			AuthType:           types.RemoteSourceAuthTypeOauth2,
+			Oauth2ClientID:     "clientid",
+			Oauth2ClientSecret: "clientsecret",
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		newUserWithLA := func(name string) *action.CreateUserRequest {
+			return &action.CreateUserRequest{
+				UserName: name,
+				CreateUserLARequest: &action.CreateUserLARequest{
+					RemoteSourceName: "rs01",
+					RemoteUserID:     "remoteuser01",
+					RemoteUserName:   "remoteuser01",
+				},
+			}
+		}
+		user03, err := cs.ah.CreateUser(ctx, newUserWithLA("user03"))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if _, err := csc.DeleteUserByID(ctx, user03.ID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if _, err := cs.ah.CreateUser(ctx, newUserWithLA("user04")); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		_, resp, err := csc.RestoreUser(ctx, user03.ID)
+		if err == nil || resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected conflict error restoring user %q", user03.ID)
+		}
+		_, err = cs.ah.RestoreUser(ctx, user03.ID)
+		if apiErr := util.APIErrorFromError(err); apiErr.Code != action.ErrorCodeLinkedAccountAlreadyExists {
+			t.Fatalf("expected error code %q, got: %v", action.ErrorCodeLinkedAccountAlreadyExists, err)
+		}
+	})
+
+	t.Run("restore and purge expired resources", func(t *testing.T) {
+		project03, err := cs.ah.CreateProject(ctx, newProject("project03"))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if err := cs.ah.DeleteProject(ctx, project03.ID, ""); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		time.Sleep(retention + 1*time.Second)
+
+		if _, err := cs.ah.RestoreProject(ctx, project03.ID); !util.IsNotExist(err) {
+			t.Fatalf("expected not exist error, got: %v", err)
+		}
+
+		if err := cs.ah.PurgeExpiredDeletedResources(ctx); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		for _, id := range []string{project02.ID, project03.ID, user02.ID} {
+			var dr *types.DeletedResource
+			err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
+				var err error
+				dr, err = cs.readDB.GetDeletedResource(tx, id)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if dr != nil {
+				t.Fatalf("expected deleted resource %q to be purged", id)
+			}
+		}
+
+		names, _ := list(t, "projects", true)
+		if diff := cmp.Diff([]string{"project01", "project02"}, names); diff != "" {
+			t.Fatalf("projects mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestProjectPatch(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	p01, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	t.Run("rename project keeping its id and other fields", func(t *testing.T) {
+		name := "newproject01"
+		p, err := cs.ah.PatchProject(ctx, &action.PatchProjectRequest{ProjectRef: path.Join("user", user.Name, "project01"), Name: &name})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if p.ID != p01.ID {
+			t.Fatalf("expected project id %q, got %q", p01.ID, p.ID)
+		}
+		if p.Name != name {
+			t.Fatalf("expected project name %q, got %q", name, p.Name)
+		}
+		if p.Visibility != types.VisibilityPublic {
+			t.Fatalf("expected project visibility %q, got %q", types.VisibilityPublic, p.Visibility)
+		}
+	})
+
+	waitReadDB(ctx, t, cs)
+
+	t.Run("change project visibility", func(t *testing.T) {
+		visibility := types.VisibilityPrivate
+		p, err := cs.ah.PatchProject(ctx, &action.PatchProjectRequest{ProjectRef: p01.ID, Visibility: &visibility})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if p.Name != "newproject01" {
+			t.Fatalf("expected project name %q, got %q", "newproject01", p.Name)
+		}
+		if p.Visibility != visibility {
+			t.Fatalf("expected project visibility %q, got %q", visibility, p.Visibility)
+		}
+	})
+
+	t.Run("rename project to an already existing name", func(t *testing.T) {
+		name := "project02"
+		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", name, path.Join("user", user.Name, name))
+		_, err := cs.ah.PatchProject(ctx, &action.PatchProjectRequest{ProjectRef: p01.ID, Name: &name})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.IsConflict(err) {
+			t.Fatalf("expected conflict error, got err: %v", err)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("patch unexistent project", func(t *testing.T) {
+		name := "project03"
+		_, err := cs.ah.PatchProject(ctx, &action.PatchProjectRequest{ProjectRef: path.Join("user", user.Name, "unexistent"), Name: &name})
+		if !util.IsNotExist(err) {
+			t.Fatalf("expected not exist error, got err: %v", err)
+		}
+	})
+}
+
+func TestProjectConfigOverrides(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	newProject := func(name, configPath, defaultBranch string) *types.Project {
+		return &types.Project{Name: name, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "user/user01"}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual, ConfigPath: configPath, DefaultBranch: defaultBranch}
+	}
+
+	p01, _, err := csc.CreateProject(ctx, newProject("project01", "ci/agola.jsonnet", "develop"))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	checkProject := func(t *testing.T, configPath, defaultBranch string) {
+		p, _, err := csc.GetProject(ctx, p01.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if p.ConfigPath != configPath {
+			t.Fatalf("expected project config path %q, got %q", configPath, p.ConfigPath)
+		}
+		if p.DefaultBranch != defaultBranch {
+			t.Fatalf("expected project default branch %q, got %q", defaultBranch, p.DefaultBranch)
+		}
+	}
+
+	t.Run("create project with config overrides", func(t *testing.T) {
+		checkProject(t, "ci/agola.jsonnet", "develop")
+	})
+
+	t.Run("update project config overrides", func(t *testing.T) {
+		p, _, err := csc.GetProject(ctx, p01.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		p.ConfigPath = ".agola/custom.yml"
+		p.DefaultBranch = "main"
+		if _, _, err := csc.UpdateProject(ctx, p.ID, p.Project); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		checkProject(t, ".agola/custom.yml", "main")
+	})
+
+	t.Run("patch project config overrides", func(t *testing.T) {
+		configPath := ""
+		defaultBranch := "release/1.0"
+		if _, _, err := csc.PatchProject(ctx, p01.ID, &csapitypes.PatchProjectRequest{ConfigPath: &configPath, DefaultBranch: &defaultBranch}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		checkProject(t, "", "release/1.0")
+	})
+
+	t.Run("invalid config overrides are rejected", func(t *testing.T) {
+		tests := []struct {
+			configPath    string
+			defaultBranch string
+		}{
+			{configPath: "../config.yml"},
+			{configPath: "ci/../../config.yml"},
+			{configPath: "/etc/config.yml"},
+			{defaultBranch: "bad branch"},
+			{defaultBranch: "foo..bar"},
+		}
+		for _, tt := range tests {
+			_, resp, err := csc.CreateProject(ctx, newProject("project02", tt.configPath, tt.defaultBranch))
+			if err == nil {
+				t.Fatalf("expected error creating a project with config path %q and default branch %q, got nil error", tt.configPath, tt.defaultBranch)
+			}
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+
+			_, resp, err = csc.PatchProject(ctx, p01.ID, &csapitypes.PatchProjectRequest{ConfigPath: &tt.configPath, DefaultBranch: &tt.defaultBranch})
+			if err == nil {
+				t.Fatalf("expected error patching a project with config path %q and default branch %q, got nil error", tt.configPath, tt.defaultBranch)
+			}
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+		}
+		checkProject(t, "", "release/1.0")
+	})
+}
+
+func TestProjectMove(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	if _, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	p01, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	t.Run("move project to a group with a project with the same name", func(t *testing.T) {
+		_, resp, err := csc.MoveProject(ctx, p01.ID, path.Join("org", org.Name))
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+		if resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected status code %d, got %d", http.StatusConflict, resp.StatusCode)
+		}
+	})
+
+	t.Run("move project to a not existing group", func(t *testing.T) {
+		_, resp, err := csc.MoveProject(ctx, p01.ID, path.Join("org", org.Name, "unexistent"))
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("move not existing project", func(t *testing.T) {
+		_, resp, err := csc.MoveProject(ctx, "e5a6a3e4-0000-4000-8000-000000000001", path.Join("org", org.Name, "projectgroup01"))
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("move project to another owner group", func(t *testing.T) {
+		newPath := path.Join("org", org.Name, "projectgroup01", "project01")
+		p, resp, err := csc.MoveProject(ctx, p01.ID, path.Join("org", org.Name, "projectgroup01"))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if p.ID != p01.ID {
+			t.Fatalf("expected project id %q, got %q", p01.ID, p.ID)
+		}
+		if p.Path != newPath {
+			t.Fatalf("expected project path %q, got %q", newPath, p.Path)
+		}
+		if p.OwnerType != types.ConfigTypeOrg || p.OwnerID != org.ID {
+			t.Fatalf("expected project owned by org %q, got %s %q", org.ID, p.OwnerType, p.OwnerID)
+		}
+
+		// the readdb paths are updated
+		rctx := csclient.WithMinRevision(ctx, csclient.ResponseRevision(resp))
+		if _, resp, err := csc.GetProject(rctx, path.Join("user", user.Name, "project01")); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected project not existing at the old path, got err: %v", err)
+		}
+		mp, _, err := csc.GetProject(rctx, newPath)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if mp.ID != p01.ID {
+			t.Fatalf("expected project id %q, got %q", p01.ID, mp.ID)
+		}
+	})
+}
+
+func TestReadReplica(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
+	defer shutdownEtcd(tetcd)
+
+	// setupReplica creates a read replica sharing the etcd and object storage
+	// of cs
+	setupReplica := func(name, writerURL string) *Configstore {
+		replicaDir, err := ioutil.TempDir(dir, name)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		listenAddress, port, err := testutil.GetFreePort(true, false)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		replicaConfig := *cs.c
+		replicaConfig.DataDir = replicaDir
+		replicaConfig.Web.ListenAddress = net.JoinHostPort(listenAddress, port)
+		replicaConfig.ReadReplica = config.ReadReplica{Enabled: true, WriterURL: writerURL}
+
+		replica, err := NewConfigstore(ctx, logger.With(zap.String("name", name)), &replicaConfig)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return replica
+	}
+
+	writerURL := "http://" + cs.c.Web.ListenAddress
+	replica := setupReplica("replica", writerURL)
+	replicaNoWriter := setupReplica("replicanowriter", "")
+
+	startConfigstore(ctx, t, cs)
+	startConfigstore(ctx, t, replica)
+	startConfigstore(ctx, t, replicaNoWriter)
+
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	for _, c := range []*Configstore{cs, replica, replicaNoWriter} {
+		waitReadDB(ctx, t, c)
+	}
+
+	replicaURL := "http://" + replica.c.Web.ListenAddress
+	replicaNoWriterURL := "http://" + replicaNoWriter.c.Web.ListenAddress
+
+	t.Run("test read replica serves the reads", func(t *testing.T) {
+		for _, u := range []string{replicaURL, replicaNoWriterURL} {
+			user, _, err := csclient.NewClient(u).GetUser(ctx, "user01")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if user.Name != "user01" {
+				t.Fatalf("expected user name %q, got %q", "user01", user.Name)
+			}
+		}
+	})
+
+	t.Run("test read replica redirects the writes to the writer", func(t *testing.T) {
+		client := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Post(replicaURL+"/api/v1alpha/users", "application/json", strings.NewReader(`{"user_name": "user02"}`))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTemporaryRedirect {
+			t.Fatalf("expected status code %d, got %d", http.StatusTemporaryRedirect, resp.StatusCode)
+		}
+		expectedLocation := writerURL + "/api/v1alpha/users"
+		if location := resp.Header.Get("Location"); location != expectedLocation {
+			t.Fatalf("expected location %q, got %q", expectedLocation, location)
+		}
+
+		// the client follows the redirect and the user is created by the writer
+		if _, _, err := csclient.NewClient(replicaURL).CreateUser(ctx, &csapitypes.CreateUserRequest{UserName: "user02"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, _, err := csclient.NewClient(writerURL).GetUser(ctx, "user02"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	t.Run("test read replica without writer rejects the writes", func(t *testing.T) {
+		resp, err := http.Post(replicaNoWriterURL+"/api/v1alpha/users", "application/json", strings.NewReader(`{"user_name": "user03"}`))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusMisdirectedRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusMisdirectedRequest, resp.StatusCode)
+		}
+		var apiErr util.APIError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if apiErr.Code != util.ErrorCodeMisdirectedRequest {
+			t.Fatalf("expected error code %q, got %q", util.ErrorCodeMisdirectedRequest, apiErr.Code)
+		}
+		if _, _, err := csclient.NewClient(writerURL).GetUser(ctx, "user03"); err == nil {
+			t.Fatalf("expected user03 not created")
+		}
+	})
+
+	t.Run("test read replica serves the local writes", func(t *testing.T) {
+		if _, _, err := csclient.NewClient(replicaNoWriterURL).SetLogLevel(ctx, "info"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	t.Run("test read replica rejects the direct writes", func(t *testing.T) {
+		_, err := replica.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user04"})
+		if !util.IsUnavailable(err) {
+			t.Fatalf("expected unavailable error, got: %v", err)
+		}
+	})
+}
+
+func TestLastModified(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	project, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	get := func(t *testing.T, u string, ifModifiedSince string) *http.Response {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/api/v1alpha%s", cs.c.Web.ListenAddress, u), nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if ifModifiedSince != "" {
+			req.Header.Set("If-Modified-Since", ifModifiedSince)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return resp
+	}
+
+	// waitModified waits for the resource to be reported as modified since
+	// lastModified
+	waitModified := func(t *testing.T, u string, lastModified string) *http.Response {
+		var resp *http.Response
+		for i := 0; i < 50; i++ {
+			resp = get(t, u, lastModified)
+			if resp.StatusCode != http.StatusNotModified {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		return resp
+	}
+
+	checkLastModified := func(t *testing.T, resp *http.Response) time.Time {
+		lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+		if err != nil {
+			t.Fatalf("wrong Last-Modified header %q: %v", resp.Header.Get("Last-Modified"), err)
+		}
+		return lastModified
+	}
+
+	userURL := fmt.Sprintf("/users/%s", user.ID)
+	projectURL := fmt.Sprintf("/projects/%s", project.ID)
+
+	for _, u := range []string{userURL, projectURL} {
+		u := u
+		t.Run(fmt.Sprintf("not modified %s", u), func(t *testing.T) {
+			resp := get(t, u, "")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+			lastModified := resp.Header.Get("Last-Modified")
+			checkLastModified(t, resp)
+
+			resp = get(t, u, lastModified)
+			if resp.StatusCode != http.StatusNotModified {
+				t.Fatalf("expected status %d, got %d", http.StatusNotModified, resp.StatusCode)
+			}
+			if resp.Header.Get("Last-Modified") != lastModified {
+				t.Fatalf("expected Last-Modified %q, got %q", lastModified, resp.Header.Get("Last-Modified"))
+			}
+			if resp.Header.Get("ETag") == "" {
+				t.Fatalf("expected ETag header")
+			}
+
+			// a wrong If-Modified-Since is ignored
+			resp = get(t, u, "wrong date")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+		})
+	}
+
+	t.Run("modified project", func(t *testing.T) {
+		resp := get(t, projectURL, "")
+		lastModified := resp.Header.Get("Last-Modified")
+		prevModTime := checkLastModified(t, resp)
+
+		visibility := types.VisibilityPrivate
+		if _, err := cs.ah.PatchProject(ctx, &action.PatchProjectRequest{ProjectRef: project.ID, Visibility: &visibility}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		resp = waitModified(t, projectURL, lastModified)
+		if modTime := checkLastModified(t, resp); !modTime.After(prevModTime) {
+			t.Fatalf("expected Last-Modified after %s, got %s", prevModTime, modTime)
+		}
+	})
+
+	t.Run("modified project owner", func(t *testing.T) {
+		userResp := get(t, userURL, "")
+		userLastModified := userResp.Header.Get("Last-Modified")
+		resp := get(t, projectURL, "")
+		lastModified := resp.Header.Get("Last-Modified")
+		prevModTime := checkLastModified(t, resp)
+
+		// the project path depends on its owner name
+		if _, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: user.ID, UserName: "user02"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitModified(t, userURL, userLastModified)
+		resp = waitModified(t, projectURL, lastModified)
+		if modTime := checkLastModified(t, resp); !modTime.After(prevModTime) {
+			t.Fatalf("expected Last-Modified after %s, got %s", prevModTime, modTime)
+		}
+	})
+}
+
+func TestProjectsPagination(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	user01, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	user02, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	// create projects with the same name in different parents to check that
+	// pagination doesn't skip or duplicate them
+	expectedNames := []string{}
+	for _, user := range []*types.User{user01, user02} {
+		for i := 1; i <= 3; i++ {
+			name := fmt.Sprintf("project%02d", i)
+			if _, err := cs.ah.CreateProject(ctx, &types.Project{Name: name, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			expectedNames = append(expectedNames, name)
+		}
+	}
+	sort.Strings(expectedNames)
+
+	waitReadDB(ctx, t, cs)
+
+	h := api.NewProjectsHandler(logger, cs.readDB, 0)
+
+	linkRegexp := regexp.MustCompile(`^<(.*)>; rel="next"$`)
+
+	names := []string{}
+	ids := map[string]struct{}{}
+	u := "/projects?limit=4&asc"
+	pages := 0
+	for u != "" {
+		pages++
+		if pages > 10 {
+			t.Fatalf("too many pages")
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", w.Code, w.Body.String())
+		}
+		var projects []*csapitypes.Project
+		if err := json.Unmarshal(w.Body.Bytes(), &projects); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		for _, p := range projects {
+			if _, ok := ids[p.ID]; ok {
+				t.Fatalf("duplicate project %q", p.ID)
+			}
+			ids[p.ID] = struct{}{}
+			names = append(names, p.Name)
+		}
+
+		u = ""
+		if link := w.Header().Get("Link"); link != "" {
+			m := linkRegexp.FindStringSubmatch(link)
+			if m == nil {
+				t.Fatalf("wrong link header %q", link)
+			}
+			u = m[1]
+		}
+	}
+
+	if pages != 2 {
+		t.Fatalf("expected 2 pages, got %d", pages)
+	}
+	if diff := cmp.Diff(expectedNames, names); diff != "" {
+		t.Fatalf("projects mismatch (-expected +got):\n%s", diff)
+	}
+
+	t.Run("wrong start", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/projects?start=project01", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+}
+
+func TestProjectLabels(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.ah.SetSoftDelete(true, time.Hour)
+	})
+	defer teardown()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	csc := csclient.NewClient("http://" + cs.c.Web.ListenAddress)
+
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	newProject := func(name string, labels map[string]string) *types.Project {
+		return &types.Project{Name: name, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "user/user01"}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual, Labels: labels}
+	}
+
+	project01, _, err := csc.CreateProject(ctx, newProject("project01", map[string]string{"team": "backend", "app.example.com/tier": "api"}))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, _, err := csc.CreateProject(ctx, newProject("project02", map[string]string{"team": "frontend"})); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, _, err := csc.CreateProject(ctx, newProject("project03", map[string]string{"team": "backend", "archived": ""})); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, _, err := csc.CreateProject(ctx, newProject("project04", nil)); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	projectNames := func(t *testing.T, labelSelectors ...string) []string {
+		projects, _, err := csc.GetProjectsWithLabels(ctx, labelSelectors, "", 0, true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		names := []string{}
+		for _, p := range projects {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+
+	t.Run("get project labels", func(t *testing.T) {
+		project, _, err := csc.GetProject(ctx, project01.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedLabels := map[string]string{"team": "backend", "app.example.com/tier": "api"}
+		if diff := cmp.Diff(expectedLabels, project.Labels); diff != "" {
+			t.Fatalf("labels mismatch (-expected +got):\n%s", diff)
+		}
+	})
+
+	t.Run("filter by labels", func(t *testing.T) {
+		tests := []struct {
+			labelSelectors []string
+			expectedNames  []string
+		}{
+			{labelSelectors: []string{}, expectedNames: []string{"project01", "project02", "project03", "project04"}},
+			{labelSelectors: []string{"team=backend"}, expectedNames: []string{"project01", "project03"}},
+			{labelSelectors: []string{"team"}, expectedNames: []string{"project01", "project02", "project03"}},
+			{labelSelectors: []string{"team=backend", "app.example.com/tier=api"}, expectedNames: []string{"project01"}},
+			{labelSelectors: []string{"archived="}, expectedNames: []string{"project03"}},
+			{labelSelectors: []string{"team=backend", "team=frontend"}, expectedNames: []string{}},
+			{labelSelectors: []string{"notexisting"}, expectedNames: []string{}},
+		}
+		for _, tt := range tests {
+			if diff := cmp.Diff(tt.expectedNames, projectNames(t, tt.labelSelectors...)); diff != "" {
+				t.Fatalf("projects with labels %v mismatch (-expected +got):\n%s", tt.labelSelectors, diff)
+			}
+		}
+	})
+
+	t.Run("paginate filtered projects", func(t *testing.T) {
+		h := api.NewProjectsHandler(logger, cs.readDB, 0)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/projects?label=team%3Dbackend&limit=1&asc", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", w.Code, w.Body.String())
+		}
+		link := w.Header().Get("Link")
+		m := regexp.MustCompile(`^<(.*)>; rel="next"$`).FindStringSubmatch(link)
+		if m == nil {
+			t.Fatalf("wrong link header %q", link)
+		}
+		next, err := url.Parse(m[1])
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff([]string{"team=backend"}, next.Query()["label"]); diff != "" {
+			t.Fatalf("next link label selectors mismatch (-expected +got):\n%s", diff)
+		}
+	})
+
+	t.Run("update project labels", func(t *testing.T) {
+		project, _, err := csc.GetProject(ctx, project01.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		project.Labels = map[string]string{"team": "frontend"}
+		if _, _, err := csc.UpdateProject(ctx, project.ID, project.Project); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if diff := cmp.Diff([]string{"project01", "project02"}, projectNames(t, "team=frontend")); diff != "" {
+			t.Fatalf("projects mismatch (-expected +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{}, projectNames(t, "app.example.com/tier")); diff != "" {
+			t.Fatalf("projects mismatch (-expected +got):\n%s", diff)
+		}
+	})
+
+	t.Run("filter soft deleted projects by labels", func(t *testing.T) {
+		if _, err := csc.DeleteProject(ctx, "user/user01/project03"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if diff := cmp.Diff([]string{}, projectNames(t, "team=backend")); diff != "" {
+			t.Fatalf("projects mismatch (-expected +got):\n%s", diff)
+		}
+
+		h := api.NewProjectsHandler(logger, cs.readDB, 0)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/projects?label=team%3Dbackend&includeDeleted=true", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", w.Code, w.Body.String())
+		}
+		var projects []*csapitypes.Project
+		if err := json.Unmarshal(w.Body.Bytes(), &projects); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(projects) != 1 || projects[0].Name != "project03" || projects[0].DeletionTime == nil {
+			t.Fatalf("expected the soft deleted project03, got: %s", w.Body.String())
+		}
+	})
+
+	t.Run("invalid labels", func(t *testing.T) {
+		for _, labels := range []map[string]string{
+			{"-team": "backend"},
+			{"team": "back end"},
+			{strings.Repeat("a", util.MaxLabelKeyLength+1): "backend"},
+			{"team": strings.Repeat("a", util.MaxLabelValueLength+1)},
+		} {
+			_, resp, err := csc.CreateProject(ctx, newProject("project05", labels))
+			if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status code %d for labels %v, got resp: %v, err: %v", http.StatusBadRequest, labels, resp, err)
+			}
+		}
+
+		// the action validates the labels too
+		if _, err := cs.ah.CreateProject(ctx, newProject("project05", map[string]string{"team/": "backend"})); !util.IsBadRequest(err) {
+			t.Fatalf("expected bad request error, got: %v", err)
+		}
+	})
+
+	t.Run("invalid label selectors", func(t *testing.T) {
+		for _, labelSelector := range []string{"", "=backend", "team=back end", "-team"} {
+			_, resp, err := csc.GetProjectsWithLabels(ctx, []string{labelSelector}, "", 0, true)
+			if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status code %d for label selector %q, got resp: %v, err: %v", http.StatusBadRequest, labelSelector, resp, err)
+			}
+		}
+	})
+}
+
+func TestOwnerProjects(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.ah.SetSoftDelete(true, time.Hour)
+	})
+	defer teardown()
+
+	csc := csclient.NewClient("http://" + cs.c.Web.ListenAddress)
+
+	for _, userName := range []string{"user01", "user02", "user03"} {
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	if _, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org02", Visibility: types.VisibilityPublic}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	// the projects are created in the owner root project group and in nested
+	// project groups
+	for _, ownerPath := range []string{"user/user01", "user/user02", "org/org01"} {
+		pgPath := ownerPath
+		for _, pgName := range []string{"projectgroup01", "projectgroup02"} {
+			if _, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: pgName, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: pgPath}, Visibility: types.VisibilityPublic}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			pgPath = path.Join(pgPath, pgName)
+		}
+	}
+	for _, parentPath := range []string{
+		"user/user01", "user/user01/projectgroup01", "user/user01/projectgroup01/projectgroup02",
+		"user/user02",
+		"org/org01", "org/org01/projectgroup01/projectgroup02",
+	} {
+		if _, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: parentPath}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	if _, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "user/user01/projectgroup01"}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// a soft deleted project must not be listed
+	if _, err := cs.ah.CreateProject(ctx, &types.Project{Name: "deletedproject", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "user/user01"}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := cs.ah.DeleteProject(ctx, "user/user01/deletedproject", ""); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	projectPaths := func(projects []*csapitypes.Project) []string {
+		paths := []string{}
+		for _, p := range projects {
+			paths = append(paths, p.Path)
+		}
+		return paths
+	}
+
+	tests := []struct {
+		name          string
+		get           func(ctx context.Context, start string, limit int, asc bool) ([]*csapitypes.Project, *http.Response, error)
+		expectedPaths []string
+	}{
+		{
+			name: "user projects in all the project groups",
+			get: func(ctx context.Context, start string, limit int, asc bool) ([]*csapitypes.Project, *http.Response, error) {
+				return csc.GetUserProjects(ctx, "user01", start, limit, asc)
+			},
+			expectedPaths: []string{
+				"user/user01/project01",
+				"user/user01/projectgroup01/project01",
+				"user/user01/projectgroup01/projectgroup02/project01",
+				"user/user01/projectgroup01/project02",
+			},
+		},
+		{
+			name: "user projects",
+			get: func(ctx context.Context, start string, limit int, asc bool) ([]*csapitypes.Project, *http.Response, error) {
+				return csc.GetUserProjects(ctx, "user02", start, limit, asc)
+			},
+			expectedPaths: []string{"user/user02/project01"},
+		},
+		{
+			name: "org projects",
+			get: func(ctx context.Context, start string, limit int, asc bool) ([]*csapitypes.Project, *http.Response, error) {
+				return csc.GetOrgProjects(ctx, "org01", start, limit, asc)
+			},
+			expectedPaths: []string{"org/org01/project01", "org/org01/projectgroup01/projectgroup02/project01"},
+		},
+		{
+			name: "user without projects",
+			get: func(ctx context.Context, start string, limit int, asc bool) ([]*csapitypes.Project, *http.Response, error) {
+				return csc.GetUserProjects(ctx, "user03", start, limit, asc)
+			},
+			expectedPaths: []string{},
+		},
+		{
+			name: "org without projects",
+			get: func(ctx context.Context, start string, limit int, asc bool) ([]*csapitypes.Project, *http.Response, error) {
+				return csc.GetOrgProjects(ctx, "org02", start, limit, asc)
+			},
+			expectedPaths: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			projects, _, err := tt.get(ctx, "", 0, true)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			// projects with the same name are ordered by id so compare them
+			// sorted
+			paths := projectPaths(projects)
+			sort.Strings(paths)
+			expectedPaths := append([]string{}, tt.expectedPaths...)
+			sort.Strings(expectedPaths)
+			if diff := cmp.Diff(expectedPaths, paths); diff != "" {
+				t.Fatalf("projects mismatch (-expected +got):\n%s", diff)
+			}
+
+			// the pages must contain all the projects in the same order
+			pagedProjects := []*csapitypes.Project{}
+			start := ""
+			for i := 0; ; i++ {
+				if i > len(projects) {
+					t.Fatalf("too many pages")
+				}
+				page, resp, err := tt.get(ctx, start, 1, true)
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				pagedProjects = append(pagedProjects, page...)
+				if resp.Header.Get("Link") == "" {
+					break
+				}
+				last := page[len(page)-1]
+				start = last.Name + "/" + last.ID
+			}
+			if diff := cmp.Diff(projectPaths(projects), projectPaths(pagedProjects)); diff != "" {
+				t.Fatalf("paged projects mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("not existing owner", func(t *testing.T) {
+		if _, resp, err := csc.GetUserProjects(ctx, "notexistinguser", "", 0, true); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got resp: %v, err: %v", http.StatusNotFound, resp, err)
+		}
+		if _, resp, err := csc.GetOrgProjects(ctx, "notexistingorg", "", 0, true); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got resp: %v, err: %v", http.StatusNotFound, resp, err)
+		}
+	})
+}
+
+func TestUsersSearch(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	reqs := []*action.CreateUserRequest{}
+	for _, userName := range []string{"user01", "user02", "user03", "User04", "admin01"} {
+		reqs = append(reqs, &action.CreateUserRequest{UserName: userName})
+	}
+	if _, err := cs.ah.ImportUsers(ctx, reqs); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	h := api.NewUsersHandler(logger, cs.readDB)
+
+	linkRegexp := regexp.MustCompile(`^<(.*)>; rel="next"$`)
+
+	// getUsersPages follows the next links and returns the user names of
+	// every page
+	getUsersPages := func(t *testing.T, u string) [][]string {
+		pages := [][]string{}
+		for u != "" {
+			if len(pages) > 10 {
+				t.Fatalf("too many pages")
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected status code: %d, body: %s", w.Code, w.Body.String())
+			}
+			var users []*types.User
+			if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			names := []string{}
+			for _, user := range users {
+				names = append(names, user.Name)
+			}
+			pages = append(pages, names)
+
+			u = ""
+			if link := w.Header().Get("Link"); link != "" {
+				m := linkRegexp.FindStringSubmatch(link)
+				if m == nil {
+					t.Fatalf("wrong link header %q", link)
+				}
+				u = m[1]
+			}
+		}
+		return pages
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		expected [][]string
+	}{
+		{
+			name:     "prefix match",
+			url:      "/users?query=adm&asc",
+			expected: [][]string{{"admin01"}},
+		},
+		{
+			name:     "substring match",
+			url:      "/users?query=min&asc",
+			expected: [][]string{{"admin01"}},
+		},
+		{
+			name:     "case insensitive match",
+			url:      "/users?query=USER0&asc",
+			expected: [][]string{{"User04", "user01", "user02", "user03"}},
+		},
+		{
+			name:     "like special chars aren't wildcards",
+			url:      "/users?query=user_1&asc",
+			expected: [][]string{{}},
+		},
+		{
+			name:     "empty results",
+			url:      "/users?query=notexisting&limit=2&asc",
+			expected: [][]string{{}},
+		},
+		{
+			name:     "page size equal to the results",
+			url:      "/users?query=user&limit=4&asc",
+			expected: [][]string{{"User04", "user01", "user02", "user03"}},
+		},
+		{
+			name:     "pages exactly filled",
+			url:      "/users?query=user&limit=2&asc",
+			expected: [][]string{{"User04", "user01"}, {"user02", "user03"}},
+		},
+		{
+			name:     "last page partially filled",
+			url:      "/users?query=user&limit=3&asc",
+			expected: [][]string{{"User04", "user01", "user02"}, {"user03"}},
+		},
+		{
+			name:     "descending pagination",
+			url:      "/users?query=user&limit=3",
+			expected: [][]string{{"user03", "user02", "user01"}, {"User04"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages := getUsersPages(t, tt.url)
+			if diff := cmp.Diff(tt.expected, pages); diff != "" {
+				t.Fatalf("users mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProjectGroupUpdate(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	pg01 := &types.ProjectGroup{Name: "pg01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}
+	pg01, err = cs.ah.CreateProjectGroup(ctx, pg01)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	pg02 := &types.ProjectGroup{Name: "pg02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}
+	pg02, err = cs.ah.CreateProjectGroup(ctx, pg02)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	pg03 := &types.ProjectGroup{Name: "pg03", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}
+	pg03, err = cs.ah.CreateProjectGroup(ctx, pg03)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	pg04 := &types.ProjectGroup{Name: "pg01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name, "pg01")}, Visibility: types.VisibilityPublic}
+	_, err = cs.ah.CreateProjectGroup(ctx, pg04)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	pg05 := &types.ProjectGroup{Name: "pg01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name, "pg02")}, Visibility: types.VisibilityPublic}
+	pg05, err = cs.ah.CreateProjectGroup(ctx, pg05)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("rename project group keeping same parent", func(t *testing.T) {
+		projectGroupName := "pg03"
+		pg03.Name = "newpg03"
+		_, err := cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name, projectGroupName), ProjectGroup: pg03})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("move project to project group having project with same name", func(t *testing.T) {
+		projectGroupName := "pg01"
+		expectedErr := fmt.Sprintf("project group with name %q, path %q already exists", projectGroupName, path.Join("user", user.Name, projectGroupName))
+		pg05.Parent.ID = path.Join("user", user.Name)
+		_, err := cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name, "pg02", projectGroupName), ProjectGroup: pg05})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("move project group to project group changing name", func(t *testing.T) {
+		projectGroupName := "pg01"
+		pg05.Name = "newpg01"
+		pg05.Parent.ID = path.Join("user", user.Name)
+		_, err := cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name, "pg02", projectGroupName), ProjectGroup: pg05})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("move project group inside itself", func(t *testing.T) {
+		projectGroupName := "pg02"
+		expectedErr := "cannot move project group inside itself or child project group"
+		pg02.Parent.ID = path.Join("user", user.Name, "pg02")
+		_, err := cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name, projectGroupName), ProjectGroup: pg02})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("move project group to child project group", func(t *testing.T) {
+		projectGroupName := "pg01"
+		expectedErr := "cannot move project group inside itself or child project group"
+		pg01.Parent.ID = path.Join("user", user.Name, "pg01", "pg01")
+		_, err := cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name, projectGroupName), ProjectGroup: pg01})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("change root project group parent", func(t *testing.T) {
+
+		var rootPG *types.ProjectGroup
+		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		rootPG.Parent.ID = path.Join("user", user.Name, "pg01")
+
+		expectedErr := "cannot change root project group parent type or id"
+		_, err = cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name), ProjectGroup: rootPG})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("change root project group name", func(t *testing.T) {
+		var rootPG *types.ProjectGroup
+		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		rootPG.Name = "rootpgnewname"
+
+		expectedErr := "project group name for root project group must be empty"
+		_, err = cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name), ProjectGroup: rootPG})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("change root project group visibility", func(t *testing.T) {
+		var rootPG *types.ProjectGroup
+		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		rootPG.Visibility = types.VisibilityPrivate
+
+		_, err = cs.ah.UpdateProjectGroup(ctx, &action.UpdateProjectGroupRequest{ProjectGroupRef: path.Join("user", user.Name), ProjectGroup: rootPG})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		rootPG, err = cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if rootPG.Visibility != types.VisibilityPrivate {
+			t.Fatalf("expected visiblity %q, got visibility: %q", types.VisibilityPublic, rootPG.Visibility)
+		}
+	})
+}
+
+func TestProjectGroupDelete(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	// create a projectgroup in org root project group
+	pg01, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// create a child projectgroup in org root project group
+	spg01, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "subprojectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: pg01.ID}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("delete root project group", func(t *testing.T) {
+		expectedErr := "cannot delete root project group"
+		err := cs.ah.DeleteProjectGroup(ctx, path.Join("org", org.Name), false)
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("delete not empty project group without cascade", func(t *testing.T) {
+		expectedErr := fmt.Sprintf("project group %q isn't empty", pg01.ID)
+		err := cs.ah.DeleteProjectGroup(ctx, pg01.ID, false)
+		if err == nil {
+			t.Fatalf("expected err %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("delete not empty project group with cascade false", func(t *testing.T) {
+		for _, cascade := range []string{"false", "0", "notabool"} {
+			req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/api/v1alpha/projectgroups/%s?cascade=%s", cs.c.Web.ListenAddress, pg01.ID, cascade), nil)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("cascade %q: expected status code %d, got %d", cascade, http.StatusBadRequest, resp.StatusCode)
+			}
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
+			pg, err := cs.readDB.GetProjectGroupByID(tx, spg01.ID)
+			if err != nil {
+				return err
+			}
+			if pg == nil {
+				return fmt.Errorf("expected project group %q not deleted", spg01.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	t.Run("delete project group", func(t *testing.T) {
+		err := cs.ah.DeleteProjectGroup(ctx, pg01.ID, true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	waitReadDB(ctx, t, cs)
+
+	t.Run("project group childs are deleted", func(t *testing.T) {
+		err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
+			pg, err := cs.readDB.GetProjectGroupByID(tx, spg01.ID)
+			if err != nil {
+				return err
+			}
+			if pg != nil {
+				return fmt.Errorf("expected project group %q deleted", spg01.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
+
+func TestProjectGroupDeleteDontSeeOldChildObjects(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	// create a projectgroup in org root project group
+	pg01, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// create a child projectgroup in org root project group
+	spg01, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "subprojectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: pg01.ID}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// create a project inside child projectgroup
+	project, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: spg01.ID}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// create project secret
+	_, err = cs.ah.CreateSecret(ctx, &types.Secret{Name: "secret01", Parent: types.Parent{Type: types.ConfigTypeProject, ID: project.ID}, Type: types.SecretTypeInternal, Data: map[string]string{"secret01": "secretvar01"}})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// create project variable
+	_, err = cs.ah.CreateVariable(ctx, &types.Variable{Name: "variable01", Parent: types.Parent{Type: types.ConfigTypeProject, ID: project.ID}, Values: []types.VariableValue{{SecretName: "secret01", SecretVar: "secretvar01"}}})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// delete projectgroup
+	if err = cs.ah.DeleteProjectGroup(ctx, pg01.ID, true); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// recreate the same hierarchj using the paths
+	pg01, err = cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	spg01, err = cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "subprojectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name, pg01.Name)}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	project, err = cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("org", org.Name, pg01.Name, spg01.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	secret, err := cs.ah.CreateSecret(ctx, &types.Secret{Name: "secret01", Parent: types.Parent{Type: types.ConfigTypeProject, ID: path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name)}, Type: types.SecretTypeInternal, Data: map[string]string{"secret01": "secretvar01"}})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	variable, err := cs.ah.CreateVariable(ctx, &types.Variable{Name: "variable01", Parent: types.Parent{Type: types.ConfigTypeProject, ID: path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name)}, Values: []types.VariableValue{{SecretName: "secret01", SecretVar: "secretvar01"}}})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// Get by projectgroup id
+	projects, err := cs.ah.GetProjectGroupProjects(ctx, spg01.ID)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if diff := cmp.Diff(projects, []*types.Project{project}); diff != "" {
+		t.Error(diff)
+	}
+
+	// Get by projectgroup path
+	projects, err = cs.ah.GetProjectGroupProjects(ctx, path.Join("org", org.Name, pg01.Name, spg01.Name))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if diff := cmp.Diff(projects, []*types.Project{project}); diff != "" {
+		t.Error(diff)
+	}
+
+	secrets, err := cs.ah.GetSecrets(ctx, types.ConfigTypeProject, project.ID, false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if diff := cmp.Diff(secrets, []*types.Secret{secret}); diff != "" {
+		t.Error(diff)
+	}
+
+	secrets, err = cs.ah.GetSecrets(ctx, types.ConfigTypeProject, path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name), false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if diff := cmp.Diff(secrets, []*types.Secret{secret}); diff != "" {
+		t.Error(diff)
+	}
+
+	variables, err := cs.ah.GetVariables(ctx, types.ConfigTypeProject, project.ID, false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if diff := cmp.Diff(variables, []*types.Variable{variable}); diff != "" {
+		t.Error(diff)
+	}
+
+	variables, err = cs.ah.GetVariables(ctx, types.ConfigTypeProject, path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name), false)
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 	if diff := cmp.Diff(variables, []*types.Variable{variable}); diff != "" {
 		t.Error(diff)
 	}
+}
+
+func TestOrgMembers(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic, CreatorUserID: user.ID})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	t.Run("test user org creator is org member with owner role", func(t *testing.T) {
+		expectedResponse := []*action.UserOrgsResponse{
+			{
+				Organization: org,
+				Role:         types.MemberRoleOwner,
+			},
+		}
+		res, err := cs.ah.GetUserOrgs(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff(res, expectedResponse); diff != "" {
+			t.Error(diff)
+		}
+	})
+
+	orgs := []*types.Organization{}
+	for i := 0; i < 10; i++ {
+		org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: fmt.Sprintf("org%d", i), Visibility: types.VisibilityPublic, CreatorUserID: user.ID})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		orgs = append(orgs, org)
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := cs.ah.DeleteOrg(ctx, fmt.Sprintf("org%d", i)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// delete some org and check that if also orgmembers aren't yet cleaned only the existing orgs are reported
+	t.Run("test only existing orgs are reported", func(t *testing.T) {
+		expectedResponse := []*action.UserOrgsResponse{
+			{
+				Organization: org,
+				Role:         types.MemberRoleOwner,
+			},
+		}
+		for i := 5; i < 10; i++ {
+			expectedResponse = append(expectedResponse, &action.UserOrgsResponse{
+				Organization: orgs[i],
+				Role:         types.MemberRoleOwner,
+			})
+		}
+		res, err := cs.ah.GetUserOrgs(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff(res, expectedResponse); diff != "" {
+			t.Error(diff)
+		}
+	})
+
+	waitReadDB(ctx, t, cs)
+
+}
+
+func TestUserLinkedAccounts(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	rs, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+		Name:               "rs01",
+		APIURL:             "https://api.example.com",
+		Type:               types.RemoteSourceTypeGitea,
+		AuthType:           types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:     "clientid",
+		Oauth2ClientSecret: "clientsecret",
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	la, err := cs.ah.CreateUserLA(ctx, &action.CreateUserLARequest{
+		UserRef:           "user01",
+		RemoteSourceName:  "rs01",
+		RemoteUserID:      "remoteuserid01",
+		RemoteUserName:    "remoteuser01",
+		Oauth2AccessToken: "accesstoken",
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	t.Run("list user linked accounts", func(t *testing.T) {
+		las, _, err := csc.GetUserLinkedAccounts(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedLAs := []*csapitypes.UserLinkedAccount{
+			{
+				ID:               la.ID,
+				RemoteSourceID:   rs.ID,
+				RemoteSourceName: "rs01",
+				RemoteUserID:     "remoteuserid01",
+				RemoteUserName:   "remoteuser01",
+			},
+		}
+		if diff := cmp.Diff(expectedLAs, las); diff != "" {
+			t.Fatalf("linked accounts mismatch (-expected +got):\n%s", diff)
+		}
+	})
+
+	t.Run("list linked accounts of not existing user", func(t *testing.T) {
+		_, resp, err := csc.GetUserLinkedAccounts(ctx, "user02")
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("get user by remote user", func(t *testing.T) {
+		user, _, err := csc.GetUserByRemoteUser(ctx, rs.ID, "remoteuserid01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if user.Name != "user01" {
+			t.Fatalf("expected user %q, got %q", "user01", user.Name)
+		}
+		if _, ok := user.LinkedAccounts[la.ID]; !ok {
+			t.Fatalf("expected linked account %q", la.ID)
+		}
+	})
+
+	t.Run("get user by not existing remote user", func(t *testing.T) {
+		_, resp, err := csc.GetUserByRemoteUser(ctx, rs.ID, "remoteuserid02")
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("get user by remote user without remote source", func(t *testing.T) {
+		_, resp, err := csc.GetUserByRemoteUser(ctx, "", "remoteuserid01")
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("update linked account token", func(t *testing.T) {
+		expiresAt := time.Now().Add(1 * time.Hour).UTC().Truncate(time.Second)
+		req := &csapitypes.UpdateUserLATokenRequest{
+			Oauth2AccessToken:          "newaccesstoken",
+			Oauth2RefreshToken:         "newrefreshtoken",
+			Oauth2AccessTokenExpiresAt: expiresAt,
+		}
+		ula, resp, err := csc.UpdateUserLAToken(ctx, "user01", la.ID, req)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedLA := &csapitypes.UserLinkedAccount{
+			ID:               la.ID,
+			RemoteSourceID:   rs.ID,
+			RemoteSourceName: "rs01",
+			RemoteUserID:     "remoteuserid01",
+			RemoteUserName:   "remoteuser01",
+		}
+		if diff := cmp.Diff(expectedLA, ula); diff != "" {
+			t.Fatalf("linked account mismatch (-expected +got):\n%s", diff)
+		}
+
+		// read our own write
+		rctx := csclient.WithMinRevision(ctx, csclient.ResponseRevision(resp))
+		user, _, err := csc.GetUser(rctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		sla := user.LinkedAccounts[la.ID]
+		if sla.RemoteUserID != "remoteuserid01" || sla.RemoteUserName != "remoteuser01" {
+			t.Fatalf("expected remote user unchanged, got id %q, name %q", sla.RemoteUserID, sla.RemoteUserName)
+		}
+		if sla.Oauth2AccessToken != "newaccesstoken" || sla.Oauth2RefreshToken != "newrefreshtoken" || !sla.Oauth2AccessTokenExpiresAt.Equal(expiresAt) {
+			t.Fatalf("tokens not updated: %+v", sla)
+		}
+
+		// the same update doesn't write a new version of the user
+		if _, _, err := csc.UpdateUserLAToken(ctx, "user01", la.ID, req); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		nuser, _, err := csc.GetUser(rctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff(user, nuser); diff != "" {
+			t.Fatalf("user mismatch (-expected +got):\n%s", diff)
+		}
+	})
+
+	t.Run("update token of not existing linked account", func(t *testing.T) {
+		_, resp, err := csc.UpdateUserLAToken(ctx, "user01", "notexistinglaid", &csapitypes.UpdateUserLATokenRequest{Oauth2AccessToken: "accesstoken"})
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	createUserLA := func(t *testing.T, userRef string, req *csapitypes.CreateUserLARequest) (*http.Response, *util.APIError) {
+		reqj, err := json.Marshal(req)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp, err := http.Post(fmt.Sprintf("http://%s/api/v1alpha/users/%s/linkedaccounts", cs.c.Web.ListenAddress, userRef), "application/json", bytes.NewReader(reqj))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		var apiErr *util.APIError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return resp, apiErr
+	}
+
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user03"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	t.Run("create linked account with not existing remote source", func(t *testing.T) {
+		resp, apiErr := createUserLA(t, "user03", &csapitypes.CreateUserLARequest{RemoteSourceName: "rs02", RemoteUserID: "remoteuserid03"})
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+		expected := &util.APIError{Code: action.ErrorCodeRemoteSourceNotExist, Message: `remote source "rs02" doesn't exist`}
+		if diff := cmp.Diff(expected, apiErr); diff != "" {
+			t.Fatalf("error mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("create linked account already linked to another user", func(t *testing.T) {
+		resp, apiErr := createUserLA(t, "user03", &csapitypes.CreateUserLARequest{RemoteSourceName: "rs01", RemoteUserID: "remoteuserid01"})
+		if resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected status code %d, got %d", http.StatusConflict, resp.StatusCode)
+		}
+		expected := &util.APIError{Code: action.ErrorCodeLinkedAccountAlreadyExists, Message: `remote user id "remoteuserid01" for remote source "rs01" is already linked to user "user01"`}
+		if diff := cmp.Diff(expected, apiErr); diff != "" {
+			t.Fatalf("error mismatch (-want +got):\n%s", diff)
+		}
+
+		user, _, err := csc.GetUser(ctx, "user03")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(user.LinkedAccounts) != 0 {
+			t.Fatalf("expected no linked accounts, got %d", len(user.LinkedAccounts))
+		}
+	})
+}
+
+func TestDeleteUserLinkedAccounts(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	for _, rsName := range []string{"rs01", "rs02"} {
+		if _, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+			Name:               rsName,
+			APIURL:             "https://api.example.com",
+			Type:               types.RemoteSourceTypeGitea,
+			AuthType:           types.RemoteSourceAuthTypeOauth2,
+			Oauth2ClientID:     "clientid",
+			Oauth2ClientSecret: "clientsecret",
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	for _, userName := range []string{"user01", "user02"} {
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	createLA := func(userName, rsName, remoteUserID string) *types.LinkedAccount {
+		la, err := cs.ah.CreateUserLA(ctx, &action.CreateUserLARequest{
+			UserRef:           userName,
+			RemoteSourceName:  rsName,
+			RemoteUserID:      remoteUserID,
+			RemoteUserName:    remoteUserID,
+			Oauth2AccessToken: "accesstoken",
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		waitReadDB(ctx, t, cs)
+		return la
+	}
+	la01 := createLA("user01", "rs01", "remoteuserid01")
+	la02 := createLA("user01", "rs02", "remoteuserid02")
+	la03 := createLA("user02", "rs01", "remoteuserid03")
+
+	if _, err := cs.ah.CreateUserToken(ctx, "user01", "token01", nil); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	committedWalSequence := func() *sequence.Sequence {
+		var seq string
+		err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
+			var err error
+			seq, err = cs.readDB.GetCommittedWalSequence(tx)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		s, err := sequence.Parse(seq)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return s
+	}
+
+	t.Run("delete all the user linked accounts", func(t *testing.T) {
+		startSeq := committedWalSequence()
+
+		res, _, err := csc.DeleteUserLAs(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedIDs := []string{la01.ID, la02.ID}
+		sort.Strings(expectedIDs)
+		if diff := cmp.Diff(expectedIDs, res.DeletedLinkedAccountIDs); diff != "" {
+			t.Fatalf("deleted linked account ids mismatch (-expected +got):\n%s", diff)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		// all the linked accounts are removed by a single wal
+		if seq := committedWalSequence(); seq.C != startSeq.C+1 {
+			t.Fatalf("expected one wal committed, got %d", seq.C-startSeq.C)
+		}
+
+		user, _, err := csc.GetUser(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(user.LinkedAccounts) != 0 {
+			t.Fatalf("expected no linked accounts, got %v", user.LinkedAccounts)
+		}
+		if _, ok := user.Tokens["token01"]; !ok {
+			t.Fatalf("expected user token %q to be kept", "token01")
+		}
+
+		// the linked accounts of the other users aren't changed
+		user, _, err = csc.GetUser(ctx, "user02")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, ok := user.LinkedAccounts[la03.ID]; !ok || len(user.LinkedAccounts) != 1 {
+			t.Fatalf("expected only linked account %q, got %v", la03.ID, user.LinkedAccounts)
+		}
+	})
+
+	t.Run("delete all the linked accounts of a user without linked accounts", func(t *testing.T) {
+		res, _, err := csc.DeleteUserLAs(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(res.DeletedLinkedAccountIDs) != 0 {
+			t.Fatalf("expected no deleted linked accounts, got %v", res.DeletedLinkedAccountIDs)
+		}
+	})
+
+	t.Run("delete all the linked accounts of a not existing user", func(t *testing.T) {
+		_, resp, err := csc.DeleteUserLAs(ctx, "user03")
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+}
+
+func TestUserTokens(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	token, err := cs.ah.CreateUserToken(ctx, "user01", "token01", nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateUserToken(ctx, "user01", "token01", nil); err == nil {
+		t.Fatalf("expected error creating duplicate token, got nil")
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	t.Run("list user tokens", func(t *testing.T) {
+		tokens, _, err := csc.GetUserTokens(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(tokens) != 1 || tokens[0].Name != "token01" {
+			t.Fatalf("unexpected tokens: %s", util.Dump(tokens))
+		}
+		if tokens[0].CreationTime == nil || tokens[0].CreationTime.IsZero() {
+			t.Fatalf("expected token creation time")
+		}
+		tokensj, err := json.Marshal(tokens)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if strings.Contains(string(tokensj), token) {
+			t.Fatalf("token value must not be returned")
+		}
+	})
+
+	t.Run("revoke user token", func(t *testing.T) {
+		resp, err := csc.DeleteUserToken(ctx, "user01", "token01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		// 202 is returned only when the token isn't yet revoked
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected status code %d, got %d", http.StatusNoContent, resp.StatusCode)
+		}
+
+		// the token must be immediately revoked
+		var user *types.User
+		err = cs.readDB.Do(ctx, func(tx *db.Tx) error {
+			var err error
+			user, err = cs.readDB.GetUserByTokenValue(tx, token)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if user != nil {
+			t.Fatalf("expected token revoked")
+		}
+
+		tokens, _, err := csc.GetUserTokens(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(tokens) != 0 {
+			t.Fatalf("unexpected tokens: %s", util.Dump(tokens))
+		}
+	})
+
+	t.Run("revoke not existing user token", func(t *testing.T) {
+		resp, err := csc.DeleteUserToken(ctx, "user01", "token01")
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+}
+
+func TestUserTokenExpiration(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.c.Auth.Enabled = true
+		cs.c.Auth.AdminToken = "admintoken"
+	})
+	defer teardown()
+
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+	csc.SetToken("admintoken")
+
+	t.Run("create token with invalid ttl", func(t *testing.T) {
+		for _, ttl := range []string{"bad", "-1s", "0s"} {
+			_, resp, err := csc.CreateUserToken(ctx, "user01", &csapitypes.CreateUserTokenRequest{TokenName: "token01", TTL: ttl})
+			if err == nil {
+				t.Fatalf("expected error creating a token with ttl %q, got nil error", ttl)
+			}
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+		}
+	})
+
+	res, _, err := csc.CreateUserToken(ctx, "user01", &csapitypes.CreateUserTokenRequest{TokenName: "expiringtoken", TTL: "3s"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	expiringToken := res.Token
+	res, _, err = csc.CreateUserToken(ctx, "user01", &csapitypes.CreateUserTokenRequest{TokenName: "token01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	token := res.Token
+
+	tokens, _, err := csc.GetUserTokens(ctx, "user01")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("unexpected tokens: %s", util.Dump(tokens))
+	}
+	for _, ut := range tokens {
+		switch ut.Name {
+		case "expiringtoken":
+			if ut.ExpirationTime == nil || ut.ExpirationTime.Sub(*ut.CreationTime) != 3*time.Second {
+				t.Fatalf("expected token expiration time 3s after the creation time, got: %s", util.Dump(ut))
+			}
+		case "token01":
+			if ut.ExpirationTime != nil {
+				t.Fatalf("expected no token expiration time, got: %s", util.Dump(ut))
+			}
+		}
+	}
+
+	userClient := func(token string) *csclient.Client {
+		c := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+		c.SetToken(token)
+		return c
+	}
+
+	if _, _, err := userClient(expiringToken).GetUser(ctx, "user01"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, _, err := csc.GetUserByToken(ctx, expiringToken); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	time.Sleep(4 * time.Second)
+
+	t.Run("expired token is rejected", func(t *testing.T) {
+		_, resp, err := userClient(expiringToken).GetUser(ctx, "user01")
+		if err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected status code %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+
+		_, resp, err = csc.GetUserByToken(ctx, expiringToken)
+		if err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+
+		if _, _, err := userClient(token).GetUser(ctx, "user01"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	t.Run("expired token is purged", func(t *testing.T) {
+		if err := cs.ah.PurgeExpiredUserTokens(ctx); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		var user *types.User
+		var users []*types.User
+		err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
+			var err error
+			user, err = cs.readDB.GetUserByTokenValue(tx, expiringToken)
+			if err != nil {
+				return err
+			}
+			users, err = cs.readDB.GetUsersWithExpiredTokens(tx, time.Now(), 0)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if user != nil {
+			t.Fatalf("expected expired token removed from the readdb")
+		}
+		if len(users) != 0 {
+			t.Fatalf("expected no users with expired tokens, got: %s", util.Dump(users))
+		}
+
+		tokens, _, err := csc.GetUserTokens(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(tokens) != 1 || tokens[0].Name != "token01" {
+			t.Fatalf("unexpected tokens: %s", util.Dump(tokens))
+		}
+	})
+}
+
+func TestUserTokenIntrospection(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.c.Auth.Enabled = true
+		cs.c.Auth.AdminToken = "admintoken"
+	})
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+	csc.SetToken("admintoken")
+
+	res, _, err := csc.CreateUserToken(ctx, "user01", &csapitypes.CreateUserTokenRequest{TokenName: "token01", Scopes: []types.TokenScope{types.TokenScopeWrite}})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	token := res.Token
+	res, _, err = csc.CreateUserToken(ctx, "user01", &csapitypes.CreateUserTokenRequest{TokenName: "expiringtoken", TTL: "2s"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	expiringToken := res.Token
+
+	t.Run("tokens are saved hashed", func(t *testing.T) {
+		var user *types.User
+		err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
+			var err error
+			user, err = cs.readDB.GetUser(tx, "user01")
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if user.Tokens["token01"] != types.HashToken(token) {
+			t.Fatalf("expected token saved as %q, got %q", types.HashToken(token), user.Tokens["token01"])
+		}
+	})
+
+	t.Run("valid token", func(t *testing.T) {
+		_, resp, err := csc.IntrospectUserToken(ctx, expiringToken)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+
+		introspection, _, err := csc.IntrospectUserToken(ctx, token)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expected := &csapitypes.UserTokenIntrospection{
+			UserID:    user.ID,
+			UserName:  "user01",
+			TokenName: "token01",
+			Scopes:    []types.TokenScope{types.TokenScopeWrite},
+		}
+		if introspection.CreationTime == nil {
+			t.Fatalf("expected token creation time")
+		}
+		introspection.CreationTime = nil
+		if diff := cmp.Diff(expected, introspection); diff != "" {
+			t.Fatalf("introspection mismatch (-want +got):\n%s", diff)
+		}
+		introspectionj, err := json.Marshal(introspection)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if strings.Contains(string(introspectionj), token) {
+			t.Fatalf("token value must not be returned")
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		_, resp, err := csc.IntrospectUserToken(ctx, "unknowntoken")
+		if err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected status code %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+
+	t.Run("introspection requires the admin scope", func(t *testing.T) {
+		c := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+		c.SetToken(token)
+		_, resp, err := c.IntrospectUserToken(ctx, token)
+		if err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected status code %d, got %d", http.StatusForbidden, resp.StatusCode)
+		}
+	})
+
+	time.Sleep(3 * time.Second)
+
+	t.Run("expired token", func(t *testing.T) {
+		_, resp, err := csc.IntrospectUserToken(ctx, expiringToken)
+		if err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected status code %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+}
+
+func TestSecretsInheritance(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.ah.SetSecretsKey(bytes.Repeat([]byte{1}, 32))
+	})
+	defer teardown()
+
+	org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	rootPGRef := path.Join("org", org.Name)
+	pg01, err := cs.ah.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: rootPGRef}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	project, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: pg01.ID}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	secrets := []*types.Secret{
+		{Name: "secret01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: rootPGRef}, Type: types.SecretTypeInternal, Data: map[string]string{"var01": "rootvalue"}},
+		{Name: "secret02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: pg01.ID}, Type: types.SecretTypeInternal, Data: map[string]string{"var01": "pg01value"}},
+		{Name: "secret01", Parent: types.Parent{Type: types.ConfigTypeProject, ID: project.ID}, Type: types.SecretTypeInternal, Data: map[string]string{"var01": "projectvalue"}},
+	}
+	for _, secret := range secrets {
+		if _, err := cs.ah.CreateSecret(ctx, secret); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	t.Run("secrets data is encrypted at rest", func(t *testing.T) {
+		var secret *types.Secret
+		err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
+			var err error
+			secret, err = cs.readDB.GetSecretByName(tx, project.ID, "secret01")
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if !secret.DataEncrypted {
+			t.Fatalf("expected encrypted secret data")
+		}
+		if secret.Data["var01"] == "projectvalue" {
+			t.Fatalf("expected encrypted secret data, got plaintext value")
+		}
+	})
+
+	t.Run("project secrets tree with closer secrets first", func(t *testing.T) {
+		secrets, err := cs.ah.GetSecrets(ctx, types.ConfigTypeProject, project.ID, true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expected := []string{"secret01:projectvalue", "secret02:pg01value", "secret01:rootvalue"}
+		got := []string{}
+		for _, s := range secrets {
+			got = append(got, s.Name+":"+s.Data["var01"])
+		}
+		if diff := cmp.Diff(expected, got); diff != "" {
+			t.Fatalf("secrets mismatch (-expected +got):\n%s", diff)
+		}
+	})
+
+	t.Run("closer secret overrides ancestors secret", func(t *testing.T) {
+		tests := []struct {
+			parentType    types.ConfigType
+			parentID      string
+			name          string
+			expectedValue string
+		}{
+			{types.ConfigTypeProject, project.ID, "secret01", "projectvalue"},
+			{types.ConfigTypeProject, project.ID, "secret02", "pg01value"},
+			{types.ConfigTypeProjectGroup, pg01.ID, "secret01", "rootvalue"},
+		}
+		for _, tt := range tests {
+			var secret *types.Secret
+			err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
+				var err error
+				secret, err = cs.readDB.GetSecretTree(tx, tt.parentType, tt.parentID, tt.name)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			secret, err = cs.ah.GetSecret(ctx, secret.ID)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if secret.Data["var01"] != tt.expectedValue {
+				t.Fatalf("expected secret %q value %q, got %q", tt.name, tt.expectedValue, secret.Data["var01"])
+			}
+		}
+	})
+
+	t.Run("list secrets without data", func(t *testing.T) {
+		csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+		secrets, _, err := csc.GetProjectSecrets(ctx, project.ID, true, false)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		for _, s := range secrets {
+			if len(s.Data) != 0 {
+				t.Fatalf("expected no secret data, got: %v", s.Data)
+			}
+		}
+		secrets, _, err = csc.GetProjectSecrets(ctx, project.ID, false, true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(secrets) != 1 || secrets[0].Data["var01"] != "projectvalue" {
+			t.Fatalf("unexpected secrets: %s", util.Dump(secrets))
+		}
+	})
+
+	t.Run("withdata parameter value is parsed", func(t *testing.T) {
+		u := fmt.Sprintf("http://%s/api/v1alpha/projects/%s/secrets", cs.c.Web.ListenAddress, project.ID)
+		resp, err := http.Get(u + "?withdata=false")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		var secrets []*csapitypes.Secret
+		if err := json.NewDecoder(resp.Body).Decode(&secrets); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(secrets) != 1 || len(secrets[0].Data) != 0 {
+			t.Fatalf("expected secrets without data, got: %s", util.Dump(secrets))
+		}
+
+		resp, err = http.Get(u + "?withdata=notabool")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
+
+func TestResolveVariables(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	rootPGRef := path.Join("org", org.Name)
+	project, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: rootPGRef}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	rootSecret, err := cs.ah.CreateSecret(ctx, &types.Secret{Name: "secret01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: rootPGRef}, Type: types.SecretTypeInternal, Data: map[string]string{"var01": "value01"}})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	masterWhen := &stypes.When{Branch: &stypes.WhenConditions{Include: []stypes.WhenCondition{{Type: stypes.WhenConditionTypeSimple, Match: "master"}}}}
+	variables := []*types.Variable{
+		{
+			Name:   "variable01",
+			Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: rootPGRef},
+			Values: []types.VariableValue{
+				{SecretName: "secret01", SecretVar: "master", When: masterWhen},
+				{SecretName: "secret01", SecretVar: "default"},
+			},
+		},
+		{
+			Name:   "variable02",
+			Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: rootPGRef},
+			Values: []types.VariableValue{{SecretName: "secret01", SecretVar: "root"}},
+		},
+		{
+			Name:   "variable02",
+			Parent: types.Parent{Type: types.ConfigTypeProject, ID: project.ID},
+			Values: []types.VariableValue{{SecretName: "secret01", SecretVar: "project"}},
+		},
+		{
+			Name:   "variable03",
+			Parent: types.Parent{Type: types.ConfigTypeProject, ID: project.ID},
+			Values: []types.VariableValue{{SecretName: "missingsecret", SecretVar: "var01"}},
+		},
+	}
+	for _, variable := range variables {
+		if _, err := cs.ah.CreateVariable(ctx, variable); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	tests := []struct {
+		name     string
+		branch   string
+		expected []*csapitypes.ResolvedVariable
+	}{
+		{
+			name:   "matching branch",
+			branch: "master",
+			expected: []*csapitypes.ResolvedVariable{
+				{Name: "variable02", ParentPath: path.Join(rootPGRef, project.Name), Matched: true, SecretName: "secret01", SecretVar: "project", SecretID: rootSecret.ID, SecretParentPath: rootPGRef},
+				{Name: "variable03", ParentPath: path.Join(rootPGRef, project.Name), Matched: true, SecretName: "missingsecret", SecretVar: "var01"},
+				{Name: "variable01", ParentPath: rootPGRef, Matched: true, SecretName: "secret01", SecretVar: "master", SecretID: rootSecret.ID, SecretParentPath: rootPGRef},
+			},
+		},
+		{
+			name:   "not matching branch",
+			branch: "feature",
+			expected: []*csapitypes.ResolvedVariable{
+				{Name: "variable02", ParentPath: path.Join(rootPGRef, project.Name), Matched: true, SecretName: "secret01", SecretVar: "project", SecretID: rootSecret.ID, SecretParentPath: rootPGRef},
+				{Name: "variable03", ParentPath: path.Join(rootPGRef, project.Name), Matched: true, SecretName: "missingsecret", SecretVar: "var01"},
+				{Name: "variable01", ParentPath: rootPGRef, Matched: true, SecretName: "secret01", SecretVar: "default", SecretID: rootSecret.ID, SecretParentPath: rootPGRef},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, _, err := csc.GetProjectResolvedVariables(ctx, project.ID, string(itypes.RunRefTypeBranch), tt.branch, "", "")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, resolved); diff != "" {
+				t.Fatalf("resolved variables mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("wrong ref type", func(t *testing.T) {
+		_, resp, err := csc.GetProjectResolvedVariables(ctx, project.ID, "wrong", "master", "", "")
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
+
+func TestRemoteSource(t *testing.T) {
+	tests := []struct {
+		name string
+		f    func(ctx context.Context, t *testing.T, cs *Configstore)
+	}{
+		{
+			name: "test create remote source",
+			f: func(ctx context.Context, t *testing.T, cs *Configstore) {
+				rs := &types.RemoteSource{
+					Name:               "rs01",
+					APIURL:             "https://api.example.com",
+					Type:               types.RemoteSourceTypeGitea,
+					AuthType:           types.RemoteSourceAuthTypeOauth2,
+					Oauth2ClientID:     "clientid",
+					Oauth2ClientSecret: "clientsecret",
+				}
+				_, err := cs.ah.CreateRemoteSource(ctx, rs)
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			},
+		},
+		{
+			name: "test create duplicate remote source",
+			f: func(ctx context.Context, t *testing.T, cs *Configstore) {
+				rs := &types.RemoteSource{
+					Name:               "rs02",
+					APIURL:             "https://api.example.com",
+					Type:               types.RemoteSourceTypeGitea,
+					AuthType:           types.RemoteSourceAuthTypeOauth2,
+					Oauth2ClientID:     "clientid",
+					Oauth2ClientSecret: "clientsecret",
+				}
+				rs, err := cs.ah.CreateRemoteSource(ctx, rs)
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+
+				waitReadDB(ctx, t, cs)
+
+				expectedError := util.NewErrConflict(fmt.Errorf(`remotesource "rs02" already exists`))
+				_, err = cs.ah.CreateRemoteSource(ctx, rs)
+				if err.Error() != expectedError.Error() {
+					t.Fatalf("expected err: %v, got err: %v", expectedError.Error(), err.Error())
+				}
+				if !util.IsConflict(err) {
+					t.Fatalf("expected conflict error, got err: %v", err)
+				}
+			},
+		},
+		{
+			name: "test rename remote source",
+			f: func(ctx context.Context, t *testing.T, cs *Configstore) {
+				rs := &types.RemoteSource{
+					Name:               "rs03",
+					APIURL:             "https://api.example.com",
+					Type:               types.RemoteSourceTypeGitea,
+					AuthType:           types.RemoteSourceAuthTypeOauth2,
+					Oauth2ClientID:     "clientid",
+					Oauth2ClientSecret: "clientsecret",
+				}
+				rs, err := cs.ah.CreateRemoteSource(ctx, rs)
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+
+				waitReadDB(ctx, t, cs)
+
+				rs.Name = "rs04"
+				req := &action.UpdateRemoteSourceRequest{
+					RemoteSourceRef: "rs03",
+					RemoteSource:    rs,
+				}
+				_, err = cs.ah.UpdateRemoteSource(ctx, req)
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			},
+		},
+		{
+			name: "test update remote source keeping same name",
+			f: func(ctx context.Context, t *testing.T, cs *Configstore) {
+				rs01 := &types.RemoteSource{
+					Name:               "rs05",
+					APIURL:             "https://api.example.com",
+					Type:               types.RemoteSourceTypeGitea,
+					AuthType:           types.RemoteSourceAuthTypeOauth2,
+					Oauth2ClientID:     "clientid",
+					Oauth2ClientSecret: "clientsecret",
+				}
+				rs01, err := cs.ah.CreateRemoteSource(ctx, rs01)
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+
+				waitReadDB(ctx, t, cs)
+
+				rs01.APIURL = "https://api01.example.com"
+				req := &action.UpdateRemoteSourceRequest{
+					RemoteSourceRef: "rs05",
+					RemoteSource:    rs01,
+				}
+				_, err = cs.ah.UpdateRemoteSource(ctx, req)
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			},
+		},
+		{
+			name: "test rename remote source to an already existing name",
+			f: func(ctx context.Context, t *testing.T, cs *Configstore) {
+				rs01 := &types.RemoteSource{
+					Name:               "rs06",
+					APIURL:             "https://api.example.com",
+					Type:               types.RemoteSourceTypeGitea,
+					AuthType:           types.RemoteSourceAuthTypeOauth2,
+					Oauth2ClientID:     "clientid",
+					Oauth2ClientSecret: "clientsecret",
+				}
+				rs01, err := cs.ah.CreateRemoteSource(ctx, rs01)
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+
+				rs02 := &types.RemoteSource{
+					Name:               "rs07",
+					APIURL:             "https://api.example.com",
+					Type:               types.RemoteSourceTypeGitea,
+					AuthType:           types.RemoteSourceAuthTypeOauth2,
+					Oauth2ClientID:     "clientid",
+					Oauth2ClientSecret: "clientsecret",
+				}
+				if _, err = cs.ah.CreateRemoteSource(ctx, rs02); err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+
+				waitReadDB(ctx, t, cs)
+
+				expectedError := util.NewErrConflict(fmt.Errorf(`remotesource "rs07" already exists`))
+				rs01.Name = "rs07"
+				req := &action.UpdateRemoteSourceRequest{
+					RemoteSourceRef: "rs06",
+					RemoteSource:    rs01,
+				}
+				_, err = cs.ah.UpdateRemoteSource(ctx, req)
+				if err.Error() != expectedError.Error() {
+					t.Fatalf("expected err: %v, got err: %v", expectedError.Error(), err.Error())
+				}
+			},
+		},
+	}
+
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f(ctx, t, cs)
+		})
+	}
+}
+
+func TestGithubAppRemoteSource(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.ah.SetSecretsKey(bytes.Repeat([]byte{1}, 32))
+	})
+	defer teardown()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	privateKey := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+
+	// fake github api returning installation tokens with the provided
+	// expirations
+	var mu sync.Mutex
+	tokenExpirations := []time.Duration{2 * time.Minute, 1 * time.Hour}
+	tokensCreated := 0
+	ghServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || !strings.HasSuffix(r.URL.Path, "/app/installations/2/access_tokens") {
+			http.NotFound(w, r)
+			return
+		}
+		appToken, err := jwt.ParseWithClaims(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		})
+		if err != nil || appToken.Claims.(*jwt.StandardClaims).Issuer != "1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		expiration := tokenExpirations[len(tokenExpirations)-1]
+		if tokensCreated < len(tokenExpirations) {
+			expiration = tokenExpirations[tokensCreated]
+		}
+		tokensCreated++
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      fmt.Sprintf("token%02d", tokensCreated),
+			"expires_at": time.Now().Add(expiration).UTC().Format(time.RFC3339),
+		})
+	}))
+	defer ghServer.Close()
+
+	newRemoteSource := func() *types.RemoteSource {
+		return &types.RemoteSource{
+			Name:                    "rs01",
+			APIURL:                  ghServer.URL,
+			Type:                    types.RemoteSourceTypeGithub,
+			AuthType:                types.RemoteSourceAuthTypeGithubApp,
+			GithubAppID:             1,
+			GithubAppInstallationID: 2,
+			GithubAppPrivateKey:     privateKey,
+		}
+	}
+
+	t.Run("test github app remote source validation", func(t *testing.T) {
+		rs := newRemoteSource()
+		rs.GithubAppInstallationID = 0
+		expectedErr := fmt.Sprintf("remotesource github app installation id required for auth type %q", types.RemoteSourceAuthTypeGithubApp)
+		if _, err := cs.ah.CreateRemoteSource(ctx, rs); err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		rs = newRemoteSource()
+		rs.GithubAppPrivateKey = "notakey"
+		if _, err := cs.ah.CreateRemoteSource(ctx, rs); !util.IsBadRequest(err) {
+			t.Fatalf("expected bad request error, got err: %v", err)
+		}
+
+		rs = newRemoteSource()
+		rs.AuthType = types.RemoteSourceAuthTypeGithubApp
+		rs.Type = types.RemoteSourceTypeGitea
+		expectedErr = fmt.Sprintf("remotesource type %q doesn't support auth type %q", types.RemoteSourceTypeGitea, types.RemoteSourceAuthTypeGithubApp)
+		if _, err := cs.ah.CreateRemoteSource(ctx, rs); err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	if _, err := cs.ah.CreateRemoteSource(ctx, newRemoteSource()); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+		Name:               "rs02",
+		APIURL:             "https://api.example.com",
+		Type:               types.RemoteSourceTypeGitea,
+		AuthType:           types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:     "clientid",
+		Oauth2ClientSecret: "clientsecret",
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	t.Run("test private key is stored encrypted", func(t *testing.T) {
+		rs, _, err := csc.GetRemoteSource(ctx, "rs01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if !rs.GithubAppPrivateKeyEncrypted {
+			t.Fatalf("expected encrypted private key")
+		}
+		if rs.GithubAppPrivateKey == privateKey {
+			t.Fatalf("expected private key to not be stored in plain text")
+		}
+
+		// updating the remote source with its current encrypted private key
+		// must keep it
+		rs.SkipVerify = true
+		if _, err := cs.ah.UpdateRemoteSource(ctx, &action.UpdateRemoteSourceRequest{RemoteSourceRef: "rs01", RemoteSource: rs}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	waitReadDB(ctx, t, cs)
+
+	t.Run("test remote sources auth type filter", func(t *testing.T) {
+		remoteSources, err := cs.readDB.GetRemoteSources(ctx, "", "", types.RemoteSourceAuthTypeGithubApp, 0, true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(remoteSources) != 1 || remoteSources[0].Name != "rs01" {
+			t.Fatalf("expected only remote source %q, got %v", "rs01", remoteSources)
+		}
+	})
+
+	t.Run("test installation token refresh", func(t *testing.T) {
+		// the first token expires inside the refresh margin so a new one
+		// must be created on the next request
+		token, _, err := csc.GetGithubAppInstallationToken(ctx, "rs01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if token.Token != "token01" {
+			t.Fatalf("expected token %q, got %q", "token01", token.Token)
+		}
+
+		token, _, err = csc.GetGithubAppInstallationToken(ctx, "rs01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if token.Token != "token02" {
+			t.Fatalf("expected token %q, got %q", "token02", token.Token)
+		}
+
+		// the second token is far from its expiration and must be reused
+		token, _, err = csc.GetGithubAppInstallationToken(ctx, "rs01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if token.Token != "token02" {
+			t.Fatalf("expected token %q, got %q", "token02", token.Token)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if tokensCreated != 2 {
+			t.Fatalf("expected %d tokens created, got %d", 2, tokensCreated)
+		}
+	})
+
+	t.Run("test installation token for non github app remote source", func(t *testing.T) {
+		_, resp, err := csc.GetGithubAppInstallationToken(ctx, "rs02")
+		if err == nil {
+			t.Fatalf("expected error, got nil err")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
+
+func TestTestRemoteSource(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.ah.SetSecretsKey(bytes.Repeat([]byte{1}, 32))
+	})
+	defer teardown()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	privateKey := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	wrongKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	wrongPrivateKey := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(wrongKey)}))
+
+	// fake github api returning the app installation only when authenticated
+	// with the app key
+	ghServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || !strings.HasSuffix(r.URL.Path, "/app/installations/2") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		appToken, err := jwt.ParseWithClaims(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		})
+		if err != nil || appToken.Claims.(*jwt.StandardClaims).Issuer != "1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"message": "Bad credentials"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      2,
+			"account": map[string]interface{}{"login": "org01"},
+		})
+	}))
+	defer ghServer.Close()
+
+	for _, rs := range []*types.RemoteSource{
+		{
+			Name:                    "rs01",
+			APIURL:                  ghServer.URL,
+			Type:                    types.RemoteSourceTypeGithub,
+			AuthType:                types.RemoteSourceAuthTypeGithubApp,
+			GithubAppID:             1,
+			GithubAppInstallationID: 2,
+			GithubAppPrivateKey:     privateKey,
+		},
+		{
+			Name:                    "rs02",
+			APIURL:                  ghServer.URL,
+			Type:                    types.RemoteSourceTypeGithub,
+			AuthType:                types.RemoteSourceAuthTypeGithubApp,
+			GithubAppID:             1,
+			GithubAppInstallationID: 2,
+			GithubAppPrivateKey:     wrongPrivateKey,
+		},
+		{
+			Name:               "rs03",
+			APIURL:             ghServer.URL,
+			Type:               types.RemoteSourceTypeGitea,
+			AuthType:           types.RemoteSourceAuthTypeOauth2,
+			Oauth2ClientID:     "clientid",
+			Oauth2ClientSecret: "clientsecret",
+		},
+	} {
+		if _, err := cs.ah.CreateRemoteSource(ctx, rs); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	t.Run("test github app remote source with valid credentials", func(t *testing.T) {
+		res, _, err := csc.TestRemoteSource(ctx, "rs01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if !res.Success || !res.CredentialsVerified {
+			t.Fatalf("expected successful test with verified credentials, got %s", util.Dump(res))
+		}
+		if !strings.Contains(res.Message, `"org01"`) {
+			t.Fatalf("expected message with the installation account, got %q", res.Message)
+		}
+	})
+
+	t.Run("test github app remote source with wrong credentials", func(t *testing.T) {
+		res, _, err := csc.TestRemoteSource(ctx, "rs02")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if res.Success || !res.CredentialsVerified {
+			t.Fatalf("expected failed test with verified credentials, got %s", util.Dump(res))
+		}
+		if !strings.Contains(res.Message, "401 Bad credentials") {
+			t.Fatalf("expected message with the provider error, got %q", res.Message)
+		}
+		if strings.Contains(res.Message, wrongPrivateKey) {
+			t.Fatalf("expected message without the private key, got %q", res.Message)
+		}
+	})
+
+	t.Run("test oauth2 remote source", func(t *testing.T) {
+		res, _, err := csc.TestRemoteSource(ctx, "rs03")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if !res.Success || res.CredentialsVerified {
+			t.Fatalf("expected successful test without verified credentials, got %s", util.Dump(res))
+		}
+	})
+
+	t.Run("test not existing remote source", func(t *testing.T) {
+		_, resp, err := csc.TestRemoteSource(ctx, "rs04")
+		if err == nil {
+			t.Fatalf("expected error, got nil err")
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+}
+
+func TestGiteaRemoteSource(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	t.Run("test api url normalization", func(t *testing.T) {
+		tests := []struct {
+			apiURL         string
+			expectedAPIURL string
+		}{
+			{"https://gitea01.example.com", "https://gitea01.example.com"},
+			{"https://gitea02.example.com/", "https://gitea02.example.com"},
+			{"https://gitea03.example.com/api/v1", "https://gitea03.example.com"},
+			{"https://gitea04.example.com/api/v1/", "https://gitea04.example.com"},
+			{"http://example.com:3000/gitea05/api/v1", "http://example.com:3000/gitea05"},
+			{"http://example.com/gitea06//", "http://example.com/gitea06"},
+		}
+
+		for i, tt := range tests {
+			rs, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+				Name:     fmt.Sprintf("rs%02d", i),
+				APIURL:   tt.apiURL,
+				Type:     types.RemoteSourceTypeGitea,
+				AuthType: types.RemoteSourceAuthTypeToken,
+			})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if rs.APIURL != tt.expectedAPIURL {
+				t.Fatalf("expected api url %q for %q, got %q", tt.expectedAPIURL, tt.apiURL, rs.APIURL)
+			}
+		}
+	})
+
+	t.Run("test invalid api url", func(t *testing.T) {
+		for _, apiURL := range []string{"https://gitea.example.com/?a=b", "https://gitea.example.com/#a"} {
+			_, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+				Name:     "rsinvalid",
+				APIURL:   apiURL,
+				Type:     types.RemoteSourceTypeGitea,
+				AuthType: types.RemoteSourceAuthTypeToken,
+			})
+			if !util.IsBadRequest(err) {
+				t.Fatalf("expected bad request error for api url %q, got err: %v", apiURL, err)
+			}
+		}
+	})
+
+	t.Run("test token auth type support", func(t *testing.T) {
+		for _, rsType := range []types.RemoteSourceType{types.RemoteSourceTypeGithub, types.RemoteSourceTypeGitlab} {
+			expectedErr := fmt.Sprintf("remotesource type %q doesn't support auth type %q", rsType, types.RemoteSourceAuthTypeToken)
+			_, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+				Name:     "rstoken",
+				APIURL:   "https://example.com",
+				Type:     rsType,
+				AuthType: types.RemoteSourceAuthTypeToken,
+			})
+			if err == nil || err.Error() != expectedErr {
+				t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+			}
+		}
+	})
+
+	t.Run("test invalid remote source type", func(t *testing.T) {
+		expectedErr := `invalid remotesource type "gogs"`
+		_, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+			Name:     "rsgogs",
+			APIURL:   "https://example.com",
+			Type:     "gogs",
+			AuthType: types.RemoteSourceAuthTypeToken,
+		})
+		if err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	if _, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+		Name:               "rsoauth2",
+		APIURL:             "https://gitea.example.com/",
+		Type:               types.RemoteSourceTypeGitea,
+		AuthType:           types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:     "clientid",
+		Oauth2ClientSecret: "clientsecret",
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	t.Run("test remote sources auth type filter", func(t *testing.T) {
+		remoteSources, err := cs.readDB.GetRemoteSources(ctx, "", types.RemoteSourceTypeGitea, types.RemoteSourceAuthTypeToken, 0, true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(remoteSources) != 6 {
+			t.Fatalf("expected %d remote sources, got %d", 6, len(remoteSources))
+		}
+		for _, rs := range remoteSources {
+			if rs.Type != types.RemoteSourceTypeGitea || rs.AuthType != types.RemoteSourceAuthTypeToken {
+				t.Fatalf("unexpected remote source %q type %q, auth type %q", rs.Name, rs.Type, rs.AuthType)
+			}
+		}
+	})
+}
+
+func TestRemoteSourcePatch(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	rs, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+		Name:               "rs01",
+		APIURL:             "https://api.example.com",
+		Type:               types.RemoteSourceTypeGitea,
+		AuthType:           types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:     "clientid",
+		Oauth2ClientSecret: "clientsecret",
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{
+		UserName: "user01",
+		CreateUserLARequest: &action.CreateUserLARequest{
+			RemoteSourceName: "rs01",
+			RemoteUserID:     "1",
+			RemoteUserName:   "user01",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	baseURL := fmt.Sprintf("http://%s/api/v1alpha", cs.c.Web.ListenAddress)
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	t.Run("test create duplicate remote source returns conflict", func(t *testing.T) {
+		_, resp, err := csc.CreateRemoteSource(ctx, &types.RemoteSource{
+			Name:               "rs01",
+			APIURL:             "https://api02.example.com",
+			Type:               types.RemoteSourceTypeGitea,
+			AuthType:           types.RemoteSourceAuthTypeOauth2,
+			Oauth2ClientID:     "clientid",
+			Oauth2ClientSecret: "clientsecret",
+		})
+		if err == nil {
+			t.Fatalf("expected error, got nil err")
+		}
+		if resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected status code %d, got %d", http.StatusConflict, resp.StatusCode)
+		}
+	})
+
+	t.Run("test patch remote source immutable fields", func(t *testing.T) {
+		req, err := http.NewRequest("PATCH", baseURL+"/remotesources/rs01", strings.NewReader(`{"name": "rs02"}`))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("test patch remote source preserves linked accounts", func(t *testing.T) {
+		prs, _, err := csc.PatchRemoteSource(ctx, "rs01", &csapitypes.PatchRemoteSourceRequest{
+			APIURL:             util.StringP("https://api02.example.com"),
+			Oauth2ClientID:     util.StringP("clientid02"),
+			Oauth2ClientSecret: util.StringP("clientsecret02"),
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if prs.ID != rs.ID || prs.Name != rs.Name {
+			t.Fatalf("expected remote source id %q and name %q, got id %q and name %q", rs.ID, rs.Name, prs.ID, prs.Name)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		grs, _, err := csc.GetRemoteSource(ctx, "rs01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if grs.APIURL != "https://api02.example.com" || grs.Oauth2ClientID != "clientid02" || grs.Oauth2ClientSecret != "clientsecret02" {
+			t.Fatalf("remote source not updated: %v", util.Dump(grs))
+		}
+
+		var lauser *types.User
+		err = cs.readDB.Do(ctx, func(tx *db.Tx) error {
+			var err error
+			lauser, err = cs.readDB.GetUserByLinkedAccountRemoteUserIDandSource(tx, "1", grs.ID)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if lauser == nil || lauser.ID != user.ID {
+			t.Fatalf("expected user %q linked to remote source %q", user.ID, grs.Name)
+		}
+	})
+}
+
+func TestRemoteSourceRotateSecret(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	rs, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+		Name:               "rs01",
+		APIURL:             "https://api.example.com",
+		Type:               types.RemoteSourceTypeGitea,
+		AuthType:           types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:     "clientid",
+		Oauth2ClientSecret: "clientsecret",
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+		Name:     "rs02",
+		APIURL:   "https://api.example.com",
+		Type:     types.RemoteSourceTypeGitea,
+		AuthType: types.RemoteSourceAuthTypePassword,
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{
+		UserName: "user01",
+		CreateUserLARequest: &action.CreateUserLARequest{
+			RemoteSourceName:           "rs01",
+			RemoteUserID:               "1",
+			RemoteUserName:             "user01",
+			UserAccessToken:            "accesstoken",
+			Oauth2AccessToken:          "oauth2accesstoken",
+			Oauth2RefreshToken:         "oauth2refreshtoken",
+			Oauth2AccessTokenExpiresAt: time.Now().Add(time.Hour),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	checkLinkedAccount := func(t *testing.T) {
+		lauser, _, err := csc.GetUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff(user.LinkedAccounts, lauser.LinkedAccounts); diff != "" {
+			t.Fatalf("linked accounts changed (-want +got):\n%s", diff)
+		}
+	}
+
+	t.Run("rotate secret", func(t *testing.T) {
+		crs, _, err := csc.GetRemoteSource(ctx, "rs01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		rrs, _, err := csc.RotateRemoteSourceSecret(ctx, "rs01", &csapitypes.RotateRemoteSourceSecretRequest{Oauth2ClientSecret: "clientsecret02"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		// the change must be immediately visible
+		grs, _, err := csc.GetRemoteSource(ctx, "rs01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedRS := *crs
+		expectedRS.Oauth2ClientSecret = "clientsecret02"
+		if diff := cmp.Diff(&expectedRS, rrs); diff != "" {
+			t.Fatalf("rotated remote source mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(&expectedRS, grs); diff != "" {
+			t.Fatalf("remote source mismatch (-want +got):\n%s", diff)
+		}
+		checkLinkedAccount(t)
+	})
+
+	t.Run("rotate secret and client id", func(t *testing.T) {
+		if _, _, err := csc.RotateRemoteSourceSecret(ctx, rs.ID, &csapitypes.RotateRemoteSourceSecretRequest{Oauth2ClientID: util.StringP("clientid03"), Oauth2ClientSecret: "clientsecret03"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		grs, _, err := csc.GetRemoteSource(ctx, "rs01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if grs.ID != rs.ID || grs.Oauth2ClientID != "clientid03" || grs.Oauth2ClientSecret != "clientsecret03" {
+			t.Fatalf("remote source not updated: %v", util.Dump(grs))
+		}
+		checkLinkedAccount(t)
+	})
+
+	t.Run("rotate with wrong requests", func(t *testing.T) {
+		tests := []struct {
+			name               string
+			rsRef              string
+			req                *csapitypes.RotateRemoteSourceSecretRequest
+			expectedStatusCode int
+		}{
+			{
+				name:               "empty secret",
+				rsRef:              "rs01",
+				req:                &csapitypes.RotateRemoteSourceSecretRequest{},
+				expectedStatusCode: http.StatusBadRequest,
+			},
+			{
+				name:               "empty client id",
+				rsRef:              "rs01",
+				req:                &csapitypes.RotateRemoteSourceSecretRequest{Oauth2ClientID: util.StringP(""), Oauth2ClientSecret: "clientsecret04"},
+				expectedStatusCode: http.StatusBadRequest,
+			},
+			{
+				name:               "not oauth2 remote source",
+				rsRef:              "rs02",
+				req:                &csapitypes.RotateRemoteSourceSecretRequest{Oauth2ClientSecret: "clientsecret04"},
+				expectedStatusCode: http.StatusBadRequest,
+			},
+			{
+				name:               "not existing remote source",
+				rsRef:              "rs03",
+				req:                &csapitypes.RotateRemoteSourceSecretRequest{Oauth2ClientSecret: "clientsecret04"},
+				expectedStatusCode: http.StatusNotFound,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, resp, err := csc.RotateRemoteSourceSecret(ctx, tt.rsRef, tt.req)
+				if err == nil {
+					t.Fatalf("expected error, got nil error")
+				}
+				if resp.StatusCode != tt.expectedStatusCode {
+					t.Fatalf("expected status code %d, got %d", tt.expectedStatusCode, resp.StatusCode)
+				}
+			})
+		}
+
+		grs, _, err := csc.GetRemoteSource(ctx, "rs01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if grs.Oauth2ClientSecret != "clientsecret03" {
+			t.Fatalf("expected remote source secret unchanged, got %q", grs.Oauth2ClientSecret)
+		}
+	})
+}
+
+func TestRemoteSourcesList(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	rsTypes := []types.RemoteSourceType{types.RemoteSourceTypeGitea, types.RemoteSourceTypeGithub, types.RemoteSourceTypeGitlab, types.RemoteSourceTypeGithub, types.RemoteSourceTypeGithub}
+	for i, rsType := range rsTypes {
+		if _, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+			Name:               fmt.Sprintf("rs%02d", i+1),
+			APIURL:             "https://api.example.com",
+			Type:               rsType,
+			AuthType:           types.RemoteSourceAuthTypeOauth2,
+			Oauth2ClientID:     "clientid",
+			Oauth2ClientSecret: "clientsecret",
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	h := api.NewRemoteSourcesHandler(logger, cs.readDB)
+
+	linkRegexp := regexp.MustCompile(`^<(.*)>; rel="next"$`)
+
+	// list returns the remote sources names of all the pages starting from u
+	list := func(t *testing.T, u string) ([]string, int) {
+		names := []string{}
+		pages := 0
+		for u != "" {
+			pages++
+			if pages > 10 {
+				t.Fatalf("too many pages")
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected status code: %d, body: %s", w.Code, w.Body.String())
+			}
+			var remoteSources []*types.RemoteSource
+			if err := json.Unmarshal(w.Body.Bytes(), &remoteSources); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if remoteSources == nil {
+				t.Fatalf("expected a json array, got: %s", w.Body.String())
+			}
+			for _, rs := range remoteSources {
+				names = append(names, rs.Name)
+			}
+
+			u = ""
+			if link := w.Header().Get("Link"); link != "" {
+				m := linkRegexp.FindStringSubmatch(link)
+				if m == nil {
+					t.Fatalf("wrong link header %q", link)
+				}
+				u = m[1]
+			}
+		}
+		return names, pages
+	}
+
+	tests := []struct {
+		name          string
+		u             string
+		expectedNames []string
+		expectedPages int
+	}{
+		{
+			name:          "all remote sources",
+			u:             "/remotesources?asc",
+			expectedNames: []string{"rs01", "rs02", "rs03", "rs04", "rs05"},
+			expectedPages: 1,
+		},
+		{
+			name:          "filter by type",
+			u:             "/remotesources?type=gitlab&asc",
+			expectedNames: []string{"rs03"},
+			expectedPages: 1,
+		},
+		{
+			name:          "filter by type paginated",
+			u:             "/remotesources?type=github&limit=2&asc",
+			expectedNames: []string{"rs02", "rs04", "rs05"},
+			expectedPages: 2,
+		},
+		{
+			name:          "filter by type paginated descending",
+			u:             "/remotesources?type=github&limit=2",
+			expectedNames: []string{"rs05", "rs04", "rs02"},
+			expectedPages: 2,
+		},
+		{
+			name:          "unknown type",
+			u:             "/remotesources?type=unknown",
+			expectedNames: []string{},
+			expectedPages: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, pages := list(t, tt.u)
+			if pages != tt.expectedPages {
+				t.Fatalf("expected %d pages, got %d", tt.expectedPages, pages)
+			}
+			if diff := cmp.Diff(tt.expectedNames, names); diff != "" {
+				t.Fatalf("remote sources mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRemoteSourceValidation(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	headRequests := 0
+	var mu sync.Mutex
+	reachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == "HEAD" {
+			headRequests++
+		}
+		// any status code means reachable
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer reachable.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	newRemoteSource := func(name, apiURL string) *types.RemoteSource {
+		return &types.RemoteSource{
+			Name:               name,
+			APIURL:             apiURL,
+			Type:               types.RemoteSourceTypeGitea,
+			AuthType:           types.RemoteSourceAuthTypeOauth2,
+			Oauth2ClientID:     "clientid",
+			Oauth2ClientSecret: "clientsecret",
+		}
+	}
+
+	t.Run("malformed api url", func(t *testing.T) {
+		for _, apiURL := range []string{"api.example.com", "ftp://api.example.com", "https://", "http://[::1"} {
+			_, resp, err := csc.CreateRemoteSource(ctx, newRemoteSource("rs01", apiURL))
+			if err == nil {
+				t.Fatalf("expected error for api url %q, got nil error", apiURL)
+			}
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status code %d for api url %q, got %d", http.StatusBadRequest, apiURL, resp.StatusCode)
+			}
+			expectedErr := fmt.Sprintf("invalid remotesource api url %q", apiURL)
+			if !strings.HasPrefix(err.Error(), expectedErr) {
+				t.Fatalf("expected err %q, got err: %v", expectedErr, err)
+			}
+		}
+	})
+
+	t.Run("reachable api url", func(t *testing.T) {
+		if _, _, err := csc.CreateRemoteSourceValidated(ctx, newRemoteSource("rs01", reachable.URL)); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if headRequests != 1 {
+			t.Fatalf("expected 1 HEAD request, got %d", headRequests)
+		}
+	})
+
+	t.Run("unreachable api url", func(t *testing.T) {
+		_, resp, err := csc.CreateRemoteSourceValidated(ctx, newRemoteSource("rs02", unreachable.URL))
+		if err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		expectedErr := fmt.Sprintf("remotesource api url %q isn't reachable", unreachable.URL)
+		if !strings.HasPrefix(err.Error(), expectedErr) {
+			t.Fatalf("expected err %q, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("reachability check respects the context", func(t *testing.T) {
+		hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer hanging.Close()
+
+		cctx, ccancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		defer ccancel()
+		start := time.Now()
+		if err := cs.ah.CheckRemoteSourceReachable(cctx, newRemoteSource("rs03", hanging.URL)); !util.IsBadRequest(err) {
+			t.Fatalf("expected bad request error, got err: %v", err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Fatalf("reachability check took %s", d)
+		}
+	})
+
+	t.Run("unreachable api url without validation", func(t *testing.T) {
+		if _, _, err := csc.CreateRemoteSource(ctx, newRemoteSource("rs02", unreachable.URL)); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
+
+func TestRemoteSourceLimits(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	if _, _, err := csc.CreateRemoteSource(ctx, &types.RemoteSource{
+		Name:               "rs01",
+		APIURL:             "https://github.example.com",
+		Type:               types.RemoteSourceTypeGithub,
+		AuthType:           types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:     "clientid",
+		Oauth2ClientSecret: "clientsecret",
+		APIRateLimit:       5000,
+		MaxConcurrency:     10,
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, _, err := csc.CreateRemoteSource(ctx, &types.RemoteSource{
+		Name:     "rs02",
+		APIURL:   "https://gitea.example.com",
+		Type:     types.RemoteSourceTypeGitea,
+		AuthType: types.RemoteSourceAuthTypeToken,
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	checkLimits := func(t *testing.T, name string, apiRateLimit, maxConcurrency int) {
+		rs, _, err := csc.GetRemoteSource(ctx, name)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if rs.APIRateLimit != apiRateLimit {
+			t.Fatalf("expected remote source %q api rate limit %d, got %d", name, apiRateLimit, rs.APIRateLimit)
+		}
+		if rs.MaxConcurrency != maxConcurrency {
+			t.Fatalf("expected remote source %q max concurrency %d, got %d", name, maxConcurrency, rs.MaxConcurrency)
+		}
+	}
+
+	t.Run("test limits are persisted", func(t *testing.T) {
+		checkLimits(t, "rs01", 5000, 10)
+		// no limits by default
+		checkLimits(t, "rs02", 0, 0)
+	})
+
+	t.Run("test patch limits", func(t *testing.T) {
+		apiRateLimit := 100
+		maxConcurrency := 2
+		if _, _, err := csc.PatchRemoteSource(ctx, "rs02", &csapitypes.PatchRemoteSourceRequest{APIRateLimit: &apiRateLimit, MaxConcurrency: &maxConcurrency}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		// a zero limit removes it
+		noLimit := 0
+		if _, _, err := csc.PatchRemoteSource(ctx, "rs01", &csapitypes.PatchRemoteSourceRequest{APIRateLimit: &noLimit}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		checkLimits(t, "rs01", 0, 10)
+		checkLimits(t, "rs02", 100, 2)
+	})
+
+	t.Run("test negative limits", func(t *testing.T) {
+		negative := -1
+		expectedErr := "remotesource api rate limit must be greater or equal than 0"
+		_, resp, err := csc.PatchRemoteSource(ctx, "rs01", &csapitypes.PatchRemoteSourceRequest{APIRateLimit: &negative})
+		if err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got err: %v", expectedErr, err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		expectedErr = "remotesource max concurrency must be greater or equal than 0"
+		if _, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+			Name:           "rs03",
+			APIURL:         "https://gitea.example.com",
+			Type:           types.RemoteSourceTypeGitea,
+			AuthType:       types.RemoteSourceAuthTypeToken,
+			MaxConcurrency: -1,
+		}); err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got err: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	checkHealth := func(t *testing.T, expectedReadOnly bool) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/health", cs.c.Web.ListenAddress))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		var health api.HealthResponse
+		if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if health.ReadOnly != expectedReadOnly {
+			t.Fatalf("expected health read only %t, got %t", expectedReadOnly, health.ReadOnly)
+		}
+	}
+
+	if _, _, err := csc.CreateUser(ctx, &csapitypes.CreateUserRequest{UserName: "user01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	checkHealth(t, false)
+
+	if _, err := csc.SetReadOnly(ctx, true); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("test writes are rejected", func(t *testing.T) {
+		checkHealth(t, true)
+
+		expectedErr := "configstore is in read only mode"
+		_, resp, err := csc.CreateUser(ctx, &csapitypes.CreateUserRequest{UserName: "user02"})
+		if err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got err: %v", expectedErr, err)
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+		resp, err = csc.DeleteUser(ctx, "user01")
+		if err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got err: %v", expectedErr, err)
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+	})
+
+	t.Run("test reads are allowed", func(t *testing.T) {
+		if _, _, err := csc.GetUser(ctx, "user01"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		users, _, err := csc.GetUsers(ctx, "", 0, true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(users) != 1 {
+			t.Fatalf("expected %d users, got %d", 1, len(users))
+		}
+	})
+
+	t.Run("test writes are allowed after disabling", func(t *testing.T) {
+		if _, err := csc.SetReadOnly(ctx, false); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		checkHealth(t, false)
+
+		if _, _, err := csc.CreateUser(ctx, &csapitypes.CreateUserRequest{UserName: "user02"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
+
+func TestAuditEntries(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+	actorCtx := csclient.WithActor(ctx, "admin01")
+
+	start := time.Now()
+
+	user, _, err := csc.CreateUser(actorCtx, &csapitypes.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	// a failed operation must not create an audit entry
+	if _, _, err := csc.CreateUser(actorCtx, &csapitypes.CreateUserRequest{UserName: "user01"}); err == nil {
+		t.Fatalf("expected error, got nil err")
+	}
+
+	if _, err := csc.DeleteUser(actorCtx, "user01"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// operations without an actor are recorded with an empty actor
+	if _, _, err := csc.CreateUser(ctx, &csapitypes.CreateUserRequest{UserName: "user02"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	type auditEntry struct {
+		Actor        string
+		Operation    string
+		ResourceType types.ConfigType
+		ResourceID   string
+		Deleted      bool
+	}
+	toAuditEntries := func(entries []*types.AuditEntry) []auditEntry {
+		res := []auditEntry{}
+		for _, e := range entries {
+			if e.Time.Before(start) {
+				t.Fatalf("wrong audit entry time %s", e.Time)
+			}
+			// ignore the user root project group changes
+			if e.ResourceType != types.ConfigTypeUser {
+				continue
+			}
+			res = append(res, auditEntry{Actor: e.Actor, Operation: e.Operation, ResourceType: e.ResourceType, ResourceID: e.ResourceID, Deleted: e.Deleted})
+		}
+		return res
+	}
+
+	t.Run("test audit entries for create and delete", func(t *testing.T) {
+		entries, _, err := csc.GetAuditEntries(ctx, time.Time{}, time.Time{}, "admin01", 0, true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expected := []auditEntry{
+			{Actor: "admin01", Operation: "create_user", ResourceType: types.ConfigTypeUser, ResourceID: user.ID},
+			{Actor: "admin01", Operation: "delete_user", ResourceType: types.ConfigTypeUser, ResourceID: user.ID, Deleted: true},
+		}
+		if diff := cmp.Diff(expected, toAuditEntries(entries)); diff != "" {
+			t.Fatalf("audit entries mismatch (-expected +got):\n%s", diff)
+		}
+	})
+
+	t.Run("test audit entries time range", func(t *testing.T) {
+		entries, _, err := csc.GetAuditEntries(ctx, time.Time{}, start, "", 0, true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("expected no audit entries before %s, got %d", start, len(entries))
+		}
+
+		entries, _, err = csc.GetAuditEntries(ctx, start, time.Now(), "", 0, false)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		got := toAuditEntries(entries)
+		if len(got) != 3 {
+			t.Fatalf("expected %d user audit entries, got %d", 3, len(got))
+		}
+		// newest first
+		if got[0].Operation != "create_user" || got[0].Actor != "" {
+			t.Fatalf("unexpected newest audit entry: %v", got[0])
+		}
+	})
+
+	t.Run("test resource audit entries", func(t *testing.T) {
+		entries, _, err := csc.GetResourceAuditEntries(ctx, types.ConfigTypeUser, user.ID, time.Time{}, time.Time{}, "", 0, false)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expected := []auditEntry{
+			{Actor: "admin01", Operation: "delete_user", ResourceType: types.ConfigTypeUser, ResourceID: user.ID, Deleted: true},
+			{Actor: "admin01", Operation: "create_user", ResourceType: types.ConfigTypeUser, ResourceID: user.ID},
+		}
+		if diff := cmp.Diff(expected, toAuditEntries(entries)); diff != "" {
+			t.Fatalf("audit entries mismatch (-expected +got):\n%s", diff)
+		}
+
+		// a resource type not matching the resource id
+		entries, _, err = csc.GetResourceAuditEntries(ctx, types.ConfigTypeProject, user.ID, time.Time{}, time.Time{}, "", 0, false)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("expected no audit entries, got %d", len(entries))
+		}
+	})
+
+	t.Run("test resource audit entries time range", func(t *testing.T) {
+		all, _, err := csc.GetResourceAuditEntries(ctx, types.ConfigTypeUser, user.ID, time.Time{}, time.Time{}, "", 0, true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(all) != 2 {
+			t.Fatalf("expected %d audit entries, got %d", 2, len(all))
+		}
+
+		// only the delete entry is in the [deletion time, now) range
+		entries, _, err := csc.GetResourceAuditEntries(ctx, types.ConfigTypeUser, user.ID, all[1].Time, time.Now(), "", 0, true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(entries) != 1 || entries[0].ID != all[1].ID {
+			t.Fatalf("expected audit entry %q, got %s", all[1].ID, util.Dump(entries))
+		}
+
+		entries, _, err = csc.GetResourceAuditEntries(ctx, types.ConfigTypeUser, user.ID, time.Time{}, start, "", 0, true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("expected no audit entries before %s, got %d", start, len(entries))
+		}
+	})
+
+	t.Run("test resource audit entries pagination", func(t *testing.T) {
+		entries, resp, err := csc.GetResourceAuditEntries(ctx, types.ConfigTypeUser, user.ID, time.Time{}, time.Time{}, "", 1, false)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(entries) != 1 || entries[0].Operation != "delete_user" {
+			t.Fatalf("unexpected audit entries: %s", util.Dump(entries))
+		}
+		if link := resp.Header.Get("Link"); !strings.Contains(link, "start="+entries[0].ID) {
+			t.Fatalf("expected next link starting after %q, got %q", entries[0].ID, link)
+		}
+
+		entries, resp, err = csc.GetResourceAuditEntries(ctx, types.ConfigTypeUser, user.ID, time.Time{}, time.Time{}, entries[0].ID, 1, false)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(entries) != 1 || entries[0].Operation != "create_user" {
+			t.Fatalf("unexpected audit entries: %s", util.Dump(entries))
+		}
+		if link := resp.Header.Get("Link"); link != "" {
+			t.Fatalf("expected no next link, got %q", link)
+		}
+	})
+}
+
+func TestWebhooks(t *testing.T) {
+	eventsCh := make(chan *csapitypes.ChangeEvent, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get(csapitypes.SignatureHeader) != webhook.Signature([]byte("secret"), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event *csapitypes.ChangeEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		eventsCh <- event
+	}))
+	defer ts.Close()
+
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.c.Webhooks.URLs = []string{ts.URL}
+		cs.c.Webhooks.Secret = "secret"
+	})
+	defer teardown()
+
+	waitEvent := func(t *testing.T) *csapitypes.ChangeEvent {
+		select {
+		case event := <-eventsCh:
+			return event
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for event")
+		}
+		return nil
+	}
+
+	user, err := cs.ah.CreateUser(action.WithActor(ctx, "admin"), &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// the user creation also creates the user root project group
+	events := map[types.ConfigType]*csapitypes.ChangeEvent{}
+	for i := 0; i < 2; i++ {
+		event := waitEvent(t)
+		events[event.Type] = event
+	}
+	event := events[types.ConfigTypeUser]
+	if event == nil {
+		t.Fatalf("expected user event")
+	}
+	if event.Action != csapitypes.ChangeEventActionPut || event.ResourceID != user.ID || event.Operation != "create_user" || event.Actor != "admin" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if events[types.ConfigTypeProjectGroup] == nil {
+		t.Fatalf("expected project group event")
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	if err := cs.ah.DeleteUser(ctx, user.Name, ""); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	event = waitEvent(t)
+	if event.Type != types.ConfigTypeUser || event.Action != csapitypes.ChangeEventActionDelete || event.ResourceID != user.ID || event.Operation != "delete_user" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	// the event id is the id of the audit entry recording the change
+	auditEntryIDs := map[string]struct{}{}
+	err = cs.readDB.Do(ctx, func(tx *db.Tx) error {
+		entries, err := cs.readDB.GetAuditEntries(tx, &readdb.AuditEntriesFilter{}, "", 0, true)
+		for _, entry := range entries {
+			auditEntryIDs[entry.ID] = struct{}{}
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, ok := auditEntryIDs[event.ID]; !ok {
+		t.Fatalf("expected audit entry with id %q", event.ID)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		// the events streams aren't subject to the request timeouts
+		cs.c.RequestTimeout.Read = 1 * time.Second
+	})
+	defer teardown()
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	// readEvents sends the change notifications read from the stream to the
+	// returned channel, closed when the stream ends
+	readEvents := func(t *testing.T, stream io.Reader) <-chan *csapitypes.ChangeNotification {
+		ch := make(chan *csapitypes.ChangeNotification, 10)
+		go func() {
+			defer close(ch)
+			var event string
+			scanner := bufio.NewScanner(stream)
+			for scanner.Scan() {
+				line := scanner.Text()
+				switch {
+				case strings.HasPrefix(line, "event: "):
+					event = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					if event != csapitypes.ChangeEventName {
+						continue
+					}
+					var n *csapitypes.ChangeNotification
+					if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &n); err != nil {
+						return
+					}
+					ch <- n
+				case line == "":
+					event = ""
+				}
+			}
+		}()
+		return ch
+	}
+
+	waitEvent := func(t *testing.T, ch <-chan *csapitypes.ChangeNotification) *csapitypes.ChangeNotification {
+		select {
+		case n, ok := <-ch:
+			if !ok {
+				t.Fatalf("events stream closed")
+			}
+			return n
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for event")
+		}
+		return nil
+	}
+
+	t.Run("test wrong type", func(t *testing.T) {
+		expectedErr := `wrong type "wrongtype"`
+		_, _, err := csc.GetEvents(ctx, []types.ConfigType{types.ConfigTypeUser, "wrongtype"})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	allStream, _, err := csc.GetEvents(ctx, nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer allStream.Close()
+	allEvents := readEvents(t, allStream)
+
+	projectStream, resp, err := csc.GetEvents(ctx, []types.ConfigType{types.ConfigTypeProject})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer projectStream.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("expected content type %q, got %q", "text/event-stream", contentType)
+	}
+	projectEvents := readEvents(t, projectStream)
+
+	// wait more than the request read timeout
+	time.Sleep(2 * time.Second)
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// the user creation also creates the user root project group
+	events := map[types.ConfigType]*csapitypes.ChangeNotification{}
+	for i := 0; i < 2; i++ {
+		n := waitEvent(t, allEvents)
+		events[n.Type] = n
+	}
+	if n := events[types.ConfigTypeUser]; n == nil || n.Action != csapitypes.ChangeEventActionPut || n.ResourceID != user.ID {
+		t.Fatalf("unexpected user event: %+v", n)
+	}
+	if events[types.ConfigTypeProjectGroup] == nil {
+		t.Fatalf("expected project group event")
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	project, err := cs.ah.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectedEvent := &csapitypes.ChangeNotification{Type: types.ConfigTypeProject, Action: csapitypes.ChangeEventActionPut, ResourceID: project.ID}
+	// only the project events are received on the filtered stream
+	if n := waitEvent(t, projectEvents); !reflect.DeepEqual(n, expectedEvent) {
+		t.Fatalf("expected event %+v, got %+v", expectedEvent, n)
+	}
+	if n := waitEvent(t, allEvents); !reflect.DeepEqual(n, expectedEvent) {
+		t.Fatalf("expected event %+v, got %+v", expectedEvent, n)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	if err := cs.ah.DeleteProject(ctx, project.ID, ""); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	expectedEvent = &csapitypes.ChangeNotification{Type: types.ConfigTypeProject, Action: csapitypes.ChangeEventActionDelete, ResourceID: project.ID}
+	if n := waitEvent(t, projectEvents); !reflect.DeepEqual(n, expectedEvent) {
+		t.Fatalf("expected event %+v, got %+v", expectedEvent, n)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	// set the values injected at build time
+	oldVersion, oldCommit, oldBuildDate := cmd.Version, cmd.Commit, cmd.BuildDate
+	defer func() { cmd.Version, cmd.Commit, cmd.BuildDate = oldVersion, oldCommit, oldBuildDate }()
+	cmd.Version = "v0.1.0"
+	cmd.Commit = "8a8b0b2e4f5d0f0c1b36a8c2d6b5e3f2a1c0d9e8"
+	cmd.BuildDate = "2026-01-02T03:04:05Z"
+
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	version, _, err := csc.GetVersion(ctx)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// no data type has schema migrations
+	expectedWalVersions := map[string]int{}
+	for _, dataType := range []types.ConfigType{
+		types.ConfigTypeUser,
+		types.ConfigTypeOrg,
+		types.ConfigTypeOrgMember,
+		types.ConfigTypeProjectGroup,
+		types.ConfigTypeProject,
+		types.ConfigTypeRemoteSource,
+		types.ConfigTypeSecret,
+		types.ConfigTypeVariable,
+		types.ConfigTypeAuditEntry,
+		types.ConfigTypeDeletedResource,
+	} {
+		expectedWalVersions[string(dataType)] = 0
+	}
+	expected := &csapitypes.VersionResponse{
+		Version:     "v0.1.0",
+		Commit:      "8a8b0b2e4f5d0f0c1b36a8c2d6b5e3f2a1c0d9e8",
+		BuildDate:   "2026-01-02T03:04:05Z",
+		APIVersion:  "v1alpha",
+		WalVersions: expectedWalVersions,
+	}
+	if diff := cmp.Diff(expected, version); diff != "" {
+		t.Fatalf("version mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	_, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/v1alpha/openapi.json", cs.c.Web.ListenAddress))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	var doc *openAPIDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if doc.OpenAPI != openAPIVersion {
+		t.Fatalf("expected openapi version %q, got %q", openAPIVersion, doc.OpenAPI)
+	}
+
+	defaultRouter, _ := cs.setupDefaultRouter()
+	defaultRoutes, err := walkAPIRoutes(defaultRouter)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	maintenanceRouter, _ := cs.setupMaintenanceRouter()
+	maintenanceRoutes, err := walkAPIRoutes(maintenanceRouter)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if len(defaultRoutes) == 0 || len(maintenanceRoutes) == 0 {
+		t.Fatalf("expected some api routes")
+	}
+
+	t.Run("test all routes are documented", func(t *testing.T) {
+		for _, route := range defaultRoutes {
+			p := pathVarRegexp.ReplaceAllString(route.path, "{$1}")
+			o, ok := doc.Paths[p][strings.ToLower(route.method)]
+			if !ok {
+				t.Errorf("route %s %s missing from the openapi document", route.method, route.path)
+				continue
+			}
+			if o.Summary == "" {
+				t.Errorf("route %s %s isn't documented", route.method, route.path)
+			}
+		}
+		for _, route := range maintenanceRoutes {
+			if _, ok := apiOperations[apiOperationKey(route.method, route.path)]; !ok {
+				t.Errorf("maintenance route %s %s isn't documented", route.method, route.path)
+			}
+		}
+	})
+
+	t.Run("test all documented operations are registered", func(t *testing.T) {
+		registered := map[string]struct{}{}
+		for _, route := range append(defaultRoutes, maintenanceRoutes...) {
+			registered[apiOperationKey(route.method, route.path)] = struct{}{}
+		}
+		for key := range apiOperations {
+			if _, ok := registered[key]; !ok {
+				t.Errorf("documented operation %q isn't registered", key)
+			}
+		}
+	})
+
+	t.Run("test schemas", func(t *testing.T) {
+		o := doc.Paths["/projects/{projectref}"]["get"]
+		if o == nil {
+			t.Fatalf("missing get project operation")
+		}
+		r, ok := o.Responses[strconv.Itoa(http.StatusOK)]
+		if !ok {
+			t.Fatalf("missing get project response")
+		}
+		ref := r.Content["application/json"].Schema.Ref
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		schema, ok := doc.Components.Schemas[name]
+		if !ok {
+			t.Fatalf("missing schema %q", ref)
+		}
+		for _, prop := range []string{"id", "name", "global_visibility", "parent_path"} {
+			if _, ok := schema.Properties[prop]; !ok {
+				t.Errorf("missing property %q in schema %q", prop, name)
+			}
+		}
+	})
+}
+
+// baselineReadDBStmts is the readdb schema of the first readdb version
+var baselineReadDBStmts = []string{
+	"create table revision (revision bigint, PRIMARY KEY(revision))",
+	"create table committedwalsequence (seq varchar, PRIMARY KEY (seq))",
+	"create table changegrouprevision (id varchar, revision varchar, PRIMARY KEY (id, revision))",
+	"create table projectgroup (id uuid, name varchar, parentid varchar, parenttype varchar, data bytea, PRIMARY KEY (id))",
+	"create index projectgroup_name on projectgroup(name)",
+	"create table project (id uuid, name varchar, parentid varchar, parenttype varchar, data bytea, PRIMARY KEY (id))",
+	"create index project_name on project(name)",
+	"create table user (id uuid, name varchar, data bytea, PRIMARY KEY (id))",
+	"create index user_name on user(name)",
+	"create table user_token (tokenvalue varchar, userid uuid, PRIMARY KEY (tokenvalue, userid))",
+	"create table org (id uuid, name varchar, data bytea, PRIMARY KEY (id))",
+	"create index org_name on org(name)",
+	"create table orgmember (id uuid, orgid uuid, userid uuid, role varchar, data bytea, PRIMARY KEY (id))",
+	"create index orgmember_role on orgmember(role)",
+	"create index orgmember_orgid_userid on orgmember(orgid, userid)",
+	"create table remotesource (id uuid, name varchar, data bytea, PRIMARY KEY (id))",
+	"create table linkedaccount_user (id uuid, remotesourceid uuid, userid uuid, remoteuserid uuid, PRIMARY KEY (id), FOREIGN KEY(userid) REFERENCES user(id))",
+	"create table linkedaccount_project (id uuid, projectid uuid, PRIMARY KEY (id), FOREIGN KEY(projectid) REFERENCES user(id))",
+	"create table secret (id uuid, name varchar, parentid varchar, parenttype varchar, data bytea, PRIMARY KEY (id))",
+	"create index secret_name on secret(name)",
+	"create table variable (id uuid, name varchar, parentid varchar, parenttype varchar, data bytea, PRIMARY KEY (id))",
+	"create index variable_name on variable(name)",
+}
+
+func TestReadDBSchemaUpgrade(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		// a readdb created by the first version
+		rdb, err := db.NewDB(db.Sqlite3, filepath.Join(cs.c.DataDir, "readdb", "db"))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if err := rdb.Create(context.Background(), 1, baselineReadDBStmts); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		rdb.Close()
+	})
+	defer teardown()
+
+	if err := cs.readDB.Degraded(); err != nil {
+		t.Fatalf("unexpected readdb sync err: %v", err)
+	}
+
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+	user, _, err := csc.GetUser(ctx, "user01")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if user.Name != "user01" {
+		t.Fatalf("expected user name %q, got %q", "user01", user.Name)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
+	defer shutdownEtcd(tetcd)
+
+	startConfigstore(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	// write some wals and checkpoint them multiple times so the old data
+	// status and wals will be removed
+	expectedUsers := []string{}
+	for n := 0; n < 5; n++ {
+		for i := 0; i < 5; i++ {
+			userName := fmt.Sprintf("user%d%d", n, i)
+			if _, _, err := csc.CreateUser(ctx, &csapitypes.CreateUserRequest{UserName: userName}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			expectedUsers = append(expectedUsers, userName)
+		}
+
+		waitReadDB(ctx, t, cs)
+
+		if _, err := csc.Checkpoint(ctx); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	userNames := func(cs *Configstore) []string {
+		users, err := getUsers(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		names := []string{}
+		for _, user := range users {
+			names = append(names, user.Name)
+		}
+		return names
+	}
+
+	if diff := cmp.Diff(expectedUsers, userNames(cs)); diff != "" {
+		t.Fatalf("users mismatch (-want +got):\n%s", diff)
+	}
+
+	// the readdb of a new configstore must be populated from the remaining
+	// checkpoints and wals
+	listenAddress, port, err := testutil.GetFreePort(true, false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	csDir2, err := ioutil.TempDir(dir, "cs2")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	cs2Config := *cs.c
+	cs2Config.DataDir = csDir2
+	cs2Config.Web.ListenAddress = net.JoinHostPort(listenAddress, port)
+
+	cs2, err := NewConfigstore(ctx, logger, &cs2Config)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	startConfigstore(ctx, t, cs2)
+	waitReadDB(ctx, t, cs2)
+
+	if diff := cmp.Diff(expectedUsers, userNames(cs2)); diff != "" {
+		t.Fatalf("users mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	users := []*types.User{}
+	for i := 1; i <= 3; i++ {
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: fmt.Sprintf("user0%d", i)})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		users = append(users, user)
+	}
+	if _, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	// checkpoint some of the resources to check them from both the data and
+	// the wals
+	if _, err := csc.Checkpoint(ctx); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user04"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := cs.ah.DeleteUser(ctx, "user03", ""); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	t.Run("test no discrepancies", func(t *testing.T) {
+		res, _, err := csc.SelfCheck(ctx)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(res.Discrepancies) != 0 {
+			t.Fatalf("expected no discrepancies, got: %s", util.Dump(res.Discrepancies))
+		}
+		if res.WalSequence == "" || res.WalSequence < res.DataWalSequence {
+			t.Fatalf("wrong wal sequence %q, data wal sequence %q", res.WalSequence, res.DataWalSequence)
+		}
+	})
+
+	t.Run("test drift detected and repaired", func(t *testing.T) {
+		// change the readdb without updating the wals
+		err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
+			if _, err := tx.Exec("delete from user where id = $1", users[0].ID); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("update user set data = $1 where id = $2", []byte(`{"name": "changed"}`), users[1].ID); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("insert into user (id, name, data) values ($1, $2, $3)", "extrauserid", "extrauser", []byte(`{}`)); err != nil {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		expectedDiscrepancies := []*csapitypes.SelfCheckDiscrepancy{
+			{Type: types.ConfigTypeUser, ID: users[0].ID, Kind: "missing"},
+			{Type: types.ConfigTypeUser, ID: users[1].ID, Kind: "mismatch"},
+			{Type: types.ConfigTypeUser, ID: "extrauserid", Kind: "extra"},
+		}
+		sort.Slice(expectedDiscrepancies, func(i, j int) bool {
+			return expectedDiscrepancies[i].ID < expectedDiscrepancies[j].ID
+		})
+
+		res, _, err := csc.SelfCheck(ctx)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff(expectedDiscrepancies, res.Discrepancies); diff != "" {
+			t.Fatalf("discrepancies mismatch (-want +got):\n%s", diff)
+		}
+		if res.Repairing {
+			t.Fatalf("expected no repair")
+		}
+
+		res, _, err = csc.RepairSelfCheck(ctx)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff(expectedDiscrepancies, res.Discrepancies); diff != "" {
+			t.Fatalf("discrepancies mismatch (-want +got):\n%s", diff)
+		}
+		if !res.Repairing {
+			t.Fatalf("expected repair")
+		}
+
+		// wait for the readdb to be rebuilt
+		for i := 0; i < 60; i++ {
+			res, _, err = csc.SelfCheck(ctx)
+			if err == nil && len(res.Discrepancies) == 0 {
+				break
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(res.Discrepancies) != 0 {
+			t.Fatalf("expected no discrepancies, got: %s", util.Dump(res.Discrepancies))
+		}
+
+		user, _, err := csc.GetUser(ctx, users[0].ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if user.Name != "user01" {
+			t.Fatalf("expected user name %q, got %q", "user01", user.Name)
+		}
+	})
+}
+
+func TestCreateDryRun(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	user, _, err := csc.CreateUser(ctx, &csapitypes.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, _, err := csc.CreateProject(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	committedWalSequence := func() string {
+		var seq string
+		err := cs.readDB.Do(ctx, func(tx *db.Tx) error {
+			var err error
+			seq, err = cs.readDB.GetCommittedWalSequence(tx)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return seq
+	}
+
+	walSequence := committedWalSequence()
+
+	checkNoChanges := func(t *testing.T) {
+		waitReadDB(ctx, t, cs)
+
+		if seq := committedWalSequence(); seq != walSequence {
+			t.Fatalf("expected wal sequence %q, got %q", walSequence, seq)
+		}
+		users, err := getUsers(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(users) != 1 {
+			t.Fatalf("expected 1 user, got %d users", len(users))
+		}
+		projects, err := getProjects(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(projects) != 1 {
+			t.Fatalf("expected 1 project, got %d projects", len(projects))
+		}
+	}
+
+	t.Run("dry run create user", func(t *testing.T) {
+		user, resp, err := csc.CreateUserDryRun(ctx, &csapitypes.CreateUserRequest{UserName: "user02"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if user.Name != "user02" {
+			t.Fatalf("expected user name %q, got %q", "user02", user.Name)
+		}
+
+		checkNoChanges(t)
+	})
+
+	t.Run("dry run create user with duplicate name", func(t *testing.T) {
+		_, resp, err := csc.CreateUserDryRun(ctx, &csapitypes.CreateUserRequest{UserName: "user01"})
+		expectedErr := `user with name "user01" already exists`
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+		// a real create must return the same error
+		_, cresp, cerr := csc.CreateUser(ctx, &csapitypes.CreateUserRequest{UserName: "user01"})
+		if cerr == nil || cerr.Error() != err.Error() || cresp.StatusCode != resp.StatusCode {
+			t.Fatalf("expected same error of real create %v (code: %d), got err: %v (code: %d)", cerr, cresp.StatusCode, err, resp.StatusCode)
+		}
+
+		checkNoChanges(t)
+	})
+
+	t.Run("dry run create project", func(t *testing.T) {
+		project, resp, err := csc.CreateProjectDryRun(ctx, &types.Project{Name: "project02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		expectedPath := path.Join("user", user.Name, "project02")
+		if project.Path != expectedPath {
+			t.Fatalf("expected project path %q, got %q", expectedPath, project.Path)
+		}
+
+		checkNoChanges(t)
+	})
+
+	t.Run("dry run create project with duplicate name", func(t *testing.T) {
+		_, _, err := csc.CreateProjectDryRun(ctx, &types.Project{Name: "project01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", "project01", path.Join("user", user.Name, "project01"))
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		checkNoChanges(t)
+	})
+
+	t.Run("dry run create project with unexistent parent", func(t *testing.T) {
+		_, _, err := csc.CreateProjectDryRun(ctx, &types.Project{Name: "project02", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "unexistentid"}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		expectedErr := `project group with id "unexistentid" doesn't exist`
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		checkNoChanges(t)
+	})
+}
+
+func TestAuth(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.c.Auth.Enabled = true
+		cs.c.Auth.AdminToken = "admintoken"
+	})
+	defer teardown()
+
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	readToken, err := cs.ah.CreateUserToken(ctx, "user01", "readtoken", nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	writeToken, err := cs.ah.CreateUserToken(ctx, "user01", "writetoken", []types.TokenScope{types.TokenScopeWrite})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateUserToken(ctx, "user01", "admintoken", []types.TokenScope{types.TokenScopeAdmin}); err == nil {
+		t.Fatalf("expected error creating an admin token for a not admin user, got nil error")
+	}
+	if _, err := cs.ah.CreateUserToken(ctx, "user01", "badtoken", []types.TokenScope{"bad"}); err == nil {
+		t.Fatalf("expected error creating a token with an invalid scope, got nil error")
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	newClient := func(token string) *csclient.Client {
+		csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+		csc.SetToken(token)
+		return csc
+	}
+
+	checkStatus := func(t *testing.T, resp *http.Response, err error, expectedStatus int) {
+		if expectedStatus/100 == 2 {
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+		} else if err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("expected status code %d, got %d", expectedStatus, resp.StatusCode)
+		}
+	}
+
+	t.Run("request without token is rejected", func(t *testing.T) {
+		_, resp, err := newClient("").GetUser(ctx, "user01")
+		checkStatus(t, resp, err, http.StatusUnauthorized)
+	})
+
+	t.Run("request with invalid token is rejected", func(t *testing.T) {
+		_, resp, err := newClient("invalidtoken").GetUser(ctx, "user01")
+		checkStatus(t, resp, err, http.StatusUnauthorized)
+	})
+
+	t.Run("unscoped token is accepted on read", func(t *testing.T) {
+		user, resp, err := newClient(readToken).GetUser(ctx, "user01")
+		checkStatus(t, resp, err, http.StatusOK)
+		if user.Name != "user01" {
+			t.Fatalf("expected user %q, got %q", "user01", user.Name)
+		}
+	})
+
+	t.Run("unscoped token is rejected on write", func(t *testing.T) {
+		_, resp, err := newClient(readToken).CreateUser(ctx, &csapitypes.CreateUserRequest{UserName: "user03"})
+		checkStatus(t, resp, err, http.StatusForbidden)
+	})
+
+	t.Run("write token is accepted on write", func(t *testing.T) {
+		// the actor is the token user also if another actor is provided
+		_, resp, err := newClient(writeToken).CreateUser(csclient.WithActor(ctx, "user02"), &csapitypes.CreateUserRequest{UserName: "user03"})
+		checkStatus(t, resp, err, http.StatusCreated)
+
+		entries, resp, err := newClient("admintoken").GetAuditEntries(ctx, time.Time{}, time.Time{}, "user01", 0, false)
+		checkStatus(t, resp, err, http.StatusOK)
+		if len(entries) == 0 {
+			t.Fatalf("expected audit entries with actor %q", "user01")
+		}
+		for _, entry := range entries {
+			if entry.Operation != "create_user" {
+				t.Fatalf("unexpected audit entries: %s", util.Dump(entries))
+			}
+		}
+		entries, resp, err = newClient("admintoken").GetAuditEntries(ctx, time.Time{}, time.Time{}, "user02", 0, false)
+		checkStatus(t, resp, err, http.StatusOK)
+		if len(entries) != 0 {
+			t.Fatalf("unexpected audit entries: %s", util.Dump(entries))
+		}
+	})
+
+	t.Run("write token is rejected on admin operations", func(t *testing.T) {
+		resp, err := newClient(writeToken).Checkpoint(ctx)
+		checkStatus(t, resp, err, http.StatusForbidden)
+	})
+
+	t.Run("admin token is accepted on admin operations", func(t *testing.T) {
+		resp, err := newClient("admintoken").Checkpoint(ctx)
+		checkStatus(t, resp, err, http.StatusOK)
+	})
+
+	t.Run("user token cannot create tokens for other users", func(t *testing.T) {
+		_, resp, err := newClient(writeToken).CreateUserToken(ctx, "user02", &csapitypes.CreateUserTokenRequest{TokenName: "token01"})
+		checkStatus(t, resp, err, http.StatusForbidden)
+	})
+
+	t.Run("user token scopes are listed", func(t *testing.T) {
+		tokens, resp, err := newClient(readToken).GetUserTokens(ctx, "user01")
+		checkStatus(t, resp, err, http.StatusOK)
+		expectedTokens := map[string][]types.TokenScope{
+			"readtoken":  nil,
+			"writetoken": {types.TokenScopeWrite},
+		}
+		if len(tokens) != len(expectedTokens) {
+			t.Fatalf("unexpected tokens: %s", util.Dump(tokens))
+		}
+		for _, token := range tokens {
+			if !cmp.Equal(token.Scopes, expectedTokens[token.Name]) {
+				t.Fatalf("unexpected token %q scopes: %v", token.Name, token.Scopes)
+			}
+		}
+	})
+}
+
+func TestAccessDeniedPolicy(t *testing.T) {
+	tests := []struct {
+		policy         config.AccessDeniedPolicy
+		expectedStatus int
+	}{
+		{policy: "", expectedStatus: http.StatusForbidden},
+		{policy: config.AccessDeniedPolicyForbidden, expectedStatus: http.StatusForbidden},
+		{policy: config.AccessDeniedPolicyNotFound, expectedStatus: http.StatusNotFound},
+	}
 
-	variables, err = cs.ah.GetVariables(ctx, types.ConfigTypeProject, path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name), false)
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("policy %q", tt.policy), func(t *testing.T) {
+			ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+				cs.c.Auth.Enabled = true
+				cs.c.Auth.AdminToken = "admintoken"
+				cs.c.Auth.AccessDeniedPolicy = tt.policy
+				cs.ah.SetSoftDelete(true, time.Hour)
+			})
+			defer teardown()
+
+			user01, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			user02, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if _, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPrivate, CreatorUserID: user02.ID}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if _, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org02", Visibility: types.VisibilityPublic, CreatorUserID: user02.ID}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			waitReadDB(ctx, t, cs)
+
+			if _, err := cs.ah.AddOrgMember(ctx, "org02", user01.ID, types.MemberRoleMember); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			newProject := func(parentPath, name string, visibility types.Visibility) *types.Project {
+				return &types.Project{Name: name, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: parentPath}, Visibility: visibility, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
+			}
+			projects := map[string]*types.Project{}
+			for _, p := range []struct {
+				parentPath string
+				name       string
+				visibility types.Visibility
+			}{
+				{parentPath: "user/user01", name: "project01", visibility: types.VisibilityPublic},
+				{parentPath: "user/user02", name: "private01", visibility: types.VisibilityPrivate},
+				{parentPath: "user/user02", name: "public01", visibility: types.VisibilityPublic},
+				{parentPath: "user/user02", name: "deleted01", visibility: types.VisibilityPublic},
+				{parentPath: "org/org02", name: "private01", visibility: types.VisibilityPrivate},
+			} {
+				project, err := cs.ah.CreateProject(ctx, newProject(p.parentPath, p.name, p.visibility))
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				projects[path.Join(p.parentPath, p.name)] = project
+			}
+			if err := cs.ah.DeleteProject(ctx, "user/user02/deleted01", ""); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			user03, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user03"})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if err := cs.ah.DeleteUser(ctx, "user03", ""); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if _, err := cs.ah.CreateRemoteSource(ctx, &types.RemoteSource{
+				Name:               "rs01",
+				APIURL:             "https://api.example.com",
+				Type:               types.RemoteSourceTypeGitea,
+				AuthType:           types.RemoteSourceAuthTypeOauth2,
+				Oauth2ClientID:     "clientid",
+				Oauth2ClientSecret: "clientsecret",
+			}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			writeToken, err := cs.ah.CreateUserToken(ctx, "user01", "writetoken", []types.TokenScope{types.TokenScopeWrite})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			waitReadDB(ctx, t, cs)
+
+			userClient := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+			userClient.SetToken(writeToken)
+			adminClient := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+			adminClient.SetToken("admintoken")
+
+			requests := []struct {
+				name string
+				do   func(csc *csclient.Client) (*http.Response, error)
+				// denied reports if the request is denied to the user token
+				denied bool
+			}{
+				{
+					name: "get user itself",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetUser(ctx, "user01")
+						return resp, err
+					},
+					denied: false,
+				},
+				{
+					name: "get another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetUser(ctx, "user02")
+						return resp, err
+					},
+					denied: true,
+				},
+				{
+					name: "get another user tokens",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetUserTokens(ctx, "user02")
+						return resp, err
+					},
+					denied: true,
+				},
+				{
+					name: "get a private project of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetProject(ctx, "user/user02/private01")
+						return resp, err
+					},
+					denied: true,
+				},
+				{
+					name: "get a public project of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetProject(ctx, "user/user02/public01")
+						return resp, err
+					},
+					denied: false,
+				},
+				{
+					name: "get a private project of an user org",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetProject(ctx, "org/org02/private01")
+						return resp, err
+					},
+					denied: false,
+				},
+				{
+					name: "get a private org",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetOrg(ctx, "org01")
+						return resp, err
+					},
+					denied: true,
+				},
+				{
+					name: "get an user org",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetOrg(ctx, "org02")
+						return resp, err
+					},
+					denied: false,
+				},
+				// the next requests are denied to the user token and executed
+				// last with the admin token since they delete the resources
+				{
+					name: "delete a public project of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						return csc.DeleteProject(ctx, "user/user02/public01")
+					},
+					denied: true,
+				},
+				{
+					name: "delete a project of an org without the owner role",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						return csc.DeleteProject(ctx, "org/org02/private01")
+					},
+					denied: true,
+				},
+				{
+					name:   "delete an org without the owner role",
+					do:     func(csc *csclient.Client) (*http.Response, error) { return csc.DeleteOrg(ctx, "org02") },
+					denied: true,
+				},
+				{
+					name:   "delete another user",
+					do:     func(csc *csclient.Client) (*http.Response, error) { return csc.DeleteUser(ctx, "user02") },
+					denied: true,
+				},
+			}
+
+			for _, req := range requests {
+				resp, err := req.do(userClient)
+				expectedStatus := http.StatusOK
+				if req.denied {
+					expectedStatus = tt.expectedStatus
+				}
+				if resp == nil || resp.StatusCode/100 != expectedStatus/100 || (req.denied && resp.StatusCode != expectedStatus) {
+					t.Fatalf("%s: expected status code %d, got resp: %v, err: %v", req.name, expectedStatus, resp, err)
+				}
+			}
+
+			// the writes of the resources the user isn't allowed to write,
+			// also when it can read them, and the reads of the secrets data
+			// that require the write access. The admin only routes and the
+			// denied parents of the created or moved projects are always
+			// forbidden.
+			public01 := projects["user/user02/public01"]
+			writes := []struct {
+				name string
+				do   func(csc *csclient.Client) (*http.Response, error)
+				// expectedStatus is the expected status when not denied by
+				// the policy
+				expectedStatus int
+			}{
+				{
+					name: "update another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.UpdateUser(ctx, "user02", &csapitypes.UpdateUserRequest{UserName: "user02new"})
+						return resp, err
+					},
+				},
+				{
+					name: "patch another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						name := "user02new"
+						_, resp, err := csc.PatchUser(ctx, "user02", &csapitypes.PatchUserRequest{UserName: &name})
+						return resp, err
+					},
+				},
+				{
+					name: "delete another user by id",
+					do:   func(csc *csclient.Client) (*http.Response, error) { return csc.DeleteUserByID(ctx, user02.ID) },
+				},
+				{
+					name: "restore another deleted user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.RestoreUser(ctx, user03.ID)
+						return resp, err
+					},
+				},
+				{
+					name: "create a linked account of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.CreateUserLA(ctx, "user02", &csapitypes.CreateUserLARequest{RemoteSourceName: "rs01", RemoteUserID: "remoteuser01", RemoteUserName: "remoteuser01"})
+						return resp, err
+					},
+				},
+				{
+					name: "update a linked account of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.UpdateUserLA(ctx, "user02", "la01", &csapitypes.UpdateUserLARequest{RemoteUserID: "remoteuser01"})
+						return resp, err
+					},
+				},
+				{
+					name: "update a linked account token of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.UpdateUserLAToken(ctx, "user02", "la01", &csapitypes.UpdateUserLATokenRequest{UserAccessToken: "token"})
+						return resp, err
+					},
+				},
+				{
+					name: "create a token of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.CreateUserToken(ctx, "user02", &csapitypes.CreateUserTokenRequest{TokenName: "token01"})
+						return resp, err
+					},
+				},
+				{
+					name: "add itself to a private org",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.AddOrgMember(ctx, "org01", "user01", types.MemberRoleOwner)
+						return resp, err
+					},
+				},
+				{
+					name: "add itself as owner of an org without the owner role",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.AddOrgMember(ctx, "org02", "user01", types.MemberRoleOwner)
+						return resp, err
+					},
+				},
+				{
+					name: "update a public project of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.UpdateProject(ctx, "user/user02/public01", newProject("user/user02", "public02", types.VisibilityPublic))
+						return resp, err
+					},
+				},
+				{
+					name: "patch a public project of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						name := "public02"
+						_, resp, err := csc.PatchProject(ctx, "user/user02/public01", &csapitypes.PatchProjectRequest{Name: &name})
+						return resp, err
+					},
+				},
+				{
+					name: "delete a public project of another user by id",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						return csc.DeleteProjectByID(ctx, public01.ID)
+					},
+				},
+				{
+					name: "restore a deleted project of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.RestoreProject(ctx, projects["user/user02/deleted01"].ID)
+						return resp, err
+					},
+				},
+				{
+					name: "move a public project of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.MoveProject(ctx, public01.ID, "user/user01")
+						return resp, err
+					},
+				},
+				{
+					name: "move a project in a project group of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.MoveProject(ctx, projects["user/user01/project01"].ID, "user/user02")
+						return resp, err
+					},
+					expectedStatus: http.StatusForbidden,
+				},
+				{
+					name: "create a project in a project group of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.CreateProject(ctx, newProject("user/user02", "project02", types.VisibilityPublic))
+						return resp, err
+					},
+					expectedStatus: http.StatusForbidden,
+				},
+				{
+					name: "create a project group in a project group of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.CreateProjectGroup(ctx, &types.ProjectGroup{Name: "projectgroup01", Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: "user/user02"}, Visibility: types.VisibilityPublic})
+						return resp, err
+					},
+					expectedStatus: http.StatusForbidden,
+				},
+				{
+					name: "update a public project group of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.UpdateProjectGroup(ctx, "user/user02", &types.ProjectGroup{Parent: types.Parent{Type: types.ConfigTypeUser, ID: user02.ID}, Visibility: types.VisibilityPrivate})
+						return resp, err
+					},
+				},
+				{
+					name: "create a secret in a public project of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.CreateProjectSecret(ctx, "user/user02/public01", &types.Secret{Name: "secret01", Type: types.SecretTypeInternal, Data: map[string]string{"key": "value"}})
+						return resp, err
+					},
+				},
+				{
+					name: "update a secret in a public project group of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.UpdateProjectGroupSecret(ctx, "user/user02", "secret01", &types.Secret{Name: "secret01", Type: types.SecretTypeInternal, Data: map[string]string{"key": "value"}})
+						return resp, err
+					},
+				},
+				{
+					name: "create a variable in a public project of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.CreateProjectVariable(ctx, "user/user02/public01", &types.Variable{Name: "variable01"})
+						return resp, err
+					},
+				},
+				{
+					name: "update a variable in a public project group of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.UpdateProjectGroupVariable(ctx, "user/user02", "variable01", &types.Variable{Name: "variable01"})
+						return resp, err
+					},
+				},
+				{
+					name: "get the secrets of a public project of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetProjectSecrets(ctx, "user/user02/public01", true, false)
+						return resp, err
+					},
+					expectedStatus: http.StatusOK,
+				},
+				{
+					name: "get the secrets data of a public project of another user",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetProjectSecrets(ctx, "user/user02/public01", true, true)
+						return resp, err
+					},
+					expectedStatus: http.StatusForbidden,
+				},
+				{
+					name: "delete projects in bulk",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.DeleteProjects(ctx, &csapitypes.DeleteProjectsRequest{NamePrefix: "public"})
+						return resp, err
+					},
+					expectedStatus: http.StatusForbidden,
+				},
+				{
+					name: "get a remote source",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetRemoteSource(ctx, "rs01")
+						return resp, err
+					},
+					expectedStatus: http.StatusForbidden,
+				},
+				{
+					name: "get the remote sources",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetRemoteSources(ctx, "", 0, true)
+						return resp, err
+					},
+					expectedStatus: http.StatusForbidden,
+				},
+				{
+					name: "create a remote source",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.CreateRemoteSource(ctx, &types.RemoteSource{Name: "rs02"})
+						return resp, err
+					},
+					expectedStatus: http.StatusForbidden,
+				},
+				{
+					name: "update a remote source",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.UpdateRemoteSource(ctx, "rs01", &types.RemoteSource{Name: "rs01"})
+						return resp, err
+					},
+					expectedStatus: http.StatusForbidden,
+				},
+				{
+					name:           "delete a remote source",
+					do:             func(csc *csclient.Client) (*http.Response, error) { return csc.DeleteRemoteSource(ctx, "rs01") },
+					expectedStatus: http.StatusForbidden,
+				},
+				{
+					name: "get a remote source installation token",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.GetGithubAppInstallationToken(ctx, "rs01")
+						return resp, err
+					},
+					expectedStatus: http.StatusForbidden,
+				},
+				{
+					name: "test a remote source",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.TestRemoteSource(ctx, "rs01")
+						return resp, err
+					},
+					expectedStatus: http.StatusForbidden,
+				},
+				{
+					name: "create a project in its project group",
+					do: func(csc *csclient.Client) (*http.Response, error) {
+						_, resp, err := csc.CreateProject(ctx, newProject("user/user01", "project02", types.VisibilityPublic))
+						return resp, err
+					},
+					expectedStatus: http.StatusCreated,
+				},
+			}
+
+			for _, req := range writes {
+				resp, err := req.do(userClient)
+				expectedStatus := req.expectedStatus
+				if expectedStatus == 0 {
+					expectedStatus = tt.expectedStatus
+				}
+				if resp == nil || resp.StatusCode != expectedStatus {
+					t.Fatalf("%s: expected status code %d, got resp: %v, err: %v", req.name, expectedStatus, resp, err)
+				}
+			}
+
+			// a not existing resource is always not found
+			if _, resp, err := userClient.GetUser(ctx, "user04"); resp == nil || resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected status code %d, got resp: %v, err: %v", http.StatusNotFound, resp, err)
+			}
+			if _, resp, err := userClient.GetProject(ctx, "user/user02/notexisting"); resp == nil || resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected status code %d, got resp: %v, err: %v", http.StatusNotFound, resp, err)
+			}
+
+			// the admin token can access all the resources
+			for _, req := range requests {
+				resp, err := req.do(adminClient)
+				if err != nil || resp.StatusCode/100 != 2 {
+					t.Fatalf("%s: expected success with the admin token, got resp: %v, err: %v", req.name, resp, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxAge         time.Duration
+		requestMethod  string
+		requestHeaders string
+		expectedMaxAge string
+		// simple methods aren't returned in the allowed methods
+		expectedAllowedMethod string
+	}{
+		{
+			name:           "test default max age",
+			requestMethod:  "GET",
+			expectedMaxAge: "300",
+		},
+		{
+			name:           "test configured max age",
+			maxAge:         2 * time.Minute,
+			requestMethod:  "GET",
+			expectedMaxAge: "120",
+		},
+		{
+			name:                  "test patch with the default allowed headers",
+			requestMethod:         "PATCH",
+			requestHeaders:        "Content-Type,If-Match,Idempotency-Key,X-Request-Id",
+			expectedMaxAge:        "300",
+			expectedAllowedMethod: "PATCH",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agola")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cs, tetcd := setupConfigstore(ctx, t, logger, dir)
+			defer shutdownEtcd(tetcd)
+
+			cs.c.Web.AllowedOrigins = []string{"https://agola.example.com"}
+			cs.c.Web.MaxAge = tt.maxAge
+
+			startConfigstore(ctx, t, cs)
+
+			req, err := http.NewRequest("OPTIONS", fmt.Sprintf("http://%s/users", cs.c.Web.ListenAddress), nil)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			req.Header.Set("Origin", "https://agola.example.com")
+			req.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+			if tt.requestHeaders != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.requestHeaders)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+			if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "https://agola.example.com" {
+				t.Fatalf("expected allowed origin %q, got %q", "https://agola.example.com", origin)
+			}
+			if maxAge := resp.Header.Get("Access-Control-Max-Age"); maxAge != tt.expectedMaxAge {
+				t.Fatalf("expected max age %q, got %q", tt.expectedMaxAge, maxAge)
+			}
+			if method := resp.Header.Get("Access-Control-Allow-Methods"); method != tt.expectedAllowedMethod {
+				t.Fatalf("expected allowed method %q, got %q", tt.expectedAllowedMethod, method)
+			}
+			if headers := resp.Header.Get("Access-Control-Allow-Headers"); headers != tt.requestHeaders {
+				t.Fatalf("expected allowed headers %q, got %q", tt.requestHeaders, headers)
+			}
+		})
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	if diff := cmp.Diff(variables, []*types.Variable{variable}); diff != "" {
-		t.Error(diff)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the logger must use the configstore log level to check its changes
+	defer level.SetLevel(level.Level())
+	level.SetLevel(zapcore.InfoLevel)
+	core, logs := observer.New(level)
+	logger := zap.New(core)
+
+	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
+	defer shutdownEtcd(tetcd)
+
+	cs.c.Auth.Enabled = true
+	cs.c.Auth.AdminToken = "admintoken"
+
+	startConfigstore(ctx, t, cs)
+
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	writeToken, err := cs.ah.CreateUserToken(ctx, "user01", "writetoken", []types.TokenScope{types.TokenScopeWrite})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	adminClient := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+	adminClient.SetToken("admintoken")
+	writeClient := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+	writeClient.SetToken(writeToken)
+
+	// getUser executes a readdb query logged at debug level and returns the
+	// number of query debug lines emitted
+	getUser := func(t *testing.T) int {
+		logs.TakeAll()
+		if _, _, err := adminClient.GetUser(ctx, "user01"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		n := 0
+		for _, entry := range logs.FilterMessageSnippet("q: ").All() {
+			if entry.Level == zapcore.DebugLevel {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("get log level", func(t *testing.T) {
+		logLevel, _, err := adminClient.GetLogLevel(ctx)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if logLevel.Level != "info" {
+			t.Fatalf("expected log level %q, got %q", "info", logLevel.Level)
+		}
+		if n := getUser(t); n != 0 {
+			t.Fatalf("expected no debug log lines, got %d", n)
+		}
+	})
+
+	t.Run("set log level requires the admin scope", func(t *testing.T) {
+		_, resp, err := writeClient.SetLogLevel(ctx, "debug")
+		if err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected status code %d, got %d", http.StatusForbidden, resp.StatusCode)
+		}
+		if level.Level() != zapcore.InfoLevel {
+			t.Fatalf("expected log level %q, got %q", zapcore.InfoLevel, level.Level())
+		}
+	})
+
+	t.Run("set wrong log level", func(t *testing.T) {
+		_, resp, err := adminClient.SetLogLevel(ctx, "verbose")
+		if err == nil {
+			t.Fatalf("expected error, got nil error")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		if level.Level() != zapcore.InfoLevel {
+			t.Fatalf("expected log level %q, got %q", zapcore.InfoLevel, level.Level())
+		}
+	})
+
+	t.Run("set debug log level", func(t *testing.T) {
+		logLevel, _, err := adminClient.SetLogLevel(ctx, "debug")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if logLevel.Level != "debug" {
+			t.Fatalf("expected log level %q, got %q", "debug", logLevel.Level)
+		}
+		if n := getUser(t); n == 0 {
+			t.Fatalf("expected debug log lines")
+		}
+	})
+
+	t.Run("set back info log level", func(t *testing.T) {
+		if _, _, err := adminClient.SetLogLevel(ctx, "info"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if n := getUser(t); n != 0 {
+			t.Fatalf("expected no debug log lines, got %d", n)
+		}
+	})
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	_, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.c.RequestBodyLimit = config.RequestBodyLimit{MaxSize: 1024, ImportMaxSize: 8192}
+	})
+	defer teardown()
+
+	baseURL := fmt.Sprintf("http://%s/api/v1alpha", cs.c.Web.ListenAddress)
+
+	post := func(t *testing.T, p string, body io.Reader) (*http.Response, *util.APIError) {
+		resp, err := http.Post(baseURL+p, "application/json", body)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < http.StatusBadRequest {
+			return resp, nil
+		}
+		var apiErr *util.APIError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return resp, apiErr
+	}
+
+	oversizedUser := fmt.Sprintf(`{"user_name": "user01", "padding": %q}`, strings.Repeat("a", 2048))
+	expectedErr := &util.APIError{
+		Code:    util.ErrorCodeRequestTooLarge,
+		Message: "request body exceeds the max size of 1024 bytes",
+	}
+
+	t.Run("test oversized body", func(t *testing.T) {
+		resp, apiErr := post(t, "/users", strings.NewReader(oversizedUser))
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("expected status code %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+		}
+		if diff := cmp.Diff(expectedErr, apiErr); diff != "" {
+			t.Fatalf("api error mismatch (-expected +got):\n%s", diff)
+		}
+	})
+
+	t.Run("test oversized body without content length", func(t *testing.T) {
+		// a reader of unknown size is sent with a chunked encoding
+		resp, apiErr := post(t, "/users", io.MultiReader(strings.NewReader(oversizedUser)))
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("expected status code %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+		}
+		if diff := cmp.Diff(expectedErr, apiErr); diff != "" {
+			t.Fatalf("api error mismatch (-expected +got):\n%s", diff)
+		}
+	})
+
+	t.Run("test body within the limit", func(t *testing.T) {
+		resp, apiErr := post(t, "/users", strings.NewReader(`{"user_name": "user01"}`))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d, err: %v", http.StatusCreated, resp.StatusCode, apiErr)
+		}
+	})
+
+	t.Run("test import body bigger than the default limit", func(t *testing.T) {
+		req := []*csapitypes.CreateUserRequest{}
+		for i := 0; i < 100; i++ {
+			req = append(req, &csapitypes.CreateUserRequest{UserName: fmt.Sprintf("importeduser%03d", i)})
+		}
+		reqj, err := json.Marshal(req)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(reqj) <= 1024 {
+			t.Fatalf("expected import body bigger than 1024 bytes, got %d bytes", len(reqj))
+		}
+		resp, apiErr := post(t, "/users/import", bytes.NewReader(reqj))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d, err: %v", http.StatusCreated, resp.StatusCode, apiErr)
+		}
+	})
+}
+
+func TestCount(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.ah.SetSoftDelete(true, time.Hour)
+	})
+	defer teardown()
+
+	reqs := []*action.CreateUserRequest{}
+	for _, userName := range []string{"admin01", "user01", "user02", "user03", "user04"} {
+		reqs = append(reqs, &action.CreateUserRequest{UserName: userName})
+	}
+	users, err := cs.ah.ImportUsers(ctx, reqs)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	projects := []*types.Project{}
+	for i := 0; i < 3; i++ {
+		project, err := cs.ah.CreateProject(ctx, &types.Project{Name: fmt.Sprintf("project%02d", i), Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", users[1].Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		projects = append(projects, project)
+	}
+
+	if err := cs.ah.DeleteUserByID(ctx, users[4].ID, ""); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := cs.ah.DeleteProjectByID(ctx, projects[0].ID, ""); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	waitReadDB(ctx, t, cs)
+
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
+
+	// listLen returns the number of resources returned by the list api
+	listLen := func(t *testing.T, resource string, q url.Values) int {
+		q.Set("limit", "0")
+		resp, err := http.Get(fmt.Sprintf("http://%s/api/v1alpha/%s?%s", cs.c.Web.ListenAddress, resource, q.Encode()))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		var resources []json.RawMessage
+		if err := json.NewDecoder(resp.Body).Decode(&resources); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return len(resources)
 	}
+
+	t.Run("count users", func(t *testing.T) {
+		tests := []struct {
+			query          string
+			includeDeleted bool
+			expected       int
+		}{
+			{expected: 4},
+			{includeDeleted: true, expected: 5},
+			{query: "user", expected: 3},
+			{query: "USER", includeDeleted: true, expected: 4},
+			{query: "admin", expected: 1},
+			{query: "notexisting", expected: 0},
+		}
+
+		for _, tt := range tests {
+			count, _, err := csc.CountUsers(ctx, tt.query, tt.includeDeleted)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if count != tt.expected {
+				t.Fatalf("query %q, includeDeleted %t: expected count %d, got %d", tt.query, tt.includeDeleted, tt.expected, count)
+			}
+			q := url.Values{}
+			if tt.query != "" {
+				q.Set("query", tt.query)
+			}
+			if tt.includeDeleted {
+				q.Set("includeDeleted", "true")
+			}
+			if n := listLen(t, "users", q); n != count {
+				t.Fatalf("query %q, includeDeleted %t: expected count %d equal to the listed users %d", tt.query, tt.includeDeleted, count, n)
+			}
+		}
+	})
+
+	t.Run("count projects", func(t *testing.T) {
+		for includeDeleted, expected := range map[bool]int{false: 2, true: 3} {
+			count, _, err := csc.CountProjects(ctx, includeDeleted)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if count != expected {
+				t.Fatalf("includeDeleted %t: expected count %d, got %d", includeDeleted, expected, count)
+			}
+			q := url.Values{}
+			if includeDeleted {
+				q.Set("includeDeleted", "true")
+			}
+			if n := listLen(t, "projects", q); n != count {
+				t.Fatalf("includeDeleted %t: expected count %d equal to the listed projects %d", includeDeleted, count, n)
+			}
+		}
+	})
+
+	t.Run("count with wrong includeDeleted", func(t *testing.T) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/api/v1alpha/users/count?includeDeleted=wrong", cs.c.Web.ListenAddress))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
 }
 
-func TestOrgMembers(t *testing.T) {
-	dir, err := ioutil.TempDir("", "agola")
+func TestIdempotencyKey(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, func(cs *Configstore) {
+		cs.ah.SetIdempotencyKeyTTL(3 * time.Second)
+	})
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	defer os.RemoveAll(dir)
 
-	ctx := context.Background()
-	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+	waitReadDB(ctx, t, cs)
 
-	cs, tetcd := setupConfigstore(ctx, t, logger, dir)
-	defer shutdownEtcd(tetcd)
+	csc := csclient.NewClient(fmt.Sprintf("http://%s", cs.c.Web.ListenAddress))
 
-	t.Logf("starting cs")
-	go func() { _ = cs.Run(ctx) }()
+	newProject := func(name string) *types.Project {
+		return &types.Project{Name: name, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
+	}
 
-	// TODO(sgotti) change the sleep with a real check that all is ready
-	time.Sleep(2 * time.Second)
+	key01Ctx := csclient.WithIdempotencyKey(ctx, "key01")
 
-	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic, CreatorUserID: user.ID})
+	project01, _, err := csc.CreateProject(key01Ctx, newProject("project01"))
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	// TODO(sgotti) change the sleep with a real check that all is ready
-	time.Sleep(2 * time.Second)
-
-	t.Run("test user org creator is org member with owner role", func(t *testing.T) {
-		expectedResponse := []*action.UserOrgsResponse{
-			{
-				Organization: org,
-				Role:         types.MemberRoleOwner,
-			},
+	t.Run("test retried create returns the same project", func(t *testing.T) {
+		// also a changed request returns the project created by the first one
+		for _, name := range []string{"project01", "project02"} {
+			project, resp, err := csc.CreateProject(key01Ctx, newProject(name))
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("expected status code %d, got %d", http.StatusCreated, resp.StatusCode)
+			}
+			if project.ID != project01.ID {
+				t.Fatalf("expected project id %q, got %q", project01.ID, project.ID)
+			}
 		}
-		res, err := cs.ah.GetUserOrgs(ctx, user.ID)
+	})
+
+	t.Run("test create with a different key creates a new project", func(t *testing.T) {
+		project, _, err := csc.CreateProject(csclient.WithIdempotencyKey(ctx, "key02"), newProject("project02"))
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-		if diff := cmp.Diff(res, expectedResponse); diff != "" {
-			t.Error(diff)
+		if project.ID == project01.ID {
+			t.Fatalf("expected a new project")
+		}
+		if project.Name != "project02" {
+			t.Fatalf("expected project name %q, got %q", "project02", project.Name)
 		}
 	})
 
-	orgs := []*types.Organization{}
-	for i := 0; i < 10; i++ {
-		org, err := cs.ah.CreateOrg(ctx, &types.Organization{Name: fmt.Sprintf("org%d", i), Visibility: types.VisibilityPublic, CreatorUserID: user.ID})
-		if err != nil {
-			t.Fatalf("err: %v", err)
+	t.Run("test create without key isn't idempotent", func(t *testing.T) {
+		if _, resp, err := csc.CreateProject(ctx, newProject("project01")); err == nil || resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected status code %d, got err: %v", http.StatusConflict, err)
 		}
-		orgs = append(orgs, org)
-		time.Sleep(200 * time.Millisecond)
-	}
+	})
 
-	for i := 0; i < 5; i++ {
-		if err := cs.ah.DeleteOrg(ctx, fmt.Sprintf("org%d", i)); err != nil {
-			t.Fatalf("err: %v", err)
+	t.Run("test key used by a different operation", func(t *testing.T) {
+		_, resp, err := csc.CreateOrg(key01Ctx, &types.Organization{Name: "org01", Visibility: types.VisibilityPublic})
+		if err == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got err: %v", http.StatusBadRequest, err)
 		}
-	}
+	})
 
-	// delete some org and check that if also orgmembers aren't yet cleaned only the existing orgs are reported
-	t.Run("test only existing orgs are reported", func(t *testing.T) {
-		expectedResponse := []*action.UserOrgsResponse{
-			{
-				Organization: org,
-				Role:         types.MemberRoleOwner,
-			},
+	t.Run("test concurrent creates with the same key create one project", func(t *testing.T) {
+		key03Ctx := csclient.WithIdempotencyKey(ctx, "key03")
+
+		projects := make([]*csapitypes.Project, 5)
+		errs := make([]error, len(projects))
+		var wg sync.WaitGroup
+		for i := range projects {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				projects[i], _, errs[i] = csc.CreateProject(key03Ctx, newProject("project04"))
+			}(i)
 		}
-		for i := 5; i < 10; i++ {
-			expectedResponse = append(expectedResponse, &action.UserOrgsResponse{
-				Organization: orgs[i],
-				Role:         types.MemberRoleOwner,
-			})
+		wg.Wait()
+
+		for i := range projects {
+			if errs[i] != nil {
+				t.Fatalf("unexpected err: %v", errs[i])
+			}
+			if projects[i].ID != projects[0].ID {
+				t.Fatalf("expected project id %q, got %q", projects[0].ID, projects[i].ID)
+			}
 		}
-		res, err := cs.ah.GetUserOrgs(ctx, user.ID)
+	})
+
+	t.Run("test key used by a different principal", func(t *testing.T) {
+		project, err := cs.ah.CreateProject(action.WithPrincipal(action.WithIdempotencyKey(ctx, "key04"), &action.Principal{UserID: user.ID, UserName: user.Name}), newProject("project05"))
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-		if diff := cmp.Diff(res, expectedResponse); diff != "" {
-			t.Error(diff)
+		otherProject, err := cs.ah.CreateProject(action.WithPrincipal(action.WithIdempotencyKey(ctx, "key04"), &action.Principal{}), newProject("project06"))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if otherProject.ID == project.ID {
+			t.Fatalf("expected a new project")
 		}
 	})
 
-	// TODO(sgotti) change the sleep with a real check that user is in readdb
-	time.Sleep(2 * time.Second)
+	t.Run("test expired key", func(t *testing.T) {
+		time.Sleep(5 * time.Second)
 
+		if _, resp, err := csc.CreateProject(key01Ctx, newProject("project01")); err == nil || resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected status code %d, got err: %v", http.StatusConflict, err)
+		}
+		project, _, err := csc.CreateProject(key01Ctx, newProject("project03"))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if project.ID == project01.ID {
+			t.Fatalf("expected a new project")
+		}
+	})
 }
 
-func TestRemoteSource(t *testing.T) {
-	dir, err := ioutil.TempDir("", "agola")
+func TestFieldsSelection(t *testing.T) {
+	ctx, cs, teardown := setupTestConfigstore(t, nil)
+	defer teardown()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	defer os.RemoveAll(dir)
-
-	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
-
-	tests := []struct {
-		name string
-		f    func(ctx context.Context, t *testing.T, cs *Configstore)
-	}{
-		{
-			name: "test create remote source",
-			f: func(ctx context.Context, t *testing.T, cs *Configstore) {
-				rs := &types.RemoteSource{
-					Name:               "rs01",
-					APIURL:             "https://api.example.com",
-					Type:               types.RemoteSourceTypeGitea,
-					AuthType:           types.RemoteSourceAuthTypeOauth2,
-					Oauth2ClientID:     "clientid",
-					Oauth2ClientSecret: "clientsecret",
-				}
-				_, err := cs.ah.CreateRemoteSource(ctx, rs)
-				if err != nil {
-					t.Fatalf("unexpected err: %v", err)
-				}
-			},
-		},
-		{
-			name: "test create duplicate remote source",
-			f: func(ctx context.Context, t *testing.T, cs *Configstore) {
-				rs := &types.RemoteSource{
-					Name:               "rs01",
-					APIURL:             "https://api.example.com",
-					Type:               types.RemoteSourceTypeGitea,
-					AuthType:           types.RemoteSourceAuthTypeOauth2,
-					Oauth2ClientID:     "clientid",
-					Oauth2ClientSecret: "clientsecret",
-				}
-				rs, err := cs.ah.CreateRemoteSource(ctx, rs)
-				if err != nil {
-					t.Fatalf("unexpected err: %v", err)
-				}
 
-				expectedError := util.NewErrBadRequest(fmt.Errorf(`remotesource "rs01" already exists`))
-				_, err = cs.ah.CreateRemoteSource(ctx, rs)
-				if err.Error() != expectedError.Error() {
-					t.Fatalf("expected err: %v, got err: %v", expectedError.Error(), err.Error())
-				}
-			},
-		},
-		{
-			name: "test rename remote source",
-			f: func(ctx context.Context, t *testing.T, cs *Configstore) {
-				rs := &types.RemoteSource{
-					Name:               "rs01",
-					APIURL:             "https://api.example.com",
-					Type:               types.RemoteSourceTypeGitea,
-					AuthType:           types.RemoteSourceAuthTypeOauth2,
-					Oauth2ClientID:     "clientid",
-					Oauth2ClientSecret: "clientsecret",
-				}
-				rs, err := cs.ah.CreateRemoteSource(ctx, rs)
-				if err != nil {
-					t.Fatalf("unexpected err: %v", err)
-				}
+	waitReadDB(ctx, t, cs)
 
-				rs.Name = "rs02"
-				req := &action.UpdateRemoteSourceRequest{
-					RemoteSourceRef: "rs01",
-					RemoteSource:    rs,
-				}
-				_, err = cs.ah.UpdateRemoteSource(ctx, req)
-				if err != nil {
-					t.Fatalf("unexpected err: %v", err)
-				}
-			},
-		},
-		{
-			name: "test update remote source keeping same name",
-			f: func(ctx context.Context, t *testing.T, cs *Configstore) {
-				rs01 := &types.RemoteSource{
-					Name:               "rs01",
-					APIURL:             "https://api.example.com",
-					Type:               types.RemoteSourceTypeGitea,
-					AuthType:           types.RemoteSourceAuthTypeOauth2,
-					Oauth2ClientID:     "clientid",
-					Oauth2ClientSecret: "clientsecret",
-				}
-				rs01, err := cs.ah.CreateRemoteSource(ctx, rs01)
-				if err != nil {
-					t.Fatalf("unexpected err: %v", err)
-				}
+	for _, name := range []string{"project01", "project02"} {
+		if _, err := cs.ah.CreateProject(ctx, &types.Project{Name: name, Parent: types.Parent{Type: types.ConfigTypeProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
 
-				rs01.APIURL = "https://api01.example.com"
-				req := &action.UpdateRemoteSourceRequest{
-					RemoteSourceRef: "rs01",
-					RemoteSource:    rs01,
-				}
-				_, err = cs.ah.UpdateRemoteSource(ctx, req)
-				if err != nil {
-					t.Fatalf("unexpected err: %v", err)
-				}
-			},
-		},
-		{
-			name: "test rename remote source to an already existing name",
-			f: func(ctx context.Context, t *testing.T, cs *Configstore) {
-				rs01 := &types.RemoteSource{
-					Name:               "rs01",
-					APIURL:             "https://api.example.com",
-					Type:               types.RemoteSourceTypeGitea,
-					AuthType:           types.RemoteSourceAuthTypeOauth2,
-					Oauth2ClientID:     "clientid",
-					Oauth2ClientSecret: "clientsecret",
-				}
-				rs01, err := cs.ah.CreateRemoteSource(ctx, rs01)
-				if err != nil {
-					t.Fatalf("unexpected err: %v", err)
-				}
+	waitReadDB(ctx, t, cs)
 
-				rs02 := &types.RemoteSource{
-					Name:               "rs02",
-					APIURL:             "https://api.example.com",
-					Type:               types.RemoteSourceTypeGitea,
-					AuthType:           types.RemoteSourceAuthTypeOauth2,
-					Oauth2ClientID:     "clientid",
-					Oauth2ClientSecret: "clientsecret",
-				}
-				if _, err = cs.ah.CreateRemoteSource(ctx, rs02); err != nil {
-					t.Fatalf("unexpected err: %v", err)
-				}
+	baseURL := fmt.Sprintf("http://%s/api/v1alpha", cs.c.Web.ListenAddress)
 
-				expectedError := util.NewErrBadRequest(fmt.Errorf(`remotesource "rs02" already exists`))
-				rs01.Name = "rs02"
-				req := &action.UpdateRemoteSourceRequest{
-					RemoteSourceRef: "rs01",
-					RemoteSource:    rs01,
-				}
-				_, err = cs.ah.UpdateRemoteSource(ctx, req)
-				if err.Error() != expectedError.Error() {
-					t.Fatalf("expected err: %v, got err: %v", expectedError.Error(), err.Error())
-				}
-			},
-		},
+	get := func(t *testing.T, p string, expectedStatusCode int, res interface{}) {
+		resp, err := http.Get(baseURL + p)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != expectedStatusCode {
+			t.Fatalf("expected status code %d, got %d", expectedStatusCode, resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			dir, err := ioutil.TempDir(dir, "agola")
-			if err != nil {
-				t.Fatalf("unexpected err: %v", err)
-			}
-			ctx := context.Background()
+	keys := func(obj map[string]json.RawMessage) []string {
+		keys := []string{}
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
 
-			cs, tetcd := setupConfigstore(ctx, t, logger, dir)
-			defer shutdownEtcd(tetcd)
+	t.Run("test get project fields", func(t *testing.T) {
+		var project map[string]json.RawMessage
+		get(t, "/projects/"+url.PathEscape(path.Join("user", user.Name, "project01"))+"?fields=id,name,global_visibility", http.StatusOK, &project)
+		if diff := cmp.Diff([]string{"global_visibility", "id", "name"}, keys(project)); diff != "" {
+			t.Fatalf("project fields mismatch (-want +got):\n%s", diff)
+		}
+		if string(project["name"]) != `"project01"` {
+			t.Fatalf("expected project name %q, got %s", "project01", project["name"])
+		}
+	})
 
-			t.Logf("starting cs")
-			go func() { _ = cs.Run(ctx) }()
+	t.Run("test list projects fields", func(t *testing.T) {
+		var projects []map[string]json.RawMessage
+		get(t, "/projects?asc&fields="+url.QueryEscape("id, name"), http.StatusOK, &projects)
+		if len(projects) != 2 {
+			t.Fatalf("expected 2 projects, got %d", len(projects))
+		}
+		for _, project := range projects {
+			if diff := cmp.Diff([]string{"id", "name"}, keys(project)); diff != "" {
+				t.Fatalf("project fields mismatch (-want +got):\n%s", diff)
+			}
+		}
+	})
 
-			// TODO(sgotti) change the sleep with a real check that all is ready
-			time.Sleep(2 * time.Second)
+	t.Run("test field omitted since empty", func(t *testing.T) {
+		var res map[string]json.RawMessage
+		get(t, "/users/"+user.Name+"?fields=id,linked_accounts", http.StatusOK, &res)
+		if _, ok := res["id"]; !ok {
+			t.Fatalf("expected user id field")
+		}
+		if _, ok := res["secret"]; ok {
+			t.Fatalf("unexpected user secret field")
+		}
+	})
 
-			tt.f(ctx, t, cs)
-		})
-	}
+	t.Run("test invalid fields", func(t *testing.T) {
+		var apiErr *util.APIError
+		get(t, "/projects?fields=id,notexisting,Name,other", http.StatusBadRequest, &apiErr)
+		expected := &util.APIError{
+			Code:    util.ErrorCodeBadRequest,
+			Message: "invalid fields: notexisting, Name, other",
+			Details: []string{"notexisting", "Name", "other"},
+		}
+		if diff := cmp.Diff(expected, apiErr); diff != "" {
+			t.Fatalf("error mismatch (-want +got):\n%s", diff)
+		}
+	})
 }
@@ -0,0 +1,77 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	errors "golang.org/x/xerrors"
+)
+
+// dataDirs returns the configstore data directories
+func dataDirs(dataDir string) []string {
+	return []string{
+		dataDir,
+		filepath.Join(dataDir, "readdb"),
+	}
+}
+
+// setupDataDirs creates the missing data directories with the provided mode
+// and checks that the existing ones are directories owned by the current user
+// and writable. It avoids failing later, in the middle of the run, with less
+// clear errors.
+func setupDataDirs(dataDir string, mode os.FileMode) error {
+	for _, dir := range dataDirs(dataDir) {
+		if err := setupDataDir(dir, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setupDataDir(dir string, mode os.FileMode) error {
+	fi, err := os.Stat(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Errorf("failed to stat data dir %q: %w", dir, err)
+	}
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, mode); err != nil {
+			return errors.Errorf("failed to create data dir %q: %w", dir, err)
+		}
+		log.Infof("created data dir %q", dir)
+		if fi, err = os.Stat(dir); err != nil {
+			return errors.Errorf("failed to stat data dir %q: %w", dir, err)
+		}
+	}
+
+	if !fi.IsDir() {
+		return errors.Errorf("data dir %q isn't a directory", dir)
+	}
+	if uid, ok := fileOwner(fi); ok && uid != os.Geteuid() {
+		return errors.Errorf("data dir %q is owned by uid %d but the configstore is running as uid %d", dir, uid, os.Geteuid())
+	}
+
+	f, err := ioutil.TempFile(dir, ".agola-check-")
+	if err != nil {
+		return errors.Errorf("data dir %q isn't writable: %w", dir, err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return errors.Errorf("data dir %q isn't writable: %w", dir, err)
+	}
+	return nil
+}
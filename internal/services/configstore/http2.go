@@ -0,0 +1,56 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"agola.io/agola/internal/services/config"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	errors "golang.org/x/xerrors"
+)
+
+// setupHTTP2 configures the http server protocols.
+// When http2 is enabled and the server uses tls, http2 is negotiated with
+// ALPN and the clients not supporting it fall back to http/1.1. Without tls the
+// handler also accepts cleartext http2 connections (h2c), both with prior
+// knowledge or upgrading an http/1.1 request.
+// When http2 is disabled only http/1.1 is served.
+func setupHTTP2(srv *http.Server, c *config.HTTP2) error {
+	if !c.Enabled {
+		// a non nil empty map disables the automatic http2 support of the
+		// tls server
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return nil
+	}
+
+	h2s := &http2.Server{
+		MaxConcurrentStreams: c.MaxConcurrentStreams,
+		IdleTimeout:          c.IdleTimeout,
+	}
+
+	if srv.TLSConfig == nil {
+		srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+		return nil
+	}
+
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return errors.Errorf("failed to configure http2: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"agola.io/agola/internal/datamanager"
+	"agola.io/agola/internal/sequence"
+	"agola.io/agola/internal/services/configstore/readdb"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "agola"
+	metricsSubsystem = "configstore"
+)
+
+type metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests        *prometheus.CounterVec
+	httpRequestDuration *prometheus.HistogramVec
+}
+
+func newMetrics(dm *datamanager.DataManager, readDB *readdb.ReadDB) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "http_requests_total",
+			Help:      "Total number of http requests by handler, method and status code.",
+		}, []string{"handler", "method", "code"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of http requests by handler and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"handler", "method"}),
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpRequestDuration,
+		newDataManagerCollector(dm),
+		newReadDBCollector(readDB),
+	)
+
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher since it's used by streaming handlers like
+// the export handler
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// middleware is a mux middleware that records the requests count and duration
+// using the route path template as the handler label
+func (m *metrics) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			handler, _ = route.GetPathTemplate()
+		}
+
+		start := time.Now()
+		rw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rw, r)
+
+		m.httpRequests.WithLabelValues(handler, r.Method, strconv.Itoa(rw.status)).Inc()
+		m.httpRequestDuration.WithLabelValues(handler, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// dataManagerCollector exports the datamanager wal stats
+type dataManagerCollector struct {
+	dm *datamanager.DataManager
+
+	walSequence        *prometheus.Desc
+	pendingWals        *prometheus.Desc
+	lastCheckpointTime *prometheus.Desc
+}
+
+func newDataManagerCollector(dm *datamanager.DataManager) *dataManagerCollector {
+	return &dataManagerCollector{
+		dm: dm,
+		walSequence: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "wal_sequence"),
+			"Counter part of the last received wal sequence.",
+			[]string{"epoch"}, nil,
+		),
+		pendingWals: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "wal_pending"),
+			"Number of wals not yet checkpointed.",
+			nil, nil,
+		),
+		lastCheckpointTime: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "wal_last_checkpoint_timestamp_seconds"),
+			"Unix time of the last checkpoint done by this instance.",
+			nil, nil,
+		),
+	}
+}
+
+func (c *dataManagerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.walSequence
+	ch <- c.pendingWals
+	ch <- c.lastCheckpointTime
+}
+
+func (c *dataManagerCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.dm.Stats()
+
+	if seq, err := sequence.Parse(stats.WalSequence); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.walSequence, prometheus.GaugeValue, float64(seq.C), strconv.FormatUint(seq.Epoch, 10))
+	}
+	ch <- prometheus.MustNewConstMetric(c.pendingWals, prometheus.GaugeValue, float64(stats.PendingWals))
+
+	var lastCheckpointTime float64
+	if !stats.LastCheckpointTime.IsZero() {
+		lastCheckpointTime = float64(stats.LastCheckpointTime.UnixNano()) / 1e9
+	}
+	ch <- prometheus.MustNewConstMetric(c.lastCheckpointTime, prometheus.GaugeValue, lastCheckpointTime)
+}
+
+// readDBCollector exports the readdb cache stats
+type readDBCollector struct {
+	readDB *readdb.ReadDB
+
+	cacheHits    *prometheus.Desc
+	cacheMisses  *prometheus.Desc
+	cacheEntries *prometheus.Desc
+}
+
+func newReadDBCollector(readDB *readdb.ReadDB) *readDBCollector {
+	return &readDBCollector{
+		readDB: readDB,
+		cacheHits: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "readdb_cache_hits_total"),
+			"Total number of readdb cache hits.",
+			nil, nil,
+		),
+		cacheMisses: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "readdb_cache_misses_total"),
+			"Total number of readdb cache misses.",
+			nil, nil,
+		),
+		cacheEntries: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "readdb_cache_entries"),
+			"Number of objects in the readdb cache.",
+			nil, nil,
+		),
+	}
+}
+
+func (c *readDBCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cacheHits
+	ch <- c.cacheMisses
+	ch <- c.cacheEntries
+}
+
+func (c *readDBCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.readDB.CacheStats()
+	// cache disabled
+	if stats == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.cacheHits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(c.cacheMisses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(c.cacheEntries, prometheus.GaugeValue, float64(stats.Entries))
+}
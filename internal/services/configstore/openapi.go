@@ -0,0 +1,452 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/services/configstore/api"
+	"agola.io/agola/internal/util"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+
+	"github.com/gorilla/mux"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	apiBasePath = "/api/v1alpha"
+
+	openAPIVersion = "3.0.3"
+)
+
+// openAPIDocument is an OpenAPI 3 document. Only the fields used to describe
+// the configstore api are defined.
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Servers    []openAPIServer                         `json:"servers"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*jsonSchema `json:"schemas"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary,omitempty"`
+	OperationID string                      `json:"operationId"`
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Schema      *jsonSchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                         `json:"required"`
+	Content  map[string]*openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *jsonSchema `json:"schema"`
+}
+
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties,omitempty"`
+}
+
+// apiParam is a query or header parameter of an api operation
+type apiParam struct {
+	name        string
+	in          string
+	typ         string
+	description string
+	required    bool
+}
+
+func queryParam(name, typ, description string) apiParam {
+	return apiParam{name: name, in: "query", typ: typ, description: description}
+}
+
+var (
+	startParam          = queryParam("start", "string", "the name of the item after which the list starts")
+	limitParam          = queryParam("limit", "integer", "the max number of returned items")
+	ascParam            = queryParam("asc", "boolean", "sort in ascending order")
+	dryRunParam         = queryParam("dryRun", "boolean", "validate the request without applying it")
+	includeDeletedParam = queryParam("includeDeleted", "boolean", "include the soft deleted resources")
+	ignoreMissingParam  = queryParam("ignoreMissing", "boolean", "succeed also if the resource doesn't exist (i.e. on a retried delete)")
+	ifMatchParam        = apiParam{name: "If-Match", in: "header", typ: "string", description: "the expected resource revision (ETag)"}
+	fieldsParam         = queryParam(api.FieldsParam, "string", "the comma separated response fields to return")
+	idempotencyKeyParam = apiParam{name: csapitypes.IdempotencyKeyHeader, in: "header", typ: "string", description: "a retried create request with the same key returns the resource already created"}
+)
+
+// apiOperation documents an api route
+type apiOperation struct {
+	summary string
+	params  []apiParam
+
+	// request is a value of the json request body type, nil when the
+	// operation has no body
+	request interface{}
+	// requestContentType is the content type of a non json request body
+	requestContentType string
+
+	// status is the status code of a successful response
+	status int
+	// response is a value of the json response body type, nil when the
+	// response has no body
+	response interface{}
+	// responseContentType is the content type of a non json response body
+	responseContentType string
+}
+
+func apiOperationKey(method, pathTemplate string) string {
+	return method + " " + pathTemplate
+}
+
+// pathVarRegexp matches the mux path variables
+var pathVarRegexp = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+
+// apiRoute is a route registered in the api router
+type apiRoute struct {
+	method string
+	// path is the route path template relative to the api base path
+	path string
+}
+
+// walkAPIRoutes returns the routes registered in h and in the routers it
+// forwards the requests to with the api base path prefix
+func walkAPIRoutes(h http.Handler) ([]*apiRoute, error) {
+	routes := []*apiRoute{}
+	router, ok := h.(*mux.Router)
+	if !ok {
+		return routes, nil
+	}
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if h := route.GetHandler(); h != nil {
+			subRoutes, err := walkAPIRoutes(h)
+			if err != nil {
+				return err
+			}
+			routes = append(routes, subRoutes...)
+		}
+
+		tpl, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil || !strings.HasPrefix(tpl, apiBasePath+"/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			routes = append(routes, &apiRoute{method: method, path: strings.TrimPrefix(tpl, apiBasePath)})
+		}
+		return nil
+	})
+	return routes, err
+}
+
+// openAPIGenerator generates the OpenAPI document of the routes registered in
+// a router
+type openAPIGenerator struct {
+	schemas map[string]*jsonSchema
+	// names maps the types to their components schema name
+	names map[reflect.Type]string
+}
+
+func newOpenAPIDocument(routes []*apiRoute) *openAPIDocument {
+	g := &openAPIGenerator{
+		schemas: map[string]*jsonSchema{},
+		names:   map[reflect.Type]string{},
+	}
+
+	doc := &openAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info: openAPIInfo{
+			Title:   "Agola configstore API",
+			Version: strings.TrimPrefix(apiBasePath, "/api/"),
+		},
+		Servers:    []openAPIServer{{URL: apiBasePath}},
+		Paths:      map[string]map[string]*openAPIOperation{},
+		Components: openAPIComponents{Schemas: g.schemas},
+	}
+
+	errorSchema := g.schema(reflect.TypeOf(util.APIError{}))
+	for _, route := range routes {
+		p := pathVarRegexp.ReplaceAllString(route.path, "{$1}")
+		if doc.Paths[p] == nil {
+			doc.Paths[p] = map[string]*openAPIOperation{}
+		}
+		op := &openAPIOperation{
+			OperationID: operationID(route.method, p),
+			Responses: map[string]*openAPIResponse{
+				"default": {
+					Description: "error",
+					Content:     map[string]*openAPIMediaType{"application/json": {Schema: errorSchema}},
+				},
+			},
+		}
+		for _, m := range pathVarRegexp.FindAllStringSubmatch(route.path, -1) {
+			op.Parameters = append(op.Parameters, &openAPIParameter{Name: m[1], In: "path", Required: true, Schema: &jsonSchema{Type: "string"}})
+		}
+
+		// an undocumented route is described only by its path parameters
+		if o, ok := apiOperations[apiOperationKey(route.method, route.path)]; ok {
+			g.describeOperation(op, route.method, o)
+		}
+		doc.Paths[p][strings.ToLower(route.method)] = op
+	}
+
+	return doc
+}
+
+func (g *openAPIGenerator) describeOperation(op *openAPIOperation, method string, o *apiOperation) {
+	op.Summary = o.summary
+	params := o.params
+	if method == "GET" && o.responseContentType == "" && o.response != nil && hasObjectItems(reflect.TypeOf(o.response)) {
+		params = append(params, fieldsParam)
+	}
+	for _, p := range params {
+		op.Parameters = append(op.Parameters, &openAPIParameter{Name: p.name, In: p.in, Description: p.description, Required: p.required, Schema: &jsonSchema{Type: p.typ}})
+	}
+
+	if o.request != nil || o.requestContentType != "" {
+		contentType, schema := "application/json", (*jsonSchema)(nil)
+		if o.requestContentType != "" {
+			contentType, schema = o.requestContentType, &jsonSchema{Type: "string", Format: "binary"}
+		} else {
+			schema = g.schema(reflect.TypeOf(o.request))
+		}
+		op.RequestBody = &openAPIRequestBody{
+			Required: true,
+			Content:  map[string]*openAPIMediaType{contentType: {Schema: schema}},
+		}
+	}
+
+	res := &openAPIResponse{Description: http.StatusText(o.status)}
+	switch {
+	case o.responseContentType != "":
+		res.Content = map[string]*openAPIMediaType{o.responseContentType: {Schema: &jsonSchema{Type: "string", Format: "binary"}}}
+	case o.response != nil:
+		res.Content = map[string]*openAPIMediaType{"application/json": {Schema: g.schema(reflect.TypeOf(o.response))}}
+	}
+	op.Responses[strconv.Itoa(o.status)] = res
+}
+
+// hasObjectItems reports if t is a struct or a list of structs, the responses
+// supporting the fields selection
+func hasObjectItems(t reflect.Type) bool {
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// operationID returns an operation id like "getProjectgroupsProjectgroupref"
+func operationID(method, p string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, part := range strings.Split(p, "/") {
+		part = strings.Trim(part, "{}")
+		if part == "" {
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaPrefixes are the prefixes of the components schema names of the types
+// defined in the package, used to avoid names conflicts
+var schemaPrefixes = map[string]string{
+	"agola.io/agola/services/configstore/types":     "",
+	"agola.io/agola/services/configstore/api/types": "API",
+	"agola.io/agola/internal/util":                  "",
+}
+
+func (g *openAPIGenerator) schemaName(t reflect.Type) string {
+	prefix, ok := schemaPrefixes[t.PkgPath()]
+	if !ok {
+		prefix = strings.Title(path.Base(t.PkgPath()))
+	}
+	return prefix + t.Name()
+}
+
+// schema returns the json schema of the json encoding of type t. The named
+// struct types are defined in the components schemas.
+func (g *openAPIGenerator) schema(t reflect.Type) *jsonSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case timeType:
+		return &jsonSchema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &jsonSchema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &jsonSchema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return &jsonSchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &jsonSchema{Type: "string", Format: "byte"}
+		}
+		return &jsonSchema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name, ok := g.names[t]
+		if !ok {
+			name = g.schemaName(t)
+			g.names[t] = name
+			// register it before generating the properties to handle the
+			// recursive types
+			g.schemas[name] = &jsonSchema{}
+			*g.schemas[name] = *g.structSchema(t)
+		}
+		return &jsonSchema{Ref: "#/components/schemas/" + name}
+	default:
+		// interfaces could contain any value
+		return &jsonSchema{}
+	}
+}
+
+func (g *openAPIGenerator) structSchema(t reflect.Type) *jsonSchema {
+	s := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}}
+	g.addProperties(s, t)
+	return s
+}
+
+// addProperties adds the properties of the json encoding of the struct type t
+// to s
+func (g *openAPIGenerator) addProperties(s *jsonSchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		// the fields of an untagged embedded struct are encoded as fields
+		// of the outer struct
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			g.addProperties(s, ft)
+			continue
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = g.schema(f.Type)
+	}
+}
+
+// openAPIHandler serves the OpenAPI document of the api routes registered in
+// router. The document is generated at the first request, when all the routes
+// have been registered.
+type openAPIHandler struct {
+	router *mux.Router
+
+	once sync.Once
+	docj []byte
+	err  error
+}
+
+func newOpenAPIHandler(router *mux.Router) *openAPIHandler {
+	return &openAPIHandler{router: router}
+}
+
+func (h *openAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.once.Do(func() {
+		var routes []*apiRoute
+		routes, h.err = walkAPIRoutes(h.router)
+		if h.err != nil {
+			return
+		}
+		h.docj, h.err = json.Marshal(newOpenAPIDocument(routes))
+	})
+	if h.err != nil {
+		log.Errorf("err: %+v", h.err)
+		api.HTTPError(w, r, errors.Errorf("failed to generate openapi document: %w", h.err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(h.docj)
+}
@@ -0,0 +1,444 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"net/http"
+
+	csapitypes "agola.io/agola/services/configstore/api/types"
+	"agola.io/agola/services/configstore/types"
+)
+
+var (
+	secretsParams = []apiParam{
+		queryParam("tree", "boolean", "also return the secrets of the parent project groups"),
+		queryParam("withdata", "boolean", "return the secrets data, requires the parent write access"),
+	}
+	variablesParams = []apiParam{
+		queryParam("tree", "boolean", "also return the variables of the parent project groups"),
+	}
+	resolvedVariablesParams = []apiParam{
+		queryParam("ref_type", "string", "the run ref type (branch, tag, pullrequest)"),
+		queryParam("branch", "string", "the run branch"),
+		queryParam("tag", "string", "the run tag"),
+		queryParam("ref", "string", "the run git ref"),
+	}
+)
+
+// apiOperations documents the api routes. They are keyed by the route method
+// and path template relative to the api base path.
+// Every registered route must be documented: it's checked by the tests.
+var apiOperations = map[string]*apiOperation{
+	// project groups
+	"GET /projectgroups/{projectgroupref}": {
+		summary: "Get a project group", status: http.StatusOK, response: csapitypes.ProjectGroup{},
+	},
+	"GET /projectgroups/{projectgroupref}/subgroups": {
+		summary: "List the project group subgroups", status: http.StatusOK, response: []*csapitypes.ProjectGroup{},
+	},
+	"GET /projectgroups/{projectgroupref}/projects": {
+		summary: "List the project group projects", status: http.StatusOK, response: []*csapitypes.Project{},
+	},
+	"POST /projectgroups": {
+		summary: "Create a project group",
+		params:  []apiParam{idempotencyKeyParam},
+		request: types.ProjectGroup{}, status: http.StatusCreated, response: csapitypes.ProjectGroup{},
+	},
+	"PUT /projectgroups/{projectgroupref}": {
+		summary: "Update a project group", request: types.ProjectGroup{}, status: http.StatusCreated, response: csapitypes.ProjectGroup{},
+	},
+	"DELETE /projectgroups/{projectgroupref}": {
+		summary: "Delete a project group",
+		params:  []apiParam{queryParam("cascade", "boolean", "also delete the project group children")},
+		status:  http.StatusNoContent,
+	},
+
+	// projects
+	"GET /projects": {
+		summary: "List the projects ordered by name and id or, when the path is provided, get the project with the path and its ancestry",
+		params: []apiParam{
+			startParam, limitParam, ascParam, includeDeletedParam,
+			queryParam("path", "string", "the project path (i.e. org/org01/projectgroup01/project01), the segments containing a slash must be escaped"),
+			queryParam("label", "string", "a label selector in the form key or key=value, can be repeated to match all the selectors"),
+		},
+		status: http.StatusOK, response: []*csapitypes.Project{},
+	},
+	"GET /projects/count": {
+		summary: "Count the projects",
+		params:  []apiParam{includeDeletedParam},
+		status:  http.StatusOK, response: csapitypes.CountResponse{},
+	},
+	"GET /projects/{projectref}": {
+		summary: "Get a project", status: http.StatusOK, response: csapitypes.Project{},
+	},
+	"GET /projects/{projectpath}/available": {
+		summary: "Report if a project with the path (i.e. org/org01/project01) could be created. It's only advisory, the creation always checks the name uniqueness",
+		status:  http.StatusOK, response: csapitypes.NameAvailabilityResponse{},
+	},
+	"POST /projects": {
+		summary: "Create a project",
+		params:  []apiParam{idempotencyKeyParam, dryRunParam},
+		request: types.Project{}, status: http.StatusCreated, response: csapitypes.Project{},
+	},
+	"PUT /projects/{projectref}": {
+		summary: "Update a project",
+		params:  []apiParam{ifMatchParam},
+		request: types.Project{}, status: http.StatusCreated, response: csapitypes.Project{},
+	},
+	"PATCH /projects/{projectref}": {
+		summary: "Update the provided project fields",
+		params:  []apiParam{ifMatchParam},
+		request: csapitypes.PatchProjectRequest{}, status: http.StatusOK, response: csapitypes.Project{},
+	},
+	"DELETE /projects/{projectref}": {
+		summary: "Delete a project",
+		params:  []apiParam{ifMatchParam, ignoreMissingParam},
+		status:  http.StatusNoContent,
+	},
+	"DELETE /projects": {
+		summary: "Delete all the projects matching the filters",
+		params:  []apiParam{queryParam("confirm", "boolean", "must be true to delete the projects")},
+		request: csapitypes.DeleteProjectsRequest{}, status: http.StatusOK, response: csapitypes.DeleteProjectsResponse{},
+	},
+	"DELETE /project/{projectid}": {
+		summary: "Delete a project by id",
+		params:  []apiParam{ifMatchParam, ignoreMissingParam},
+		status:  http.StatusNoContent,
+	},
+	"POST /project/{projectid}/restore": {
+		summary: "Restore a soft deleted project", status: http.StatusOK, response: csapitypes.Project{},
+	},
+	"PATCH /project/{projectid}/move": {
+		summary: "Move a project to another project group",
+		params:  []apiParam{ifMatchParam},
+		request: csapitypes.MoveProjectRequest{}, status: http.StatusOK, response: csapitypes.Project{},
+	},
+
+	// secrets
+	"GET /projectgroups/{projectgroupref}/secrets": {
+		summary: "List the project group secrets", params: secretsParams, status: http.StatusOK, response: []*csapitypes.Secret{},
+	},
+	"GET /projects/{projectref}/secrets": {
+		summary: "List the project secrets", params: secretsParams, status: http.StatusOK, response: []*csapitypes.Secret{},
+	},
+	"POST /projectgroups/{projectgroupref}/secrets": {
+		summary: "Create a project group secret",
+		params:  []apiParam{idempotencyKeyParam},
+		request: types.Secret{}, status: http.StatusCreated, response: types.Secret{},
+	},
+	"POST /projects/{projectref}/secrets": {
+		summary: "Create a project secret",
+		params:  []apiParam{idempotencyKeyParam},
+		request: types.Secret{}, status: http.StatusCreated, response: types.Secret{},
+	},
+	"PUT /projectgroups/{projectgroupref}/secrets/{secretname}": {
+		summary: "Update a project group secret", request: types.Secret{}, status: http.StatusOK, response: types.Secret{},
+	},
+	"PUT /projects/{projectref}/secrets/{secretname}": {
+		summary: "Update a project secret", request: types.Secret{}, status: http.StatusOK, response: types.Secret{},
+	},
+	"DELETE /projectgroups/{projectgroupref}/secrets/{secretname}": {
+		summary: "Delete a project group secret", status: http.StatusNoContent,
+	},
+	"DELETE /projects/{projectref}/secrets/{secretname}": {
+		summary: "Delete a project secret", status: http.StatusNoContent,
+	},
+
+	// variables
+	"GET /projectgroups/{projectgroupref}/variables": {
+		summary: "List the project group variables", params: variablesParams, status: http.StatusOK, response: []*csapitypes.Variable{},
+	},
+	"GET /projects/{projectref}/variables": {
+		summary: "List the project variables", params: variablesParams, status: http.StatusOK, response: []*csapitypes.Variable{},
+	},
+	"GET /projectgroups/{projectgroupref}/resolvedvariables": {
+		summary: "List the project group variables resolved for a run", params: resolvedVariablesParams, status: http.StatusOK, response: []*csapitypes.ResolvedVariable{},
+	},
+	"GET /projects/{projectref}/resolvedvariables": {
+		summary: "List the project variables resolved for a run", params: resolvedVariablesParams, status: http.StatusOK, response: []*csapitypes.ResolvedVariable{},
+	},
+	"POST /projectgroups/{projectgroupref}/variables": {
+		summary: "Create a project group variable",
+		params:  []apiParam{idempotencyKeyParam},
+		request: types.Variable{}, status: http.StatusCreated, response: types.Variable{},
+	},
+	"POST /projects/{projectref}/variables": {
+		summary: "Create a project variable",
+		params:  []apiParam{idempotencyKeyParam},
+		request: types.Variable{}, status: http.StatusCreated, response: types.Variable{},
+	},
+	"PUT /projectgroups/{projectgroupref}/variables/{variablename}": {
+		summary: "Update a project group variable", request: types.Variable{}, status: http.StatusOK, response: types.Variable{},
+	},
+	"PUT /projects/{projectref}/variables/{variablename}": {
+		summary: "Update a project variable", request: types.Variable{}, status: http.StatusOK, response: types.Variable{},
+	},
+	"DELETE /projectgroups/{projectgroupref}/variables/{variablename}": {
+		summary: "Delete a project group variable", status: http.StatusNoContent,
+	},
+	"DELETE /projects/{projectref}/variables/{variablename}": {
+		summary: "Delete a project variable", status: http.StatusNoContent,
+	},
+
+	// users
+	"GET /users/byLinkedAccount": {
+		summary: "Get the user with a linked account of a remote user",
+		params: []apiParam{
+			{name: "remoteSourceId", in: "query", typ: "string", description: "the remote source id", required: true},
+			{name: "remoteUserId", in: "query", typ: "string", description: "the remote user id", required: true},
+		},
+		status: http.StatusOK, response: types.User{},
+	},
+	"GET /users/count": {
+		summary: "Count the users",
+		params: []apiParam{
+			includeDeletedParam,
+			queryParam("query", "string", "count only the users with a name containing it"),
+		},
+		status: http.StatusOK, response: csapitypes.CountResponse{},
+	},
+	"GET /users/{userref}": {
+		summary: "Get a user", status: http.StatusOK, response: types.User{},
+	},
+	"GET /users/{username}/available": {
+		summary: "Report if the user name isn't already used. It's only advisory, the creation always checks the name uniqueness",
+		status:  http.StatusOK, response: csapitypes.NameAvailabilityResponse{},
+	},
+	"GET /users": {
+		summary: "List the users ordered by name and id",
+		params: []apiParam{
+			startParam, limitParam, ascParam, includeDeletedParam,
+			queryParam("query", "string", "return only the users with a name containing it"),
+			queryParam("query_type", "string", "a special query (bytoken, bylinkedaccount, byremoteuser)"),
+			queryParam("token", "string", "the user token of the bytoken query"),
+			queryParam("linkedaccountid", "string", "the linked account id of the bylinkedaccount query"),
+			queryParam("remoteuserid", "string", "the remote user id of the byremoteuser query"),
+			queryParam("remotesourceid", "string", "the remote source id of the byremoteuser query"),
+		},
+		status: http.StatusOK, response: []*types.User{},
+	},
+	"POST /users": {
+		summary: "Create a user",
+		params:  []apiParam{idempotencyKeyParam, dryRunParam},
+		request: csapitypes.CreateUserRequest{}, status: http.StatusCreated, response: types.User{},
+	},
+	"POST /users/import": {
+		summary: "Create many users", request: []*csapitypes.CreateUserRequest{}, status: http.StatusCreated, response: csapitypes.ImportUsersResponse{},
+	},
+	"PUT /users/{userref}": {
+		summary: "Update a user",
+		params:  []apiParam{ifMatchParam},
+		request: csapitypes.UpdateUserRequest{}, status: http.StatusCreated, response: types.User{},
+	},
+	"PATCH /users/{userref}": {
+		summary: "Update the provided user fields",
+		params:  []apiParam{ifMatchParam},
+		request: csapitypes.PatchUserRequest{}, status: http.StatusOK, response: types.User{},
+	},
+	"DELETE /users/{userref}": {
+		summary: "Delete a user",
+		params:  []apiParam{ifMatchParam},
+		status:  http.StatusNoContent,
+	},
+	"DELETE /user/{userid}": {
+		summary: "Delete a user by id",
+		params:  []apiParam{ifMatchParam},
+		status:  http.StatusNoContent,
+	},
+	"POST /user/{userid}/restore": {
+		summary: "Restore a soft deleted user", status: http.StatusOK, response: types.User{},
+	},
+	"GET /users/{userref}/linkedaccounts": {
+		summary: "List the user linked accounts", status: http.StatusOK, response: []*csapitypes.UserLinkedAccount{},
+	},
+	"POST /users/{userref}/linkedaccounts": {
+		summary: "Create a user linked account", request: csapitypes.CreateUserLARequest{}, status: http.StatusCreated, response: types.LinkedAccount{},
+	},
+	"DELETE /users/{userref}/linkedaccounts": {
+		summary: "Delete all the user linked accounts", status: http.StatusOK, response: csapitypes.DeleteUserLAsResponse{},
+	},
+	"DELETE /users/{userref}/linkedaccounts/{laid}": {
+		summary: "Delete a user linked account", status: http.StatusNoContent,
+	},
+	"PUT /users/{userref}/linkedaccounts/{laid}": {
+		summary: "Update a user linked account", request: csapitypes.UpdateUserLARequest{}, status: http.StatusOK, response: types.LinkedAccount{},
+	},
+	"PUT /users/{userref}/linkedaccounts/{laid}/token": {
+		summary: "Update the tokens of a user linked account", request: csapitypes.UpdateUserLATokenRequest{}, status: http.StatusOK, response: csapitypes.UserLinkedAccount{},
+	},
+	"GET /users/{userref}/tokens": {
+		summary: "List the user tokens", status: http.StatusOK, response: []*csapitypes.UserToken{},
+	},
+	"POST /users/{userref}/tokens": {
+		summary: "Create a user token", request: csapitypes.CreateUserTokenRequest{}, status: http.StatusCreated, response: csapitypes.CreateUserTokenResponse{},
+	},
+	"DELETE /users/{userref}/tokens/{tokenname}": {
+		summary: "Delete a user token. Returns 202 when the token is deleted but not yet revoked", status: http.StatusNoContent,
+	},
+	"POST /auth/token/introspect": {
+		summary: "Get the user owning a token, the token scopes and expiration time",
+		request: csapitypes.IntrospectUserTokenRequest{}, status: http.StatusOK, response: csapitypes.UserTokenIntrospection{},
+	},
+	"GET /users/{userref}/orgs": {
+		summary: "List the user organizations", status: http.StatusOK, response: []*csapitypes.UserOrgsResponse{},
+	},
+	"GET /users/{userref}/projects": {
+		summary: "List the projects owned by the user ordered by name and id",
+		params:  []apiParam{startParam, limitParam, ascParam},
+		status:  http.StatusOK, response: []*csapitypes.Project{},
+	},
+
+	// organizations
+	"GET /orgs/{orgref}": {
+		summary: "Get an organization", status: http.StatusOK, response: types.Organization{},
+	},
+	"GET /orgs": {
+		summary: "List the organizations",
+		params:  []apiParam{startParam, limitParam, ascParam},
+		status:  http.StatusOK, response: []*types.Organization{},
+	},
+	"POST /orgs": {
+		summary: "Create an organization",
+		params:  []apiParam{idempotencyKeyParam},
+		request: types.Organization{}, status: http.StatusCreated, response: types.Organization{},
+	},
+	"DELETE /orgs/{orgref}": {
+		summary: "Delete an organization", status: http.StatusNoContent,
+	},
+	"GET /orgs/{orgref}/members": {
+		summary: "List the organization members", status: http.StatusOK, response: []*csapitypes.OrgMemberResponse{},
+	},
+	"GET /orgs/{orgref}/projects": {
+		summary: "List the projects owned by the organization ordered by name and id",
+		params:  []apiParam{startParam, limitParam, ascParam},
+		status:  http.StatusOK, response: []*csapitypes.Project{},
+	},
+	"PUT /orgs/{orgref}/members/{userref}": {
+		summary: "Add a member to an organization or change its role", request: csapitypes.AddOrgMemberRequest{}, status: http.StatusCreated, response: types.OrganizationMember{},
+	},
+	"DELETE /orgs/{orgref}/members/{userref}": {
+		summary: "Remove a member from an organization", status: http.StatusNoContent,
+	},
+
+	// remote sources
+	"GET /remotesources/{remotesourceref}": {
+		summary: "Get a remote source", status: http.StatusOK, response: types.RemoteSource{},
+	},
+	"GET /remotesources": {
+		summary: "List the remote sources ordered by name and id",
+		params:  []apiParam{startParam, limitParam, ascParam, queryParam("type", "string", "return only the remote sources of this type")},
+		status:  http.StatusOK, response: []*types.RemoteSource{},
+	},
+	"POST /remotesources": {
+		summary: "Create a remote source",
+		params:  []apiParam{idempotencyKeyParam, queryParam("validate", "boolean", "also check that the remote source api url is reachable")},
+		request: types.RemoteSource{}, status: http.StatusCreated, response: types.RemoteSource{},
+	},
+	"PUT /remotesources/{remotesourceref}": {
+		summary: "Update a remote source", request: types.RemoteSource{}, status: http.StatusCreated, response: types.RemoteSource{},
+	},
+	"PATCH /remotesources/{remotesourceref}": {
+		summary: "Update the provided remote source fields", request: csapitypes.PatchRemoteSourceRequest{}, status: http.StatusOK, response: types.RemoteSource{},
+	},
+	"POST /remotesources/{remotesourceref}/rotatesecret": {
+		summary: "Replace the remote source oauth2 client secret and optionally its client id",
+		request: csapitypes.RotateRemoteSourceSecretRequest{}, status: http.StatusOK, response: types.RemoteSource{},
+	},
+	"DELETE /remotesources/{remotesourceref}": {
+		summary: "Delete a remote source", status: http.StatusNoContent,
+	},
+	"GET /remotesources/{remotesourceref}/installationtoken": {
+		summary: "Get a github app installation token", status: http.StatusOK, response: csapitypes.GithubAppInstallationTokenResponse{},
+	},
+	"POST /remotesources/{remotesourceref}/test": {
+		summary: "Test the remote source connectivity and, when possible, its credentials. A failed test is reported in the response",
+		status:  http.StatusOK, response: csapitypes.TestRemoteSourceResponse{},
+	},
+
+	// search
+	"GET /search": {
+		summary: "Search the projects, users and remote sources by name",
+		params: []apiParam{
+			queryParam("q", "string", "the term contained in the returned resources names"),
+			queryParam("limit", "integer", "the max number of returned items for every resource type"),
+		},
+		status: http.StatusOK, response: csapitypes.SearchResponse{},
+	},
+
+	// administration
+	"PUT /maintenance": {
+		summary: "Enable the maintenance mode", status: http.StatusOK,
+	},
+	"DELETE /maintenance": {
+		summary: "Disable the maintenance mode", status: http.StatusOK,
+	},
+	"GET /export": {
+		summary: "Export the configstore data", status: http.StatusOK, responseContentType: "application/octet-stream",
+	},
+	"POST /import": {
+		summary: "Import the configstore data in maintenance mode", requestContentType: "application/octet-stream", status: http.StatusOK,
+	},
+	"POST /checkpoint": {
+		summary: "Checkpoint the wals", status: http.StatusOK,
+	},
+	"GET /audit": {
+		summary: "List the audit entries ordered by time and id",
+		params: []apiParam{
+			queryParam("start", "string", "the id of the audit entry after which the list starts"),
+			limitParam, ascParam,
+			queryParam("since", "string", "return the entries from this RFC3339 time"),
+			queryParam("until", "string", "return the entries before this RFC3339 time"),
+			queryParam("actor", "string", "return only the entries of this actor"),
+			queryParam("resourceType", "string", "return only the entries of this resource type"),
+			queryParam("resourceId", "string", "return only the entries of the resource with this id"),
+		},
+		status: http.StatusOK, response: []*types.AuditEntry{},
+	},
+	"GET /events": {
+		summary: "Stream the resource changes as server-sent events of ChangeNotification data",
+		params:  []apiParam{queryParam("type", "string", "stream only the changes of these resource types")},
+		status:  http.StatusOK, responseContentType: "text/event-stream",
+	},
+	"GET /admin/loglevel": {
+		summary: "Get the log level", status: http.StatusOK, response: csapitypes.LogLevel{},
+	},
+	"PUT /admin/loglevel": {
+		summary: "Change the log level", request: csapitypes.LogLevel{}, status: http.StatusOK, response: csapitypes.LogLevel{},
+	},
+	"PUT /admin/readonly": {
+		summary: "Enable the read only mode", status: http.StatusOK,
+	},
+	"DELETE /admin/readonly": {
+		summary: "Disable the read only mode", status: http.StatusOK,
+	},
+	"GET /admin/export": {
+		summary: "Export the resources as newline delimited json", status: http.StatusOK, responseContentType: "application/x-ndjson",
+	},
+	"POST /admin/import": {
+		summary: "Import a resources export in an empty configstore", requestContentType: "application/x-ndjson", status: http.StatusOK,
+	},
+	"GET /admin/selfcheck": {
+		summary: "Check that the readdb reflects the data and the wals", status: http.StatusOK, response: csapitypes.SelfCheckResponse{},
+	},
+	"POST /admin/selfcheck/repair": {
+		summary: "Check the readdb and rebuild it when there're discrepancies", status: http.StatusOK, response: csapitypes.SelfCheckResponse{},
+	},
+	"GET /version": {
+		summary: "Get the configstore build version and the supported api and wal versions", status: http.StatusOK, response: csapitypes.VersionResponse{},
+	},
+	"GET /openapi.json": {
+		summary: "Get the OpenAPI document of the api", status: http.StatusOK, response: map[string]interface{}{},
+	},
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/internal/services/configstore/api"
+	"agola.io/agola/internal/util"
+
+	"golang.org/x/time/rate"
+	errors "golang.org/x/xerrors"
+)
+
+const DefaultRateLimitIdleTimeout = 10 * time.Minute
+
+type rateLimitBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter is a token bucket rate limiter keyed by the request bearer token
+// when it authenticates or else by the client ip, so random tokens cannot be
+// used to bypass the client ip limit.
+// The bucket of a key without requests for more than idleTimeout is removed
+// so one off clients won't be kept in memory.
+type rateLimiter struct {
+	token       config.RateLimitRule
+	ip          config.RateLimitRule
+	idleTimeout time.Duration
+	// auth authenticates the request tokens, nil when the api authentication
+	// is disabled and all the requests are keyed by client ip
+	auth *authHandler
+
+	// now is replaced in tests
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*rateLimitBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(c *config.RateLimit, auth *authHandler) *rateLimiter {
+	idleTimeout := c.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultRateLimitIdleTimeout
+	}
+	return &rateLimiter{
+		token:       c.Token,
+		ip:          c.IP,
+		idleTimeout: idleTimeout,
+		auth:        auth,
+		now:         time.Now,
+		buckets:     map[string]*rateLimitBucket{},
+	}
+}
+
+func newLimiter(rule config.RateLimitRule) *rate.Limiter {
+	burst := rule.Burst
+	if burst == 0 {
+		burst = int(math.Ceil(rule.RequestsPerSecond))
+	}
+	return rate.NewLimiter(rate.Limit(rule.RequestsPerSecond), burst)
+}
+
+// requestKey returns the rate limit key of the request and its rule. The
+// token is hashed to not keep it in memory.
+func (l *rateLimiter) requestKey(r *http.Request) (string, config.RateLimitRule) {
+	if token := bearerToken(r); token != "" && l.auth != nil {
+		if _, err := l.auth.authenticate(r.Context(), token); err == nil {
+			return "token-" + util.EncodeSha256Hex(token), l.token
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip-" + host, l.ip
+}
+
+// allow reports if a request for key is allowed or the time to wait before
+// the next allowed request
+func (l *rateLimiter) allow(key string, rule config.RateLimitRule) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= l.idleTimeout {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateLimitBucket{limiter: newLimiter(rule)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	res := b.limiter.ReserveN(now, 1)
+	if !res.OK() {
+		return false, l.idleTimeout
+	}
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// sweep removes the idle buckets
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) >= l.idleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// middleware is a mux middleware that rejects the requests exceeding the rate
+// limit with a 429 status code and a Retry-After header
+func (l *rateLimiter) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, rule := l.requestKey(r)
+		if ok, delay := l.allow(key, rule); !ok {
+			retryAfter := int(math.Ceil(delay.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			api.HTTPError(w, r, util.NewErrTooManyRequests(errors.Errorf("rate limit exceeded, retry after %d seconds", retryAfter)))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
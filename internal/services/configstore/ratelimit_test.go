@@ -0,0 +1,147 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/internal/util"
+)
+
+func TestRateLimit(t *testing.T) {
+	l := newRateLimiter(&config.RateLimit{
+		Enabled:     true,
+		Token:       config.RateLimitRule{RequestsPerSecond: 1, Burst: 2},
+		IP:          config.RateLimitRule{RequestsPerSecond: 0.5},
+		IdleTimeout: 1 * time.Minute,
+	}, newAuthHandler(&adminTokenAuthenticator{token: "token01"}, &adminTokenAuthenticator{token: "token02"}))
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	h := l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	doRequest := func(token, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1alpha/users", nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	checkAllowed := func(t *testing.T, w *httptest.ResponseRecorder) {
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+
+	checkThrottled := func(t *testing.T, w *httptest.ResponseRecorder, expectedRetryAfter string) {
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status code %d, got %d", http.StatusTooManyRequests, w.Code)
+		}
+		if retryAfter := w.Header().Get("Retry-After"); retryAfter != expectedRetryAfter {
+			t.Fatalf("expected Retry-After %q, got %q", expectedRetryAfter, retryAfter)
+		}
+		var apiErr util.APIError
+		if err := json.Unmarshal(w.Body.Bytes(), &apiErr); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if apiErr.Code != util.ErrorCodeTooManyRequests {
+			t.Fatalf("expected error code %q, got %q", util.ErrorCodeTooManyRequests, apiErr.Code)
+		}
+	}
+
+	t.Run("token over its limit is throttled and then recovers", func(t *testing.T) {
+		checkAllowed(t, doRequest("token01", "192.168.0.1:1000"))
+		checkAllowed(t, doRequest("token01", "192.168.0.1:1000"))
+		checkThrottled(t, doRequest("token01", "192.168.0.1:1000"), "1")
+
+		// another token isn't throttled
+		checkAllowed(t, doRequest("token02", "192.168.0.1:1000"))
+
+		now = now.Add(1 * time.Second)
+		checkAllowed(t, doRequest("token01", "192.168.0.1:1000"))
+		checkThrottled(t, doRequest("token01", "192.168.0.1:1000"), "1")
+	})
+
+	t.Run("client ip over its limit is throttled and then recovers", func(t *testing.T) {
+		checkAllowed(t, doRequest("", "192.168.0.1:1000"))
+		// a different port is the same client
+		checkThrottled(t, doRequest("", "192.168.0.1:1001"), "2")
+
+		// another ip isn't throttled
+		checkAllowed(t, doRequest("", "192.168.0.2:1000"))
+
+		now = now.Add(2 * time.Second)
+		checkAllowed(t, doRequest("", "192.168.0.1:1000"))
+	})
+
+	t.Run("not authenticating tokens are limited by client ip", func(t *testing.T) {
+		now = now.Add(2 * time.Second)
+		checkAllowed(t, doRequest("invalidtoken01", "192.168.0.4:1000"))
+		checkThrottled(t, doRequest("invalidtoken02", "192.168.0.4:1000"), "2")
+		checkThrottled(t, doRequest("", "192.168.0.4:1000"), "2")
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, token := range []string{"invalidtoken01", "invalidtoken02"} {
+			if _, ok := l.buckets["token-"+util.EncodeSha256Hex(token)]; ok {
+				t.Fatalf("unexpected bucket of not authenticating token %q", token)
+			}
+		}
+	})
+
+	t.Run("tokens aren't validated when the authentication is disabled", func(t *testing.T) {
+		l := newRateLimiter(&config.RateLimit{
+			Enabled: true,
+			Token:   config.RateLimitRule{RequestsPerSecond: 1, Burst: 2},
+			IP:      config.RateLimitRule{RequestsPerSecond: 0.5},
+		}, nil)
+		l.now = func() time.Time { return now }
+		h := l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		for i, expectedStatus := range []int{http.StatusOK, http.StatusTooManyRequests} {
+			req := httptest.NewRequest("GET", "/api/v1alpha/users", nil)
+			req.RemoteAddr = "192.168.0.5:1000"
+			req.Header.Set("Authorization", "Bearer token01")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != expectedStatus {
+				t.Fatalf("request %d: expected status code %d, got %d", i, expectedStatus, w.Code)
+			}
+		}
+	})
+
+	t.Run("idle buckets are removed", func(t *testing.T) {
+		now = now.Add(1 * time.Minute)
+		checkAllowed(t, doRequest("", "192.168.0.3:1000"))
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if len(l.buckets) != 1 {
+			t.Fatalf("expected 1 bucket, got %d buckets", len(l.buckets))
+		}
+	})
+}
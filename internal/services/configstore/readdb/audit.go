@@ -0,0 +1,163 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readdb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"agola.io/agola/internal/db"
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/configstore/types"
+
+	sq "github.com/Masterminds/squirrel"
+	errors "golang.org/x/xerrors"
+)
+
+var (
+	auditEntryInsert = sb.Insert("auditentry").Columns("id", "time", "actor", "resourcetype", "resourceid", "data")
+)
+
+func (r *ReadDB) insertAuditEntry(tx *db.Tx, data []byte) error {
+	entry := types.AuditEntry{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return errors.Errorf("failed to unmarshal audit entry: %w", err)
+	}
+	// poor man insert or update...
+	if err := r.deleteAuditEntry(tx, entry.ID); err != nil {
+		return err
+	}
+	q, args, err := auditEntryInsert.Values(entry.ID, entry.Time.UnixNano(), entry.Actor, entry.ResourceType, entry.ResourceID, data).ToSql()
+	if err != nil {
+		return errors.Errorf("failed to build query: %w", err)
+	}
+	if _, err = tx.Exec(q, args...); err != nil {
+		return errors.Errorf("failed to insert audit entry: %w", err)
+	}
+
+	return nil
+}
+
+func (r *ReadDB) deleteAuditEntry(tx *db.Tx, id string) error {
+	if _, err := tx.Exec("delete from auditentry where id = $1", id); err != nil {
+		return errors.Errorf("failed to delete audit entry: %w", err)
+	}
+	return nil
+}
+
+// AuditEntriesFilter defines the audit entries returned by GetAuditEntries.
+// The zero values aren't used as filters.
+type AuditEntriesFilter struct {
+	// Since and Until define the [Since, Until) time range
+	Since time.Time
+	Until time.Time
+
+	Actor        string
+	ResourceType types.ConfigType
+	ResourceID   string
+}
+
+// GetAuditEntries returns the audit entries matching the filter ordered by
+// time and id, starting after the audit entry with id startID (when not
+// empty).
+func (r *ReadDB) GetAuditEntries(tx *db.Tx, filter *AuditEntriesFilter, startID string, limit int, asc bool) ([]*types.AuditEntry, error) {
+	s := sb.Select("id", "data").From("auditentry")
+	if asc {
+		s = s.OrderBy("time asc", "id asc")
+	} else {
+		s = s.OrderBy("time desc", "id desc")
+	}
+	if !filter.Since.IsZero() {
+		s = s.Where(sq.GtOrEq{"time": filter.Since.UnixNano()})
+	}
+	if !filter.Until.IsZero() {
+		s = s.Where(sq.Lt{"time": filter.Until.UnixNano()})
+	}
+	if filter.Actor != "" {
+		s = s.Where(sq.Eq{"actor": filter.Actor})
+	}
+	if filter.ResourceType != "" {
+		s = s.Where(sq.Eq{"resourcetype": filter.ResourceType})
+	}
+	if filter.ResourceID != "" {
+		s = s.Where(sq.Eq{"resourceid": filter.ResourceID})
+	}
+	if startID != "" {
+		// many entries can have the same time (they're written in the same
+		// wal) so also compare the id to have a stable ordering
+		op := ">"
+		if !asc {
+			op = "<"
+		}
+		s = s.Where(fmt.Sprintf("(time %[1]s (select time from auditentry where id = ?) or (time = (select time from auditentry where id = ?) and id %[1]s ?))", op), startID, startID, startID)
+	}
+	if limit > 0 {
+		s = s.Limit(uint64(limit))
+	}
+
+	q, args, err := s.ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return nil, errors.Errorf("failed to build query: %w", err)
+	}
+
+	entries, _, err := fetchAuditEntries(tx, q, args...)
+	return entries, err
+}
+
+func fetchAuditEntries(tx *db.Tx, q string, args ...interface{}) ([]*types.AuditEntry, []string, error) {
+	rows, err := tx.Query(q, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	return scanAuditEntries(rows)
+}
+
+func scanAuditEntry(rows *sql.Rows, additionalFields ...interface{}) (*types.AuditEntry, string, error) {
+	var id string
+	var data []byte
+	if err := rows.Scan(&id, &data); err != nil {
+		return nil, "", errors.Errorf("failed to scan rows: %w", err)
+	}
+	entry := types.AuditEntry{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, "", errors.Errorf("failed to unmarshal audit entry: %w", err)
+		}
+	}
+
+	return &entry, id, nil
+}
+
+func scanAuditEntries(rows *sql.Rows) ([]*types.AuditEntry, []string, error) {
+	entries := []*types.AuditEntry{}
+	ids := []string{}
+	for rows.Next() {
+		e, id, err := scanAuditEntry(rows)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		entries = append(entries, e)
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return entries, ids, nil
+}
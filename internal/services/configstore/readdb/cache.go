@@ -0,0 +1,337 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readdb
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/db"
+	"agola.io/agola/services/configstore/types"
+)
+
+const (
+	DefaultCacheSize = 1000
+	DefaultCacheTTL  = 5 * time.Minute
+
+	// RemoteSourceCacheTTL is the max expiration time of the cached remote
+	// sources. They are invalidated when changed like all the other objects
+	// but, since they contain the credentials used by the gateway, they are
+	// kept for a shorter time.
+	RemoteSourceCacheTTL = 30 * time.Second
+)
+
+// maxTypeTTLs are the max expiration times of the cached objects of a type,
+// used when shorter than the cache ttl
+var maxTypeTTLs = map[types.ConfigType]time.Duration{
+	types.ConfigTypeRemoteSource: RemoteSourceCacheTTL,
+}
+
+// cacheObject identifies the readdb object a cache entry belongs to
+type cacheObject struct {
+	configType types.ConfigType
+	id         string
+}
+
+type cacheEntry struct {
+	key     string
+	obj     cacheObject
+	data    []byte
+	expires time.Time
+}
+
+// CacheStats contains the readdb cache statistics
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// cache is an in memory lru cache of the readdb objects.
+//
+// The cache entries of an object are removed when an action changing the
+// object is applied. To never serve stale data:
+// * an object changed by a not yet committed transaction isn't served from
+// the cache and cannot be cached until the transaction ends.
+// * the cache generation is incremented at the end of every transaction
+// applying some changes. An entry can be cached only if the generation is the
+// same of when the reading transaction was started, so entries read from a db
+// snapshot older than an applied change are never cached.
+type cache struct {
+	size int
+	ttl  time.Duration
+
+	mu sync.Mutex
+	ll *list.List
+	// entries maps the cache keys to their ll element
+	entries map[string]*list.Element
+	// objEntries maps an object to the keys of its cache entries
+	objEntries map[cacheObject]map[string]struct{}
+	// changing are the objects changed by in progress transactions
+	changing   map[cacheObject]int
+	generation uint64
+
+	hits   uint64
+	misses uint64
+}
+
+func newCache(size int, ttl time.Duration) *cache {
+	return &cache{
+		size:       size,
+		ttl:        ttl,
+		ll:         list.New(),
+		entries:    map[string]*list.Element{},
+		objEntries: map[cacheObject]map[string]struct{}{},
+		changing:   map[cacheObject]int{},
+	}
+}
+
+func (c *cache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+func (c *cache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if _, ok := c.changing[e.obj]; ok {
+		c.misses++
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		c.removeElement(el)
+		c.misses++
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.hits++
+	return e.data, true
+}
+
+func (c *cache) put(generation uint64, key string, obj cacheObject, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if _, ok := c.changing[obj]; ok {
+		return
+	}
+
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+
+	ttl := c.ttl
+	if maxTTL, ok := maxTypeTTLs[obj.configType]; ok && maxTTL < ttl {
+		ttl = maxTTL
+	}
+
+	e := &cacheEntry{key: key, obj: obj, data: data, expires: time.Now().Add(ttl)}
+	c.entries[key] = c.ll.PushFront(e)
+	if _, ok := c.objEntries[obj]; !ok {
+		c.objEntries[obj] = map[string]struct{}{}
+	}
+	c.objEntries[obj][key] = struct{}{}
+
+	for c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *cache) removeElement(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.ll.Remove(el)
+	delete(c.entries, e.key)
+	if keys, ok := c.objEntries[e.obj]; ok {
+		delete(keys, e.key)
+		if len(keys) == 0 {
+			delete(c.objEntries, e.obj)
+		}
+	}
+}
+
+func (c *cache) removeObject(obj cacheObject) {
+	for key := range c.objEntries[obj] {
+		c.removeElement(c.entries[key])
+	}
+}
+
+// beginChange marks the object as changing and removes its entries
+func (c *cache) beginChange(obj cacheObject) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.changing[obj]++
+	c.removeObject(obj)
+}
+
+// endChanges must be called when the transaction changing the objects has
+// been committed or rolled back
+func (c *cache) endChanges(objs []cacheObject) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, obj := range objs {
+		c.removeObject(obj)
+		c.changing[obj]--
+		if c.changing[obj] <= 0 {
+			delete(c.changing, obj)
+		}
+	}
+	c.generation++
+}
+
+// reset removes all the cache entries
+func (c *cache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.entries = map[string]*list.Element{}
+	c.objEntries = map[cacheObject]map[string]struct{}{}
+	c.generation++
+}
+
+func (c *cache) stats() *CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return &CacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: c.ll.Len(),
+	}
+}
+
+// txCache is the cache state of a readdb transaction
+type txCache struct {
+	// generation is the cache generation when the transaction was started
+	generation uint64
+	// apply reports if the transaction applies actions, the cache isn't used
+	// inside these transactions
+	apply bool
+	// changes are the objects changed by the applied actions
+	changes []cacheObject
+}
+
+// CacheStats returns the readdb cache stats or nil if the cache is disabled
+func (r *ReadDB) CacheStats() *CacheStats {
+	if r.cache == nil {
+		return nil
+	}
+	return r.cache.stats()
+}
+
+// doApply executes f in a transaction used to apply actions. The cache
+// entries of the objects changed by the applied actions are removed and the
+// objects won't be cached until the transaction ends.
+func (r *ReadDB) doApply(ctx context.Context, f func(tx *db.Tx) error) error {
+	if r.cache == nil {
+		return r.rdb.Do(ctx, f)
+	}
+
+	// keep the state of all the transactions since db.Do could retry f in a
+	// new transaction
+	tcs := []*txCache{}
+	defer func() {
+		for _, tc := range tcs {
+			r.cache.endChanges(tc.changes)
+		}
+	}()
+
+	return r.rdb.Do(ctx, func(tx *db.Tx) error {
+		tc := &txCache{apply: true}
+		tcs = append(tcs, tc)
+		r.txs.Store(tx, tc)
+		defer r.txs.Delete(tx)
+
+		return f(tx)
+	})
+}
+
+func (r *ReadDB) cacheChange(tx *db.Tx, configType types.ConfigType, id string) {
+	if r.cache == nil {
+		return
+	}
+
+	obj := cacheObject{configType: configType, id: id}
+	r.cache.beginChange(obj)
+
+	// if the transaction isn't tracked the object will remain as changing so
+	// it won't be cached anymore, but stale data won't be served
+	if v, ok := r.txs.Load(tx); ok {
+		tc := v.(*txCache)
+		tc.changes = append(tc.changes, obj)
+	}
+}
+
+func (r *ReadDB) txCache(tx *db.Tx) *txCache {
+	if r.cache == nil {
+		return nil
+	}
+	v, ok := r.txs.Load(tx)
+	if !ok {
+		return nil
+	}
+	tc := v.(*txCache)
+	if tc.apply {
+		return nil
+	}
+	return tc
+}
+
+// cacheGet unmarshals in v the cached value for key. It returns false if the
+// value isn't cached or the cache cannot be used in the transaction.
+func (r *ReadDB) cacheGet(tx *db.Tx, key string, v interface{}) bool {
+	if r.txCache(tx) == nil {
+		return false
+	}
+	data, ok := r.cache.get(key)
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		r.log.Warnf("failed to unmarshal cached value for key %q: %v", key, err)
+		return false
+	}
+	return true
+}
+
+func (r *ReadDB) cachePut(tx *db.Tx, key string, configType types.ConfigType, id string, v interface{}) {
+	tc := r.txCache(tx)
+	if tc == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		r.log.Warnf("failed to marshal value for key %q: %v", key, err)
+		return
+	}
+	r.cache.put(tc.generation, key, cacheObject{configType: configType, id: id}, data)
+}
@@ -14,37 +14,72 @@
 
 package readdb
 
+// dbVersion is the readdb schema version. It must be increased on every Stmts
+// change: a readdb with a different version is recreated and fully synced.
+const dbVersion = 2
+
 var Stmts = []string{
 
 	// last processed etcd event revision
 	"create table revision (revision bigint, PRIMARY KEY(revision))",
 
+	// applytime is the time, in unix seconds, of the last applied wal (or
+	// data dump) with walsequence. It's the modification time of the objects
+	// changed by it
+	"create table applytime (time bigint, walsequence varchar, PRIMARY KEY(time))",
+
 	// committedwalsequence stores the last committed wal sequence
 	"create table committedwalsequence (seq varchar, PRIMARY KEY (seq))",
 
+	// namepolicy stores the names case sensitivity used to populate the
+	// name keys
+	"create table namepolicy (caseinsensitive boolean)",
+
 	// changegrouprevision stores the current revision of the changegroup for optimistic locking
 	"create table changegrouprevision (id varchar, revision varchar, PRIMARY KEY (id, revision))",
 
-	"create table projectgroup (id uuid, name varchar, parentid varchar, parenttype varchar, data bytea, PRIMARY KEY (id))",
+	// modtime is the time, in unix seconds, the project group was last applied
+	// namekey is the name as compared by the names case sensitivity
+	"create table projectgroup (id uuid, name varchar, namekey varchar, parentid varchar, parenttype varchar, modtime bigint, data bytea, PRIMARY KEY (id))",
 	"create index projectgroup_name on projectgroup(name)",
+	"create index projectgroup_parentid_namekey on projectgroup(parentid, namekey)",
 
-	"create table project (id uuid, name varchar, parentid varchar, parenttype varchar, data bytea, PRIMARY KEY (id))",
+	// revision is the sequence of the last wal that updated the project
+	// modtime is the time, in unix seconds, the project was last applied
+	// namekey is the name as compared by the names case sensitivity
+	"create table project (id uuid, name varchar, namekey varchar, parentid varchar, parenttype varchar, revision varchar, modtime bigint, data bytea, PRIMARY KEY (id))",
 	"create index project_name on project(name)",
+	"create index project_parentid_namekey on project(parentid, namekey)",
+	// deleted reports if the labels are of a soft deleted project
+	"create table project_label (projectid uuid, key varchar, value varchar, deleted boolean, PRIMARY KEY (projectid, key, deleted))",
+	"create index project_label_key_value on project_label(key, value)",
 
-	"create table user (id uuid, name varchar, data bytea, PRIMARY KEY (id))",
+	// revision is the sequence of the last wal that updated the user
+	// modtime is the time, in unix seconds, the user was last applied
+	// namekey is the name as compared by the names case sensitivity
+	"create table user (id uuid, name varchar, namekey varchar, revision varchar, modtime bigint, data bytea, PRIMARY KEY (id))",
 	"create index user_name on user(name)",
-	"create table user_token (tokenvalue varchar, userid uuid, PRIMARY KEY (tokenvalue, userid))",
+	"create index user_namekey on user(namekey)",
+	// expirationtime is the token expiration unix time in nanoseconds, 0 when
+	// the token never expires
+	"create table user_token (tokenhash varchar, userid uuid, expirationtime bigint, PRIMARY KEY (tokenhash, userid))",
+	"create index user_token_expirationtime on user_token(expirationtime)",
 
-	"create table org (id uuid, name varchar, data bytea, PRIMARY KEY (id))",
+	// modtime is the time, in unix seconds, the org was last applied
+	// namekey is the name as compared by the names case sensitivity
+	"create table org (id uuid, name varchar, namekey varchar, modtime bigint, data bytea, PRIMARY KEY (id))",
 	"create index org_name on org(name)",
+	"create index org_namekey on org(namekey)",
 
 	"create table orgmember (id uuid, orgid uuid, userid uuid, role varchar, data bytea, PRIMARY KEY (id))",
 	"create index orgmember_role on orgmember(role)",
 	"create index orgmember_orgid_userid on orgmember(orgid, userid)",
 
-	"create table remotesource (id uuid, name varchar, data bytea, PRIMARY KEY (id))",
+	"create table remotesource (id uuid, name varchar, type varchar, authtype varchar, data bytea, PRIMARY KEY (id))",
+	"create index remotesource_name on remotesource(name)",
 
 	"create table linkedaccount_user (id uuid, remotesourceid uuid, userid uuid, remoteuserid uuid, PRIMARY KEY (id), FOREIGN KEY(userid) REFERENCES user(id))",
+	"create index linkedaccount_user_remotesourceid_remoteuserid on linkedaccount_user(remotesourceid, remoteuserid)",
 
 	"create table linkedaccount_project (id uuid, projectid uuid, PRIMARY KEY (id), FOREIGN KEY(projectid) REFERENCES user(id))",
 
@@ -53,4 +88,15 @@ var Stmts = []string{
 
 	"create table variable (id uuid, name varchar, parentid varchar, parenttype varchar, data bytea, PRIMARY KEY (id))",
 	"create index variable_name on variable(name)",
+
+	// time is the unix time in nanoseconds
+	"create table auditentry (id uuid, time bigint, actor varchar, resourcetype varchar, resourceid varchar, data bytea, PRIMARY KEY (id))",
+	"create index auditentry_time on auditentry(time)",
+	"create index auditentry_actor_time on auditentry(actor, time)",
+	"create index auditentry_resourceid_time on auditentry(resourceid, time)",
+	"create index auditentry_resourcetype_time on auditentry(resourcetype, time)",
+
+	// data is the deleted resource data, deletiontime is the unix time in nanoseconds
+	"create table deletedresource (id uuid, resourcetype varchar, name varchar, parentid varchar, deletiontime bigint, data bytea, PRIMARY KEY (id))",
+	"create index deletedresource_deletiontime on deletedresource(deletiontime)",
 }
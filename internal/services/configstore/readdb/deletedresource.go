@@ -0,0 +1,172 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readdb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"agola.io/agola/internal/db"
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/configstore/types"
+
+	sq "github.com/Masterminds/squirrel"
+	errors "golang.org/x/xerrors"
+)
+
+var (
+	deletedResourceSelect = sb.Select("id", "resourcetype", "deletiontime", "data").From("deletedresource")
+	deletedResourceInsert = sb.Insert("deletedresource").Columns("id", "resourcetype", "name", "parentid", "deletiontime", "data")
+)
+
+func (r *ReadDB) insertDeletedResource(tx *db.Tx, data []byte) error {
+	dr := types.DeletedResource{}
+	if err := json.Unmarshal(data, &dr); err != nil {
+		return errors.Errorf("failed to unmarshal deleted resource: %w", err)
+	}
+
+	// save the resource name and parent to list the deleted resources with
+	// the live ones
+	var name, parentID string
+	var project *types.Project
+	switch dr.ResourceType {
+	case types.ConfigTypeProject:
+		if err := json.Unmarshal(dr.Data, &project); err != nil {
+			return errors.Errorf("failed to unmarshal project: %w", err)
+		}
+		name, parentID = project.Name, project.Parent.ID
+	case types.ConfigTypeUser:
+		user := types.User{}
+		if err := json.Unmarshal(dr.Data, &user); err != nil {
+			return errors.Errorf("failed to unmarshal user: %w", err)
+		}
+		name = user.Name
+	default:
+		return errors.Errorf("unsupported deleted resource type %q", dr.ResourceType)
+	}
+
+	// poor man insert or update...
+	if err := r.deleteDeletedResource(tx, dr.ID); err != nil {
+		return err
+	}
+	q, args, err := deletedResourceInsert.Values(dr.ID, dr.ResourceType, name, parentID, dr.DeletionTime.UnixNano(), []byte(dr.Data)).ToSql()
+	if err != nil {
+		return errors.Errorf("failed to build query: %w", err)
+	}
+	if _, err = tx.Exec(q, args...); err != nil {
+		return errors.Errorf("failed to insert deleted resource: %w", err)
+	}
+
+	if project != nil {
+		// keep the labels to filter also the soft deleted projects
+		return r.insertProjectLabels(tx, project, true)
+	}
+	return nil
+}
+
+func (r *ReadDB) deleteDeletedResource(tx *db.Tx, id string) error {
+	if _, err := tx.Exec("delete from deletedresource where id = $1", id); err != nil {
+		return errors.Errorf("failed to delete deleted resource: %w", err)
+	}
+	// the deleted resource ids are the resource ids so this removes the
+	// labels of a soft deleted project
+	return r.deleteProjectLabels(tx, id, true)
+}
+
+// deletedResourcesFrom returns a from clause, aliased as the resource table,
+// with both the live and the soft deleted resources of the provided type
+func deletedResourcesFrom(resourceType types.ConfigType, fields string) string {
+	return fmt.Sprintf("(select %[1]s from %[2]s union all select %[1]s from deletedresource where resourcetype = '%[2]s') as %[2]s", fields, resourceType)
+}
+
+// GetDeletedResource returns the soft deleted resource with the provided id
+func (r *ReadDB) GetDeletedResource(tx *db.Tx, id string) (*types.DeletedResource, error) {
+	q, args, err := deletedResourceSelect.Where(sq.Eq{"id": id}).ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return nil, errors.Errorf("failed to build query: %w", err)
+	}
+
+	drs, err := fetchDeletedResources(tx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(drs) > 1 {
+		return nil, errors.Errorf("too many rows returned")
+	}
+	if len(drs) == 0 {
+		return nil, nil
+	}
+	return drs[0], nil
+}
+
+// GetExpiredDeletedResources returns the resources soft deleted before
+// deletedBefore ordered by deletion time
+func (r *ReadDB) GetExpiredDeletedResources(tx *db.Tx, deletedBefore time.Time, limit int) ([]*types.DeletedResource, error) {
+	s := deletedResourceSelect.Where(sq.Lt{"deletiontime": deletedBefore.UnixNano()}).OrderBy("deletiontime asc")
+	if limit > 0 {
+		s = s.Limit(uint64(limit))
+	}
+	q, args, err := s.ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return nil, errors.Errorf("failed to build query: %w", err)
+	}
+
+	return fetchDeletedResources(tx, q, args...)
+}
+
+func fetchDeletedResources(tx *db.Tx, q string, args ...interface{}) ([]*types.DeletedResource, error) {
+	rows, err := tx.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanDeletedResources(rows)
+}
+
+func scanDeletedResource(rows *sql.Rows) (*types.DeletedResource, error) {
+	var id, resourceType string
+	var deletionTime int64
+	var data []byte
+	if err := rows.Scan(&id, &resourceType, &deletionTime, &data); err != nil {
+		return nil, errors.Errorf("failed to scan rows: %w", err)
+	}
+
+	return &types.DeletedResource{
+		ID:           id,
+		ResourceType: types.ConfigType(resourceType),
+		DeletionTime: time.Unix(0, deletionTime),
+		Data:         data,
+	}, nil
+}
+
+func scanDeletedResources(rows *sql.Rows) ([]*types.DeletedResource, error) {
+	drs := []*types.DeletedResource{}
+	for rows.Next() {
+		dr, err := scanDeletedResource(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		drs = append(drs, dr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return drs, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readdb
+
+import (
+	"sync"
+
+	"agola.io/agola/internal/db"
+	"agola.io/agola/services/configstore/types"
+)
+
+// subscriberQueueSize is the number of changes queued for a subscriber
+const subscriberQueueSize = 100
+
+// Change is an object change applied to the readdb
+type Change struct {
+	Type    types.ConfigType
+	ID      string
+	Deleted bool
+}
+
+type subscriber struct {
+	ch    chan *Change
+	types map[types.ConfigType]struct{}
+}
+
+// subscribers are the subscribers of the readdb changes
+type subscribers struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+// Subscribe returns a channel receiving the changes of the objects of the
+// provided types, or of all the types if empty, after the wal changing them
+// has been applied, and a function to cancel the subscription.
+// The channel is closed when the subscription is canceled, when the subscriber
+// doesn't keep up with the changes (since it would miss some of them) and by
+// CloseSubscriptions. The changes applied by a full resync aren't notified.
+func (r *ReadDB) Subscribe(configTypes []types.ConfigType) (<-chan *Change, func()) {
+	sub := &subscriber{ch: make(chan *Change, subscriberQueueSize)}
+	if len(configTypes) > 0 {
+		sub.types = make(map[types.ConfigType]struct{}, len(configTypes))
+		for _, t := range configTypes {
+			sub.types[t] = struct{}{}
+		}
+	}
+
+	r.subscribers.mu.Lock()
+	if r.subscribers.subs == nil {
+		r.subscribers.subs = make(map[*subscriber]struct{})
+	}
+	r.subscribers.subs[sub] = struct{}{}
+	r.subscribers.mu.Unlock()
+
+	return sub.ch, func() {
+		r.subscribers.mu.Lock()
+		defer r.subscribers.mu.Unlock()
+		r.removeSubscriber(sub)
+	}
+}
+
+// CloseSubscriptions closes all the current subscriptions
+func (r *ReadDB) CloseSubscriptions() {
+	r.subscribers.mu.Lock()
+	defer r.subscribers.mu.Unlock()
+	for sub := range r.subscribers.subs {
+		r.removeSubscriber(sub)
+	}
+}
+
+// removeSubscriber must be called with the subscribers lock held
+func (r *ReadDB) removeSubscriber(sub *subscriber) {
+	if _, ok := r.subscribers.subs[sub]; !ok {
+		return
+	}
+	delete(r.subscribers.subs, sub)
+	close(sub.ch)
+}
+
+// publishChanges sends the changes to the subscribers. It never blocks.
+func (r *ReadDB) publishChanges(changes []*Change) {
+	if len(changes) == 0 {
+		return
+	}
+
+	r.subscribers.mu.Lock()
+	defer r.subscribers.mu.Unlock()
+	for sub := range r.subscribers.subs {
+		for _, change := range changes {
+			if sub.types != nil {
+				if _, ok := sub.types[change.Type]; !ok {
+					continue
+				}
+			}
+			select {
+			case sub.ch <- change:
+			default:
+				r.log.Warnf("subscriber changes queue full, closing subscription")
+				r.removeSubscriber(sub)
+			}
+			if _, ok := r.subscribers.subs[sub]; !ok {
+				break
+			}
+		}
+	}
+}
+
+// trackChanges records the changes applied in tx in changes
+func (r *ReadDB) trackChanges(tx *db.Tx, changes *[]*Change) func() {
+	r.txChanges.Store(tx, changes)
+	return func() { r.txChanges.Delete(tx) }
+}
+
+func (r *ReadDB) recordChange(tx *db.Tx, change *Change) {
+	if v, ok := r.txChanges.Load(tx); ok {
+		changes := v.(*[]*Change)
+		*changes = append(*changes, change)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readdb
+
+import (
+	"database/sql"
+	"fmt"
+
+	"agola.io/agola/internal/db"
+	"agola.io/agola/services/configstore/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+// ExportedTypes are the types of the exported resources. They are ordered so
+// every resource is imported after the resources it references.
+var ExportedTypes = []types.ConfigType{
+	types.ConfigTypeRemoteSource,
+	types.ConfigTypeUser,
+	types.ConfigTypeOrg,
+	types.ConfigTypeOrgMember,
+	types.ConfigTypeProjectGroup,
+	types.ConfigTypeProject,
+	types.ConfigTypeSecret,
+	types.ConfigTypeVariable,
+}
+
+func exportedTable(resourceType types.ConfigType) (string, error) {
+	for _, t := range ExportedTypes {
+		if t == resourceType {
+			// the table name is the resource type
+			return string(t), nil
+		}
+	}
+	return "", errors.Errorf("unsupported resource type %q", resourceType)
+}
+
+// ForEachResource calls f with the data of every resource of the provided
+// type, ordered by id. The rows are read one at a time so all the resources
+// aren't kept in memory.
+func (r *ReadDB) ForEachResource(tx *db.Tx, resourceType types.ConfigType, f func(data []byte) error) error {
+	table, err := exportedTable(resourceType)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(fmt.Sprintf("select data from %s order by id", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return errors.Errorf("failed to scan rows: %w", err)
+		}
+		if err := f(data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// HasResources reports if there's at least a resource of the provided type
+func (r *ReadDB) HasResources(tx *db.Tx, resourceType types.ConfigType) (bool, error) {
+	table, err := exportedTable(resourceType)
+	if err != nil {
+		return false, err
+	}
+	var n int
+	err = tx.QueryRow(fmt.Sprintf("select 1 from %s limit 1", table)).Scan(&n)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetRevisionTx returns the last applied etcd revision in the provided
+// transaction
+func (r *ReadDB) GetRevisionTx(tx *db.Tx) (int64, error) {
+	return r.getRevision(tx)
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readdb
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"agola.io/agola/internal/db"
+
+	errors "golang.org/x/xerrors"
+)
+
+// updateApplyTime sets the apply time of the wal (or data dump) with the
+// provided sequence. Every wal gets an apply time after the previous one, also
+// if the clock goes backwards or many wals are applied in the same second.
+// Since the http dates have a seconds precision this guarantees that a change
+// is never missed by a client, also when the modification time of a resource
+// is the max modification time of many objects (like a project and its
+// parents).
+// The apply times can be a bit ahead of the clock when more than a wal per
+// second is applied but they catch up when the writes slow down.
+func (r *ReadDB) updateApplyTime(tx *db.Tx, walSequence string) error {
+	var last int64
+	var lastWalSequence string
+	err := tx.QueryRow("select time, walsequence from applytime order by time desc limit 1").Scan(&last, &lastWalSequence)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Errorf("failed to get apply time: %w", err)
+	}
+	// a data dump is applied in many transactions with the same sequence
+	if err == nil && lastWalSequence == walSequence {
+		return nil
+	}
+
+	applyTime := time.Now().Unix()
+	if applyTime <= last {
+		applyTime = last + 1
+	}
+	// poor man insert or update that works because transaction isolation level is serializable
+	if _, err := tx.Exec("delete from applytime"); err != nil {
+		return errors.Errorf("failed to delete apply time: %w", err)
+	}
+	if _, err := tx.Exec("insert into applytime (time, walsequence) values ($1, $2)", applyTime, walSequence); err != nil {
+		return errors.Errorf("failed to insert apply time: %w", err)
+	}
+	return nil
+}
+
+// applyTime returns the apply time, in unix seconds, of the wal being applied
+func (r *ReadDB) applyTime(tx *db.Tx) (int64, error) {
+	var applyTime int64
+	err := tx.QueryRow("select time from applytime order by time desc limit 1").Scan(&applyTime)
+	if err == sql.ErrNoRows {
+		return time.Now().Unix(), nil
+	}
+	if err != nil {
+		return 0, errors.Errorf("failed to get apply time: %w", err)
+	}
+	return applyTime, nil
+}
+
+// getModTime returns the modification time of the object with the provided id
+// in table, a zero time is returned if the object doesn't exist
+func (r *ReadDB) getModTime(tx *db.Tx, table, id string) (time.Time, error) {
+	var modTime sql.NullInt64
+	err := tx.QueryRow(fmt.Sprintf("select modtime from %s where id = $1", table), id).Scan(&modTime)
+	if err == sql.ErrNoRows || (err == nil && !modTime.Valid) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, errors.Errorf("failed to get %s modification time: %w", table, err)
+	}
+	return time.Unix(modTime.Int64, 0).UTC(), nil
+}
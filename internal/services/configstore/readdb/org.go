@@ -29,7 +29,7 @@ import (
 
 var (
 	orgSelect = sb.Select("org.id", "org.data").From("org")
-	orgInsert = sb.Insert("org").Columns("id", "name", "data")
+	orgInsert = sb.Insert("org").Columns("id", "name", "namekey", "modtime", "data")
 
 	orgmemberSelect = sb.Select("orgmember.id", "orgmember.data").From("orgmember")
 	orgmemberInsert = sb.Insert("orgmember").Columns("id", "orgid", "userid", "role", "data")
@@ -41,11 +41,15 @@ func (r *ReadDB) insertOrg(tx *db.Tx, data []byte) error {
 		return errors.Errorf("failed to unmarshal org: %w", err)
 	}
 	r.log.Debugf("inserting org: %s", util.Dump(org))
+	modTime, err := r.applyTime(tx)
+	if err != nil {
+		return err
+	}
 	// poor man insert or update...
 	if err := r.deleteOrg(tx, org.ID); err != nil {
 		return err
 	}
-	q, args, err := orgInsert.Values(org.ID, org.Name, data).ToSql()
+	q, args, err := orgInsert.Values(org.ID, org.Name, r.NameKey(org.Name), modTime, data).ToSql()
 	if err != nil {
 		return errors.Errorf("failed to build query: %w", err)
 	}
@@ -100,7 +104,7 @@ func (r *ReadDB) GetOrgByID(tx *db.Tx, orgID string) (*types.Organization, error
 }
 
 func (r *ReadDB) GetOrgByName(tx *db.Tx, name string) (*types.Organization, error) {
-	q, args, err := orgSelect.Where(sq.Eq{"name": name}).ToSql()
+	q, args, err := orgSelect.Where(sq.Eq{"namekey": r.NameKey(name)}).ToSql()
 	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
 	if err != nil {
 		return nil, errors.Errorf("failed to build query: %w", err)
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"path"
 	"strings"
+	"time"
 
 	"agola.io/agola/internal/db"
 	"agola.io/agola/internal/services/configstore/common"
@@ -31,19 +32,25 @@ import (
 
 var (
 	projectSelect = sb.Select("id", "data").From("project")
-	projectInsert = sb.Insert("project").Columns("id", "name", "parentid", "parenttype", "data")
+	projectInsert = sb.Insert("project").Columns("id", "name", "namekey", "parentid", "parenttype", "revision", "modtime", "data")
+
+	projectLabelInsert = sb.Insert("project_label").Columns("projectid", "key", "value", "deleted")
 )
 
-func (r *ReadDB) insertProject(tx *db.Tx, data []byte) error {
+func (r *ReadDB) insertProject(tx *db.Tx, data []byte, revision string) error {
 	var project *types.Project
 	if err := json.Unmarshal(data, &project); err != nil {
 		return errors.Errorf("failed to unmarshal project: %w", err)
 	}
+	modTime, err := r.applyTime(tx)
+	if err != nil {
+		return err
+	}
 	// poor man insert or update...
 	if err := r.deleteProject(tx, project.ID); err != nil {
 		return err
 	}
-	q, args, err := projectInsert.Values(project.ID, project.Name, project.Parent.ID, project.Parent.Type, data).ToSql()
+	q, args, err := projectInsert.Values(project.ID, project.Name, r.NameKey(project.Name), project.Parent.ID, project.Parent.Type, revision, modTime, data).ToSql()
 	if err != nil {
 		return errors.Errorf("failed to build query: %w", err)
 	}
@@ -51,7 +58,7 @@ func (r *ReadDB) insertProject(tx *db.Tx, data []byte) error {
 		return errors.Errorf("failed to insert project: %w", err)
 	}
 
-	return nil
+	return r.insertProjectLabels(tx, project, false)
 }
 
 func (r *ReadDB) deleteProject(tx *db.Tx, id string) error {
@@ -59,9 +66,94 @@ func (r *ReadDB) deleteProject(tx *db.Tx, id string) error {
 	if _, err := tx.Exec("delete from project where id = $1", id); err != nil {
 		return errors.Errorf("failed to delete project: %w", err)
 	}
+	return r.deleteProjectLabels(tx, id, false)
+}
+
+// insertProjectLabels saves the project labels used to filter the projects.
+// The labels of the live and of the soft deleted projects are kept apart, by
+// deleted, since they're updated by different wal actions
+func (r *ReadDB) insertProjectLabels(tx *db.Tx, project *types.Project, deleted bool) error {
+	for key, value := range project.Labels {
+		q, args, err := projectLabelInsert.Values(project.ID, key, value, deleted).ToSql()
+		if err != nil {
+			return errors.Errorf("failed to build query: %w", err)
+		}
+		if _, err = tx.Exec(q, args...); err != nil {
+			return errors.Errorf("failed to insert project label: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *ReadDB) deleteProjectLabels(tx *db.Tx, projectID string, deleted bool) error {
+	if _, err := tx.Exec("delete from project_label where projectid = $1 and deleted = $2", projectID, deleted); err != nil {
+		return errors.Errorf("failed to delete project labels: %w", err)
+	}
 	return nil
 }
 
+// GetProjectModTime returns the last modification time of the project. Since
+// the project path and global visibility depend on its parents it's the last
+// modification time of the project, its parent project groups and its owner.
+func (r *ReadDB) GetProjectModTime(tx *db.Tx, project *types.Project) (time.Time, error) {
+	modTime, err := r.getModTime(tx, "project", project.ID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	parent := project.Parent
+	for parent.Type == types.ConfigTypeProjectGroup {
+		group, err := r.GetProjectGroup(tx, parent.ID)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if group == nil {
+			break
+		}
+		groupModTime, err := r.getModTime(tx, "projectgroup", group.ID)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if groupModTime.After(modTime) {
+			modTime = groupModTime
+		}
+		parent = group.Parent
+	}
+
+	var ownerModTime time.Time
+	switch parent.Type {
+	case types.ConfigTypeUser:
+		ownerModTime, err = r.getModTime(tx, "user", parent.ID)
+	case types.ConfigTypeOrg:
+		ownerModTime, err = r.getModTime(tx, "org", parent.ID)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ownerModTime.After(modTime) {
+		modTime = ownerModTime
+	}
+	return modTime, nil
+}
+
+// GetProjectRevision returns the revision of the project with the provided id,
+// an empty string is returned if the project doesn't exist
+func (r *ReadDB) GetProjectRevision(tx *db.Tx, projectID string) (string, error) {
+	var revision string
+
+	q, args, err := sb.Select("revision").From("project").Where(sq.Eq{"id": projectID}).ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return "", errors.Errorf("failed to build query: %w", err)
+	}
+
+	err = tx.QueryRow(q, args...).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return revision, err
+}
+
 func (r *ReadDB) GetProjectPath(tx *db.Tx, project *types.Project) (string, error) {
 	pgroup, err := r.GetProjectGroup(tx, project.Parent.ID)
 	if err != nil {
@@ -108,6 +200,12 @@ func (r *ReadDB) GetProject(tx *db.Tx, projectRef string) (*types.Project, error
 }
 
 func (r *ReadDB) GetProjectByID(tx *db.Tx, projectID string) (*types.Project, error) {
+	cacheKey := "project/id/" + projectID
+	var cached types.Project
+	if r.cacheGet(tx, cacheKey, &cached) {
+		return &cached, nil
+	}
+
 	q, args, err := projectSelect.Where(sq.Eq{"id": projectID}).ToSql()
 	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
 	if err != nil {
@@ -124,11 +222,18 @@ func (r *ReadDB) GetProjectByID(tx *db.Tx, projectID string) (*types.Project, er
 	if len(projects) == 0 {
 		return nil, nil
 	}
+	r.cachePut(tx, cacheKey, types.ConfigTypeProject, projects[0].ID, projects[0])
 	return projects[0], nil
 }
 
 func (r *ReadDB) GetProjectByName(tx *db.Tx, parentID, name string) (*types.Project, error) {
-	q, args, err := projectSelect.Where(sq.Eq{"parentid": parentID, "name": name}).ToSql()
+	cacheKey := "project/name/" + parentID + "/" + r.NameKey(name)
+	var cached types.Project
+	if r.cacheGet(tx, cacheKey, &cached) {
+		return &cached, nil
+	}
+
+	q, args, err := projectSelect.Where(sq.Eq{"parentid": parentID, "namekey": r.NameKey(name)}).ToSql()
 	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
 	if err != nil {
 		return nil, errors.Errorf("failed to build query: %w", err)
@@ -144,6 +249,7 @@ func (r *ReadDB) GetProjectByName(tx *db.Tx, parentID, name string) (*types.Proj
 	if len(projects) == 0 {
 		return nil, nil
 	}
+	r.cachePut(tx, cacheKey, types.ConfigTypeProject, projects[0].ID, projects[0])
 	return projects[0], nil
 }
 
@@ -169,6 +275,87 @@ func (r *ReadDB) GetProjectByPath(tx *db.Tx, projectPath string) (*types.Project
 	return project, nil
 }
 
+// ResolvedProjectPath is the result of the resolution of a project path
+type ResolvedProjectPath struct {
+	OwnerType types.ConfigType
+	OwnerID   string
+	OwnerName string
+	// ProjectGroups are the project groups containing the project, from the
+	// owner root project group to the project parent
+	ProjectGroups []*types.ProjectGroup
+	Project       *types.Project
+	// UnresolvedSegment is the index of the first path segment that doesn't
+	// exist or -1 when the whole path is resolved
+	UnresolvedSegment int
+}
+
+// ResolveProjectPath resolves the segments of a project path: the owner type
+// (user or org), the owner name, the project groups names and the project
+// name. Unlike GetProjectByPath the segments are already split, so they could
+// contain a slash, and the resolved ancestry of the project is returned.
+// When a segment cannot be resolved the resolution stops and its index is
+// reported in UnresolvedSegment.
+func (r *ReadDB) ResolveProjectPath(tx *db.Tx, segments []string) (*ResolvedProjectPath, error) {
+	if len(segments) < 3 {
+		return nil, errors.Errorf("wrong project path segments: %q", segments)
+	}
+
+	res := &ResolvedProjectPath{UnresolvedSegment: -1}
+	switch segments[0] {
+	case "org":
+		org, err := r.GetOrgByName(tx, segments[1])
+		if err != nil {
+			return nil, errors.Errorf("failed to get org %q: %w", segments[1], err)
+		}
+		if org == nil {
+			res.UnresolvedSegment = 1
+			return res, nil
+		}
+		res.OwnerType, res.OwnerID, res.OwnerName = types.ConfigTypeOrg, org.ID, org.Name
+	case "user":
+		user, err := r.GetUserByName(tx, segments[1])
+		if err != nil {
+			return nil, errors.Errorf("failed to get user %q: %w", segments[1], err)
+		}
+		if user == nil {
+			res.UnresolvedSegment = 1
+			return res, nil
+		}
+		res.OwnerType, res.OwnerID, res.OwnerName = types.ConfigTypeUser, user.ID, user.Name
+	default:
+		return nil, errors.Errorf("wrong project path owner type %q", segments[0])
+	}
+
+	parentID := res.OwnerID
+	// the root project group (empty name) is resolved with the owner segment
+	groupNames := append([]string{""}, segments[2:len(segments)-1]...)
+	for i, groupName := range groupNames {
+		projectGroup, err := r.GetProjectGroupByName(tx, parentID, groupName)
+		if err != nil {
+			return nil, errors.Errorf("failed to get project group %q: %w", groupName, err)
+		}
+		if projectGroup == nil {
+			res.UnresolvedSegment = i + 1
+			return res, nil
+		}
+		res.ProjectGroups = append(res.ProjectGroups, projectGroup)
+		parentID = projectGroup.ID
+	}
+
+	projectName := segments[len(segments)-1]
+	project, err := r.GetProjectByName(tx, parentID, projectName)
+	if err != nil {
+		return nil, errors.Errorf("failed to get project %q: %w", projectName, err)
+	}
+	if project == nil {
+		res.UnresolvedSegment = len(segments) - 1
+		return res, nil
+	}
+	res.Project = project
+
+	return res, nil
+}
+
 func (r *ReadDB) GetProjectGroupProjects(tx *db.Tx, parentID string) ([]*types.Project, error) {
 	var projects []*types.Project
 
@@ -182,6 +369,106 @@ func (r *ReadDB) GetProjectGroupProjects(tx *db.Tx, parentID string) ([]*types.P
 	return projects, err
 }
 
+// projectsSelect selects the fields of the projects. If includeDeleted is true
+// also the soft deleted projects are selected
+func projectsSelect(includeDeleted bool, fields ...string) sq.SelectBuilder {
+	from := "project as project"
+	if includeDeleted {
+		from = deletedResourcesFrom(types.ConfigTypeProject, "id, name, data")
+	}
+	return sb.Select(fields...).From(from)
+}
+
+// LabelSelector selects the projects with the label Key. If Value is not nil
+// the label must also have the provided value
+type LabelSelector struct {
+	Key   string
+	Value *string
+}
+
+func getProjectsFilteredQuery(startProjectName, startProjectID string, limit int, asc, includeDeleted bool, labelSelectors []*LabelSelector) sq.SelectBuilder {
+	s := projectsSelect(includeDeleted, "id", "data")
+	for _, ls := range labelSelectors {
+		if ls.Value != nil {
+			s = s.Where("project.id in (select projectid from project_label where key = ? and value = ?)", ls.Key, *ls.Value)
+		} else {
+			s = s.Where("project.id in (select projectid from project_label where key = ?)", ls.Key)
+		}
+	}
+	// project names are unique only inside the same parent so also order by id
+	// to have a stable ordering
+	if asc {
+		s = s.OrderBy("project.name asc", "project.id asc")
+	} else {
+		s = s.OrderBy("project.name desc", "project.id desc")
+	}
+	if startProjectName != "" {
+		if asc {
+			s = s.Where(sq.Or{sq.Gt{"project.name": startProjectName}, sq.And{sq.Eq{"project.name": startProjectName}, sq.Gt{"project.id": startProjectID}}})
+		} else {
+			s = s.Where(sq.Or{sq.Lt{"project.name": startProjectName}, sq.And{sq.Eq{"project.name": startProjectName}, sq.Lt{"project.id": startProjectID}}})
+		}
+	}
+	if limit > 0 {
+		s = s.Limit(uint64(limit))
+	}
+
+	return s
+}
+
+// GetProjects returns the projects ordered by name and id starting after the
+// project with the provided name and id. If includeDeleted is true also the
+// soft deleted projects are returned. Only the projects matching all the label
+// selectors are returned
+func (r *ReadDB) GetProjects(tx *db.Tx, startProjectName, startProjectID string, limit int, asc, includeDeleted bool, labelSelectors []*LabelSelector) ([]*types.Project, error) {
+	var projects []*types.Project
+
+	s := getProjectsFilteredQuery(startProjectName, startProjectID, limit, asc, includeDeleted, labelSelectors)
+	q, args, err := s.ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return nil, errors.Errorf("failed to build query: %w", err)
+	}
+
+	projects, _, err = fetchProjects(tx, q, args...)
+	return projects, err
+}
+
+// GetOwnerProjects returns the projects, in all the project groups, of the user
+// or org with the provided id. They're ordered and paginated like in
+// GetProjects. The soft deleted projects aren't returned.
+func (r *ReadDB) GetOwnerProjects(tx *db.Tx, ownerID, startProjectName, startProjectID string, limit int, asc bool) ([]*types.Project, error) {
+	var projects []*types.Project
+
+	// ownergroups are the owner root project group and all its descendants
+	s := getProjectsFilteredQuery(startProjectName, startProjectID, limit, asc, false, nil).
+		Prefix("with recursive ownergroups(id) as (select id from projectgroup where parentid = ? union all select projectgroup.id from projectgroup join ownergroups on projectgroup.parentid = ownergroups.id)", ownerID).
+		Where("project.parentid in (select id from ownergroups)")
+	q, args, err := s.ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return nil, errors.Errorf("failed to build query: %w", err)
+	}
+
+	projects, _, err = fetchProjects(tx, q, args...)
+	return projects, err
+}
+
+// CountProjects returns the number of projects returned by GetProjects with the
+// same includeDeleted
+func (r *ReadDB) CountProjects(tx *db.Tx, includeDeleted bool) (int, error) {
+	var count int
+
+	q, args, err := projectsSelect(includeDeleted, "count(*)").ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return 0, errors.Errorf("failed to build query: %w", err)
+	}
+
+	err = tx.QueryRow(q, args...).Scan(&count)
+	return count, err
+}
+
 func fetchProjects(tx *db.Tx, q string, args ...interface{}) ([]*types.Project, []string, error) {
 	rows, err := tx.Query(q, args...)
 	if err != nil {
@@ -31,7 +31,7 @@ import (
 
 var (
 	projectgroupSelect = sb.Select("id", "data").From("projectgroup")
-	projectgroupInsert = sb.Insert("projectgroup").Columns("id", "name", "parentid", "parenttype", "data")
+	projectgroupInsert = sb.Insert("projectgroup").Columns("id", "name", "namekey", "parentid", "parenttype", "modtime", "data")
 )
 
 func (r *ReadDB) insertProjectGroup(tx *db.Tx, data []byte) error {
@@ -40,11 +40,15 @@ func (r *ReadDB) insertProjectGroup(tx *db.Tx, data []byte) error {
 		return errors.Errorf("failed to unmarshal group: %w", err)
 	}
 
+	modTime, err := r.applyTime(tx)
+	if err != nil {
+		return err
+	}
 	// poor man insert or update...
 	if err := r.deleteProjectGroup(tx, group.ID); err != nil {
 		return err
 	}
-	q, args, err := projectgroupInsert.Values(group.ID, group.Name, group.Parent.ID, group.Parent.Type, data).ToSql()
+	q, args, err := projectgroupInsert.Values(group.ID, group.Name, r.NameKey(group.Name), group.Parent.ID, group.Parent.Type, modTime, data).ToSql()
 	if err != nil {
 		return errors.Errorf("failed to build query: %w", err)
 	}
@@ -185,7 +189,7 @@ func (r *ReadDB) GetProjectGroupByID(tx *db.Tx, projectGroupID string) (*types.P
 }
 
 func (r *ReadDB) GetProjectGroupByName(tx *db.Tx, parentID, name string) (*types.ProjectGroup, error) {
-	q, args, err := projectgroupSelect.Where(sq.Eq{"parentid": parentID, "name": name}).ToSql()
+	q, args, err := projectgroupSelect.Where(sq.Eq{"parentid": parentID, "namekey": r.NameKey(name)}).ToSql()
 	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
 	if err != nil {
 		return nil, errors.Errorf("failed to build query: %w", err)
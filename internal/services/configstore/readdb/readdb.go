@@ -18,9 +18,12 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -47,10 +50,30 @@ var (
 	committedwalsequenceSelect = sb.Select("seq").From("committedwalsequence")
 	committedwalsequenceInsert = sb.Insert("committedwalsequence").Columns("seq")
 
+	namepolicySelect = sb.Select("caseinsensitive").From("namepolicy")
+	namepolicyInsert = sb.Insert("namepolicy").Columns("caseinsensitive")
+
 	changegrouprevisionSelect = sb.Select("id, revision").From("changegrouprevision")
 	changegrouprevisionInsert = sb.Insert("changegrouprevision").Columns("id", "revision")
 )
 
+const (
+	// minSyncRetryDelay and maxSyncRetryDelay are the bounds of the backoff
+	// between the retries of a failed readdb initialization or wal events
+	// handling
+	minSyncRetryDelay = 1 * time.Second
+	maxSyncRetryDelay = 30 * time.Second
+)
+
+const (
+	// DefaultSyncBatchSize is the default max number of wals applied in a
+	// single transaction when syncing from the object storage wals
+	DefaultSyncBatchSize = 100
+	// DefaultSyncBatchMaxSize is the default max size in bytes of the actions
+	// data of the wals of a batch, kept in memory until the batch is applied
+	DefaultSyncBatchMaxSize = 32 * 1024 * 1024
+)
+
 type ReadDB struct {
 	log     *zap.SugaredLogger
 	dataDir string
@@ -59,26 +82,103 @@ type ReadDB struct {
 	ost     *objectstorage.ObjStorage
 	dm      *datamanager.DataManager
 
+	// cache is nil when the cache is disabled
+	cache *cache
+	// txs contains the cache state of the in progress transactions
+	txs sync.Map
+
+	subscribers subscribers
+	// txChanges contains the changes applied by the in progress transactions
+	// whose changes are notified to the subscribers
+	txChanges sync.Map
+
 	Initialized bool
 	initLock    sync.Mutex
+	// fullSyncRequested forces a full sync at the next initialization, it's
+	// protected by initLock
+	fullSyncRequested bool
+	// resyncCh stops the events handling to start a requested full sync
+	resyncCh chan struct{}
+
+	// syncErr is the last error of the readdb initialization or the wal events
+	// handling, it's reset when the wal events are applied again. syncFailures
+	// is the number of consecutive failures
+	syncErr      error
+	syncFailures int
+	syncErrLock  sync.Mutex
+
+	// syncBatchSize and syncBatchMaxSize are the limits of the batches of
+	// wals applied when syncing from the object storage wals
+	syncBatchSize    int
+	syncBatchMaxSize int64
+
+	// caseInsensitiveNames makes the users, orgs, project groups and projects
+	// names unique regardless of their case
+	caseInsensitiveNames bool
 }
 
-func NewReadDB(ctx context.Context, logger *zap.Logger, dataDir string, e *etcd.Store, ost *objectstorage.ObjStorage, dm *datamanager.DataManager) (*ReadDB, error) {
+// NewReadDB creates a new readdb. cacheSize is the max number of cached
+// objects and cacheTTL their expiration time, when 0 the defaults are used. A
+// negative cacheSize disables the cache.
+func NewReadDB(ctx context.Context, logger *zap.Logger, dataDir string, e *etcd.Store, ost *objectstorage.ObjStorage, dm *datamanager.DataManager, cacheSize int, cacheTTL time.Duration) (*ReadDB, error) {
 	if err := os.MkdirAll(dataDir, 0770); err != nil {
 		return nil, err
 	}
 
 	readDB := &ReadDB{
-		log:     logger.Sugar(),
-		dataDir: dataDir,
-		e:       e,
-		ost:     ost,
-		dm:      dm,
+		log:              logger.Sugar(),
+		dataDir:          dataDir,
+		e:                e,
+		ost:              ost,
+		dm:               dm,
+		resyncCh:         make(chan struct{}, 1),
+		syncBatchSize:    DefaultSyncBatchSize,
+		syncBatchMaxSize: DefaultSyncBatchMaxSize,
+	}
+
+	if cacheSize == 0 {
+		cacheSize = DefaultCacheSize
+	}
+	if cacheTTL == 0 {
+		cacheTTL = DefaultCacheTTL
+	}
+	if cacheSize > 0 {
+		readDB.cache = newCache(cacheSize, cacheTTL)
 	}
 
 	return readDB, nil
 }
 
+// SetSyncBatch sets the max number of wals, batchSize, and the max size in
+// bytes of their actions data, batchMaxSize, applied in a single transaction
+// when syncing from the object storage wals. When 0 the defaults are used.
+func (r *ReadDB) SetSyncBatch(batchSize int, batchMaxSize int64) {
+	if batchSize <= 0 {
+		batchSize = DefaultSyncBatchSize
+	}
+	if batchMaxSize <= 0 {
+		batchMaxSize = DefaultSyncBatchMaxSize
+	}
+	r.syncBatchSize = batchSize
+	r.syncBatchMaxSize = batchMaxSize
+}
+
+// SetCaseInsensitiveNames sets the case sensitivity of the users, orgs,
+// project groups and projects names. It must be called before Run. If it
+// differs from the one used to populate the readdb a full sync is done.
+func (r *ReadDB) SetCaseInsensitiveNames(caseInsensitive bool) {
+	r.caseInsensitiveNames = caseInsensitive
+}
+
+// NameKey returns the key used to compare the users, orgs, project groups and
+// projects names. The names keep their case but are looked up by their key.
+func (r *ReadDB) NameKey(name string) string {
+	if r.caseInsensitiveNames {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
 func (r *ReadDB) SetInitialized(initialized bool) {
 	r.initLock.Lock()
 	r.Initialized = initialized
@@ -91,6 +191,61 @@ func (r *ReadDB) IsInitialized() bool {
 	return r.Initialized
 }
 
+func (r *ReadDB) setSyncErr(err error) {
+	r.syncErrLock.Lock()
+	defer r.syncErrLock.Unlock()
+	r.syncErr = err
+	if err != nil {
+		r.syncFailures++
+	} else {
+		r.syncFailures = 0
+	}
+}
+
+// Degraded returns the reason, if any, why the readdb isn't being updated with
+// the last wals (i.e. etcd is unavailable)
+func (r *ReadDB) Degraded() error {
+	r.syncErrLock.Lock()
+	defer r.syncErrLock.Unlock()
+	return r.syncErr
+}
+
+// syncRetryDelay returns the time to wait before retrying the readdb sync, it
+// exponentially grows with the consecutive failures
+func (r *ReadDB) syncRetryDelay() time.Duration {
+	r.syncErrLock.Lock()
+	defer r.syncErrLock.Unlock()
+
+	delay := minSyncRetryDelay
+	for i := 1; i < r.syncFailures && delay < maxSyncRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxSyncRetryDelay {
+		delay = maxSyncRetryDelay
+	}
+	return util.Jitter(delay, 0.1)
+}
+
+// RequestFullSync requests the rebuild of the readdb from the last data dump
+// and the wals applied after it. It's done asynchronously and the readdb isn't
+// available until it's completed.
+func (r *ReadDB) RequestFullSync() {
+	r.initLock.Lock()
+	r.fullSyncRequested = true
+	r.initLock.Unlock()
+
+	select {
+	case r.resyncCh <- struct{}{}:
+	default:
+	}
+}
+
+func (r *ReadDB) isFullSyncRequested() bool {
+	r.initLock.Lock()
+	defer r.initLock.Unlock()
+	return r.fullSyncRequested
+}
+
 // Initialize populates the readdb with the current etcd data and save the
 // revision to then feed it with the etcd events
 func (r *ReadDB) Initialize(ctx context.Context) error {
@@ -118,12 +273,16 @@ func (r *ReadDB) ResetDB(ctx context.Context) error {
 	}
 
 	// populate readdb
-	if err := rdb.Create(ctx, Stmts); err != nil {
+	if err := rdb.Create(ctx, dbVersion, Stmts); err != nil {
 		return err
 	}
 
 	r.rdb = rdb
 
+	if r.cache != nil {
+		r.cache.reset()
+	}
+
 	return nil
 }
 
@@ -134,29 +293,15 @@ func (r *ReadDB) SyncFromDump(ctx context.Context) (string, error) {
 	}
 	for dataType, files := range dumpIndex.Files {
 		for _, file := range files {
-			dumpf, err := r.ost.ReadObject(r.dm.DataFilePath(dataType, file.ID))
+			dumpEntries, err := r.readDataFile(dataType, file.ID)
 			if err != nil {
 				return "", err
 			}
-			dumpEntries := []*datamanager.DataEntry{}
-			dec := json.NewDecoder(dumpf)
-			for {
-				var de *datamanager.DataEntry
 
-				err := dec.Decode(&de)
-				if err == io.EOF {
-					// all done
-					break
-				}
-				if err != nil {
-					dumpf.Close()
-					return "", err
+			err = r.doApply(ctx, func(tx *db.Tx) error {
+				if err := r.updateApplyTime(tx, dumpIndex.WalSequence); err != nil {
+					return err
 				}
-				dumpEntries = append(dumpEntries, de)
-			}
-			dumpf.Close()
-
-			err = r.rdb.Do(ctx, func(tx *db.Tx) error {
 				for _, de := range dumpEntries {
 					action := &datamanager.Action{
 						ActionType: datamanager.ActionTypePut,
@@ -164,7 +309,7 @@ func (r *ReadDB) SyncFromDump(ctx context.Context) (string, error) {
 						DataType:   dataType,
 						Data:       de.Data,
 					}
-					if err := r.applyAction(tx, action); err != nil {
+					if err := r.applyAction(tx, action, dumpIndex.WalSequence); err != nil {
 						return err
 					}
 				}
@@ -180,6 +325,9 @@ func (r *ReadDB) SyncFromDump(ctx context.Context) (string, error) {
 		if err := r.insertCommittedWalSequence(tx, dumpIndex.WalSequence); err != nil {
 			return err
 		}
+		if err := r.insertNamePolicy(tx); err != nil {
+			return err
+		}
 		return nil
 	})
 	if err != nil {
@@ -189,67 +337,159 @@ func (r *ReadDB) SyncFromDump(ctx context.Context) (string, error) {
 	return dumpIndex.WalSequence, nil
 }
 
-func (r *ReadDB) SyncFromWals(ctx context.Context, startWalSeq, endWalSeq string) (string, error) {
-	insertfunc := func(walFiles []*datamanager.WalFile) error {
-		err := r.rdb.Do(ctx, func(tx *db.Tx) error {
-			for _, walFile := range walFiles {
-				header, err := r.dm.ReadWal(walFile.WalSequence)
-				if err != nil {
-					return err
-				}
-				if err := r.insertCommittedWalSequence(tx, walFile.WalSequence); err != nil {
-					return err
-				}
-				if err := r.applyWal(tx, header.WalDataFileID); err != nil {
-					return err
-				}
-			}
-			return nil
-		})
-		return err
+// readDataFile returns the entries of a data file of the data dump
+func (r *ReadDB) readDataFile(dataType, id string) ([]*datamanager.DataEntry, error) {
+	dumpf, err := r.ost.ReadObject(r.dm.DataFilePath(dataType, id))
+	if err != nil {
+		return nil, err
 	}
+	defer dumpf.Close()
 
-	lastWalSeq := startWalSeq
-	walFiles := []*datamanager.WalFile{}
-	count := 0
+	dumpEntries := []*datamanager.DataEntry{}
+	dec := json.NewDecoder(dumpf)
+	for {
+		var de *datamanager.DataEntry
+
+		err := dec.Decode(&de)
+		if err == io.EOF {
+			// all done
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := r.dm.MigrateDataEntry(de); err != nil {
+			return nil, err
+		}
+		dumpEntries = append(dumpEntries, de)
+	}
+
+	return dumpEntries, nil
+}
 
-	doneCh := make(chan struct{})
-	defer close(doneCh)
+// SyncFromWals applies the object storage wals after startWalSeq. The wals
+// are read outside the readdb transactions and applied in batches, every batch
+// in a single transaction together with its last wal sequence as the committed
+// wal sequence. So if the sync is interrupted the readdb will contain the
+// changes of all the batches until the last applied one and the next sync will
+// restart from it.
+func (r *ReadDB) SyncFromWals(ctx context.Context, startWalSeq, endWalSeq string) (string, error) {
+	lastWalSeq := startWalSeq
+	b := r.newWalsBatcher(ctx)
 
+	// ListOSTWals must be fully read
+	var err error
 	for walFile := range r.dm.ListOSTWals(startWalSeq) {
+		if err != nil {
+			continue
+		}
 		if walFile.Err != nil {
-			return "", walFile.Err
+			err = walFile.Err
+			continue
 		}
 
-		walFiles = append(walFiles, walFile)
-		lastWalSeq = walFile.WalSequence
-
-		if count > 100 {
-			if err := insertfunc(walFiles); err != nil {
-				return "", err
-			}
-			count = 0
-			walFiles = []*datamanager.WalFile{}
-		} else {
-			count++
+		header, herr := r.dm.ReadWal(walFile.WalSequence)
+		if herr != nil {
+			err = herr
+			continue
+		}
+		actions, aerr := r.readWalActions(header.WalDataFileID)
+		if aerr != nil {
+			err = aerr
+			continue
 		}
+		if aerr := b.add(walFile.WalSequence, actions); aerr != nil {
+			err = aerr
+			continue
+		}
+		lastWalSeq = walFile.WalSequence
+	}
+	if err != nil {
+		return "", err
 	}
-	if err := insertfunc(walFiles); err != nil {
+	if err := b.flush(); err != nil {
 		return "", err
 	}
 
 	return lastWalSeq, nil
 }
 
+// batchWal is a wal in a walsBatcher batch
+type batchWal struct {
+	walSequence string
+	actions     []*datamanager.Action
+}
+
+// walsBatcher applies the added wals in batches of at most batchSize wals, or
+// less if the size of their actions data reaches batchMaxSize. All the wals of
+// a batch are applied in a single transaction.
+type walsBatcher struct {
+	ctx context.Context
+	r   *ReadDB
+
+	batchSize    int
+	batchMaxSize int64
+
+	wals []*batchWal
+	size int64
+	// batches is the number of applied batches
+	batches int
+}
+
+func (r *ReadDB) newWalsBatcher(ctx context.Context) *walsBatcher {
+	return &walsBatcher{ctx: ctx, r: r, batchSize: r.syncBatchSize, batchMaxSize: r.syncBatchMaxSize}
+}
+
+func (b *walsBatcher) add(walSequence string, actions []*datamanager.Action) error {
+	b.wals = append(b.wals, &batchWal{walSequence: walSequence, actions: actions})
+	for _, action := range actions {
+		b.size += int64(len(action.Data))
+	}
+	if len(b.wals) >= b.batchSize || b.size >= b.batchMaxSize {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush applies the current batch wals
+func (b *walsBatcher) flush() error {
+	if len(b.wals) == 0 {
+		return nil
+	}
+	err := b.r.doApply(b.ctx, func(tx *db.Tx) error {
+		for _, wal := range b.wals {
+			if err := b.r.insertCommittedWalSequence(tx, wal.walSequence); err != nil {
+				return err
+			}
+			if err := b.r.applyActions(tx, wal.actions, wal.walSequence); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.wals = nil
+	b.size = 0
+	b.batches++
+	return nil
+}
+
 func (r *ReadDB) SyncRDB(ctx context.Context) error {
 	// get the last committed storage wal sequence saved in the rdb
 	curWalSeq := ""
+	caseInsensitiveNames := false
 	err := r.rdb.Do(ctx, func(tx *db.Tx) error {
 		var err error
 		curWalSeq, err = r.GetCommittedWalSequence(tx)
 		if err != nil {
 			return err
 		}
+		caseInsensitiveNames, err = r.getNamePolicy(tx)
+		if err != nil {
+			return err
+		}
 		return nil
 	})
 	if err != nil {
@@ -262,9 +502,15 @@ func (r *ReadDB) SyncRDB(ctx context.Context) error {
 	}
 
 	doFullSync := false
-	if curWalSeq == "" {
+	if r.isFullSyncRequested() {
+		doFullSync = true
+		r.log.Warn("full sync requested")
+	} else if curWalSeq == "" {
 		doFullSync = true
 		r.log.Warn("no startWalSeq in db, doing a full sync")
+	} else if caseInsensitiveNames != r.caseInsensitiveNames {
+		doFullSync = true
+		r.log.Warnf("names case sensitivity changed, doing a full sync")
 	} else {
 		ok, err := r.dm.HasOSTWal(curWalSeq)
 		if err != nil {
@@ -307,6 +553,10 @@ func (r *ReadDB) SyncRDB(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
+
+		r.initLock.Lock()
+		r.fullSyncRequested = false
+		r.initLock.Unlock()
 	}
 
 	r.log.Debugf("startWalSeq: %s", curWalSeq)
@@ -339,7 +589,7 @@ func (r *ReadDB) SyncRDB(ctx context.Context) error {
 	}
 
 	r.log.Infof("syncing from wals")
-	err = r.rdb.Do(ctx, func(tx *db.Tx) error {
+	err = r.doApply(ctx, func(tx *db.Tx) error {
 		if err := r.insertRevision(tx, revision); err != nil {
 			return err
 		}
@@ -363,7 +613,7 @@ func (r *ReadDB) SyncRDB(ctx context.Context) error {
 			}
 
 			r.log.Debugf("applying wal to db")
-			if err := r.applyWal(tx, walElement.WalData.WalDataFileID); err != nil {
+			if err := r.applyWal(tx, walElement.WalData.WalDataFileID, walElement.WalData.WalSequence); err != nil {
 				return err
 			}
 		}
@@ -382,8 +632,13 @@ func (r *ReadDB) SyncRDB(ctx context.Context) error {
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	return r.rdb.Do(ctx, func(tx *db.Tx) error {
+		return r.checkNameCollisions(tx)
+	})
 }
 
 func (r *ReadDB) Run(ctx context.Context) error {
@@ -396,8 +651,22 @@ func (r *ReadDB) Run(ctx context.Context) error {
 	}
 	r.rdb = rdb
 
+	// a readdb with a different schema version (i.e. created by a previous
+	// version) is recreated. Since it'll be empty a full sync will be done
+	version, err := r.rdb.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version != 0 && version != dbVersion {
+		r.log.Infof("readdb schema version %d different than the current version %d, recreating the readdb", version, dbVersion)
+		if err := r.ResetDB(ctx); err != nil {
+			return err
+		}
+		r.SetInitialized(false)
+	}
+
 	// populate readdb
-	if err := r.rdb.Create(ctx, Stmts); err != nil {
+	if err := r.rdb.Create(ctx, dbVersion, Stmts); err != nil {
 		return err
 	}
 
@@ -409,12 +678,13 @@ func (r *ReadDB) Run(ctx context.Context) error {
 	if revision == 0 || !r.Initialized {
 		for {
 			err := r.Initialize(ctx)
+			r.setSyncErr(err)
 			if err == nil {
 				break
 			}
 			r.log.Errorf("initialize err: %+v", err)
 
-			sleepCh := time.NewTimer(1 * time.Second).C
+			sleepCh := time.NewTimer(r.syncRetryDelay()).C
 			select {
 			case <-ctx.Done():
 				return nil
@@ -431,13 +701,14 @@ func (r *ReadDB) Run(ctx context.Context) error {
 				break
 			}
 			err := r.Initialize(ctx)
+			r.setSyncErr(err)
 			if err == nil {
 				r.SetInitialized(true)
 				break
 			}
 			r.log.Errorf("initialize err: %+v", err)
 
-			sleepCh := time.NewTimer(1 * time.Second).C
+			sleepCh := time.NewTimer(r.syncRetryDelay()).C
 			select {
 			case <-ctx.Done():
 				return nil
@@ -455,6 +726,7 @@ func (r *ReadDB) Run(ctx context.Context) error {
 			r.log.Infof("starting handleEvents")
 			if err := r.handleEvents(hctx); err != nil {
 				r.log.Errorf("handleEvents err: %+v", err)
+				r.setSyncErr(err)
 			}
 			wg.Done()
 			doneCh <- struct{}{}
@@ -464,14 +736,20 @@ func (r *ReadDB) Run(ctx context.Context) error {
 		case <-ctx.Done():
 			r.log.Infof("readdb exiting")
 			cancel()
+			wg.Wait()
 			return nil
 		case <-doneCh:
 			// cancel context and wait for the all the goroutines to exit
 			cancel()
 			wg.Wait()
+		case <-r.resyncCh:
+			r.log.Infof("stopping handleEvents for a full sync")
+			cancel()
+			wg.Wait()
+			r.SetInitialized(false)
 		}
 
-		sleepCh := time.NewTimer(1 * time.Second).C
+		sleepCh := time.NewTimer(r.syncRetryDelay()).C
 		select {
 		case <-ctx.Done():
 			return nil
@@ -518,7 +796,11 @@ func (r *ReadDB) handleEvents(ctx context.Context) error {
 
 		// a single transaction for every response (every response contains all the
 		// events happened in an etcd revision).
-		err = r.rdb.Do(ctx, func(tx *db.Tx) error {
+		var changes []*Change
+		err = r.doApply(ctx, func(tx *db.Tx) error {
+			// reset the changes since the transaction could be retried
+			changes = nil
+			defer r.trackChanges(tx, &changes)()
 
 			// if theres a wal seq epoch change something happened to etcd, usually (if
 			// the user hasn't messed up with etcd keys) this means etcd has been reset
@@ -561,6 +843,8 @@ func (r *ReadDB) handleEvents(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
+		r.setSyncErr(nil)
+		r.publishChanges(changes)
 	}
 	r.log.Infof("wch closed")
 
@@ -595,18 +879,29 @@ func (r *ReadDB) handleWalEvent(tx *db.Tx, we *datamanager.WatchElement) error {
 		}
 
 		r.log.Debugf("applying wal to db")
-		return r.applyWal(tx, we.WalData.WalDataFileID)
+		return r.applyWal(tx, we.WalData.WalDataFileID, we.WalData.WalSequence)
 	}
 	return nil
 }
 
-func (r *ReadDB) applyWal(tx *db.Tx, walDataFileID string) error {
+func (r *ReadDB) applyWal(tx *db.Tx, walDataFileID, walSequence string) error {
+	actions, err := r.readWalActions(walDataFileID)
+	if err != nil {
+		return err
+	}
+
+	return r.applyActions(tx, actions, walSequence)
+}
+
+// readWalActions returns the actions of a wal data file
+func (r *ReadDB) readWalActions(walDataFileID string) ([]*datamanager.Action, error) {
 	walFile, err := r.dm.ReadWalData(walDataFileID)
 	if err != nil {
-		return errors.Errorf("cannot read wal data file %q: %w", walDataFileID, err)
+		return nil, errors.Errorf("cannot read wal data file %q: %w", walDataFileID, err)
 	}
 	defer walFile.Close()
 
+	actions := []*datamanager.Action{}
 	dec := json.NewDecoder(walFile)
 	for {
 		var action *datamanager.Action
@@ -617,23 +912,44 @@ func (r *ReadDB) applyWal(tx *db.Tx, walDataFileID string) error {
 			break
 		}
 		if err != nil {
-			return errors.Errorf("failed to decode wal file: %w", err)
+			return nil, errors.Errorf("failed to decode wal file: %w", err)
 		}
-
-		if err := r.applyAction(tx, action); err != nil {
-			return err
+		if err := r.dm.MigrateAction(action); err != nil {
+			return nil, err
 		}
+		actions = append(actions, action)
 	}
 
+	return actions, nil
+}
+
+// applyActions applies all the actions of a wal in the provided transaction.
+// If an action fails the transaction must be rolled back so the wal changes
+// are applied together or not at all.
+func (r *ReadDB) applyActions(tx *db.Tx, actions []*datamanager.Action, walSequence string) error {
+	if err := r.updateApplyTime(tx, walSequence); err != nil {
+		return err
+	}
+	for _, action := range actions {
+		if err := r.applyAction(tx, action, walSequence); err != nil {
+			return errors.Errorf("failed to apply action %s of %s %q: %w", action.ActionType, action.DataType, action.ID, err)
+		}
+	}
 	return nil
 }
 
-func (r *ReadDB) applyAction(tx *db.Tx, action *datamanager.Action) error {
+// applyAction applies the action to the readdb. walSequence is the sequence of
+// the wal containing the action (or of the data dump) and is saved as the
+// revision of the objects that support optimistic locking.
+func (r *ReadDB) applyAction(tx *db.Tx, action *datamanager.Action, walSequence string) error {
+	r.cacheChange(tx, types.ConfigType(action.DataType), action.ID)
+	r.recordChange(tx, &Change{Type: types.ConfigType(action.DataType), ID: action.ID, Deleted: action.ActionType == datamanager.ActionTypeDelete})
+
 	switch action.ActionType {
 	case datamanager.ActionTypePut:
 		switch types.ConfigType(action.DataType) {
 		case types.ConfigTypeUser:
-			if err := r.insertUser(tx, action.Data); err != nil {
+			if err := r.insertUser(tx, action.Data, walSequence); err != nil {
 				return err
 			}
 		case types.ConfigTypeOrg:
@@ -649,7 +965,7 @@ func (r *ReadDB) applyAction(tx *db.Tx, action *datamanager.Action) error {
 				return err
 			}
 		case types.ConfigTypeProject:
-			if err := r.insertProject(tx, action.Data); err != nil {
+			if err := r.insertProject(tx, action.Data, walSequence); err != nil {
 				return err
 			}
 		case types.ConfigTypeRemoteSource:
@@ -664,6 +980,14 @@ func (r *ReadDB) applyAction(tx *db.Tx, action *datamanager.Action) error {
 			if err := r.insertVariable(tx, action.Data); err != nil {
 				return err
 			}
+		case types.ConfigTypeAuditEntry:
+			if err := r.insertAuditEntry(tx, action.Data); err != nil {
+				return err
+			}
+		case types.ConfigTypeDeletedResource:
+			if err := r.insertDeletedResource(tx, action.Data); err != nil {
+				return err
+			}
 		}
 
 	case datamanager.ActionTypeDelete:
@@ -708,6 +1032,16 @@ func (r *ReadDB) applyAction(tx *db.Tx, action *datamanager.Action) error {
 			if err := r.deleteVariable(tx, action.ID); err != nil {
 				return err
 			}
+		case types.ConfigTypeAuditEntry:
+			r.log.Debugf("deleting audit entry with id: %s", action.ID)
+			if err := r.deleteAuditEntry(tx, action.ID); err != nil {
+				return err
+			}
+		case types.ConfigTypeDeletedResource:
+			r.log.Debugf("deleting deleted resource with id: %s", action.ID)
+			if err := r.deleteDeletedResource(tx, action.ID); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -715,7 +1049,18 @@ func (r *ReadDB) applyAction(tx *db.Tx, action *datamanager.Action) error {
 }
 
 func (r *ReadDB) Do(ctx context.Context, f func(tx *db.Tx) error) error {
-	return r.rdb.Do(ctx, f)
+	if r.cache == nil {
+		return r.rdb.Do(ctx, f)
+	}
+
+	// get the cache generation before starting the transaction
+	generation := r.cache.currentGeneration()
+	return r.rdb.Do(ctx, func(tx *db.Tx) error {
+		r.txs.Store(tx, &txCache{generation: generation})
+		defer r.txs.Delete(tx)
+
+		return f(tx)
+	})
 }
 
 func (r *ReadDB) insertRevision(tx *db.Tx, revision int64) error {
@@ -745,6 +1090,27 @@ func (r *ReadDB) GetRevision(ctx context.Context) (int64, error) {
 	return revision, err
 }
 
+// WaitRevision waits for the readdb to have applied all the etcd events up to
+// the provided revision
+func (r *ReadDB) WaitRevision(ctx context.Context, revision int64) error {
+	for {
+		curRevision, err := r.GetRevision(ctx)
+		if err != nil {
+			return err
+		}
+		if curRevision >= revision {
+			return nil
+		}
+
+		sleepCh := time.NewTimer(100 * time.Millisecond).C
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("timeout waiting for readdb revision %d, current revision: %d", revision, curRevision)
+		case <-sleepCh:
+		}
+	}
+}
+
 func (r *ReadDB) getRevision(tx *db.Tx) (int64, error) {
 	var revision int64
 
@@ -793,6 +1159,96 @@ func (r *ReadDB) GetCommittedWalSequence(tx *db.Tx) (string, error) {
 	return seq, err
 }
 
+func (r *ReadDB) insertNamePolicy(tx *db.Tx) error {
+	// poor man insert or update that works because transaction isolation level is serializable
+	if _, err := tx.Exec("delete from namepolicy"); err != nil {
+		return errors.Errorf("failed to delete namepolicy: %w", err)
+	}
+	q, args, err := namepolicyInsert.Values(r.caseInsensitiveNames).ToSql()
+	if err != nil {
+		return errors.Errorf("failed to build query: %w", err)
+	}
+	if _, err = tx.Exec(q, args...); err != nil {
+		return err
+	}
+	return nil
+}
+
+// getNamePolicy returns the names case sensitivity used to populate the
+// readdb. A readdb without it has been populated with case sensitive names.
+func (r *ReadDB) getNamePolicy(tx *db.Tx) (bool, error) {
+	var caseInsensitive bool
+
+	q, args, err := namepolicySelect.ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return false, errors.Errorf("failed to build query: %w", err)
+	}
+
+	err = tx.QueryRow(q, args...).Scan(&caseInsensitive)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return caseInsensitive, err
+}
+
+// checkNameCollisions returns an error when, with case insensitive names, the
+// readdb contains users, orgs, project groups or projects whose names differ
+// only by their case. They were created with case sensitive names and, since
+// their lookup by name would be ambiguous, must be renamed before switching
+// to case insensitive names.
+func (r *ReadDB) checkNameCollisions(tx *db.Tx) error {
+	if !r.caseInsensitiveNames {
+		return nil
+	}
+
+	checks := []struct {
+		resourceType string
+		table        string
+		scope        []string
+	}{
+		{resourceType: "users", table: "user"},
+		{resourceType: "orgs", table: "org"},
+		{resourceType: "project groups", table: "projectgroup", scope: []string{"parentid"}},
+		{resourceType: "projects", table: "project", scope: []string{"parentid"}},
+	}
+
+	var collisions []string
+	for _, c := range checks {
+		groupBy := append(c.scope, "namekey")
+		q, args, err := sb.Select("group_concat(name, ', ')").From(c.table).GroupBy(groupBy...).Having("count(*) > 1").ToSql()
+		r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+		if err != nil {
+			return errors.Errorf("failed to build query: %w", err)
+		}
+
+		rows, err := tx.Query(q, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var names string
+			if err := rows.Scan(&names); err != nil {
+				rows.Close()
+				return errors.Errorf("failed to scan rows: %w", err)
+			}
+			sortedNames := strings.Split(names, ", ")
+			sort.Strings(sortedNames)
+			collisions = append(collisions, fmt.Sprintf("%s %s", c.resourceType, strings.Join(sortedNames, ", ")))
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return err
+		}
+		rows.Close()
+	}
+
+	if len(collisions) > 0 {
+		return errors.Errorf("case insensitive names enabled but there are names differing only by their case, switch back to case sensitive names and rename them: %s", strings.Join(collisions, "; "))
+	}
+	return nil
+}
+
 func (r *ReadDB) insertChangeGroupRevision(tx *db.Tx, changegroup string, revision int64) error {
 	r.log.Debugf("insertChangeGroupRevision: %s %d", changegroup, revision)
 
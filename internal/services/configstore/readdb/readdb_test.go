@@ -0,0 +1,865 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/datamanager"
+	"agola.io/agola/internal/db"
+	"agola.io/agola/services/configstore/types"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupReadDB(ctx context.Context, t *testing.T, dir string) *ReadDB {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	r, err := NewReadDB(ctx, logger, dir, nil, nil, nil, 0, 0)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// ResetDB removes the current db
+	if err := ioutil.WriteFile(filepath.Join(dir, "db"), nil, 0660); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := r.ResetDB(ctx); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	return r
+}
+
+func userPutAction(t *testing.T, user *types.User) *datamanager.Action {
+	userj, err := json.Marshal(user)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	return &datamanager.Action{
+		ActionType: datamanager.ActionTypePut,
+		DataType:   string(types.ConfigTypeUser),
+		ID:         user.ID,
+		Data:       userj,
+	}
+}
+
+func TestApplyActionsAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	r := setupReadDB(ctx, t, dir)
+
+	user01 := &types.User{ID: "e5a6a3e4-0000-4000-8000-000000000001", Name: "user01"}
+	user02 := &types.User{ID: "e5a6a3e4-0000-4000-8000-000000000002", Name: "user02"}
+	user03 := &types.User{ID: "e5a6a3e4-0000-4000-8000-000000000003", Name: "user03"}
+
+	getUserNames := func(t *testing.T) []string {
+		names := []string{}
+		err := r.Do(ctx, func(tx *db.Tx) error {
+			users, err := r.GetUsers(tx, "", "", "", 0, true, false)
+			for _, u := range users {
+				names = append(names, u.Name)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return names
+	}
+
+	if err := r.doApply(ctx, func(tx *db.Tx) error {
+		return r.applyActions(tx, []*datamanager.Action{userPutAction(t, user01)}, "seq01")
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("failure between changes", func(t *testing.T) {
+		// the second action fails, the first and the last must not be applied
+		actions := []*datamanager.Action{
+			userPutAction(t, user02),
+			{
+				ActionType: datamanager.ActionTypePut,
+				DataType:   string(types.ConfigTypeUser),
+				ID:         "e5a6a3e4-0000-4000-8000-000000000004",
+				Data:       []byte("{wrong json"),
+			},
+			userPutAction(t, user03),
+			{
+				ActionType: datamanager.ActionTypeDelete,
+				DataType:   string(types.ConfigTypeUser),
+				ID:         user01.ID,
+			},
+		}
+		err := r.doApply(ctx, func(tx *db.Tx) error {
+			return r.applyActions(tx, actions, "seq02")
+		})
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+
+		names := getUserNames(t)
+		if len(names) != 1 || names[0] != "user01" {
+			t.Fatalf("expected only user01, got %v", names)
+		}
+	})
+
+	t.Run("all changes applied", func(t *testing.T) {
+		actions := []*datamanager.Action{
+			userPutAction(t, user02),
+			userPutAction(t, user03),
+			{
+				ActionType: datamanager.ActionTypeDelete,
+				DataType:   string(types.ConfigTypeUser),
+				ID:         user01.ID,
+			},
+		}
+		if err := r.doApply(ctx, func(tx *db.Tx) error {
+			return r.applyActions(tx, actions, "seq02")
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		names := getUserNames(t)
+		if len(names) != 2 || names[0] != "user02" || names[1] != "user03" {
+			t.Fatalf("expected user02 and user03, got %v", names)
+		}
+	})
+}
+
+func TestGetUsersPaginationWithSameNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	r := setupReadDB(ctx, t, dir)
+
+	// a live user01 and two soft deleted users with the same name
+	users := []*types.User{
+		{ID: "e5a6a3e4-0000-4000-8000-000000000001", Name: "user01"},
+		{ID: "e5a6a3e4-0000-4000-8000-000000000002", Name: "user01"},
+		{ID: "e5a6a3e4-0000-4000-8000-000000000003", Name: "user01"},
+		{ID: "e5a6a3e4-0000-4000-8000-000000000004", Name: "user02"},
+	}
+	if err := r.doApply(ctx, func(tx *db.Tx) error {
+		if err := r.applyActions(tx, []*datamanager.Action{userPutAction(t, users[0]), userPutAction(t, users[3])}, "seq01"); err != nil {
+			return err
+		}
+		for _, user := range users[1:3] {
+			userj, err := json.Marshal(user)
+			if err != nil {
+				return err
+			}
+			drj, err := json.Marshal(&types.DeletedResource{ID: user.ID, ResourceType: types.ConfigTypeUser, DeletionTime: time.Now(), Data: userj})
+			if err != nil {
+				return err
+			}
+			if err := r.insertDeletedResource(tx, drj); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	for _, asc := range []bool{true, false} {
+		t.Run(fmt.Sprintf("asc %t", asc), func(t *testing.T) {
+			expected := []string{}
+			for _, user := range users {
+				expected = append(expected, user.ID)
+			}
+			if !asc {
+				for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+					expected[i], expected[j] = expected[j], expected[i]
+				}
+			}
+
+			// pages of 2 users, the page boundary is between users with the
+			// same name
+			got := []string{}
+			var startName, startID string
+			for i := 0; i < len(users); i++ {
+				var page []*types.User
+				err := r.Do(ctx, func(tx *db.Tx) error {
+					var err error
+					page, err = r.GetUsers(tx, startName, startID, "", 2, asc, true)
+					return err
+				})
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				if len(page) == 0 {
+					break
+				}
+				for _, user := range page {
+					got = append(got, user.ID)
+				}
+				last := page[len(page)-1]
+				startName, startID = last.Name, last.ID
+			}
+			if strings.Join(got, ",") != strings.Join(expected, ",") {
+				t.Fatalf("expected users %v, got %v", expected, got)
+			}
+		})
+	}
+}
+
+func TestCheckNameCollisions(t *testing.T) {
+	ctx := context.Background()
+
+	projectPutAction := func(t *testing.T, project *types.Project) *datamanager.Action {
+		projectj, err := json.Marshal(project)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return &datamanager.Action{
+			ActionType: datamanager.ActionTypePut,
+			DataType:   string(types.ConfigTypeProject),
+			ID:         project.ID,
+			Data:       projectj,
+		}
+	}
+
+	parent01 := types.Parent{Type: types.ConfigTypeProjectGroup, ID: "e5a6a3e4-0000-4000-8000-000000000101"}
+	parent02 := types.Parent{Type: types.ConfigTypeProjectGroup, ID: "e5a6a3e4-0000-4000-8000-000000000102"}
+
+	tests := []struct {
+		name               string
+		caseInsensitive    bool
+		actions            func(t *testing.T) []*datamanager.Action
+		expectedCollisions []string
+	}{
+		{
+			name: "test case sensitive names",
+			actions: func(t *testing.T) []*datamanager.Action {
+				return []*datamanager.Action{
+					userPutAction(t, &types.User{ID: "e5a6a3e4-0000-4000-8000-000000000001", Name: "Foo"}),
+					userPutAction(t, &types.User{ID: "e5a6a3e4-0000-4000-8000-000000000002", Name: "foo"}),
+				}
+			},
+		},
+		{
+			name:            "test case insensitive names without collisions",
+			caseInsensitive: true,
+			actions: func(t *testing.T) []*datamanager.Action {
+				return []*datamanager.Action{
+					userPutAction(t, &types.User{ID: "e5a6a3e4-0000-4000-8000-000000000001", Name: "Foo"}),
+					userPutAction(t, &types.User{ID: "e5a6a3e4-0000-4000-8000-000000000002", Name: "bar"}),
+					// same names in different parents
+					projectPutAction(t, &types.Project{ID: "e5a6a3e4-0000-4000-8000-000000000003", Name: "Project01", Parent: parent01}),
+					projectPutAction(t, &types.Project{ID: "e5a6a3e4-0000-4000-8000-000000000004", Name: "project01", Parent: parent02}),
+				}
+			},
+		},
+		{
+			name:            "test case insensitive names with collisions",
+			caseInsensitive: true,
+			actions: func(t *testing.T) []*datamanager.Action {
+				return []*datamanager.Action{
+					userPutAction(t, &types.User{ID: "e5a6a3e4-0000-4000-8000-000000000001", Name: "Foo"}),
+					userPutAction(t, &types.User{ID: "e5a6a3e4-0000-4000-8000-000000000002", Name: "foo"}),
+					projectPutAction(t, &types.Project{ID: "e5a6a3e4-0000-4000-8000-000000000003", Name: "Project01", Parent: parent01}),
+					projectPutAction(t, &types.Project{ID: "e5a6a3e4-0000-4000-8000-000000000004", Name: "project01", Parent: parent01}),
+				}
+			},
+			expectedCollisions: []string{"users Foo, foo", "projects Project01, project01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agola")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			r := setupReadDB(ctx, t, dir)
+			r.SetCaseInsensitiveNames(tt.caseInsensitive)
+
+			if err := r.doApply(ctx, func(tx *db.Tx) error {
+				return r.applyActions(tx, tt.actions(t), "seq01")
+			}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			err = r.Do(ctx, func(tx *db.Tx) error {
+				return r.checkNameCollisions(tx)
+			})
+			if len(tt.expectedCollisions) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected name collisions error, got nil err")
+			}
+			for _, collision := range tt.expectedCollisions {
+				if !strings.Contains(err.Error(), collision) {
+					t.Fatalf("expected err to report %q, got err: %v", collision, err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetUserLinkedAccounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	r := setupReadDB(ctx, t, dir)
+
+	rs := &types.RemoteSource{ID: "e5a6a3e4-0000-4000-8000-000000000101", Name: "rs01"}
+	// the linked account la02 remote source doesn't exist anymore
+	user := &types.User{
+		ID:   "e5a6a3e4-0000-4000-8000-000000000001",
+		Name: "user01",
+		LinkedAccounts: map[string]*types.LinkedAccount{
+			"e5a6a3e4-0000-4000-8000-000000000201": {ID: "e5a6a3e4-0000-4000-8000-000000000201", RemoteSourceID: rs.ID, RemoteUserID: "remoteuser01"},
+			"e5a6a3e4-0000-4000-8000-000000000202": {ID: "e5a6a3e4-0000-4000-8000-000000000202", RemoteSourceID: "e5a6a3e4-0000-4000-8000-000000000102", RemoteUserID: "remoteuser01"},
+		},
+	}
+	if err := r.doApply(ctx, func(tx *db.Tx) error {
+		return r.applyActions(tx, []*datamanager.Action{remoteSourcePutAction(t, rs), userPutAction(t, user)}, "seq01")
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	var las []*UserLinkedAccount
+	err = r.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		las, err = r.GetUserLinkedAccounts(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	if len(las) != 2 {
+		t.Fatalf("expected 2 linked accounts, got %d", len(las))
+	}
+	if las[0].LinkedAccount.ID != "e5a6a3e4-0000-4000-8000-000000000201" || las[0].RemoteSource == nil || las[0].RemoteSource.Name != "rs01" {
+		t.Fatalf("unexpected linked account: %+v", las[0])
+	}
+	if las[1].LinkedAccount.ID != "e5a6a3e4-0000-4000-8000-000000000202" || las[1].RemoteSource != nil {
+		t.Fatalf("unexpected linked account: %+v", las[1])
+	}
+}
+
+func TestGetUserByRemoteUserUsesIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	r := setupReadDB(ctx, t, dir)
+
+	user01 := &types.User{
+		ID:   "e5a6a3e4-0000-4000-8000-000000000001",
+		Name: "user01",
+		LinkedAccounts: map[string]*types.LinkedAccount{
+			"e5a6a3e4-0000-4000-8000-000000000011": {
+				ID:             "e5a6a3e4-0000-4000-8000-000000000011",
+				RemoteSourceID: "e5a6a3e4-0000-4000-8000-000000000021",
+				RemoteUserID:   "remoteuserid01",
+			},
+		},
+	}
+	if err := r.doApply(ctx, func(tx *db.Tx) error {
+		return r.applyActions(tx, []*datamanager.Action{userPutAction(t, user01)}, "seq01")
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	err = r.Do(ctx, func(tx *db.Tx) error {
+		q, args, err := getUserByRemoteUserQuery("remoteuserid01", "e5a6a3e4-0000-4000-8000-000000000021").ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.Query("explain query plan "+q, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		details := []string{}
+		for rows.Next() {
+			var id, parent, notused int
+			var detail string
+			if err := rows.Scan(&id, &parent, &notused, &detail); err != nil {
+				return err
+			}
+			details = append(details, detail)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, detail := range details {
+			if strings.Contains(detail, "linkedaccount_user_remotesourceid_remoteuserid") {
+				return nil
+			}
+		}
+		t.Fatalf("expected query plan using the linkedaccount_user_remotesourceid_remoteuserid index, got %v", details)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	err = r.Do(ctx, func(tx *db.Tx) error {
+		user, err := r.GetUserByLinkedAccountRemoteUserIDandSource(tx, "remoteuserid01", "e5a6a3e4-0000-4000-8000-000000000021")
+		if err != nil {
+			return err
+		}
+		if user == nil || user.ID != user01.ID {
+			t.Fatalf("expected user %q, got %+v", user01.ID, user)
+		}
+
+		user, err = r.GetUserByLinkedAccountRemoteUserIDandSource(tx, "remoteuserid02", "e5a6a3e4-0000-4000-8000-000000000021")
+		if err != nil {
+			return err
+		}
+		if user != nil {
+			t.Fatalf("expected no user, got %+v", user)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+func remoteSourcePutAction(t *testing.T, rs *types.RemoteSource) *datamanager.Action {
+	rsj, err := json.Marshal(rs)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	return &datamanager.Action{
+		ActionType: datamanager.ActionTypePut,
+		DataType:   string(types.ConfigTypeRemoteSource),
+		ID:         rs.ID,
+		Data:       rsj,
+	}
+}
+
+func TestRemoteSourceCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	r := setupReadDB(ctx, t, dir)
+
+	rs := &types.RemoteSource{
+		ID:                 "e5a6a3e4-0000-4000-8000-000000000001",
+		Name:               "rs01",
+		Type:               types.RemoteSourceTypeGitea,
+		AuthType:           types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:     "clientid",
+		Oauth2ClientSecret: "secret01",
+	}
+
+	apply := func(t *testing.T, action *datamanager.Action, walSequence string) {
+		if err := r.doApply(ctx, func(tx *db.Tx) error {
+			return r.applyActions(tx, []*datamanager.Action{action}, walSequence)
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	// getRemoteSource gets the remote source by id and by name (an empty
+	// name skips the lookup by name) checking they are equal
+	getRemoteSource := func(t *testing.T, name string) *types.RemoteSource {
+		var byID, byName *types.RemoteSource
+		err := r.Do(ctx, func(tx *db.Tx) error {
+			var err error
+			byID, err = r.GetRemoteSourceByID(tx, rs.ID)
+			if err != nil || name == "" {
+				return err
+			}
+			byName, err = r.GetRemoteSourceByName(tx, name)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if name != "" && (byID == nil) != (byName == nil) {
+			t.Fatalf("expected both remote sources by id and name, got by id: %v, by name: %v", byID, byName)
+		}
+		if byID != nil && byName != nil && byID.Name != byName.Name {
+			t.Fatalf("remote source by id %q different than remote source by name %q", byID.Name, byName.Name)
+		}
+		return byID
+	}
+
+	apply(t, remoteSourcePutAction(t, rs), "seq01")
+
+	t.Run("cached read", func(t *testing.T) {
+		getRemoteSource(t, "rs01")
+		stats := r.CacheStats()
+
+		if rs := getRemoteSource(t, "rs01"); rs == nil {
+			t.Fatalf("expected remote source, got nil")
+		}
+		nstats := r.CacheStats()
+		if nstats.Hits != stats.Hits+2 {
+			t.Fatalf("expected 2 cache hits, got %d", nstats.Hits-stats.Hits)
+		}
+
+		// the cached remote sources expire before the other objects
+		e := r.cache.entries["remotesource/id/"+rs.ID].Value.(*cacheEntry)
+		if e.expires.After(time.Now().Add(RemoteSourceCacheTTL)) {
+			t.Fatalf("expected remote source cache entry to expire in less than %s, expires at %s", RemoteSourceCacheTTL, e.expires)
+		}
+	})
+
+	t.Run("cached read invalidated by credentials rotation", func(t *testing.T) {
+		// populate the cache
+		getRemoteSource(t, "rs01")
+
+		nrs := *rs
+		nrs.Oauth2ClientSecret = "secret02"
+		apply(t, remoteSourcePutAction(t, &nrs), "seq02")
+
+		if rs := getRemoteSource(t, "rs01"); rs.Oauth2ClientSecret != "secret02" {
+			t.Fatalf("expected oauth2 client secret %q, got %q", "secret02", rs.Oauth2ClientSecret)
+		}
+	})
+
+	t.Run("cached read invalidated by rename", func(t *testing.T) {
+		// populate the cache
+		getRemoteSource(t, "rs01")
+
+		nrs := *rs
+		nrs.Name = "rs02"
+		apply(t, remoteSourcePutAction(t, &nrs), "seq03")
+
+		err := r.Do(ctx, func(tx *db.Tx) error {
+			rs, err := r.GetRemoteSourceByName(tx, "rs01")
+			if err != nil {
+				return err
+			}
+			if rs != nil {
+				t.Fatalf("expected nil remote source, got %v", rs)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if rs := getRemoteSource(t, "rs02"); rs == nil || rs.Name != "rs02" {
+			t.Fatalf("expected remote source rs02, got %v", rs)
+		}
+	})
+
+	t.Run("cached read invalidated by delete", func(t *testing.T) {
+		// populate the cache
+		getRemoteSource(t, "rs02")
+
+		apply(t, &datamanager.Action{
+			ActionType: datamanager.ActionTypeDelete,
+			DataType:   string(types.ConfigTypeRemoteSource),
+			ID:         rs.ID,
+		}, "seq04")
+
+		if rs := getRemoteSource(t, "rs02"); rs != nil {
+			t.Fatalf("expected nil remote source, got %v", rs)
+		}
+	})
+}
+
+func TestUserCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	r := setupReadDB(ctx, t, dir)
+
+	user := &types.User{ID: "e5a6a3e4-0000-4000-8000-000000000001", Name: "user01"}
+
+	apply := func(t *testing.T, action *datamanager.Action, walSequence string) {
+		if err := r.doApply(ctx, func(tx *db.Tx) error {
+			return r.applyActions(tx, []*datamanager.Action{action}, walSequence)
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	getUserByName := func(t *testing.T, name string) *types.User {
+		var u *types.User
+		err := r.Do(ctx, func(tx *db.Tx) error {
+			var err error
+			u, err = r.GetUserByName(tx, name)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return u
+	}
+
+	apply(t, userPutAction(t, user), "seq01")
+
+	t.Run("cached read", func(t *testing.T) {
+		if u := getUserByName(t, "user01"); u == nil || u.ID != user.ID {
+			t.Fatalf("expected user %q, got %v", user.ID, u)
+		}
+		stats := r.CacheStats()
+
+		if u := getUserByName(t, "user01"); u == nil || u.ID != user.ID {
+			t.Fatalf("expected user %q, got %v", user.ID, u)
+		}
+		nstats := r.CacheStats()
+		if nstats.Hits != stats.Hits+1 {
+			t.Fatalf("expected cache hit")
+		}
+	})
+
+	t.Run("cached read invalidated by rename", func(t *testing.T) {
+		// populate the cache
+		getUserByName(t, "user01")
+
+		nuser := *user
+		nuser.Name = "user02"
+		apply(t, userPutAction(t, &nuser), "seq02")
+
+		if u := getUserByName(t, "user01"); u != nil {
+			t.Fatalf("expected nil user, got user %v", u)
+		}
+		if u := getUserByName(t, "user02"); u == nil || u.ID != user.ID {
+			t.Fatalf("expected user %q, got %v", user.ID, u)
+		}
+	})
+
+	t.Run("cached read invalidated by delete", func(t *testing.T) {
+		// populate the cache
+		if u := getUserByName(t, "user02"); u == nil {
+			t.Fatalf("expected user, got nil user")
+		}
+
+		apply(t, &datamanager.Action{
+			ActionType: datamanager.ActionTypeDelete,
+			DataType:   string(types.ConfigTypeUser),
+			ID:         user.ID,
+		}, "seq03")
+
+		if u := getUserByName(t, "user02"); u != nil {
+			t.Fatalf("expected nil user, got user %v", u)
+		}
+	})
+
+	t.Run("concurrent reads and writes", func(t *testing.T) {
+		user := &types.User{ID: "e5a6a3e4-0000-4000-8000-000000000003", Name: "user03"}
+		apply(t, userPutAction(t, user), "seq04")
+
+		rctx, rcancel := context.WithCancel(ctx)
+		defer rcancel()
+		for i := 0; i < 5; i++ {
+			go func() {
+				for {
+					select {
+					case <-rctx.Done():
+						return
+					default:
+					}
+					_ = r.Do(rctx, func(tx *db.Tx) error {
+						_, err := r.GetUserByID(tx, user.ID)
+						return err
+					})
+					time.Sleep(1 * time.Millisecond)
+				}
+			}()
+		}
+
+		for i := 0; i < 10; i++ {
+			nuser := *user
+			nuser.Name = fmt.Sprintf("user03-%d", i)
+			apply(t, userPutAction(t, &nuser), fmt.Sprintf("seq05-%d", i))
+
+			var u *types.User
+			err := r.Do(ctx, func(tx *db.Tx) error {
+				var err error
+				u, err = r.GetUserByID(tx, user.ID)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if u.Name != nuser.Name {
+				t.Fatalf("expected user name %q, got %q", nuser.Name, u.Name)
+			}
+		}
+	})
+}
+
+func TestSyncBatch(t *testing.T) {
+	ctx := context.Background()
+
+	const walsCount = 1000
+	wals := make([]*batchWal, walsCount)
+	for i := range wals {
+		user := &types.User{ID: fmt.Sprintf("e5a6a3e4-0000-4000-8000-%012d", i), Name: fmt.Sprintf("user%04d", i)}
+		wals[i] = &batchWal{walSequence: fmt.Sprintf("seq%04d", i), actions: []*datamanager.Action{userPutAction(t, user)}}
+	}
+
+	// applyWals applies the wals with the provided batch limits and returns
+	// the number of applied batches
+	applyWals := func(t *testing.T, r *ReadDB, wals []*batchWal, batchSize int, batchMaxSize int64) (int, error) {
+		r.SetSyncBatch(batchSize, batchMaxSize)
+		b := r.newWalsBatcher(ctx)
+		for _, wal := range wals {
+			if err := b.add(wal.walSequence, wal.actions); err != nil {
+				return b.batches, err
+			}
+		}
+		err := b.flush()
+		return b.batches, err
+	}
+
+	// checkReadDB checks that the readdb contains the first usersCount users
+	// and the expected committed wal sequence
+	checkReadDB := func(t *testing.T, r *ReadDB, usersCount int, expectedWalSeq string) {
+		err := r.Do(ctx, func(tx *db.Tx) error {
+			count, err := r.CountUsers(tx, "", false)
+			if err != nil {
+				return err
+			}
+			if count != usersCount {
+				t.Fatalf("expected %d users, got %d", usersCount, count)
+			}
+			walSeq, err := r.GetCommittedWalSequence(tx)
+			if err != nil {
+				return err
+			}
+			if walSeq != expectedWalSeq {
+				t.Fatalf("expected committed wal sequence %q, got %q", expectedWalSeq, walSeq)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name            string
+		batchSize       int
+		batchMaxSize    int64
+		expectedBatches int
+	}{
+		{
+			name:            "without batching",
+			batchSize:       1,
+			expectedBatches: walsCount,
+		},
+		{
+			name:            "with batching",
+			expectedBatches: walsCount / DefaultSyncBatchSize,
+		},
+		{
+			name:      "with batching bounded by the batch max size",
+			batchSize: walsCount,
+			// every wal has a single user action with the same size
+			batchMaxSize:    int64(len(wals[0].actions[0].Data) * 250),
+			expectedBatches: walsCount / 250,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agola")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			r := setupReadDB(ctx, t, dir)
+
+			start := time.Now()
+			batches, err := applyWals(t, r, wals, tt.batchSize, tt.batchMaxSize)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			t.Logf("applied %d wals in %d batches in %s", walsCount, batches, time.Since(start))
+
+			if batches != tt.expectedBatches {
+				t.Fatalf("expected %d batches, got %d", tt.expectedBatches, batches)
+			}
+			checkReadDB(t, r, walsCount, wals[walsCount-1].walSequence)
+		})
+	}
+
+	t.Run("failure in a batch", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "agola")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		r := setupReadDB(ctx, t, dir)
+
+		failingWals := append([]*batchWal{}, wals[:25]...)
+		failingWals[15] = &batchWal{
+			walSequence: wals[15].walSequence,
+			actions: []*datamanager.Action{
+				{
+					ActionType: datamanager.ActionTypePut,
+					DataType:   string(types.ConfigTypeUser),
+					ID:         "e5a6a3e4-0000-4000-8000-999999999999",
+					Data:       []byte("{wrong json"),
+				},
+			},
+		}
+
+		batches, err := applyWals(t, r, failingWals, 10, 0)
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if batches != 1 {
+			t.Fatalf("expected 1 applied batch, got %d", batches)
+		}
+		// the failed batch isn't applied, the next sync will restart after the
+		// last wal of the previous batch
+		checkReadDB(t, r, 10, wals[9].walSequence)
+	})
+}
@@ -30,7 +30,7 @@ import (
 
 var (
 	remotesourceSelect = sb.Select("id", "data").From("remotesource")
-	remotesourceInsert = sb.Insert("remotesource").Columns("id", "name", "data")
+	remotesourceInsert = sb.Insert("remotesource").Columns("id", "name", "type", "authtype", "data")
 )
 
 func (r *ReadDB) insertRemoteSource(tx *db.Tx, data []byte) error {
@@ -42,7 +42,7 @@ func (r *ReadDB) insertRemoteSource(tx *db.Tx, data []byte) error {
 	if err := r.deleteRemoteSource(tx, remoteSource.ID); err != nil {
 		return err
 	}
-	q, args, err := remotesourceInsert.Values(remoteSource.ID, remoteSource.Name, data).ToSql()
+	q, args, err := remotesourceInsert.Values(remoteSource.ID, remoteSource.Name, remoteSource.Type, remoteSource.AuthType, data).ToSql()
 	if err != nil {
 		return errors.Errorf("failed to build query: %w", err)
 	}
@@ -78,6 +78,12 @@ func (r *ReadDB) GetRemoteSource(tx *db.Tx, rsRef string) (*types.RemoteSource,
 }
 
 func (r *ReadDB) GetRemoteSourceByID(tx *db.Tx, remoteSourceID string) (*types.RemoteSource, error) {
+	cacheKey := "remotesource/id/" + remoteSourceID
+	var cached types.RemoteSource
+	if r.cacheGet(tx, cacheKey, &cached) {
+		return &cached, nil
+	}
+
 	q, args, err := remotesourceSelect.Where(sq.Eq{"id": remoteSourceID}).ToSql()
 	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
 	if err != nil {
@@ -94,10 +100,17 @@ func (r *ReadDB) GetRemoteSourceByID(tx *db.Tx, remoteSourceID string) (*types.R
 	if len(remoteSources) == 0 {
 		return nil, nil
 	}
+	r.cachePut(tx, cacheKey, types.ConfigTypeRemoteSource, remoteSources[0].ID, remoteSources[0])
 	return remoteSources[0], nil
 }
 
 func (r *ReadDB) GetRemoteSourceByName(tx *db.Tx, name string) (*types.RemoteSource, error) {
+	cacheKey := "remotesource/name/" + name
+	var cached types.RemoteSource
+	if r.cacheGet(tx, cacheKey, &cached) {
+		return &cached, nil
+	}
+
 	q, args, err := remotesourceSelect.Where(sq.Eq{"name": name}).ToSql()
 	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
 	if err != nil {
@@ -114,17 +127,24 @@ func (r *ReadDB) GetRemoteSourceByName(tx *db.Tx, name string) (*types.RemoteSou
 	if len(remoteSources) == 0 {
 		return nil, nil
 	}
+	r.cachePut(tx, cacheKey, types.ConfigTypeRemoteSource, remoteSources[0].ID, remoteSources[0])
 	return remoteSources[0], nil
 }
 
-func getRemoteSourcesFilteredQuery(startRemoteSourceName string, limit int, asc bool) sq.SelectBuilder {
+func getRemoteSourcesFilteredQuery(startRemoteSourceName string, rsType types.RemoteSourceType, authType types.RemoteSourceAuthType, limit int, asc bool) sq.SelectBuilder {
 	fields := []string{"id", "data"}
 
 	s := sb.Select(fields...).From("remotesource as remotesource")
+	if rsType != "" {
+		s = s.Where(sq.Eq{"remotesource.type": rsType})
+	}
+	if authType != "" {
+		s = s.Where(sq.Eq{"remotesource.authtype": authType})
+	}
 	if asc {
-		s = s.OrderBy("remotesource.name asc")
+		s = s.OrderBy("remotesource.name asc", "remotesource.id asc")
 	} else {
-		s = s.OrderBy("remotesource.name desc")
+		s = s.OrderBy("remotesource.name desc", "remotesource.id desc")
 	}
 	if startRemoteSourceName != "" {
 		if asc {
@@ -140,10 +160,13 @@ func getRemoteSourcesFilteredQuery(startRemoteSourceName string, limit int, asc
 	return s
 }
 
-func (r *ReadDB) GetRemoteSources(ctx context.Context, startRemoteSourceName string, limit int, asc bool) ([]*types.RemoteSource, error) {
+// GetRemoteSources returns the remote sources ordered by name and id. If rsType or
+// authType aren't empty only the remote sources with this type and auth type
+// are returned
+func (r *ReadDB) GetRemoteSources(ctx context.Context, startRemoteSourceName string, rsType types.RemoteSourceType, authType types.RemoteSourceAuthType, limit int, asc bool) ([]*types.RemoteSource, error) {
 	var remoteSources []*types.RemoteSource
 
-	s := getRemoteSourcesFilteredQuery(startRemoteSourceName, limit, asc)
+	s := getRemoteSourcesFilteredQuery(startRemoteSourceName, rsType, authType, limit, asc)
 	q, args, err := s.ToSql()
 	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
 	if err != nil {
@@ -0,0 +1,63 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readdb
+
+import (
+	"strings"
+
+	"agola.io/agola/internal/db"
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/configstore/types"
+
+	sq "github.com/Masterminds/squirrel"
+	errors "golang.org/x/xerrors"
+)
+
+// nameContains returns a case insensitive match of the name column containing
+// term
+func nameContains(column, term string) sq.Sqlizer {
+	return sq.Expr(column+` LIKE ? ESCAPE '\'`, "%"+likeEscaper.Replace(strings.ToLower(term))+"%")
+}
+
+// SearchProjects returns the projects with a name containing term (case
+// insensitive) ordered by name and id starting after the project with the
+// provided name and id
+func (r *ReadDB) SearchProjects(tx *db.Tx, term, startProjectName, startProjectID string, limit int) ([]*types.Project, error) {
+	s := getProjectsFilteredQuery(startProjectName, startProjectID, limit, true, false, nil)
+	s = s.Where(nameContains("lower(project.name)", term))
+	q, args, err := s.ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return nil, errors.Errorf("failed to build query: %w", err)
+	}
+
+	projects, _, err := fetchProjects(tx, q, args...)
+	return projects, err
+}
+
+// SearchRemoteSources returns the remote sources with a name containing term
+// (case insensitive) ordered by name and id
+func (r *ReadDB) SearchRemoteSources(tx *db.Tx, term string, limit int) ([]*types.RemoteSource, error) {
+	s := getRemoteSourcesFilteredQuery("", "", "", limit, true)
+	s = s.Where(nameContains("lower(remotesource.name)", term))
+	q, args, err := s.ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return nil, errors.Errorf("failed to build query: %w", err)
+	}
+
+	remoteSources, _, err := fetchRemoteSources(tx, q, args...)
+	return remoteSources, err
+}
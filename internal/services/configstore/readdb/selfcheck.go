@@ -0,0 +1,276 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+
+	"agola.io/agola/internal/datamanager"
+	"agola.io/agola/internal/db"
+	"agola.io/agola/services/configstore/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+type DiscrepancyKind string
+
+const (
+	// DiscrepancyKindMissing is an object missing from the readdb
+	DiscrepancyKindMissing DiscrepancyKind = "missing"
+	// DiscrepancyKindExtra is an object in the readdb that doesn't exist
+	DiscrepancyKindExtra DiscrepancyKind = "extra"
+	// DiscrepancyKindMismatch is an object whose readdb data is different
+	DiscrepancyKindMismatch DiscrepancyKind = "mismatch"
+)
+
+// Discrepancy is a difference between an object in the readdb and the same
+// object in the data dump and the wals
+type Discrepancy struct {
+	Type types.ConfigType
+	ID   string
+	Kind DiscrepancyKind
+}
+
+type SelfCheckResult struct {
+	// DataWalSequence is the wal sequence of the data dump the check started
+	// from
+	DataWalSequence string
+	// WalSequence is the sequence of the last wal applied to the checked readdb
+	WalSequence   string
+	Discrepancies []*Discrepancy
+}
+
+// selfCheckTypes are the checked object types, their data is saved in the
+// readdb table with the same name
+var selfCheckTypes = []types.ConfigType{
+	types.ConfigTypeUser,
+	types.ConfigTypeOrg,
+	types.ConfigTypeOrgMember,
+	types.ConfigTypeProjectGroup,
+	types.ConfigTypeProject,
+	types.ConfigTypeRemoteSource,
+	types.ConfigTypeSecret,
+	types.ConfigTypeVariable,
+	types.ConfigTypeAuditEntry,
+	types.ConfigTypeDeletedResource,
+}
+
+// SelfCheck verifies that the readdb objects are the ones of the last data
+// dump with applied all the wals after it until the last one applied to the
+// readdb.
+// The readdb objects are read in a single transaction, so the check is done
+// on a consistent snapshot, and compared after it has ended without blocking
+// the readdb updates.
+func (r *ReadDB) SelfCheck(ctx context.Context) (*SelfCheckResult, error) {
+	dataStatus, err := r.dm.GetLastDataStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	var walSeq string
+	objects := map[types.ConfigType]map[string][]byte{}
+	err = r.rdb.Do(ctx, func(tx *db.Tx) error {
+		var err error
+		walSeq, err = r.GetCommittedWalSequence(tx)
+		if err != nil {
+			return err
+		}
+		for _, configType := range selfCheckTypes {
+			objects[configType], err = r.getObjectsData(tx, configType)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if walSeq < dataStatus.WalSequence {
+		return nil, errors.Errorf("readdb wal sequence %q is behind the data dump wal sequence %q", walSeq, dataStatus.WalSequence)
+	}
+
+	expected := map[types.ConfigType]map[string][]byte{}
+	for _, configType := range selfCheckTypes {
+		expected[configType] = map[string][]byte{}
+	}
+	for dataType, files := range dataStatus.Files {
+		if _, ok := expected[types.ConfigType(dataType)]; !ok {
+			continue
+		}
+		for _, file := range files {
+			entries, err := r.readDataFile(dataType, file.ID)
+			if err != nil {
+				return nil, err
+			}
+			for _, de := range entries {
+				expected[types.ConfigType(dataType)][de.ID] = de.Data
+			}
+		}
+	}
+
+	walDataFileIDs, err := r.walDataFileIDs(ctx, dataStatus.WalSequence, walSeq)
+	if err != nil {
+		return nil, err
+	}
+	walSeqs := make([]string, 0, len(walDataFileIDs))
+	for seq := range walDataFileIDs {
+		walSeqs = append(walSeqs, seq)
+	}
+	sort.Strings(walSeqs)
+	for _, seq := range walSeqs {
+		actions, err := r.readWalActions(walDataFileIDs[seq])
+		if err != nil {
+			return nil, err
+		}
+		for _, action := range actions {
+			typeObjects, ok := expected[types.ConfigType(action.DataType)]
+			if !ok {
+				continue
+			}
+			switch action.ActionType {
+			case datamanager.ActionTypePut:
+				typeObjects[action.ID] = action.Data
+			case datamanager.ActionTypeDelete:
+				delete(typeObjects, action.ID)
+			}
+		}
+	}
+
+	res := &SelfCheckResult{
+		DataWalSequence: dataStatus.WalSequence,
+		WalSequence:     walSeq,
+		Discrepancies:   []*Discrepancy{},
+	}
+	for _, configType := range selfCheckTypes {
+		for id, data := range expected[configType] {
+			rdata, ok := objects[configType][id]
+			if !ok {
+				res.Discrepancies = append(res.Discrepancies, &Discrepancy{Type: configType, ID: id, Kind: DiscrepancyKindMissing})
+				continue
+			}
+			data, err := readDBData(configType, data)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(data, rdata) {
+				res.Discrepancies = append(res.Discrepancies, &Discrepancy{Type: configType, ID: id, Kind: DiscrepancyKindMismatch})
+			}
+		}
+		for id := range objects[configType] {
+			if _, ok := expected[configType][id]; !ok {
+				res.Discrepancies = append(res.Discrepancies, &Discrepancy{Type: configType, ID: id, Kind: DiscrepancyKindExtra})
+			}
+		}
+	}
+	sort.Slice(res.Discrepancies, func(i, j int) bool {
+		di, dj := res.Discrepancies[i], res.Discrepancies[j]
+		if di.Type != dj.Type {
+			return di.Type < dj.Type
+		}
+		return di.ID < dj.ID
+	})
+
+	return res, nil
+}
+
+func (r *ReadDB) getObjectsData(tx *db.Tx, configType types.ConfigType) (map[string][]byte, error) {
+	q, args, err := sb.Select("id", "data").From(string(configType)).ToSql()
+	if err != nil {
+		return nil, errors.Errorf("failed to build query: %w", err)
+	}
+	rows, err := tx.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects := map[string][]byte{}
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, errors.Errorf("failed to scan rows: %w", err)
+		}
+		objects[id] = data
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// walDataFileIDs returns the data file ids of the wals after startWalSeq until
+// endWalSeq, keyed by wal sequence.
+// The etcd wals are listed before the storage wals, so a wal removed from etcd
+// while listing will be found in the storage since it's removed only after
+// being committed to it.
+func (r *ReadDB) walDataFileIDs(ctx context.Context, startWalSeq, endWalSeq string) (map[string]string, error) {
+	walDataFileIDs := map[string]string{}
+	inRange := func(seq string) bool {
+		return seq > startWalSeq && seq <= endWalSeq
+	}
+
+	for walElement := range r.dm.ListEtcdWals(ctx, 0) {
+		if walElement.Err != nil {
+			return nil, walElement.Err
+		}
+		if inRange(walElement.WalData.WalSequence) {
+			walDataFileIDs[walElement.WalData.WalSequence] = walElement.WalData.WalDataFileID
+		}
+	}
+
+	// ListOSTWals must be fully read
+	var err error
+	for walFile := range r.dm.ListOSTWals(startWalSeq) {
+		if err != nil {
+			continue
+		}
+		if walFile.Err != nil {
+			err = walFile.Err
+			continue
+		}
+		if _, ok := walDataFileIDs[walFile.WalSequence]; ok || !inRange(walFile.WalSequence) {
+			continue
+		}
+		header, herr := r.dm.ReadWal(walFile.WalSequence)
+		if herr != nil {
+			err = herr
+			continue
+		}
+		walDataFileIDs[walFile.WalSequence] = header.WalDataFileID
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return walDataFileIDs, nil
+}
+
+// readDBData returns the data saved in the readdb for the object data
+func readDBData(configType types.ConfigType, data []byte) ([]byte, error) {
+	if configType != types.ConfigTypeDeletedResource {
+		return data, nil
+	}
+	// only the data of the deleted resource is saved
+	dr := types.DeletedResource{}
+	if err := json.Unmarshal(data, &dr); err != nil {
+		return nil, errors.Errorf("failed to unmarshal deleted resource: %w", err)
+	}
+	return []byte(dr.Data), nil
+}
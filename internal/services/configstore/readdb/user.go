@@ -17,6 +17,8 @@ package readdb
 import (
 	"database/sql"
 	"encoding/json"
+	"strings"
+	"time"
 
 	"agola.io/agola/internal/db"
 	"agola.io/agola/internal/services/configstore/common"
@@ -29,7 +31,7 @@ import (
 
 var (
 	userSelect = sb.Select("user.id", "user.data").From("user")
-	userInsert = sb.Insert("user").Columns("id", "name", "data")
+	userInsert = sb.Insert("user").Columns("id", "name", "namekey", "revision", "modtime", "data")
 
 	//linkedaccountSelect     = sb.Select("id", "data").From("linkedaccount")
 	//linkedaccountInsert     = sb.Insert("linkedaccount").Columns("id", "name", "data")
@@ -37,21 +39,25 @@ var (
 	//linkedaccountuserSelect    = sb.Select("id", "userid").From("linkedaccount_user")
 	//linkedaccountprojectInsert = sb.Insert("linkedaccount_project").Columns("id", "userid")
 
-	//usertokenSelect = sb.Select("tokenvalue", "userid").From("user_token")
-	usertokenInsert = sb.Insert("user_token").Columns("tokenvalue", "userid")
+	//usertokenSelect = sb.Select("tokenhash", "userid").From("user_token")
+	usertokenInsert = sb.Insert("user_token").Columns("tokenhash", "userid", "expirationtime")
 )
 
-func (r *ReadDB) insertUser(tx *db.Tx, data []byte) error {
+func (r *ReadDB) insertUser(tx *db.Tx, data []byte, revision string) error {
 	user := types.User{}
 	if err := json.Unmarshal(data, &user); err != nil {
 		return errors.Errorf("failed to unmarshal user: %w", err)
 	}
 	r.log.Debugf("inserting user: %s", util.Dump(user))
+	modTime, err := r.applyTime(tx)
+	if err != nil {
+		return err
+	}
 	// poor man insert or update...
 	if err := r.deleteUser(tx, user.ID); err != nil {
 		return err
 	}
-	q, args, err := userInsert.Values(user.ID, user.Name, data).ToSql()
+	q, args, err := userInsert.Values(user.ID, user.Name, r.NameKey(user.Name), revision, modTime, data).ToSql()
 	if err != nil {
 		return errors.Errorf("failed to build query: %w", err)
 	}
@@ -72,13 +78,19 @@ func (r *ReadDB) insertUser(tx *db.Tx, data []byte) error {
 			return errors.Errorf("failed to insert user: %w", err)
 		}
 	}
-	// insert user_token
-	for _, tokenValue := range user.Tokens {
-		r.log.Debugf("inserting user token: %s", tokenValue)
-		if err := r.deleteUserToken(tx, tokenValue); err != nil {
+	// insert user_token. The tokens are indexed by their hash, also when saved
+	// as plain values by an older version
+	for tokenName, savedToken := range user.Tokens {
+		r.log.Debugf("inserting user token: %s", tokenName)
+		tokenHash := types.TokenHash(savedToken)
+		if err := r.deleteUserToken(tx, tokenHash); err != nil {
 			return err
 		}
-		q, args, err = usertokenInsert.Values(tokenValue, user.ID).ToSql()
+		var expirationTime int64
+		if t, ok := user.TokensExpirationTime[tokenName]; ok {
+			expirationTime = t.UnixNano()
+		}
+		q, args, err = usertokenInsert.Values(tokenHash, user.ID, expirationTime).ToSql()
 		if err != nil {
 			return errors.Errorf("failed to build query: %w", err)
 		}
@@ -131,14 +143,38 @@ func (r *ReadDB) deleteUserLinkedAccount(tx *db.Tx, id string) error {
 	return nil
 }
 
-func (r *ReadDB) deleteUserToken(tx *db.Tx, tokenValue string) error {
+func (r *ReadDB) deleteUserToken(tx *db.Tx, tokenHash string) error {
 	// poor man insert or update...
-	if _, err := tx.Exec("delete from user_token where tokenvalue = $1", tokenValue); err != nil {
+	if _, err := tx.Exec("delete from user_token where tokenhash = $1", tokenHash); err != nil {
 		return errors.Errorf("failed to delete user_token: %w", err)
 	}
 	return nil
 }
 
+// GetUserModTime returns the last modification time of the user with the
+// provided id, a zero time is returned if the user doesn't exist
+func (r *ReadDB) GetUserModTime(tx *db.Tx, userID string) (time.Time, error) {
+	return r.getModTime(tx, "user", userID)
+}
+
+// GetUserRevision returns the revision of the user with the provided id, an
+// empty string is returned if the user doesn't exist
+func (r *ReadDB) GetUserRevision(tx *db.Tx, userID string) (string, error) {
+	var revision string
+
+	q, args, err := sb.Select("revision").From("user").Where(sq.Eq{"id": userID}).ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return "", errors.Errorf("failed to build query: %w", err)
+	}
+
+	err = tx.QueryRow(q, args...).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return revision, err
+}
+
 func (r *ReadDB) GetUser(tx *db.Tx, userRef string) (*types.User, error) {
 	refType, err := common.ParseNameRef(userRef)
 	if err != nil {
@@ -156,6 +192,12 @@ func (r *ReadDB) GetUser(tx *db.Tx, userRef string) (*types.User, error) {
 }
 
 func (r *ReadDB) GetUserByID(tx *db.Tx, userID string) (*types.User, error) {
+	cacheKey := "user/id/" + userID
+	var cached types.User
+	if r.cacheGet(tx, cacheKey, &cached) {
+		return &cached, nil
+	}
+
 	q, args, err := userSelect.Where(sq.Eq{"id": userID}).ToSql()
 	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
 	if err != nil {
@@ -172,11 +214,18 @@ func (r *ReadDB) GetUserByID(tx *db.Tx, userID string) (*types.User, error) {
 	if len(users) == 0 {
 		return nil, nil
 	}
+	r.cachePut(tx, cacheKey, types.ConfigTypeUser, users[0].ID, users[0])
 	return users[0], nil
 }
 
 func (r *ReadDB) GetUserByName(tx *db.Tx, name string) (*types.User, error) {
-	q, args, err := userSelect.Where(sq.Eq{"name": name}).ToSql()
+	cacheKey := "user/name/" + r.NameKey(name)
+	var cached types.User
+	if r.cacheGet(tx, cacheKey, &cached) {
+		return &cached, nil
+	}
+
+	q, args, err := userSelect.Where(sq.Eq{"namekey": r.NameKey(name)}).ToSql()
 	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
 	if err != nil {
 		return nil, errors.Errorf("failed to build query: %w", err)
@@ -192,13 +241,16 @@ func (r *ReadDB) GetUserByName(tx *db.Tx, name string) (*types.User, error) {
 	if len(users) == 0 {
 		return nil, nil
 	}
+	r.cachePut(tx, cacheKey, types.ConfigTypeUser, users[0].ID, users[0])
 	return users[0], nil
 }
 
+// GetUserByTokenValue returns the user owning the token with the provided
+// value. The token is looked up by its hash.
 func (r *ReadDB) GetUserByTokenValue(tx *db.Tx, tokenValue string) (*types.User, error) {
 	s := userSelect
 	s = s.Join("user_token on user_token.userid = user.id")
-	s = s.Where(sq.Eq{"user_token.tokenvalue": tokenValue})
+	s = s.Where(sq.Eq{"user_token.tokenhash": types.HashToken(tokenValue)})
 	q, args, err := s.ToSql()
 	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
 	if err != nil {
@@ -218,6 +270,26 @@ func (r *ReadDB) GetUserByTokenValue(tx *db.Tx, tokenValue string) (*types.User,
 	return users[0], nil
 }
 
+// GetUsersWithExpiredTokens returns the users with tokens expired before
+// expiredBefore
+func (r *ReadDB) GetUsersWithExpiredTokens(tx *db.Tx, expiredBefore time.Time, limit int) ([]*types.User, error) {
+	s := userSelect.Distinct()
+	s = s.Join("user_token on user_token.userid = user.id")
+	s = s.Where(sq.And{sq.Gt{"user_token.expirationtime": 0}, sq.LtOrEq{"user_token.expirationtime": expiredBefore.UnixNano()}})
+	s = s.OrderBy("user.id")
+	if limit > 0 {
+		s = s.Limit(uint64(limit))
+	}
+	q, args, err := s.ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return nil, errors.Errorf("failed to build query: %w", err)
+	}
+
+	users, _, err := fetchUsers(tx, q, args...)
+	return users, err
+}
+
 func (r *ReadDB) GetUserByLinkedAccount(tx *db.Tx, linkedAccountID string) (*types.User, error) {
 	s := userSelect
 	s = s.Join("linkedaccount_user as lau on lau.userid = user.id")
@@ -241,11 +313,79 @@ func (r *ReadDB) GetUserByLinkedAccount(tx *db.Tx, linkedAccountID string) (*typ
 	return users[0], nil
 }
 
-func (r *ReadDB) GetUserByLinkedAccountRemoteUserIDandSource(tx *db.Tx, remoteUserID, remoteSourceID string) (*types.User, error) {
+// UserLinkedAccount is a user linked account with its related remote source.
+// RemoteSource is nil when the remote source doesn't exist anymore.
+type UserLinkedAccount struct {
+	LinkedAccount *types.LinkedAccount
+	RemoteSource  *types.RemoteSource
+}
+
+// GetUserLinkedAccounts returns the linked accounts of the provided user
+// ordered by linked account id
+func (r *ReadDB) GetUserLinkedAccounts(tx *db.Tx, userID string) ([]*UserLinkedAccount, error) {
+	user, err := r.GetUserByID(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, util.NewErrNotExist(errors.Errorf("user with id %q doesn't exist", userID))
+	}
+
+	s := sb.Select("lau.id", "remotesource.id", "remotesource.data").From("linkedaccount_user as lau")
+	s = s.LeftJoin("remotesource on remotesource.id = lau.remotesourceid")
+	s = s.Where(sq.Eq{"lau.userid": userID})
+	s = s.OrderBy("lau.id")
+	q, args, err := s.ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return nil, errors.Errorf("failed to build query: %w", err)
+	}
+
+	rows, err := tx.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	las := []*UserLinkedAccount{}
+	for rows.Next() {
+		var laID string
+		var rsID sql.NullString
+		var rsData []byte
+		if err := rows.Scan(&laID, &rsID, &rsData); err != nil {
+			return nil, errors.Errorf("failed to scan rows: %w", err)
+		}
+		var rs *types.RemoteSource
+		if rsID.Valid {
+			if err := json.Unmarshal(rsData, &rs); err != nil {
+				return nil, errors.Errorf("failed to unmarshal remotesource: %w", err)
+			}
+		}
+		la, ok := user.LinkedAccounts[laID]
+		if !ok {
+			return nil, errors.Errorf("user %q linked account %q doesn't exist", userID, laID)
+		}
+		las = append(las, &UserLinkedAccount{LinkedAccount: la, RemoteSource: rs})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return las, nil
+}
+
+// getUserByRemoteUserQuery returns the query of the user with a linked
+// account for the remote user. It uses the linkedaccount_user
+// (remotesourceid, remoteuserid) index.
+func getUserByRemoteUserQuery(remoteUserID, remoteSourceID string) sq.SelectBuilder {
 	s := userSelect
 	s = s.Join("linkedaccount_user as lau on lau.userid = user.id")
-	s = s.Where(sq.Eq{"lau.remoteuserid": remoteUserID, "lau.remotesourceid": remoteSourceID})
-	q, args, err := s.ToSql()
+	s = s.Where(sq.Eq{"lau.remotesourceid": remoteSourceID, "lau.remoteuserid": remoteUserID})
+	return s
+}
+
+func (r *ReadDB) GetUserByLinkedAccountRemoteUserIDandSource(tx *db.Tx, remoteUserID, remoteSourceID string) (*types.User, error) {
+	q, args, err := getUserByRemoteUserQuery(remoteUserID, remoteSourceID).ToSql()
 	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
 	if err != nil {
 		return nil, errors.Errorf("failed to build query: %w", err)
@@ -264,16 +404,41 @@ func (r *ReadDB) GetUserByLinkedAccountRemoteUserIDandSource(tx *db.Tx, remoteUs
 	return users[0], nil
 }
 
-func getUsersFilteredQuery(startUserName string, limit int, asc bool) sq.SelectBuilder {
-	fields := []string{"id", "data"}
+// likeEscaper escapes the LIKE special chars using a backslash as escape char
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// usersSelect selects the fields of the users with a name containing query
+// (case insensitive). If includeDeleted is true also the soft deleted users
+// are selected
+func usersSelect(query string, includeDeleted bool, fields ...string) sq.SelectBuilder {
+	from := "user as user"
+	if includeDeleted {
+		from = deletedResourcesFrom(types.ConfigTypeUser, "id, name, data")
+	}
+	s := sb.Select(fields...).From(from)
+	if query != "" {
+		s = s.Where(nameContains("lower(user.name)", query))
+	}
+	return s
+}
 
-	s := sb.Select(fields...).From("user as user")
+func getUsersFilteredQuery(startUserName, startUserID, query string, limit int, asc, includeDeleted bool) sq.SelectBuilder {
+	s := usersSelect(query, includeDeleted, "id", "data")
+	// user names are unique but the soft deleted users can have the same name
+	// of an existing user so also order by id to have a stable ordering
 	if asc {
-		s = s.OrderBy("user.name asc")
+		s = s.OrderBy("user.name asc", "user.id asc")
 	} else {
-		s = s.OrderBy("user.name desc")
+		s = s.OrderBy("user.name desc", "user.id desc")
 	}
-	if startUserName != "" {
+	switch {
+	case startUserName != "" && startUserID != "":
+		if asc {
+			s = s.Where(sq.Or{sq.Gt{"user.name": startUserName}, sq.And{sq.Eq{"user.name": startUserName}, sq.Gt{"user.id": startUserID}}})
+		} else {
+			s = s.Where(sq.Or{sq.Lt{"user.name": startUserName}, sq.And{sq.Eq{"user.name": startUserName}, sq.Lt{"user.id": startUserID}}})
+		}
+	case startUserName != "":
 		if asc {
 			s = s.Where(sq.Gt{"user.name": startUserName})
 		} else {
@@ -287,10 +452,15 @@ func getUsersFilteredQuery(startUserName string, limit int, asc bool) sq.SelectB
 	return s
 }
 
-func (r *ReadDB) GetUsers(tx *db.Tx, startUserName string, limit int, asc bool) ([]*types.User, error) {
+// GetUsers returns the users ordered by name and id starting after the user
+// with the provided name and id, or after all the users with the provided name
+// when startUserID is empty. If query isn't empty only the users with a name
+// containing it (case insensitive) are returned. If includeDeleted is true
+// also the soft deleted users are returned
+func (r *ReadDB) GetUsers(tx *db.Tx, startUserName, startUserID, query string, limit int, asc, includeDeleted bool) ([]*types.User, error) {
 	var users []*types.User
 
-	s := getUsersFilteredQuery(startUserName, limit, asc)
+	s := getUsersFilteredQuery(startUserName, startUserID, query, limit, asc, includeDeleted)
 	q, args, err := s.ToSql()
 	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
 	if err != nil {
@@ -306,6 +476,21 @@ func (r *ReadDB) GetUsers(tx *db.Tx, startUserName string, limit int, asc bool)
 	return users, err
 }
 
+// CountUsers returns the number of users returned by GetUsers with the same
+// query and includeDeleted
+func (r *ReadDB) CountUsers(tx *db.Tx, query string, includeDeleted bool) (int, error) {
+	var count int
+
+	q, args, err := usersSelect(query, includeDeleted, "count(*)").ToSql()
+	r.log.Debugf("q: %s, args: %s", q, util.Dump(args))
+	if err != nil {
+		return 0, errors.Errorf("failed to build query: %w", err)
+	}
+
+	err = tx.QueryRow(q, args...).Scan(&count)
+	return count, err
+}
+
 func fetchUsers(tx *db.Tx, q string, args ...interface{}) ([]*types.User, []string, error) {
 	rows, err := tx.Query(q, args...)
 	if err != nil {
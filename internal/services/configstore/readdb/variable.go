@@ -19,8 +19,10 @@ import (
 	"encoding/json"
 
 	"agola.io/agola/internal/db"
+	itypes "agola.io/agola/internal/services/types"
 	"agola.io/agola/internal/util"
 	"agola.io/agola/services/configstore/types"
+	stypes "agola.io/agola/services/types"
 
 	sq "github.com/Masterminds/squirrel"
 	errors "golang.org/x/xerrors"
@@ -147,6 +149,57 @@ func (r *ReadDB) GetVariablesTree(tx *db.Tx, parentType types.ConfigType, parent
 	return allVariables, nil
 }
 
+// ResolvedVariable is the effective value of a variable
+type ResolvedVariable struct {
+	Variable *types.Variable
+	// Value is the first variable value matching the conditions, nil if no
+	// value matches
+	Value *types.VariableValue
+	// Secret is the secret referenced by the matching value, nil if it doesn't
+	// exist
+	Secret *types.Secret
+}
+
+// ResolveVariables returns the effective value of the variables visible by the
+// provided project or project group. Variables defined at a closer level
+// override the same named variables defined in the ancestors project groups.
+// For every variable the first value matching the provided conditions wins and
+// the referenced secret is searched starting from the variable level.
+func (r *ReadDB) ResolveVariables(tx *db.Tx, parentType types.ConfigType, parentID string, refType itypes.RunRefType, branch, tag, ref string) ([]*ResolvedVariable, error) {
+	variables, err := r.GetVariablesTree(tx, parentType, parentID)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := []*ResolvedVariable{}
+	seen := map[string]struct{}{}
+	for _, variable := range variables {
+		// the variables tree starts from the closer level
+		if _, ok := seen[variable.Name]; ok {
+			continue
+		}
+		seen[variable.Name] = struct{}{}
+
+		rv := &ResolvedVariable{Variable: variable}
+		for i, varval := range variable.Values {
+			if !stypes.MatchWhen(varval.When, refType, branch, tag, ref) {
+				continue
+			}
+			rv.Value = &variable.Values[i]
+
+			secret, err := r.GetSecretTree(tx, variable.Parent.Type, variable.Parent.ID, varval.SecretName)
+			if err != nil {
+				return nil, err
+			}
+			rv.Secret = secret
+			break
+		}
+		resolved = append(resolved, rv)
+	}
+
+	return resolved, nil
+}
+
 func fetchVariables(tx *db.Tx, q string, args ...interface{}) ([]*types.Variable, []string, error) {
 	rows, err := tx.Query(q, args...)
 	if err != nil {
@@ -0,0 +1,67 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"net/http"
+	"strings"
+
+	"agola.io/agola/internal/services/configstore/api"
+	"agola.io/agola/internal/util"
+
+	"github.com/gorilla/mux"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	setLogLevelRouteName     = "setLogLevel"
+	selfCheckRepairRouteName = "selfCheckRepair"
+)
+
+// localWriteRoutes are the names of the write routes changing only the state
+// of the serving configstore, they are also served by a read replica
+var localWriteRoutes = map[string]struct{}{
+	setLogLevelRouteName:     {},
+	selfCheckRepairRouteName: {},
+}
+
+// readReplicaMiddleware is a mux middleware, used only on a read replica,
+// that serves the read requests and sends the other ones to the writer
+// configstore. If the writer url isn't configured they are rejected with a
+// 421 misdirected request error.
+// The redirect uses a 307 status code so the method and body of the request
+// are kept.
+func (s *Configstore) readReplicaMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			h.ServeHTTP(w, r)
+			return
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			if _, ok := localWriteRoutes[route.GetName()]; ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		writerURL := s.c.ReadReplica.WriterURL
+		if writerURL == "" {
+			api.HTTPError(w, r, util.NewErrMisdirectedRequest(errors.Errorf("configstore is a read replica, the writes must be sent to the writer configstore")))
+			return
+		}
+		http.Redirect(w, r, strings.TrimSuffix(writerURL, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+
+	slog "agola.io/agola/internal/log"
+	"agola.io/agola/internal/services/configstore/action"
+	"agola.io/agola/internal/services/configstore/api"
+	"agola.io/agola/internal/util"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+
+	uuid "github.com/satori/go.uuid"
+	errors "golang.org/x/xerrors"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// validRequestID limits the accepted client provided request ids to avoid
+// logging arbitrary data
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// requestIDMiddleware is a mux middleware that reads the request id from the
+// request header or generates a new one. The request id is saved in the
+// request context, so it'll be added to the log entries of the request, and
+// returned in the response header.
+func requestIDMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.NewV4().String()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		ctx := slog.WithRequestID(r.Context(), requestID)
+
+		start := time.Now()
+		rw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rw, r.WithContext(ctx))
+
+		slog.WithContext(ctx, log).Debugw("http request", "method", r.Method, "path", r.URL.Path, "status", rw.status, "duration", time.Since(start))
+	})
+}
+
+// maxActorLength limits the size of the actor recorded in the audit entries
+const maxActorLength = 256
+
+// actorMiddleware is a mux middleware that saves in the request context the
+// actor provided in the request header. Actors longer than maxActorLength are
+// truncated.
+func actorMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor := r.Header.Get(csapitypes.ActorHeader)
+		if len(actor) > maxActorLength {
+			actor = actor[:maxActorLength]
+		}
+		if actor != "" {
+			r = r.WithContext(action.WithActor(r.Context(), actor))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// maxIdempotencyKeyLength limits the size of the client provided idempotency
+// keys
+const maxIdempotencyKeyLength = 256
+
+// idempotencyKeyMiddleware is a mux middleware that saves in the request
+// context the idempotency key provided in the request header
+func idempotencyKeyMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(csapitypes.IdempotencyKeyHeader)
+		if len(key) > maxIdempotencyKeyLength {
+			api.HTTPError(w, r, util.NewErrBadRequest(errors.Errorf("idempotency key longer than %d chars", maxIdempotencyKeyLength)))
+			return
+		}
+		if key != "" {
+			r = r.WithContext(action.WithIdempotencyKey(r.Context(), key))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"agola.io/agola/internal/services/configstore/action"
+	"agola.io/agola/internal/services/configstore/api"
+	"agola.io/agola/internal/util"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+// minRevisionTimeout is the max time waiting for the readdb to apply the
+// revision requested with the minRevision parameter
+const minRevisionTimeout = 10 * time.Second
+
+// revisionResponseWriter sets the revision header with the revision of the
+// changes written by the request before writing the response
+type revisionResponseWriter struct {
+	http.ResponseWriter
+	wr          *action.WriteRevision
+	wroteHeader bool
+}
+
+func (w *revisionResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if revision := w.wr.Revision(); revision > 0 {
+			w.Header().Set(csapitypes.RevisionHeader, strconv.FormatInt(revision, 10))
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *revisionResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher since it's used by streaming handlers like
+// the export handler
+func (w *revisionResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// revisionMiddleware is a mux middleware that returns the revision of the
+// changes written by the request in the revision header and, when the
+// minRevision query parameter is provided, waits for the readdb to apply the
+// requested revision before executing the request so a client can read its
+// own writes.
+func (s *Configstore) revisionMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if v := r.URL.Query().Get(csapitypes.MinRevisionParam); v != "" {
+			minRevision, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || minRevision < 0 {
+				api.HTTPError(w, r, util.NewErrBadRequest(errors.Errorf("wrong %s value %q", csapitypes.MinRevisionParam, v)))
+				return
+			}
+			wctx, cancel := context.WithTimeout(ctx, minRevisionTimeout)
+			err = s.readDB.WaitRevision(wctx, minRevision)
+			timedOut := wctx.Err() == context.DeadlineExceeded
+			cancel()
+			if err != nil {
+				if timedOut {
+					err = util.NewErrUnavailable(err)
+				}
+				api.HTTPError(w, r, err)
+				return
+			}
+		}
+
+		wr := &action.WriteRevision{}
+		rw := &revisionResponseWriter{ResponseWriter: w, wr: wr}
+		h.ServeHTTP(rw, r.WithContext(action.WithWriteRevision(ctx, wr)))
+	})
+}
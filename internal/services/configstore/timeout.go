@@ -0,0 +1,204 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configstore
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/internal/services/configstore/api"
+	"agola.io/agola/internal/util"
+
+	"github.com/gorilla/mux"
+	errors "golang.org/x/xerrors"
+)
+
+// timeoutResponseWriter forwards the handler response until the request
+// times out. When the request times out before the handler has written the
+// response header the timeout error is returned instead and the next handler
+// writes are discarded.
+type timeoutResponseWriter struct {
+	ctx context.Context
+	w   http.ResponseWriter
+	h   http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutResponseWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutResponseWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(status)
+}
+
+func (tw *timeoutResponseWriter) writeHeader(status int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	// a response written by the handler after the deadline, i.e. the error
+	// of its canceled work, is replaced by the timeout error
+	if tw.ctx.Err() == context.DeadlineExceeded {
+		tw.timedOut = true
+		return
+	}
+	tw.wroteHeader = true
+	dst := tw.w.Header()
+	for k, v := range tw.h {
+		dst[k] = v
+	}
+	tw.w.WriteHeader(status)
+}
+
+func (tw *timeoutResponseWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeader(http.StatusOK)
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	return tw.w.Write(b)
+}
+
+// Flush implements http.Flusher since it's used by streaming handlers like
+// the export handler
+func (tw *timeoutResponseWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// timeout marks the request as timed out. It returns false if the handler has
+// already started writing the response.
+func (tw *timeoutResponseWriter) timeout() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wroteHeader {
+		return false
+	}
+	tw.timedOut = true
+	return true
+}
+
+const (
+	eventsRouteName          = "events"
+	exportRouteName          = "export"
+	resourcesExportRouteName = "resourcesExport"
+)
+
+// longLivedRoutes are the names of the routes of the long lived requests that
+// aren't subject to the request timeouts: the events streams and the exports,
+// imports and repairs whose duration depends on the amount of data
+var longLivedRoutes = map[string]struct{}{
+	eventsRouteName:          {},
+	exportRouteName:          {},
+	importRouteName:          {},
+	resourcesExportRouteName: {},
+	resourcesImportRouteName: {},
+	selfCheckRepairRouteName: {},
+}
+
+// requestTimeout returns the timeout of the request, the read timeout for the
+// GET and HEAD requests and the write timeout for the others
+func requestTimeout(c *config.RequestTimeout, r *http.Request) time.Duration {
+	switch r.Method {
+	case "GET", "HEAD":
+		return c.Read
+	default:
+		return c.Write
+	}
+}
+
+// timeoutMiddleware is a mux middleware that cancels the request context when
+// the configured request timeout is exceeded. The handler work (readdb
+// queries, wal writes) is stopped by the context cancellation and a 504 error
+// is returned.
+// A streaming handler that has already started its response is only
+// cancelled, since a different status code cannot be sent anymore.
+func (s *Configstore) timeoutMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := requestTimeout(&s.c.RequestTimeout, r)
+		if route := mux.CurrentRoute(r); route != nil {
+			if _, ok := longLivedRoutes[route.GetName()]; ok {
+				timeout = 0
+			}
+		}
+		if timeout <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutResponseWriter{ctx: ctx, w: w, h: make(http.Header)}
+		done := make(chan struct{})
+		panicChan := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicChan <- p
+				}
+			}()
+			h.ServeHTTP(tw, r)
+			close(done)
+		}()
+
+		select {
+		case p := <-panicChan:
+			panic(p)
+		case <-done:
+			// the handler response could have been discarded if written
+			// after the deadline
+			if ctx.Err() == nil || !tw.timeout() {
+				return
+			}
+		case <-ctx.Done():
+			if !tw.timeout() {
+				// wait for the canceled streaming handler to complete
+				select {
+				case p := <-panicChan:
+					panic(p)
+				case <-done:
+				}
+				return
+			}
+		}
+
+		if ctx.Err() != context.DeadlineExceeded {
+			// the client went away
+			return
+		}
+		log.Warnf("request %s %s timed out after %s", r.Method, r.URL.Path, timeout)
+		api.HTTPError(w, r, util.NewErrTimeout(errors.Errorf("request timed out after %s", timeout)))
+	})
+}
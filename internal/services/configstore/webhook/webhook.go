@@ -0,0 +1,311 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+	"agola.io/agola/services/configstore/types"
+
+	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	DefaultMaxRetries    = 5
+	DefaultRetryInterval = 1 * time.Second
+
+	maxRetryInterval = 1 * time.Minute
+	requestTimeout   = 10 * time.Second
+	// flushTimeout is the max time spent delivering the queued events when
+	// the notifier is stopped
+	flushTimeout = 5 * time.Second
+
+	// queueSize is the max number of events waiting to be delivered to an
+	// endpoint. When full the new events are written to the dead letter log
+	queueSize = 1000
+)
+
+// notifiedTypes are the resource types whose changes are notified
+var notifiedTypes = map[types.ConfigType]struct{}{
+	types.ConfigTypeUser:         {},
+	types.ConfigTypeOrg:          {},
+	types.ConfigTypeOrgMember:    {},
+	types.ConfigTypeProjectGroup: {},
+	types.ConfigTypeProject:      {},
+	types.ConfigTypeRemoteSource: {},
+	types.ConfigTypeSecret:       {},
+	types.ConfigTypeVariable:     {},
+}
+
+type endpoint struct {
+	url   string
+	queue chan *csapitypes.ChangeEvent
+}
+
+// Notifier asynchronously delivers the configstore change events to the
+// configured webhook endpoints. Every endpoint has its own queue, so a slow or
+// unavailable endpoint doesn't delay the delivery to the others, and receives
+// the events in the order they are notified.
+// An event not delivered after the max retries is written to the dead letter
+// log.
+type Notifier struct {
+	log *zap.SugaredLogger
+
+	endpoints     []*endpoint
+	secret        []byte
+	maxRetries    int
+	retryInterval time.Duration
+	client        *http.Client
+
+	deadLetterFile string
+	deadLetterMu   sync.Mutex
+}
+
+// NewNotifier returns a notifier for the configured webhooks. When
+// c.DeadLetterFile is empty defaultDeadLetterFile is used
+func NewNotifier(logger *zap.Logger, c *config.ConfigstoreWebhooks, defaultDeadLetterFile string) *Notifier {
+	maxRetries := c.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	retryInterval := c.RetryInterval
+	if retryInterval == 0 {
+		retryInterval = DefaultRetryInterval
+	}
+	deadLetterFile := c.DeadLetterFile
+	if deadLetterFile == "" {
+		deadLetterFile = defaultDeadLetterFile
+	}
+
+	n := &Notifier{
+		log:            logger.Sugar(),
+		maxRetries:     maxRetries,
+		retryInterval:  retryInterval,
+		client:         &http.Client{Timeout: requestTimeout},
+		deadLetterFile: deadLetterFile,
+	}
+	if c.Secret != "" {
+		n.secret = []byte(c.Secret)
+	}
+	for _, u := range c.URLs {
+		n.endpoints = append(n.endpoints, &endpoint{url: u, queue: make(chan *csapitypes.ChangeEvent, queueSize)})
+	}
+	return n
+}
+
+// Notify queues the change events of the provided audit entries. It never
+// blocks: if the queue of an endpoint is full the event is written to the
+// dead letter log.
+func (n *Notifier) Notify(entries []*types.AuditEntry) {
+	for _, entry := range entries {
+		if _, ok := notifiedTypes[entry.ResourceType]; !ok {
+			continue
+		}
+		action := csapitypes.ChangeEventActionPut
+		if entry.Deleted {
+			action = csapitypes.ChangeEventActionDelete
+		}
+		event := &csapitypes.ChangeEvent{
+			ID:         entry.ID,
+			Time:       entry.Time,
+			Type:       entry.ResourceType,
+			Action:     action,
+			ResourceID: entry.ResourceID,
+			Operation:  entry.Operation,
+			Actor:      entry.Actor,
+		}
+
+		for _, e := range n.endpoints {
+			select {
+			case e.queue <- event:
+			default:
+				n.deadLetter(e.url, event, errors.Errorf("delivery queue full"))
+			}
+		}
+	}
+}
+
+// Run delivers the queued events until ctx is done. Then the events left in
+// the queues are delivered, without retries, for at most flushTimeout and the
+// undelivered ones are written to the dead letter log.
+func (n *Notifier) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, e := range n.endpoints {
+		e := e
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.deliverLoop(ctx, e)
+		}()
+	}
+	wg.Wait()
+}
+
+func (n *Notifier) deliverLoop(ctx context.Context, e *endpoint) {
+	for {
+		if ctx.Err() != nil {
+			n.flush(e)
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case event := <-e.queue:
+			if err := n.deliver(ctx, e.url, event); err != nil {
+				n.deadLetter(e.url, event, err)
+			}
+		}
+	}
+}
+
+// flush delivers the events left in the queue of e before flushTimeout
+func (n *Notifier) flush(e *endpoint) {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	for {
+		select {
+		case event := <-e.queue:
+			body, err := json.Marshal(event)
+			if err != nil {
+				n.deadLetter(e.url, event, errors.Errorf("failed to marshal event: %w", err))
+				continue
+			}
+			if err := n.send(ctx, e.url, body); err != nil {
+				n.deadLetter(e.url, event, errors.Errorf("notifier stopped: %w", err))
+			}
+		default:
+			return
+		}
+	}
+}
+
+// deliver sends the event to url retrying with an exponential backoff
+func (n *Notifier) deliver(ctx context.Context, url string, event *csapitypes.ChangeEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Errorf("failed to marshal event: %w", err)
+	}
+
+	interval := n.retryInterval
+	for i := 0; ; i++ {
+		err = n.send(ctx, url, body)
+		if err == nil {
+			return nil
+		}
+		if i >= n.maxRetries {
+			return err
+		}
+		n.log.Warnf("failed to deliver event %q to %q, retrying in %s: %v", event.ID, url, interval, err)
+
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("notifier stopped: %w", err)
+		case <-time.After(interval):
+		}
+		interval *= 2
+		if interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
+func (n *Notifier) send(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != nil {
+		req.Header.Set(csapitypes.SignatureHeader, Signature(n.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Signature returns the hex encoded HMAC-SHA256 of body
+func Signature(secret, body []byte) string {
+	h := hmac.New(sha256.New, secret)
+	_, _ = h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// deadLetterEntry is a line of the dead letter log
+type deadLetterEntry struct {
+	Time  time.Time               `json:"time"`
+	URL   string                  `json:"url"`
+	Event *csapitypes.ChangeEvent `json:"event"`
+	Error string                  `json:"error"`
+}
+
+// deadLetter appends the undeliverable event to the dead letter log
+func (n *Notifier) deadLetter(url string, event *csapitypes.ChangeEvent, deliveryErr error) {
+	n.log.Errorf("failed to deliver event %q to %q: %v", event.ID, url, deliveryErr)
+
+	if err := n.writeDeadLetter(&deadLetterEntry{Time: time.Now().UTC(), URL: url, Event: event, Error: deliveryErr.Error()}); err != nil {
+		n.log.Errorf("failed to write event %q to the dead letter log: %+v", event.ID, err)
+	}
+}
+
+func (n *Notifier) writeDeadLetter(entry *deadLetterEntry) error {
+	entryj, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Errorf("failed to marshal dead letter entry: %w", err)
+	}
+
+	n.deadLetterMu.Lock()
+	defer n.deadLetterMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(n.deadLetterFile), 0770); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(n.deadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(entryj, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
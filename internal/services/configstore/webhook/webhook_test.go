@@ -0,0 +1,262 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+	"agola.io/agola/services/configstore/types"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+type receivedRequest struct {
+	signature string
+	body      []byte
+}
+
+// receiver is a webhook endpoint failing the first failures requests
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	requests []*receivedRequest
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, &receivedRequest{signature: r.Header.Get(csapitypes.SignatureHeader), body: body})
+	if rc.failures != 0 {
+		rc.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (rc *receiver) waitRequests(t *testing.T, n int) []*receivedRequest {
+	for i := 0; i < 100; i++ {
+		rc.mu.Lock()
+		requests := rc.requests
+		rc.mu.Unlock()
+		if len(requests) >= n {
+			return requests
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d requests", n)
+	return nil
+}
+
+func readDeadLetter(t *testing.T, deadLetterFile string) []*deadLetterEntry {
+	f, err := os.Open(deadLetterFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer f.Close()
+
+	var entries []*deadLetterEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry *deadLetterEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestNotifierDeliver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	rc := &receiver{failures: 2}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+
+	n := NewNotifier(logger, &config.ConfigstoreWebhooks{URLs: []string{ts.URL}, Secret: "secret", RetryInterval: 10 * time.Millisecond}, filepath.Join(dir, "deadletter.log"))
+	go n.Run(ctx)
+
+	now := time.Now().UTC()
+	n.Notify([]*types.AuditEntry{
+		{ID: "entry01", Time: now, Actor: "user01", Operation: "create_project", ResourceType: types.ConfigTypeProject, ResourceID: "project01"},
+		// audit entries changes aren't notified
+		{ID: "entry02", Time: now, Operation: "create_project", ResourceType: types.ConfigTypeAuditEntry, ResourceID: "entry01"},
+		{ID: "entry03", Time: now, Operation: "delete_user", ResourceType: types.ConfigTypeUser, ResourceID: "user02", Deleted: true},
+	})
+
+	// two failed deliveries of the first event, then the two events
+	rc.waitRequests(t, 4)
+	// check that no other request is received
+	time.Sleep(200 * time.Millisecond)
+	requests := rc.waitRequests(t, 4)
+	if len(requests) != 4 {
+		t.Fatalf("expected 4 requests, got %d", len(requests))
+	}
+
+	expectedEvents := []*csapitypes.ChangeEvent{
+		{ID: "entry01", Time: now, Type: types.ConfigTypeProject, Action: csapitypes.ChangeEventActionPut, ResourceID: "project01", Operation: "create_project", Actor: "user01"},
+		{ID: "entry01", Time: now, Type: types.ConfigTypeProject, Action: csapitypes.ChangeEventActionPut, ResourceID: "project01", Operation: "create_project", Actor: "user01"},
+		{ID: "entry01", Time: now, Type: types.ConfigTypeProject, Action: csapitypes.ChangeEventActionPut, ResourceID: "project01", Operation: "create_project", Actor: "user01"},
+		{ID: "entry03", Time: now, Type: types.ConfigTypeUser, Action: csapitypes.ChangeEventActionDelete, ResourceID: "user02", Operation: "delete_user"},
+	}
+	events := []*csapitypes.ChangeEvent{}
+	for _, req := range requests {
+		if req.signature != Signature([]byte("secret"), req.body) {
+			t.Fatalf("wrong signature %q", req.signature)
+		}
+		var event *csapitypes.ChangeEvent
+		if err := json.Unmarshal(req.body, &event); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		events = append(events, event)
+	}
+	if diff := cmp.Diff(expectedEvents, events); diff != "" {
+		t.Fatalf("events mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "deadletter.log")); !os.IsNotExist(err) {
+		t.Fatalf("expected no dead letter log")
+	}
+}
+
+func TestNotifierDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	rc := &receiver{failures: -1}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+
+	deadLetterFile := filepath.Join(dir, "deadletter.log")
+	n := NewNotifier(logger, &config.ConfigstoreWebhooks{URLs: []string{ts.URL}, MaxRetries: 2, RetryInterval: 10 * time.Millisecond}, deadLetterFile)
+	go n.Run(ctx)
+
+	n.Notify([]*types.AuditEntry{
+		{ID: "entry01", Time: time.Now().UTC(), Operation: "create_user", ResourceType: types.ConfigTypeUser, ResourceID: "user01"},
+	})
+
+	// the first delivery and two retries
+	requests := rc.waitRequests(t, 3)
+	for _, req := range requests {
+		if req.signature != "" {
+			t.Fatalf("expected no signature without a secret, got %q", req.signature)
+		}
+	}
+
+	var entries []*deadLetterEntry
+	for i := 0; i < 100; i++ {
+		entries = readDeadLetter(t, deadLetterFile)
+		if len(entries) > 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 dead letter entry, got %d", len(entries))
+	}
+	if entries[0].URL != ts.URL || entries[0].Event.ID != "entry01" || entries[0].Error != "unexpected status code 500" {
+		t.Fatalf("unexpected dead letter entry: %+v", entries[0])
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(rc.requests))
+	}
+}
+
+func TestNotifierStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	rc := &receiver{}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	failingRC := &receiver{failures: -1}
+	failingTS := httptest.NewServer(failingRC)
+	defer failingTS.Close()
+
+	deadLetterFile := filepath.Join(dir, "deadletter.log")
+	n := NewNotifier(logger, &config.ConfigstoreWebhooks{URLs: []string{ts.URL, failingTS.URL}, RetryInterval: 10 * time.Millisecond}, deadLetterFile)
+
+	n.Notify([]*types.AuditEntry{
+		{ID: "entry01", Time: time.Now().UTC(), Operation: "create_user", ResourceType: types.ConfigTypeUser, ResourceID: "user01"},
+		{ID: "entry02", Time: time.Now().UTC(), Operation: "create_user", ResourceType: types.ConfigTypeUser, ResourceID: "user02"},
+		{ID: "entry03", Time: time.Now().UTC(), Operation: "create_user", ResourceType: types.ConfigTypeUser, ResourceID: "user03"},
+	})
+
+	// the queued events are flushed when the notifier is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n.Run(ctx)
+
+	// every event is sent once to every endpoint
+	if len(rc.requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(rc.requests))
+	}
+	if len(failingRC.requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(failingRC.requests))
+	}
+
+	// the events not delivered are written to the dead letter log
+	entries := readDeadLetter(t, deadLetterFile)
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 dead letter entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		expectedID := []string{"entry01", "entry02", "entry03"}[i]
+		if entry.URL != failingTS.URL || entry.Event.ID != expectedID || entry.Error != "notifier stopped: unexpected status code 500" {
+			t.Fatalf("unexpected dead letter entry: %+v", entry)
+		}
+	}
+}
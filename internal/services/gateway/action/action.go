@@ -58,6 +58,8 @@ func ErrFromRemote(resp *http.Response, err error) error {
 			return util.NewErrBadRequest(err)
 		case http.StatusNotFound:
 			return util.NewErrNotExist(err)
+		case http.StatusConflict:
+			return util.NewErrConflict(err)
 		}
 	}
 
@@ -20,7 +20,9 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"time"
 
+	"agola.io/agola/internal/config"
 	gitsource "agola.io/agola/internal/gitsources"
 	"agola.io/agola/internal/services/types"
 	"agola.io/agola/internal/util"
@@ -58,8 +60,15 @@ type CreateProjectRequest struct {
 	RepoPath            string
 	SkipSSHHostKeyCheck bool
 	PassVarsToForkedPR  bool
+	// ValidateConfig requires the repository default branch to contain a
+	// valid run config
+	ValidateConfig bool
 }
 
+// validateConfigTimeout is the max time spent fetching the repository run
+// config when validating it at project creation
+const validateConfigTimeout = 30 * time.Second
+
 func (h *ActionHandler) CreateProject(ctx context.Context, req *CreateProjectRequest) (*csapitypes.Project, error) {
 	curUserID := h.CurrentUserID(ctx)
 
@@ -131,6 +140,12 @@ func (h *ActionHandler) CreateProject(ctx context.Context, req *CreateProjectReq
 		return nil, errors.Errorf("failed to get repository info from gitsource: %w", err)
 	}
 
+	if req.ValidateConfig {
+		if err := h.validateRepoConfig(ctx, gitSource, req.RepoPath, repo.DefaultBranch); err != nil {
+			return nil, err
+		}
+	}
+
 	h.log.Infof("generating ssh key pairs")
 	privateKey, _, err := util.GenSSHKeyPair(4096)
 	if err != nil {
@@ -181,6 +196,75 @@ func (h *ActionHandler) CreateProject(ctx context.Context, req *CreateProjectReq
 	return rp, nil
 }
 
+// validateRepoConfig fetches the run config from the repository branch and
+// checks that it can be parsed
+func (h *ActionHandler) validateRepoConfig(ctx context.Context, gitSource gitsource.GitSource, repoPath, branch string) error {
+	if branch == "" {
+		return util.NewErrBadRequest(errors.Errorf("cannot validate the run config: unknown default branch of repository %q", repoPath))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, validateConfigTimeout)
+	defer cancel()
+
+	data, filename, err := h.fetchRefConfigFile(ctx, gitSource, repoPath, branch)
+	if err != nil {
+		return err
+	}
+
+	configContext := &config.ConfigContext{
+		RefType: types.RunRefTypeBranch,
+		Ref:     gitSource.BranchRef(branch),
+		Branch:  branch,
+	}
+	if _, err := config.ParseConfig(data, configFileFormat(filename), configContext); err != nil {
+		return util.NewErrBadRequest(errors.Errorf("invalid run config %q in branch %q of repository %q: %w", path.Join(agolaDefaultConfigDir, filename), branch, repoPath, err))
+	}
+
+	return nil
+}
+
+// fetchRefConfigFile returns the first config file found in the repository
+// ref. Since the gitsource calls aren't context aware they are executed in a
+// goroutine that's left behind if the ctx is done before they return.
+func (h *ActionHandler) fetchRefConfigFile(ctx context.Context, gitSource gitsource.GitSource, repoPath, ref string) ([]byte, string, error) {
+	type configFile struct {
+		data     []byte
+		filename string
+		err      error
+	}
+
+	fileCh := make(chan configFile, 1)
+	go func() {
+		var err error
+		for _, filename := range agolaDefaultConfigFiles {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			var data []byte
+			data, err = gitSource.GetFile(repoPath, ref, path.Join(agolaDefaultConfigDir, filename))
+			if err == nil {
+				fileCh <- configFile{data: data, filename: filename}
+				return
+			}
+			h.log.Debugf("get file %q err: %v", filename, err)
+		}
+		fileCh <- configFile{err: err}
+	}()
+
+	var f configFile
+	select {
+	case <-ctx.Done():
+	case f = <-fileCh:
+	}
+	if ctx.Err() != nil {
+		return nil, "", errors.Errorf("failed to fetch run config from repository %q: %w", repoPath, ctx.Err())
+	}
+	if f.err != nil {
+		return nil, "", util.NewErrBadRequest(errors.Errorf("no run config found in dir %q of repository %q ref %q: %w", agolaDefaultConfigDir, repoPath, ref, f.err))
+	}
+	return f.data, f.filename, nil
+}
+
 type UpdateProjectRequest struct {
 	Name      *string
 	ParentRef *string
@@ -0,0 +1,176 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package action
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	gitsource "agola.io/agola/internal/gitsources"
+	"agola.io/agola/internal/util"
+
+	"go.uber.org/zap"
+)
+
+// testGitSource is a gitsource returning the files of a single repository
+// branch
+type testGitSource struct {
+	gitsource.GitSource
+
+	branch string
+	files  map[string]string
+	// block, when not nil, blocks GetFile until closed
+	block chan struct{}
+}
+
+func (s *testGitSource) GetFile(repopath, commit, file string) ([]byte, error) {
+	if s.block != nil {
+		<-s.block
+	}
+	if commit != s.branch {
+		return nil, fmt.Errorf("ref %q doesn't exist", commit)
+	}
+	data, ok := s.files[file]
+	if !ok {
+		return nil, fmt.Errorf("file %q doesn't exist", file)
+	}
+	return []byte(data), nil
+}
+
+func (s *testGitSource) BranchRef(branch string) string {
+	return "refs/heads/" + branch
+}
+
+func TestValidateRepoConfig(t *testing.T) {
+	validConfig := `
+runs:
+  - name: run01
+    tasks:
+      - name: task01
+        runtime:
+          type: pod
+          containers:
+            - image: busybox
+`
+	invalidConfig := `
+runs:
+  - name: run01
+    tasks:
+      - name: task01
+        runtime:
+          type: pod
+          containers:
+            - image: busybox
+        depends:
+          - task02
+`
+
+	tests := []struct {
+		name   string
+		branch string
+		files  map[string]string
+		err    string
+	}{
+		{
+			name:   "test valid yaml config",
+			branch: "master",
+			files:  map[string]string{path.Join(agolaDefaultConfigDir, agolaDefaultYamlConfigFile): validConfig},
+		},
+		{
+			name:   "test valid config file has precedence over an invalid one",
+			branch: "master",
+			files: map[string]string{
+				path.Join(agolaDefaultConfigDir, agolaDefaultJsonConfigFile): validConfig,
+				path.Join(agolaDefaultConfigDir, agolaDefaultYamlConfigFile): invalidConfig,
+			},
+		},
+		{
+			name:   "test invalid yaml config",
+			branch: "master",
+			files:  map[string]string{path.Join(agolaDefaultConfigDir, agolaDefaultYamlConfigFile): invalidConfig},
+			err:    `invalid run config ".agola/config.yml" in branch "master" of repository "user01/repo01": run task "task02" needed by task "task01" doesn't exist`,
+		},
+		{
+			name:   "test invalid jsonnet config",
+			branch: "master",
+			files:  map[string]string{path.Join(agolaDefaultConfigDir, agolaDefaultJsonnetConfigFile): `{ runs: [`},
+			err:    `invalid run config ".agola/config.jsonnet" in branch "master" of repository "user01/repo01"`,
+		},
+		{
+			name:   "test missing config",
+			branch: "master",
+			err:    `no run config found in dir ".agola" of repository "user01/repo01" ref "master"`,
+		},
+		{
+			name: "test unknown default branch",
+			err:  `cannot validate the run config: unknown default branch of repository "user01/repo01"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &ActionHandler{log: zap.NewNop().Sugar()}
+			gitSource := &testGitSource{branch: tt.branch, files: tt.files}
+
+			err := h.validateRepoConfig(context.Background(), gitSource, "user01/repo01", tt.branch)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected err %q, got no error", tt.err)
+			}
+			if !util.IsBadRequest(err) {
+				t.Fatalf("expected bad request error, got: %v", err)
+			}
+			if !strings.HasPrefix(err.Error(), tt.err) {
+				t.Fatalf("expected err %q, got: %v", tt.err, err)
+			}
+		})
+	}
+
+	t.Run("test fetch respects the context timeout", func(t *testing.T) {
+		h := &ActionHandler{log: zap.NewNop().Sugar()}
+		block := make(chan struct{})
+		defer close(block)
+		gitSource := &testGitSource{
+			branch: "master",
+			files:  map[string]string{path.Join(agolaDefaultConfigDir, agolaDefaultYamlConfigFile): validConfig},
+			block:  block,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := h.validateRepoConfig(ctx, gitSource, "user01/repo01", "master")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded error, got: %v", err)
+		}
+		if util.IsBadRequest(err) {
+			t.Fatalf("unexpected bad request error: %v", err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Fatalf("expected validation to stop at the context deadline, took %s", d)
+		}
+	})
+}
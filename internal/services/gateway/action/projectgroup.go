@@ -159,7 +159,8 @@ func (h *ActionHandler) DeleteProjectGroup(ctx context.Context, projectRef strin
 		return util.NewErrForbidden(errors.Errorf("user not authorized"))
 	}
 
-	resp, err = h.configstoreClient.DeleteProjectGroup(ctx, projectRef)
+	// also delete all the project group childs
+	resp, err = h.configstoreClient.DeleteProjectGroup(ctx, projectRef, true)
 	if err != nil {
 		return ErrFromRemote(resp, err)
 	}
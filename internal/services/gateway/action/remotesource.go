@@ -57,6 +57,10 @@ type CreateRemoteSourceRequest struct {
 	SkipSSHHostKeyCheck bool
 	RegistrationEnabled *bool
 	LoginEnabled        *bool
+
+	GithubAppID             int64
+	GithubAppInstallationID int64
+	GithubAppPrivateKey     string
 }
 
 func (h *ActionHandler) CreateRemoteSource(ctx context.Context, req *CreateRemoteSourceRequest) (*cstypes.RemoteSource, error) {
@@ -94,6 +98,17 @@ func (h *ActionHandler) CreateRemoteSource(ctx context.Context, req *CreateRemot
 			return nil, util.NewErrBadRequest(errors.Errorf("remotesource oauth2 client secret required"))
 		}
 	}
+	if req.AuthType == string(cstypes.RemoteSourceAuthTypeGithubApp) {
+		if req.GithubAppID <= 0 {
+			return nil, util.NewErrBadRequest(errors.Errorf("remotesource github app id required"))
+		}
+		if req.GithubAppInstallationID <= 0 {
+			return nil, util.NewErrBadRequest(errors.Errorf("remotesource github app installation id required"))
+		}
+		if req.GithubAppPrivateKey == "" {
+			return nil, util.NewErrBadRequest(errors.Errorf("remotesource github app private key required"))
+		}
+	}
 
 	rs := &cstypes.RemoteSource{
 		Name:                req.Name,
@@ -107,6 +122,10 @@ func (h *ActionHandler) CreateRemoteSource(ctx context.Context, req *CreateRemot
 		SkipSSHHostKeyCheck: req.SkipSSHHostKeyCheck,
 		RegistrationEnabled: req.RegistrationEnabled,
 		LoginEnabled:        req.LoginEnabled,
+
+		GithubAppID:             req.GithubAppID,
+		GithubAppInstallationID: req.GithubAppInstallationID,
+		GithubAppPrivateKey:     req.GithubAppPrivateKey,
 	}
 
 	h.log.Infof("creating remotesource")
@@ -70,6 +70,10 @@ const (
 
 var (
 	SkipRunMessage = regexp.MustCompile(`.*\[ci skip\].*`)
+
+	// agolaDefaultConfigFiles are the config files looked up in the config
+	// dir, in order of precedence
+	agolaDefaultConfigFiles = []string{agolaDefaultStarlarkConfigFile, agolaDefaultJsonnetConfigFile, agolaDefaultJsonConfigFile, agolaDefaultYamlConfigFile}
 )
 
 func (h *ActionHandler) GetRun(ctx context.Context, runID string) (*rsapitypes.RunResponse, error) {
@@ -482,24 +486,17 @@ func (h *ActionHandler) CreateRuns(ctx context.Context, req *CreateRunRequest) e
 		cacheGroup = req.User.ID + "-" + req.UserRunRepoUUID
 	}
 
-	data, filename, err := h.fetchConfigFiles(ctx, req.GitSource, req.RepoPath, req.CommitSHA)
+	var configPath string
+	if req.RunType == itypes.RunTypeProject {
+		configPath = req.Project.ConfigPath
+	}
+	data, filename, err := h.fetchConfigFiles(ctx, req.GitSource, req.RepoPath, req.CommitSHA, configPath)
 	if err != nil {
 		return util.NewErrInternal(errors.Errorf("failed to fetch config file: %w", err))
 	}
 	h.log.Debug("data: %s", data)
 
-	var configFormat config.ConfigFormat
-	switch path.Ext(filename) {
-	case ".star":
-		configFormat = config.ConfigFormatStarlark
-	case ".jsonnet":
-		configFormat = config.ConfigFormatJsonnet
-	case ".json":
-		fallthrough
-	case ".yml":
-		configFormat = config.ConfigFormatJSON
-
-	}
+	configFormat := configFileFormat(filename)
 
 	configContext := &config.ConfigContext{
 		RefType:       req.RefType,
@@ -565,13 +562,27 @@ func (h *ActionHandler) CreateRuns(ctx context.Context, req *CreateRunRequest) e
 	return nil
 }
 
-func (h *ActionHandler) fetchConfigFiles(ctx context.Context, gitSource gitsource.GitSource, repopath, commitSHA string) ([]byte, string, error) {
+// projectConfigFiles returns the paths of the run config files looked up in
+// the repository. The project config path, when set, replaces the default
+// config files
+func projectConfigFiles(configPath string) []string {
+	if configPath != "" {
+		return []string{configPath}
+	}
+	files := make([]string, 0, len(agolaDefaultConfigFiles))
+	for _, filename := range agolaDefaultConfigFiles {
+		files = append(files, path.Join(agolaDefaultConfigDir, filename))
+	}
+	return files
+}
+
+func (h *ActionHandler) fetchConfigFiles(ctx context.Context, gitSource gitsource.GitSource, repopath, commitSHA, configPath string) ([]byte, string, error) {
 	var data []byte
 	var filename string
 	err := util.ExponentialBackoff(ctx, util.FetchFileBackoff, func() (bool, error) {
-		for _, filename = range []string{agolaDefaultStarlarkConfigFile, agolaDefaultJsonnetConfigFile, agolaDefaultJsonConfigFile, agolaDefaultYamlConfigFile} {
+		for _, filename = range projectConfigFiles(configPath) {
 			var err error
-			data, err = gitSource.GetFile(repopath, commitSHA, path.Join(agolaDefaultConfigDir, filename))
+			data, err = gitSource.GetFile(repopath, commitSHA, filename)
 			if err == nil {
 				return true, nil
 			}
@@ -585,6 +596,19 @@ func (h *ActionHandler) fetchConfigFiles(ctx context.Context, gitSource gitsourc
 	return data, filename, nil
 }
 
+// configFileFormat returns the config format of the config file based on its
+// extension
+func configFileFormat(filename string) config.ConfigFormat {
+	switch path.Ext(filename) {
+	case ".star":
+		return config.ConfigFormatStarlark
+	case ".jsonnet":
+		return config.ConfigFormatJsonnet
+	default:
+		return config.ConfigFormatJSON
+	}
+}
+
 func (h *ActionHandler) genRunVariables(ctx context.Context, req *CreateRunRequest) (map[string]string, error) {
 	variables := map[string]string{}
 
@@ -598,7 +622,7 @@ func (h *ActionHandler) genRunVariables(ctx context.Context, req *CreateRunReque
 	pvars = common.FilterOverriddenVariables(pvars)
 
 	// get project secrets
-	secrets, _, err := h.configstoreClient.GetProjectSecrets(ctx, req.Project.ID, true)
+	secrets, _, err := h.configstoreClient.GetProjectSecrets(ctx, req.Project.ID, true, true)
 	if err != nil {
 		return nil, errors.Errorf("failed to get project secrets: %w", err)
 	}
@@ -273,8 +273,14 @@ func (h *ActionHandler) RefreshLinkedAccount(ctx context.Context, rs *cstypes.Re
 				la.Oauth2RefreshToken = token.RefreshToken
 				la.Oauth2AccessTokenExpiresAt = token.Expiry
 
-				if err := h.UpdateUserLA(ctx, userName, la); err != nil {
-					return nil, errors.Errorf("failed to update linked account: %w", err)
+				creq := &csapitypes.UpdateUserLATokenRequest{
+					UserAccessToken:            la.UserAccessToken,
+					Oauth2AccessToken:          la.Oauth2AccessToken,
+					Oauth2RefreshToken:         la.Oauth2RefreshToken,
+					Oauth2AccessTokenExpiresAt: la.Oauth2AccessTokenExpiresAt,
+				}
+				if _, resp, err := h.configstoreClient.UpdateUserLAToken(ctx, userName, la.ID, creq); err != nil {
+					return nil, errors.Errorf("failed to update linked account: %w", ErrFromRemote(resp, err))
 				}
 			}
 		}
@@ -584,6 +590,24 @@ func (h *ActionHandler) HandleRemoteSourceAuth(ctx context.Context, remoteSource
 			Response: cres.Response,
 		}, nil
 
+	case cstypes.RemoteSourceAuthTypeToken:
+		// the password is the user personal access token, it's checked
+		// getting the remote user info
+		if loginPassword == "" {
+			return nil, util.NewErrBadRequest(errors.Errorf("remotesource %q access token required", rs.Name))
+		}
+		requestj, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		cres, err := h.HandleRemoteSourceAuthRequest(ctx, requestType, string(requestj), loginPassword, "", "", time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		return &RemoteSourceAuthResponse{
+			Response: cres.Response,
+		}, nil
+
 	default:
 		return nil, errors.Errorf("unknown remote source authentication type: %q", rs.AuthType)
 	}
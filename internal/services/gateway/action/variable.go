@@ -45,7 +45,7 @@ func (h *ActionHandler) GetVariables(ctx context.Context, req *GetVariablesReque
 		if err != nil {
 			return nil, nil, ErrFromRemote(resp, err)
 		}
-		cssecrets, resp, err = h.configstoreClient.GetProjectGroupSecrets(ctx, req.ParentRef, true)
+		cssecrets, resp, err = h.configstoreClient.GetProjectGroupSecrets(ctx, req.ParentRef, true, false)
 		if err != nil {
 			return nil, nil, ErrFromRemote(resp, err)
 		}
@@ -56,7 +56,7 @@ func (h *ActionHandler) GetVariables(ctx context.Context, req *GetVariablesReque
 		if err != nil {
 			return nil, nil, ErrFromRemote(resp, err)
 		}
-		cssecrets, resp, err = h.configstoreClient.GetProjectSecrets(ctx, req.ParentRef, true)
+		cssecrets, resp, err = h.configstoreClient.GetProjectSecrets(ctx, req.ParentRef, true, false)
 		if err != nil {
 			return nil, nil, ErrFromRemote(resp, err)
 		}
@@ -112,7 +112,7 @@ func (h *ActionHandler) CreateVariable(ctx context.Context, req *CreateVariableR
 	case cstypes.ConfigTypeProjectGroup:
 		var err error
 		var resp *http.Response
-		cssecrets, resp, err = h.configstoreClient.GetProjectGroupSecrets(ctx, req.ParentRef, true)
+		cssecrets, resp, err = h.configstoreClient.GetProjectGroupSecrets(ctx, req.ParentRef, true, false)
 		if err != nil {
 			return nil, nil, errors.Errorf("failed to get project group %q secrets: %w", req.ParentRef, ErrFromRemote(resp, err))
 		}
@@ -125,7 +125,7 @@ func (h *ActionHandler) CreateVariable(ctx context.Context, req *CreateVariableR
 	case cstypes.ConfigTypeProject:
 		var err error
 		var resp *http.Response
-		cssecrets, resp, err = h.configstoreClient.GetProjectSecrets(ctx, req.ParentRef, true)
+		cssecrets, resp, err = h.configstoreClient.GetProjectSecrets(ctx, req.ParentRef, true, false)
 		if err != nil {
 			return nil, nil, errors.Errorf("failed to get project %q secrets: %w", req.ParentRef, ErrFromRemote(resp, err))
 		}
@@ -185,7 +185,7 @@ func (h *ActionHandler) UpdateVariable(ctx context.Context, req *UpdateVariableR
 	case cstypes.ConfigTypeProjectGroup:
 		var err error
 		var resp *http.Response
-		cssecrets, resp, err = h.configstoreClient.GetProjectGroupSecrets(ctx, req.ParentRef, true)
+		cssecrets, resp, err = h.configstoreClient.GetProjectGroupSecrets(ctx, req.ParentRef, true, false)
 		if err != nil {
 			return nil, nil, errors.Errorf("failed to get project group %q secrets: %w", req.ParentRef, ErrFromRemote(resp, err))
 		}
@@ -198,7 +198,7 @@ func (h *ActionHandler) UpdateVariable(ctx context.Context, req *UpdateVariableR
 	case cstypes.ConfigTypeProject:
 		var err error
 		var resp *http.Response
-		cssecrets, resp, err = h.configstoreClient.GetProjectSecrets(ctx, req.ParentRef, true)
+		cssecrets, resp, err = h.configstoreClient.GetProjectSecrets(ctx, req.ParentRef, true, false)
 		if err != nil {
 			return nil, nil, errors.Errorf("failed to get project %q secrets: %w", req.ParentRef, ErrFromRemote(resp, err))
 		}
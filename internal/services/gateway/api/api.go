@@ -50,6 +50,10 @@ func ErrorResponseFromError(err error) *ErrorResponse {
 		var cerr *util.ErrUnauthorized
 		errors.As(err, &cerr)
 		aerr = cerr
+	case util.IsConflict(err):
+		var cerr *util.ErrConflict
+		errors.As(err, &cerr)
+		aerr = cerr
 	case util.IsInternal(err):
 		var cerr *util.ErrInternal
 		errors.As(err, &cerr)
@@ -88,6 +92,9 @@ func httpError(w http.ResponseWriter, err error) bool {
 	case util.IsUnauthorized(err):
 		w.WriteHeader(http.StatusUnauthorized)
 		_, _ = w.Write(resj)
+	case util.IsConflict(err):
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write(resj)
 	case util.IsInternal(err):
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write(resj)
@@ -56,6 +56,7 @@ func (h *CreateProjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		RemoteSourceName:    req.RemoteSourceName,
 		SkipSSHHostKeyCheck: req.SkipSSHHostKeyCheck,
 		PassVarsToForkedPR:  req.PassVarsToForkedPR,
+		ValidateConfig:      req.ValidateConfig,
 	}
 
 	project, err := h.ah.CreateProject(ctx, areq)
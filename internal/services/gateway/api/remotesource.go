@@ -60,6 +60,10 @@ func (h *CreateRemoteSourceHandler) ServeHTTP(w http.ResponseWriter, r *http.Req
 		SkipSSHHostKeyCheck: req.SkipSSHHostKeyCheck,
 		RegistrationEnabled: req.RegistrationEnabled,
 		LoginEnabled:        req.LoginEnabled,
+
+		GithubAppID:             req.GithubAppID,
+		GithubAppInstallationID: req.GithubAppInstallationID,
+		GithubAppPrivateKey:     req.GithubAppPrivateKey,
 	}
 	rs, err := h.ah.CreateRemoteSource(ctx, creq)
 	if httpError(w, err) {
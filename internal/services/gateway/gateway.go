@@ -121,12 +121,15 @@ func NewGateway(ctx context.Context, l *zap.Logger, gc *config.Config) (*Gateway
 		return nil, errors.Errorf("unknown token signing method: %q", c.TokenSigning.Method)
 	}
 
-	ost, err := scommon.NewObjectStorage(&c.ObjectStorage)
+	ost, err := scommon.NewObjectStorage(ctx, logger, &c.ObjectStorage)
 	if err != nil {
 		return nil, err
 	}
 
 	configstoreClient := csclient.NewClient(c.ConfigstoreURL)
+	if c.ConfigstoreToken != "" {
+		configstoreClient.SetToken(c.ConfigstoreToken)
+	}
 	runserviceClient := rsclient.NewClient(c.RunserviceURL)
 
 	ah := action.NewActionHandler(logger, sd, configstoreClient, runserviceClient, gc.ID, c.APIExposedURL, c.WebExposedURL)
@@ -148,10 +151,11 @@ func (g *Gateway) Run(ctx context.Context) error {
 	}
 
 	if len(g.c.Web.AllowedOrigins) > 0 {
-		corsAllowedMethodsOptions := ghandlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE"})
-		corsAllowedHeadersOptions := ghandlers.AllowedHeaders([]string{"Accept", "Accept-Encoding", "Authorization", "Content-Length", "Content-Type", "X-CSRF-Token", "Authorization"})
+		corsAllowedMethodsOptions := ghandlers.AllowedMethods(g.c.Web.CORSAllowedMethods())
+		corsAllowedHeadersOptions := ghandlers.AllowedHeaders(g.c.Web.CORSAllowedHeaders())
 		corsAllowedOriginsOptions := ghandlers.AllowedOrigins(g.c.Web.AllowedOrigins)
-		corsHandler = ghandlers.CORS(corsAllowedMethodsOptions, corsAllowedHeadersOptions, corsAllowedOriginsOptions)
+		corsMaxAgeOptions := ghandlers.MaxAge(g.c.Web.CORSMaxAge())
+		corsHandler = ghandlers.CORS(corsAllowedMethodsOptions, corsAllowedHeadersOptions, corsAllowedOriginsOptions, corsMaxAgeOptions)
 	}
 
 	webhooksHandler := api.NewWebhooksHandler(logger, g.ah, g.configstoreClient, g.runserviceClient, g.c.APIExposedURL)
@@ -28,6 +28,11 @@ import (
 	errors "golang.org/x/xerrors"
 )
 
+// adminTokenActor is the actor recorded in the configstore audit entries for
+// the requests authenticated with the admin token. It isn't a valid user name
+// so it cannot be confused with a real user.
+const adminTokenActor = "<admintoken>"
+
 type AuthHandler struct {
 	log  *zap.SugaredLogger
 	next http.Handler
@@ -60,6 +65,7 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if h.adminToken != "" && tokenString != "" {
 		if tokenString == h.adminToken {
 			ctx = context.WithValue(ctx, "admin", true)
+			ctx = csclient.WithActor(ctx, adminTokenActor)
 			h.next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		} else {
@@ -76,6 +82,7 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// pass userid to handlers via context
 			ctx = context.WithValue(ctx, "userid", user.ID)
 			ctx = context.WithValue(ctx, "username", user.Name)
+			ctx = csclient.WithActor(ctx, user.Name)
 
 			if user.Admin {
 				ctx = context.WithValue(ctx, "admin", true)
@@ -130,6 +137,7 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// pass userid and username to handlers via context
 		ctx = context.WithValue(ctx, "userid", user.ID)
 		ctx = context.WithValue(ctx, "username", user.Name)
+		ctx = csclient.WithActor(ctx, user.Name)
 
 		if user.Admin {
 			ctx = context.WithValue(ctx, "admin", true)
@@ -59,6 +59,9 @@ func NewNotificationService(ctx context.Context, l *zap.Logger, gc *config.Confi
 	}
 
 	configstoreClient := csclient.NewClient(c.ConfigstoreURL)
+	if c.ConfigstoreToken != "" {
+		configstoreClient.SetToken(c.ConfigstoreToken)
+	}
 	runserviceClient := rsclient.NewClient(c.RunserviceURL)
 
 	return &NotificationService{
@@ -75,6 +78,9 @@ func (n *NotificationService) Run(ctx context.Context) error {
 
 	<-ctx.Done()
 	log.Infof("notification service exiting")
+	if err := n.e.Close(); err != nil {
+		log.Errorf("failed to close etcd store: %+v", err)
+	}
 
 	return nil
 }
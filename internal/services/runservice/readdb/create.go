@@ -14,6 +14,9 @@
 
 package readdb
 
+// dbVersion is the readdb schema version
+const dbVersion = 1
+
 var Stmts = []string{
 	// last processed etcd event revision
 	"create table revision (revision bigint, PRIMARY KEY(revision))",
@@ -168,7 +168,7 @@ func (r *ReadDB) ResetDB(ctx context.Context) error {
 	}
 
 	// populate readdb
-	if err := rdb.Create(ctx, Stmts); err != nil {
+	if err := rdb.Create(ctx, dbVersion, Stmts); err != nil {
 		return err
 	}
 
@@ -258,7 +258,7 @@ func (r *ReadDB) Run(ctx context.Context) error {
 	r.rdb = rdb
 
 	// populate readdb
-	if err := r.rdb.Create(ctx, Stmts); err != nil {
+	if err := r.rdb.Create(ctx, dbVersion, Stmts); err != nil {
 		return err
 	}
 
@@ -690,6 +690,10 @@ func (r *ReadDB) SyncFromDump(ctx context.Context) (string, error) {
 					dumpf.Close()
 					return "", err
 				}
+				if err := r.dm.MigrateDataEntry(de); err != nil {
+					dumpf.Close()
+					return "", err
+				}
 				dumpEntries = append(dumpEntries, de)
 			}
 			dumpf.Close()
@@ -883,6 +887,9 @@ func (r *ReadDB) applyWal(tx *db.Tx, walDataFileID string) error {
 		if err != nil {
 			return errors.Errorf("failed to decode wal file: %w", err)
 		}
+		if err := r.dm.MigrateAction(action); err != nil {
+			return err
+		}
 
 		if err := r.applyAction(tx, action); err != nil {
 			return err
@@ -156,7 +156,7 @@ func NewRunservice(ctx context.Context, l *zap.Logger, c *config.Runservice) (*R
 	}
 	log = logger.Sugar()
 
-	ost, err := scommon.NewObjectStorage(&c.ObjectStorage)
+	ost, err := scommon.NewObjectStorage(ctx, logger, &c.ObjectStorage)
 	if err != nil {
 		return nil, err
 	}
@@ -312,6 +312,9 @@ func (s *Runservice) Run(ctx context.Context) error {
 		select {
 		case <-ctx.Done():
 			log.Infof("runservice exiting")
+			if err := s.e.Close(); err != nil {
+				log.Errorf("failed to close etcd store: %+v", err)
+			}
 			return nil
 		case <-sleepCh:
 		}
@@ -150,6 +150,171 @@ func IsUnauthorized(err error) bool {
 	return errors.Is(err, &ErrUnauthorized{})
 }
 
+// ErrConflict represent an error caused by a conflict with the current state
+// of a resource (i.e. a duplicate name)
+// it's used to differentiate an internal error from an user error
+type ErrConflict struct {
+	Err error
+}
+
+func (e *ErrConflict) Error() string {
+	return e.Err.Error()
+}
+
+func NewErrConflict(err error) *ErrConflict {
+	return &ErrConflict{Err: err}
+}
+
+func (*ErrConflict) Is(err error) bool {
+	_, ok := err.(*ErrConflict)
+	return ok
+}
+
+func IsConflict(err error) bool {
+	return errors.Is(err, &ErrConflict{})
+}
+
+// ErrPreconditionFailed represent an error caused by a failed precondition
+// provided by the user (i.e. a resource changed since it was read)
+// it's used to differentiate an internal error from an user error
+type ErrPreconditionFailed struct {
+	Err error
+}
+
+func (e *ErrPreconditionFailed) Error() string {
+	return e.Err.Error()
+}
+
+func NewErrPreconditionFailed(err error) *ErrPreconditionFailed {
+	return &ErrPreconditionFailed{Err: err}
+}
+
+func (*ErrPreconditionFailed) Is(err error) bool {
+	_, ok := err.(*ErrPreconditionFailed)
+	return ok
+}
+
+func IsPreconditionFailed(err error) bool {
+	return errors.Is(err, &ErrPreconditionFailed{})
+}
+
+// ErrTooManyRequests represent an error caused by a client exceeding the
+// allowed requests rate
+// it's used to differentiate an internal error from an user error
+type ErrTooManyRequests struct {
+	Err error
+}
+
+func (e *ErrTooManyRequests) Error() string {
+	return e.Err.Error()
+}
+
+func NewErrTooManyRequests(err error) *ErrTooManyRequests {
+	return &ErrTooManyRequests{Err: err}
+}
+
+func (*ErrTooManyRequests) Is(err error) bool {
+	_, ok := err.(*ErrTooManyRequests)
+	return ok
+}
+
+func IsTooManyRequests(err error) bool {
+	return errors.Is(err, &ErrTooManyRequests{})
+}
+
+// ErrRequestTooLarge represent an error caused by a request body exceeding
+// the allowed size
+// it's used to differentiate an internal error from an user error
+type ErrRequestTooLarge struct {
+	Err error
+}
+
+func (e *ErrRequestTooLarge) Error() string {
+	return e.Err.Error()
+}
+
+func NewErrRequestTooLarge(err error) *ErrRequestTooLarge {
+	return &ErrRequestTooLarge{Err: err}
+}
+
+func (*ErrRequestTooLarge) Is(err error) bool {
+	_, ok := err.(*ErrRequestTooLarge)
+	return ok
+}
+
+func IsRequestTooLarge(err error) bool {
+	return errors.Is(err, &ErrRequestTooLarge{})
+}
+
+// ErrUnavailable represent an error caused by a temporary unavailability of
+// the service. The client can retry the request later.
+type ErrUnavailable struct {
+	Err error
+}
+
+func (e *ErrUnavailable) Error() string {
+	return e.Err.Error()
+}
+
+func NewErrUnavailable(err error) *ErrUnavailable {
+	return &ErrUnavailable{Err: err}
+}
+
+func (*ErrUnavailable) Is(err error) bool {
+	_, ok := err.(*ErrUnavailable)
+	return ok
+}
+
+func IsUnavailable(err error) bool {
+	return errors.Is(err, &ErrUnavailable{})
+}
+
+// ErrTimeout represent an error caused by a request not completed in the
+// allowed time
+type ErrTimeout struct {
+	Err error
+}
+
+func (e *ErrTimeout) Error() string {
+	return e.Err.Error()
+}
+
+func NewErrTimeout(err error) *ErrTimeout {
+	return &ErrTimeout{Err: err}
+}
+
+func (*ErrTimeout) Is(err error) bool {
+	_, ok := err.(*ErrTimeout)
+	return ok
+}
+
+func IsTimeout(err error) bool {
+	return errors.Is(err, &ErrTimeout{})
+}
+
+// ErrMisdirectedRequest represent an error caused by a request sent to a
+// service instance that cannot serve it (i.e. a write sent to a read replica)
+type ErrMisdirectedRequest struct {
+	Err error
+}
+
+func (e *ErrMisdirectedRequest) Error() string {
+	return e.Err.Error()
+}
+
+func NewErrMisdirectedRequest(err error) *ErrMisdirectedRequest {
+	return &ErrMisdirectedRequest{Err: err}
+}
+
+func (*ErrMisdirectedRequest) Is(err error) bool {
+	_, ok := err.(*ErrMisdirectedRequest)
+	return ok
+}
+
+func IsMisdirectedRequest(err error) bool {
+	return errors.Is(err, &ErrMisdirectedRequest{})
+}
+
 type ErrInternal struct {
 	Err error
 }
@@ -171,3 +336,112 @@ func (*ErrInternal) Is(err error) bool {
 func IsInternal(err error) bool {
 	return errors.Is(err, &ErrInternal{})
 }
+
+// ErrorCode is a stable machine readable error code returned by the api
+type ErrorCode string
+
+const (
+	ErrorCodeBadRequest         ErrorCode = "bad_request"
+	ErrorCodeNotExist           ErrorCode = "not_exist"
+	ErrorCodeForbidden          ErrorCode = "forbidden"
+	ErrorCodeUnauthorized       ErrorCode = "unauthorized"
+	ErrorCodeConflict           ErrorCode = "conflict"
+	ErrorCodePreconditionFailed ErrorCode = "precondition_failed"
+	ErrorCodeTooManyRequests    ErrorCode = "too_many_requests"
+	ErrorCodeRequestTooLarge    ErrorCode = "request_too_large"
+	ErrorCodeUnavailable        ErrorCode = "unavailable"
+	ErrorCodeTimeout            ErrorCode = "timeout"
+	ErrorCodeMisdirectedRequest ErrorCode = "misdirected_request"
+	ErrorCodeInternal           ErrorCode = "internal"
+)
+
+// APIError is the error returned to the api clients.
+// It could be wrapped inside one of the above error types to provide a more
+// specific code and some details than the ones derived from the error type
+// (i.e. NewErrBadRequest(NewAPIError("project_group_not_empty", err)))
+type APIError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Details []string  `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func NewAPIError(code ErrorCode, err error, details ...string) *APIError {
+	return &APIError{Code: code, Message: err.Error(), Details: details}
+}
+
+// APIErrorFromError returns the APIError to return to the clients. Only the
+// messages of the above user error types are returned, other errors are
+// reported as a generic internal error to not leak the real error.
+func APIErrorFromError(err error) *APIError {
+	var code ErrorCode
+	var aerr error
+	// use the inner errors of these types
+	switch {
+	// checked before the bad request since a too large body is usually
+	// reported by the body decoding as a bad request
+	case IsRequestTooLarge(err):
+		var cerr *ErrRequestTooLarge
+		errors.As(err, &cerr)
+		code, aerr = ErrorCodeRequestTooLarge, cerr.Err
+	case IsBadRequest(err):
+		var cerr *ErrBadRequest
+		errors.As(err, &cerr)
+		code, aerr = ErrorCodeBadRequest, cerr.Err
+	case IsNotExist(err):
+		var cerr *ErrNotExist
+		errors.As(err, &cerr)
+		code, aerr = ErrorCodeNotExist, cerr.Err
+	case IsForbidden(err):
+		var cerr *ErrForbidden
+		errors.As(err, &cerr)
+		code, aerr = ErrorCodeForbidden, cerr.Err
+	case IsUnauthorized(err):
+		var cerr *ErrUnauthorized
+		errors.As(err, &cerr)
+		code, aerr = ErrorCodeUnauthorized, cerr.Err
+	case IsConflict(err):
+		var cerr *ErrConflict
+		errors.As(err, &cerr)
+		code, aerr = ErrorCodeConflict, cerr.Err
+	case IsPreconditionFailed(err):
+		var cerr *ErrPreconditionFailed
+		errors.As(err, &cerr)
+		code, aerr = ErrorCodePreconditionFailed, cerr.Err
+	case IsTooManyRequests(err):
+		var cerr *ErrTooManyRequests
+		errors.As(err, &cerr)
+		code, aerr = ErrorCodeTooManyRequests, cerr.Err
+	case IsUnavailable(err):
+		var cerr *ErrUnavailable
+		errors.As(err, &cerr)
+		code, aerr = ErrorCodeUnavailable, cerr.Err
+	case IsTimeout(err):
+		var cerr *ErrTimeout
+		errors.As(err, &cerr)
+		code, aerr = ErrorCodeTimeout, cerr.Err
+	case IsMisdirectedRequest(err):
+		var cerr *ErrMisdirectedRequest
+		errors.As(err, &cerr)
+		code, aerr = ErrorCodeMisdirectedRequest, cerr.Err
+	case IsInternal(err):
+		var cerr *ErrInternal
+		errors.As(err, &cerr)
+		code, aerr = ErrorCodeInternal, cerr.Err
+	}
+
+	if code == "" {
+		return &APIError{Code: ErrorCodeInternal, Message: "internal server error"}
+	}
+
+	apiErr := &APIError{Code: code, Message: aerr.Error()}
+	var cerr *APIError
+	if errors.As(aerr, &cerr) {
+		apiErr.Code = cerr.Code
+		apiErr.Details = cerr.Details
+	}
+	return apiErr
+}
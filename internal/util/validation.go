@@ -16,13 +16,25 @@ package util
 
 import (
 	"errors"
+	"path"
 	"regexp"
+	"strings"
 
 	uuid "github.com/satori/go.uuid"
 )
 
 var nameRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9]*([-]?[a-zA-Z0-9]+)+$`)
 
+// labelRegexp matches the label keys and values: alphanumeric characters,
+// dashes, underscores, dots and slashes, starting and ending with an
+// alphanumeric character
+var labelRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._/-]*[a-zA-Z0-9])?$`)
+
+const (
+	MaxLabelKeyLength   = 63
+	MaxLabelValueLength = 63
+)
+
 var (
 	ErrValidation = errors.New("validation error")
 )
@@ -35,3 +47,49 @@ func ValidateName(s string) bool {
 	}
 	return nameRegexp.MatchString(s)
 }
+
+func ValidateLabelKey(s string) bool {
+	return len(s) <= MaxLabelKeyLength && labelRegexp.MatchString(s)
+}
+
+// ValidateLabelValue reports if s is a valid label value. Unlike the keys the
+// values can be empty
+func ValidateLabelValue(s string) bool {
+	return s == "" || (len(s) <= MaxLabelValueLength && labelRegexp.MatchString(s))
+}
+
+// ValidateRelativePath reports if s is a clean relative slash separated path
+// that doesn't reference its parent directories (i.e. .agola/config.yml)
+func ValidateRelativePath(s string) bool {
+	if s == "" || s == "." || path.IsAbs(s) || path.Clean(s) != s {
+		return false
+	}
+	for _, part := range strings.Split(s, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return !strings.ContainsAny(s, "\\\x00")
+}
+
+// ValidateBranchName reports if s is a valid git branch name following the
+// git check-ref-format rules
+func ValidateBranchName(s string) bool {
+	if s == "" || s == "@" || strings.HasPrefix(s, "-") || strings.HasPrefix(s, "/") || strings.HasSuffix(s, "/") || strings.HasSuffix(s, ".") {
+		return false
+	}
+	if strings.Contains(s, "..") || strings.Contains(s, "//") || strings.Contains(s, "@{") {
+		return false
+	}
+	for _, part := range strings.Split(s, "/") {
+		if strings.HasPrefix(part, ".") || strings.HasSuffix(part, ".lock") {
+			return false
+		}
+	}
+	for _, c := range s {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+	return true
+}
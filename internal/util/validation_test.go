@@ -14,7 +14,10 @@
 
 package util
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 var (
 	goodNames = []string{
@@ -65,3 +68,122 @@ func TestValidateName(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateLabel(t *testing.T) {
+	goodKeys := []string{
+		"a",
+		"team",
+		"app.kubernetes.io/name",
+		"foo_bar-baz",
+		"1foo",
+		strings.Repeat("a", MaxLabelKeyLength),
+	}
+	badKeys := []string{
+		"",
+		"foo bar",
+		"-foo",
+		"foo-",
+		".foo",
+		"foo/",
+		"foo=bar",
+		"foo,bar",
+		"f\u00f6o",
+		strings.Repeat("a", MaxLabelKeyLength+1),
+	}
+
+	for _, key := range goodKeys {
+		if !ValidateLabelKey(key) {
+			t.Errorf("expect valid label key for %q", key)
+		}
+		if !ValidateLabelValue(key) {
+			t.Errorf("expect valid label value for %q", key)
+		}
+	}
+	for _, key := range badKeys {
+		if ValidateLabelKey(key) {
+			t.Errorf("expect invalid label key for %q", key)
+		}
+		if key != "" && ValidateLabelValue(key) {
+			t.Errorf("expect invalid label value for %q", key)
+		}
+	}
+	if !ValidateLabelValue("") {
+		t.Errorf("expect valid empty label value")
+	}
+}
+
+func TestValidateRelativePath(t *testing.T) {
+	goodPaths := []string{
+		"config.yml",
+		".agola/config.yml",
+		"ci/agola/config.jsonnet",
+		"foo..bar/config.yml",
+	}
+	badPaths := []string{
+		"",
+		".",
+		"/config.yml",
+		"..",
+		"../config.yml",
+		"ci/../../config.yml",
+		"./config.yml",
+		"ci//config.yml",
+		"ci/",
+		"ci\\config.yml",
+	}
+
+	for _, p := range goodPaths {
+		if !ValidateRelativePath(p) {
+			t.Errorf("expect valid relative path for %q", p)
+		}
+	}
+	for _, p := range badPaths {
+		if ValidateRelativePath(p) {
+			t.Errorf("expect invalid relative path for %q", p)
+		}
+	}
+}
+
+func TestValidateBranchName(t *testing.T) {
+	goodBranches := []string{
+		"master",
+		"main",
+		"feature/foo-bar",
+		"release-1.0",
+		"fix_123",
+	}
+	badBranches := []string{
+		"",
+		"@",
+		"-foo",
+		"/foo",
+		"foo/",
+		"foo.",
+		"foo..bar",
+		"foo//bar",
+		"foo@{bar",
+		".foo",
+		"foo/.bar",
+		"foo.lock",
+		"foo bar",
+		"foo~1",
+		"foo^",
+		"foo:bar",
+		"foo?",
+		"foo*",
+		"foo[bar",
+		"foo\\bar",
+		"foo\tbar",
+	}
+
+	for _, b := range goodBranches {
+		if !ValidateBranchName(b) {
+			t.Errorf("expect valid branch name for %q", b)
+		}
+	}
+	for _, b := range badBranches {
+		if ValidateBranchName(b) {
+			t.Errorf("expect invalid branch name for %q", b)
+		}
+	}
+}
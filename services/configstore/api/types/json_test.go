@@ -0,0 +1,282 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/util"
+	cstypes "agola.io/agola/services/configstore/types"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+// jsonFieldNameRegexp is the format of the resources and requests json field
+// names, every word starts with a letter (i.e. oauth2 and not oauth_2)
+var jsonFieldNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9]*(_[a-z][a-z0-9]*)*$`)
+
+// jsonResources are the resources returned by the configstore api. Their json
+// encoding is a stable contract pinned by the golden files in testdata: all
+// the fields have a snake case name and are omitted when empty, with the
+// exception of the struct (i.e. time) fields that are always present.
+func jsonResources() map[string]interface{} {
+	t := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	project := &cstypes.Project{
+		Version:                    "v0.1.0",
+		ID:                         "projectid",
+		Name:                       "project01",
+		Secret:                     "projectsecret",
+		Parent:                     cstypes.Parent{Type: cstypes.ConfigTypeProjectGroup, ID: "projectgroupid"},
+		Visibility:                 cstypes.VisibilityPublic,
+		RemoteRepositoryConfigType: cstypes.RemoteRepositoryConfigTypeRemoteSource,
+		RemoteSourceID:             "remotesourceid",
+		LinkedAccountID:            "linkedaccountid",
+		RepositoryID:               "repositoryid",
+		RepositoryPath:             "user01/repo01",
+		SSHPrivateKey:              "sshprivatekey",
+		SkipSSHHostKeyCheck:        true,
+		WebhookSecret:              "webhooksecret",
+		PassVarsToForkedPR:         true,
+		ConfigPath:                 ".agola/config.yml",
+		DefaultBranch:              "main",
+		Labels:                     map[string]string{"team": "team01"},
+		DeletionTime:               &t,
+	}
+
+	linkedAccount := &cstypes.LinkedAccount{
+		Version:                    "v0.1.0",
+		ID:                         "linkedaccountid",
+		RemoteUserID:               "remoteuserid",
+		RemoteUserName:             "remoteuser01",
+		RemoteUserAvatarURL:        "https://example.com/avatar.png",
+		RemoteSourceID:             "remotesourceid",
+		UserAccessToken:            "useraccesstoken",
+		Oauth2AccessToken:          "oauth2accesstoken",
+		Oauth2RefreshToken:         "oauth2refreshtoken",
+		Oauth2AccessTokenExpiresAt: t,
+	}
+
+	return map[string]interface{}{
+		"project": &Project{
+			Project:          project,
+			OwnerType:        cstypes.ConfigTypeUser,
+			OwnerID:          "userid",
+			Path:             "user/user01/project01",
+			ParentPath:       "user/user01",
+			GlobalVisibility: cstypes.VisibilityPublic,
+		},
+		"project_zero": &Project{Project: &cstypes.Project{}},
+		"user": &cstypes.User{
+			Version:              "v0.1.0",
+			ID:                   "userid",
+			Name:                 "user01",
+			Secret:               "usersecret",
+			LinkedAccounts:       map[string]*cstypes.LinkedAccount{linkedAccount.ID: linkedAccount},
+			Password:             "password",
+			Tokens:               map[string]string{"token01": "tokenhash"},
+			TokensCreationTime:   map[string]time.Time{"token01": t},
+			TokensScopes:         map[string][]cstypes.TokenScope{"token01": {cstypes.TokenScopeWrite}},
+			TokensExpirationTime: map[string]time.Time{"token01": t},
+			Admin:                true,
+			DeletionTime:         &t,
+		},
+		"user_zero": &cstypes.User{},
+		"remotesource": &cstypes.RemoteSource{
+			Version:                      "v0.1.0",
+			ID:                           "remotesourceid",
+			Name:                         "rs01",
+			APIURL:                       "https://api.github.com",
+			SkipVerify:                   true,
+			Type:                         cstypes.RemoteSourceTypeGithub,
+			AuthType:                     cstypes.RemoteSourceAuthTypeGithubApp,
+			Oauth2ClientID:               "clientid",
+			Oauth2ClientSecret:           "clientsecret",
+			GithubAppID:                  1,
+			GithubAppInstallationID:      2,
+			GithubAppPrivateKey:          "privatekey",
+			GithubAppPrivateKeyEncrypted: true,
+			SSHHostKey:                   "sshhostkey",
+			SkipSSHHostKeyCheck:          true,
+			RegistrationEnabled:          util.BoolP(false),
+			LoginEnabled:                 util.BoolP(true),
+			APIRateLimit:                 5000,
+			MaxConcurrency:               10,
+		},
+		"remotesource_zero":  &cstypes.RemoteSource{},
+		"linkedaccount":      linkedAccount,
+		"linkedaccount_zero": &cstypes.LinkedAccount{},
+	}
+}
+
+// jsonRequests are the requests with fields shared with the resources. Their
+// json field names are pinned by the golden files in testdata.
+func jsonRequests() map[string]interface{} {
+	t := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	return map[string]interface{}{
+		"create_user_la_request": &CreateUserLARequest{
+			RemoteSourceName:           "rs01",
+			RemoteUserID:               "remoteuserid",
+			RemoteUserName:             "remoteuser01",
+			UserAccessToken:            "useraccesstoken",
+			Oauth2AccessToken:          "oauth2accesstoken",
+			Oauth2RefreshToken:         "oauth2refreshtoken",
+			Oauth2AccessTokenExpiresAt: t,
+		},
+		"update_user_la_request": &UpdateUserLARequest{
+			RemoteUserID:               "remoteuserid",
+			RemoteUserName:             "remoteuser01",
+			UserAccessToken:            "useraccesstoken",
+			Oauth2AccessToken:          "oauth2accesstoken",
+			Oauth2RefreshToken:         "oauth2refreshtoken",
+			Oauth2AccessTokenExpiresAt: t,
+		},
+		"update_user_la_token_request": &UpdateUserLATokenRequest{
+			UserAccessToken:            "useraccesstoken",
+			Oauth2AccessToken:          "oauth2accesstoken",
+			Oauth2RefreshToken:         "oauth2refreshtoken",
+			Oauth2AccessTokenExpiresAt: t,
+		},
+	}
+}
+
+func TestJSONGolden(t *testing.T) {
+	golden := jsonResources()
+	for name, req := range jsonRequests() {
+		golden[name] = req
+	}
+	for name, res := range golden {
+		name, res := name, res
+		t.Run(name, func(t *testing.T) {
+			data, err := json.MarshalIndent(res, "", "  ")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			data = append(data, '\n')
+
+			golden := filepath.Join("testdata", name+".golden.json")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, data, 0644); err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if !bytes.Equal(expected, data) {
+				t.Fatalf("json mismatch, expected:\n%s\ngot:\n%s", expected, data)
+			}
+
+		})
+	}
+}
+
+func TestJSONFieldNames(t *testing.T) {
+	var checkFields func(t *testing.T, typ reflect.Type, checkOmitEmpty bool)
+	checkFields = func(t *testing.T, typ reflect.Type, checkOmitEmpty bool) {
+		for typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			tag, ok := f.Tag.Lookup("json")
+			if f.Anonymous && !ok {
+				checkFields(t, f.Type, checkOmitEmpty)
+				continue
+			}
+			parts := strings.Split(tag, ",")
+			if !jsonFieldNameRegexp.MatchString(parts[0]) {
+				t.Errorf("%s.%s: json field name %q isn't snake case", typ.Name(), f.Name, parts[0])
+			}
+			omitEmpty := false
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					omitEmpty = true
+				}
+			}
+			if checkOmitEmpty && !omitEmpty {
+				t.Errorf("%s.%s: json field %q isn't omitempty", typ.Name(), f.Name, parts[0])
+			}
+		}
+	}
+
+	for name, res := range jsonResources() {
+		name, res := name, res
+		t.Run(name, func(t *testing.T) {
+			checkFields(t, reflect.TypeOf(res), true)
+		})
+	}
+	// the requests fields aren't omitempty
+	for name, req := range jsonRequests() {
+		name, req := name, req
+		t.Run(name, func(t *testing.T) {
+			checkFields(t, reflect.TypeOf(req), false)
+		})
+	}
+}
+
+func TestLinkedAccountOldOauth2ExpiresAt(t *testing.T) {
+	// linked accounts saved by older versions
+	data := []byte(`{"id": "linkedaccountid", "oauth_2_access_token_expires_at": "2020-01-02T03:04:05Z"}`)
+	var la *cstypes.LinkedAccount
+	if err := json.Unmarshal(data, &la); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	expected := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !la.Oauth2AccessTokenExpiresAt.Equal(expected) {
+		t.Fatalf("expected expiration time %s, got %s", expected, la.Oauth2AccessTokenExpiresAt)
+	}
+}
+
+func TestLinkedAccountRequestsOldOauth2ExpiresAt(t *testing.T) {
+	// requests sent by older clients
+	data := []byte(`{"remote_user_id": "remoteuserid", "oauth_2_access_token_expires_at": "2020-01-02T03:04:05Z"}`)
+	expected := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var createReq *CreateUserLARequest
+	if err := json.Unmarshal(data, &createReq); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	var updateReq *UpdateUserLARequest
+	if err := json.Unmarshal(data, &updateReq); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	var updateTokenReq *UpdateUserLATokenRequest
+	if err := json.Unmarshal(data, &updateTokenReq); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for _, expiresAt := range []time.Time{createReq.Oauth2AccessTokenExpiresAt, updateReq.Oauth2AccessTokenExpiresAt, updateTokenReq.Oauth2AccessTokenExpiresAt} {
+		if !expiresAt.Equal(expected) {
+			t.Fatalf("expected expiration time %s, got %s", expected, expiresAt)
+		}
+	}
+	if createReq.RemoteUserID != "remoteuserid" || updateReq.RemoteUserID != "remoteuserid" {
+		t.Fatalf("expected remote user id %q", "remoteuserid")
+	}
+}
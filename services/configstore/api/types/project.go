@@ -23,9 +23,56 @@ type Project struct {
 	*cstypes.Project
 
 	// dynamic data
-	OwnerType        cstypes.ConfigType
-	OwnerID          string
-	Path             string
-	ParentPath       string
-	GlobalVisibility cstypes.Visibility
+	OwnerType        cstypes.ConfigType `json:"owner_type,omitempty"`
+	OwnerID          string             `json:"owner_id,omitempty"`
+	Path             string             `json:"path,omitempty"`
+	ParentPath       string             `json:"parent_path,omitempty"`
+	GlobalVisibility cstypes.Visibility `json:"global_visibility,omitempty"`
+}
+
+// ProjectByPathResponse is the project resolved from its path with its
+// ancestry
+type ProjectByPathResponse struct {
+	*Project
+
+	// Ancestry are the project parents starting from its owner
+	Ancestry []*ProjectAncestor `json:"ancestry"`
+}
+
+// ProjectAncestor is a parent of a project: its owner (user or org) or one of
+// the project groups containing it. The owner root project group has an
+// empty name.
+type ProjectAncestor struct {
+	Type cstypes.ConfigType `json:"type"`
+	ID   string             `json:"id"`
+	Name string             `json:"name"`
+	Path string             `json:"path"`
+}
+
+// MoveProjectRequest defines the project group where the project is moved
+type MoveProjectRequest struct {
+	ParentRef string `json:"parent_ref"`
+}
+
+// PatchProjectRequest defines the project fields to update. Only the provided
+// (non nil) fields will be changed.
+type PatchProjectRequest struct {
+	Name          *string             `json:"name,omitempty"`
+	ParentRef     *string             `json:"parent_ref,omitempty"`
+	Visibility    *cstypes.Visibility `json:"visibility,omitempty"`
+	ConfigPath    *string             `json:"config_path,omitempty"`
+	DefaultBranch *string             `json:"default_branch,omitempty"`
+}
+
+// DeleteProjectsRequest defines the filters of the projects to delete. Only
+// the projects matching all the provided filters are deleted.
+type DeleteProjectsRequest struct {
+	NamePrefix string             `json:"name_prefix,omitempty"`
+	OwnerType  cstypes.ConfigType `json:"owner_type,omitempty"`
+	OwnerID    string             `json:"owner_id,omitempty"`
+}
+
+// DeleteProjectsResponse contains the ids of the deleted projects
+type DeleteProjectsResponse struct {
+	DeletedProjectIDs []string `json:"deleted_project_ids"`
 }
@@ -23,9 +23,9 @@ type ProjectGroup struct {
 	*cstypes.ProjectGroup
 
 	// dynamic data
-	OwnerType        cstypes.ConfigType
-	OwnerID          string
-	Path             string
-	ParentPath       string
-	GlobalVisibility cstypes.Visibility
+	OwnerType        cstypes.ConfigType `json:"owner_type,omitempty"`
+	OwnerID          string             `json:"owner_id,omitempty"`
+	Path             string             `json:"path,omitempty"`
+	ParentPath       string             `json:"parent_path,omitempty"`
+	GlobalVisibility cstypes.Visibility `json:"global_visibility,omitempty"`
 }
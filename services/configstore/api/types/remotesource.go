@@ -0,0 +1,59 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"time"
+)
+
+// PatchRemoteSourceRequest contains the remote source fields to update. The
+// remote source name, type and auth type cannot be changed.
+type PatchRemoteSourceRequest struct {
+	APIURL                  *string `json:"apiurl,omitempty"`
+	SkipVerify              *bool   `json:"skip_verify,omitempty"`
+	Oauth2ClientID          *string `json:"client_id,omitempty"`
+	Oauth2ClientSecret      *string `json:"client_secret,omitempty"`
+	SSHHostKey              *string `json:"ssh_host_key,omitempty"`
+	SkipSSHHostKeyCheck     *bool   `json:"skip_ssh_host_key_check,omitempty"`
+	RegistrationEnabled     *bool   `json:"registration_enabled,omitempty"`
+	LoginEnabled            *bool   `json:"login_enabled,omitempty"`
+	GithubAppID             *int64  `json:"github_app_id,omitempty"`
+	GithubAppInstallationID *int64  `json:"github_app_installation_id,omitempty"`
+	GithubAppPrivateKey     *string `json:"github_app_private_key,omitempty"`
+	APIRateLimit            *int    `json:"api_rate_limit,omitempty"`
+	MaxConcurrency          *int    `json:"max_concurrency,omitempty"`
+}
+
+// RotateRemoteSourceSecretRequest contains the new remote source oauth2
+// client secret. When provided also the client id is replaced
+type RotateRemoteSourceSecretRequest struct {
+	Oauth2ClientID     *string `json:"client_id,omitempty"`
+	Oauth2ClientSecret string  `json:"client_secret"`
+}
+
+type GithubAppInstallationTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TestRemoteSourceResponse is the result of a remote source connectivity and
+// credentials test
+type TestRemoteSourceResponse struct {
+	Success bool `json:"success"`
+	// CredentialsVerified reports if the remote source credentials were used
+	// in the test
+	CredentialsVerified bool   `json:"credentials_verified"`
+	Message             string `json:"message"`
+}
@@ -0,0 +1,25 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+// RevisionHeader is the response header of the write requests containing the
+// revision of the written changes. It can be passed back to the read requests
+// with the MinRevisionParam query parameter to read them as soon as they are
+// applied.
+const RevisionHeader = "X-Agola-Revision"
+
+// MinRevisionParam is the query parameter to wait, up to a timeout, that the
+// provided revision has been applied before executing the read request.
+const MinRevisionParam = "minRevision"
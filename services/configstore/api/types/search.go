@@ -0,0 +1,35 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	cstypes "agola.io/agola/services/configstore/types"
+)
+
+// SearchResponse contains the resources matching a search term grouped by
+// type
+type SearchResponse struct {
+	Projects      []*SearchResult `json:"projects"`
+	Users         []*SearchResult `json:"users"`
+	RemoteSources []*SearchResult `json:"remote_sources"`
+}
+
+type SearchResult struct {
+	Type cstypes.ConfigType `json:"type"`
+	ID   string             `json:"id"`
+	Name string             `json:"name"`
+	// Path is the project path
+	Path string `json:"path,omitempty"`
+}
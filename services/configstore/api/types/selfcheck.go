@@ -0,0 +1,38 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"agola.io/agola/services/configstore/types"
+)
+
+// SelfCheckResponse reports the differences between the readdb and the
+// resources in the last data dump with applied the wals after it
+type SelfCheckResponse struct {
+	DataWalSequence string                  `json:"data_wal_sequence"`
+	WalSequence     string                  `json:"wal_sequence"`
+	Discrepancies   []*SelfCheckDiscrepancy `json:"discrepancies"`
+	// Repairing reports that a readdb rebuild has been started to fix the
+	// discrepancies
+	Repairing bool `json:"repairing,omitempty"`
+}
+
+// SelfCheckDiscrepancy is a resource missing from the readdb, existing
+// only in the readdb (extra) or with different data (mismatch)
+type SelfCheckDiscrepancy struct {
+	Type types.ConfigType `json:"type"`
+	ID   string           `json:"id"`
+	Kind string           `json:"kind"`
+}
@@ -15,6 +15,7 @@
 package types
 
 import (
+	"encoding/json"
 	"time"
 
 	cstypes "agola.io/agola/services/configstore/types"
@@ -26,10 +27,25 @@ type CreateUserRequest struct {
 	CreateUserLARequest *CreateUserLARequest `json:"create_user_la_request"`
 }
 
+type ImportUsersResponse struct {
+	Users []*ImportedUser `json:"users"`
+}
+
+type ImportedUser struct {
+	ID       string `json:"id"`
+	UserName string `json:"user_name"`
+}
+
 type UpdateUserRequest struct {
 	UserName string `json:"user_name"`
 }
 
+// PatchUserRequest defines the user fields to update. Only the provided (non
+// nil) fields will be changed.
+type PatchUserRequest struct {
+	UserName *string `json:"user_name,omitempty"`
+}
+
 type CreateUserLARequest struct {
 	RemoteSourceName           string    `json:"remote_source_name"`
 	RemoteUserID               string    `json:"remote_user_id"`
@@ -37,7 +53,7 @@ type CreateUserLARequest struct {
 	UserAccessToken            string    `json:"user_access_token"`
 	Oauth2AccessToken          string    `json:"oauth2_access_token"`
 	Oauth2RefreshToken         string    `json:"oauth2_refresh_token"`
-	Oauth2AccessTokenExpiresAt time.Time `json:"oauth_2_access_token_expires_at"`
+	Oauth2AccessTokenExpiresAt time.Time `json:"oauth2_access_token_expires_at"`
 }
 
 type UpdateUserLARequest struct {
@@ -46,11 +62,101 @@ type UpdateUserLARequest struct {
 	UserAccessToken            string    `json:"user_access_token"`
 	Oauth2AccessToken          string    `json:"oauth2_access_token"`
 	Oauth2RefreshToken         string    `json:"oauth2_refresh_token"`
-	Oauth2AccessTokenExpiresAt time.Time `json:"oauth_2_access_token_expires_at"`
+	Oauth2AccessTokenExpiresAt time.Time `json:"oauth2_access_token_expires_at"`
+}
+
+// UpdateUserLATokenRequest updates only the tokens of a linked account
+type UpdateUserLATokenRequest struct {
+	UserAccessToken            string    `json:"user_access_token"`
+	Oauth2AccessToken          string    `json:"oauth2_access_token"`
+	Oauth2RefreshToken         string    `json:"oauth2_refresh_token"`
+	Oauth2AccessTokenExpiresAt time.Time `json:"oauth2_access_token_expires_at"`
+}
+
+func (r *CreateUserLARequest) UnmarshalJSON(b []byte) error {
+	type createUserLARequest CreateUserLARequest
+	if err := json.Unmarshal(b, (*createUserLARequest)(r)); err != nil {
+		return err
+	}
+	return unmarshalOldOauth2AccessTokenExpiresAt(b, &r.Oauth2AccessTokenExpiresAt)
+}
+
+func (r *UpdateUserLARequest) UnmarshalJSON(b []byte) error {
+	type updateUserLARequest UpdateUserLARequest
+	if err := json.Unmarshal(b, (*updateUserLARequest)(r)); err != nil {
+		return err
+	}
+	return unmarshalOldOauth2AccessTokenExpiresAt(b, &r.Oauth2AccessTokenExpiresAt)
+}
+
+func (r *UpdateUserLATokenRequest) UnmarshalJSON(b []byte) error {
+	type updateUserLATokenRequest UpdateUserLATokenRequest
+	if err := json.Unmarshal(b, (*updateUserLATokenRequest)(r)); err != nil {
+		return err
+	}
+	return unmarshalOldOauth2AccessTokenExpiresAt(b, &r.Oauth2AccessTokenExpiresAt)
+}
+
+// unmarshalOldOauth2AccessTokenExpiresAt sets expiresAt from the
+// oauth_2_access_token_expires_at field name sent by older clients
+func unmarshalOldOauth2AccessTokenExpiresAt(b []byte, expiresAt *time.Time) error {
+	var old struct {
+		Oauth2AccessTokenExpiresAt *time.Time `json:"oauth_2_access_token_expires_at"`
+	}
+	if err := json.Unmarshal(b, &old); err != nil {
+		return err
+	}
+	if old.Oauth2AccessTokenExpiresAt != nil && expiresAt.IsZero() {
+		*expiresAt = *old.Oauth2AccessTokenExpiresAt
+	}
+	return nil
+}
+
+// UserLinkedAccount is a user linked account without its secret fields
+type UserLinkedAccount struct {
+	ID                  string `json:"id"`
+	RemoteSourceID      string `json:"remote_source_id"`
+	RemoteSourceName    string `json:"remote_source_name"`
+	RemoteUserID        string `json:"remote_user_id"`
+	RemoteUserName      string `json:"remote_user_name"`
+	RemoteUserAvatarURL string `json:"remote_user_avatar_url"`
+}
+
+// UserToken is a user token without its value
+type UserToken struct {
+	Name           string               `json:"name"`
+	CreationTime   *time.Time           `json:"creation_time,omitempty"`
+	Scopes         []cstypes.TokenScope `json:"scopes,omitempty"`
+	ExpirationTime *time.Time           `json:"expiration_time,omitempty"`
+}
+
+type IntrospectUserTokenRequest struct {
+	Token string `json:"token"`
+}
+
+// UserTokenIntrospection describes the user token provided to the token
+// introspection. The token value is never returned.
+type UserTokenIntrospection struct {
+	UserID         string               `json:"user_id"`
+	UserName       string               `json:"user_name"`
+	TokenName      string               `json:"token_name"`
+	Scopes         []cstypes.TokenScope `json:"scopes"`
+	CreationTime   *time.Time           `json:"creation_time,omitempty"`
+	ExpirationTime *time.Time           `json:"expiration_time,omitempty"`
 }
 
 type CreateUserTokenRequest struct {
 	TokenName string `json:"token_name"`
+	// Scopes are the token scopes. When empty a read only token is created
+	Scopes []cstypes.TokenScope `json:"scopes,omitempty"`
+	// TTL is the token time to live as a duration string (i.e. 720h). When
+	// empty the token never expires
+	TTL string `json:"ttl,omitempty"`
+}
+
+// DeleteUserLAsResponse contains the ids of the deleted user linked accounts
+type DeleteUserLAsResponse struct {
+	DeletedLinkedAccountIDs []string `json:"deleted_linked_account_ids"`
 }
 
 type CreateUserTokenResponse struct {
@@ -25,3 +25,20 @@ type Variable struct {
 	// dynamic data
 	ParentPath string
 }
+
+// ResolvedVariable is the effective value of a variable for the requested
+// conditions
+type ResolvedVariable struct {
+	Name       string `json:"name"`
+	ParentPath string `json:"parent_path"`
+
+	// Matched reports if a variable value matched the conditions
+	Matched    bool   `json:"matched"`
+	SecretName string `json:"secret_name,omitempty"`
+	SecretVar  string `json:"secret_var,omitempty"`
+
+	// SecretID and SecretParentPath are populated when the referenced secret
+	// exists
+	SecretID         string `json:"secret_id,omitempty"`
+	SecretParentPath string `json:"secret_parent_path,omitempty"`
+}
@@ -0,0 +1,29 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+// APIVersion is the version of the configstore api
+const APIVersion = "v1alpha"
+
+// VersionResponse reports the configstore build and the supported api and wal
+// schema versions
+type VersionResponse struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit"`
+	BuildDate  string `json:"build_date"`
+	APIVersion string `json:"api_version"`
+	// WalVersions are the schema versions of the wal data types
+	WalVersions map[string]int `json:"wal_versions"`
+}
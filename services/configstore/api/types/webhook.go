@@ -0,0 +1,48 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"time"
+
+	cstypes "agola.io/agola/services/configstore/types"
+)
+
+// SignatureHeader is the webhook request header containing the hex encoded
+// HMAC-SHA256 of the request body computed with the webhooks secret
+const SignatureHeader = "X-Agola-Signature"
+
+type ChangeEventAction string
+
+const (
+	ChangeEventActionPut    ChangeEventAction = "put"
+	ChangeEventActionDelete ChangeEventAction = "delete"
+)
+
+// ChangeEvent is the event sent to the configstore webhooks for every changed
+// resource
+type ChangeEvent struct {
+	// ID is the id of the audit entry recording the change. The same event
+	// could be delivered more than once
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+
+	Type       cstypes.ConfigType `json:"type"`
+	Action     ChangeEventAction  `json:"action"`
+	ResourceID string             `json:"resource_id"`
+
+	Operation string `json:"operation"`
+	Actor     string `json:"actor,omitempty"`
+}
@@ -25,6 +25,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	csapitypes "agola.io/agola/services/configstore/api/types"
 	"agola.io/agola/services/configstore/types"
@@ -38,6 +39,46 @@ var jsonContent = http.Header{"Content-Type": []string{"application/json"}}
 type Client struct {
 	url    string
 	client *http.Client
+	token  string
+}
+
+type actorKeyType struct{}
+
+var actorKey actorKeyType
+
+// WithActor returns a copy of ctx with the actor to send with the requests
+// done using it. The configstore records it in the audit entries.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+type idempotencyKeyType struct{}
+
+var idempotencyKey idempotencyKeyType
+
+// WithIdempotencyKey returns a copy of ctx with the idempotency key to send
+// with the create requests done using it. Retrying a create request with the
+// same key returns the resource created by the first request.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey, key)
+}
+
+type minRevisionKeyType struct{}
+
+var minRevisionKey minRevisionKeyType
+
+// WithMinRevision returns a copy of ctx where the requests done using it wait
+// for the configstore to apply the provided revision, usually the one
+// returned by ResponseRevision for a previous write, before being executed.
+func WithMinRevision(ctx context.Context, revision int64) context.Context {
+	return context.WithValue(ctx, minRevisionKey, revision)
+}
+
+// ResponseRevision returns the revision of the changes written by the
+// request, 0 if the request hasn't written anything
+func ResponseRevision(resp *http.Response) int64 {
+	revision, _ := strconv.ParseInt(resp.Header.Get(csapitypes.RevisionHeader), 10, 64)
+	return revision
 }
 
 // NewClient initializes and returns a API client.
@@ -53,11 +94,22 @@ func (c *Client) SetHTTPClient(client *http.Client) {
 	c.client = client
 }
 
+// SetToken sets the bearer token used to authenticate the requests.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
 func (c *Client) doRequest(ctx context.Context, method, path string, query url.Values, header http.Header, ibody io.Reader) (*http.Response, error) {
 	u, err := url.Parse(c.url + "/api/v1alpha" + path)
 	if err != nil {
 		return nil, err
 	}
+	if minRevision, ok := ctx.Value(minRevisionKey).(int64); ok && minRevision > 0 {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set(csapitypes.MinRevisionParam, strconv.FormatInt(minRevision, 10))
+	}
 	u.RawQuery = query.Encode()
 
 	req, err := http.NewRequest(method, u.String(), ibody)
@@ -68,6 +120,15 @@ func (c *Client) doRequest(ctx context.Context, method, path string, query url.V
 	for k, v := range header {
 		req.Header[k] = v
 	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if actor, ok := ctx.Value(actorKey).(string); ok && actor != "" {
+		req.Header.Set(csapitypes.ActorHeader, actor)
+	}
+	if key, ok := ctx.Value(idempotencyKey).(string); ok && key != "" {
+		req.Header.Set(csapitypes.IdempotencyKeyHeader, key)
+	}
 
 	return c.client.Do(req)
 }
@@ -147,8 +208,12 @@ func (c *Client) UpdateProjectGroup(ctx context.Context, projectGroupRef string,
 	return resProjectGroup, resp, err
 }
 
-func (c *Client) DeleteProjectGroup(ctx context.Context, projectGroupRef string) (*http.Response, error) {
-	return c.getResponse(ctx, "DELETE", fmt.Sprintf("/projectgroups/%s", url.PathEscape(projectGroupRef)), nil, jsonContent, nil)
+func (c *Client) DeleteProjectGroup(ctx context.Context, projectGroupRef string, cascade bool) (*http.Response, error) {
+	q := url.Values{}
+	if cascade {
+		q.Add("cascade", "true")
+	}
+	return c.getResponse(ctx, "DELETE", fmt.Sprintf("/projectgroups/%s", url.PathEscape(projectGroupRef)), q, jsonContent, nil)
 }
 
 func (c *Client) GetProject(ctx context.Context, projectRef string) (*csapitypes.Project, *http.Response, error) {
@@ -157,6 +222,80 @@ func (c *Client) GetProject(ctx context.Context, projectRef string) (*csapitypes
 	return project, resp, err
 }
 
+// GetProjectByPath returns the project with the provided path segments (i.e.
+// "org", "org01", "projectgroup01", "project01") and its ancestry. The
+// segments are escaped so they can contain a slash.
+func (c *Client) GetProjectByPath(ctx context.Context, segments ...string) (*csapitypes.ProjectByPathResponse, *http.Response, error) {
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		escaped[i] = url.PathEscape(segment)
+	}
+	q := url.Values{}
+	q.Add("path", strings.Join(escaped, "/"))
+
+	project := new(csapitypes.ProjectByPathResponse)
+	resp, err := c.getParsedResponse(ctx, "GET", "/projects", q, jsonContent, nil, project)
+	return project, resp, err
+}
+
+func (c *Client) GetProjects(ctx context.Context, start string, limit int, asc bool) ([]*csapitypes.Project, *http.Response, error) {
+	q := url.Values{}
+	if start != "" {
+		q.Add("start", start)
+	}
+	if limit > 0 {
+		q.Add("limit", strconv.Itoa(limit))
+	}
+	if asc {
+		q.Add("asc", "")
+	}
+
+	projects := []*csapitypes.Project{}
+	resp, err := c.getParsedResponse(ctx, "GET", "/projects", q, jsonContent, nil, &projects)
+	return projects, resp, err
+}
+
+// GetProjectsWithLabels returns the projects matching all the label selectors,
+// in the form key or key=value
+func (c *Client) GetProjectsWithLabels(ctx context.Context, labelSelectors []string, start string, limit int, asc bool) ([]*csapitypes.Project, *http.Response, error) {
+	q := url.Values{}
+	for _, ls := range labelSelectors {
+		q.Add("label", ls)
+	}
+	if start != "" {
+		q.Add("start", start)
+	}
+	if limit > 0 {
+		q.Add("limit", strconv.Itoa(limit))
+	}
+	if asc {
+		q.Add("asc", "")
+	}
+
+	projects := []*csapitypes.Project{}
+	resp, err := c.getParsedResponse(ctx, "GET", "/projects", q, jsonContent, nil, &projects)
+	return projects, resp, err
+}
+
+func (c *Client) CountProjects(ctx context.Context, includeDeleted bool) (int, *http.Response, error) {
+	q := url.Values{}
+	if includeDeleted {
+		q.Add("includeDeleted", "true")
+	}
+
+	count := new(csapitypes.CountResponse)
+	resp, err := c.getParsedResponse(ctx, "GET", "/projects/count", q, jsonContent, nil, count)
+	return count.Count, resp, err
+}
+
+// ProjectAvailable reports if a project with the provided path (i.e.
+// org/org01/project01) could be created
+func (c *Client) ProjectAvailable(ctx context.Context, projectPath string) (bool, *http.Response, error) {
+	res := new(csapitypes.NameAvailabilityResponse)
+	resp, err := c.getParsedResponse(ctx, "GET", fmt.Sprintf("/projects/%s/available", url.PathEscape(projectPath)), nil, jsonContent, nil, res)
+	return res.Available, resp, err
+}
+
 func (c *Client) CreateProject(ctx context.Context, project *cstypes.Project) (*csapitypes.Project, *http.Response, error) {
 	pj, err := json.Marshal(project)
 	if err != nil {
@@ -168,6 +307,22 @@ func (c *Client) CreateProject(ctx context.Context, project *cstypes.Project) (*
 	return resProject, resp, err
 }
 
+// CreateProjectDryRun validates the project creation without saving it and
+// returns the project that would be created
+func (c *Client) CreateProjectDryRun(ctx context.Context, project *cstypes.Project) (*csapitypes.Project, *http.Response, error) {
+	pj, err := json.Marshal(project)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	q := url.Values{}
+	q.Add("dryRun", "true")
+
+	resProject := new(csapitypes.Project)
+	resp, err := c.getParsedResponse(ctx, "POST", "/projects", q, jsonContent, bytes.NewReader(pj), resProject)
+	return resProject, resp, err
+}
+
 func (c *Client) UpdateProject(ctx context.Context, projectRef string, project *cstypes.Project) (*csapitypes.Project, *http.Response, error) {
 	pj, err := json.Marshal(project)
 	if err != nil {
@@ -179,26 +334,106 @@ func (c *Client) UpdateProject(ctx context.Context, projectRef string, project *
 	return resProject, resp, err
 }
 
+func (c *Client) PatchProject(ctx context.Context, projectRef string, req *csapitypes.PatchProjectRequest) (*csapitypes.Project, *http.Response, error) {
+	reqj, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resProject := new(csapitypes.Project)
+	resp, err := c.getParsedResponse(ctx, "PATCH", fmt.Sprintf("/projects/%s", url.PathEscape(projectRef)), nil, jsonContent, bytes.NewReader(reqj), resProject)
+	return resProject, resp, err
+}
+
+// DeleteProjectOptions are the options of the project delete
+type DeleteProjectOptions struct {
+	// IgnoreMissing makes deleting an already deleted project not return an
+	// error
+	IgnoreMissing bool
+}
+
+func (o *DeleteProjectOptions) query() url.Values {
+	q := url.Values{}
+	if o != nil && o.IgnoreMissing {
+		q.Add("ignoreMissing", "true")
+	}
+	return q
+}
+
 func (c *Client) DeleteProject(ctx context.Context, projectRef string) (*http.Response, error) {
-	return c.getResponse(ctx, "DELETE", fmt.Sprintf("/projects/%s", url.PathEscape(projectRef)), nil, jsonContent, nil)
+	return c.DeleteProjectWithOptions(ctx, projectRef, nil)
+}
+
+// DeleteProjectWithOptions deletes the project with the provided options, opts
+// can be nil
+func (c *Client) DeleteProjectWithOptions(ctx context.Context, projectRef string, opts *DeleteProjectOptions) (*http.Response, error) {
+	return c.getResponse(ctx, "DELETE", fmt.Sprintf("/projects/%s", url.PathEscape(projectRef)), opts.query(), jsonContent, nil)
+}
+
+// DeleteProjects deletes all the projects matching the request filters
+func (c *Client) DeleteProjects(ctx context.Context, req *csapitypes.DeleteProjectsRequest) (*csapitypes.DeleteProjectsResponse, *http.Response, error) {
+	reqj, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	q := url.Values{}
+	q.Add("confirm", "true")
+
+	res := new(csapitypes.DeleteProjectsResponse)
+	resp, err := c.getParsedResponse(ctx, "DELETE", "/projects", q, jsonContent, bytes.NewReader(reqj), res)
+	return res, resp, err
+}
+
+func (c *Client) DeleteProjectByID(ctx context.Context, projectID string) (*http.Response, error) {
+	return c.DeleteProjectByIDWithOptions(ctx, projectID, nil)
+}
+
+// DeleteProjectByIDWithOptions deletes the project with the provided options,
+// opts can be nil
+func (c *Client) DeleteProjectByIDWithOptions(ctx context.Context, projectID string, opts *DeleteProjectOptions) (*http.Response, error) {
+	return c.getResponse(ctx, "DELETE", fmt.Sprintf("/project/%s", url.PathEscape(projectID)), opts.query(), jsonContent, nil)
+}
+
+func (c *Client) MoveProject(ctx context.Context, projectID, parentRef string) (*csapitypes.Project, *http.Response, error) {
+	reqj, err := json.Marshal(&csapitypes.MoveProjectRequest{ParentRef: parentRef})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resProject := new(csapitypes.Project)
+	resp, err := c.getParsedResponse(ctx, "PATCH", fmt.Sprintf("/project/%s/move", url.PathEscape(projectID)), nil, jsonContent, bytes.NewReader(reqj), resProject)
+	return resProject, resp, err
+}
+
+func (c *Client) RestoreProject(ctx context.Context, projectID string) (*csapitypes.Project, *http.Response, error) {
+	project := new(csapitypes.Project)
+	resp, err := c.getParsedResponse(ctx, "POST", fmt.Sprintf("/project/%s/restore", url.PathEscape(projectID)), nil, jsonContent, nil, project)
+	return project, resp, err
 }
 
-func (c *Client) GetProjectGroupSecrets(ctx context.Context, projectGroupRef string, tree bool) ([]*csapitypes.Secret, *http.Response, error) {
+func (c *Client) GetProjectGroupSecrets(ctx context.Context, projectGroupRef string, tree, withData bool) ([]*csapitypes.Secret, *http.Response, error) {
 	q := url.Values{}
 	if tree {
 		q.Add("tree", "")
 	}
+	if withData {
+		q.Add("withdata", "true")
+	}
 
 	secrets := []*csapitypes.Secret{}
 	resp, err := c.getParsedResponse(ctx, "GET", fmt.Sprintf("/projectgroups/%s/secrets", url.PathEscape(projectGroupRef)), q, jsonContent, nil, &secrets)
 	return secrets, resp, err
 }
 
-func (c *Client) GetProjectSecrets(ctx context.Context, projectRef string, tree bool) ([]*csapitypes.Secret, *http.Response, error) {
+func (c *Client) GetProjectSecrets(ctx context.Context, projectRef string, tree, withData bool) ([]*csapitypes.Secret, *http.Response, error) {
 	q := url.Values{}
 	if tree {
 		q.Add("tree", "")
 	}
+	if withData {
+		q.Add("withdata", "true")
+	}
 
 	secrets := []*csapitypes.Secret{}
 	resp, err := c.getParsedResponse(ctx, "GET", fmt.Sprintf("/projects/%s/secrets", url.PathEscape(projectRef)), q, jsonContent, nil, &secrets)
@@ -279,6 +514,32 @@ func (c *Client) GetProjectVariables(ctx context.Context, projectRef string, tre
 	return variables, resp, err
 }
 
+func (c *Client) GetProjectGroupResolvedVariables(ctx context.Context, projectGroupRef string, refType, branch, tag, ref string) ([]*csapitypes.ResolvedVariable, *http.Response, error) {
+	return c.getResolvedVariables(ctx, fmt.Sprintf("/projectgroups/%s/resolvedvariables", url.PathEscape(projectGroupRef)), refType, branch, tag, ref)
+}
+
+func (c *Client) GetProjectResolvedVariables(ctx context.Context, projectRef string, refType, branch, tag, ref string) ([]*csapitypes.ResolvedVariable, *http.Response, error) {
+	return c.getResolvedVariables(ctx, fmt.Sprintf("/projects/%s/resolvedvariables", url.PathEscape(projectRef)), refType, branch, tag, ref)
+}
+
+func (c *Client) getResolvedVariables(ctx context.Context, path string, refType, branch, tag, ref string) ([]*csapitypes.ResolvedVariable, *http.Response, error) {
+	q := url.Values{}
+	q.Add("ref_type", refType)
+	if branch != "" {
+		q.Add("branch", branch)
+	}
+	if tag != "" {
+		q.Add("tag", tag)
+	}
+	if ref != "" {
+		q.Add("ref", ref)
+	}
+
+	variables := []*csapitypes.ResolvedVariable{}
+	resp, err := c.getParsedResponse(ctx, "GET", path, q, jsonContent, nil, &variables)
+	return variables, resp, err
+}
+
 func (c *Client) CreateProjectGroupVariable(ctx context.Context, projectGroupRef string, variable *cstypes.Variable) (*csapitypes.Variable, *http.Response, error) {
 	pj, err := json.Marshal(variable)
 	if err != nil {
@@ -364,6 +625,18 @@ func (c *Client) GetUserByLinkedAccountRemoteUserAndSource(ctx context.Context,
 	return users[0], resp, err
 }
 
+// GetUserByRemoteUser returns the user with a linked account for the remote
+// user of the remote source
+func (c *Client) GetUserByRemoteUser(ctx context.Context, remoteSourceID, remoteUserID string) (*cstypes.User, *http.Response, error) {
+	q := url.Values{}
+	q.Add("remoteSourceId", remoteSourceID)
+	q.Add("remoteUserId", remoteUserID)
+
+	user := new(cstypes.User)
+	resp, err := c.getParsedResponse(ctx, "GET", "/users/byLinkedAccount", q, jsonContent, nil, user)
+	return user, resp, err
+}
+
 func (c *Client) GetUserByLinkedAccount(ctx context.Context, linkedAccountID string) (*cstypes.User, *http.Response, error) {
 	q := url.Values{}
 	q.Add("query_type", "bylinkedaccount")
@@ -388,6 +661,33 @@ func (c *Client) CreateUser(ctx context.Context, req *csapitypes.CreateUserReque
 	return user, resp, err
 }
 
+// CreateUserDryRun validates the user creation without saving it and returns
+// the user that would be created
+func (c *Client) CreateUserDryRun(ctx context.Context, req *csapitypes.CreateUserRequest) (*cstypes.User, *http.Response, error) {
+	reqj, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	q := url.Values{}
+	q.Add("dryRun", "true")
+
+	user := new(types.User)
+	resp, err := c.getParsedResponse(ctx, "POST", "/users", q, jsonContent, bytes.NewReader(reqj), user)
+	return user, resp, err
+}
+
+func (c *Client) ImportUsers(ctx context.Context, req []*csapitypes.CreateUserRequest) (*csapitypes.ImportUsersResponse, *http.Response, error) {
+	reqj, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iresp := new(csapitypes.ImportUsersResponse)
+	resp, err := c.getParsedResponse(ctx, "POST", "/users/import", nil, jsonContent, bytes.NewReader(reqj), iresp)
+	return iresp, resp, err
+}
+
 func (c *Client) UpdateUser(ctx context.Context, userRef string, req *csapitypes.UpdateUserRequest) (*cstypes.User, *http.Response, error) {
 	reqj, err := json.Marshal(req)
 	if err != nil {
@@ -399,10 +699,31 @@ func (c *Client) UpdateUser(ctx context.Context, userRef string, req *csapitypes
 	return user, resp, err
 }
 
+func (c *Client) PatchUser(ctx context.Context, userRef string, req *csapitypes.PatchUserRequest) (*cstypes.User, *http.Response, error) {
+	reqj, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user := new(types.User)
+	resp, err := c.getParsedResponse(ctx, "PATCH", fmt.Sprintf("/users/%s", userRef), nil, jsonContent, bytes.NewReader(reqj), user)
+	return user, resp, err
+}
+
 func (c *Client) DeleteUser(ctx context.Context, userRef string) (*http.Response, error) {
 	return c.getResponse(ctx, "DELETE", fmt.Sprintf("/users/%s", userRef), nil, jsonContent, nil)
 }
 
+func (c *Client) DeleteUserByID(ctx context.Context, userID string) (*http.Response, error) {
+	return c.getResponse(ctx, "DELETE", fmt.Sprintf("/user/%s", url.PathEscape(userID)), nil, jsonContent, nil)
+}
+
+func (c *Client) RestoreUser(ctx context.Context, userID string) (*cstypes.User, *http.Response, error) {
+	user := new(cstypes.User)
+	resp, err := c.getParsedResponse(ctx, "POST", fmt.Sprintf("/user/%s/restore", url.PathEscape(userID)), nil, jsonContent, nil, user)
+	return user, resp, err
+}
+
 func (c *Client) GetUsers(ctx context.Context, start string, limit int, asc bool) ([]*cstypes.User, *http.Response, error) {
 	q := url.Values{}
 	if start != "" {
@@ -420,6 +741,33 @@ func (c *Client) GetUsers(ctx context.Context, start string, limit int, asc bool
 	return users, resp, err
 }
 
+// UserNameAvailable reports if the user name isn't already used
+func (c *Client) UserNameAvailable(ctx context.Context, userName string) (bool, *http.Response, error) {
+	res := new(csapitypes.NameAvailabilityResponse)
+	resp, err := c.getParsedResponse(ctx, "GET", fmt.Sprintf("/users/%s/available", userName), nil, jsonContent, nil, res)
+	return res.Available, resp, err
+}
+
+func (c *Client) CountUsers(ctx context.Context, query string, includeDeleted bool) (int, *http.Response, error) {
+	q := url.Values{}
+	if query != "" {
+		q.Add("query", query)
+	}
+	if includeDeleted {
+		q.Add("includeDeleted", "true")
+	}
+
+	count := new(csapitypes.CountResponse)
+	resp, err := c.getParsedResponse(ctx, "GET", "/users/count", q, jsonContent, nil, count)
+	return count.Count, resp, err
+}
+
+func (c *Client) GetUserLinkedAccounts(ctx context.Context, userRef string) ([]*csapitypes.UserLinkedAccount, *http.Response, error) {
+	las := []*csapitypes.UserLinkedAccount{}
+	resp, err := c.getParsedResponse(ctx, "GET", fmt.Sprintf("/users/%s/linkedaccounts", url.PathEscape(userRef)), nil, jsonContent, nil, &las)
+	return las, resp, err
+}
+
 func (c *Client) CreateUserLA(ctx context.Context, userRef string, req *csapitypes.CreateUserLARequest) (*cstypes.LinkedAccount, *http.Response, error) {
 	reqj, err := json.Marshal(req)
 	if err != nil {
@@ -427,12 +775,19 @@ func (c *Client) CreateUserLA(ctx context.Context, userRef string, req *csapityp
 	}
 
 	la := new(types.LinkedAccount)
-	resp, err := c.getParsedResponse(ctx, "POST", fmt.Sprintf("/users/%s/linkedaccounts", userRef), nil, jsonContent, bytes.NewReader(reqj), la)
+	resp, err := c.getParsedResponse(ctx, "POST", fmt.Sprintf("/users/%s/linkedaccounts", url.PathEscape(userRef)), nil, jsonContent, bytes.NewReader(reqj), la)
 	return la, resp, err
 }
 
+// DeleteUserLAs deletes all the user linked accounts
+func (c *Client) DeleteUserLAs(ctx context.Context, userRef string) (*csapitypes.DeleteUserLAsResponse, *http.Response, error) {
+	res := new(csapitypes.DeleteUserLAsResponse)
+	resp, err := c.getParsedResponse(ctx, "DELETE", fmt.Sprintf("/users/%s/linkedaccounts", url.PathEscape(userRef)), nil, jsonContent, nil, res)
+	return res, resp, err
+}
+
 func (c *Client) DeleteUserLA(ctx context.Context, userRef, laID string) (*http.Response, error) {
-	return c.getResponse(ctx, "DELETE", fmt.Sprintf("/users/%s/linkedaccounts/%s", userRef, laID), nil, jsonContent, nil)
+	return c.getResponse(ctx, "DELETE", fmt.Sprintf("/users/%s/linkedaccounts/%s", url.PathEscape(userRef), url.PathEscape(laID)), nil, jsonContent, nil)
 }
 
 func (c *Client) UpdateUserLA(ctx context.Context, userRef, laID string, req *csapitypes.UpdateUserLARequest) (*cstypes.LinkedAccount, *http.Response, error) {
@@ -442,10 +797,28 @@ func (c *Client) UpdateUserLA(ctx context.Context, userRef, laID string, req *cs
 	}
 
 	la := new(types.LinkedAccount)
-	resp, err := c.getParsedResponse(ctx, "PUT", fmt.Sprintf("/users/%s/linkedaccounts/%s", userRef, laID), nil, jsonContent, bytes.NewReader(reqj), la)
+	resp, err := c.getParsedResponse(ctx, "PUT", fmt.Sprintf("/users/%s/linkedaccounts/%s", url.PathEscape(userRef), url.PathEscape(laID)), nil, jsonContent, bytes.NewReader(reqj), la)
+	return la, resp, err
+}
+
+// UpdateUserLAToken updates only the tokens of a linked account
+func (c *Client) UpdateUserLAToken(ctx context.Context, userRef, laID string, req *csapitypes.UpdateUserLATokenRequest) (*csapitypes.UserLinkedAccount, *http.Response, error) {
+	reqj, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	la := new(csapitypes.UserLinkedAccount)
+	resp, err := c.getParsedResponse(ctx, "PUT", fmt.Sprintf("/users/%s/linkedaccounts/%s/token", url.PathEscape(userRef), url.PathEscape(laID)), nil, jsonContent, bytes.NewReader(reqj), la)
 	return la, resp, err
 }
 
+func (c *Client) GetUserTokens(ctx context.Context, userRef string) ([]*csapitypes.UserToken, *http.Response, error) {
+	tokens := []*csapitypes.UserToken{}
+	resp, err := c.getParsedResponse(ctx, "GET", fmt.Sprintf("/users/%s/tokens", userRef), nil, jsonContent, nil, &tokens)
+	return tokens, resp, err
+}
+
 func (c *Client) CreateUserToken(ctx context.Context, userRef string, req *csapitypes.CreateUserTokenRequest) (*csapitypes.CreateUserTokenResponse, *http.Response, error) {
 	reqj, err := json.Marshal(req)
 	if err != nil {
@@ -457,6 +830,19 @@ func (c *Client) CreateUserToken(ctx context.Context, userRef string, req *csapi
 	return tresp, resp, err
 }
 
+// IntrospectUserToken returns the user owning the token, the token scopes and
+// expiration time
+func (c *Client) IntrospectUserToken(ctx context.Context, token string) (*csapitypes.UserTokenIntrospection, *http.Response, error) {
+	reqj, err := json.Marshal(&csapitypes.IntrospectUserTokenRequest{Token: token})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	introspection := new(csapitypes.UserTokenIntrospection)
+	resp, err := c.getParsedResponse(ctx, "POST", "/auth/token/introspect", nil, jsonContent, bytes.NewReader(reqj), introspection)
+	return introspection, resp, err
+}
+
 func (c *Client) DeleteUserToken(ctx context.Context, userRef, tokenName string) (*http.Response, error) {
 	return c.getResponse(ctx, "DELETE", fmt.Sprintf("/users/%s/tokens/%s", userRef, tokenName), nil, jsonContent, nil)
 }
@@ -467,6 +853,27 @@ func (c *Client) GetUserOrgs(ctx context.Context, userRef string) ([]*csapitypes
 	return userOrgs, resp, err
 }
 
+func (c *Client) GetUserProjects(ctx context.Context, userRef string, start string, limit int, asc bool) ([]*csapitypes.Project, *http.Response, error) {
+	return c.getOwnerProjects(ctx, fmt.Sprintf("/users/%s/projects", userRef), start, limit, asc)
+}
+
+func (c *Client) getOwnerProjects(ctx context.Context, path string, start string, limit int, asc bool) ([]*csapitypes.Project, *http.Response, error) {
+	q := url.Values{}
+	if start != "" {
+		q.Add("start", start)
+	}
+	if limit > 0 {
+		q.Add("limit", strconv.Itoa(limit))
+	}
+	if asc {
+		q.Add("asc", "")
+	}
+
+	projects := []*csapitypes.Project{}
+	resp, err := c.getParsedResponse(ctx, "GET", path, q, jsonContent, nil, &projects)
+	return projects, resp, err
+}
+
 func (c *Client) GetRemoteSource(ctx context.Context, rsRef string) (*cstypes.RemoteSource, *http.Response, error) {
 	rs := new(types.RemoteSource)
 	resp, err := c.getParsedResponse(ctx, "GET", fmt.Sprintf("/remotesources/%s", rsRef), nil, jsonContent, nil, rs)
@@ -490,6 +897,18 @@ func (c *Client) GetRemoteSources(ctx context.Context, start string, limit int,
 	return rss, resp, err
 }
 
+func (c *Client) Search(ctx context.Context, term string, limit int) (*csapitypes.SearchResponse, *http.Response, error) {
+	q := url.Values{}
+	q.Add("q", term)
+	if limit > 0 {
+		q.Add("limit", strconv.Itoa(limit))
+	}
+
+	res := &csapitypes.SearchResponse{}
+	resp, err := c.getParsedResponse(ctx, "GET", "/search", q, jsonContent, nil, res)
+	return res, resp, err
+}
+
 func (c *Client) CreateRemoteSource(ctx context.Context, rs *cstypes.RemoteSource) (*types.RemoteSource, *http.Response, error) {
 	rsj, err := json.Marshal(rs)
 	if err != nil {
@@ -501,6 +920,22 @@ func (c *Client) CreateRemoteSource(ctx context.Context, rs *cstypes.RemoteSourc
 	return rs, resp, err
 }
 
+// CreateRemoteSourceValidated creates the remote source only if its api url
+// is reachable
+func (c *Client) CreateRemoteSourceValidated(ctx context.Context, rs *cstypes.RemoteSource) (*types.RemoteSource, *http.Response, error) {
+	rsj, err := json.Marshal(rs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	q := url.Values{}
+	q.Add("validate", "true")
+
+	rs = new(types.RemoteSource)
+	resp, err := c.getParsedResponse(ctx, "POST", "/remotesources", q, jsonContent, bytes.NewReader(rsj), rs)
+	return rs, resp, err
+}
+
 func (c *Client) UpdateRemoteSource(ctx context.Context, remoteSourceRef string, remoteSource *cstypes.RemoteSource) (*types.RemoteSource, *http.Response, error) {
 	rsj, err := json.Marshal(remoteSource)
 	if err != nil {
@@ -512,10 +947,102 @@ func (c *Client) UpdateRemoteSource(ctx context.Context, remoteSourceRef string,
 	return resRemoteSource, resp, err
 }
 
+func (c *Client) PatchRemoteSource(ctx context.Context, remoteSourceRef string, req *csapitypes.PatchRemoteSourceRequest) (*types.RemoteSource, *http.Response, error) {
+	reqj, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remoteSource := new(types.RemoteSource)
+	resp, err := c.getParsedResponse(ctx, "PATCH", fmt.Sprintf("/remotesources/%s", url.PathEscape(remoteSourceRef)), nil, jsonContent, bytes.NewReader(reqj), remoteSource)
+	return remoteSource, resp, err
+}
+
+func (c *Client) RotateRemoteSourceSecret(ctx context.Context, remoteSourceRef string, req *csapitypes.RotateRemoteSourceSecretRequest) (*types.RemoteSource, *http.Response, error) {
+	reqj, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remoteSource := new(types.RemoteSource)
+	resp, err := c.getParsedResponse(ctx, "POST", fmt.Sprintf("/remotesources/%s/rotatesecret", url.PathEscape(remoteSourceRef)), nil, jsonContent, bytes.NewReader(reqj), remoteSource)
+	return remoteSource, resp, err
+}
+
+func (c *Client) GetGithubAppInstallationToken(ctx context.Context, rsRef string) (*csapitypes.GithubAppInstallationTokenResponse, *http.Response, error) {
+	token := new(csapitypes.GithubAppInstallationTokenResponse)
+	resp, err := c.getParsedResponse(ctx, "GET", fmt.Sprintf("/remotesources/%s/installationtoken", url.PathEscape(rsRef)), nil, jsonContent, nil, token)
+	return token, resp, err
+}
+
+func (c *Client) TestRemoteSource(ctx context.Context, rsRef string) (*csapitypes.TestRemoteSourceResponse, *http.Response, error) {
+	res := new(csapitypes.TestRemoteSourceResponse)
+	resp, err := c.getParsedResponse(ctx, "POST", fmt.Sprintf("/remotesources/%s/test", url.PathEscape(rsRef)), nil, jsonContent, nil, res)
+	return res, resp, err
+}
+
 func (c *Client) DeleteRemoteSource(ctx context.Context, rsRef string) (*http.Response, error) {
 	return c.getResponse(ctx, "DELETE", fmt.Sprintf("/remotesources/%s", rsRef), nil, jsonContent, nil)
 }
 
+// GetAuditEntries returns the audit entries in the [since, until) time range
+// done by actor. Zero since, until and empty actor aren't used as filters.
+func (c *Client) GetAuditEntries(ctx context.Context, since, until time.Time, actor string, limit int, asc bool) ([]*cstypes.AuditEntry, *http.Response, error) {
+	q := url.Values{}
+	if !since.IsZero() {
+		q.Add("since", since.Format(time.RFC3339Nano))
+	}
+	if !until.IsZero() {
+		q.Add("until", until.Format(time.RFC3339Nano))
+	}
+	if actor != "" {
+		q.Add("actor", actor)
+	}
+	if limit > 0 {
+		q.Add("limit", strconv.Itoa(limit))
+	}
+	if asc {
+		q.Add("asc", "")
+	}
+
+	return c.getAuditEntries(ctx, q)
+}
+
+// GetResourceAuditEntries returns the audit entries of the resource with the
+// provided type and id in the [since, until) time range, starting after the
+// audit entry with id start. Zero since, until and empty resourceType, start
+// aren't used as filters.
+func (c *Client) GetResourceAuditEntries(ctx context.Context, resourceType cstypes.ConfigType, resourceID string, since, until time.Time, start string, limit int, asc bool) ([]*cstypes.AuditEntry, *http.Response, error) {
+	q := url.Values{}
+	q.Add("resourceId", resourceID)
+	if resourceType != "" {
+		q.Add("resourceType", string(resourceType))
+	}
+	if !since.IsZero() {
+		q.Add("since", since.Format(time.RFC3339Nano))
+	}
+	if !until.IsZero() {
+		q.Add("until", until.Format(time.RFC3339Nano))
+	}
+	if start != "" {
+		q.Add("start", start)
+	}
+	if limit > 0 {
+		q.Add("limit", strconv.Itoa(limit))
+	}
+	if asc {
+		q.Add("asc", "")
+	}
+
+	return c.getAuditEntries(ctx, q)
+}
+
+func (c *Client) getAuditEntries(ctx context.Context, q url.Values) ([]*cstypes.AuditEntry, *http.Response, error) {
+	entries := []*cstypes.AuditEntry{}
+	resp, err := c.getParsedResponse(ctx, "GET", "/audit", q, jsonContent, nil, &entries)
+	return entries, resp, err
+}
+
 func (c *Client) CreateOrg(ctx context.Context, org *cstypes.Organization) (*types.Organization, *http.Response, error) {
 	oj, err := json.Marshal(org)
 	if err != nil {
@@ -577,3 +1104,86 @@ func (c *Client) GetOrgMembers(ctx context.Context, orgRef string) ([]*csapitype
 	resp, err := c.getParsedResponse(ctx, "GET", fmt.Sprintf("/orgs/%s/members", orgRef), nil, jsonContent, nil, &orgMembers)
 	return orgMembers, resp, err
 }
+
+func (c *Client) GetOrgProjects(ctx context.Context, orgRef string, start string, limit int, asc bool) ([]*csapitypes.Project, *http.Response, error) {
+	return c.getOwnerProjects(ctx, fmt.Sprintf("/orgs/%s/projects", orgRef), start, limit, asc)
+}
+
+func (c *Client) Checkpoint(ctx context.Context) (*http.Response, error) {
+	return c.getResponse(ctx, "POST", "/checkpoint", nil, jsonContent, nil)
+}
+
+// ExportResources returns the newline delimited json export of the
+// configstore resources. The caller must close the returned reader.
+func (c *Client) ExportResources(ctx context.Context) (io.ReadCloser, *http.Response, error) {
+	resp, err := c.getResponse(ctx, "GET", "/admin/export", nil, nil, nil)
+	if err != nil {
+		return nil, resp, err
+	}
+	return resp.Body, resp, nil
+}
+
+// GetEvents opens the server-sent events stream of the changes of the
+// resources of the provided types, or of all the types if empty. The stream
+// must be closed by the caller.
+func (c *Client) GetEvents(ctx context.Context, configTypes []cstypes.ConfigType) (io.ReadCloser, *http.Response, error) {
+	q := url.Values{}
+	for _, t := range configTypes {
+		q.Add("type", string(t))
+	}
+	resp, err := c.getResponse(ctx, "GET", "/events", q, http.Header{"Accept": []string{"text/event-stream"}}, nil)
+	if err != nil {
+		return nil, resp, err
+	}
+	return resp.Body, resp, nil
+}
+
+// ImportResources imports the resources export read from r in an empty
+// configstore
+func (c *Client) ImportResources(ctx context.Context, r io.Reader) (*http.Response, error) {
+	return c.getResponse(ctx, "POST", "/admin/import", nil, http.Header{"Content-Type": []string{"application/x-ndjson"}}, r)
+}
+
+func (c *Client) GetLogLevel(ctx context.Context) (*csapitypes.LogLevel, *http.Response, error) {
+	logLevel := new(csapitypes.LogLevel)
+	resp, err := c.getParsedResponse(ctx, "GET", "/admin/loglevel", nil, jsonContent, nil, logLevel)
+	return logLevel, resp, err
+}
+
+func (c *Client) SetLogLevel(ctx context.Context, level string) (*csapitypes.LogLevel, *http.Response, error) {
+	lj, err := json.Marshal(&csapitypes.LogLevel{Level: level})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logLevel := new(csapitypes.LogLevel)
+	resp, err := c.getParsedResponse(ctx, "PUT", "/admin/loglevel", nil, jsonContent, bytes.NewReader(lj), logLevel)
+	return logLevel, resp, err
+}
+
+// SetReadOnly enables or disables the configstore read only mode
+func (c *Client) SetReadOnly(ctx context.Context, enabled bool) (*http.Response, error) {
+	method := "DELETE"
+	if enabled {
+		method = "PUT"
+	}
+	return c.getResponse(ctx, method, "/admin/readonly", nil, jsonContent, nil)
+}
+
+func (c *Client) SelfCheck(ctx context.Context) (*csapitypes.SelfCheckResponse, *http.Response, error) {
+	res := new(csapitypes.SelfCheckResponse)
+	resp, err := c.getParsedResponse(ctx, "GET", "/admin/selfcheck", nil, jsonContent, nil, res)
+	return res, resp, err
+}
+
+func (c *Client) RepairSelfCheck(ctx context.Context) (*csapitypes.SelfCheckResponse, *http.Response, error) {
+	res := new(csapitypes.SelfCheckResponse)
+	resp, err := c.getParsedResponse(ctx, "POST", "/admin/selfcheck/repair", nil, jsonContent, nil, res)
+	return res, resp, err
+}
+
+func (c *Client) GetVersion(ctx context.Context) (*csapitypes.VersionResponse, *http.Response, error) {
+	res := new(csapitypes.VersionResponse)
+	resp, err := c.getParsedResponse(ctx, "GET", "/version", nil, jsonContent, nil, res)
+	return res, resp, err
+}
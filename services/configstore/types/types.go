@@ -15,8 +15,12 @@
 package types
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"agola.io/agola/services/types"
@@ -36,6 +40,9 @@ const (
 	ConfigTypeRemoteSource ConfigType = "remotesource"
 	ConfigTypeSecret       ConfigType = "secret"
 	ConfigTypeVariable     ConfigType = "variable"
+	ConfigTypeAuditEntry   ConfigType = "auditentry"
+
+	ConfigTypeDeletedResource ConfigType = "deletedresource"
 )
 
 type Visibility string
@@ -95,10 +102,113 @@ type User struct {
 	// Optional local auth
 	Password string `json:"password,omitempty"`
 
+	// Tokens contains the hashes of the tokens by token name (see HashToken).
+	// Tokens created by older versions are saved as plain values
 	Tokens map[string]string `json:"tokens,omitempty"`
+	// TokensCreationTime contains the creation time of the tokens by token name
+	TokensCreationTime map[string]time.Time `json:"tokens_creation_time,omitempty"`
+	// TokensScopes contains the scopes of the tokens by token name. A token
+	// without scopes is a read only token
+	TokensScopes map[string][]TokenScope `json:"tokens_scopes,omitempty"`
+	// TokensExpirationTime contains the expiration time of the tokens by token
+	// name. A token without an expiration time never expires
+	TokensExpirationTime map[string]time.Time `json:"tokens_expiration_time,omitempty"`
 
 	// Admin defines if the user is a global admin
 	Admin bool `json:"admin,omitempty"`
+
+	// DeletionTime is the time the user was soft deleted. It's set only on
+	// soft deleted users
+	DeletionTime *time.Time `json:"deletion_time,omitempty"`
+}
+
+// TokenExpired reports if the user token is expired at the provided time
+func (u *User) TokenExpired(tokenName string, now time.Time) bool {
+	expirationTime, ok := u.TokensExpirationTime[tokenName]
+	return ok && !now.Before(expirationTime)
+}
+
+// TokenName returns the name of the user token with the provided value
+func (u *User) TokenName(token string) (string, bool) {
+	tokenHash := HashToken(token)
+	for tokenName, savedToken := range u.Tokens {
+		if subtle.ConstantTimeCompare([]byte(TokenHash(savedToken)), []byte(tokenHash)) == 1 {
+			return tokenName, true
+		}
+	}
+	return "", false
+}
+
+// TokenScopes returns the scopes granted to the user token. The admin scope is
+// removed if the user isn't an admin anymore and a token without scopes is a
+// read only token.
+func (u *User) TokenScopes(tokenName string) []TokenScope {
+	scopes := []TokenScope{}
+	for _, scope := range u.TokensScopes[tokenName] {
+		if scope == TokenScopeAdmin && !u.Admin {
+			continue
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		scopes = []TokenScope{TokenScopeRead}
+	}
+	return scopes
+}
+
+const tokenHashPrefix = "sha256:"
+
+// HashToken returns the hash of a user token value. Only the token hashes are
+// saved so the token values cannot be retrieved from the stored users.
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return tokenHashPrefix + hex.EncodeToString(h[:])
+}
+
+// TokenHash returns the hash of a saved user token, hashing it if it's a plain
+// token value saved by an older version
+func TokenHash(savedToken string) string {
+	if strings.HasPrefix(savedToken, tokenHashPrefix) {
+		return savedToken
+	}
+	return HashToken(savedToken)
+}
+
+// TokenScope defines the configstore api operations allowed to a user token
+type TokenScope string
+
+const (
+	// TokenScopeRead allows only read operations
+	TokenScopeRead TokenScope = "read"
+	// TokenScopeWrite allows read and write operations on all the configstore
+	// resources
+	TokenScopeWrite TokenScope = "write"
+	// TokenScopeAdmin allows all the operations, including the administrative
+	// ones (maintenance, export, import, checkpoint, audit). Only global admin
+	// users can have admin tokens
+	TokenScopeAdmin TokenScope = "admin"
+)
+
+func IsValidTokenScope(s TokenScope) bool {
+	switch s {
+	case TokenScopeRead, TokenScopeWrite, TokenScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// TokenScopeIncludes reports if the scope allows the operations of the
+// required scope
+func TokenScopeIncludes(s, required TokenScope) bool {
+	switch s {
+	case TokenScopeAdmin:
+		return true
+	case TokenScopeWrite:
+		return required == TokenScopeWrite || required == TokenScopeRead
+	case TokenScopeRead:
+		return required == TokenScopeRead
+	}
+	return false
 }
 
 type Organization struct {
@@ -141,6 +251,60 @@ type ProjectGroup struct {
 	Visibility Visibility `json:"visibility,omitempty"`
 }
 
+// AuditEntry records a mutating operation done on a configstore resource
+type AuditEntry struct {
+	// The type version. Increase when a breaking change is done. Usually not
+	// needed when adding fields.
+	Version string `json:"version,omitempty"`
+
+	ID string `json:"id,omitempty"`
+
+	Time time.Time `json:"time,omitempty"`
+	// Actor is the user that requested the operation. Empty when unknown
+	// (i.e. for operations not requested through the gateway)
+	Actor     string `json:"actor,omitempty"`
+	Operation string `json:"operation,omitempty"`
+
+	ResourceType ConfigType `json:"resource_type,omitempty"`
+	ResourceID   string     `json:"resource_id,omitempty"`
+	// Deleted reports if the resource was deleted by the operation
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// DeletedResource is a soft deleted resource. It can be restored until its
+// retention time has passed, then it's permanently removed
+type DeletedResource struct {
+	// The type version. Increase when a breaking change is done. Usually not
+	// needed when adding fields.
+	Version string `json:"version,omitempty"`
+
+	// ID is the id of the deleted resource
+	ID string `json:"id,omitempty"`
+
+	ResourceType ConfigType `json:"resource_type,omitempty"`
+	DeletionTime time.Time  `json:"deletion_time,omitempty"`
+
+	// Data is the resource data, with its DeletionTime set
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// ExportVersion is the version of the resources export format
+const ExportVersion = 1
+
+// ExportHeader is the first line of a resources export
+type ExportHeader struct {
+	Version int `json:"version"`
+	// Revision is the revision of the exported snapshot
+	Revision int64 `json:"revision"`
+}
+
+// ExportRecord is an exported resource. The resources export is a newline
+// delimited json stream of an ExportHeader followed by the ExportRecords.
+type ExportRecord struct {
+	Type ConfigType      `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
 type RemoteSourceType string
 
 const (
@@ -154,6 +318,11 @@ type RemoteSourceAuthType string
 const (
 	RemoteSourceAuthTypePassword RemoteSourceAuthType = "password"
 	RemoteSourceAuthTypeOauth2   RemoteSourceAuthType = "oauth2"
+	// RemoteSourceAuthTypeGithubApp authenticates as a github app installation
+	RemoteSourceAuthTypeGithubApp RemoteSourceAuthType = "github_app"
+	// RemoteSourceAuthTypeToken authenticates the users with a personal access
+	// token created by them on the remote source
+	RemoteSourceAuthTypeToken RemoteSourceAuthType = "token"
 )
 
 type RemoteSource struct {
@@ -175,12 +344,28 @@ type RemoteSource struct {
 	Oauth2ClientID     string `json:"client_id,omitempty"`
 	Oauth2ClientSecret string `json:"client_secret,omitempty"`
 
+	// GitHub App data
+	GithubAppID             int64 `json:"github_app_id,omitempty"`
+	GithubAppInstallationID int64 `json:"github_app_installation_id,omitempty"`
+	// GithubAppPrivateKey is the PEM encoded app private key
+	GithubAppPrivateKey string `json:"github_app_private_key,omitempty"`
+	// GithubAppPrivateKeyEncrypted reports if the private key is encrypted
+	// with the configstore secrets key
+	GithubAppPrivateKeyEncrypted bool `json:"github_app_private_key_encrypted,omitempty"`
+
 	SSHHostKey string `json:"ssh_host_key,omitempty"` // Public ssh host key of the remote source
 
 	SkipSSHHostKeyCheck bool `json:"skip_ssh_host_key_check,omitempty"`
 
 	RegistrationEnabled *bool `json:"registration_enabled,omitempty"`
 	LoginEnabled        *bool `json:"login_enabled,omitempty"`
+
+	// APIRateLimit is the maximum number of api requests per hour to the
+	// remote source, 0 means no limit
+	APIRateLimit int `json:"api_rate_limit,omitempty"`
+	// MaxConcurrency is the maximum number of concurrent api requests to the
+	// remote source, 0 means no limit
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
 }
 
 func (rs *RemoteSource) UnmarshalJSON(b []byte) error {
@@ -202,12 +387,20 @@ func (rs *RemoteSource) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+func IsValidRemoteSourceType(t RemoteSourceType) bool {
+	switch t {
+	case RemoteSourceTypeGitea, RemoteSourceTypeGithub, RemoteSourceTypeGitlab:
+		return true
+	}
+	return false
+}
+
 func SourceSupportedAuthTypes(rsType RemoteSourceType) []RemoteSourceAuthType {
 	switch rsType {
 	case RemoteSourceTypeGitea:
-		return []RemoteSourceAuthType{RemoteSourceAuthTypeOauth2, RemoteSourceAuthTypePassword}
+		return []RemoteSourceAuthType{RemoteSourceAuthTypeOauth2, RemoteSourceAuthTypePassword, RemoteSourceAuthTypeToken}
 	case RemoteSourceTypeGithub:
-		fallthrough
+		return []RemoteSourceAuthType{RemoteSourceAuthTypeOauth2, RemoteSourceAuthTypeGithubApp}
 	case RemoteSourceTypeGitlab:
 		return []RemoteSourceAuthType{RemoteSourceAuthTypeOauth2}
 
@@ -243,7 +436,28 @@ type LinkedAccount struct {
 
 	Oauth2AccessToken          string    `json:"oauth2_access_token,omitempty"`
 	Oauth2RefreshToken         string    `json:"oauth2_refresh_token,omitempty"`
-	Oauth2AccessTokenExpiresAt time.Time `json:"oauth_2_access_token_expires_at,omitempty"`
+	Oauth2AccessTokenExpiresAt time.Time `json:"oauth2_access_token_expires_at,omitempty"`
+}
+
+func (la *LinkedAccount) UnmarshalJSON(b []byte) error {
+	type linkedAccount LinkedAccount
+
+	// the oauth2 access token expiration was saved by older versions with the
+	// oauth_2_access_token_expires_at field name
+	tla := struct {
+		*linkedAccount
+		OldOauth2AccessTokenExpiresAt *time.Time `json:"oauth_2_access_token_expires_at,omitempty"`
+	}{linkedAccount: (*linkedAccount)(la)}
+
+	if err := json.Unmarshal(b, &tla); err != nil {
+		return err
+	}
+
+	if tla.OldOauth2AccessTokenExpiresAt != nil && la.Oauth2AccessTokenExpiresAt.IsZero() {
+		la.Oauth2AccessTokenExpiresAt = *tla.OldOauth2AccessTokenExpiresAt
+	}
+
+	return nil
 }
 
 // RemoteRepositoryConfigType defines how a remote repository is configured and
@@ -309,6 +523,21 @@ type Project struct {
 	WebhookSecret string `json:"webhook_secret,omitempty"`
 
 	PassVarsToForkedPR bool `json:"pass_vars_to_forked_pr,omitempty"`
+
+	// ConfigPath is the path of the run config file relative to the repository
+	// root. When empty the default config files in the .agola dir are used
+	ConfigPath string `json:"config_path,omitempty"`
+
+	// DefaultBranch overrides the default branch of the remote repository
+	DefaultBranch string `json:"default_branch,omitempty"`
+
+	// Labels are arbitrary key/value metadata used by external tools and to
+	// filter the projects
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// DeletionTime is the time the project was soft deleted. It's set only on
+	// soft deleted projects
+	DeletionTime *time.Time `json:"deletion_time,omitempty"`
 }
 
 type SecretType string
@@ -336,6 +565,8 @@ type Secret struct {
 
 	// internal secret
 	Data map[string]string `json:"data,omitempty"`
+	// DataEncrypted reports if the Data values are encrypted
+	DataEncrypted bool `json:"data_encrypted,omitempty"`
 
 	// external secret
 	SecretProviderID string `json:"secret_provider_id,omitempty"`
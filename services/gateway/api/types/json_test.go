@@ -0,0 +1,143 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"agola.io/agola/internal/util"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+// jsonFieldNameRegexp is the format of the json field names, every word
+// starts with a letter (i.e. oauth2 and not oauth_2)
+var jsonFieldNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9]*(_[a-z][a-z0-9]*)*$`)
+
+// jsonRequests are the requests whose json field names are pinned by the
+// golden files in testdata
+func jsonRequests() map[string]interface{} {
+	return map[string]interface{}{
+		"create_remote_source_request": &CreateRemoteSourceRequest{
+			Name:                    "rs01",
+			APIURL:                  "https://api.github.com",
+			Type:                    "github",
+			AuthType:                "oauth2",
+			SkipVerify:              true,
+			Oauth2ClientID:          "clientid",
+			Oauth2ClientSecret:      "clientsecret",
+			SSHHostKey:              "sshhostkey",
+			SkipSSHHostKeyCheck:     true,
+			RegistrationEnabled:     util.BoolP(false),
+			LoginEnabled:            util.BoolP(true),
+			GithubAppID:             1,
+			GithubAppInstallationID: 2,
+			GithubAppPrivateKey:     "privatekey",
+		},
+		"update_remote_source_request": &UpdateRemoteSourceRequest{
+			Name:                util.StringP("rs01"),
+			APIURL:              util.StringP("https://api.github.com"),
+			SkipVerify:          util.BoolP(true),
+			Oauth2ClientID:      util.StringP("clientid"),
+			Oauth2ClientSecret:  util.StringP("clientsecret"),
+			SSHHostKey:          util.StringP("sshhostkey"),
+			SkipSSHHostKeyCheck: util.BoolP(true),
+			RegistrationEnabled: util.BoolP(false),
+			LoginEnabled:        util.BoolP(true),
+		},
+	}
+}
+
+func TestJSONGolden(t *testing.T) {
+	for name, req := range jsonRequests() {
+		name, req := name, req
+		t.Run(name, func(t *testing.T) {
+			data, err := json.MarshalIndent(req, "", "  ")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			data = append(data, '\n')
+
+			golden := filepath.Join("testdata", name+".golden.json")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, data, 0644); err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if !bytes.Equal(expected, data) {
+				t.Fatalf("json mismatch, expected:\n%s\ngot:\n%s", expected, data)
+			}
+		})
+	}
+}
+
+func TestJSONFieldNames(t *testing.T) {
+	for name, req := range jsonRequests() {
+		name, req := name, req
+		t.Run(name, func(t *testing.T) {
+			typ := reflect.TypeOf(req).Elem()
+			for i := 0; i < typ.NumField(); i++ {
+				f := typ.Field(i)
+				tag := strings.Split(f.Tag.Get("json"), ",")[0]
+				if !jsonFieldNameRegexp.MatchString(tag) {
+					t.Errorf("%s.%s: json field name %q isn't snake case", typ.Name(), f.Name, tag)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoteSourceRequestsOldOauth2Client(t *testing.T) {
+	// requests sent by older clients
+	data := []byte(`{"name": "rs01", "oauth_2_client_id": "clientid", "oauth_2_client_secret": "clientsecret"}`)
+
+	var createReq *CreateRemoteSourceRequest
+	if err := json.Unmarshal(data, &createReq); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if createReq.Name != "rs01" || createReq.Oauth2ClientID != "clientid" || createReq.Oauth2ClientSecret != "clientsecret" {
+		t.Fatalf("unexpected create request: %+v", createReq)
+	}
+
+	var updateReq *UpdateRemoteSourceRequest
+	if err := json.Unmarshal(data, &updateReq); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if *updateReq.Name != "rs01" || *updateReq.Oauth2ClientID != "clientid" || *updateReq.Oauth2ClientSecret != "clientsecret" {
+		t.Fatalf("unexpected update request: %+v", updateReq)
+	}
+
+	// the new field names take precedence
+	data = []byte(`{"oauth_2_client_id": "oldclientid", "oauth2_client_id": "clientid"}`)
+	createReq = nil
+	if err := json.Unmarshal(data, &createReq); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if createReq.Oauth2ClientID != "clientid" {
+		t.Fatalf("expected client id %q, got %q", "clientid", createReq.Oauth2ClientID)
+	}
+}
@@ -22,6 +22,7 @@ type CreateProjectRequest struct {
 	RemoteSourceName    string     `json:"remote_source_name,omitempty"`
 	SkipSSHHostKeyCheck bool       `json:"skip_ssh_host_key_check,omitempty"`
 	PassVarsToForkedPR  bool       `json:"pass_vars_to_forked_pr,omitempty"`
+	ValidateConfig      bool       `json:"validate_config,omitempty"`
 }
 
 type UpdateProjectRequest struct {
@@ -14,32 +14,94 @@
 
 package types
 
+import "encoding/json"
+
 type CreateRemoteSourceRequest struct {
 	Name                string `json:"name"`
 	APIURL              string `json:"apiurl"`
 	Type                string `json:"type"`
 	AuthType            string `json:"auth_type"`
 	SkipVerify          bool   `json:"skip_verify"`
-	Oauth2ClientID      string `json:"oauth_2_client_id"`
-	Oauth2ClientSecret  string `json:"oauth_2_client_secret"`
+	Oauth2ClientID      string `json:"oauth2_client_id"`
+	Oauth2ClientSecret  string `json:"oauth2_client_secret"`
 	SSHHostKey          string `json:"ssh_host_key"`
 	SkipSSHHostKeyCheck bool   `json:"skip_ssh_host_key_check"`
 	RegistrationEnabled *bool  `json:"registration_enabled"`
 	LoginEnabled        *bool  `json:"login_enabled"`
+
+	GithubAppID             int64  `json:"github_app_id"`
+	GithubAppInstallationID int64  `json:"github_app_installation_id"`
+	GithubAppPrivateKey     string `json:"github_app_private_key"`
 }
 
 type UpdateRemoteSourceRequest struct {
 	Name                *string `json:"name"`
 	APIURL              *string `json:"apiurl"`
 	SkipVerify          *bool   `json:"skip_verify"`
-	Oauth2ClientID      *string `json:"oauth_2_client_id"`
-	Oauth2ClientSecret  *string `json:"oauth_2_client_secret"`
+	Oauth2ClientID      *string `json:"oauth2_client_id"`
+	Oauth2ClientSecret  *string `json:"oauth2_client_secret"`
 	SSHHostKey          *string `json:"ssh_host_key"`
 	SkipSSHHostKeyCheck *bool   `json:"skip_ssh_host_key_check"`
 	RegistrationEnabled *bool   `json:"registration_enabled"`
 	LoginEnabled        *bool   `json:"login_enabled"`
 }
 
+func (r *CreateRemoteSourceRequest) UnmarshalJSON(b []byte) error {
+	type createRemoteSourceRequest CreateRemoteSourceRequest
+	if err := json.Unmarshal(b, (*createRemoteSourceRequest)(r)); err != nil {
+		return err
+	}
+
+	old, err := unmarshalOldOauth2Client(b)
+	if err != nil {
+		return err
+	}
+	if old.Oauth2ClientID != nil && r.Oauth2ClientID == "" {
+		r.Oauth2ClientID = *old.Oauth2ClientID
+	}
+	if old.Oauth2ClientSecret != nil && r.Oauth2ClientSecret == "" {
+		r.Oauth2ClientSecret = *old.Oauth2ClientSecret
+	}
+	return nil
+}
+
+func (r *UpdateRemoteSourceRequest) UnmarshalJSON(b []byte) error {
+	type updateRemoteSourceRequest UpdateRemoteSourceRequest
+	if err := json.Unmarshal(b, (*updateRemoteSourceRequest)(r)); err != nil {
+		return err
+	}
+
+	old, err := unmarshalOldOauth2Client(b)
+	if err != nil {
+		return err
+	}
+	if r.Oauth2ClientID == nil {
+		r.Oauth2ClientID = old.Oauth2ClientID
+	}
+	if r.Oauth2ClientSecret == nil {
+		r.Oauth2ClientSecret = old.Oauth2ClientSecret
+	}
+	return nil
+}
+
+// oldOauth2Client are the oauth2 client fields with the names sent by older
+// clients
+type oldOauth2Client struct {
+	Oauth2ClientID     *string `json:"oauth_2_client_id"`
+	Oauth2ClientSecret *string `json:"oauth_2_client_secret"`
+}
+
+func unmarshalOldOauth2Client(b []byte) (*oldOauth2Client, error) {
+	var old *oldOauth2Client
+	if err := json.Unmarshal(b, &old); err != nil {
+		return nil, err
+	}
+	if old == nil {
+		old = &oldOauth2Client{}
+	}
+	return old, nil
+}
+
 type RemoteSourceResponse struct {
 	ID                  string `json:"id"`
 	Name                string `json:"name"`